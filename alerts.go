@@ -0,0 +1,865 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/metrics"
+	"github.com/VazRibeiro/evabot-backend/internal/plugin"
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+)
+
+// alertRulesBucket holds one alertRule per key, by name.
+const alertRulesBucket = "ALERT_RULES"
+
+// Rule kinds.
+const (
+	ruleThreshold = "threshold" // a field compared with a value
+	ruleRate      = "rate"      // a field's change per second over a window, compared with a value
+	ruleAbsence   = "absence"   // no message on a subject
+)
+
+// Alert states. Only firing and resolved are published and notified;
+// pending is a condition that hasn't held for the rule's For yet.
+const (
+	alertPending  = "pending"
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// maxAlertHistory bounds the resolved alerts kept for GET /api/alerts.
+const maxAlertHistory = 500
+
+// A notification is tried notifyAttempts times, waiting notifyBackoff and
+// then twice as long after each failure, unless the channel says retrying
+// is pointless (plugin.Permanent).
+const (
+	notifyAttempts = 5
+	notifyBackoff  = 2 * time.Second
+	notifyTimeout  = 10 * time.Second
+)
+
+// maxDeliveries bounds the delivery log kept for GET /api/alerts/deliveries.
+const maxDeliveries = 500
+
+// alertRule is a condition on live telemetry, e.g. battery_v < 11 held
+// for 30s:
+//
+//	{"kind":"threshold","subject":"telemetry.*.battery","field":"battery_v","op":"<","value":11,"for":"30s"}
+//
+// A rate rule compares the field's change per second over Window (default
+// 10s) instead of the field; an absence rule fires when a subject it matches
+// has been quiet for For, and needs no field. Each subject matching a rule
+// is a series of its own, so one rule alerts per robot.
+type alertRule struct {
+	Name     string    `json:"name"`
+	Kind     string    `json:"kind"`
+	Subject  string    `json:"subject"`
+	Field    string    `json:"field,omitempty"`
+	Op       string    `json:"op,omitempty"`
+	Value    float64   `json:"value"`
+	For      string    `json:"for,omitempty"`
+	Window   string    `json:"window,omitempty"`
+	Severity string    `json:"severity"`
+	Notify   []string  `json:"notify,omitempty"` // ALERT_CHANNELS names
+	Disabled bool      `json:"disabled,omitempty"`
+	Updated  time.Time `json:"updated"`
+	By       string    `json:"by,omitempty"`
+
+	hold, window time.Duration
+}
+
+var alertSeverities = map[string]bool{"info": true, "warning": true, "critical": true}
+
+// compile checks r and parses its durations.
+func (r *alertRule) compile(channels map[string]plugin.Notifier) error {
+	if !strings.HasPrefix(r.Subject, "telemetry.") {
+		return errors.New("subject must be a telemetry.… pattern")
+	}
+	if r.Severity == "" {
+		r.Severity = "warning"
+	}
+	if !alertSeverities[r.Severity] {
+		return errors.New("severity must be info, warning or critical")
+	}
+	var err error
+	if r.For != "" {
+		if r.hold, err = time.ParseDuration(r.For); err != nil || r.hold < 0 {
+			return fmt.Errorf("bad for %q", r.For)
+		}
+	}
+	switch r.Kind {
+	case ruleThreshold, ruleRate:
+		if r.Field == "" {
+			return errors.New(r.Kind + " rules need a field")
+		}
+		if _, ok := compareOps[r.Op]; !ok {
+			return errors.New("op must be one of < <= > >= == !=")
+		}
+		if r.Kind == ruleRate {
+			r.window = 10 * time.Second
+			if r.Window != "" {
+				if r.window, err = time.ParseDuration(r.Window); err != nil || r.window <= 0 {
+					return fmt.Errorf("bad window %q", r.Window)
+				}
+			}
+		}
+	case ruleAbsence:
+		if r.hold <= 0 {
+			return errors.New("absence rules need a for")
+		}
+	default:
+		return errors.New("kind must be threshold, rate or absence")
+	}
+	for _, c := range r.Notify {
+		if channels[c] == nil {
+			return fmt.Errorf("no notification channel %q (see ALERT_CHANNELS)", c)
+		}
+	}
+	return nil
+}
+
+var compareOps = map[string]func(a, b float64) bool{
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+type alert struct {
+	ID         string     `json:"id"` // rule:subject
+	Rule       string     `json:"rule"`
+	Robot      string     `json:"robot"`
+	Subject    string     `json:"subject"`
+	Severity   string     `json:"severity"`
+	State      string     `json:"state"`
+	Value      *float64   `json:"value,omitempty"` // the field, or its rate; none for absence
+	Message    string     `json:"message"`
+	Since      time.Time  `json:"since"` // when the condition began
+	FiredAt    *time.Time `json:"fired_at,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+type rateSample struct {
+	t time.Time
+	v float64
+}
+
+// alertSeries is one rule's state for one subject.
+type alertSeries struct {
+	rule     string
+	subject  string
+	lastSeen time.Time
+	samples  []rateSample // rate rules
+	alert    *alert       // pending or firing; nil while the condition is false
+}
+
+// alerting evaluates alert rules against live telemetry. Rules live in the
+// ALERT_RULES bucket, so every gateway sees the same set; evaluation keeps
+// its state in memory and runs where ALERTING isn't off, which should be
+// one gateway of a deployment, or each firing is notified once per gateway.
+// Firing and resolving are published on events.alert.{robot} (so they show
+// in the robot's timeline), sent to the rule's notification channels and
+// streamed on /ws/alerts.
+//
+// Channels are notifiers (internal/plugin) configured in ALERT_CHANNELS as
+// name → type and config, and a rule's notify names those it goes to:
+//
+//	ALERT_CHANNELS={"ops":{"type":"slack","config":{"url":"https://hooks.slack.com/…"}},
+//	                "oncall":{"type":"webhook","config":{"url":"https://…","secret":"…"}},
+//	                "pager":{"type":"acme-pager","config":{"key":"…"}}}
+//
+// Built in are log, webhook (signed with HMAC-SHA256), slack and smtp.
+// Failed notifications are retried with backoff, and every delivery, made
+// or given up, is kept in a log (GET /api/alerts/deliveries).
+//
+// Users can also have alerts sent to them on a schedule, urgent ones at
+// once and the rest in periodic digests (see digests).
+//
+// Absence is only known for subjects heard from since the gateway started.
+type alerting struct {
+	js       nats.JetStreamContext
+	kv       nats.KeyValue
+	rb       *rbac
+	audit    *auditLog
+	channels map[string]plugin.Notifier
+	types    map[string]string // channel → notifier type
+	notified *metrics.Counter
+	digests  *digests // set by newDigests
+
+	mu         sync.Mutex
+	rules      map[string]*alertRule
+	series     map[string]*alertSeries // rule:subject →
+	history    []alert                 // resolved, oldest first
+	deliveries []delivery              // oldest first
+	listeners  map[chan alert]struct{}
+}
+
+// delivery is one notification's fate on one channel.
+type delivery struct {
+	Alert    string    `json:"alert"` // rule:subject, or "test"
+	Rule     string    `json:"rule,omitempty"`
+	Robot    string    `json:"robot,omitempty"`
+	State    string    `json:"state,omitempty"`
+	Channel  string    `json:"channel"`
+	Type     string    `json:"type"`
+	OK       bool      `json:"ok"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+	At       time.Time `json:"at"` // when it was delivered or given up
+}
+
+// parseAlertChannels builds the notifiers ALERT_CHANNELS names.
+func parseAlertChannels(s string) (map[string]plugin.Notifier, map[string]string, error) {
+	var cfg map[string]struct {
+		Type   string          `json:"type"`
+		Config json.RawMessage `json:"config"`
+	}
+	if err := json.Unmarshal([]byte(s), &cfg); err != nil {
+		return nil, nil, fmt.Errorf("ALERT_CHANNELS: %w", err)
+	}
+	out, types := map[string]plugin.Notifier{}, map[string]string{}
+	for name, c := range cfg {
+		if !tokenRe.MatchString(name) {
+			return nil, nil, fmt.Errorf("ALERT_CHANNELS: bad channel name %q", name)
+		}
+		n, err := plugin.NewNotifier(c.Type, c.Config)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ALERT_CHANNELS: %s: %w", name, err)
+		}
+		out[name], types[name] = n, c.Type
+	}
+	return out, types, nil
+}
+
+func newAlerting(js nats.JetStreamContext, rb *rbac, audit *auditLog, channels string) (*alerting, error) {
+	chs, types, err := parseAlertChannels(channels)
+	if err != nil {
+		return nil, err
+	}
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: alertRulesBucket, History: 5, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	return &alerting{js: js, kv: kv, rb: rb, audit: audit, channels: chs, types: types,
+		notified: metrics.NewCounter("evabot_alert_notifications_total", "Alert notifications by channel and outcome (delivered, failed).", "channel", "outcome"),
+		rules:    map[string]*alertRule{}, series: map[string]*alertSeries{}, listeners: map[chan alert]struct{}{}}, nil
+}
+
+// run follows the rules bucket and telemetry, and fires absence rules and
+// rules whose condition has held long enough, until ctx is done.
+func (a *alerting) run(ctx context.Context, nc *nats.Conn) error {
+	w, err := a.kv.WatchAll()
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer w.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-w.Updates():
+				if e != nil {
+					a.setRule(e)
+				}
+			}
+		}
+	}()
+	if a.digests != nil {
+		if err := a.digests.run(ctx); err != nil {
+			return err
+		}
+	}
+	sub, err := nc.Subscribe("telemetry.>", func(msg *nats.Msg) {
+		now := time.Now()
+		subject := telem.TrimFormat(msg.Subject)
+		if !a.matches(subject) {
+			return
+		}
+		p, err := telem.DecodeAny(msg.Subject, msg.Header.Get("Content-Type"), msg.Data, now, now)
+		if err != nil {
+			p = telem.Point{Time: now}
+		}
+		a.observe(subject, p, now)
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Unsubscribe()
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				a.tick(now)
+				if a.digests != nil {
+					a.digests.flush(now)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (a *alerting) setRule(e nats.KeyValueEntry) {
+	var r alertRule
+	ok := e.Operation() == nats.KeyValuePut && json.Unmarshal(e.Value(), &r) == nil
+	if ok {
+		if err := r.compile(a.channels); err != nil {
+			log.Printf("alerts: rule %s: not applied: %v", e.Key(), err)
+			ok = false
+		}
+	}
+	a.mu.Lock()
+	// a changed rule starts over: what it fired is resolved
+	var resolved []alert
+	for key, s := range a.series {
+		if s.rule != e.Key() {
+			continue
+		}
+		if s.alert != nil && s.alert.State == alertFiring {
+			resolved = append(resolved, a.resolve(s, time.Now(), "rule changed"))
+		}
+		delete(a.series, key)
+	}
+	if ok && !r.Disabled {
+		a.rules[e.Key()] = &r
+	} else {
+		delete(a.rules, e.Key())
+	}
+	a.mu.Unlock()
+	for _, al := range resolved {
+		a.publish(al, nil)
+	}
+}
+
+func (a *alerting) matches(subject string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, r := range a.rules {
+		if telem.SubjectMatches(r.Subject, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// numeric reads a field as a number; bools are 0 and 1.
+func numeric(v interface{}) (float64, bool) {
+	switch vv := v.(type) {
+	case float64:
+		return vv, true
+	case bool:
+		if vv {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+type alertChange struct {
+	alert alert
+	rule  *alertRule
+}
+
+// observe evaluates the rules matching subject against one message.
+func (a *alerting) observe(subject string, p telem.Point, now time.Time) {
+	var changes []alertChange
+	a.mu.Lock()
+	for name, r := range a.rules {
+		if !telem.SubjectMatches(r.Subject, subject) {
+			continue
+		}
+		s := a.seriesOf(name, subject)
+		s.lastSeen = now
+		switch r.Kind {
+		case ruleAbsence:
+			if s.alert != nil {
+				changes = append(changes, alertChange{a.resolve(s, now, "heard from again"), r})
+			}
+		case ruleThreshold:
+			v, ok := numeric(p.Fields[r.Field])
+			if ok {
+				changes = a.step(changes, r, s, compareOps[r.Op](v, r.Value), v, now)
+			}
+		case ruleRate:
+			v, ok := numeric(p.Fields[r.Field])
+			if !ok {
+				continue
+			}
+			s.samples = append(s.samples, rateSample{p.Time, v})
+			for len(s.samples) > 2 && p.Time.Sub(s.samples[1].t) >= r.window {
+				s.samples = s.samples[1:]
+			}
+			first, last := s.samples[0], s.samples[len(s.samples)-1]
+			if secs := last.t.Sub(first.t).Seconds(); secs > 0 {
+				rate := (last.v - first.v) / secs
+				changes = a.step(changes, r, s, compareOps[r.Op](rate, r.Value), rate, now)
+			}
+		}
+	}
+	a.mu.Unlock()
+	for _, c := range changes {
+		a.publish(c.alert, c.rule)
+	}
+}
+
+// assess sets the condition of a rule kept outside the bucket, such as the
+// latency SLO's, from values per subject; the rule's series missing from
+// values are no longer measured, so what they fired resolves.
+func (a *alerting) assess(r *alertRule, values map[string]float64, now time.Time) {
+	var changes []alertChange
+	a.mu.Lock()
+	for subject, v := range values {
+		s := a.seriesOf(r.Name, subject)
+		s.lastSeen = now
+		changes = a.step(changes, r, s, compareOps[r.Op](v, r.Value), v, now)
+	}
+	for key, s := range a.series {
+		if _, ok := values[s.subject]; ok || s.rule != r.Name {
+			continue
+		}
+		if s.alert != nil && s.alert.State == alertFiring {
+			changes = append(changes, alertChange{a.resolve(s, now, "no longer measured"), r})
+		}
+		delete(a.series, key)
+	}
+	a.mu.Unlock()
+	for _, c := range changes {
+		a.publish(c.alert, c.rule)
+	}
+}
+
+func (a *alerting) seriesOf(rule, subject string) *alertSeries {
+	key := rule + ":" + subject
+	s := a.series[key]
+	if s == nil {
+		s = &alertSeries{rule: rule, subject: subject}
+		a.series[key] = s
+	}
+	return s
+}
+
+// step moves a series on by whether its condition holds; a.mu is held.
+func (a *alerting) step(changes []alertChange, r *alertRule, s *alertSeries, holds bool, v float64, now time.Time) []alertChange {
+	switch {
+	case holds && s.alert == nil:
+		s.alert = &alert{ID: r.Name + ":" + s.subject, Rule: r.Name, Robot: telem.RobotID(s.subject), Subject: s.subject,
+			Severity: r.Severity, State: alertPending, Since: now}
+	case !holds && s.alert != nil:
+		if s.alert.State == alertFiring {
+			return append(changes, alertChange{a.resolve(s, now, fmt.Sprintf("%s is %g", r.Field, v)), r})
+		}
+		s.alert = nil
+		return changes
+	}
+	if s.alert == nil {
+		return changes
+	}
+	s.alert.Value = &v
+	s.alert.Message = fmt.Sprintf("%s %s %g (now %g)", r.Field, r.Op, r.Value, v)
+	if r.Kind == ruleRate {
+		s.alert.Message = fmt.Sprintf("%s changing at %g/s, %s %g", r.Field, v, r.Op, r.Value)
+	}
+	if s.alert.State == alertPending && now.Sub(s.alert.Since) >= r.hold {
+		changes = append(changes, alertChange{a.fire(s, now), r})
+	}
+	return changes
+}
+
+func (a *alerting) fire(s *alertSeries, now time.Time) alert {
+	s.alert.State, s.alert.FiredAt = alertFiring, &now
+	return *s.alert
+}
+
+// resolve ends a series' alert, keeping it in the history; a.mu is held.
+func (a *alerting) resolve(s *alertSeries, now time.Time, why string) alert {
+	al := *s.alert
+	al.State, al.ResolvedAt, al.Message = alertResolved, &now, why
+	s.alert = nil
+	a.history = append(a.history, al)
+	if len(a.history) > maxAlertHistory {
+		a.history = a.history[len(a.history)-maxAlertHistory:]
+	}
+	return al
+}
+
+// tick fires pending alerts that have held for their rule's For without new
+// messages, and absence rules.
+func (a *alerting) tick(now time.Time) {
+	var changes []alertChange
+	a.mu.Lock()
+	for _, s := range a.series {
+		r := a.rules[s.rule]
+		if r == nil {
+			continue
+		}
+		switch {
+		case r.Kind == ruleAbsence && s.alert == nil && now.Sub(s.lastSeen) >= r.hold:
+			s.alert = &alert{ID: r.Name + ":" + s.subject, Rule: r.Name, Robot: telem.RobotID(s.subject), Subject: s.subject,
+				Severity: r.Severity, Since: s.lastSeen, Message: fmt.Sprintf("nothing on %s for %s", s.subject, r.For)}
+			changes = append(changes, alertChange{a.fire(s, now), r})
+		case r.Kind != ruleAbsence && s.alert != nil && s.alert.State == alertPending && now.Sub(s.alert.Since) >= r.hold:
+			changes = append(changes, alertChange{a.fire(s, now), r})
+		}
+	}
+	a.mu.Unlock()
+	for _, c := range changes {
+		a.publish(c.alert, c.rule)
+	}
+}
+
+// publish announces a firing or resolved alert: on events.alert.{robot}, to
+// the feed's listeners and, with its rule, to the rule's channels.
+func (a *alerting) publish(al alert, r *alertRule) {
+	b, _ := json.Marshal(al)
+	subject := "events.alert." + al.Robot
+	if al.Robot == "" {
+		subject = "events.alert" // fleet-wide
+	}
+	if _, err := a.js.Publish(subject, b); err != nil {
+		log.Printf("alerts: publish %s: %v", al.ID, err)
+	}
+	a.mu.Lock()
+	for ch := range a.listeners {
+		select {
+		case ch <- al:
+		default: // a slow client misses transitions; GET /api/alerts has them
+		}
+	}
+	a.mu.Unlock()
+	if r == nil {
+		return
+	}
+	n := alertNotification(al)
+	for _, name := range r.Notify {
+		go a.deliver(name, n, delivery{Alert: al.ID, Rule: al.Rule, Robot: al.Robot, State: al.State})
+	}
+	if a.digests != nil {
+		a.digests.offer(al, time.Now())
+	}
+}
+
+func alertNotification(al alert) plugin.Notification {
+	on := al.Robot
+	if on == "" {
+		on = "the fleet"
+	}
+	return plugin.Notification{Title: strings.ToUpper(al.State) + ": " + al.Rule + " on " + on, Body: al.Message,
+		Severity: al.Severity, Robot: al.Robot, Labels: map[string]string{"rule": al.Rule, "subject": al.Subject, "state": al.State},
+		TS: time.Now()}
+}
+
+// deliver sends n to a channel, retrying with backoff, and logs the outcome
+// in d.
+func (a *alerting) deliver(name string, n plugin.Notification, d delivery) {
+	d.Channel, d.Type = name, a.types[name]
+	ch := a.channels[name]
+	backoff := notifyBackoff
+	var err error
+	for d.Attempts < notifyAttempts {
+		if d.Attempts > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		d.Attempts++
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		err = ch.Notify(ctx, n)
+		cancel()
+		if err == nil || plugin.IsPermanent(err) {
+			break
+		}
+	}
+	d.OK, d.At = err == nil, time.Now().UTC()
+	if err != nil {
+		d.Error = err.Error()
+		log.Printf("alerts: notify %s of %s: gave up after %d attempts: %v", name, d.Alert, d.Attempts, err)
+	}
+	a.logDelivery(d)
+}
+
+func (a *alerting) logDelivery(d delivery) {
+	outcome := "delivered"
+	if !d.OK {
+		outcome = "failed"
+	}
+	a.notified.Inc(d.Channel, outcome)
+	a.mu.Lock()
+	a.deliveries = append(a.deliveries, d)
+	if len(a.deliveries) > maxDeliveries {
+		a.deliveries = a.deliveries[len(a.deliveries)-maxDeliveries:]
+	}
+	a.mu.Unlock()
+}
+
+// active lists pending and firing alerts.
+func (a *alerting) active() []alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := []alert{}
+	for _, s := range a.series {
+		if s.alert != nil {
+			out = append(out, *s.alert)
+		}
+	}
+	return out
+}
+
+func (a *alerting) getRule(name string) (*alertRule, nats.KeyValueEntry, error) {
+	e, err := a.kv.Get(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	var r alertRule
+	if err := json.Unmarshal(e.Value(), &r); err != nil {
+		return nil, nil, err
+	}
+	return &r, e, nil
+}
+
+// GET /api/alerts/rules
+func (a *alerting) handleListRules(w http.ResponseWriter, _ *http.Request) {
+	keys, err := kvKeys(a.kv, ">")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := []alertRule{}
+	for _, k := range keys {
+		if r, _, err := a.getRule(k); err == nil {
+			out = append(out, *r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	writeJSON(w, out)
+}
+
+// GET /api/alerts/rules/{name}
+func (a *alerting) handleGetRule(w http.ResponseWriter, req *http.Request) {
+	r, _, err := a.getRule(chi.URLParam(req, "name"))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such rule", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, r)
+}
+
+// PUT /api/alerts/rules/{name} creates or replaces a rule (see alertRule).
+func (a *alerting) handlePutRule(w http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, "name")
+	if !tokenRe.MatchString(name) {
+		http.Error(w, "bad rule name", 400)
+		return
+	}
+	var r alertRule
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64<<10)).Decode(&r); err != nil {
+		http.Error(w, "bad JSON", 400)
+		return
+	}
+	r.Name, r.Updated, r.By = name, time.Now().UTC(), actorOf(req)
+	if err := r.compile(a.channels); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := a.audit.record(auditRecord{Actor: r.By, Action: "alert_rule.put", Details: map[string]interface{}{"name": name, "kind": r.Kind, "subject": r.Subject, "disabled": r.Disabled}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	b, _ := json.Marshal(r)
+	if _, err := a.kv.Put(name, b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, r)
+}
+
+// DELETE /api/alerts/rules/{name} removes a rule, resolving what it fired.
+func (a *alerting) handleDeleteRule(w http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, "name")
+	if _, _, err := a.getRule(name); errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such rule", 404)
+		return
+	}
+	if err := a.audit.record(auditRecord{Actor: actorOf(req), Action: "alert_rule.delete", Details: map[string]interface{}{"name": name}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	if err := a.kv.Delete(name); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// GET /api/alerts[?state=pending|firing|resolved][&robot=] lists current
+// alerts, then recently resolved ones, newest first, within the caller's
+// scope.
+func (a *alerting) handleList(w http.ResponseWriter, req *http.Request) {
+	id := identityOf(req)
+	state, robot := req.URL.Query().Get("state"), req.URL.Query().Get("robot")
+	all := a.active()
+	sort.Slice(all, func(i, j int) bool { return all[i].Since.After(all[j].Since) })
+	a.mu.Lock()
+	for i := len(a.history) - 1; i >= 0; i-- {
+		all = append(all, a.history[i])
+	}
+	a.mu.Unlock()
+	out := []alert{}
+	for _, al := range all {
+		if (state == "" || al.State == state) && (robot == "" || al.Robot == robot) && a.rb.sees(id, al.Robot) {
+			out = append(out, al)
+		}
+	}
+	writeJSON(w, out)
+}
+
+// GET /api/alerts/deliveries[?channel=][&ok=false] lists recent
+// notifications, newest first, with whether each got through and after how
+// many attempts, within the caller's scope.
+func (a *alerting) handleDeliveries(w http.ResponseWriter, req *http.Request) {
+	id := identityOf(req)
+	channel, ok := req.URL.Query().Get("channel"), req.URL.Query().Get("ok")
+	if ok != "" && ok != "true" && ok != "false" {
+		http.Error(w, "bad 'ok' (true or false)", 400)
+		return
+	}
+	a.mu.Lock()
+	out := []delivery{}
+	for i := len(a.deliveries) - 1; i >= 0; i-- {
+		d := a.deliveries[i]
+		if (channel == "" || d.Channel == channel) && (ok == "" || strconv.FormatBool(d.OK) == ok) && a.rb.sees(id, d.Robot) {
+			out = append(out, d)
+		}
+	}
+	a.mu.Unlock()
+	writeJSON(w, out)
+}
+
+// GET /api/alerts/channels lists the notification channels and their types
+// (not their configuration, which holds secrets).
+func (a *alerting) handleChannels(w http.ResponseWriter, _ *http.Request) {
+	type channel struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+	out := []channel{}
+	for name, t := range a.types {
+		out = append(out, channel{name, t})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	writeJSON(w, out)
+}
+
+// POST /api/alerts/channels/{name}/test sends a test notification through a
+// channel, once, and reports whether it got through.
+func (a *alerting) handleTestChannel(w http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, "name")
+	ch := a.channels[name]
+	if ch == nil {
+		http.Error(w, "no such channel", 404)
+		return
+	}
+	actor := actorOf(req)
+	if err := a.audit.record(auditRecord{Actor: actor, Action: "alert_channel.test", Details: map[string]interface{}{"channel": name}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	n := plugin.Notification{Title: "Test notification from evabot", Body: "Sent by " + actor + " to check the " + name + " channel.",
+		Severity: "info", Labels: map[string]string{"channel": name, "state": "test"}, TS: time.Now()}
+	ctx, cancel := context.WithTimeout(req.Context(), notifyTimeout)
+	defer cancel()
+	d := delivery{Alert: "test", Channel: name, Type: a.types[name], Attempts: 1}
+	err := ch.Notify(ctx, n)
+	d.OK, d.At = err == nil, time.Now().UTC()
+	if err != nil {
+		d.Error = err.Error()
+	}
+	a.logDelivery(d)
+	if err != nil {
+		http.Error(w, name+": "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, d)
+}
+
+// alertsSubject is what GET /ws/alerts counts against WebSocket quotas.
+func alertsSubject(*http.Request) string { return "events.alert.>" }
+
+// GET /ws/alerts sends the firing alerts on connect, then every alert that
+// fires or resolves, each as a JSON message, within the caller's scope.
+func (a *alerting) handleWS(w http.ResponseWriter, req *http.Request) {
+	id := identityOf(req)
+	c, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	ch := make(chan alert, 64)
+	a.mu.Lock()
+	a.listeners[ch] = struct{}{}
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		delete(a.listeners, ch)
+		a.mu.Unlock()
+	}()
+	// the client sends nothing; reading notices it going away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := c.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(al alert) bool {
+		if !a.rb.sees(id, al.Robot) {
+			return true
+		}
+		b, _ := json.Marshal(al)
+		return c.WriteMessage(websocket.TextMessage, b) == nil
+	}
+	for _, al := range a.active() {
+		if al.State == alertFiring && !send(al) {
+			return
+		}
+	}
+	for {
+		select {
+		case al := <-ch:
+			if !send(al) {
+				return
+			}
+		case <-gone:
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/worker"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// runAllInOne implements `evabot-backend all-in-one`: an embedded NATS server
+// with JetStream, the telemetry worker and the HTTP API in one process, for
+// edge boxes and demos. Clients in the same process connect in-process; robots
+// and tools reach the broker on NATS_HOST:NATS_PORT (default 127.0.0.1:4222).
+// State lives under DATA_DIR (default ./evabot-data). Influx stays optional as
+// in the split deployment. MQTT_PORT also opens the broker to MQTT devices
+// (see the mqtt infrastructure driver).
+func runAllInOne() error {
+	dataDir := env("DATA_DIR", "./evabot-data")
+	opts := &server.Options{
+		ServerName: "evabot-all-in-one",
+		Host:       env("NATS_HOST", "127.0.0.1"),
+		Port:       envInt("NATS_PORT", 4222),
+		JetStream:  true,
+		StoreDir:   filepath.Join(dataDir, "nats"),
+		NoSigs:     true, // serve handles SIGTERM, draining clients first
+	}
+	if port := envInt("MQTT_PORT", 0); port > 0 {
+		opts.MQTT = server.MQTTOpts{Host: opts.Host, Port: port}
+	}
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		return err
+	}
+	ns.ConfigureLogger()
+	go ns.Start()
+	if !ns.ReadyForConnections(10 * time.Second) {
+		return errors.New("embedded nats: not ready after 10s")
+	}
+	log.Printf("embedded nats on %s (data in %s)", ns.ClientURL(), dataDir)
+
+	nc, err := nats.Connect("", nats.InProcessServer(ns))
+	if err != nil {
+		return err
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+	// the worker's consumer needs TELEMETRY before serve gets to it, and
+	// residency routing the ROBOTS bucket
+	if err := ensureStreams(js); err != nil {
+		return err
+	}
+	if _, err := newRegistry(js); err != nil {
+		return err
+	}
+
+	wnc, err := nats.Connect("", nats.InProcessServer(ns), nats.Name("evabot-telem-worker"))
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := worker.Run(context.Background(), wnc); err != nil {
+			log.Fatalf("worker: %v", err)
+		}
+	}()
+
+	serve(nc)
+	ns.Shutdown()
+	return nil
+}
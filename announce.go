@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// announcement is what was said through a robot's speaker, kept {robot}.{seq}
+// in the ANNOUNCEMENTS bucket for 30 days.
+type announcement struct {
+	Seq         uint64    `json:"seq"` // the CTRL command
+	Robot       string    `json:"robot"`
+	Text        string    `json:"text,omitempty"`
+	Sound       string    `json:"sound,omitempty"`
+	Lang        string    `json:"lang,omitempty"`
+	Priority    string    `json:"priority"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	RequestedBy string    `json:"requested_by"`
+	Sent        time.Time `json:"sent"`
+	State       string    `json:"state"` // the command's state, or expired; computed on read
+}
+
+// Announcement limits.
+const (
+	maxAnnounceText   = 500
+	maxAnnounceExpiry = time.Hour
+)
+
+// announcer lets operators warn bystanders through a robot: a text for the
+// robot's TTS or a pre-registered sound (ANNOUNCE_SOUNDS), sent as a command
+// on ctrl.{id}.announce:
+//
+//	{"text":…,"sound":…,"lang":…,"priority":"high","expires_at":…,"requested_by":…,"ts_ns":…}
+//
+// Robots play announcements by priority and drop those past expires_at, so a
+// robot coming back online doesn't warn about a hazard long cleared.
+type announcer struct {
+	cmds   *commands
+	kv     nats.KeyValue
+	sounds []string
+}
+
+func newAnnouncer(js nats.JetStreamContext, cmds *commands, sounds string) (*announcer, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "ANNOUNCEMENTS", TTL: 30 * 24 * time.Hour, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	a := &announcer{cmds: cmds, kv: kv, sounds: []string{}}
+	for _, s := range strings.Split(sounds, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !tokenRe.MatchString(s) {
+			return nil, fmt.Errorf("ANNOUNCE_SOUNDS: bad sound id %q", s)
+		}
+		a.sounds = append(a.sounds, s)
+	}
+	return a, nil
+}
+
+// GET /api/sounds lists the sound ids robots have installed.
+func (a *announcer) handleSounds(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, a.sounds)
+}
+
+// POST /api/robot/{id}/announce with {"text":"Robot reversing, stand clear",
+// "lang":"en","priority":"high","expires_in":"2m"} or {"sound":"evacuate"}.
+// Priority is one of low, normal (default), high and critical; expires_in
+// defaults to 1m and may be at most 1h. Answers 202 with the announcement,
+// or with ?dryRun=true 200 with the command it would have sent.
+func (a *announcer) handleAnnounce(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	dry, err := dryRun(req)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var in struct {
+		Text      string `json:"text"`
+		Sound     string `json:"sound"`
+		Lang      string `json:"lang"`
+		Priority  string `json:"priority"`
+		ExpiresIn string `json:"expires_in"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		http.Error(w, "bad body: "+err.Error(), 400)
+		return
+	}
+	in.Text = strings.TrimSpace(in.Text)
+	switch {
+	case (in.Text == "") == (in.Sound == ""):
+		http.Error(w, "give either 'text' or 'sound'", 400)
+		return
+	case len(in.Text) > maxAnnounceText:
+		http.Error(w, fmt.Sprintf("text over %d bytes", maxAnnounceText), 400)
+		return
+	case in.Sound != "" && !contains(a.sounds, in.Sound):
+		http.Error(w, fmt.Sprintf("unknown sound %q (see GET /api/sounds)", in.Sound), 400)
+		return
+	case in.Lang != "" && !tokenRe.MatchString(in.Lang):
+		http.Error(w, "bad lang (e.g. en, pt-PT)", 400)
+		return
+	}
+	if in.Priority == "" {
+		in.Priority = "normal"
+	}
+	if !contains(cmdPriorities, in.Priority) {
+		http.Error(w, fmt.Sprintf("bad priority %q (one of %v)", in.Priority, cmdPriorities), 400)
+		return
+	}
+	expiry := time.Minute
+	if in.ExpiresIn != "" {
+		d, err := time.ParseDuration(in.ExpiresIn)
+		if err != nil || d <= 0 || d > maxAnnounceExpiry {
+			http.Error(w, "bad expires_in (e.g. 30s, at most 1h)", 400)
+			return
+		}
+		expiry = d
+	}
+
+	now := time.Now()
+	an := announcement{Robot: id, Text: in.Text, Sound: in.Sound, Lang: in.Lang, Priority: in.Priority,
+		ExpiresAt: now.Add(expiry), RequestedBy: actorOf(req), Sent: now, State: cmdPending}
+	payload, _ := json.Marshal(map[string]interface{}{"text": an.Text, "sound": an.Sound, "lang": an.Lang,
+		"priority": an.Priority, "expires_at": an.ExpiresAt, "requested_by": an.RequestedBy, "ts_ns": now.UnixNano()})
+	if dry {
+		writePlan(w, a.cmds.plan(id, "announce", payload))
+		return
+	}
+	cmd, err := a.cmds.publish(id, "announce", payload)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	an.Seq = cmd.Seq
+	b, _ := json.Marshal(an)
+	if _, err := a.kv.Put(cmdKey(id, an.Seq), b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSONStatus(w, http.StatusAccepted, an)
+}
+
+// GET /api/robot/{id}/announcements lists the robot's announcements, newest
+// first, each with whether the robot has taken it (acked), it is still
+// queued (pending), it was canceled, or it expired before delivery.
+func (a *announcer) handleHistory(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	cmds, err := a.cmds.list(id)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	states := map[uint64]string{}
+	for _, c := range cmds {
+		states[c.Seq] = c.State
+	}
+	keys, err := kvKeys(a.kv, id+".>")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	now := time.Now()
+	out := []announcement{}
+	for _, k := range keys {
+		e, err := a.kv.Get(k)
+		if err != nil {
+			continue
+		}
+		var an announcement
+		if json.Unmarshal(e.Value(), &an) != nil {
+			continue
+		}
+		if st, ok := states[an.Seq]; ok {
+			an.State = st
+		}
+		if an.State == cmdPending && now.After(an.ExpiresAt) {
+			an.State = "expired"
+		}
+		out = append(out, an)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Seq > out[j].Seq })
+	writeJSON(w, out)
+}
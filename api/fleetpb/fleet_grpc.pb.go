@@ -0,0 +1,214 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
+// source: api/fleetpb/fleet.proto
+
+package fleetpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	Fleet_StreamTelemetry_FullMethodName = "/evabot.fleet.v1.Fleet/StreamTelemetry"
+	Fleet_SendCommand_FullMethodName     = "/evabot.fleet.v1.Fleet/SendCommand"
+	Fleet_QueryTimeSeries_FullMethodName = "/evabot.fleet.v1.Fleet/QueryTimeSeries"
+)
+
+// FleetClient is the client API for Fleet service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type FleetClient interface {
+	StreamTelemetry(ctx context.Context, in *SubjectFilter, opts ...grpc.CallOption) (Fleet_StreamTelemetryClient, error)
+	SendCommand(ctx context.Context, in *CommandRequest, opts ...grpc.CallOption) (*CommandReply, error)
+	QueryTimeSeries(ctx context.Context, in *TimeSeriesQuery, opts ...grpc.CallOption) (*TimeSeries, error)
+}
+
+type fleetClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFleetClient(cc grpc.ClientConnInterface) FleetClient {
+	return &fleetClient{cc}
+}
+
+func (c *fleetClient) StreamTelemetry(ctx context.Context, in *SubjectFilter, opts ...grpc.CallOption) (Fleet_StreamTelemetryClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Fleet_ServiceDesc.Streams[0], Fleet_StreamTelemetry_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fleetStreamTelemetryClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Fleet_StreamTelemetryClient interface {
+	Recv() (*TelemetryMessage, error)
+	grpc.ClientStream
+}
+
+type fleetStreamTelemetryClient struct {
+	grpc.ClientStream
+}
+
+func (x *fleetStreamTelemetryClient) Recv() (*TelemetryMessage, error) {
+	m := new(TelemetryMessage)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *fleetClient) SendCommand(ctx context.Context, in *CommandRequest, opts ...grpc.CallOption) (*CommandReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CommandReply)
+	err := c.cc.Invoke(ctx, Fleet_SendCommand_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fleetClient) QueryTimeSeries(ctx context.Context, in *TimeSeriesQuery, opts ...grpc.CallOption) (*TimeSeries, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TimeSeries)
+	err := c.cc.Invoke(ctx, Fleet_QueryTimeSeries_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// FleetServer is the server API for Fleet service.
+// All implementations must embed UnimplementedFleetServer
+// for forward compatibility
+type FleetServer interface {
+	StreamTelemetry(*SubjectFilter, Fleet_StreamTelemetryServer) error
+	SendCommand(context.Context, *CommandRequest) (*CommandReply, error)
+	QueryTimeSeries(context.Context, *TimeSeriesQuery) (*TimeSeries, error)
+	mustEmbedUnimplementedFleetServer()
+}
+
+// UnimplementedFleetServer must be embedded to have forward compatible implementations.
+type UnimplementedFleetServer struct {
+}
+
+func (UnimplementedFleetServer) StreamTelemetry(*SubjectFilter, Fleet_StreamTelemetryServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamTelemetry not implemented")
+}
+func (UnimplementedFleetServer) SendCommand(context.Context, *CommandRequest) (*CommandReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendCommand not implemented")
+}
+func (UnimplementedFleetServer) QueryTimeSeries(context.Context, *TimeSeriesQuery) (*TimeSeries, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryTimeSeries not implemented")
+}
+func (UnimplementedFleetServer) mustEmbedUnimplementedFleetServer() {}
+
+// UnsafeFleetServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FleetServer will
+// result in compilation errors.
+type UnsafeFleetServer interface {
+	mustEmbedUnimplementedFleetServer()
+}
+
+func RegisterFleetServer(s grpc.ServiceRegistrar, srv FleetServer) {
+	s.RegisterService(&Fleet_ServiceDesc, srv)
+}
+
+func _Fleet_StreamTelemetry_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubjectFilter)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FleetServer).StreamTelemetry(m, &fleetStreamTelemetryServer{ServerStream: stream})
+}
+
+type Fleet_StreamTelemetryServer interface {
+	Send(*TelemetryMessage) error
+	grpc.ServerStream
+}
+
+type fleetStreamTelemetryServer struct {
+	grpc.ServerStream
+}
+
+func (x *fleetStreamTelemetryServer) Send(m *TelemetryMessage) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Fleet_SendCommand_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CommandRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FleetServer).SendCommand(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Fleet_SendCommand_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FleetServer).SendCommand(ctx, req.(*CommandRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Fleet_QueryTimeSeries_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TimeSeriesQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FleetServer).QueryTimeSeries(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Fleet_QueryTimeSeries_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FleetServer).QueryTimeSeries(ctx, req.(*TimeSeriesQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Fleet_ServiceDesc is the grpc.ServiceDesc for Fleet service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Fleet_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "evabot.fleet.v1.Fleet",
+	HandlerType: (*FleetServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SendCommand",
+			Handler:    _Fleet_SendCommand_Handler,
+		},
+		{
+			MethodName: "QueryTimeSeries",
+			Handler:    _Fleet_QueryTimeSeries_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamTelemetry",
+			Handler:       _Fleet_StreamTelemetry_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/fleetpb/fleet.proto",
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// Approval states.
+const (
+	approvalPending   = "pending"
+	approvalConfirmed = "confirmed"
+	approvalRejected  = "rejected"
+	approvalExpired   = "expired"
+)
+
+// approval is a staged destructive request waiting for a second person.
+type approval struct {
+	ID          string     `json:"id"`
+	Kind        string     `json:"kind"`
+	Method      string     `json:"method"`
+	Path        string     `json:"path"`
+	Body        []byte     `json:"body,omitempty"`
+	RequestedBy string     `json:"requested_by"`
+	RequestedAt time.Time  `json:"requested_at"`
+	Expires     time.Time  `json:"expires"`
+	State       string     `json:"state"`
+	DecidedBy   string     `json:"decided_by,omitempty"`
+	DecidedAt   *time.Time `json:"decided_at,omitempty"`
+	Status      int        `json:"status,omitempty"` // HTTP status of the executed request
+}
+
+type approvalKey struct{}
+
+// approvals implements two-person confirmation. Wrapped endpoints don't act
+// when called: the request is staged (202 with the approval) and runs only
+// when a different user holding an approver role confirms it within the
+// window. Confirmation replays the staged method, path and body through the
+// router with the confirmer's credentials, so gates such as break-glass apply
+// to the confirmer; the audit log records both people.
+type approvals struct {
+	kv        nats.KeyValue
+	audit     *auditLog
+	window    time.Duration
+	approvers map[string]bool
+	enabled   bool
+	router    http.Handler // set once routes are mounted
+}
+
+func newApprovals(js nats.JetStreamContext, audit *auditLog, enabled bool, window time.Duration, approverRoles string) (*approvals, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "APPROVALS", History: 5, TTL: 30 * 24 * time.Hour, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	a := &approvals{kv: kv, audit: audit, window: window, approvers: map[string]bool{}, enabled: enabled}
+	for _, r := range strings.Split(approverRoles, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			a.approvers[r] = true
+		}
+	}
+	return a, nil
+}
+
+func (a *approvals) isApprover(id *identity) bool {
+	for _, r := range id.Roles {
+		if a.approvers[r] {
+			return true
+		}
+	}
+	return false
+}
+
+// require wraps a destructive endpoint so it needs a second person.
+func (a *approvals) require(kind string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !a.enabled || req.Context().Value(approvalKey{}) != nil {
+			next(w, req)
+			return
+		}
+		id := identityOf(req)
+		if id == nil || !a.isApprover(id) {
+			http.Error(w, "two-person action: log in as an approver to request it", http.StatusForbidden)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		now := time.Now().UTC()
+		ap := approval{ID: nuid.Next(), Kind: kind, Method: req.Method, Path: req.URL.RequestURI(), Body: body,
+			RequestedBy: id.User, RequestedAt: now, Expires: now.Add(a.window), State: approvalPending}
+		if err := a.audit.record(auditRecord{Actor: actorOf(req), Action: "approval.request", Details: map[string]interface{}{"approval": ap.ID, "kind": kind, "path": ap.Path}}); err != nil {
+			http.Error(w, "audit: "+err.Error(), 500)
+			return
+		}
+		b, _ := json.Marshal(ap)
+		if _, err := a.kv.Create(ap.ID, b); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		writeJSONStatus(w, http.StatusAccepted, ap)
+	}
+}
+
+func (a *approvals) get(id string) (*approval, uint64, error) {
+	e, err := a.kv.Get(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	var ap approval
+	if err := json.Unmarshal(e.Value(), &ap); err != nil {
+		return nil, 0, err
+	}
+	if ap.State == approvalPending && time.Now().After(ap.Expires) {
+		ap.State = approvalExpired
+	}
+	return &ap, e.Revision(), nil
+}
+
+// GET /api/approvals?state=pending
+func (a *approvals) handleList(w http.ResponseWriter, req *http.Request) {
+	state := req.URL.Query().Get("state")
+	keys, err := kvKeys(a.kv, ">")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := []approval{}
+	for _, k := range keys {
+		ap, _, err := a.get(k)
+		if err != nil || (state != "" && ap.State != state) {
+			continue
+		}
+		out = append(out, *ap)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].RequestedAt.After(out[j].RequestedAt) })
+	writeJSON(w, out)
+}
+
+// decide moves a pending approval to state, enforcing the two-person rule.
+func (a *approvals) decide(w http.ResponseWriter, req *http.Request, state string) (*approval, bool) {
+	id := identityOf(req)
+	if id == nil || !a.isApprover(id) {
+		http.Error(w, "only an approver can decide", http.StatusForbidden)
+		return nil, false
+	}
+	ap, rev, err := a.get(chi.URLParam(req, "aid"))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such approval", 404)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil, false
+	}
+	if ap.State != approvalPending {
+		http.Error(w, "approval is "+ap.State, http.StatusConflict)
+		return nil, false
+	}
+	if state == approvalConfirmed && id.User == ap.RequestedBy {
+		http.Error(w, "the requester can't confirm their own action", http.StatusForbidden)
+		return nil, false
+	}
+	now := time.Now().UTC()
+	ap.State, ap.DecidedBy, ap.DecidedAt = state, id.User, &now
+	if err := a.audit.record(auditRecord{Actor: actorOf(req), Action: "approval." + state, Details: map[string]interface{}{
+		"approval": ap.ID, "kind": ap.Kind, "path": ap.Path, "requested_by": ap.RequestedBy, "decided_by": ap.DecidedBy}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return nil, false
+	}
+	b, _ := json.Marshal(ap)
+	// the revision check makes sure only one confirmation executes
+	if _, err := a.kv.Update(ap.ID, b, rev); err != nil {
+		code := 500
+		if errors.Is(err, nats.ErrKeyExists) {
+			code = http.StatusConflict
+		}
+		http.Error(w, err.Error(), code)
+		return nil, false
+	}
+	return ap, true
+}
+
+// statusRecorder remembers the status a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// POST /api/approvals/{aid}/confirm executes the staged request; the response
+// is that request's response.
+func (a *approvals) handleConfirm(w http.ResponseWriter, req *http.Request) {
+	ap, ok := a.decide(w, req, approvalConfirmed)
+	if !ok {
+		return
+	}
+	// a fresh context: the replay is routed from scratch
+	ctx := context.WithValue(context.Background(), approvalKey{}, ap)
+	replay, err := http.NewRequestWithContext(ctx, ap.Method, ap.Path, bytes.NewReader(ap.Body))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	replay.Header = req.Header.Clone()
+	replay.RemoteAddr = req.RemoteAddr
+	replay.Host = req.Host
+	rec := &statusRecorder{ResponseWriter: w, status: 200}
+	a.router.ServeHTTP(rec, replay)
+
+	ap.Status = rec.status
+	b, _ := json.Marshal(ap)
+	_, _ = a.kv.Put(ap.ID, b)
+}
+
+// POST /api/approvals/{aid}/reject
+func (a *approvals) handleReject(w http.ResponseWriter, req *http.Request) {
+	if ap, ok := a.decide(w, req, approvalRejected); ok {
+		writeJSON(w, ap)
+	}
+}
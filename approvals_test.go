@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// TestApprovalsRequire walks staged requests through the two-person rule:
+// nothing runs until a second approver confirms, it runs once with the
+// staged body, and decided or expired approvals can't be confirmed again.
+func TestApprovalsRequire(t *testing.T) {
+	_, js := testJetStream(t)
+	audit, err := newAuditLog(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appr, err := newApprovals(js, audit, true, time.Minute, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	people := map[string]*identity{
+		"alice": {User: "alice", Roles: []string{roleAdmin}},
+		"bob":   {User: "bob", Roles: []string{roleAdmin}},
+		"olga":  {User: "olga", Roles: []string{roleOperator}},
+	}
+	var ran []string // bodies the wrapped handler saw
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler { // stands in for auth.middleware
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if id := people[req.Header.Get("X-Test-User")]; id != nil {
+				req = as(req, id)
+			}
+			next.ServeHTTP(w, req)
+		})
+	})
+	r.Delete("/api/things/{n}", appr.require("thing.delete", func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		ran = append(ran, chi.URLParam(req, "n")+":"+string(b))
+		w.WriteHeader(204)
+	}))
+	r.Post("/api/approvals/{aid}/confirm", appr.handleConfirm)
+	r.Post("/api/approvals/{aid}/reject", appr.handleReject)
+	appr.router = r
+
+	staged := map[string]string{} // step name → approval id
+	steps := []struct {
+		name   string
+		user   string
+		method string
+		path   string // {name} is replaced by the approval staged at that step
+		body   string
+		window time.Duration // for staging; 0 keeps a minute
+		want   int
+		ran    int // handler runs so far
+	}{
+		{"non-approver request", "olga", "DELETE", "/api/things/1", "", 0, 403, 0},
+		{"anonymous request", "", "DELETE", "/api/things/1", "", 0, 403, 0},
+		{"first", "alice", "DELETE", "/api/things/1", `{"why":"test"}`, 0, 202, 0},
+		{"own confirmation", "alice", "POST", "/api/approvals/{first}/confirm", "", 0, 403, 0},
+		{"non-approver confirmation", "olga", "POST", "/api/approvals/{first}/confirm", "", 0, 403, 0},
+		{"second person confirms", "bob", "POST", "/api/approvals/{first}/confirm", "", 0, 204, 1},
+		{"confirmed twice", "bob", "POST", "/api/approvals/{first}/confirm", "", 0, 409, 1},
+		{"rejected", "alice", "DELETE", "/api/things/2", "", 0, 202, 1},
+		{"reject it", "bob", "POST", "/api/approvals/{rejected}/reject", "", 0, 200, 1},
+		{"confirm after reject", "bob", "POST", "/api/approvals/{rejected}/confirm", "", 0, 409, 1},
+		{"expired", "alice", "DELETE", "/api/things/3", "", -time.Second, 202, 1},
+		{"confirm after expiry", "bob", "POST", "/api/approvals/{expired}/confirm", "", 0, 409, 1},
+		{"unknown approval", "bob", "POST", "/api/approvals/nosuch/confirm", "", 0, 404, 1},
+	}
+	for _, s := range steps {
+		path := s.path
+		for name, aid := range staged {
+			path = strings.ReplaceAll(path, "{"+name+"}", aid)
+		}
+		appr.window = time.Minute
+		if s.window != 0 {
+			appr.window = s.window
+		}
+		req := httptest.NewRequest(s.method, path, strings.NewReader(s.body))
+		req.Header.Set("X-Test-User", s.user)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != s.want {
+			t.Fatalf("%s: got %d, want %d: %s", s.name, rec.Code, s.want, rec.Body)
+		}
+		if len(ran) != s.ran {
+			t.Fatalf("%s: handler ran %d times, want %d", s.name, len(ran), s.ran)
+		}
+		if rec.Code == 202 {
+			var ap approval
+			if err := json.Unmarshal(rec.Body.Bytes(), &ap); err != nil || ap.State != approvalPending {
+				t.Fatalf("%s: staged %+v, %v", s.name, ap, err)
+			}
+			staged[s.name] = ap.ID
+		}
+	}
+
+	if ran[0] != `1:{"why":"test"}` {
+		t.Errorf("replay ran with %q, want the staged path and body", ran[0])
+	}
+	ap, _, err := appr.get(staged["first"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ap.State != approvalConfirmed || ap.RequestedBy != "alice" || ap.DecidedBy != "bob" || ap.Status != 204 {
+		t.Errorf("confirmed approval recorded as %+v", ap)
+	}
+}
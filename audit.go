@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// auditRecord is one entry of the audit trail. Records are published to
+// audit.{action} and kept in the AUDIT stream.
+type auditRecord struct {
+	TS      time.Time              `json:"ts"`
+	Actor   string                 `json:"actor"`
+	Action  string                 `json:"action"`
+	Robot   string                 `json:"robot,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+type auditLog struct {
+	js nats.JetStreamContext
+}
+
+func newAuditLog(js nats.JetStreamContext) (*auditLog, error) {
+	_, err := js.AddStream(&nats.StreamConfig{Name: "AUDIT", Subjects: []string{"audit.>"}, Storage: nats.FileStorage, MaxAge: 2 * 365 * 24 * time.Hour})
+	if err != nil && err != nats.ErrStreamNameAlreadyInUse {
+		return nil, err
+	}
+	return &auditLog{js: js}, nil
+}
+
+// record appends to the audit trail; failing to audit fails the caller.
+func (a *auditLog) record(rec auditRecord) error {
+	if rec.TS.IsZero() {
+		rec.TS = time.Now()
+	}
+	b, _ := json.Marshal(rec)
+	_, err := a.js.Publish("audit."+rec.Action, b)
+	return err
+}
+
+// actorOf names whoever is making the request, for the audit trail: the
+// authenticated user if there is one, else only the client address. Nothing
+// the client merely claims is taken.
+func actorOf(req *http.Request) string {
+	if id := identityOf(req); id != nil {
+		return id.User + "@" + req.RemoteAddr
+	}
+	return req.RemoteAddr
+}
+
+// GET /api/audit?limit=100 returns the most recent records, newest first.
+func (a *auditLog) handleList(w http.ResponseWriter, req *http.Request) {
+	limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	info, err := a.js.StreamInfo("AUDIT")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	out := make([]auditRecord, 0, limit)
+	for seq := info.State.LastSeq; seq >= info.State.FirstSeq && seq > 0 && len(out) < limit; seq-- {
+		m, err := a.js.GetMsg("AUDIT", seq)
+		if err != nil {
+			continue // deleted
+		}
+		var rec auditRecord
+		if json.Unmarshal(m.Data, &rec) == nil {
+			out = append(out, rec)
+		}
+	}
+	writeJSON(w, out)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// broadcastMsg is published to ctrl.broadcast. Robots confirm receipt by
+// publishing anything to ack.broadcast.{id}.{robot}.
+type broadcastMsg struct {
+	ID      string          `json:"id"`
+	Kind    string          `json:"kind"` // message | config
+	Message string          `json:"message,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	TS      time.Time       `json:"ts"`
+}
+
+type broadcastRecord struct {
+	broadcastMsg
+	Actor    string   `json:"actor"`
+	Expected []string `json:"expected"` // active registry robots at send time
+}
+
+// broadcasts sends fleet-wide messages and collects per-robot receipts. Sent
+// broadcasts live in BROADCASTS, receipts in BROADCAST_ACKS as {id}.{robot}.
+type broadcasts struct {
+	js    nats.JetStreamContext
+	reg   *registry
+	audit *auditLog
+	sent  nats.KeyValue
+	acks  nats.KeyValue
+}
+
+func newBroadcasts(js nats.JetStreamContext, reg *registry, audit *auditLog) (*broadcasts, error) {
+	sent, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "BROADCASTS", TTL: 30 * 24 * time.Hour, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	acks, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "BROADCAST_ACKS", TTL: 30 * 24 * time.Hour, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	return &broadcasts{js: js, reg: reg, audit: audit, sent: sent, acks: acks}, nil
+}
+
+func (b *broadcasts) subscribe(nc *nats.Conn) error {
+	_, err := nc.Subscribe("ack.broadcast.*.*", func(msg *nats.Msg) {
+		parts := strings.Split(msg.Subject, ".")
+		bid, robot := parts[2], parts[3]
+		if _, err := b.sent.Get(bid); err != nil {
+			return // unknown or expired broadcast
+		}
+		ts, _ := json.Marshal(time.Now())
+		if _, err := b.acks.Create(bid+"."+robot, ts); err != nil && !errors.Is(err, nats.ErrKeyExists) {
+			log.Printf("broadcast: record ack %s from %s: %v", bid, robot, err)
+		}
+	})
+	return err
+}
+
+// prepare gives m an id and addresses it to every active robot.
+func (b *broadcasts) prepare(actor string, m broadcastMsg) (*broadcastRecord, error) {
+	robots, err := b.reg.active()
+	if err != nil {
+		return nil, err
+	}
+	m.ID = nuid.Next()
+	m.TS = time.Now()
+	rec := &broadcastRecord{broadcastMsg: m, Actor: actor, Expected: make([]string, 0, len(robots))}
+	for _, r := range robots {
+		rec.Expected = append(rec.Expected, r.ID)
+	}
+	return rec, nil
+}
+
+// send publishes a broadcast to every robot and records who should confirm.
+func (b *broadcasts) send(actor string, m broadcastMsg) (*broadcastRecord, error) {
+	rec, err := b.prepare(actor, m)
+	if err != nil {
+		return nil, err
+	}
+	m = rec.broadcastMsg
+
+	rb, _ := json.Marshal(rec)
+	if _, err := b.sent.Put(m.ID, rb); err != nil {
+		return nil, err
+	}
+	if err := b.audit.record(auditRecord{Actor: actor, Action: "fleet.broadcast", Details: map[string]interface{}{"id": m.ID, "kind": m.Kind, "message": m.Message}}); err != nil {
+		return nil, err
+	}
+	mb, _ := json.Marshal(m)
+	if _, err := b.js.Publish("ctrl.broadcast", mb); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// POST /api/fleet/broadcast with {"kind":"message","message":"pause all missions at 18:00"}
+// or, to see what would be published and who would be expected to confirm
+// without sending it, with ?dryRun=true. A real send gets a new id and ts.
+func (b *broadcasts) handleSend(w http.ResponseWriter, req *http.Request) {
+	dry, err := dryRun(req)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var m broadcastMsg
+	if err := json.NewDecoder(req.Body).Decode(&m); err != nil {
+		http.Error(w, "bad body: "+err.Error(), 400)
+		return
+	}
+	if m.Kind == "" {
+		m.Kind = "message"
+	}
+	if m.Kind != "message" && m.Kind != "config" {
+		http.Error(w, "kind must be message or config", 400)
+		return
+	}
+	if m.Message == "" && len(m.Data) == 0 {
+		http.Error(w, "message or data required", 400)
+		return
+	}
+	if dry {
+		rec, err := b.prepare(actorOf(req), m)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		mb, _ := json.Marshal(rec.broadcastMsg)
+		writeJSON(w, map[string]interface{}{"dry_run": true, "messages": []plannedCommand{{Subject: "ctrl.broadcast", Payload: mb}},
+			"expected": rec.Expected})
+		return
+	}
+	rec, err := b.send(actorOf(req), m)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSONStatus(w, http.StatusAccepted, rec)
+}
+
+type broadcastReport struct {
+	broadcastRecord
+	Confirmed map[string]time.Time `json:"confirmed"`
+	Missing   []string             `json:"missing"`
+}
+
+func (b *broadcasts) report(bid string) (*broadcastReport, error) {
+	e, err := b.sent.Get(bid)
+	if err != nil {
+		return nil, err
+	}
+	var rep broadcastReport
+	if err := json.Unmarshal(e.Value(), &rep.broadcastRecord); err != nil {
+		return nil, err
+	}
+	keys, err := kvKeys(b.acks, bid+".*")
+	if err != nil {
+		return nil, err
+	}
+	rep.Confirmed = map[string]time.Time{}
+	for _, k := range keys {
+		ae, err := b.acks.Get(k)
+		if err != nil {
+			continue
+		}
+		var ts time.Time
+		_ = json.Unmarshal(ae.Value(), &ts)
+		rep.Confirmed[strings.TrimPrefix(k, bid+".")] = ts
+	}
+	rep.Missing = []string{}
+	for _, id := range rep.Expected {
+		if _, ok := rep.Confirmed[id]; !ok {
+			rep.Missing = append(rep.Missing, id)
+		}
+	}
+	return &rep, nil
+}
+
+// GET /api/fleet/broadcast/{bid}
+func (b *broadcasts) handleReport(w http.ResponseWriter, req *http.Request) {
+	rep, err := b.report(chi.URLParam(req, "bid"))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such broadcast", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, rep)
+}
+
+// GET /api/fleet/broadcasts lists sent broadcasts with confirmation counts.
+func (b *broadcasts) handleList(w http.ResponseWriter, _ *http.Request) {
+	keys, err := kvKeys(b.sent, ">")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	type summary struct {
+		broadcastMsg
+		Confirmed string `json:"confirmed"` // "n/m"
+	}
+	out := make([]summary, 0, len(keys))
+	for _, k := range keys {
+		rep, err := b.report(k)
+		if err != nil {
+			continue
+		}
+		out = append(out, summary{rep.broadcastMsg, fmt.Sprintf("%d/%d", len(rep.Expected)-len(rep.Missing), len(rep.Expected))})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].TS.After(out[j].TS) })
+	writeJSON(w, out)
+}
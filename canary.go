@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/metrics"
+	"github.com/nats-io/nats.go"
+)
+
+// Canary paths: a probe is published to TELEMETRY, and must come back
+// through the hub (what WebSocket clients are sent) and from Influx (what
+// queries read, once the worker has written it).
+const (
+	canaryWS     = "ws"
+	canaryInflux = "influx"
+)
+
+var canaryUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// canary is a synthetic robot that checks the telemetry pipeline end to
+// end. With CANARY on, every CANARY_EVERY (default 5s) it publishes a probe,
+// {"ts_ns","seq"}, on telemetry.{CANARY_ROBOT}.{instance} (robot default
+// canary, so each gateway checks its own), and a path is failing while a
+// probe older than CANARY_DEADLINE (default 30s) hasn't come back through
+// it. Influx is polled each round, so its latency is only known to within
+// CANARY_EVERY. Health shows on /readyz and /metrics.
+type canary struct {
+	js       nats.JetStreamContext
+	hub      *hub
+	db       *influxTarget // nil skips the Influx path
+	subject  string
+	every    time.Duration
+	deadline time.Duration
+
+	ok      *metrics.Gauge
+	latency *metrics.Gauge
+	missed  *metrics.Counter
+
+	mu     sync.Mutex
+	seq    uint64
+	probes map[uint64]*canaryProbe
+	paths  map[string]*canaryPath
+}
+
+type canaryProbe struct {
+	sent time.Time
+	seen map[string]bool
+}
+
+type canaryPath struct {
+	OK       bool       `json:"ok"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	Latency  float64    `json:"latency_ms"` // of the last probe seen
+	Missed   uint64     `json:"missed"`     // probes past the deadline, since start
+	Error    string     `json:"error,omitempty"`
+
+	failedAt time.Time // when the last missed probe was sent
+}
+
+func newCanary(js nats.JetStreamContext, h *hub, db *influxTarget, robot, instance string, every, deadline time.Duration) *canary {
+	c := &canary{js: js, hub: h, db: db, subject: "telemetry." + robot + "." + canaryUnsafe.ReplaceAllString(instance, "_"),
+		every: every, deadline: deadline, probes: map[uint64]*canaryProbe{}, paths: map[string]*canaryPath{},
+		ok:      metrics.NewGauge("evabot_canary_ok", "Whether canary probes come back through each path (1) or not (0).", "path"),
+		latency: metrics.NewGauge("evabot_canary_latency_seconds", "Latency of the last canary probe seen, by path.", "path"),
+		missed:  metrics.NewCounter("evabot_canary_missed_total", "Canary probes not seen within CANARY_DEADLINE, by path.", "path")}
+	for _, p := range c.pathNames() {
+		c.paths[p] = &canaryPath{OK: true}
+		c.ok.Set(1, p)
+	}
+	return c
+}
+
+func (c *canary) pathNames() []string {
+	if c.db == nil {
+		return []string{canaryWS}
+	}
+	return []string{canaryWS, canaryInflux}
+}
+
+// run probes until ctx is done.
+func (c *canary) run(ctx context.Context) error {
+	cl, err := c.hub.join(c.subject, 64, dropOldest, "canary", "internal")
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer c.hub.leave(c.subject, cl)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-cl.Gone:
+				return
+			case m := <-cl.C:
+				var p struct {
+					Seq uint64 `json:"seq"`
+				}
+				if json.Unmarshal(m.Data, &p) == nil {
+					c.seen(canaryWS, p.Seq, time.Now())
+				}
+			}
+		}
+	}()
+	go func() {
+		t := time.NewTicker(c.every)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				c.probe(now)
+				if c.db != nil {
+					c.pollInflux(ctx, now)
+				}
+				c.check(now)
+			}
+		}
+	}()
+	log.Printf("canary: probing %s every %s, deadline %s", c.subject, c.every, c.deadline)
+	return nil
+}
+
+func (c *canary) probe(now time.Time) {
+	c.mu.Lock()
+	c.seq++
+	seq := c.seq
+	c.probes[seq] = &canaryProbe{sent: now, seen: map[string]bool{}}
+	c.mu.Unlock()
+	b, _ := json.Marshal(map[string]interface{}{"ts_ns": now.UnixNano(), "seq": seq})
+	if _, err := c.js.Publish(c.subject, b); err != nil {
+		log.Printf("canary: publish: %v", err)
+	}
+}
+
+// pollInflux marks the probes Influx has.
+func (c *canary) pollInflux(ctx context.Context, now time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, c.every)
+	defer cancel()
+	flux := `from(bucket:"` + c.db.Bucket + `") |> range(start: -` + (c.deadline + 2*c.every).String() + `)` + telemetryFilter() +
+		` |> filter(fn:(r)=> r._field == "seq" and r.subject == "` + c.subject + `") |> keep(columns: ["_value"])`
+	res, err := c.db.Client.QueryAPI(c.db.Org).Query(ctx, flux)
+	if err == nil {
+		for res.Next() {
+			if seq, ok := numeric(res.Record().Value()); ok {
+				c.seen(canaryInflux, uint64(seq), now)
+			}
+		}
+		err = res.Err()
+		res.Close()
+	}
+	c.mu.Lock()
+	if err != nil {
+		c.paths[canaryInflux].Error = err.Error()
+	} else {
+		c.paths[canaryInflux].Error = ""
+	}
+	c.mu.Unlock()
+}
+
+func (c *canary) seen(path string, seq uint64, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.probes[seq]
+	if p == nil || p.seen[path] {
+		return
+	}
+	p.seen[path] = true
+	st := c.paths[path]
+	if st.LastSeen == nil || at.After(*st.LastSeen) {
+		st.LastSeen = &at
+		st.Latency = float64(at.Sub(p.sent)) / float64(time.Millisecond)
+		c.latency.Set(at.Sub(p.sent).Seconds(), path)
+	}
+	// a path recovers once a probe sent after its last miss comes back
+	if !st.OK && p.sent.After(st.failedAt) {
+		st.OK = true
+		c.ok.Set(1, path)
+	}
+}
+
+// check fails each path with a probe past the deadline unseen, counting
+// each such probe once, and forgets probes seen or counted on every path.
+func (c *canary) check(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for seq, p := range c.probes {
+		overdue := now.Sub(p.sent) > c.deadline
+		done := true
+		for _, path := range c.pathNames() {
+			switch {
+			case p.seen[path]:
+			case overdue:
+				p.seen[path] = true // counted
+				st := c.paths[path]
+				st.OK, st.Missed = false, st.Missed+1
+				if p.sent.After(st.failedAt) {
+					st.failedAt = p.sent
+				}
+				c.missed.Inc(path)
+				c.ok.Set(0, path)
+			default:
+				done = false
+			}
+		}
+		if done {
+			delete(c.probes, seq)
+		}
+	}
+}
+
+// status reports each path's health, and whether all are ok.
+func (c *canary) status() (map[string]canaryPath, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out, ok := map[string]canaryPath{}, true
+	for name, p := range c.paths {
+		out[name] = *p
+		ok = ok && p.OK
+	}
+	return out, ok
+}
+
+// GET /readyz is 200 while the gateway is connected to NATS, isn't
+// draining and, with CANARY on, canary probes come back through every path;
+// 503 otherwise, with the failing checks. /healthz stays about this process
+// alone.
+func readyz(nc *nats.Conn, h *hub, c *canary) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		checks, failing := map[string]interface{}{}, []string{}
+		if st := nc.Status(); st != nats.CONNECTED {
+			failing = append(failing, "nats")
+			checks["nats"] = st.String()
+		} else {
+			checks["nats"] = "ok"
+		}
+		if h.draining() {
+			failing = append(failing, "draining")
+		}
+		if c != nil {
+			paths, ok := c.status()
+			checks["canary"] = paths
+			if !ok {
+				names := make([]string, 0, len(paths))
+				for name, p := range paths {
+					if !p.OK {
+						names = append(names, "canary."+name)
+					}
+				}
+				sort.Strings(names)
+				failing = append(failing, names...)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if len(failing) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"ready": len(failing) == 0, "failing": failing, "checks": checks})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/latency"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// clockSync is an NTP-style time service for robots.
+//
+// A robot sends {"t0": <its send time, ns>} to svc.{id}.time and gets back
+// t1 (backend receive) and t2 (backend transmit). With its own receive time
+// t3 it has one sample:
+//
+//	offset = ((t1 - t0) + (t2 - t3)) / 2   // backend clock minus robot clock
+//	rtt    = (t3 - t0) - (t2 - t1)
+//
+// After a burst of samples the robot posts them all to svc.{id}.time.report;
+// the backend keeps the lowest-RTT third (the least queuing-distorted), takes
+// the median offset of those and records it per robot.
+type clockSync struct {
+	kv nats.KeyValue
+}
+
+type clockSample struct {
+	T0 int64 `json:"t0"`
+	T1 int64 `json:"t1"`
+	T2 int64 `json:"t2"`
+	T3 int64 `json:"t3"`
+}
+
+func (s clockSample) offset() int64 { return ((s.T1 - s.T0) + (s.T2 - s.T3)) / 2 }
+func (s clockSample) rtt() int64    { return (s.T3 - s.T0) - (s.T2 - s.T1) }
+
+// clockEstimate is what gets recorded per robot.
+type clockEstimate struct {
+	OffsetNs int64     `json:"offset_ns"`
+	RTTNs    int64     `json:"rtt_ns"`
+	Samples  int       `json:"samples"`
+	Used     int       `json:"used"`
+	Measured time.Time `json:"measured"`
+}
+
+func newClockSync(js nats.JetStreamContext) (*clockSync, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: latency.ClockBucket, History: 20, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	return &clockSync{kv: kv}, nil
+}
+
+func (c *clockSync) serveTime(req micro.Request) {
+	t1 := time.Now().UnixNano()
+	var in struct {
+		T0 int64 `json:"t0"`
+	}
+	_ = json.Unmarshal(req.Data(), &in)
+	_ = req.RespondJSON(map[string]int64{"t0": in.T0, "t1": t1, "t2": time.Now().UnixNano()})
+}
+
+func (c *clockSync) serveReport(req micro.Request) {
+	var in struct {
+		Samples []clockSample `json:"samples"`
+	}
+	if err := json.Unmarshal(req.Data(), &in); err != nil {
+		_ = req.Error("400", "bad report: "+err.Error(), nil)
+		return
+	}
+	est, ok := estimateClock(in.Samples)
+	if !ok {
+		_ = req.Error("400", "no usable samples", nil)
+		return
+	}
+	b, _ := json.Marshal(est)
+	if _, err := c.kv.Put(svcRobotID(req), b); err != nil {
+		_ = req.Error("500", err.Error(), nil)
+		return
+	}
+	_ = req.Respond(b)
+}
+
+func estimateClock(samples []clockSample) (clockEstimate, bool) {
+	valid := make([]clockSample, 0, len(samples))
+	for _, s := range samples {
+		if s.T0 > 0 && s.T3 >= s.T0 && s.T2 >= s.T1 && s.rtt() >= 0 {
+			valid = append(valid, s)
+		}
+	}
+	if len(valid) == 0 {
+		return clockEstimate{}, false
+	}
+	sort.Slice(valid, func(i, j int) bool { return valid[i].rtt() < valid[j].rtt() })
+	best := valid[:(len(valid)+2)/3]
+
+	offsets := make([]int64, len(best))
+	for i, s := range best {
+		offsets[i] = s.offset()
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	return clockEstimate{
+		OffsetNs: offsets[len(offsets)/2],
+		RTTNs:    best[0].rtt(),
+		Samples:  len(samples),
+		Used:     len(best),
+		Measured: time.Now(),
+	}, true
+}
+
+// estimate returns the last recorded estimate for a robot.
+func (c *clockSync) estimate(id string) (*clockEstimate, error) {
+	e, err := c.kv.Get(id)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var est clockEstimate
+	return &est, json.Unmarshal(e.Value(), &est)
+}
+
+// GET /api/robots/{id}/clock returns the latest estimate plus recent history.
+func (c *clockSync) handleGet(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	hist, err := c.kv.History(id)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no clock measurements for robot", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := struct {
+		Latest  clockEstimate   `json:"latest"`
+		History []clockEstimate `json:"history"`
+	}{History: make([]clockEstimate, 0, len(hist))}
+	for _, e := range hist {
+		var est clockEstimate
+		if json.Unmarshal(e.Value(), &est) == nil {
+			out.History = append(out.History, est)
+		}
+	}
+	if len(out.History) > 0 {
+		out.Latest = out.History[len(out.History)-1]
+	}
+	writeJSON(w, out)
+}
@@ -0,0 +1,174 @@
+// enricher periodically fetches external context for every site in the SITES
+// bucket and publishes it as telemetry.site-{id}.weather with
+// "source":"external", so it is stored like robot telemetry (tagged
+// source=external) and can be queried and alerted on alongside it.
+//
+// Weather comes from Open-Meteo (no API key). Env: NATS_URL, ENRICH_EVERY
+// (default 10m), WEATHER_URL (default https://api.open-meteo.com/v1/forecast).
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func getenv(k, def string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return def
+}
+
+type site struct {
+	ID  string  `json:"id"`
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// Open-Meteo "current" variables and the field names they are stored under.
+var weatherFields = [][2]string{
+	{"temperature_2m", "temperature_c"},
+	{"relative_humidity_2m", "humidity_pct"},
+	{"precipitation", "precipitation_mm"},
+	{"rain", "rain_mm"},
+	{"wind_speed_10m", "wind_speed_ms"},
+	{"wind_gusts_10m", "wind_gust_ms"},
+	{"wind_direction_10m", "wind_dir_deg"},
+	{"cloud_cover", "cloud_pct"},
+	{"weather_code", "weather_code"},
+}
+
+type enricher struct {
+	js      nats.JetStreamContext
+	sites   nats.KeyValue
+	baseURL string
+	client  *http.Client
+}
+
+func (e *enricher) listSites() ([]site, error) {
+	w, err := e.sites.WatchAll(nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+	var out []site
+	for entry := range w.Updates() {
+		if entry == nil {
+			break
+		}
+		var s site
+		if json.Unmarshal(entry.Value(), &s) == nil && s.ID != "" {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+func (e *enricher) weather(ctx context.Context, s site) (time.Time, map[string]float64, error) {
+	vars := ""
+	for i, f := range weatherFields {
+		if i > 0 {
+			vars += ","
+		}
+		vars += f[0]
+	}
+	q := url.Values{
+		"latitude":        {strconv.FormatFloat(s.Lat, 'f', 4, 64)},
+		"longitude":       {strconv.FormatFloat(s.Lon, 'f', 4, 64)},
+		"current":         {vars},
+		"wind_speed_unit": {"ms"},
+		"timeformat":      {"unixtime"},
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", e.baseURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	res, err := e.client.Do(req)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return time.Time{}, nil, fmt.Errorf("weather: %s", res.Status)
+	}
+	var body struct {
+		Current map[string]float64 `json:"current"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return time.Time{}, nil, err
+	}
+	ts, ok := body.Current["time"]
+	if !ok {
+		return time.Time{}, nil, errors.New("weather: no current.time in response")
+	}
+	out := map[string]float64{}
+	for _, f := range weatherFields {
+		if v, ok := body.Current[f[0]]; ok {
+			out[f[1]] = v
+		}
+	}
+	return time.Unix(int64(ts), 0), out, nil
+}
+
+func (e *enricher) round(ctx context.Context) {
+	sites, err := e.listSites()
+	if err != nil {
+		log.Printf("sites: %v", err)
+		return
+	}
+	for _, s := range sites {
+		ts, fields, err := e.weather(ctx, s)
+		if err != nil {
+			log.Printf("site %s: %v", s.ID, err)
+			continue
+		}
+		msg, _ := json.Marshal(map[string]interface{}{
+			"ts_ns":  ts.UnixNano(),
+			"source": "external",
+			"topic":  "weather",
+			"data":   fields,
+		})
+		if _, err := e.js.Publish("telemetry.site-"+s.ID+".weather", msg); err != nil {
+			log.Printf("site %s: publish: %v", s.ID, err)
+		}
+	}
+	log.Printf("enriched %d sites", len(sites))
+}
+
+func main() {
+	every, err := time.ParseDuration(getenv("ENRICH_EVERY", "10m"))
+	if err != nil {
+		log.Fatalf("bad ENRICH_EVERY: %v", err)
+	}
+	nc, err := nats.Connect(getenv("NATS_URL", "nats://127.0.0.1:4222"), nats.Name("evabot-enricher"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer nc.Drain()
+	js, err := nc.JetStream()
+	if err != nil {
+		log.Fatal(err)
+	}
+	kv, err := js.KeyValue("SITES")
+	if err != nil {
+		log.Fatalf("SITES bucket (created by the gateway): %v", err)
+	}
+
+	e := &enricher{js: js, sites: kv, baseURL: getenv("WEATHER_URL", "https://api.open-meteo.com/v1/forecast"), client: &http.Client{Timeout: 20 * time.Second}}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		e.round(context.Background())
+		<-t.C
+	}
+}
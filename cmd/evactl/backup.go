@@ -0,0 +1,366 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// A backup is a gzipped tar of everything that isn't time series:
+//
+//	manifest.json          when, from where, and what is inside
+//	kv/{bucket}.json       bucket config and the latest value of every key
+//	obj/{bucket}.json      object store config and object metadata
+//	obj/{bucket}/{name}    object contents
+//	config.json            the configuration document (GET /api/config/export)
+//
+// KV buckets hold the robot registry, users and sessions, locks and e-stop
+// state, schedules and the rest of the metadata, so restoring them (into an
+// empty NATS, or over a damaged one) brings an environment back short of
+// its telemetry, which lives in Influx and the TELEMETRY stream.
+
+type backupManifest struct {
+	Created time.Time      `json:"created"`
+	NATS    string         `json:"nats"`
+	KV      map[string]int `json:"kv"`  // bucket → keys
+	Obj     map[string]int `json:"obj"` // bucket → objects
+	Config  bool           `json:"config"`
+}
+
+type kvBackup struct {
+	Config  nats.KeyValueConfig `json:"config"`
+	Entries []kvBackupEntry     `json:"entries"`
+}
+
+type kvBackupEntry struct {
+	Key     string    `json:"key"`
+	Value   []byte    `json:"value"`
+	Created time.Time `json:"created"`
+}
+
+type objBackup struct {
+	Config  nats.ObjectStoreConfig `json:"config"`
+	Objects []nats.ObjectMeta      `json:"objects"`
+}
+
+// bucketFilter parses -only; empty keeps everything.
+func bucketFilter(only string) func(string) bool {
+	if only == "" {
+		return func(string) bool { return true }
+	}
+	keep := map[string]bool{}
+	for _, b := range strings.Split(only, ",") {
+		keep[strings.TrimSpace(b)] = true
+	}
+	return func(b string) bool { return keep[b] }
+}
+
+func cmdBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := fs.String("o", "", "archive to write (default evabot-backup-{time}.tar.gz)")
+	only := fs.String("only", "", "back up only these buckets, e.g. ROBOTS,USERS")
+	withConfig := fs.Bool("config", true, "include the configuration document from the API")
+	fs.Parse(args)
+	if *out == "" {
+		*out = "evabot-backup-" + time.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+	}
+	keep := bucketFilter(*only)
+
+	nc, js, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	put := func(name string, b []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(b)), ModTime: time.Now()}); err != nil {
+			return err
+		}
+		_, err := tw.Write(b)
+		return err
+	}
+	putJSON := func(name string, v interface{}) error {
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return put(name, b)
+	}
+
+	m := backupManifest{Created: time.Now().UTC(), NATS: nc.ConnectedUrl(), KV: map[string]int{}, Obj: map[string]int{}}
+	var kvNames []string
+	for name := range js.KeyValueStoreNames() {
+		if keep(name) {
+			kvNames = append(kvNames, name)
+		}
+	}
+	sort.Strings(kvNames)
+	for _, name := range kvNames {
+		b, err := backupKV(js, name)
+		if err != nil {
+			return fmt.Errorf("kv %s: %w", name, err)
+		}
+		if err := putJSON("kv/"+name+".json", b); err != nil {
+			return err
+		}
+		m.KV[name] = len(b.Entries)
+	}
+
+	var objNames []string
+	for name := range js.ObjectStoreNames() {
+		if name = strings.TrimPrefix(name, "OBJ_"); keep(name) {
+			objNames = append(objNames, name)
+		}
+	}
+	sort.Strings(objNames)
+	for _, name := range objNames {
+		obj, err := js.ObjectStore(name)
+		if err != nil {
+			return fmt.Errorf("obj %s: %w", name, err)
+		}
+		info, err := js.StreamInfo("OBJ_" + name)
+		if err != nil {
+			return fmt.Errorf("obj %s: %w", name, err)
+		}
+		b := objBackup{Config: nats.ObjectStoreConfig{Bucket: name, Description: info.Config.Description,
+			TTL: info.Config.MaxAge, MaxBytes: info.Config.MaxBytes, Storage: info.Config.Storage, Replicas: info.Config.Replicas}}
+		list, err := obj.List()
+		if err != nil && !errors.Is(err, nats.ErrNoObjectsFound) {
+			return fmt.Errorf("obj %s: %w", name, err)
+		}
+		for _, o := range list {
+			data, err := obj.GetBytes(o.Name)
+			if err != nil {
+				return fmt.Errorf("obj %s/%s: %w", name, o.Name, err)
+			}
+			if err := put("obj/"+name+"/"+o.Name, data); err != nil {
+				return err
+			}
+			b.Objects = append(b.Objects, o.ObjectMeta)
+		}
+		if err := putJSON("obj/"+name+".json", b); err != nil {
+			return err
+		}
+		m.Obj[name] = len(b.Objects)
+	}
+
+	if *withConfig {
+		doc, err := api("GET", "/api/config/export", nil)
+		if err != nil {
+			return fmt.Errorf("config document (-config=false to skip): %w", err)
+		}
+		if err := put("config.json", doc); err != nil {
+			return err
+		}
+		m.Config = true
+	}
+
+	if err := putJSON("manifest.json", m); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s: %d KV buckets, %d object stores, config=%v\n", *out, len(m.KV), len(m.Obj), m.Config)
+	return f.Close()
+}
+
+// backupKV reads a bucket's config from its stream and the latest value of
+// every key.
+func backupKV(js nats.JetStreamContext, name string) (*kvBackup, error) {
+	info, err := js.StreamInfo("KV_" + name)
+	if err != nil {
+		return nil, err
+	}
+	c := info.Config
+	b := &kvBackup{Config: nats.KeyValueConfig{Bucket: name, Description: c.Description, MaxValueSize: c.MaxMsgSize,
+		History: uint8(c.MaxMsgsPerSubject), TTL: c.MaxAge, MaxBytes: c.MaxBytes, Storage: c.Storage, Replicas: c.Replicas},
+		Entries: []kvBackupEntry{}}
+	kv, err := js.KeyValue(name)
+	if err != nil {
+		return nil, err
+	}
+	w, err := kv.WatchAll(nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+	for e := range w.Updates() {
+		if e == nil {
+			break
+		}
+		b.Entries = append(b.Entries, kvBackupEntry{Key: e.Key(), Value: e.Value(), Created: e.Created()})
+	}
+	return b, nil
+}
+
+func cmdRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	only := fs.String("only", "", "restore only these buckets, e.g. ROBOTS,USERS")
+	overwrite := fs.Bool("overwrite", false, "replace keys and objects that exist (default: keep them)")
+	withConfig := fs.Bool("config", true, "import the configuration document through the API")
+	dryRun := fs.Bool("dry-run", false, "only report what would be restored")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: restore [-only a,b] [-overwrite] [-config=false] [-dry-run] <archive>")
+	}
+	keep := bucketFilter(*only)
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if files[h.Name], err = io.ReadAll(tr); err != nil {
+			return err
+		}
+	}
+	var m backupManifest
+	if err := json.Unmarshal(files["manifest.json"], &m); err != nil {
+		return fmt.Errorf("not an evactl backup (manifest.json): %w", err)
+	}
+	fmt.Printf("backup of %s taken %s\n", m.NATS, m.Created.Format(time.RFC3339))
+
+	nc, js, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	for _, name := range sortedKeys(m.KV) {
+		if !keep(name) {
+			continue
+		}
+		var b kvBackup
+		if err := json.Unmarshal(files["kv/"+name+".json"], &b); err != nil {
+			return fmt.Errorf("kv %s: %w", name, err)
+		}
+		put, skipped, err := restoreKV(js, &b, *overwrite, *dryRun)
+		if err != nil {
+			return fmt.Errorf("kv %s: %w", name, err)
+		}
+		fmt.Printf("kv  %-20s %d restored, %d kept\n", name, put, skipped)
+	}
+
+	for _, name := range sortedKeys(m.Obj) {
+		if !keep(name) {
+			continue
+		}
+		var b objBackup
+		if err := json.Unmarshal(files["obj/"+name+".json"], &b); err != nil {
+			return fmt.Errorf("obj %s: %w", name, err)
+		}
+		put, skipped := 0, 0
+		obj, err := js.ObjectStore(name)
+		if errors.Is(err, nats.ErrStreamNotFound) || errors.Is(err, nats.ErrBucketNotFound) {
+			if !*dryRun {
+				obj, err = js.CreateObjectStore(&b.Config)
+			} else {
+				err = nil
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("obj %s: %w", name, err)
+		}
+		for _, meta := range b.Objects {
+			if obj != nil && !*overwrite {
+				if _, err := obj.GetInfo(meta.Name); err == nil {
+					skipped++
+					continue
+				}
+			}
+			if !*dryRun {
+				meta := meta
+				if _, err := obj.Put(&meta, bytes.NewReader(files[path.Join("obj", name, meta.Name)])); err != nil {
+					return fmt.Errorf("obj %s/%s: %w", name, meta.Name, err)
+				}
+			}
+			put++
+		}
+		fmt.Printf("obj %-20s %d restored, %d kept\n", name, put, skipped)
+	}
+
+	if m.Config && *withConfig {
+		b, err := api("POST", fmt.Sprintf("/api/config/import?dry_run=%v", *dryRun), bytes.NewReader(files["config.json"]))
+		if err != nil {
+			return fmt.Errorf("config document (-config=false to skip): %w", err)
+		}
+		fmt.Println("config document:")
+		return printJSON(b)
+	}
+	return nil
+}
+
+// restoreKV creates the bucket if it is missing and puts its keys back.
+func restoreKV(js nats.JetStreamContext, b *kvBackup, overwrite, dryRun bool) (put, skipped int, err error) {
+	kv, err := js.KeyValue(b.Config.Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		if dryRun {
+			return len(b.Entries), 0, nil
+		}
+		kv, err = js.CreateKeyValue(&b.Config)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, e := range b.Entries {
+		if !overwrite {
+			if _, err := kv.Get(e.Key); err == nil {
+				skipped++
+				continue
+			}
+		}
+		if !dryRun {
+			if _, err := kv.Put(e.Key, e.Value); err != nil {
+				return put, skipped, fmt.Errorf("%s: %w", e.Key, err)
+			}
+		}
+		put++
+	}
+	return put, skipped, nil
+}
+
+func sortedKeys(m map[string]int) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+)
+
+const layoutUsage = "usage: layout status | begin [-window 168h] <file|-> | compare [-start -1h] | cutover [-force] | abort | finish"
+
+// cmdLayout walks a change of the Influx layout of telemetry through its
+// phases: begin dual-writes the layout in file next to the current one,
+// compare counts both sides, cutover switches writes and reads over, and
+// finish forgets the old layout once its data has aged out.
+func cmdLayout(args []string) error {
+	if len(args) == 0 {
+		return errors.New(layoutUsage)
+	}
+	var b []byte
+	var err error
+	switch verb, rest := args[0], args[1:]; verb {
+	case "status":
+		b, err = api("GET", "/api/layouts", nil)
+	case "begin":
+		fs := flag.NewFlagSet("layout begin", flag.ExitOnError)
+		window := fs.String("window", "168h", "how long to dual-write before cutover is allowed without -force")
+		fs.Parse(rest)
+		if fs.NArg() != 1 {
+			return errors.New(layoutUsage)
+		}
+		doc, err := readDoc(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		l, err := io.ReadAll(doc)
+		if err != nil {
+			return err
+		}
+		body, err := json.Marshal(map[string]interface{}{"layout": json.RawMessage(l), "window": *window})
+		if err != nil {
+			return fmt.Errorf("%s: not JSON: %w", fs.Arg(0), err)
+		}
+		b, err = api("POST", "/api/layouts/begin", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+	case "compare":
+		fs := flag.NewFlagSet("layout compare", flag.ExitOnError)
+		start := fs.String("start", "-1h", "count points from")
+		fs.Parse(rest)
+		b, err = api("GET", "/api/layouts/compare?start="+url.QueryEscape(*start), nil)
+	case "cutover":
+		fs := flag.NewFlagSet("layout cutover", flag.ExitOnError)
+		force := fs.Bool("force", false, "cut over before the transition window is over")
+		fs.Parse(rest)
+		b, err = api("POST", fmt.Sprintf("/api/layouts/cutover?force=%v", *force), nil)
+	case "abort", "finish":
+		b, err = api("POST", "/api/layouts/"+verb, nil)
+	default:
+		return errors.New(layoutUsage)
+	}
+	if err != nil {
+		return err
+	}
+	return printJSON(b)
+}
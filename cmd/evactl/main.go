@@ -0,0 +1,350 @@
+// evactl is the operator CLI for the evabot backend. It wraps the admin HTTP
+// API (EVA_API, default http://127.0.0.1:8080) and, for stream-level work,
+// talks to NATS directly (NATS_URL). EVA_TOKEN is sent as the bearer token.
+//
+//	evactl robots [-archived false|true|all]
+//	evactl tail [subject]              (default telemetry.>)
+//	evactl top [-fields a,b] [-n 4]
+//	evactl send <robot> <command> [params json]
+//	evactl lag
+//	evactl purge-quarantine [-subject quarantine.r1.>]
+//	evactl export > env.json
+//	evactl import [-dry-run] env.json
+//	evactl diff [-apply] env.json
+//	evactl backup [-o file] [-only a,b] [-config=false]
+//	evactl restore [-only a,b] [-overwrite] [-config=false] [-dry-run] file
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func getenv(k, def string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return def
+}
+
+var apiBase = strings.TrimRight(getenv("EVA_API", "http://127.0.0.1:8080"), "/")
+
+var verbs = map[string]func(args []string) error{
+	"robots":           cmdRobots,
+	"tail":             cmdTail,
+	"top":              cmdTop,
+	"send":             cmdSend,
+	"lag":              cmdLag,
+	"purge-quarantine": cmdPurgeQuarantine,
+	"export":           cmdExport,
+	"import":           cmdImport,
+	"diff":             cmdDiff,
+	"backup":           cmdBackup,
+	"restore":          cmdRestore,
+	"layout":           cmdLayout,
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: evactl <command> [args]
+
+commands:
+  robots [-archived false|true|all]   list registered robots
+  tail [subject]                      print live messages (default telemetry.>)
+  top [-fields a,b] [-n 4]            live per-robot rates, fields, lag and events
+  send <robot> <command> [params]     send a command to a robot
+  lag                                 show consumer lag for the worker and robots
+  purge-quarantine [-subject s]       drop quarantined messages
+  export                              print the configuration document
+  import [-dry-run] <file|->          import a configuration document
+  diff [-apply] <file>                compare a document with this environment
+  backup [-o file] [-only a,b]        archive KV buckets, object stores and config
+  restore [-overwrite] [-dry-run] <f> restore an archive from backup
+  layout status|begin|compare|cutover|abort|finish
+                                      change the Influx layout of telemetry`)
+	os.Exit(2)
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+	run, ok := verbs[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	if err := run(os.Args[2:]); err != nil {
+		log.Fatalf("evactl %s: %v", os.Args[1], err)
+	}
+}
+
+// api calls the backend and returns the response body, failing on non-2xx.
+func api(method, path string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, apiBase+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if tok := os.Getenv("EVA_TOKEN"); tok != "" {
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, res.Status, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
+
+func printJSON(b []byte) error {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, b, "", "  "); err != nil {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err := buf.WriteTo(os.Stdout)
+	return err
+}
+
+func connect() (*nats.Conn, nats.JetStreamContext, error) {
+	nc, err := nats.Connect(getenv("NATS_URL", "nats://127.0.0.1:4222"), nats.Name("evactl"))
+	if err != nil {
+		return nil, nil, err
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+	return nc, js, nil
+}
+
+func cmdRobots(args []string) error {
+	fs := flag.NewFlagSet("robots", flag.ExitOnError)
+	archived := fs.String("archived", "false", "false, true or all")
+	fs.Parse(args)
+
+	b, err := api("GET", "/api/robots?archived="+url.QueryEscape(*archived), nil)
+	if err != nil {
+		return err
+	}
+	var robots []struct {
+		ID       string            `json:"id"`
+		Group    string            `json:"group"`
+		Versions map[string]string `json:"versions"`
+		Drift    []string          `json:"drift"`
+		Archived bool              `json:"archived"`
+		Updated  time.Time         `json:"updated"`
+	}
+	if err := json.Unmarshal(b, &robots); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tGROUP\tVERSIONS\tDRIFT\tARCHIVED\tUPDATED")
+	for _, r := range robots {
+		vers := make([]string, 0, len(r.Versions))
+		for k, v := range r.Versions {
+			vers = append(vers, k+"="+v)
+		}
+		sort.Strings(vers)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%v\t%s\n", r.ID, r.Group, strings.Join(vers, ","), strings.Join(r.Drift, ","), r.Archived, r.Updated.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+func cmdTail(args []string) error {
+	subject := "telemetry.>"
+	if len(args) > 0 {
+		subject = args[0]
+	}
+	nc, _, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	if _, err := nc.Subscribe(subject, func(msg *nats.Msg) {
+		fmt.Printf("%s %s %s\n", time.Now().Format("15:04:05.000"), msg.Subject, msg.Data)
+	}); err != nil {
+		return err
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+	return nil
+}
+
+// cmdSend goes through the API, as a command from the UI does, so lockout,
+// throttling, payload checks, audit and delivery tracking apply.
+func cmdSend(args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return errors.New("usage: send <robot> <command> [params json]")
+	}
+	robot, name := args[0], args[1]
+	params := json.RawMessage("{}")
+	if len(args) == 3 {
+		params = json.RawMessage(args[2])
+		if !json.Valid(params) {
+			return errors.New("params must be JSON")
+		}
+	}
+
+	if name == "estop" {
+		_, err := api("POST", "/api/robot/"+url.PathEscape(robot)+"/estop", nil)
+		if err == nil {
+			fmt.Println("e-stop sent")
+		}
+		return err
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"name": name, "params": params})
+	b, err := api("POST", "/api/robot/"+url.PathEscape(robot)+"/cmd", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	var out struct {
+		Seq     uint64 `json:"seq"`
+		Subject string `json:"subject"`
+		State   string `json:"state"`
+		ID      string `json:"id"`
+		Kind    string `json:"kind"` // an approval's
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return err
+	}
+	if out.Kind != "" {
+		fmt.Printf("awaiting approval %s\n", out.ID)
+		return nil
+	}
+	fmt.Printf("sent %s seq=%d (%s)\n", out.Subject, out.Seq, out.State)
+	return nil
+}
+
+func cmdLag(_ []string) error {
+	nc, js, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STREAM\tCONSUMER\tPENDING\tACK PENDING\tREDELIVERED\tLAST ACTIVE")
+	for _, stream := range []string{"TELEMETRY", "CTRL"} {
+		for ci := range js.ConsumersInfo(stream) {
+			last := "-"
+			if ci.Delivered.Last != nil {
+				last = time.Since(*ci.Delivered.Last).Truncate(time.Second).String() + " ago"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%s\n", stream, ci.Name, ci.NumPending, ci.NumAckPending, ci.NumRedelivered, last)
+		}
+	}
+	return tw.Flush()
+}
+
+func cmdPurgeQuarantine(args []string) error {
+	fs := flag.NewFlagSet("purge-quarantine", flag.ExitOnError)
+	subject := fs.String("subject", "", "only purge this subject filter, e.g. quarantine.r1.>")
+	fs.Parse(args)
+
+	nc, js, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	before, err := js.StreamInfo("QUARANTINE")
+	if err != nil {
+		return err
+	}
+	var req *nats.StreamPurgeRequest
+	if *subject != "" {
+		req = &nats.StreamPurgeRequest{Subject: *subject}
+	}
+	if err := js.PurgeStream("QUARANTINE", req); err != nil {
+		return err
+	}
+	after, err := js.StreamInfo("QUARANTINE")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("purged %d messages\n", before.State.Msgs-after.State.Msgs)
+	return nil
+}
+
+func cmdExport(_ []string) error {
+	b, err := api("GET", "/api/config/export", nil)
+	if err != nil {
+		return err
+	}
+	return printJSON(b)
+}
+
+// readDoc reads a document argument, "-" meaning stdin.
+func readDoc(path string) (io.Reader, error) {
+	if path == "-" {
+		return os.Stdin, nil
+	}
+	b, err := os.ReadFile(path)
+	return bytes.NewReader(b), err
+}
+
+func cmdImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only report what would change")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: import [-dry-run] <file|->")
+	}
+	doc, err := readDoc(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := api("POST", fmt.Sprintf("/api/config/import?dry_run=%v", *dryRun), doc)
+	if err != nil {
+		return err
+	}
+	return printJSON(b)
+}
+
+func cmdDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	apply := fs.Bool("apply", false, "promote the document into this environment")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: diff [-apply] <file|->")
+	}
+	doc, err := readDoc(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := api("POST", fmt.Sprintf("/api/config/diff?apply=%v", *apply), doc)
+	if err != nil {
+		return err
+	}
+	return printJSON(b)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// topRobot is what `evactl top` tracks per robot.
+type topRobot struct {
+	count    int64 // messages in the current second
+	rate     float64
+	total    int64
+	lastSeen time.Time
+	fields   map[string]float64
+	updated  map[string]time.Time
+}
+
+type topState struct {
+	mu     sync.Mutex
+	robots map[string]*topRobot
+	events []string
+}
+
+func (s *topState) robot(id string) *topRobot {
+	r := s.robots[id]
+	if r == nil {
+		r = &topRobot{fields: map[string]float64{}, updated: map[string]time.Time{}}
+		s.robots[id] = r
+	}
+	return r
+}
+
+func (s *topState) onTelemetry(msg *nats.Msg) {
+	parts := strings.SplitN(msg.Subject, ".", 3)
+	if len(parts) < 2 {
+		return
+	}
+	var m map[string]interface{}
+	_ = json.Unmarshal(msg.Data, &m)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.robot(parts[1])
+	r.count++
+	r.total++
+	r.lastSeen = now
+	flat := map[string]interface{}{}
+	if dv, ok := m["data"].(map[string]interface{}); ok {
+		for k, v := range dv {
+			flat[k] = v
+		}
+	}
+	for k, v := range m {
+		flat[k] = v
+	}
+	for k, v := range flat {
+		if f, ok := v.(float64); ok && k != "ts_ns" {
+			r.fields[k] = f
+			r.updated[k] = now
+		}
+	}
+}
+
+func (s *topState) onEvent(msg *nats.Msg) {
+	line := fmt.Sprintf("%s %s %s", time.Now().Format("15:04:05"), strings.TrimPrefix(msg.Subject, "events."), msg.Data)
+	if len(line) > 160 {
+		line = line[:157] + "..."
+	}
+	s.mu.Lock()
+	s.events = append(s.events, line)
+	if len(s.events) > 8 {
+		s.events = s.events[len(s.events)-8:]
+	}
+	s.mu.Unlock()
+}
+
+// tick folds the last second's counts into a smoothed rate.
+func (s *topState) tick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.robots {
+		r.rate = 0.7*r.rate + 0.3*float64(r.count)
+		r.count = 0
+	}
+}
+
+func cmdTop(args []string) error {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	fieldList := fs.String("fields", "", "comma-separated fields to show (default: most recently updated)")
+	nFields := fs.Int("n", 4, "number of fields to show when -fields is not set")
+	fs.Parse(args)
+	var pinned []string
+	if *fieldList != "" {
+		pinned = strings.Split(*fieldList, ",")
+	}
+
+	nc, js, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	st := &topState{robots: map[string]*topRobot{}}
+	if _, err := nc.Subscribe("telemetry.>", st.onTelemetry); err != nil {
+		return err
+	}
+	if _, err := nc.Subscribe("events.>", st.onEvent); err != nil {
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	fmt.Print("\x1b[?25l") // hide cursor
+	defer fmt.Print("\x1b[?25h\n")
+	for {
+		select {
+		case <-sig:
+			return nil
+		case <-t.C:
+			st.tick()
+			st.render(js, pinned, *nFields)
+		}
+	}
+}
+
+func (s *topState) render(js nats.JetStreamContext, pinned []string, n int) {
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&b, "evactl top — %s   (ctrl-c to quit)\n\n", time.Now().Format("15:04:05"))
+
+	if ci, err := js.ConsumerInfo("TELEMETRY", "telem-worker"); err == nil {
+		fmt.Fprintf(&b, "worker lag: %d pending, %d awaiting ack, %d redelivered\n\n", ci.NumPending, ci.NumAckPending, ci.NumRedelivered)
+	} else {
+		fmt.Fprintf(&b, "worker lag: %v\n\n", err)
+	}
+
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.robots))
+	for id := range s.robots {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	fmt.Fprintf(&b, "%-20s %8s %10s %9s  %s\n", "ROBOT", "MSG/S", "TOTAL", "AGE", "FIELDS")
+	for _, id := range ids {
+		r := s.robots[id]
+		fields := pinned
+		if fields == nil {
+			fields = make([]string, 0, len(r.fields))
+			for k := range r.fields {
+				fields = append(fields, k)
+			}
+			sort.Slice(fields, func(i, j int) bool {
+				if !r.updated[fields[i]].Equal(r.updated[fields[j]]) {
+					return r.updated[fields[i]].After(r.updated[fields[j]])
+				}
+				return fields[i] < fields[j]
+			})
+			if len(fields) > n {
+				fields = fields[:n]
+			}
+		}
+		vals := make([]string, 0, len(fields))
+		for _, f := range fields {
+			if v, ok := r.fields[f]; ok {
+				vals = append(vals, fmt.Sprintf("%s=%.4g", f, v))
+			}
+		}
+		age := time.Since(r.lastSeen).Truncate(100 * time.Millisecond)
+		fmt.Fprintf(&b, "%-20s %8.1f %10d %9s  %s\n", id, r.rate, r.total, age, strings.Join(vals, " "))
+	}
+
+	b.WriteString("\nrecent events:\n")
+	for _, e := range s.events {
+		b.WriteString("  " + e + "\n")
+	}
+	s.mu.Unlock()
+	fmt.Print(b.String())
+}
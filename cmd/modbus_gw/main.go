@@ -0,0 +1,252 @@
+// modbus_gw exposes selected latest telemetry values as Modbus TCP registers
+// so factory SCADA systems can show robot status. It is read-only: writes are
+// refused. The register map is a JSON file (MODBUS_MAP):
+//
+//	{
+//	  "unit_id": 1,
+//	  "stale_after": "30s",
+//	  "registers": [
+//	    {"address": 0, "robot": "r1", "field": "battery_pct", "type": "uint16", "scale": 10},
+//	    {"address": 1, "robot": "r1", "field": "speed", "type": "float32"},
+//	    {"address": 3, "robot": "r1", "field": "_online"}
+//	  ]
+//	}
+//
+// Types are uint16, int16 (one register), uint32, int32 and float32 (two
+// registers, high word first). Values are multiplied by scale (default 1)
+// before integer conversion and saturate at the type's range. The pseudo
+// fields _online (1 if seen within stale_after) and _age_s report freshness;
+// stale values keep their last reading. Unmapped registers inside the mapped
+// range read as 0; reads beyond it are ILLEGAL DATA ADDRESS.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/nats-io/nats.go"
+)
+
+func getenv(k, def string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return def
+}
+
+type registerMapping struct {
+	Address uint16  `json:"address"`
+	Robot   string  `json:"robot"`
+	Field   string  `json:"field"`
+	Type    string  `json:"type"`
+	Scale   float64 `json:"scale"`
+}
+
+type registerMap struct {
+	UnitID     byte              `json:"unit_id"`
+	StaleAfter string            `json:"stale_after"`
+	Registers  []registerMapping `json:"registers"`
+
+	stale time.Duration
+	top   uint16
+	byReg map[uint16]int // first register → index into Registers
+}
+
+func registerWidth(typ string) (int, error) {
+	switch typ {
+	case "", "uint16", "int16":
+		return 1, nil
+	case "uint32", "int32", "float32":
+		return 2, nil
+	}
+	return 0, fmt.Errorf("unknown register type %q", typ)
+}
+
+func loadRegisterMap(path string) (*registerMap, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m registerMap
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	if m.UnitID == 0 {
+		m.UnitID = 1
+	}
+	m.stale = 30 * time.Second
+	if m.StaleAfter != "" {
+		if m.stale, err = time.ParseDuration(m.StaleAfter); err != nil {
+			return nil, fmt.Errorf("bad stale_after: %w", err)
+		}
+	}
+	used := map[uint16]string{}
+	m.byReg = map[uint16]int{}
+	for i, r := range m.Registers {
+		if r.Robot == "" || r.Field == "" {
+			return nil, fmt.Errorf("register %d: robot and field are required", r.Address)
+		}
+		if r.Scale == 0 {
+			m.Registers[i].Scale = 1
+		}
+		w, err := registerWidth(r.Type)
+		if err != nil {
+			return nil, fmt.Errorf("register %d: %w", r.Address, err)
+		}
+		for k := 0; k < w; k++ {
+			a := r.Address + uint16(k)
+			if prev, dup := used[a]; dup {
+				return nil, fmt.Errorf("register %d: overlaps %s", a, prev)
+			}
+			used[a] = r.Robot + "/" + r.Field
+			if a+1 > m.top {
+				m.top = a + 1
+			}
+		}
+		m.byReg[r.Address] = i
+	}
+	return &m, nil
+}
+
+// latest holds the most recent value of every mapped field.
+type latest struct {
+	m *registerMap
+
+	mu     sync.RWMutex
+	values map[string]float64 // robot/field
+	seen   map[string]time.Time
+}
+
+func (l *latest) onTelemetry(msg *nats.Msg) {
+	robot := telem.RobotID(msg.Subject)
+	p, err := telem.Decode(msg.Subject, msg.Data, time.Now(), time.Now())
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seen[robot] = time.Now()
+	for k, v := range p.Fields {
+		switch f := v.(type) {
+		case float64:
+			l.values[robot+"/"+k] = f
+		case bool:
+			l.values[robot+"/"+k] = 0
+			if f {
+				l.values[robot+"/"+k] = 1
+			}
+		}
+	}
+}
+
+func (l *latest) value(r registerMapping, now time.Time) float64 {
+	seen := l.seen[r.Robot]
+	switch r.Field {
+	case "_online":
+		if !seen.IsZero() && now.Sub(seen) <= l.m.stale {
+			return 1
+		}
+		return 0
+	case "_age_s":
+		if seen.IsZero() {
+			return math.Inf(1)
+		}
+		return now.Sub(seen).Seconds()
+	}
+	return l.values[r.Robot+"/"+r.Field]
+}
+
+func (l *latest) read(unit byte, addr, qty uint16) ([]uint16, bool) {
+	if unit != l.m.UnitID && unit != 0xFF {
+		return nil, false
+	}
+	if uint32(addr)+uint32(qty) > uint32(l.m.top) {
+		return nil, false
+	}
+	// render every mapping the range touches, then cut the window out
+	out := make([]uint16, qty)
+	now := time.Now()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for a := int(addr) - 1; a < int(addr)+int(qty); a++ {
+		if a < 0 {
+			continue
+		}
+		i, ok := l.m.byReg[uint16(a)]
+		if !ok {
+			continue
+		}
+		r := l.m.Registers[i]
+		for k, w := range encodeRegister(r.Type, l.value(r, now)*r.Scale) {
+			pos := a + k - int(addr)
+			if pos >= 0 && pos < int(qty) {
+				out[pos] = w
+			}
+		}
+	}
+	return out, true
+}
+
+func encodeRegister(typ string, v float64) []uint16 {
+	clamp := func(lo, hi float64) float64 {
+		if math.IsNaN(v) {
+			return 0
+		}
+		return math.Max(lo, math.Min(hi, math.Round(v)))
+	}
+	switch typ {
+	case "int16":
+		return []uint16{uint16(int16(clamp(math.MinInt16, math.MaxInt16)))}
+	case "uint32":
+		u := uint32(clamp(0, math.MaxUint32))
+		return []uint16{uint16(u >> 16), uint16(u)}
+	case "int32":
+		u := uint32(int32(clamp(math.MinInt32, math.MaxInt32)))
+		return []uint16{uint16(u >> 16), uint16(u)}
+	case "float32":
+		u := math.Float32bits(float32(v))
+		return []uint16{uint16(u >> 16), uint16(u)}
+	default: // uint16
+		return []uint16{uint16(clamp(0, math.MaxUint16))}
+	}
+}
+
+func main() {
+	m, err := loadRegisterMap(getenv("MODBUS_MAP", "modbus_map.json"))
+	if err != nil {
+		log.Fatalf("register map: %v", err)
+	}
+
+	natsURL := getenv("NATS_URL", "nats://127.0.0.1:4222")
+	nc, err := nats.Connect(natsURL, nats.Name("evabot-modbus-gw"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer nc.Drain()
+
+	l := &latest{m: m, values: map[string]float64{}, seen: map[string]time.Time{}}
+	robots := map[string]bool{}
+	for _, r := range m.Registers {
+		if !robots[r.Robot] {
+			robots[r.Robot] = true
+			if _, err := nc.Subscribe("telemetry."+r.Robot+".>", l.onTelemetry); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	addr := getenv("MODBUS_BIND", ":1502")
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("modbus gateway on %s: %d mappings for %d robots, unit %d (read-only)", addr, len(m.Registers), len(robots), m.UnitID)
+	log.Fatal(serveModbus(ln, l))
+}
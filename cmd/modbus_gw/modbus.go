@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// Modbus function and exception codes this server knows.
+const (
+	fcReadHoldingRegisters = 0x03
+	fcReadInputRegisters   = 0x04
+
+	exIllegalFunction    = 0x01
+	exIllegalDataAddress = 0x02
+	exIllegalDataValue   = 0x03
+)
+
+// registerSource answers reads of quantity registers starting at addr; ok is
+// false when the range falls outside the map.
+type registerSource interface {
+	read(unit byte, addr, quantity uint16) (regs []uint16, ok bool)
+}
+
+// serveModbus accepts Modbus TCP clients until the listener closes. Only reads
+// (FC 3 and 4, which see the same table) are implemented; every write function
+// is refused with ILLEGAL FUNCTION, so SCADA can look but not touch.
+func serveModbus(ln net.Listener, src registerSource) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handleModbusConn(c, src)
+	}
+}
+
+func handleModbusConn(c net.Conn, src registerSource) {
+	defer c.Close()
+	hdr := make([]byte, 7)
+	for {
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		if _, err := io.ReadFull(c, hdr); err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("modbus %s: %v", c.RemoteAddr(), err)
+			}
+			return
+		}
+		tid := binary.BigEndian.Uint16(hdr[0:2])
+		proto := binary.BigEndian.Uint16(hdr[2:4])
+		length := binary.BigEndian.Uint16(hdr[4:6])
+		unit := hdr[6]
+		if proto != 0 || length < 2 || length > 254 {
+			log.Printf("modbus %s: bad MBAP header", c.RemoteAddr())
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(c, pdu); err != nil {
+			return
+		}
+
+		resp := modbusPDU(unit, pdu, src)
+		out := make([]byte, 7, 7+len(resp))
+		binary.BigEndian.PutUint16(out[0:2], tid)
+		binary.BigEndian.PutUint16(out[4:6], uint16(len(resp)+1))
+		out[6] = unit
+		out = append(out, resp...)
+		_ = c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := c.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+func modbusPDU(unit byte, pdu []byte, src registerSource) []byte {
+	fc := pdu[0]
+	exception := func(code byte) []byte { return []byte{fc | 0x80, code} }
+
+	switch fc {
+	case fcReadHoldingRegisters, fcReadInputRegisters:
+	default:
+		return exception(exIllegalFunction)
+	}
+	if len(pdu) != 5 {
+		return exception(exIllegalDataValue)
+	}
+	addr := binary.BigEndian.Uint16(pdu[1:3])
+	qty := binary.BigEndian.Uint16(pdu[3:5])
+	if qty == 0 || qty > 125 {
+		return exception(exIllegalDataValue)
+	}
+	regs, ok := src.read(unit, addr, qty)
+	if !ok {
+		return exception(exIllegalDataAddress)
+	}
+	out := make([]byte, 2, 2+2*len(regs))
+	out[0] = fc
+	out[1] = byte(2 * len(regs))
+	for _, r := range regs {
+		out = binary.BigEndian.AppendUint16(out, r)
+	}
+	return out
+}
@@ -0,0 +1,6 @@
+package main
+
+// Customer decoders and transforms are linked in here with blank imports and
+// selected with DECODERS/TRANSFORMS (see internal/plugin), e.g.
+//
+//	import _ "example.com/acme/evabot-can"
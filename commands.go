@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// Command states as reported by the API.
+const (
+	cmdPending  = "pending"
+	cmdAcked    = "acked"
+	cmdCanceled = "canceled"
+)
+
+// command is what the gateway remembers about every message it put on CTRL
+// for a robot, keyed {robot}.{stream seq} in the CTRL_CMDS bucket.
+type command struct {
+	Seq       uint64    `json:"seq"`
+	Robot     string    `json:"robot"`
+	Subject   string    `json:"subject"`
+	Published time.Time `json:"published"`
+	Canceled  bool      `json:"canceled,omitempty"`
+	State     string    `json:"state"` // computed on read
+}
+
+// commands publishes robot commands to CTRL and tracks their delivery.
+//
+// Each robot consumes its commands through a durable consumer named
+// robot-{id} (filter ctrl.{id}.>, explicit ack), created here before the first
+// command is sent, so commands queue while the robot is offline instead of
+// vanishing. A command counts as delivered once the robot acked it, i.e. its
+// sequence is at or below the consumer's ack floor.
+type commands struct {
+	js    nats.JetStreamContext
+	kv    nats.KeyValue
+	proto *protocols // if set, adapts payloads to older robots
+}
+
+func newCommands(js nats.JetStreamContext) (*commands, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "CTRL_CMDS", TTL: 7 * 24 * time.Hour, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	return &commands{js: js, kv: kv}, nil
+}
+
+func robotConsumer(id string) string { return "robot-" + id }
+
+func (c *commands) ensureConsumer(id string) error {
+	_, err := c.js.ConsumerInfo("CTRL", robotConsumer(id))
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		_, err = c.js.AddConsumer("CTRL", &nats.ConsumerConfig{
+			Durable:       robotConsumer(id),
+			FilterSubject: "ctrl." + id + ".>",
+			AckPolicy:     nats.AckExplicitPolicy,
+			DeliverPolicy: nats.DeliverNewPolicy,
+		})
+	}
+	return err
+}
+
+// publish sends a command to ctrl.{id}.{name} and records it as pending.
+func (c *commands) publish(id, name string, payload []byte) (*command, error) {
+	if err := c.ensureConsumer(id); err != nil {
+		return nil, err
+	}
+	p := c.plan(id, name, payload)
+	ack, err := c.js.Publish(p.Subject, p.Payload)
+	if err != nil {
+		return nil, err
+	}
+	cmd := &command{Seq: ack.Sequence, Robot: id, Subject: p.Subject, Published: time.Now(), State: cmdPending}
+	b, _ := json.Marshal(cmd)
+	if _, err := c.kv.Put(cmdKey(id, ack.Sequence), b); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// plannedCommand is a message a dry run would have published.
+type plannedCommand struct {
+	Robot   string          `json:"robot,omitempty"`
+	Subject string          `json:"subject"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// plan is what publish would put on CTRL for robot id, as that robot's
+// protocol has it, without sending anything.
+func (c *commands) plan(id, name string, payload []byte) plannedCommand {
+	if c.proto != nil {
+		payload = c.proto.shimCommand(id, payload)
+	}
+	return plannedCommand{Robot: id, Subject: "ctrl." + id + "." + name, Payload: payload}
+}
+
+// dryRun reports whether req asks, with ?dryRun=true, to be checked and
+// planned but not carried out. Such a request is answered 200 with what
+// would have been sent, instead of sending it.
+func dryRun(req *http.Request) (bool, error) {
+	switch req.URL.Query().Get("dryRun") {
+	case "", "0", "false":
+		return false, nil
+	case "1", "true":
+		return true, nil
+	}
+	return false, errors.New("bad dryRun (true or false)")
+}
+
+// writePlan answers a dry run with the messages it would have published.
+func writePlan(w http.ResponseWriter, plan ...plannedCommand) {
+	writeJSON(w, map[string]interface{}{"dry_run": true, "messages": plan})
+}
+
+func cmdKey(id string, seq uint64) string { return id + "." + strconv.FormatUint(seq, 10) }
+
+// ackFloor is the highest stream sequence the robot has acked everything up to.
+func (c *commands) ackFloor(id string) (uint64, error) {
+	info, err := c.js.ConsumerInfo("CTRL", robotConsumer(id))
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.AckFloor.Stream, nil
+}
+
+func (c *commands) list(id string) ([]command, error) {
+	floor, err := c.ackFloor(id)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := kvKeys(c.kv, id+".>")
+	if err != nil {
+		return nil, err
+	}
+
+	out := []command{}
+	for _, k := range keys {
+		e, err := c.kv.Get(k)
+		if err != nil {
+			continue // expired or deleted meanwhile
+		}
+		var cmd command
+		if json.Unmarshal(e.Value(), &cmd) != nil {
+			continue
+		}
+		switch {
+		case cmd.Canceled:
+			cmd.State = cmdCanceled
+		case cmd.Seq <= floor:
+			cmd.State = cmdAcked
+		default:
+			cmd.State = cmdPending
+		}
+		out = append(out, cmd)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Seq < out[j].Seq })
+	return out, nil
+}
+
+// GET /api/robot/{id}/commands?state=pending
+func (c *commands) handleList(w http.ResponseWriter, req *http.Request) {
+	all, err := c.list(chi.URLParam(req, "id"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	state := req.URL.Query().Get("state")
+	out := make([]command, 0, len(all))
+	for _, cmd := range all {
+		if state == "" || cmd.State == state {
+			out = append(out, cmd)
+		}
+	}
+	writeJSON(w, out)
+}
+
+// DELETE /api/robot/{id}/commands/{seq} removes a not-yet-acked command from
+// CTRL so the robot never receives it.
+func (c *commands) handleCancel(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	seq, err := strconv.ParseUint(chi.URLParam(req, "seq"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad seq", 400)
+		return
+	}
+	e, err := c.kv.Get(cmdKey(id, seq))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such command", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	floor, err := c.ackFloor(id)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if seq <= floor {
+		http.Error(w, "command already delivered", http.StatusConflict)
+		return
+	}
+
+	if err := c.js.DeleteMsg("CTRL", seq); err != nil && !errors.Is(err, nats.ErrMsgNotFound) {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var cmd command
+	_ = json.Unmarshal(e.Value(), &cmd)
+	cmd.Canceled = true
+	cmd.State = cmdCanceled
+	b, _ := json.Marshal(cmd)
+	if _, err := c.kv.Put(cmdKey(id, seq), b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, cmd)
+}
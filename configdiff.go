@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+)
+
+// resourceDiff is the drift of one resource between a source environment
+// (e.g. staging) and a target (e.g. production).
+type resourceDiff struct {
+	Key    string   `json:"key"`
+	Change string   `json:"change"`           // added | removed | changed
+	Fields []string `json:"fields,omitempty"` // top-level fields that differ
+}
+
+type configDiff map[string][]resourceDiff // kind → drift
+
+// diffDocs reports what applying src onto dst would change, ignoring each
+// kind's volatile fields.
+func diffDocs(src, dst *configDoc) configDiff {
+	out := configDiff{}
+	for _, k := range configKinds {
+		ignore := map[string]bool{}
+		for _, f := range k.Volatile {
+			ignore[f] = true
+		}
+		s, d := src.Resources[k.Kind], dst.Resources[k.Kind]
+		diffs := []resourceDiff{}
+		for key, sv := range s {
+			dv, ok := d[key]
+			if !ok {
+				diffs = append(diffs, resourceDiff{Key: key, Change: "added"})
+				continue
+			}
+			if fields := diffFields(sv, dv, ignore); len(fields) > 0 {
+				diffs = append(diffs, resourceDiff{Key: key, Change: "changed", Fields: fields})
+			}
+		}
+		for key := range d {
+			if _, ok := s[key]; !ok {
+				diffs = append(diffs, resourceDiff{Key: key, Change: "removed"})
+			}
+		}
+		sort.Slice(diffs, func(i, j int) bool { return diffs[i].Key < diffs[j].Key })
+		out[k.Kind] = diffs
+	}
+	return out
+}
+
+// diffFields compares two documents field by field; non-object documents
+// compare as a whole (reported as field "").
+func diffFields(a, b json.RawMessage, ignore map[string]bool) []string {
+	var am, bm map[string]json.RawMessage
+	if json.Unmarshal(a, &am) != nil || json.Unmarshal(b, &bm) != nil {
+		if bytes.Equal(compactJSON(a), compactJSON(b)) {
+			return nil
+		}
+		return []string{""}
+	}
+	var fields []string
+	for f, av := range am {
+		if ignore[f] {
+			continue
+		}
+		if bv, ok := bm[f]; !ok || !bytes.Equal(compactJSON(av), compactJSON(bv)) {
+			fields = append(fields, f)
+		}
+	}
+	for f := range bm {
+		if _, ok := am[f]; !ok && !ignore[f] {
+			fields = append(fields, f)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// promotion builds the import document that brings dst in line with src for
+// every added or changed resource, keeping dst's volatile fields.
+func promotion(src, dst *configDoc, diff configDiff) *configDoc {
+	doc := &configDoc{Version: configDocVersion, Resources: map[string]map[string]json.RawMessage{}}
+	for _, k := range configKinds {
+		res := map[string]json.RawMessage{}
+		for _, d := range diff[k.Kind] {
+			if d.Change == "removed" {
+				continue // promotion never deletes
+			}
+			v := src.Resources[k.Kind][d.Key]
+			if old, ok := dst.Resources[k.Kind][d.Key]; ok && len(k.Volatile) > 0 {
+				v = keepFields(v, old, k.Volatile)
+			}
+			res[d.Key] = v
+		}
+		doc.Resources[k.Kind] = res
+	}
+	return doc
+}
+
+func keepFields(v, from json.RawMessage, fields []string) json.RawMessage {
+	var vm, fm map[string]json.RawMessage
+	if json.Unmarshal(v, &vm) != nil || json.Unmarshal(from, &fm) != nil {
+		return v
+	}
+	for _, f := range fields {
+		if fv, ok := fm[f]; ok {
+			vm[f] = fv
+		} else {
+			delete(vm, f)
+		}
+	}
+	b, _ := json.Marshal(vm)
+	return b
+}
+
+// POST /api/config/diff[?apply=true]
+//
+// The body is either a document from another environment, compared against
+// this one (and promoted into it with apply=true), or {"from": doc, "to": doc}
+// to compare two documents offline.
+func (c *configStore) handleDiff(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, 128<<20))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var pair struct {
+		From *configDoc `json:"from"`
+		To   *configDoc `json:"to"`
+	}
+	var src, dst *configDoc
+	live := false
+	if json.Unmarshal(body, &pair) == nil && pair.From != nil && pair.To != nil {
+		src, dst = pair.From, pair.To
+	} else {
+		src = &configDoc{}
+		if err := json.Unmarshal(body, src); err != nil {
+			http.Error(w, "bad document: "+err.Error(), 400)
+			return
+		}
+		if dst, err = c.export(); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		live = true
+	}
+
+	diff := diffDocs(src, dst)
+	out := map[string]interface{}{"diff": diff}
+	if req.URL.Query().Get("apply") == "true" {
+		if !live {
+			http.Error(w, "apply needs a single document compared against this environment", 400)
+			return
+		}
+		res, err := c.apply(promotion(src, dst, diff), false)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		out["applied"] = res
+	}
+	writeJSON(w, out)
+}
+
+// runDiffCLI implements `diff [-apply] from.json [to.json]`: with one file the
+// live environment is the target.
+func runDiffCLI(c *configStore, args []string, enc *json.Encoder) error {
+	apply := len(args) > 0 && args[0] == "-apply"
+	if apply {
+		args = args[1:]
+	}
+	if len(args) < 1 || len(args) > 2 || (apply && len(args) != 1) {
+		return errors.New("usage: diff [-apply] <from.json> [to.json]")
+	}
+	read := func(path string) (*configDoc, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		var d configDoc
+		return &d, json.NewDecoder(f).Decode(&d)
+	}
+	src, err := read(args[0])
+	if err != nil {
+		return err
+	}
+	var dst *configDoc
+	if len(args) == 2 {
+		dst, err = read(args[1])
+	} else {
+		dst, err = c.export()
+	}
+	if err != nil {
+		return err
+	}
+
+	diff := diffDocs(src, dst)
+	if !apply {
+		return enc.Encode(diff)
+	}
+	res, err := c.apply(promotion(src, dst, diff), false)
+	if err != nil {
+		return err
+	}
+	return enc.Encode(map[string]interface{}{"diff": diff, "applied": res})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// configDocVersion is bumped whenever the document layout changes.
+const configDocVersion = 1
+
+// configDoc is the whole environment configuration as one document:
+// resources[kind][key] is the stored JSON document.
+type configDoc struct {
+	Version   int                                   `json:"version"`
+	Exported  time.Time                             `json:"exported"`
+	Resources map[string]map[string]json.RawMessage `json:"resources"`
+}
+
+// configKinds maps each exported resource kind to the KV bucket holding it.
+// New configuration stores get added here to be part of export/import.
+// Volatile lists top-level fields that are runtime state rather than
+// configuration; environment diffs ignore them.
+var configKinds = []struct {
+	Kind     string
+	Bucket   string
+	Volatile []string
+}{
+	{"robots", "ROBOTS", []string{"created", "updated", "versions", "versions_reported", "drift", "heartbeat_interval_ms"}},
+	{"group_targets", "GROUP_TARGETS", nil},
+	{"robot_configs", "ROBOT_CONFIG", nil},
+	{"schedules", "SCHEDULES", nil},
+	{"lora_devices", "LORA_DEVICES", nil},
+	{"sites", "SITES", nil},
+	{"tenants", "TENANTS", nil},
+}
+
+type importResult struct {
+	Created   []string `json:"created"`
+	Updated   []string `json:"updated"`
+	Unchanged int      `json:"unchanged"`
+}
+
+// configStore exports and idempotently imports configDocs.
+type configStore struct {
+	js nats.JetStreamContext
+}
+
+func (c *configStore) bucket(name string, create bool) (nats.KeyValue, error) {
+	kv, err := c.js.KeyValue(name)
+	if errors.Is(err, nats.ErrBucketNotFound) && create {
+		kv, err = c.js.CreateKeyValue(&nats.KeyValueConfig{Bucket: name, Storage: nats.FileStorage})
+	}
+	return kv, err
+}
+
+func (c *configStore) export() (*configDoc, error) {
+	doc := &configDoc{Version: configDocVersion, Exported: time.Now().UTC(), Resources: map[string]map[string]json.RawMessage{}}
+	for _, k := range configKinds {
+		res := map[string]json.RawMessage{}
+		doc.Resources[k.Kind] = res
+		kv, err := c.bucket(k.Bucket, false)
+		if errors.Is(err, nats.ErrBucketNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys, err := kvKeys(kv, ">")
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			e, err := kv.Get(key)
+			if err != nil {
+				continue
+			}
+			res[key] = json.RawMessage(e.Value())
+		}
+	}
+	return doc, nil
+}
+
+// apply imports doc: keys whose stored document differs are written, the rest
+// left alone, so importing the same document twice changes nothing. Nothing is
+// deleted. With dryRun only the result is computed.
+func (c *configStore) apply(doc *configDoc, dryRun bool) (map[string]*importResult, error) {
+	if doc.Version != configDocVersion {
+		return nil, fmt.Errorf("unsupported document version %d (want %d)", doc.Version, configDocVersion)
+	}
+	known := map[string]string{}
+	for _, k := range configKinds {
+		known[k.Kind] = k.Bucket
+	}
+	for kind := range doc.Resources {
+		if _, ok := known[kind]; !ok {
+			return nil, fmt.Errorf("unknown resource kind %q", kind)
+		}
+	}
+
+	out := map[string]*importResult{}
+	for _, k := range configKinds {
+		res := doc.Resources[k.Kind]
+		r := &importResult{Created: []string{}, Updated: []string{}}
+		out[k.Kind] = r
+		if len(res) == 0 {
+			continue
+		}
+		kv, err := c.bucket(k.Bucket, !dryRun)
+		if err != nil && !(dryRun && errors.Is(err, nats.ErrBucketNotFound)) {
+			return nil, err
+		}
+
+		keys := make([]string, 0, len(res))
+		for key := range res {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			want := compactJSON(res[key])
+			var have []byte
+			if kv != nil {
+				if e, err := kv.Get(key); err == nil {
+					have = compactJSON(e.Value())
+				} else if !errors.Is(err, nats.ErrKeyNotFound) {
+					return nil, err
+				}
+			}
+			switch {
+			case have == nil:
+				r.Created = append(r.Created, key)
+			case bytes.Equal(have, want):
+				r.Unchanged++
+				continue
+			default:
+				r.Updated = append(r.Updated, key)
+			}
+			if !dryRun {
+				if _, err := kv.Put(key, want); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+func compactJSON(b []byte) []byte {
+	var buf bytes.Buffer
+	if json.Compact(&buf, b) != nil {
+		return b
+	}
+	return buf.Bytes()
+}
+
+// GET /api/config/export
+func (c *configStore) handleExport(w http.ResponseWriter, _ *http.Request) {
+	doc, err := c.export()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="evabot-config.json"`)
+	writeJSON(w, doc)
+}
+
+// POST /api/config/import[?dry_run=true] with a document from export.
+func (c *configStore) handleImport(w http.ResponseWriter, req *http.Request) {
+	var doc configDoc
+	if err := json.NewDecoder(io.LimitReader(req.Body, 64<<20)).Decode(&doc); err != nil {
+		http.Error(w, "bad document: "+err.Error(), 400)
+		return
+	}
+	res, err := c.apply(&doc, req.URL.Query().Get("dry_run") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	writeJSON(w, res)
+}
+
+// runConfigCLI implements `evabot-backend export > env.json`,
+// `evabot-backend import [-dry-run] env.json` and `evabot-backend diff …`,
+// talking to NATS directly.
+func runConfigCLI(verb string, args []string) error {
+	nc, err := nats.Connect(env("NATS_URL", "nats://127.0.0.1:4222"))
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+	c := &configStore{js: js}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	switch verb {
+	case "export":
+		doc, err := c.export()
+		if err != nil {
+			return err
+		}
+		return enc.Encode(doc)
+	case "import":
+		dryRun := len(args) > 0 && args[0] == "-dry-run"
+		if dryRun {
+			args = args[1:]
+		}
+		if len(args) != 1 {
+			return errors.New("usage: import [-dry-run] <file.json|->")
+		}
+		in := os.Stdin
+		if args[0] != "-" {
+			if in, err = os.Open(args[0]); err != nil {
+				return err
+			}
+			defer in.Close()
+		}
+		var doc configDoc
+		if err := json.NewDecoder(in).Decode(&doc); err != nil {
+			return err
+		}
+		res, err := c.apply(&doc, dryRun)
+		if err != nil {
+			return err
+		}
+		return enc.Encode(res)
+	case "diff":
+		return runDiffCLI(c, args, enc)
+	}
+	return fmt.Errorf("unknown command %q (want export, import or diff)", verb)
+}
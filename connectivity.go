@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	connHistoryLen = 50
+	rateBuckets    = 15 // minutes of message-rate trend
+)
+
+// connEvent is a connect/disconnect seen in the server's system events.
+type connEvent struct {
+	Type   string    `json:"type"` // connect | disconnect
+	TS     time.Time `json:"ts"`
+	Host   string    `json:"host,omitempty"`
+	Lang   string    `json:"lang,omitempty"`
+	Ver    string    `json:"version,omitempty"`
+	RTT    string    `json:"rtt,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+type connInfo struct {
+	history []connEvent
+	// per-minute message counts, buckets[i] counts minute bucketStart+i
+	buckets     [rateBuckets]int64
+	bucketStart time.Time
+}
+
+// connectivity gathers what support needs to triage "my robot looks offline":
+// NATS connect/disconnect history (from $SYS.ACCOUNT.*.CONNECT/DISCONNECT,
+// only if this connection may read system events), message-rate trend, and
+// the heartbeat and clock measurements kept elsewhere. Robots are matched to
+// NATS clients by connection name {prefix}{id}.
+type connectivity struct {
+	hbs        *heartbeats
+	clock      *clockSync
+	namePrefix string
+
+	mu        sync.Mutex
+	robots    map[string]*connInfo
+	sysEvents bool // seen at least one system event
+}
+
+func newConnectivity(hbs *heartbeats, clock *clockSync, namePrefix string) *connectivity {
+	return &connectivity{hbs: hbs, clock: clock, namePrefix: namePrefix, robots: map[string]*connInfo{}}
+}
+
+func (c *connectivity) subscribe(nc *nats.Conn) error {
+	if _, err := nc.Subscribe("telemetry.>", func(msg *nats.Msg) {
+		c.countMsg(telem.RobotID(msg.Subject), time.Now())
+	}); err != nil {
+		return err
+	}
+	for _, kind := range []string{"CONNECT", "DISCONNECT"} {
+		// fails silently (permissions violation) without a system account
+		if _, err := nc.Subscribe("$SYS.ACCOUNT.*."+kind, c.onSysEvent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *connectivity) info(id string) *connInfo {
+	ci := c.robots[id]
+	if ci == nil {
+		ci = &connInfo{}
+		c.robots[id] = ci
+	}
+	return ci
+}
+
+func (c *connectivity) onSysEvent(msg *nats.Msg) {
+	var ev struct {
+		Type   string    `json:"type"`
+		Time   time.Time `json:"timestamp"`
+		Reason string    `json:"reason"`
+		Client struct {
+			Host string `json:"host"`
+			Name string `json:"name"`
+			Lang string `json:"lang"`
+			Ver  string `json:"ver"`
+			RTT  string `json:"rtt"`
+		} `json:"client"`
+	}
+	if json.Unmarshal(msg.Data, &ev) != nil || !strings.HasPrefix(ev.Client.Name, c.namePrefix) {
+		c.mu.Lock()
+		c.sysEvents = true
+		c.mu.Unlock()
+		return
+	}
+	id := strings.TrimPrefix(ev.Client.Name, c.namePrefix)
+	e := connEvent{Type: "connect", TS: ev.Time, Host: ev.Client.Host, Lang: ev.Client.Lang, Ver: ev.Client.Ver, RTT: ev.Client.RTT, Reason: ev.Reason}
+	if strings.HasSuffix(msg.Subject, ".DISCONNECT") {
+		e.Type = "disconnect"
+	}
+	if e.TS.IsZero() {
+		e.TS = time.Now()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sysEvents = true
+	ci := c.info(id)
+	ci.history = append(ci.history, e)
+	if len(ci.history) > connHistoryLen {
+		ci.history = ci.history[len(ci.history)-connHistoryLen:]
+	}
+}
+
+func (c *connectivity) countMsg(id string, now time.Time) {
+	minute := now.Truncate(time.Minute)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ci := c.info(id)
+	ci.shift(minute)
+	ci.buckets[rateBuckets-1]++
+}
+
+// shift advances the ring so the last bucket is the given minute.
+func (ci *connInfo) shift(minute time.Time) {
+	last := ci.bucketStart.Add((rateBuckets - 1) * time.Minute)
+	n := int(minute.Sub(last) / time.Minute)
+	if ci.bucketStart.IsZero() || n >= rateBuckets {
+		ci.buckets = [rateBuckets]int64{}
+		ci.bucketStart = minute.Add(-(rateBuckets - 1) * time.Minute)
+		return
+	}
+	if n <= 0 {
+		return
+	}
+	copy(ci.buckets[:], ci.buckets[n:])
+	for i := rateBuckets - n; i < rateBuckets; i++ {
+		ci.buckets[i] = 0
+	}
+	ci.bucketStart = ci.bucketStart.Add(time.Duration(n) * time.Minute)
+}
+
+type ratePoint struct {
+	T     time.Time `json:"t"`
+	Count int64     `json:"count"`
+}
+
+// GET /api/robots/{id}/connectivity
+func (c *connectivity) handleGet(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	now := time.Now()
+
+	out := struct {
+		Robot               string         `json:"robot"`
+		ClientInfoAvailable bool           `json:"client_info_available"`
+		Connected           *bool          `json:"connected,omitempty"`
+		LastConnection      *connEvent     `json:"last_connection,omitempty"`
+		History             []connEvent    `json:"history"`
+		Heartbeat           hbStats        `json:"heartbeat"`
+		Clock               *clockEstimate `json:"clock,omitempty"`
+		RatePerMinute       []ratePoint    `json:"rate_per_minute"`
+	}{Robot: id, History: []connEvent{}, RatePerMinute: []ratePoint{}}
+
+	c.mu.Lock()
+	out.ClientInfoAvailable = c.sysEvents
+	if ci := c.robots[id]; ci != nil {
+		out.History = append(out.History, ci.history...)
+		if len(ci.history) > 0 {
+			last := ci.history[len(ci.history)-1]
+			connected := last.Type == "connect"
+			out.Connected, out.LastConnection = &connected, &last
+		}
+		ci.shift(now.Truncate(time.Minute))
+		for i, n := range ci.buckets {
+			out.RatePerMinute = append(out.RatePerMinute, ratePoint{T: ci.bucketStart.Add(time.Duration(i) * time.Minute), Count: n})
+		}
+	}
+	c.mu.Unlock()
+
+	out.Heartbeat, _ = c.hbs.snapshot(id, now)
+	est, err := c.clock.estimate(id)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out.Clock = est
+	writeJSON(w, out)
+}
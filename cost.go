@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/usage"
+	"github.com/nats-io/nats.go"
+)
+
+// costRates is what the infrastructure costs, from COST_RATES, e.g.
+//
+//	{"currency":"EUR","influx_points_per_million":0.25,"storage_gb_month":0.10,
+//	 "object_gb_month":0.02,"egress_gb":0.09}
+//
+// Unset rates are zero, so the report shows usage without prices.
+type costRates struct {
+	Currency       string  `json:"currency"`
+	InfluxPerMPts  float64 `json:"influx_points_per_million"`
+	StorageGBMonth float64 `json:"storage_gb_month"`
+	ObjectGBMonth  float64 `json:"object_gb_month"`
+	EgressGB       float64 `json:"egress_gb"`
+}
+
+func parseCostRates(s string) (costRates, error) {
+	rates := costRates{Currency: "USD"}
+	if s == "" {
+		return rates, nil
+	}
+	if err := json.Unmarshal([]byte(s), &rates); err != nil {
+		return rates, fmt.Errorf("COST_RATES: %w", err)
+	}
+	return rates, nil
+}
+
+const gb = 1 << 30
+
+// costs reports what the backend uses per tenant (Influx points written by
+// the worker, bytes the gateway serves) and what JetStream stores, and
+// prices it. Usage is metered into the USAGE bucket by internal/usage; the
+// month so far is projected to the whole month at the current rate.
+type costs struct {
+	js    nats.JetStreamContext
+	kv    nats.KeyValue
+	meter *usage.Meter
+	rg    *regions
+	rates costRates
+}
+
+func newCosts(js nats.JetStreamContext, rg *regions, rates costRates) (*costs, error) {
+	kv, err := usage.Open(js)
+	if err != nil {
+		return nil, err
+	}
+	return &costs{js: js, kv: kv, meter: usage.NewMeter(kv), rg: rg, rates: rates}, nil
+}
+
+// countingWriter counts the body bytes a handler writes.
+type countingWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(b)
+	c.n += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (c *countingWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// egress is middleware metering response bytes per tenant. WebSocket
+// sessions are metered by the hub, frame by frame (see egressOf).
+func (c *costs) egress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, req) // the upgrader needs the raw writer
+			return
+		}
+		cw := &countingWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, req)
+		if cw.n > 0 {
+			c.meter.Add(usage.EgressBytes, c.rg.tenantOf(req), float64(cw.n))
+		}
+	})
+}
+
+// egressOf returns the counter for what a WebSocket connection sends.
+func (c *costs) egressOf(req *http.Request) func(n int) {
+	tenant := c.rg.tenantOf(req)
+	return func(n int) { c.meter.Add(usage.EgressBytes, tenant, float64(n)) }
+}
+
+// tenantCost is one tenant's metered usage for a month.
+type tenantCost struct {
+	InfluxPoints       float64 `json:"influx_points"`
+	EgressBytes        float64 `json:"egress_bytes"`
+	Cost               float64 `json:"cost"`
+	ProjectedPoints    float64 `json:"projected_influx_points"`
+	ProjectedEgress    float64 `json:"projected_egress_bytes"`
+	ProjectedMonthCost float64 `json:"projected_cost"`
+}
+
+// streamStorage is what one JetStream stream holds now.
+type streamStorage struct {
+	Stream string  `json:"stream"`
+	Kind   string  `json:"kind"` // "stream", "kv" or "object"
+	Bytes  uint64  `json:"bytes"`
+	Msgs   uint64  `json:"msgs"`
+	Cost   float64 `json:"month_cost"`
+}
+
+// GET /api/admin/costs?month=2025-03 (default this month) reports usage per
+// tenant and storage per stream, priced at COST_RATES. Storage is what is
+// stored now, costed for a whole month; it isn't split by tenant.
+func (c *costs) handleReport(w http.ResponseWriter, req *http.Request) {
+	now := time.Now().UTC()
+	month := req.URL.Query().Get("month")
+	if month == "" {
+		month = usage.Month(now)
+	}
+	start, err := time.Parse("2006-01", month)
+	if err != nil {
+		http.Error(w, "bad 'month' (YYYY-MM)", 400)
+		return
+	}
+	end := start.AddDate(0, 1, 0)
+	if start.After(now) {
+		http.Error(w, "'month' is in the future", 400)
+		return
+	}
+	// share of the month gone by, to project month-to-date usage
+	elapsed := 1.0
+	if now.Before(end) {
+		elapsed = float64(now.Sub(start)) / float64(end.Sub(start))
+	}
+
+	totals, err := usage.Totals(c.kv, month)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	tenants := map[string]*tenantCost{}
+	tenantOf := func(id string) *tenantCost {
+		if tenants[id] == nil {
+			tenants[id] = &tenantCost{}
+		}
+		return tenants[id]
+	}
+	for id, n := range totals[usage.PointsWritten] {
+		tenantOf(id).InfluxPoints = n
+	}
+	for id, n := range totals[usage.EgressBytes] {
+		tenantOf(id).EgressBytes = n
+	}
+	var usageCost, projectedUsage float64
+	for _, t := range tenants {
+		t.Cost = t.InfluxPoints/1e6*c.rates.InfluxPerMPts + t.EgressBytes/gb*c.rates.EgressGB
+		t.ProjectedPoints, t.ProjectedEgress, t.ProjectedMonthCost = t.InfluxPoints/elapsed, t.EgressBytes/elapsed, t.Cost/elapsed
+		usageCost += t.Cost
+		projectedUsage += t.ProjectedMonthCost
+	}
+
+	storage := []streamStorage{}
+	var storageCost float64
+	for info := range c.js.StreamsInfo() {
+		s := streamStorage{Stream: info.Config.Name, Kind: "stream", Bytes: info.State.Bytes, Msgs: info.State.Msgs}
+		rate := c.rates.StorageGBMonth
+		switch {
+		case strings.HasPrefix(s.Stream, "OBJ_"):
+			s.Kind, rate = "object", c.rates.ObjectGBMonth
+		case strings.HasPrefix(s.Stream, "KV_"):
+			s.Kind = "kv"
+		}
+		s.Cost = float64(s.Bytes) / gb * rate
+		storageCost += s.Cost
+		storage = append(storage, s)
+	}
+	sort.Slice(storage, func(i, j int) bool { return storage[i].Bytes > storage[j].Bytes })
+
+	writeJSON(w, map[string]interface{}{
+		"month":    month,
+		"elapsed":  elapsed,
+		"rates":    c.rates,
+		"tenants":  tenants,
+		"storage":  storage,
+		"currency": c.rates.Currency,
+		"total": map[string]float64{
+			"usage":           usageCost,
+			"storage":         storageCost,
+			"projected_usage": projectedUsage,
+			"projected":       projectedUsage + storageCost,
+		},
+	})
+}
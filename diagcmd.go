@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// diagCommands runs allow-listed diagnostic commands on robots over NATS
+// request/reply (diag.{id}.exec). It replaces ad-hoc SSH sessions, so every
+// invocation goes to the audit log twice: diag.exec before it is sent and
+// diag.exec.result, with the full output or the error, afterwards. The channel is
+// disabled unless DIAG_TOKEN is set, and callers must present that token in
+// X-Diag-Token on top of whatever else guards the API.
+type diagCommands struct {
+	nc      *nats.Conn
+	audit   *auditLog
+	token   string
+	allow   map[string][]string // name → argv, from DIAG_COMMANDS
+	timeout time.Duration
+}
+
+func newDiagCommands(nc *nats.Conn, audit *auditLog, token, allowJSON string, timeout time.Duration) (*diagCommands, error) {
+	d := &diagCommands{nc: nc, audit: audit, token: token, allow: map[string][]string{}, timeout: timeout}
+	if allowJSON != "" {
+		if err := json.Unmarshal([]byte(allowJSON), &d.allow); err != nil {
+			return nil, fmt.Errorf("DIAG_COMMANDS: %w", err)
+		}
+	}
+	return d, nil
+}
+
+func (d *diagCommands) authorized(w http.ResponseWriter, req *http.Request) bool {
+	if d.token == "" {
+		http.Error(w, "diagnostic commands not configured", http.StatusNotImplemented)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get("X-Diag-Token")), []byte(d.token)) != 1 {
+		http.Error(w, "diagnostic command tier required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// GET /api/diag/commands
+func (d *diagCommands) handleList(w http.ResponseWriter, req *http.Request) {
+	if !d.authorized(w, req) {
+		return
+	}
+	names := make([]string, 0, len(d.allow))
+	for n := range d.allow {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	writeJSON(w, names)
+}
+
+type diagResult struct {
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+}
+
+// POST /api/robot/{id}/diag with {"command":"disk"}. The robot runs it as
+// soon as it is asked, so ?dryRun=true is refused rather than ignored.
+func (d *diagCommands) handleExec(w http.ResponseWriter, req *http.Request) {
+	if !d.authorized(w, req) {
+		return
+	}
+	if dry, err := dryRun(req); err != nil || dry {
+		http.Error(w, "diagnostic commands have no dry run", 400)
+		return
+	}
+	id := chi.URLParam(req, "id")
+	var in struct {
+		Command string `json:"command"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		http.Error(w, "bad body: "+err.Error(), 400)
+		return
+	}
+	argv, ok := d.allow[in.Command]
+	if !ok {
+		http.Error(w, "command not in allow-list", 400)
+		return
+	}
+
+	// record the request before it is sent, so a command that never
+	// reports back is still on file
+	exec := nuid.Next()
+	actor := actorOf(req)
+	if err := d.audit.record(auditRecord{Actor: actor, Action: "diag.exec", Robot: id,
+		Details: map[string]interface{}{"exec": exec, "command": in.Command, "argv": argv}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	rec := auditRecord{
+		Actor:   actor,
+		Action:  "diag.exec.result",
+		Robot:   id,
+		Details: map[string]interface{}{"exec": exec, "command": in.Command},
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{"name": in.Command, "argv": argv})
+	started := time.Now()
+	reply, err := d.nc.Request("diag."+id+".exec", payload, d.timeout)
+	rec.Details["duration_ms"] = time.Since(started).Milliseconds()
+	if err != nil {
+		rec.Details["error"] = err.Error()
+		if aerr := d.audit.record(rec); aerr != nil {
+			http.Error(w, "audit: "+aerr.Error(), 500)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+
+	var res diagResult
+	if err := json.Unmarshal(reply.Data, &res); err != nil {
+		res = diagResult{ExitCode: -1, Stdout: string(reply.Data)}
+	}
+	rec.Details["exit_code"] = res.ExitCode
+	rec.Details["stdout"] = res.Stdout
+	rec.Details["stderr"] = res.Stderr
+	// don't hand out output we couldn't record
+	if err := d.audit.record(rec); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	writeJSON(w, res)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+)
+
+// Diagnostic levels, ordered by severity (same values as ROS diagnostic_msgs).
+const (
+	diagOK    = 0
+	diagWarn  = 1
+	diagError = 2
+	diagStale = 3
+)
+
+var diagLevelNames = []string{"OK", "WARN", "ERROR", "STALE"}
+
+// diagStatus is one entry of a robot's diagnostics array, e.g.
+//
+//	{"name":"/motors/left","level":"WARN","message":"hot","values":[{"key":"temp_c","value":"71"}]}
+type diagStatus struct {
+	Name       string    `json:"name"`
+	Level      diagLevel `json:"level"`
+	Message    string    `json:"message,omitempty"`
+	HardwareID string    `json:"hardware_id,omitempty"`
+	Values     []diagKV  `json:"values,omitempty"`
+	Updated    time.Time `json:"updated"`
+}
+
+type diagKV struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// diagLevel accepts either the numeric ROS level or its name.
+type diagLevel int
+
+func (l *diagLevel) UnmarshalJSON(b []byte) error {
+	var n int
+	if err := json.Unmarshal(b, &n); err == nil {
+		*l = diagLevel(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*l = diagStale
+	for i, name := range diagLevelNames {
+		if strings.EqualFold(s, name) {
+			*l = diagLevel(i)
+		}
+	}
+	return nil
+}
+
+func (l diagLevel) MarshalJSON() ([]byte, error) {
+	if l < 0 || int(l) >= len(diagLevelNames) {
+		l = diagStale
+	}
+	return json.Marshal(diagLevelNames[l])
+}
+
+// diagNode is one level of the aggregated tree; a node's level is the worst of
+// its own status and all of its children (like diagnostic_aggregator).
+type diagNode struct {
+	Name     string      `json:"name"`
+	Path     string      `json:"path"`
+	Level    diagLevel   `json:"level"`
+	Status   *diagStatus `json:"status,omitempty"`
+	Children []*diagNode `json:"children,omitempty"`
+}
+
+// diagnostics keeps the latest status of every device per robot, fed from
+// telemetry.{id}.diagnostics.
+type diagnostics struct {
+	mu        sync.Mutex
+	robots    map[string]map[string]*diagStatus // robot → status name → status
+	listeners map[string]map[chan struct{}]struct{}
+	staleAge  time.Duration
+}
+
+func newDiagnostics(staleAge time.Duration) *diagnostics {
+	return &diagnostics{
+		robots:    map[string]map[string]*diagStatus{},
+		listeners: map[string]map[chan struct{}]struct{}{},
+		staleAge:  staleAge,
+	}
+}
+
+func (d *diagnostics) subscribe(nc *nats.Conn) error {
+	_, err := nc.Subscribe("telemetry.*.diagnostics", func(msg *nats.Msg) {
+		id := telem.RobotID(msg.Subject)
+		var in struct {
+			Status []diagStatus `json:"status"`
+		}
+		if err := json.Unmarshal(msg.Data, &in); err != nil {
+			log.Printf("diagnostics: bad payload from %s: %v", id, err)
+			return
+		}
+		d.update(id, in.Status)
+	})
+	return err
+}
+
+func (d *diagnostics) update(id string, statuses []diagStatus) {
+	now := time.Now()
+	d.mu.Lock()
+	m := d.robots[id]
+	if m == nil {
+		m = map[string]*diagStatus{}
+		d.robots[id] = m
+	}
+	for i := range statuses {
+		s := statuses[i]
+		s.Name = "/" + strings.Trim(s.Name, "/")
+		if s.Name == "/" {
+			continue
+		}
+		s.Updated = now
+		m[s.Name] = &s
+	}
+	for ch := range d.listeners[id] {
+		select {
+		case ch <- struct{}{}:
+		default: // already has a pending update
+		}
+	}
+	d.mu.Unlock()
+}
+
+// tree builds the aggregated hierarchy for a robot, or nil if it never reported.
+func (d *diagnostics) tree(id string) *diagNode {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, ok := d.robots[id]
+	if !ok {
+		return nil
+	}
+
+	root := &diagNode{Name: id, Path: "/"}
+	index := map[string]*diagNode{"/": root}
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	for _, name := range names {
+		parent, path := root, ""
+		for _, part := range strings.Split(strings.Trim(name, "/"), "/") {
+			path += "/" + part
+			n := index[path]
+			if n == nil {
+				n = &diagNode{Name: part, Path: path}
+				index[path] = n
+				parent.Children = append(parent.Children, n)
+			}
+			parent = n
+		}
+		s := *m[name]
+		if d.staleAge > 0 && now.Sub(s.Updated) > d.staleAge {
+			s.Level = diagStale
+		}
+		parent.Status = &s
+	}
+	aggregateDiag(root)
+	return root
+}
+
+func aggregateDiag(n *diagNode) diagLevel {
+	n.Level = diagOK
+	if n.Status != nil {
+		n.Level = n.Status.Level
+	}
+	for _, c := range n.Children {
+		if l := aggregateDiag(c); l > n.Level {
+			n.Level = l
+		}
+	}
+	return n.Level
+}
+
+func (d *diagnostics) listen(id string) chan struct{} {
+	ch := make(chan struct{}, 1)
+	d.mu.Lock()
+	if d.listeners[id] == nil {
+		d.listeners[id] = map[chan struct{}]struct{}{}
+	}
+	d.listeners[id][ch] = struct{}{}
+	d.mu.Unlock()
+	return ch
+}
+
+func (d *diagnostics) unlisten(id string, ch chan struct{}) {
+	d.mu.Lock()
+	delete(d.listeners[id], ch)
+	if len(d.listeners[id]) == 0 {
+		delete(d.listeners, id)
+	}
+	d.mu.Unlock()
+}
+
+// GET /api/robots/{id}/diagnostics
+func (d *diagnostics) handleGet(w http.ResponseWriter, req *http.Request) {
+	t := d.tree(chi.URLParam(req, "id"))
+	if t == nil {
+		http.Error(w, "no diagnostics for robot", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, t)
+}
+
+// GET /ws/diagnostics/{id}: sends the full tree on connect and after every update.
+func (d *diagnostics) handleWS(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	c, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	ch := d.listen(id)
+	defer d.unlisten(id, ch)
+
+	// re-send periodically too, so stale devices show up without new input
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
+	for {
+		if t := d.tree(id); t != nil {
+			b, _ := json.Marshal(t)
+			if err := c.WriteMessage(websocket.TextMessage, b); err != nil {
+				return
+			}
+		}
+		select {
+		case <-ch:
+		case <-tick.C:
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/plugin"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// alertDigestsBucket holds one digestSchedule per key, by user.
+const alertDigestsBucket = "ALERT_DIGESTS"
+
+// Bounds on a digest's period.
+const (
+	minDigestEvery = 5 * time.Minute
+	maxDigestEvery = 24 * time.Hour
+)
+
+// maxDigestLines bounds the lines of one digest; the rest are counted.
+const maxDigestLines = 50
+
+// digestSchedule is how one user hears about alerts, on top of the rules'
+// own channels: alerts of an instant severity at once, the others gathered
+// and sent every Every as one message, repeats of an alert counted rather
+// than listed:
+//
+//	{"channel":"mail-ana","every":"1h","instant":["critical"],"digest":["warning","info"],"rules":["battery-*"]}
+//
+// Severities in neither list aren't sent; no rules means every rule. Only
+// alerts on robots in the user's scope, as it was when the schedule was
+// last saved (their account's, or their token's when they save it), are
+// included.
+type digestSchedule struct {
+	User    string    `json:"user"`
+	Channel string    `json:"channel"` // an ALERT_CHANNELS name
+	Every   string    `json:"every"`
+	Instant []string  `json:"instant"`
+	Digest  []string  `json:"digest"`
+	Rules   []string  `json:"rules,omitempty"` // shell patterns of rule names
+	Scope   *identity `json:"scope,omitempty"`
+	Updated time.Time `json:"updated"`
+	By      string    `json:"by,omitempty"`
+
+	every time.Duration
+}
+
+// check fills in defaults and validates s.
+func (s *digestSchedule) check(channels map[string]plugin.Notifier) error {
+	if channels[s.Channel] == nil {
+		return fmt.Errorf("no notification channel %q (see ALERT_CHANNELS)", s.Channel)
+	}
+	if s.Every == "" {
+		s.Every = "1h"
+	}
+	var err error
+	if s.every, err = time.ParseDuration(s.Every); err != nil || s.every < minDigestEvery || s.every > maxDigestEvery {
+		return fmt.Errorf("bad every %q (%s to %s)", s.Every, minDigestEvery, maxDigestEvery)
+	}
+	if s.Instant == nil && s.Digest == nil {
+		s.Instant, s.Digest = []string{"critical"}, []string{"warning", "info"}
+	}
+	seen := map[string]bool{}
+	for _, sev := range append(append([]string{}, s.Instant...), s.Digest...) {
+		if !alertSeverities[sev] {
+			return fmt.Errorf("bad severity %q (info, warning or critical)", sev)
+		}
+		if seen[sev] {
+			return fmt.Errorf("severity %s is listed twice", sev)
+		}
+		seen[sev] = true
+	}
+	for _, p := range s.Rules {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad rule pattern %q", p)
+		}
+	}
+	return nil
+}
+
+// wants reports whether al goes to s's user, and whether at once.
+func (s *digestSchedule) wants(al alert, rb *rbac) (ok, instant bool) {
+	if len(s.Rules) > 0 {
+		match := false
+		for _, p := range s.Rules {
+			if m, _ := path.Match(p, al.Rule); m {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false, false
+		}
+	}
+	if al.Robot != "" && !rb.sees(s.Scope, al.Robot) {
+		return false, false
+	}
+	for _, sev := range s.Instant {
+		if sev == al.Severity {
+			return true, true
+		}
+	}
+	for _, sev := range s.Digest {
+		if sev == al.Severity {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// digestLine is one alert's transitions of one kind within a digest.
+type digestLine struct {
+	Rule     string    `json:"rule"`
+	Robot    string    `json:"robot,omitempty"`
+	State    string    `json:"state"`
+	Severity string    `json:"severity"`
+	Count    int       `json:"count"`
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last"`
+	Message  string    `json:"message"` // the last one's
+}
+
+// digestBatch is what a user's next digest holds.
+type digestBatch struct {
+	due   time.Time
+	lines map[string]*digestLine // rule/robot/state →
+}
+
+// digests sends alerts to users by their schedules. Schedules live in the
+// ALERT_DIGESTS bucket; the batches waiting to go out are kept in memory by
+// the gateway doing the alerting, so a restart loses them. A batch goes out
+// its schedule's every after the first alert it holds.
+type digests struct {
+	kv    nats.KeyValue
+	a     *alerting
+	users *users
+
+	mu        sync.Mutex
+	schedules map[string]*digestSchedule
+	batches   map[string]*digestBatch // by user
+}
+
+func newDigests(js nats.JetStreamContext, a *alerting, u *users) (*digests, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: alertDigestsBucket, History: 5, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	d := &digests{kv: kv, a: a, users: u, schedules: map[string]*digestSchedule{}, batches: map[string]*digestBatch{}}
+	a.digests = d
+	return d, nil
+}
+
+// run follows the schedules bucket until ctx is done; alerting.run calls it
+// and flush.
+func (d *digests) run(ctx context.Context) error {
+	w, err := d.kv.WatchAll()
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer w.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-w.Updates():
+				if e != nil {
+					d.set(e)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (d *digests) set(e nats.KeyValueEntry) {
+	var s digestSchedule
+	ok := e.Operation() == nats.KeyValuePut && json.Unmarshal(e.Value(), &s) == nil
+	if ok {
+		if err := s.check(d.a.channels); err != nil {
+			log.Printf("alerts: digest for %s: not applied: %v", e.Key(), err)
+			ok = false
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !ok {
+		delete(d.schedules, e.Key())
+		delete(d.batches, e.Key())
+		return
+	}
+	d.schedules[e.Key()] = &s
+}
+
+// offer hands a firing or resolved alert to the users whose schedules want
+// it: sent at once, or added to their batches.
+func (d *digests) offer(al alert, now time.Time) {
+	type send struct {
+		user, channel string
+	}
+	var sends []send
+	d.mu.Lock()
+	for user, s := range d.schedules {
+		ok, instant := s.wants(al, d.a.rb)
+		if !ok {
+			continue
+		}
+		if instant {
+			sends = append(sends, send{user, s.Channel})
+			continue
+		}
+		b := d.batches[user]
+		if b == nil {
+			b = &digestBatch{due: now.Add(s.every), lines: map[string]*digestLine{}}
+			d.batches[user] = b
+		}
+		key := al.Rule + "/" + al.Robot + "/" + al.State
+		l := b.lines[key]
+		if l == nil {
+			l = &digestLine{Rule: al.Rule, Robot: al.Robot, State: al.State, First: now}
+			b.lines[key] = l
+		}
+		l.Count++
+		l.Severity, l.Last, l.Message = al.Severity, now, al.Message
+	}
+	d.mu.Unlock()
+	if len(sends) == 0 {
+		return
+	}
+	n := alertNotification(al)
+	for _, s := range sends {
+		n := n
+		n.Labels = map[string]string{"rule": al.Rule, "subject": al.Subject, "state": al.State, "user": s.user}
+		go d.a.deliver(s.channel, n, delivery{Alert: al.ID, Rule: al.Rule, Robot: al.Robot, State: al.State})
+	}
+}
+
+// flush sends the batches that are due.
+func (d *digests) flush(now time.Time) {
+	type send struct {
+		user, channel string
+		lines         []digestLine
+	}
+	var due []send
+	d.mu.Lock()
+	for user, b := range d.batches {
+		if now.Before(b.due) {
+			continue
+		}
+		if s := d.schedules[user]; s != nil {
+			due = append(due, send{user, s.Channel, b.sorted()})
+		}
+		delete(d.batches, user)
+	}
+	d.mu.Unlock()
+	for _, s := range due {
+		go d.a.deliver(s.channel, digestNotification(s.user, s.lines, now), delivery{Alert: "digest:" + s.user, State: "digest"})
+	}
+}
+
+// sorted lists b's lines, most recent first.
+func (b *digestBatch) sorted() []digestLine {
+	out := make([]digestLine, 0, len(b.lines))
+	for _, l := range b.lines {
+		out = append(out, *l)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Last.Equal(out[j].Last) {
+			return out[i].Last.After(out[j].Last)
+		}
+		return out[i].Rule+out[i].Robot < out[j].Rule+out[j].Robot
+	})
+	return out
+}
+
+// digestNotification sums lines up in one message, at the severity of the
+// worst of them.
+func digestNotification(user string, lines []digestLine, now time.Time) plugin.Notification {
+	total, firing, sev := 0, 0, "info"
+	rank := map[string]int{"info": 0, "warning": 1, "critical": 2}
+	var body strings.Builder
+	for i, l := range lines {
+		total += l.Count
+		if l.State == alertFiring {
+			firing += l.Count
+		}
+		if rank[l.Severity] > rank[sev] {
+			sev = l.Severity
+		}
+		if i == maxDigestLines {
+			fmt.Fprintf(&body, "… and %d more\n", len(lines)-i)
+		}
+		if i >= maxDigestLines {
+			continue
+		}
+		on := l.Robot
+		if on == "" {
+			on = "the fleet"
+		}
+		fmt.Fprintf(&body, "%d× %s %s on %s (%s", l.Count, strings.ToUpper(l.State), l.Rule, on, l.First.UTC().Format("15:04"))
+		if l.Count > 1 {
+			fmt.Fprintf(&body, "–%s", l.Last.UTC().Format("15:04"))
+		}
+		fmt.Fprintf(&body, "): %s\n", l.Message)
+	}
+	return plugin.Notification{Title: fmt.Sprintf("Alert digest: %d firing, %d resolved", firing, total-firing), Body: body.String(),
+		Severity: sev, Labels: map[string]string{"digest": user, "alerts": fmt.Sprint(total)}, TS: now}
+}
+
+// digestView is a schedule with what its next digest holds so far.
+type digestView struct {
+	digestSchedule
+	Due     *time.Time   `json:"due,omitempty"`
+	Pending []digestLine `json:"pending"`
+}
+
+func (d *digests) view(s digestSchedule) digestView {
+	v := digestView{digestSchedule: s, Pending: []digestLine{}}
+	d.mu.Lock()
+	if b := d.batches[s.User]; b != nil {
+		due := b.due
+		v.Due, v.Pending = &due, b.sorted()
+	}
+	d.mu.Unlock()
+	return v
+}
+
+func (d *digests) get(user string) (*digestSchedule, error) {
+	e, err := d.kv.Get(user)
+	if err != nil {
+		return nil, err
+	}
+	var s digestSchedule
+	if err := json.Unmarshal(e.Value(), &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// GET /api/alerts/digests lists every user's schedule (admins).
+func (d *digests) handleList(w http.ResponseWriter, _ *http.Request) {
+	keys, err := kvKeys(d.kv, ">")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := []digestView{}
+	for _, k := range keys {
+		if s, err := d.get(k); err == nil {
+			out = append(out, d.view(*s))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].User < out[j].User })
+	writeJSON(w, out)
+}
+
+// GET /api/alerts/digests/{name} returns a user's schedule and what their
+// next digest holds (on the gateway doing the alerting); users may read
+// their own.
+func (d *digests) handleGet(w http.ResponseWriter, req *http.Request) {
+	user := chi.URLParam(req, "name")
+	s, err := d.get(user)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no digest for "+user, 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, d.view(*s))
+}
+
+// PUT /api/alerts/digests/{name} creates or replaces a user's schedule
+// (see digestSchedule); users may set their own. Admins may set anyone's
+// with an account.
+func (d *digests) handlePut(w http.ResponseWriter, req *http.Request) {
+	user := chi.URLParam(req, "name")
+	if !tokenRe.MatchString(user) {
+		http.Error(w, "bad user", 400)
+		return
+	}
+	var s digestSchedule
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64<<10)).Decode(&s); err != nil {
+		http.Error(w, "bad JSON", 400)
+		return
+	}
+	s.User, s.Updated, s.By, s.Scope = user, time.Now().UTC(), actorOf(req), nil
+	if id := identityOf(req); id != nil && id.User == user {
+		s.Scope = &identity{User: id.User, Roles: id.Roles, Tenant: id.Tenant, Robots: id.Robots}
+	} else if id != nil {
+		u, err := d.users.get(user)
+		if errors.Is(err, errUserNotFound) {
+			http.Error(w, "no such user", 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		s.Scope = &identity{User: u.Username, Roles: u.Roles, Tenant: u.Tenant, Robots: u.Robots}
+	}
+	if err := s.check(d.a.channels); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := d.a.audit.record(auditRecord{Actor: s.By, Action: "alert_digest.put", Details: map[string]interface{}{"user": user, "channel": s.Channel, "every": s.Every, "instant": s.Instant, "digest": s.Digest}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	b, _ := json.Marshal(s)
+	if _, err := d.kv.Put(user, b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, s)
+}
+
+// DELETE /api/alerts/digests/{name} stops a user's digest, dropping what it
+// held.
+func (d *digests) handleDelete(w http.ResponseWriter, req *http.Request) {
+	user := chi.URLParam(req, "name")
+	if _, err := d.get(user); errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no digest for "+user, 404)
+		return
+	}
+	if err := d.a.audit.record(auditRecord{Actor: actorOf(req), Action: "alert_digest.delete", Details: map[string]interface{}{"user": user}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	if err := d.kv.Delete(user); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// dlqEntry is a telemetry message the worker gave up on, as kept in the
+// TELEMETRY_DLQ stream by internal/worker.
+type dlqEntry struct {
+	Seq          uint64 `json:"seq"`
+	Subject      string `json:"subject"` // the original telemetry subject
+	Robot        string `json:"robot"`
+	Error        string `json:"error"`
+	Deliveries   string `json:"deliveries"`
+	Worker       string `json:"worker,omitempty"`
+	OriginalSeq  string `json:"original_seq"`
+	OriginalTime string `json:"original_time"`
+	DeadLettered string `json:"dead_lettered"`
+	Data         string `json:"data"`
+}
+
+// dlq lets operators look at dead-lettered telemetry and, once whatever made
+// it fail is fixed, replay it: it is published again on its original subject
+// with Original-Time set, so the worker stores it at the time it was first
+// published, and removed from the DLQ.
+type dlq struct {
+	js    nats.JetStreamContext
+	audit *auditLog
+}
+
+func (d *dlq) entry(seq uint64) (*dlqEntry, *nats.RawStreamMsg, error) {
+	m, err := d.js.GetMsg("TELEMETRY_DLQ", seq)
+	if err != nil {
+		return nil, nil, err
+	}
+	subject := m.Header.Get("Original-Subject")
+	return &dlqEntry{
+		Seq: seq, Subject: subject, Robot: telem.RobotID(subject),
+		Error: m.Header.Get("Dlq-Error"), Deliveries: m.Header.Get("Dlq-Deliveries"), Worker: m.Header.Get("Dlq-Worker"),
+		OriginalSeq: m.Header.Get("Original-Seq"), OriginalTime: m.Header.Get("Original-Time"),
+		DeadLettered: m.Time.UTC().Format(time.RFC3339Nano), Data: string(m.Data),
+	}, m, nil
+}
+
+// GET /api/dlq?robot=r1&limit=100 lists dead letters, newest first.
+func (d *dlq) handleList(w http.ResponseWriter, req *http.Request) {
+	robot := req.URL.Query().Get("robot")
+	limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	info, err := d.js.StreamInfo("TELEMETRY_DLQ")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := make([]dlqEntry, 0, limit)
+	for seq := info.State.LastSeq; seq >= info.State.FirstSeq && seq > 0 && len(out) < limit; seq-- {
+		e, _, err := d.entry(seq)
+		if err != nil {
+			continue // deleted
+		}
+		if robot == "" || e.Robot == robot {
+			out = append(out, *e)
+		}
+	}
+	writeJSON(w, out)
+}
+
+// replay publishes dead letter seq on its original subject again and drops
+// it from the DLQ.
+func (d *dlq) replay(seq uint64) error {
+	e, m, err := d.entry(seq)
+	if err != nil {
+		return err
+	}
+	if telem.RobotID(e.Subject) == "" {
+		return errors.New("no original subject")
+	}
+	out := nats.NewMsg(e.Subject)
+	out.Data = m.Data
+	out.Header.Set("Original-Time", e.OriginalTime)
+	out.Header.Set("Dlq-Replayed-From", strconv.FormatUint(seq, 10))
+	if _, err := d.js.PublishMsg(out); err != nil {
+		return err
+	}
+	return d.js.DeleteMsg("TELEMETRY_DLQ", seq)
+}
+
+// POST /api/dlq/replay with {"seqs":[12,13]}, or {"all":true} and optionally
+// "robot", answers {"replayed":[…],"failed":{"14":"…"}}.
+func (d *dlq) handleReplay(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Seqs  []uint64 `json:"seqs"`
+		All   bool     `json:"all"`
+		Robot string   `json:"robot"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || (len(body.Seqs) == 0) == !body.All {
+		http.Error(w, `want {"seqs":[…]} or {"all":true}`, 400)
+		return
+	}
+	if body.All {
+		info, err := d.js.StreamInfo("TELEMETRY_DLQ")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		for seq := info.State.FirstSeq; seq <= info.State.LastSeq && seq > 0; seq++ {
+			if e, _, err := d.entry(seq); err == nil && (body.Robot == "" || e.Robot == body.Robot) {
+				body.Seqs = append(body.Seqs, seq)
+			}
+		}
+	}
+	replayed, failed := []uint64{}, map[string]string{}
+	for _, seq := range body.Seqs {
+		if err := d.replay(seq); err != nil {
+			failed[strconv.FormatUint(seq, 10)] = err.Error()
+			continue
+		}
+		replayed = append(replayed, seq)
+	}
+	if err := d.audit.record(auditRecord{Actor: actorOf(req), Action: "dlq.replay", Robot: body.Robot,
+		Details: map[string]interface{}{"replayed": len(replayed), "failed": len(failed)}}); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"replayed": replayed, "failed": failed})
+}
+
+// DELETE /api/dlq/{seq} discards a dead letter for good.
+func (d *dlq) handleDelete(w http.ResponseWriter, req *http.Request) {
+	seq, err := strconv.ParseUint(chi.URLParam(req, "seq"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad seq", 400)
+		return
+	}
+	if err := d.js.DeleteMsg("TELEMETRY_DLQ", seq); err != nil {
+		if errors.Is(err, nats.ErrMsgNotFound) {
+			http.Error(w, "no such dead letter", 404)
+			return
+		}
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := d.audit.record(auditRecord{Actor: actorOf(req), Action: "dlq.delete", Details: map[string]interface{}{"seq": seq}}); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
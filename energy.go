@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// energyUse is energy accounted to one robot-day or one mission, in kWh.
+type energyUse struct {
+	Robot     string             `json:"robot,omitempty"`
+	Day       string             `json:"day,omitempty"`     // UTC, for daily records
+	Mission   string             `json:"mission,omitempty"` // for mission records
+	Robots    []string           `json:"robots,omitempty"`
+	KWh       float64            `json:"kwh"`
+	ByZone    map[string]float64 `json:"by_zone"`
+	ByMission map[string]float64 `json:"by_mission,omitempty"`
+	First     time.Time          `json:"first"`
+	Last      time.Time          `json:"last"`
+	Versions  map[string]string  `json:"versions,omitempty"` // the robot's reported versions, to spot regressions after updates
+}
+
+// energyCtx is what a robot is doing, as it last reported.
+type energyCtx struct {
+	mission, zone string
+	t             time.Time // last power sample
+	watts         float64
+}
+
+// noMission and unknownZone stand for energy used outside any mission or
+// before a robot said where it is.
+const (
+	noMission   = "none"
+	unknownZone = "unknown"
+)
+
+// energy integrates robots' power draw over time and attributes it to the
+// mission and map zone each robot is in, for kWh-per-mission and
+// kWh-per-day reports. Robots publish
+//
+//	telemetry.{id}.power    {"power_w":412} or {"voltage":48.1,"current":8.6}
+//	telemetry.{id}.mission  {"mission":"m-42"} ("" when it ends)
+//	telemetry.{id}.zone     {"zone":"aisle-3"}
+//
+// Consecutive power samples are integrated with the trapezoid rule; gaps
+// over ENERGY_MAX_GAP aren't counted. Totals accumulate in memory and are
+// added to the ENERGY bucket (d.{day}.{robot} and m.{mission}) every
+// ENERGY_FLUSH, so they survive restarts. Run it on one gateway
+// (ENERGY_ACCOUNTING=off elsewhere), or power is counted once per gateway.
+type energy struct {
+	kv     nats.KeyValue
+	reg    *registry
+	maxGap time.Duration
+
+	mu      sync.Mutex
+	robots  map[string]*energyCtx
+	pending map[string]*energyUse // bucket key → kWh not yet flushed
+}
+
+func newEnergy(js nats.JetStreamContext, reg *registry, maxGap time.Duration) (*energy, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "ENERGY", History: 1, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	return &energy{kv: kv, reg: reg, maxGap: maxGap, robots: map[string]*energyCtx{}, pending: map[string]*energyUse{}}, nil
+}
+
+func (e *energy) ctxOf(id string) *energyCtx {
+	c := e.robots[id]
+	if c == nil {
+		c = &energyCtx{mission: noMission, zone: unknownZone}
+		e.robots[id] = c
+	}
+	return c
+}
+
+func (e *energy) subscribe(nc *nats.Conn) error {
+	if _, err := nc.Subscribe("telemetry.*.power", func(msg *nats.Msg) {
+		now := time.Now()
+		p, err := telem.DecodeAny(msg.Subject, msg.Header.Get("Content-Type"), msg.Data, now, now)
+		if err != nil {
+			return
+		}
+		watts, ok := p.Fields["power_w"].(float64)
+		if !ok {
+			v, okV := p.Fields["voltage"].(float64)
+			i, okI := p.Fields["current"].(float64)
+			if !okV || !okI {
+				return
+			}
+			watts = v * i
+		}
+		e.sample(telem.RobotID(msg.Subject), p.Time, watts)
+	}); err != nil {
+		return err
+	}
+	for _, topic := range []string{"mission", "zone"} {
+		if _, err := nc.Subscribe("telemetry.*."+topic, func(msg *nats.Msg) {
+			var in map[string]interface{}
+			if json.Unmarshal(msg.Data, &in) != nil {
+				return
+			}
+			v, _ := in[topic].(string)
+			if v != "" && !tokenRe.MatchString(v) {
+				log.Printf("energy: bad %s %q from %s", topic, v, msg.Subject)
+				return
+			}
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			c := e.ctxOf(telem.RobotID(msg.Subject))
+			switch {
+			case topic == "mission" && v == "":
+				c.mission = noMission
+			case topic == "mission":
+				c.mission = v
+			case v == "":
+				c.zone = unknownZone
+			default:
+				c.zone = v
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sample integrates robot id's draw since its previous power sample.
+func (e *energy) sample(id string, t time.Time, watts float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	c := e.ctxOf(id)
+	prevT, prevW := c.t, c.watts
+	c.t, c.watts = t, watts
+	dt := t.Sub(prevT)
+	if prevT.IsZero() || dt <= 0 || dt > e.maxGap {
+		return
+	}
+	kwh := (prevW + watts) / 2 * dt.Hours() / 1000
+	day := prevT.UTC().Format("2006-01-02")
+	e.add("d."+day+"."+id, energyUse{Robot: id, Day: day}, id, c, kwh, prevT, t)
+	if c.mission != noMission {
+		e.add("m."+c.mission, energyUse{Mission: c.mission}, id, c, kwh, prevT, t)
+	}
+}
+
+// add counts kwh, used by robot id in context c, towards the record at key;
+// e.mu is held.
+func (e *energy) add(key string, init energyUse, id string, c *energyCtx, kwh float64, from, to time.Time) {
+	u := e.pending[key]
+	if u == nil {
+		init.ByZone, init.ByMission = map[string]float64{}, map[string]float64{}
+		init.First = from
+		u = &init
+		e.pending[key] = u
+	}
+	u.KWh += kwh
+	u.ByZone[c.zone] += kwh
+	if u.Mission == "" {
+		u.ByMission[c.mission] += kwh
+	} else if !contains(u.Robots, id) {
+		u.Robots = append(u.Robots, id)
+	}
+	u.Last = to
+}
+
+// run adds pending totals to the bucket every interval.
+func (e *energy) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		e.mu.Lock()
+		pending := e.pending
+		e.pending = map[string]*energyUse{}
+		e.mu.Unlock()
+		for key, u := range pending {
+			if err := e.merge(key, u); err != nil {
+				log.Printf("energy: flush %s: %v", key, err)
+				e.mu.Lock()
+				if e.pending[key] == nil {
+					e.pending[key] = u // retried with the next flush
+				} else {
+					mergeUse(e.pending[key], u)
+				}
+				e.mu.Unlock()
+			}
+		}
+	}
+}
+
+// merge adds u to the stored record at key, retrying when another writer got
+// there first.
+func (e *energy) merge(key string, u *energyUse) error {
+	if u.Robot != "" {
+		if r, err := e.reg.get(u.Robot); err == nil {
+			u.Versions = r.Versions
+		}
+	}
+	for {
+		var stored energyUse
+		var rev uint64
+		ent, err := e.kv.Get(key)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(ent.Value(), &stored); err != nil {
+				return err
+			}
+			rev = ent.Revision()
+		case errors.Is(err, nats.ErrKeyNotFound):
+		default:
+			return err
+		}
+		merged := stored
+		if rev == 0 {
+			merged = *u
+		} else {
+			mergeUse(&merged, u)
+		}
+		b, _ := json.Marshal(merged)
+		if rev == 0 {
+			_, err = e.kv.Create(key, b)
+		} else {
+			_, err = e.kv.Update(key, b, rev)
+		}
+		if !errors.Is(err, nats.ErrKeyExists) { // ErrKeyExists also covers a stale revision
+			return err
+		}
+	}
+}
+
+func mergeUse(into, u *energyUse) {
+	into.KWh += u.KWh
+	if into.ByZone == nil {
+		into.ByZone = map[string]float64{}
+	}
+	for z, v := range u.ByZone {
+		into.ByZone[z] += v
+	}
+	if len(u.ByMission) > 0 && into.ByMission == nil {
+		into.ByMission = map[string]float64{}
+	}
+	for m, v := range u.ByMission {
+		into.ByMission[m] += v
+	}
+	for _, id := range u.Robots {
+		if !contains(into.Robots, id) {
+			into.Robots = append(into.Robots, id)
+		}
+	}
+	if into.First.IsZero() || u.First.Before(into.First) {
+		into.First = u.First
+	}
+	if u.Last.After(into.Last) {
+		into.Last = u.Last
+	}
+	if u.Versions != nil {
+		into.Versions = u.Versions
+	}
+}
+
+func (e *energy) records(filter string, keep func(energyUse) bool) ([]energyUse, error) {
+	keys, err := kvKeys(e.kv, filter)
+	if err != nil {
+		return nil, err
+	}
+	out := []energyUse{}
+	for _, k := range keys {
+		ent, err := e.kv.Get(k)
+		if err != nil {
+			continue
+		}
+		var u energyUse
+		if json.Unmarshal(ent.Value(), &u) == nil && keep(u) {
+			out = append(out, u)
+		}
+	}
+	return out, nil
+}
+
+// GET /api/energy/daily?start=2025-03-01&end=2025-03-31&robot=r1 lists kWh
+// per robot and UTC day (default the last 7 days), split by zone and mission.
+func (e *energy) handleDaily(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	end, start := q.Get("end"), q.Get("start")
+	if end == "" {
+		end = time.Now().UTC().Format("2006-01-02")
+	}
+	if start == "" {
+		start = time.Now().UTC().AddDate(0, 0, -6).Format("2006-01-02")
+	}
+	for _, d := range []string{start, end} {
+		if _, err := time.Parse("2006-01-02", d); err != nil {
+			http.Error(w, "bad 'start'/'end' (YYYY-MM-DD)", 400)
+			return
+		}
+	}
+	robot := q.Get("robot")
+	if robot != "" && !tokenRe.MatchString(robot) {
+		http.Error(w, "bad 'robot'", 400)
+		return
+	}
+	out, err := e.records("d.>", func(u energyUse) bool {
+		return u.Day >= start && u.Day <= end && (robot == "" || u.Robot == robot)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Day != out[j].Day {
+			return out[i].Day < out[j].Day
+		}
+		return out[i].Robot < out[j].Robot
+	})
+	writeJSON(w, out)
+}
+
+// GET /api/energy/missions?robot=r1 lists kWh per mission, latest first.
+func (e *energy) handleMissions(w http.ResponseWriter, req *http.Request) {
+	robot := req.URL.Query().Get("robot")
+	out, err := e.records("m.>", func(u energyUse) bool { return robot == "" || contains(u.Robots, robot) })
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Last.After(out[j].Last) })
+	writeJSON(w, out)
+}
+
+// GET /api/energy/missions/{mission}
+func (e *energy) handleMission(w http.ResponseWriter, req *http.Request) {
+	mission := chi.URLParam(req, "mission")
+	if !tokenRe.MatchString(mission) {
+		http.Error(w, "bad mission id", 400)
+		return
+	}
+	ent, err := e.kv.Get("m." + mission)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no energy recorded for this mission", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ent.Value())
+}
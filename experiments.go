@@ -0,0 +1,838 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// experimentsBucket holds one experiment per key, by id.
+const experimentsBucket = "EXPERIMENTS"
+
+// Experiment states: a draft is edited until started; a running one ends
+// done when its duration is up or aborted when stopped early.
+const (
+	expDraft   = "draft"
+	expRunning = "running"
+	expDone    = "done"
+	expAborted = "aborted"
+)
+
+// expCheckEvery is how often running experiments are checked for their end.
+const expCheckEvery = 30 * time.Second
+
+// expSignificance is the two-sided p-value under which a variant's
+// difference from control counts as real.
+const expSignificance = 0.05
+
+var expAggs = map[string]bool{"mean": true, "min": true, "max": true, "median": true, "count": true, "stddev": true}
+
+// expVariant is one arm of an experiment: the parameters its robots get and
+// its share of the cohort (weight, default 1).
+type expVariant struct {
+	Name   string          `json:"name"`
+	Params json.RawMessage `json:"params"`
+	Weight int             `json:"weight,omitempty"`
+}
+
+// expMetric is a success metric: each robot's agg (default mean) of field
+// on telemetry.{robot}.{topic} (any topic without one) over the experiment,
+// and whether lower or higher is better.
+type expMetric struct {
+	Name  string `json:"name"`
+	Topic string `json:"topic,omitempty"`
+	Field string `json:"field"`
+	Agg   string `json:"agg,omitempty"`
+	Goal  string `json:"goal"`
+}
+
+// experiment tries parameter variants on cohorts of robots, e.g. controller
+// gains:
+//
+//	{"name":"drive PID v2","group":"warehouse-a","duration":"72h",
+//	 "variants":[{"name":"control","params":{"drive":{"kp":1.0}}},{"name":"tuned","params":{"drive":{"kp":1.3}}}],
+//	 "metrics":[{"name":"slip","topic":"drive","field":"slip_ratio","goal":"lower"}]}
+//
+// The cohort is robots, plus the robots of group when it starts. Starting
+// splits it between the variants by weight, in an order fixed by the
+// experiment's id (so the split doesn't follow robot ids), and sends each
+// robot its variant's params as a "params" command:
+//
+//	{"experiment":"…","variant":"tuned","params":{…}}
+//
+// When it ends (after duration, or stopped) every robot is sent baseline,
+// default the first variant's params, with "revert":true. The first variant
+// is the control the others are compared with (see expReport). Assignments
+// and reverts are also events on events.experiment.{robot}. A robot is in
+// at most one running experiment.
+type experiment struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Robots      []string        `json:"robots,omitempty"`
+	Group       string          `json:"group,omitempty"`
+	Variants    []expVariant    `json:"variants"`
+	Baseline    json.RawMessage `json:"baseline,omitempty"`
+	Duration    string          `json:"duration"`
+	Metrics     []expMetric     `json:"metrics"`
+
+	State       string            `json:"state"`
+	Assignments map[string]string `json:"assignments,omitempty"` // robot → variant
+	Started     *time.Time        `json:"started,omitempty"`
+	Ends        *time.Time        `json:"ends,omitempty"`
+	Ended       *time.Time        `json:"ended,omitempty"`
+	Updated     time.Time         `json:"updated"`
+	By          string            `json:"by,omitempty"`
+
+	duration time.Duration
+}
+
+// check validates a definition and parses its duration.
+func (e *experiment) check() error {
+	if e.Name == "" || len(e.Name) > 128 {
+		return errors.New("an experiment needs a name")
+	}
+	for _, r := range e.Robots {
+		if !tokenRe.MatchString(r) {
+			return fmt.Errorf("bad robot %q", r)
+		}
+	}
+	if e.Group != "" && !tokenRe.MatchString(e.Group) {
+		return errors.New("bad group")
+	}
+	if len(e.Robots) == 0 && e.Group == "" {
+		return errors.New("an experiment needs robots or a group")
+	}
+	if len(e.Variants) < 2 || len(e.Variants) > 8 {
+		return errors.New("an experiment needs 2 to 8 variants, the first the control")
+	}
+	names := map[string]bool{}
+	for i := range e.Variants {
+		v := &e.Variants[i]
+		if !tokenRe.MatchString(v.Name) || names[v.Name] {
+			return fmt.Errorf("bad or repeated variant name %q", v.Name)
+		}
+		names[v.Name] = true
+		if !isJSONObject(v.Params) {
+			return fmt.Errorf("variant %s: params must be a JSON object", v.Name)
+		}
+		if v.Weight == 0 {
+			v.Weight = 1
+		}
+		if v.Weight < 0 || v.Weight > 100 {
+			return fmt.Errorf("variant %s: weight must be 1 to 100", v.Name)
+		}
+	}
+	if len(e.Baseline) > 0 && !isJSONObject(e.Baseline) {
+		return errors.New("baseline must be a JSON object")
+	}
+	var err error
+	if e.duration, err = time.ParseDuration(e.Duration); err != nil || e.duration < time.Minute || e.duration > 90*24*time.Hour {
+		return fmt.Errorf("bad duration %q (1m to 90 days)", e.Duration)
+	}
+	if len(e.Metrics) == 0 || len(e.Metrics) > 16 {
+		return errors.New("an experiment needs 1 to 16 metrics")
+	}
+	names = map[string]bool{}
+	for i := range e.Metrics {
+		m := &e.Metrics[i]
+		if !tokenRe.MatchString(m.Name) || names[m.Name] {
+			return fmt.Errorf("bad or repeated metric name %q", m.Name)
+		}
+		names[m.Name] = true
+		if m.Topic != "" && !tokenRe.MatchString(m.Topic) {
+			return fmt.Errorf("metric %s: bad topic", m.Name)
+		}
+		if !fieldRe.MatchString(m.Field) {
+			return fmt.Errorf("metric %s: bad field", m.Name)
+		}
+		if m.Agg == "" {
+			m.Agg = "mean"
+		}
+		if !expAggs[m.Agg] {
+			return fmt.Errorf("metric %s: agg must be mean, min, max, median, count or stddev", m.Name)
+		}
+		if m.Goal != "lower" && m.Goal != "higher" {
+			return fmt.Errorf("metric %s: goal must be lower or higher", m.Name)
+		}
+	}
+	return nil
+}
+
+func isJSONObject(b json.RawMessage) bool {
+	b = bytes.TrimSpace(b)
+	return len(b) > 0 && b[0] == '{' && json.Valid(b)
+}
+
+// assign splits robots between the variants by weight, in an order fixed
+// by the experiment's id, each variant's count rounded by largest remainder.
+func (e *experiment) assign(robots []string) map[string]string {
+	rank := func(r string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(e.ID + "/" + r))
+		return h.Sum64()
+	}
+	sort.Slice(robots, func(i, j int) bool { return rank(robots[i]) < rank(robots[j]) })
+	total := 0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+	counts := make([]int, len(e.Variants))
+	type rem struct {
+		i int
+		f float64
+	}
+	var rems []rem
+	left := len(robots)
+	for i, v := range e.Variants {
+		share := float64(len(robots)*v.Weight) / float64(total)
+		counts[i] = int(share)
+		left -= counts[i]
+		rems = append(rems, rem{i, share - float64(counts[i])})
+	}
+	sort.SliceStable(rems, func(a, b int) bool { return rems[a].f > rems[b].f })
+	for k := 0; k < left; k++ {
+		counts[rems[k].i]++
+	}
+	out, n := map[string]string{}, 0
+	for i, v := range e.Variants {
+		for k := 0; k < counts[i]; k++ {
+			out[robots[n]] = v.Name
+			n++
+		}
+	}
+	return out
+}
+
+// experiments runs A/B tests of robot parameters (see experiment).
+type experiments struct {
+	js    nats.JetStreamContext
+	kv    nats.KeyValue
+	reg   *registry
+	cmds  *commands
+	audit *auditLog
+}
+
+func newExperiments(js nats.JetStreamContext, reg *registry, cmds *commands, audit *auditLog) (*experiments, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: experimentsBucket, History: 10, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	return &experiments{js: js, kv: kv, reg: reg, cmds: cmds, audit: audit}, nil
+}
+
+// run ends experiments whose duration is up, until ctx is done.
+func (x *experiments) run(ctx context.Context) {
+	t := time.NewTicker(expCheckEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			list, err := x.list()
+			if err != nil {
+				log.Printf("experiments: %v", err)
+				continue
+			}
+			for _, e := range list {
+				if e.State == expRunning && e.Ends != nil && !now.Before(*e.Ends) {
+					if err := x.end(e.ID, expDone, "experiments"); err != nil {
+						log.Printf("experiments: end %s: %v", e.ID, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func (x *experiments) get(id string) (*experiment, uint64, error) {
+	en, err := x.kv.Get(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	var e experiment
+	if err := json.Unmarshal(en.Value(), &e); err != nil {
+		return nil, 0, err
+	}
+	e.duration, _ = time.ParseDuration(e.Duration)
+	return &e, en.Revision(), nil
+}
+
+func (x *experiments) list() ([]experiment, error) {
+	keys, err := kvKeys(x.kv, ">")
+	if err != nil {
+		return nil, err
+	}
+	out := []experiment{}
+	for _, k := range keys {
+		if e, _, err := x.get(k); err == nil {
+			out = append(out, *e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Updated.After(out[j].Updated) })
+	return out, nil
+}
+
+// save writes e over revision rev, failing if it changed meanwhile.
+func (x *experiments) save(e *experiment, rev uint64) error {
+	e.Updated = time.Now().UTC()
+	b, _ := json.Marshal(e)
+	_, err := x.kv.Update(e.ID, b, rev)
+	return err
+}
+
+// cohort is e's robots and, now, its group's, less archived ones.
+func (x *experiments) cohort(e *experiment) ([]string, error) {
+	robots, err := x.reg.list()
+	if err != nil {
+		return nil, err
+	}
+	want := map[string]bool{}
+	for _, r := range e.Robots {
+		want[r] = true
+	}
+	var out []string
+	known := map[string]bool{}
+	for _, r := range robots {
+		known[r.ID] = true
+		if !r.Archived && (want[r.ID] || (e.Group != "" && r.Group == e.Group)) {
+			out = append(out, r.ID)
+		}
+	}
+	for _, r := range e.Robots {
+		if !known[r] {
+			return nil, fmt.Errorf("robot %s isn't registered", r)
+		}
+	}
+	return out, nil
+}
+
+// paramsCommand is the "params" command giving a robot its parameters for e.
+func paramsCommand(e *experiment, variant string, params json.RawMessage, revert bool) []byte {
+	msg := struct {
+		Experiment string          `json:"experiment"`
+		Variant    string          `json:"variant,omitempty"`
+		Params     json.RawMessage `json:"params"`
+		Revert     bool            `json:"revert,omitempty"`
+	}{e.ID, variant, params, revert}
+	b, _ := json.Marshal(msg)
+	return b
+}
+
+// send gives robot its parameters for e and records it on its timeline.
+func (x *experiments) send(e *experiment, robot, variant string, params json.RawMessage, revert bool) error {
+	if _, err := x.cmds.publish(robot, "params", paramsCommand(e, variant, params, revert)); err != nil {
+		return err
+	}
+	kind := "assigned"
+	if revert {
+		kind = "reverted"
+	}
+	ev, _ := json.Marshal(map[string]interface{}{"experiment": e.ID, "name": e.Name, "robot": robot, "variant": variant,
+		"event": kind, "ts": time.Now().UTC()})
+	_, err := x.js.Publish("events.experiment."+robot, ev)
+	return err
+}
+
+// start assigns e's cohort and sends each robot its variant. A dry run
+// stops short of saving and sending, returning the commands instead.
+func (x *experiments) start(id, by string, dry bool) (*experiment, []plannedCommand, error) {
+	e, rev, err := x.get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e.State != expDraft {
+		return nil, nil, fmt.Errorf("experiment is %s, not a draft", e.State)
+	}
+	robots, err := x.cohort(e)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(robots) < len(e.Variants) {
+		return nil, nil, fmt.Errorf("the cohort has %d robots, fewer than the variants", len(robots))
+	}
+	running, err := x.list()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, other := range running {
+		if other.State != expRunning {
+			continue
+		}
+		for _, r := range robots {
+			if _, ok := other.Assignments[r]; ok {
+				return nil, nil, fmt.Errorf("robot %s is in running experiment %s", r, other.ID)
+			}
+		}
+	}
+	now := time.Now().UTC()
+	ends := now.Add(e.duration)
+	e.State, e.Assignments, e.Started, e.Ends, e.By = expRunning, e.assign(robots), &now, &ends, by
+	sizes := map[string]int{}
+	for _, v := range e.Assignments {
+		sizes[v]++
+	}
+	for _, v := range e.Variants {
+		if sizes[v.Name] == 0 {
+			return nil, nil, fmt.Errorf("variant %s gets no robots from a cohort of %d; add robots or even out the weights", v.Name, len(robots))
+		}
+	}
+	params := map[string]json.RawMessage{}
+	for _, v := range e.Variants {
+		params[v.Name] = v.Params
+	}
+	if dry {
+		plan := make([]plannedCommand, 0, len(robots))
+		for _, r := range robots {
+			plan = append(plan, x.cmds.plan(r, "params", paramsCommand(e, e.Assignments[r], params[e.Assignments[r]], false)))
+		}
+		return e, plan, nil
+	}
+	if err := x.save(e, rev); err != nil {
+		return nil, nil, err
+	}
+	for _, r := range robots {
+		if err := x.send(e, r, e.Assignments[r], params[e.Assignments[r]], false); err != nil {
+			log.Printf("experiments: %s: send to %s: %v", e.ID, r, err)
+		}
+	}
+	return e, nil, nil
+}
+
+// end finishes a running experiment as state, reverting its robots.
+func (x *experiments) end(id, state, by string) error {
+	e, rev, err := x.get(id)
+	if err != nil {
+		return err
+	}
+	if e.State != expRunning {
+		return fmt.Errorf("experiment is %s, not running", e.State)
+	}
+	now := time.Now().UTC()
+	e.State, e.Ended, e.By = state, &now, by
+	if err := x.save(e, rev); err != nil {
+		return err
+	}
+	baseline := e.Baseline
+	if len(baseline) == 0 {
+		baseline = e.Variants[0].Params
+	}
+	for r := range e.Assignments {
+		if err := x.send(e, r, "", baseline, true); err != nil {
+			log.Printf("experiments: %s: revert %s: %v", e.ID, r, err)
+		}
+	}
+	return x.audit.record(auditRecord{Actor: by, Action: "experiment.end", Details: map[string]interface{}{"id": id, "state": state}})
+}
+
+// expArm is one variant's side of a metric: each robot's value and their
+// mean and standard deviation.
+type expArm struct {
+	Variant string             `json:"variant"`
+	N       int                `json:"n"`
+	Mean    *float64           `json:"mean,omitempty"`
+	StdDev  *float64           `json:"stddev,omitempty"`
+	Robots  map[string]float64 `json:"robots"`
+}
+
+// expComparison holds a variant against control by Welch's t-test on the
+// robots' values, robots being the unit that was assigned.
+type expComparison struct {
+	Variant  string  `json:"variant"`
+	Diff     float64 `json:"diff"`               // variant mean − control mean
+	Relative float64 `json:"relative,omitempty"` // diff / control mean
+	T        float64 `json:"t"`
+	DF       float64 `json:"df"`
+	P        float64 `json:"p"`       // two-sided
+	Verdict  string  `json:"verdict"` // better, worse or inconclusive, per the metric's goal
+}
+
+type expMetricReport struct {
+	expMetric
+	Arms        []expArm        `json:"arms"`
+	Comparisons []expComparison `json:"comparisons"`
+}
+
+// expReport is GET /api/experiments/{id}/report.
+type expReport struct {
+	ID      string            `json:"id"`
+	State   string            `json:"state"`
+	From    time.Time         `json:"from"`
+	To      time.Time         `json:"to"`
+	Control string            `json:"control"`
+	Metrics []expMetricReport `json:"metrics"`
+}
+
+// metricValues is each of robots' agg of m.Field over [from, to].
+func metricValues(ctx context.Context, db *influxTarget, m expMetric, robots []string, from, to time.Time) (map[string]float64, error) {
+	// robot ids are tokenRe, so safe inside the regex alternation
+	match := `/^telemetry\.(` + strings.Join(robots, "|") + `)\.`
+	if m.Topic != "" {
+		match += m.Topic + `$/`
+	} else {
+		match += `/`
+	}
+	flux := strings.Builder{}
+	flux.WriteString(`import "strings" `)
+	flux.WriteString(`from(bucket:"` + db.Bucket + `") |> range(start:` + from.Format(time.RFC3339Nano) + `, stop:` + to.Format(time.RFC3339Nano) + `)`)
+	flux.WriteString(telemetryFilter())
+	flux.WriteString(` |> filter(fn:(r)=> r._field == "` + m.Field + `")`)
+	flux.WriteString(` |> filter(fn:(r)=> r.subject =~ ` + match + `)`)
+	flux.WriteString(` |> map(fn:(r)=> ({r with robot: strings.split(v: r.subject, t: ".")[1], _value: float(v: r._value)}))`)
+	flux.WriteString(` |> group(columns: ["robot"]) |> ` + m.Agg + `() |> toFloat()`)
+	flux.WriteString(` |> keep(columns: ["_value","robot"])`)
+	res, err := db.Client.QueryAPI(db.Org).Query(ctx, flux.String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+	out := map[string]float64{}
+	for res.Next() {
+		robot, _ := res.Record().ValueByKey("robot").(string)
+		if v, ok := numeric(res.Record().Value()); ok && robot != "" && !math.IsNaN(v) {
+			out[robot] = v
+		}
+	}
+	return out, res.Err()
+}
+
+func meanStd(xs []float64) (float64, float64) {
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	mean := sum / float64(len(xs))
+	if len(xs) < 2 {
+		return mean, 0
+	}
+	var ss float64
+	for _, x := range xs {
+		ss += (x - mean) * (x - mean)
+	}
+	return mean, math.Sqrt(ss / float64(len(xs)-1))
+}
+
+// welch is Welch's t-test of b against a: t, the degrees of freedom and
+// the two-sided p-value. Fewer than two values a side, or no variance at
+// all, give p 1.
+func welch(a, b []float64) (float64, float64, float64) {
+	if len(a) < 2 || len(b) < 2 {
+		return 0, 0, 1
+	}
+	ma, sa := meanStd(a)
+	mb, sb := meanStd(b)
+	va, vb := sa*sa/float64(len(a)), sb*sb/float64(len(b))
+	if va+vb == 0 {
+		return 0, 0, 1
+	}
+	t := (mb - ma) / math.Sqrt(va+vb)
+	df := (va + vb) * (va + vb) / (va*va/float64(len(a)-1) + vb*vb/float64(len(b)-1))
+	return t, df, betaInc(df/2, 0.5, df/(df+t*t))
+}
+
+// betaInc is the regularized incomplete beta function I_x(a, b), by its
+// continued fraction (Numerical Recipes' betacf).
+func betaInc(a, b, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	la, _ := math.Lgamma(a + b)
+	lb, _ := math.Lgamma(a)
+	lc, _ := math.Lgamma(b)
+	front := math.Exp(la - lb - lc + a*math.Log(x) + b*math.Log(1-x))
+	if x > (a+1)/(a+b+2) {
+		return 1 - betaInc(b, a, 1-x)
+	}
+	const eps, tiny = 1e-12, 1e-300
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	f := d
+	for m := 1; m <= 300; m++ {
+		fm := float64(m)
+		num := fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm))
+		for _, n := range []float64{num, -(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1))} {
+			d = 1 + n*d
+			if math.Abs(d) < tiny {
+				d = tiny
+			}
+			c = 1 + n/c
+			if math.Abs(c) < tiny {
+				c = tiny
+			}
+			d = 1 / d
+			f *= d * c
+		}
+		if math.Abs(d*c-1) < eps {
+			break
+		}
+	}
+	return front * f / a
+}
+
+// report computes e's metrics per variant over its run so far; e has
+// started.
+func (x *experiments) report(ctx context.Context, db *influxTarget, e *experiment) (*expReport, error) {
+	to := time.Now().UTC()
+	if e.Ended != nil {
+		to = *e.Ended
+	}
+	out := &expReport{ID: e.ID, State: e.State, From: *e.Started, To: to, Control: e.Variants[0].Name, Metrics: []expMetricReport{}}
+	robots := make([]string, 0, len(e.Assignments))
+	for r := range e.Assignments {
+		robots = append(robots, r)
+	}
+	sort.Strings(robots)
+	for _, m := range e.Metrics {
+		values, err := metricValues(ctx, db, m, robots, *e.Started, to)
+		if err != nil {
+			return nil, fmt.Errorf("metric %s: %w", m.Name, err)
+		}
+		mr := expMetricReport{expMetric: m, Arms: []expArm{}, Comparisons: []expComparison{}}
+		samples := map[string][]float64{}
+		for _, v := range e.Variants {
+			arm := expArm{Variant: v.Name, Robots: map[string]float64{}}
+			for _, r := range robots {
+				if e.Assignments[r] != v.Name {
+					continue
+				}
+				if val, ok := values[r]; ok {
+					arm.Robots[r] = val
+					samples[v.Name] = append(samples[v.Name], val)
+				}
+			}
+			if arm.N = len(samples[v.Name]); arm.N > 0 {
+				mean, sd := meanStd(samples[v.Name])
+				arm.Mean, arm.StdDev = &mean, &sd
+			}
+			mr.Arms = append(mr.Arms, arm)
+		}
+		control := samples[e.Variants[0].Name]
+		for _, v := range e.Variants[1:] {
+			b := samples[v.Name]
+			if len(control) == 0 || len(b) == 0 {
+				continue
+			}
+			ma, _ := meanStd(control)
+			mb, _ := meanStd(b)
+			t, df, p := welch(control, b)
+			c := expComparison{Variant: v.Name, Diff: mb - ma, T: t, DF: df, P: p, Verdict: "inconclusive"}
+			if ma != 0 {
+				c.Relative = (mb - ma) / math.Abs(ma)
+			}
+			if p < expSignificance {
+				if (m.Goal == "lower") == (c.Diff < 0) {
+					c.Verdict = "better"
+				} else {
+					c.Verdict = "worse"
+				}
+			}
+			mr.Comparisons = append(mr.Comparisons, c)
+		}
+		out.Metrics = append(out.Metrics, mr)
+	}
+	return out, nil
+}
+
+// GET /api/experiments[?state=running]
+func (x *experiments) handleList(w http.ResponseWriter, req *http.Request) {
+	list, err := x.list()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	state := req.URL.Query().Get("state")
+	out := list[:0]
+	for _, e := range list {
+		if state == "" || e.State == state {
+			out = append(out, e)
+		}
+	}
+	writeJSON(w, out)
+}
+
+// GET /api/experiments/{id}
+func (x *experiments) handleGet(w http.ResponseWriter, req *http.Request) {
+	e, _, err := x.get(chi.URLParam(req, "id"))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such experiment", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, e)
+}
+
+// PUT /api/experiments/{id} creates or replaces a draft (see experiment).
+func (x *experiments) handlePut(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	if !tokenRe.MatchString(id) {
+		http.Error(w, "bad experiment id (letters, digits, _ and - only)", 400)
+		return
+	}
+	prev, rev, err := x.get(id)
+	if err != nil && !errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if prev != nil && prev.State != expDraft {
+		http.Error(w, "experiment is "+prev.State+"; only drafts can change", http.StatusConflict)
+		return
+	}
+	var e experiment
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 256<<10)).Decode(&e); err != nil {
+		http.Error(w, "bad JSON", 400)
+		return
+	}
+	e.ID, e.State, e.By = id, expDraft, actorOf(req)
+	e.Assignments, e.Started, e.Ends, e.Ended = nil, nil, nil, nil
+	if err := e.check(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := x.audit.record(auditRecord{Actor: e.By, Action: "experiment.put", Details: map[string]interface{}{"id": id, "name": e.Name, "variants": len(e.Variants)}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	e.Updated = time.Now().UTC()
+	b, _ := json.Marshal(e)
+	if prev == nil {
+		_, err = x.kv.Create(id, b)
+	} else {
+		_, err = x.kv.Update(id, b, rev)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, e)
+}
+
+// DELETE /api/experiments/{id} forgets an experiment that isn't running.
+func (x *experiments) handleDelete(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	e, _, err := x.get(id)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such experiment", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if e.State == expRunning {
+		http.Error(w, "experiment is running; stop it first", http.StatusConflict)
+		return
+	}
+	if err := x.audit.record(auditRecord{Actor: actorOf(req), Action: "experiment.delete", Details: map[string]interface{}{"id": id}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	if err := x.kv.Delete(id); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// POST /api/experiments/{id}/start assigns the cohort and sends the
+// parameters; 409 unless it is a draft, or if a robot is in another
+// running experiment. With ?dryRun=true it checks the same, then answers
+// with the experiment as it would start and the commands it would send,
+// leaving it a draft.
+func (x *experiments) handleStart(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	if _, _, err := x.get(id); errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such experiment", 404)
+		return
+	}
+	dry, err := dryRun(req)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if dry {
+		e, plan, err := x.start(id, actorOf(req), true)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"dry_run": true, "experiment": e, "messages": plan})
+		return
+	}
+	if err := x.audit.record(auditRecord{Actor: actorOf(req), Action: "experiment.start", Details: map[string]interface{}{"id": id}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	e, _, err := x.start(id, actorOf(req), false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, e)
+}
+
+// POST /api/experiments/{id}/stop aborts a running experiment, reverting
+// its robots to the baseline.
+func (x *experiments) handleStop(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	if _, _, err := x.get(id); errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such experiment", 404)
+		return
+	}
+	if err := x.end(id, expAborted, actorOf(req)); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	e, _, _ := x.get(id)
+	writeJSON(w, e)
+}
+
+// GET /api/experiments/{id}/report compares each variant with the control
+// on every metric, over the run so far (see expReport, expComparison).
+func (x *experiments) handleReport(w http.ResponseWriter, req *http.Request) {
+	db := influxOf(req)
+	if db == nil {
+		http.Error(w, "influx not configured", http.StatusNotImplemented)
+		return
+	}
+	e, _, err := x.get(chi.URLParam(req, "id"))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such experiment", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if e.Started == nil {
+		http.Error(w, "experiment hasn't started", http.StatusConflict)
+		return
+	}
+	out, err := x.report(req.Context(), db, e)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, out)
+}
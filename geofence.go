@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// geofencesBucket holds one geofence per key, by id.
+const geofencesBucket = "GEOFENCES"
+
+// Fence shapes and modes.
+const (
+	fenceCircle  = "circle"
+	fencePolygon = "polygon"
+
+	fenceKeepIn  = "keep_in"  // leaving is a violation
+	fenceKeepOut = "keep_out" // entering is a violation
+)
+
+// Geofence events, published on events.geofence.{id}.
+const (
+	fenceEntry     = "entry"
+	fenceExit      = "exit"
+	fenceViolation = "violation"
+)
+
+const earthRadiusM = 6371008.8
+
+type latLon struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+func (p latLon) valid() bool { return p.Lat >= -90 && p.Lat <= 90 && p.Lon >= -180 && p.Lon <= 180 }
+
+// distance is the great-circle distance from p to q in metres.
+func (p latLon) distance(q latLon) float64 {
+	rad := math.Pi / 180
+	dLat, dLon := (q.Lat-p.Lat)*rad, (q.Lon-p.Lon)*rad
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(p.Lat*rad)*math.Cos(q.Lat*rad)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * earthRadiusM * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// geofence is an area robots must stay in or out of, a circle:
+//
+//	{"name":"Dock","shape":"circle","center":{"lat":38.72,"lon":-9.14},"radius_m":25,"mode":"keep_out","robots":["r1","r2"]}
+//
+// or a polygon of at least three vertices, in order:
+//
+//	{"shape":"polygon","polygon":[{"lat":…,"lon":…},…],"mode":"keep_in","hard":true}
+//
+// No robots means every robot. Crossing the boundary the wrong way is a
+// violation; a hard fence also e-stops the robot.
+type geofence struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name,omitempty"`
+	Shape   string    `json:"shape"`
+	Center  *latLon   `json:"center,omitempty"`
+	RadiusM float64   `json:"radius_m,omitempty"`
+	Polygon []latLon  `json:"polygon,omitempty"`
+	Mode    string    `json:"mode"`
+	Hard    bool      `json:"hard,omitempty"`
+	Robots  []string  `json:"robots,omitempty"`
+	Updated time.Time `json:"updated"`
+	By      string    `json:"by,omitempty"`
+}
+
+// check validates f.
+func (f *geofence) check() error {
+	switch f.Shape {
+	case fenceCircle:
+		if f.Center == nil || !f.Center.valid() {
+			return errors.New("a circle needs a center with lat/lon in range")
+		}
+		if f.RadiusM <= 0 {
+			return errors.New("a circle needs a positive radius_m")
+		}
+		f.Polygon = nil
+	case fencePolygon:
+		if len(f.Polygon) < 3 {
+			return errors.New("a polygon needs at least three vertices")
+		}
+		for _, p := range f.Polygon {
+			if !p.valid() {
+				return errors.New("polygon lat/lon out of range")
+			}
+		}
+		f.Center, f.RadiusM = nil, 0
+	default:
+		return errors.New("shape must be circle or polygon")
+	}
+	if f.Mode == "" {
+		f.Mode = fenceKeepIn
+	}
+	if f.Mode != fenceKeepIn && f.Mode != fenceKeepOut {
+		return errors.New("mode must be keep_in or keep_out")
+	}
+	for _, r := range f.Robots {
+		if !tokenRe.MatchString(r) {
+			return fmt.Errorf("bad robot %q", r)
+		}
+	}
+	return nil
+}
+
+func (f *geofence) applies(robot string) bool {
+	if len(f.Robots) == 0 {
+		return true
+	}
+	for _, r := range f.Robots {
+		if r == robot {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether p is inside f. Polygons are taken as flat in
+// degrees, which is close enough at the size of a site.
+func (f *geofence) contains(p latLon) bool {
+	if f.Shape == fenceCircle {
+		return f.Center.distance(p) <= f.RadiusM
+	}
+	in := false
+	for i, j := 0, len(f.Polygon)-1; i < len(f.Polygon); j, i = i, i+1 {
+		a, b := f.Polygon[i], f.Polygon[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) && p.Lon < (b.Lon-a.Lon)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			in = !in
+		}
+	}
+	return in
+}
+
+// violated reports whether being inside (or not) breaks f.
+func (f *geofence) violated(inside bool) bool { return inside == (f.Mode == fenceKeepOut) }
+
+type geofenceEvent struct {
+	Fence    string    `json:"fence"`
+	Name     string    `json:"name,omitempty"`
+	Robot    string    `json:"robot"`
+	Event    string    `json:"event"` // entry, exit or violation
+	Mode     string    `json:"mode"`
+	Position latLon    `json:"position"`
+	EStop    bool      `json:"estop,omitempty"` // an e-stop was sent
+	TS       time.Time `json:"ts"`
+}
+
+// geofencing checks robots' positions against the fences in the GEOFENCES
+// bucket. Positions are read from telemetry on GEOFENCE_SUBJECTS (default
+// telemetry.*.gps), fields GEOFENCE_LAT_FIELD and GEOFENCE_LON_FIELD
+// (default lat and lon). Crossing a fence's boundary publishes entry or
+// exit on events.geofence.{id}, followed by violation when the crossing
+// breaks the fence; a robot first seen on the wrong side is a violation
+// too. Like alerting, evaluation keeps its state in memory and should run
+// on one gateway (GEOFENCING off on the others), or each event is
+// published, and each hard fence's e-stop sent, once per gateway.
+type geofencing struct {
+	js       nats.JetStreamContext
+	kv       nats.KeyValue
+	rb       *rbac
+	audit    *auditLog
+	cmds     *commands
+	subjects []string
+	lat, lon string
+
+	mu     sync.Mutex
+	fences map[string]*geofence
+	inside map[string]map[string]bool // fence → robot → inside
+}
+
+func newGeofencing(js nats.JetStreamContext, rb *rbac, audit *auditLog, cmds *commands, subjects, lat, lon string) (*geofencing, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: geofencesBucket, History: 5, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	g := &geofencing{js: js, kv: kv, rb: rb, audit: audit, cmds: cmds, lat: lat, lon: lon,
+		fences: map[string]*geofence{}, inside: map[string]map[string]bool{}}
+	for _, s := range strings.Split(subjects, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.HasPrefix(s, "telemetry.") {
+			return nil, fmt.Errorf("GEOFENCE_SUBJECTS: %q is not a telemetry.… pattern", s)
+		}
+		g.subjects = append(g.subjects, s)
+	}
+	if !fieldRe.MatchString(lat) || !fieldRe.MatchString(lon) {
+		return nil, errors.New("bad GEOFENCE_LAT_FIELD or GEOFENCE_LON_FIELD")
+	}
+	return g, nil
+}
+
+// run follows the fences bucket and positions until ctx is done.
+func (g *geofencing) run(ctx context.Context, nc *nats.Conn) error {
+	w, err := g.kv.WatchAll()
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer w.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-w.Updates():
+				if e != nil {
+					g.setFence(e)
+				}
+			}
+		}
+	}()
+	var subs []*nats.Subscription
+	for _, s := range g.subjects {
+		sub, err := nc.Subscribe(s, g.onPosition)
+		if err != nil {
+			return err
+		}
+		subs = append(subs, sub)
+	}
+	go func() {
+		<-ctx.Done()
+		for _, sub := range subs {
+			sub.Unsubscribe()
+		}
+	}()
+	return nil
+}
+
+func (g *geofencing) setFence(e nats.KeyValueEntry) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.inside, e.Key()) // a changed fence starts afresh
+	if e.Operation() != nats.KeyValuePut {
+		delete(g.fences, e.Key())
+		return
+	}
+	var f geofence
+	if err := json.Unmarshal(e.Value(), &f); err != nil || f.check() != nil {
+		log.Printf("geofences: ignoring bad fence %s", e.Key())
+		delete(g.fences, e.Key())
+		return
+	}
+	g.fences[e.Key()] = &f
+}
+
+func (g *geofencing) onPosition(msg *nats.Msg) {
+	now := time.Now()
+	robot := robotOfSubject(telem.TrimFormat(msg.Subject))
+	if robot == "" {
+		return
+	}
+	p, err := telem.DecodeAny(msg.Subject, msg.Header.Get("Content-Type"), msg.Data, now, now)
+	if err != nil {
+		return
+	}
+	lat, ok1 := numeric(p.Fields[g.lat])
+	lon, ok2 := numeric(p.Fields[g.lon])
+	pos := latLon{lat, lon}
+	if !ok1 || !ok2 || !pos.valid() {
+		return
+	}
+	g.observe(robot, pos, p.Time)
+}
+
+// observe checks robot's position against its fences and acts on the
+// crossings.
+func (g *geofencing) observe(robot string, pos latLon, ts time.Time) {
+	type crossing struct {
+		f      geofence
+		events []string
+	}
+	var crossed []crossing
+	g.mu.Lock()
+	for id, f := range g.fences {
+		if !f.applies(robot) {
+			continue
+		}
+		in := f.contains(pos)
+		states := g.inside[id]
+		if states == nil {
+			states = map[string]bool{}
+			g.inside[id] = states
+		}
+		was, known := states[robot]
+		states[robot] = in
+		var events []string
+		switch {
+		case !known:
+			if f.violated(in) {
+				events = append(events, fenceViolation)
+			}
+		case in && !was:
+			events = append(events, fenceEntry)
+		case !in && was:
+			events = append(events, fenceExit)
+		}
+		if known && in != was && f.violated(in) {
+			events = append(events, fenceViolation)
+		}
+		if len(events) > 0 {
+			crossed = append(crossed, crossing{*f, events})
+		}
+	}
+	g.mu.Unlock()
+	for _, c := range crossed {
+		for _, ev := range c.events {
+			g.publish(c.f, robot, ev, pos, ts)
+		}
+	}
+}
+
+// publish announces ev, e-stopping the robot first on a hard fence's
+// violation.
+func (g *geofencing) publish(f geofence, robot, ev string, pos latLon, ts time.Time) {
+	e := geofenceEvent{Fence: f.ID, Name: f.Name, Robot: robot, Event: ev, Mode: f.Mode, Position: pos, TS: ts}
+	if ev == fenceViolation && f.Hard {
+		reason, _ := json.Marshal(map[string]string{"reason": "geofence " + f.ID})
+		if _, err := g.cmds.publish(robot, "estop", reason); err != nil {
+			log.Printf("geofences: e-stop %s for %s: %v", robot, f.ID, err)
+		} else {
+			e.EStop = true
+			if err := g.audit.record(auditRecord{Actor: "geofencing", Action: "geofence.estop", Robot: robot,
+				Details: map[string]interface{}{"fence": f.ID, "lat": pos.Lat, "lon": pos.Lon}}); err != nil {
+				log.Printf("geofences: audit e-stop %s: %v", robot, err)
+			}
+		}
+	}
+	b, _ := json.Marshal(e)
+	if _, err := g.js.Publish("events.geofence."+f.ID, b); err != nil {
+		log.Printf("geofences: publish %s %s for %s: %v", ev, f.ID, robot, err)
+	}
+}
+
+func (g *geofencing) getFence(id string) (*geofence, error) {
+	e, err := g.kv.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	var f geofence
+	if err := json.Unmarshal(e.Value(), &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// insideOf lists the robots id knows to be inside fence, within scope.
+func (g *geofencing) insideOf(fence string, id *identity) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := []string{}
+	for robot, in := range g.inside[fence] {
+		if in && g.rb.sees(id, robot) {
+			out = append(out, robot)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// GET /api/geofences[?robot=] lists fences, or those applying to a robot.
+func (g *geofencing) handleList(w http.ResponseWriter, req *http.Request) {
+	robot := req.URL.Query().Get("robot")
+	keys, err := kvKeys(g.kv, ">")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := []geofence{}
+	for _, k := range keys {
+		if f, err := g.getFence(k); err == nil && (robot == "" || f.applies(robot)) {
+			out = append(out, *f)
+		}
+	}
+	writeJSON(w, out)
+}
+
+// GET /api/geofences/{id} gives a fence and the robots inside it.
+func (g *geofencing) handleGet(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	f, err := g.getFence(id)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such geofence", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, struct {
+		*geofence
+		Inside []string `json:"inside"`
+	}{f, g.insideOf(id, identityOf(req))})
+}
+
+// PUT /api/geofences/{id} creates or replaces a fence (see geofence).
+func (g *geofencing) handlePut(w http.ResponseWriter, req *http.Request) {
+	var f geofence
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 256<<10)).Decode(&f); err != nil {
+		http.Error(w, "bad JSON", 400)
+		return
+	}
+	f.ID, f.Updated, f.By = chi.URLParam(req, "id"), time.Now().UTC(), actorOf(req)
+	if !tokenRe.MatchString(f.ID) {
+		http.Error(w, "bad geofence id (letters, digits, _ and - only)", 400)
+		return
+	}
+	if err := f.check(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := g.audit.record(auditRecord{Actor: f.By, Action: "geofence.put", Details: map[string]interface{}{"id": f.ID, "shape": f.Shape, "mode": f.Mode, "hard": f.Hard}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	b, _ := json.Marshal(f)
+	if _, err := g.kv.Put(f.ID, b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, f)
+}
+
+// DELETE /api/geofences/{id}
+func (g *geofencing) handleDelete(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	if _, err := g.getFence(id); errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such geofence", 404)
+		return
+	}
+	if err := g.audit.record(auditRecord{Actor: actorOf(req), Action: "geofence.delete", Details: map[string]interface{}{"id": id}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	if err := g.kv.Delete(id); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
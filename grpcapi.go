@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/api/fleetpb"
+	"github.com/VazRibeiro/evabot-backend/internal/metrics"
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcStreamBuffer is how many messages a StreamTelemetry call may fall
+// behind before it loses some.
+const grpcStreamBuffer = 1024
+
+// fleetAPI serves api/fleetpb's Fleet service on GRPC_BIND, for services
+// that would rather not speak HTTP and WebSocket. Callers authenticate with
+// the same bearer tokens, in "authorization" metadata. SendCommand and
+// QueryTimeSeries are replayed through the HTTP router, as approvals are,
+// so validation, roles, scopes, lockout and query limits apply exactly as
+// they do to POST /api/robot/{id}/cmd and GET /api/ts; StreamTelemetry
+// follows NATS directly, within the caller's scope.
+type fleetAPI struct {
+	fleetpb.UnimplementedFleetServer
+	nc     *nats.Conn
+	auth   *auth
+	rb     *rbac
+	router http.Handler // set once routes are mounted
+	calls  *metrics.Counter
+}
+
+func newFleetAPI(nc *nats.Conn, a *auth, rb *rbac) *fleetAPI {
+	return &fleetAPI{nc: nc, auth: a, rb: rb,
+		calls: metrics.NewCounter("evabot_grpc_calls_total", "gRPC calls by method and status code.", "method", "code")}
+}
+
+// server returns a gRPC server with the Fleet service and call metrics.
+func (f *fleetAPI) server() *grpc.Server {
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, next grpc.UnaryHandler) (interface{}, error) {
+			resp, err := next(ctx, req)
+			f.calls.Inc(info.FullMethod, status.Code(err).String())
+			return resp, err
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, next grpc.StreamHandler) error {
+			err := next(srv, ss)
+			f.calls.Inc(info.FullMethod, status.Code(err).String())
+			return err
+		}))
+	fleetpb.RegisterFleetServer(s, f)
+	return s
+}
+
+// token is the call's bearer token, "" without one.
+func token(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if tok := strings.TrimPrefix(v, "Bearer "); tok != v {
+			return tok
+		}
+	}
+	return ""
+}
+
+// identify authenticates a call as auth.middleware does a request: nil
+// without a token, when none is required.
+func (f *fleetAPI) identify(ctx context.Context) (*identity, error) {
+	tok := token(ctx)
+	if tok == "" {
+		if f.auth.required {
+			return nil, status.Error(codes.Unauthenticated, "authentication required")
+		}
+		return nil, nil
+	}
+	id, err := f.auth.verify(tok)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return id, nil
+}
+
+// validPattern reports whether p is a NATS subject pattern: tokens, *
+// for one, > last for the rest.
+func validPattern(p string) bool {
+	parts := strings.Split(p, ".")
+	for i, t := range parts {
+		if !(t == "*" || (t == ">" && i == len(parts)-1) || tokenRe.MatchString(t)) {
+			return false
+		}
+	}
+	return len(parts) <= 16
+}
+
+// StreamTelemetry follows telemetry.> (or the filter's part of it) on core
+// NATS. Viewers, whose feed is decimated and delayed, use /ws instead.
+func (f *fleetAPI) StreamTelemetry(in *fleetpb.SubjectFilter, stream fleetpb.Fleet_StreamTelemetryServer) error {
+	id, err := f.identify(stream.Context())
+	if err != nil {
+		return err
+	}
+	if rankOf(id) < roleRank[roleOperator] {
+		return status.Error(codes.PermissionDenied, "viewers stream over /ws")
+	}
+	subject := "telemetry.>"
+	if in.Robot != "" {
+		if !tokenRe.MatchString(in.Robot) {
+			return status.Error(codes.InvalidArgument, "bad robot id")
+		}
+		if !f.rb.sees(id, in.Robot) {
+			return status.Error(codes.PermissionDenied, "robot "+in.Robot+" is outside your scope")
+		}
+		subject = "telemetry." + in.Robot + ".>"
+	}
+	if in.Subject != "" {
+		if !strings.HasPrefix(in.Subject, "telemetry.") || !validPattern(in.Subject) {
+			return status.Error(codes.InvalidArgument, "bad subject (a telemetry.… pattern)")
+		}
+		if in.Robot != "" && telem.RobotID(in.Subject) != in.Robot {
+			return status.Error(codes.InvalidArgument, "subject isn't robot "+in.Robot+"'s")
+		}
+		subject = in.Subject
+	}
+	scope := f.rb.filter(id)
+
+	ch := make(chan *nats.Msg, grpcStreamBuffer)
+	var dropped atomic.Uint64
+	sub, err := f.nc.Subscribe(subject, func(m *nats.Msg) {
+		select {
+		case ch <- m:
+		default:
+			dropped.Add(1)
+		}
+	})
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer sub.Unsubscribe()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case m := <-ch:
+			if scope != nil && !scope.allows(m.Subject) {
+				continue
+			}
+			if err := stream.Send(&fleetpb.TelemetryMessage{Subject: m.Subject, ReceivedUnixNano: time.Now().UnixNano(),
+				Payload: m.Data, ContentType: m.Header.Get("Content-Type"), Dropped: dropped.Swap(0)}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// replay runs an HTTP request through the router as the call's caller,
+// returning the response or the error its status maps to.
+func (f *fleetAPI) replay(ctx context.Context, method, target string, body []byte) (*httptest.ResponseRecorder, error) {
+	if f.router == nil {
+		return nil, status.Error(codes.Unavailable, "starting up")
+	}
+	req := httptest.NewRequest(method, target, bytes.NewReader(body)).WithContext(ctx)
+	if tok := token(ctx); tok != "" {
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		req.RemoteAddr = p.Addr.String()
+	}
+	rec := httptest.NewRecorder()
+	f.router.ServeHTTP(rec, req)
+	if rec.Code >= 300 {
+		return nil, status.Error(httpCode(rec.Code), strings.TrimSpace(rec.Body.String()))
+	}
+	return rec, nil
+}
+
+// httpCode maps an HTTP error status to the gRPC code closest to it.
+func httpCode(code int) codes.Code {
+	switch code {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict, http.StatusLocked, http.StatusPreconditionFailed:
+		return codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+// SendCommand is POST /api/robot/{id}/cmd.
+func (f *fleetAPI) SendCommand(ctx context.Context, in *fleetpb.CommandRequest) (*fleetpb.CommandReply, error) {
+	if !tokenRe.MatchString(in.Robot) {
+		return nil, status.Error(codes.InvalidArgument, "bad robot id")
+	}
+	body, _ := json.Marshal(map[string]interface{}{"name": in.Name, "params": in.Params.AsMap(), "priority": in.Priority, "requires": in.Requires})
+	rec, err := f.replay(ctx, http.MethodPost, "/api/robot/"+in.Robot+"/cmd", body)
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		command
+		ID   string `json:"id"`
+		Kind string `json:"kind"` // an approval's
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if out.Kind != "" {
+		return &fleetpb.CommandReply{ApprovalId: out.ID}, nil
+	}
+	return &fleetpb.CommandReply{Seq: out.Seq, Subject: out.Subject, State: out.State}, nil
+}
+
+// QueryTimeSeries is GET /api/ts, read as NDJSON.
+func (f *fleetAPI) QueryTimeSeries(ctx context.Context, in *fleetpb.TimeSeriesQuery) (*fleetpb.TimeSeries, error) {
+	if len(in.Fields) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "fields required")
+	}
+	q := url.Values{"format": {"ndjson"}, "field": {strings.Join(in.Fields, ",")}}
+	for k, v := range map[string]string{"subject": in.Subject, "start": in.Start, "stop": in.Stop, "window": in.Window, "agg": in.Agg} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if in.Limit > 0 {
+		q.Set("limit", strconv.Itoa(int(in.Limit)))
+	}
+	if in.Offset > 0 {
+		q.Set("offset", strconv.Itoa(int(in.Offset)))
+	}
+	rec, err := f.replay(ctx, http.MethodGet, "/api/ts?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	out := &fleetpb.TimeSeries{}
+	sc := bufio.NewScanner(rec.Body)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for sc.Scan() {
+		var line struct {
+			Subject    string                 `json:"subject"`
+			T          time.Time              `json:"t"`
+			V          interface{}            `json:"v"`
+			Values     map[string]interface{} `json:"values"`
+			Truncated  bool                   `json:"truncated"`
+			NextOffset int                    `json:"next_offset"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if line.Truncated {
+			out.Truncated, out.NextOffset = true, int32(line.NextOffset)
+			continue
+		}
+		if len(in.Fields) == 1 {
+			line.Values = map[string]interface{}{in.Fields[0]: line.V}
+		}
+		p := &fleetpb.Point{Subject: line.Subject, TimeUnixNano: line.T.UnixNano(), Values: map[string]float64{}}
+		for k, v := range line.Values {
+			if x, ok := numeric(v); ok {
+				p.Values[k] = x
+			}
+		}
+		out.Points = append(out.Points, p)
+	}
+	return out, sc.Err()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// Liveness derived from heartbeat cadence.
+const (
+	hbOK      = "ok"      // last beat within 1.5 intervals
+	hbLate    = "late"    // missed at least one beat
+	hbLost    = "lost"    // missed lostAfter beats or more
+	hbUnknown = "unknown" // never heard from
+)
+
+// heartbeat payload, published by robots on heartbeat.{id}:
+//
+//	{"seq": 1234, "ts_ns": 1741083330123456789, "interval_ms": 1000}
+//
+// interval_ms declares the robot's cadence; it is stored in the registry and
+// the backend holds the robot to it.
+type heartbeatMsg struct {
+	Seq        uint64 `json:"seq"`
+	TsNs       int64  `json:"ts_ns"`
+	IntervalMs int64  `json:"interval_ms"`
+}
+
+type hbStats struct {
+	Robot      string    `json:"robot"`
+	IntervalMs int64     `json:"interval_ms"`
+	State      string    `json:"state"`
+	LastSeen   time.Time `json:"last_seen"`
+	LastSeq    uint64    `json:"last_seq"`
+	Received   int64     `json:"received"`
+	Missed     int64     `json:"missed"`
+	JitterMs   float64   `json:"jitter_ms"`  // RFC 3550-style smoothed |arrival gap − interval|
+	LatencyMs  float64   `json:"latency_ms"` // smoothed arrival − ts_ns, corrected by clock offset
+	lastArrive time.Time
+}
+
+// heartbeats verifies that every robot beats at its declared interval and
+// keeps jitter/latency statistics. It is the source of truth for liveness.
+type heartbeats struct {
+	reg       *registry
+	clock     *clockSync
+	lostAfter int
+
+	mu    sync.Mutex
+	stats map[string]*hbStats
+}
+
+func newHeartbeats(reg *registry, clock *clockSync, lostAfter int) *heartbeats {
+	return &heartbeats{reg: reg, clock: clock, lostAfter: lostAfter, stats: map[string]*hbStats{}}
+}
+
+func (h *heartbeats) subscribe(nc *nats.Conn) error {
+	_, err := nc.Subscribe("heartbeat.*", func(msg *nats.Msg) {
+		arrive := time.Now()
+		id := strings.TrimPrefix(msg.Subject, "heartbeat.")
+		var hb heartbeatMsg
+		if err := json.Unmarshal(msg.Data, &hb); err != nil {
+			log.Printf("heartbeat: bad payload from %s: %v", id, err)
+			return
+		}
+		h.beat(id, hb, arrive)
+	})
+	return err
+}
+
+func (h *heartbeats) beat(id string, hb heartbeatMsg, arrive time.Time) {
+	h.mu.Lock()
+	s := h.stats[id]
+	fresh := s == nil
+	if fresh {
+		s = &hbStats{Robot: id}
+		h.stats[id] = s
+	}
+	declared := hb.IntervalMs > 0 && hb.IntervalMs != s.IntervalMs
+	if declared {
+		s.IntervalMs = hb.IntervalMs
+	}
+	interval := time.Duration(s.IntervalMs) * time.Millisecond
+
+	if !s.lastArrive.IsZero() && interval > 0 {
+		gap := arrive.Sub(s.lastArrive)
+		d := math.Abs(float64(gap-interval)) / float64(time.Millisecond)
+		s.JitterMs += (d - s.JitterMs) / 16
+	}
+	if s.LastSeq > 0 && hb.Seq > s.LastSeq+1 {
+		s.Missed += int64(hb.Seq - s.LastSeq - 1)
+	}
+	s.Received++
+	s.LastSeq = hb.Seq
+	s.lastArrive = arrive
+	s.LastSeen = arrive
+	h.mu.Unlock()
+
+	if hb.TsNs > 0 {
+		lat := float64(arrive.UnixNano()-hb.TsNs) / float64(time.Millisecond)
+		if est, err := h.clock.estimate(id); err == nil && est != nil {
+			// robot clock + offset = backend clock
+			lat -= float64(est.OffsetNs) / float64(time.Millisecond)
+		}
+		h.mu.Lock()
+		if s.Received == 1 {
+			s.LatencyMs = lat
+		} else {
+			s.LatencyMs += (lat - s.LatencyMs) / 16
+		}
+		h.mu.Unlock()
+	}
+
+	if declared {
+		if _, err := h.reg.updateExisting(id, func(r *robot) error {
+			r.HeartbeatIntervalMs = hb.IntervalMs
+			return nil
+		}); err != nil && !errors.Is(err, errRobotNotFound) {
+			log.Printf("heartbeat: record interval for %s: %v", id, err)
+		}
+	} else if fresh && hb.IntervalMs == 0 {
+		// fall back to what the registry says the robot declared before
+		if r, err := h.reg.get(id); err == nil && r.HeartbeatIntervalMs > 0 {
+			h.mu.Lock()
+			s.IntervalMs = r.HeartbeatIntervalMs
+			h.mu.Unlock()
+		}
+	}
+}
+
+// state classifies a robot's liveness at now.
+func (h *heartbeats) state(id string, now time.Time) (string, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.stats[id]
+	if s == nil {
+		return hbUnknown, time.Time{}
+	}
+	return h.classify(s, now), s.LastSeen
+}
+
+func (h *heartbeats) classify(s *hbStats, now time.Time) string {
+	interval := time.Duration(s.IntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	since := now.Sub(s.LastSeen)
+	switch {
+	case since <= interval*3/2:
+		return hbOK
+	case since < interval*time.Duration(h.lostAfter):
+		return hbLate
+	default:
+		return hbLost
+	}
+}
+
+func (h *heartbeats) snapshot(id string, now time.Time) (hbStats, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.stats[id]
+	if s == nil {
+		return hbStats{Robot: id, State: hbUnknown}, false
+	}
+	out := *s
+	out.State = h.classify(s, now)
+	return out, true
+}
+
+// GET /api/robots/{id}/heartbeat
+func (h *heartbeats) handleGet(w http.ResponseWriter, req *http.Request) {
+	s, ok := h.snapshot(chi.URLParam(req, "id"), time.Now())
+	if !ok {
+		http.Error(w, "no heartbeats from robot", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s)
+}
+
+// GET /api/heartbeats
+func (h *heartbeats) handleList(w http.ResponseWriter, _ *http.Request) {
+	h.mu.Lock()
+	ids := make([]string, 0, len(h.stats))
+	for id := range h.stats {
+		ids = append(ids, id)
+	}
+	h.mu.Unlock()
+	sort.Strings(ids)
+
+	now := time.Now()
+	out := make([]hbStats, 0, len(ids))
+	for _, id := range ids {
+		s, _ := h.snapshot(id, now)
+		out = append(out, s)
+	}
+	writeJSON(w, out)
+}
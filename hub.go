@@ -0,0 +1,692 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/latency"
+	"github.com/VazRibeiro/evabot-backend/internal/metrics"
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// What a client's buffer does when it is full.
+const (
+	dropOldest     = "oldest"     // discard the oldest queued message
+	dropNewest     = "newest"     // discard the incoming message
+	dropDisconnect = "disconnect" // close the client; it reconnects and catches up
+)
+
+// hub fans NATS messages out to WebSocket clients. It holds one core NATS
+// subscription per subject prefix, made when the first client joins and
+// dropped with the last, and hands every message to each client's buffered
+// channel without blocking: a slow dashboard loses messages per its drop
+// policy instead of holding up the others. Clients that want TELEMETRY
+// sequence numbers share an ordered JetStream consumer per subject instead
+// (topic streamTopic+subject), whose messages carry them.
+type hub struct {
+	nc     *nats.Conn
+	js     nats.JetStreamContext // resume replays from TELEMETRY
+	buffer int                   // per-client default, WS_CLIENT_BUFFER
+	policy string                // per-client default, WS_DROP_POLICY
+	rbac   *rbac
+	state  *stateCache // the first frame
+	// egress, if set, meters what a connection sends, per request
+	egress func(req *http.Request) func(n int)
+	// lat, if set, times publish→delivered for one in latEvery messages
+	lat      *latency.Recorder
+	latEvery uint64
+	// keepalive (see watchPeer): WS_PING_EVERY, WS_PONG_WAIT, WS_WRITE_WAIT
+	pingEvery, pongWait, writeWait time.Duration
+	dead                           *metrics.Counter
+	// compression (see wsCompressed): WS_COMPRESSION_LEVEL, and bytes by
+	// whether the connection compresses, before and on the wire
+	compressLevel           int
+	payloadBytes, wireBytes *metrics.Counter
+
+	mu     sync.Mutex
+	topics map[string]*hubTopic
+
+	// see drain
+	reconnectAfter time.Duration // WS_RECONNECT_AFTER
+	drained        chan struct{}
+	drainOnce      sync.Once
+	resume         uint64
+	active         sync.WaitGroup
+}
+
+type hubTopic struct {
+	sub     *nats.Subscription
+	clients map[*hubClient]struct{}
+	msgs    atomic.Uint64
+	dropped atomic.Uint64 // by clients that have left
+}
+
+type hubClient struct {
+	C      chan *nats.Msg
+	Gone   chan struct{} // closed when the hub disconnects the client
+	Kick   chan struct{} // closed when an admin closes the connection
+	policy string
+	drops  atomic.Uint64
+	once   sync.Once
+	kicked sync.Once
+
+	// for GET /api/admin/ws
+	id      string
+	user    string
+	addr    string
+	subject string
+	since   time.Time
+}
+
+func newHub(nc *nats.Conn, js nats.JetStreamContext, rb *rbac, st *stateCache, buffer int, policy string, reconnectAfter time.Duration) (*hub, error) {
+	if !validDropPolicy(policy) {
+		return nil, fmt.Errorf("bad drop policy %q (oldest, newest or disconnect)", policy)
+	}
+	return &hub{nc: nc, js: js, rbac: rb, state: st, buffer: buffer, policy: policy, topics: map[string]*hubTopic{},
+		reconnectAfter: reconnectAfter, drained: make(chan struct{}),
+		dead:         metrics.NewCounter("evabot_ws_dead_clients_total", "/ws connections closed for not answering pings within WS_PONG_WAIT."),
+		payloadBytes: metrics.NewCounter("evabot_ws_payload_bytes_total", "Bytes of /ws messages before compression.", "compression"),
+		wireBytes:    metrics.NewCounter("evabot_ws_wire_bytes_total", "Bytes /ws connections wrote to the network, framing included.", "compression")}, nil
+}
+
+// streamTopic prefixes the topics fed from TELEMETRY rather than core NATS.
+const streamTopic = "stream:"
+
+func validDropPolicy(p string) bool {
+	return p == dropOldest || p == dropNewest || p == dropDisconnect
+}
+
+// join registers a client for subject (a NATS subject, usually with a
+// wildcard, or streamTopic and one) with a buffer of size messages; user
+// and addr identify it to admins.
+func (h *hub) join(subject string, size int, policy, user, addr string) (*hubClient, error) {
+	if !validDropPolicy(policy) {
+		return nil, fmt.Errorf("bad drop policy %q", policy)
+	}
+	c := &hubClient{C: make(chan *nats.Msg, size), Gone: make(chan struct{}), Kick: make(chan struct{}), policy: policy,
+		id: nuid.Next(), user: user, addr: addr, subject: subject, since: time.Now()}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.topics[subject]
+	if !ok {
+		t = &hubTopic{clients: map[*hubClient]struct{}{}}
+		var sub *nats.Subscription
+		var err error
+		if filter, ok := strings.CutPrefix(subject, streamTopic); ok {
+			sub, err = h.js.Subscribe(filter, func(m *nats.Msg) { h.fanout(subject, m) }, nats.OrderedConsumer(), nats.DeliverNew())
+		} else {
+			sub, err = h.nc.Subscribe(subject, func(m *nats.Msg) { h.fanout(subject, m) })
+		}
+		if err != nil {
+			return nil, err
+		}
+		t.sub = sub
+		h.topics[subject] = t
+	}
+	t.clients[c] = struct{}{}
+	return c, nil
+}
+
+// leave unregisters c; the subscription goes with the last client.
+func (h *hub) leave(subject string, c *hubClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.topics[subject]
+	if !ok {
+		return
+	}
+	if _, ok := t.clients[c]; ok {
+		delete(t.clients, c)
+		t.dropped.Add(c.drops.Load())
+	}
+	if len(t.clients) == 0 {
+		t.sub.Unsubscribe()
+		delete(h.topics, subject)
+	}
+}
+
+func (h *hub) fanout(subject string, m *nats.Msg) {
+	h.mu.Lock()
+	t := h.topics[subject]
+	if t == nil {
+		h.mu.Unlock()
+		return
+	}
+	t.msgs.Add(1)
+	var gone []*hubClient
+	for c := range t.clients {
+		if !c.offer(m) {
+			gone = append(gone, c)
+		}
+	}
+	for _, c := range gone {
+		delete(t.clients, c)
+		t.dropped.Add(c.drops.Load())
+	}
+	h.mu.Unlock()
+}
+
+// offer queues m, applying the drop policy; false means disconnect.
+func (c *hubClient) offer(m *nats.Msg) bool {
+	select {
+	case c.C <- m:
+		return true
+	default:
+	}
+	c.drops.Add(1)
+	switch c.policy {
+	case dropOldest:
+		select {
+		case <-c.C:
+		default:
+		}
+		select {
+		case c.C <- m:
+		default:
+		}
+	case dropDisconnect:
+		c.once.Do(func() { close(c.Gone) })
+		return false
+	}
+	return true
+}
+
+type hubTopicStats struct {
+	Subject  string `json:"subject"`
+	Clients  int    `json:"clients"`
+	Messages uint64 `json:"messages"`
+	Dropped  uint64 `json:"dropped"`
+	Pending  int    `json:"pending"`
+}
+
+// totals counts open clients and the messages dropped on every topic.
+func (h *hub) totals() (clients int, dropped uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, t := range h.topics {
+		clients += len(t.clients)
+		dropped += t.dropped.Load()
+		for c := range t.clients {
+			dropped += c.drops.Load()
+		}
+	}
+	return clients, dropped
+}
+
+// GET /api/ws/stats
+func (h *hub) handleStats(w http.ResponseWriter, _ *http.Request) {
+	h.mu.Lock()
+	out := make([]hubTopicStats, 0, len(h.topics))
+	for subject, t := range h.topics {
+		s := hubTopicStats{Subject: subject, Clients: len(t.clients), Messages: t.msgs.Load(), Dropped: t.dropped.Load()}
+		for c := range t.clients {
+			s.Dropped += c.drops.Load()
+			s.Pending += len(c.C)
+		}
+		out = append(out, s)
+	}
+	h.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Subject < out[j].Subject })
+	writeJSON(w, out)
+}
+
+type hubConnStats struct {
+	ID            string    `json:"id"`
+	User          string    `json:"user"`
+	RemoteAddr    string    `json:"remote_addr"`
+	Subscriptions []string  `json:"subscriptions"`
+	Policy        string    `json:"drop_policy"`
+	Queued        int       `json:"queued"`
+	Buffer        int       `json:"buffer"`
+	Dropped       uint64    `json:"dropped"`
+	Since         time.Time `json:"since"`
+	Uptime        string    `json:"uptime"`
+}
+
+// GET /api/admin/ws lists the open /ws connections, those dropping the most
+// first, for "my dashboard is lagging" reports: a queue near its buffer and a
+// climbing drop count mean the client can't keep up. ?user= narrows to one
+// caller.
+func (h *hub) handleConns(w http.ResponseWriter, req *http.Request) {
+	user := req.URL.Query().Get("user")
+	now := time.Now()
+	h.mu.Lock()
+	out := []hubConnStats{}
+	for _, t := range h.topics {
+		for c := range t.clients {
+			if user != "" && c.user != user {
+				continue
+			}
+			out = append(out, hubConnStats{ID: c.id, User: c.user, RemoteAddr: c.addr, Subscriptions: []string{c.subject},
+				Policy: c.policy, Queued: len(c.C), Buffer: cap(c.C), Dropped: c.drops.Load(),
+				Since: c.since, Uptime: now.Sub(c.since).Round(time.Second).String()})
+		}
+	}
+	h.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Dropped != out[j].Dropped {
+			return out[i].Dropped > out[j].Dropped
+		}
+		return out[i].Since.Before(out[j].Since)
+	})
+	writeJSON(w, out)
+}
+
+// DELETE /api/admin/ws/{cid} closes a /ws connection with 1008 and the reason
+// "closed by an administrator"; dashboards reconnect on their own.
+func (h *hub) handleKick(w http.ResponseWriter, req *http.Request) {
+	cid := chi.URLParam(req, "cid")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, t := range h.topics {
+		for c := range t.clients {
+			if c.id == cid {
+				c.kicked.Do(func() { close(c.Kick) })
+				w.WriteHeader(204)
+				return
+			}
+		}
+	}
+	http.Error(w, "no such connection", http.StatusNotFound)
+}
+
+// GET /ws streams telemetry as binary frames: all of it, or one robot's with
+// ?robot={id}. ?buffer=N and ?drop=oldest|newest|disconnect override the
+// client's queue size and drop policy. Viewers get the decimated, delayed feed,
+// and scoped callers (rbac) only their robots. The first frame is a text frame
+// with the last known state of the subscribed subjects (see stateCache),
+// except for viewers. ?resume=N, the token of a drain close frame, replays
+// what was published from TELEMETRY sequence N on instead. The client is
+// pinged, and dropped when it stops answering (see watchPeer).
+//
+// ?seq=N or ?since=-5m (or an RFC3339 time) replays from that TELEMETRY
+// sequence or time, then carries on live, and every frame is a text frame
+// with its stream sequence:
+//
+//	{"seq":1042,"subject":"telemetry.r1.pose","data":{…}}
+//
+// ("data_b64" for payloads that aren't JSON), so a client that keeps the
+// last seq it got reconnects with ?seq= one past it and misses nothing.
+// ?seq=0 is live only, with sequences, after the state frame. A drain
+// closes a sequenced connection with the exact next sequence, for ?seq=.
+// Not for viewers.
+//
+// ?max_hz=N or ?every=D sends each subject at most N times a second, or
+// once every D, the latest message winning within the window (see
+// wsThrottle); for viewers it only ever slows VIEWER_EVERY's decimation.
+// Replays aren't throttled.
+//
+// ?envelope=1 sends every message, live, replayed or to a viewer, as a
+// text frame saying where it came from:
+//
+//	{"subject":"telemetry.r1.pose","ts":"2024-05-01T12:00:00.123Z","seq":1042,"payload":{…}}
+//
+// ts is when the stream stored it, else its ts_ns, else when the gateway
+// sent it; seq is only on sequenced connections. A payload that isn't JSON
+// is a base64 string, with "encoding":"base64".
+//
+// Frames are compressed when the client offers permessage-deflate, unless
+// ?compress=off (see wsCompressed).
+func (h *hub) handleTelemetryWS(w http.ResponseWriter, req *http.Request) {
+	subject := "telemetry.>"
+	scope := h.rbac.filter(identityOf(req))
+	if id := req.URL.Query().Get("robot"); id != "" {
+		if !tokenRe.MatchString(id) {
+			http.Error(w, "bad robot id", 400)
+			return
+		}
+		if scope != nil && !scope.allows("telemetry."+id) {
+			http.Error(w, "robot "+id+" is outside your scope", http.StatusForbidden)
+			return
+		}
+		subject = "telemetry." + id + ".>"
+	}
+	size := h.buffer
+	if v := req.URL.Query().Get("buffer"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 4096 {
+			http.Error(w, "bad buffer (1-4096)", 400)
+			return
+		}
+		size = n
+	}
+	policy := h.policy
+	if v := req.URL.Query().Get("drop"); v != "" {
+		policy = v
+	}
+	if !validDropPolicy(policy) {
+		http.Error(w, "bad drop policy (oldest, newest or disconnect)", 400)
+		return
+	}
+	every, err := throttleOf(req)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	view := viewerOf(req)
+	if view != nil && every > view.Every {
+		lim := *view
+		lim.Every, every = every, 0
+		view = &lim
+	} else if view != nil {
+		every = 0
+	}
+	var resume uint64
+	if v := req.URL.Query().Get("resume"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || n == 0 || view != nil {
+			http.Error(w, "bad resume (a drain close frame's token; not for viewers)", 400)
+			return
+		}
+		resume = n
+	}
+	var start nats.SubOpt // replay from, for a sequenced connection
+	sequenced := false
+	if v, since := req.URL.Query().Get("seq"), req.URL.Query().Get("since"); v != "" || since != "" {
+		if view != nil || resume > 0 || (v != "" && since != "") {
+			http.Error(w, "'seq' and 'since' exclude each other, 'resume' and viewers", 400)
+			return
+		}
+		if since != "" {
+			if !validTime(since) {
+				http.Error(w, "bad 'since' (use -15m or RFC3339 time)", 400)
+				return
+			}
+			start = nats.StartTime(startTime(since))
+		} else {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				http.Error(w, "bad 'seq' (a TELEMETRY stream sequence, or 0 for live only)", 400)
+				return
+			}
+			if n > 0 {
+				start = nats.StartSequence(n)
+			}
+		}
+		sequenced = true
+	}
+	envelope := false
+	switch req.URL.Query().Get("envelope") {
+	case "", "0", "false":
+	case "1", "true":
+		envelope = true
+	default:
+		http.Error(w, "bad envelope (1 or 0)", 400)
+		return
+	}
+	compress := wsCompressed(req)
+	switch req.URL.Query().Get("compress") {
+	case "", "on":
+	case "off":
+		compress = false
+	default:
+		http.Error(w, "bad compress (on or off)", 400)
+		return
+	}
+	label := "off"
+	if compress {
+		label = "on"
+	}
+
+	c, err := h.upgrade(w, req, label)
+	if err != nil {
+		return
+	}
+	if compress {
+		c.SetCompressionLevel(h.compressLevel)
+	} else {
+		c.EnableWriteCompression(false)
+	}
+	frame := func(typ int, data []byte) error {
+		h.payloadBytes.Add(float64(len(data)), label)
+		return h.frame(c, typ, data)
+	}
+	defer c.Close()
+	h.active.Add(1)
+	defer h.active.Done()
+	if h.draining() {
+		if resume == 0 && view == nil {
+			resume = h.resume
+		}
+		h.closeDrained(c, nil, resume)
+		return
+	}
+
+	topic := subject
+	if sequenced {
+		topic = streamTopic + subject
+	}
+	client, err := h.join(topic, size, policy, queryUser(req), req.RemoteAddr)
+	if err != nil {
+		h.closeWith(c, nil, websocket.CloseInternalServerErr, err.Error())
+		return
+	}
+	defer h.leave(topic, client)
+
+	// the client sends nothing but pongs, but reading notices it going away
+	closed := h.watchPeer(c)
+	ping, stopPing := h.pinger()
+	defer stopPing()
+
+	sent := func(int) {}
+	if h.egress != nil {
+		sent = h.egress(req)
+	}
+	// last is the sequence last sent on a sequenced connection
+	var last uint64
+	write := func(m *nats.Msg) error {
+		if !sequenced {
+			if envelope {
+				return frame(websocket.TextMessage, envelopeFrame(0, m))
+			}
+			return frame(websocket.BinaryMessage, m.Data)
+		}
+		md, err := m.Metadata()
+		if err != nil {
+			return nil
+		}
+		if md.Sequence.Stream <= last {
+			return nil // replayed already
+		}
+		last = md.Sequence.Stream
+		if envelope {
+			return frame(websocket.TextMessage, envelopeFrame(last, m))
+		}
+		return frame(websocket.TextMessage, seqFrame(last, m))
+	}
+
+	if resume > 0 || start != nil {
+		// live messages queue up meanwhile, so the switch-over may repeat
+		// some, except on a sequenced connection
+		if start == nil {
+			start = nats.StartSequence(resume)
+		}
+		if err := h.replay(req.Context(), subject, start, scope, func(m *nats.Msg) error {
+			if err := write(m); err != nil {
+				return err
+			}
+			sent(len(m.Data))
+			return nil
+		}); err != nil {
+			return
+		}
+	} else if view == nil {
+		var allow func(string) bool
+		if scope != nil {
+			allow = scope.allows
+		}
+		if err := frame(websocket.TextMessage, stateFrame(h.state.snapshot(req.URL.Query().Get("robot"), allow))); err != nil {
+			return
+		}
+	}
+
+	var delivered uint64
+	send := func(m *nats.Msg) error {
+		if err := write(m); err != nil {
+			return err
+		}
+		sent(len(m.Data))
+		if delivered++; h.lat != nil && delivered%h.latEvery == 0 {
+			h.lat.Observe(telem.RobotID(m.Subject), publishedAt(m), time.Now())
+		}
+		return nil
+	}
+	var feed *viewerFeed
+	var flush <-chan time.Time
+	if view != nil {
+		feed = newViewerFeed(view)
+		t := time.NewTicker(250 * time.Millisecond)
+		defer t.Stop()
+		flush = t.C
+	}
+	var throttle *wsThrottle
+	var due <-chan time.Time
+	if every > 0 {
+		throttle = newWSThrottle(every)
+		t := time.NewTicker(throttle.tick())
+		defer t.Stop()
+		due = t.C
+	}
+	for {
+		var out [][]byte
+		select {
+		case m := <-client.C:
+			if scope != nil && !scope.allows(m.Subject) {
+				continue
+			}
+			switch {
+			case feed != nil && envelope:
+				feed.offer(m.Subject, envelopeFrame(0, m), time.Now())
+			case feed != nil:
+				feed.offer(m.Subject, m.Data, time.Now())
+			case throttle != nil:
+				if m = throttle.offer(m, time.Now()); m != nil {
+					if err := send(m); err != nil {
+						return
+					}
+				}
+			default:
+				if err := send(m); err != nil {
+					return
+				}
+			}
+		case now := <-due:
+			for _, m := range throttle.due(now) {
+				if err := send(m); err != nil {
+					return
+				}
+			}
+		case <-flush:
+			out = feed.ready(time.Now())
+		case <-client.Gone:
+			h.closeWith(c, closed, websocket.CloseTryAgainLater, "too slow")
+			return
+		case <-client.Kick:
+			h.closeWith(c, closed, websocket.ClosePolicyViolation, "closed by an administrator")
+			return
+		case <-h.drained:
+			// deliver what was queued before fan-out stopped, then hand over
+			resume := h.resume
+			if feed != nil {
+				resume = 0
+			}
+			for len(client.C) > 0 && feed == nil {
+				m := <-client.C
+				if scope == nil || scope.allows(m.Subject) {
+					if err := write(m); err != nil {
+						return
+					}
+				}
+			}
+			if sequenced && last > 0 {
+				resume = last + 1 // exact
+			}
+			h.closeDrained(c, closed, resume)
+			return
+		case <-ping:
+			if err := h.ping(c); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+		for _, data := range out {
+			typ := websocket.BinaryMessage
+			if envelope {
+				typ = websocket.TextMessage
+			}
+			if err := frame(typ, data); err != nil {
+				return
+			}
+			sent(len(data))
+		}
+	}
+}
+
+// seqFrame wraps a message for a sequenced connection.
+func seqFrame(seq uint64, m *nats.Msg) []byte {
+	f := struct {
+		Seq     uint64          `json:"seq"`
+		Subject string          `json:"subject"`
+		Data    json.RawMessage `json:"data,omitempty"`
+		DataB64 []byte          `json:"data_b64,omitempty"`
+	}{Seq: seq, Subject: m.Subject}
+	if json.Valid(m.Data) {
+		f.Data = m.Data
+	} else {
+		f.DataB64 = m.Data
+	}
+	b, _ := json.Marshal(f)
+	return b
+}
+
+// envelopeFrame wraps a message for ?envelope=1; seq is zero but on a
+// sequenced connection.
+func envelopeFrame(seq uint64, m *nats.Msg) []byte {
+	f := struct {
+		Subject  string          `json:"subject"`
+		TS       time.Time       `json:"ts"`
+		Seq      uint64          `json:"seq,omitempty"`
+		Payload  json.RawMessage `json:"payload"`
+		Encoding string          `json:"encoding,omitempty"`
+	}{Subject: m.Subject, Seq: seq}
+	if md, err := m.Metadata(); err == nil {
+		f.TS = md.Timestamp
+	} else if f.TS = publishedAt(m); f.TS.IsZero() {
+		f.TS = time.Now()
+	}
+	f.TS = f.TS.UTC()
+	if json.Valid(m.Data) {
+		f.Payload = m.Data
+	} else {
+		f.Payload, _ = json.Marshal(m.Data)
+		f.Encoding = "base64"
+	}
+	b, _ := json.Marshal(f)
+	return b
+}
+
+// publishedAt is a JSON message's ts_ns, zero without one.
+func publishedAt(m *nats.Msg) time.Time {
+	if ct := m.Header.Get("Content-Type"); ct != "" && !strings.Contains(ct, "json") {
+		return time.Time{}
+	}
+	var v struct {
+		TsNs int64 `json:"ts_ns"`
+	}
+	if json.Unmarshal(m.Data, &v) != nil || v.TsNs <= 0 {
+		return time.Time{}
+	}
+	return telem.UnixAnyToTime(v.TsNs)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// indicatorState is what a robot's lights should show, kept per robot in the
+// INDICATORS bucket.
+type indicatorState struct {
+	Robot    string    `json:"robot"`
+	Pattern  string    `json:"pattern"`
+	Color    string    `json:"color,omitempty"` // #rrggbb, for robots whose lights can take one
+	Reason   string    `json:"reason,omitempty"`
+	SetBy    string    `json:"set_by"`
+	Updated  time.Time `json:"updated"`
+	Seq      uint64    `json:"seq"`      // the CTRL command that carried it
+	Delivery string    `json:"delivery"` // the command's state; computed on read
+}
+
+var colorRe = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// indicators drives on-robot signaling (status lights, LED rings) from one
+// place, so the UI and automations agree on what "fault" looks like. Setting
+// a pattern sends it on ctrl.{id}.indicator:
+//
+//	{"pattern":"attention","color":"#ffaa00","reason":…,"set_by":…,"ts_ns":…}
+//
+// and records it as the robot's current indicator state. Commands queue
+// while a robot is offline and arrive in order, so it ends up showing the
+// last one. Patterns are the ones robots implement (INDICATOR_PATTERNS).
+type indicators struct {
+	cmds     *commands
+	kv       nats.KeyValue
+	patterns []string
+}
+
+func newIndicators(js nats.JetStreamContext, cmds *commands, patterns string) (*indicators, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "INDICATORS", History: 10, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	in := &indicators{cmds: cmds, kv: kv}
+	for _, p := range strings.Split(patterns, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if !tokenRe.MatchString(p) {
+			return nil, fmt.Errorf("INDICATOR_PATTERNS: bad pattern %q", p)
+		}
+		in.patterns = append(in.patterns, p)
+	}
+	if len(in.patterns) == 0 {
+		return nil, fmt.Errorf("INDICATOR_PATTERNS: no patterns")
+	}
+	return in, nil
+}
+
+// current reads robot id's indicator state with its delivery state; nil if
+// it was never set.
+func (in *indicators) current(id string) (*indicatorState, error) {
+	e, err := in.kv.Get(id)
+	if err == nats.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st indicatorState
+	if err := json.Unmarshal(e.Value(), &st); err != nil {
+		return nil, err
+	}
+	cmds, err := in.cmds.list(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cmds {
+		if c.Seq == st.Seq {
+			st.Delivery = c.State
+		}
+	}
+	return &st, nil
+}
+
+// GET /api/indicators lists the patterns robots know and every robot's
+// current indicator state.
+func (in *indicators) handleList(w http.ResponseWriter, _ *http.Request) {
+	keys, err := kvKeys(in.kv, ">")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sort.Strings(keys)
+	robots := []indicatorState{}
+	for _, k := range keys {
+		st, err := in.current(k)
+		if err != nil || st == nil {
+			continue
+		}
+		robots = append(robots, *st)
+	}
+	writeJSON(w, map[string]interface{}{"patterns": in.patterns, "robots": robots})
+}
+
+// GET /api/robot/{id}/indicator
+func (in *indicators) handleGet(w http.ResponseWriter, req *http.Request) {
+	st, err := in.current(chi.URLParam(req, "id"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if st == nil {
+		http.Error(w, "no indicator state set", 404)
+		return
+	}
+	writeJSON(w, st)
+}
+
+// PUT /api/robot/{id}/indicator with {"pattern":"attention","color":"#ffaa00",
+// "reason":"waiting for the door"} answers 202 with the new state, or with
+// ?dryRun=true 200 with the command it would have sent, leaving it unset.
+func (in *indicators) handlePut(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	dry, err := dryRun(req)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var body struct {
+		Pattern string `json:"pattern"`
+		Color   string `json:"color"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, "bad body: "+err.Error(), 400)
+		return
+	}
+	if !contains(in.patterns, body.Pattern) {
+		http.Error(w, fmt.Sprintf("bad pattern %q (one of %v)", body.Pattern, in.patterns), 400)
+		return
+	}
+	if body.Color != "" && !colorRe.MatchString(body.Color) {
+		http.Error(w, "bad color (#rrggbb)", 400)
+		return
+	}
+	if len(body.Reason) > 200 {
+		http.Error(w, "reason over 200 bytes", 400)
+		return
+	}
+
+	now := time.Now()
+	st := indicatorState{Robot: id, Pattern: body.Pattern, Color: body.Color, Reason: body.Reason,
+		SetBy: actorOf(req), Updated: now, Delivery: cmdPending}
+	payload, _ := json.Marshal(map[string]interface{}{"pattern": st.Pattern, "color": st.Color, "reason": st.Reason,
+		"set_by": st.SetBy, "ts_ns": now.UnixNano()})
+	if dry {
+		writePlan(w, in.cmds.plan(id, "indicator", payload))
+		return
+	}
+	cmd, err := in.cmds.publish(id, "indicator", payload)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	st.Seq = cmd.Seq
+	b, _ := json.Marshal(st)
+	if _, err := in.kv.Put(id, b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSONStatus(w, http.StatusAccepted, st)
+}
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/metrics"
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// inferenceModelsBucket holds one inferenceModel per key, by name.
+const inferenceModelsBucket = "INFERENCE_MODELS"
+
+// Model server protocols.
+const (
+	inferJSON   = "json"   // {"instances":[[…]]} in, a flat object out
+	inferKServe = "kserve" // the KServe/Triton v2 REST protocol
+)
+
+// What a failed call publishes instead of a prediction.
+const (
+	inferFallbackSkip    = "skip"    // nothing
+	inferFallbackLast    = "last"    // the series' last prediction
+	inferFallbackDefault = "default" // the model's default
+)
+
+// After inferBreakAfter failed calls in a row a model's server is left
+// alone for inferBreakFor, every call meanwhile falling back at once; at most
+// inferMaxInFlight calls per model are outstanding, and inferTick is how
+// often series are checked for calls due.
+const (
+	inferBreakAfter  = 5
+	inferBreakFor    = 30 * time.Second
+	inferMaxInFlight = 8
+	inferTick        = 100 * time.Millisecond
+	inferMaxFields   = 64
+)
+
+// inferTopic is the subject segment predictions are published under,
+// telemetry.{robot}.inference.{model}; inference never reads it back.
+const inferTopic = "inference"
+
+var inferClient = &http.Client{}
+
+// inferenceModel streams features of a telemetry subject to an external
+// model server and publishes what it predicts:
+//
+//	{"subject":"telemetry.*.imu","features":["ax","ay","az","gz"],"window":50,"every":"1s",
+//	 "url":"http://models:8080/v2/models/slip/infer","protocol":"kserve","timeout":"300ms",
+//	 "fallback":"default","default":{"class":"unknown"}}
+//
+// Each subject matching is a series of its own. Every `every` (default 1s)
+// that a series has new readings, its last `window` readings (default 1)
+// carrying all the features are sent, as rows in feature order; a json
+// server gets {"model","robot","subject","features","instances":[[…]…]}
+// and answers with an object whose top-level strings, numbers and booleans
+// (and one level of nested objects, as {key}_{sub}) become the prediction,
+// a kserve server an FP64 input "features" shaped [window, features] and
+// each output becoming {name} (one value) or {name}_{i}.
+//
+// A prediction is published as telemetry on
+// telemetry.{robot}.inference.{model}, so it is stored and streamed like
+// any other, with ts_ns the newest reading's and latency_ms the call's;
+// whenever its class_field (default class) changes an event goes out on
+// events.inference.{robot}. A call over timeout (default 500ms) or failing
+// publishes the fallback instead, marked "fallback":true: nothing (skip,
+// the default), the series' last prediction (last) or default.
+type inferenceModel struct {
+	Name       string                 `json:"name"`
+	Subject    string                 `json:"subject"`
+	Features   []string               `json:"features"`
+	Window     int                    `json:"window,omitempty"`
+	Every      string                 `json:"every,omitempty"`
+	URL        string                 `json:"url"`
+	Protocol   string                 `json:"protocol,omitempty"`
+	Headers    map[string]string      `json:"headers,omitempty"`
+	Timeout    string                 `json:"timeout,omitempty"`
+	Fallback   string                 `json:"fallback,omitempty"`
+	Default    map[string]interface{} `json:"default,omitempty"`
+	ClassField string                 `json:"class_field,omitempty"`
+	Disabled   bool                   `json:"disabled,omitempty"`
+	Updated    time.Time              `json:"updated"`
+	By         string                 `json:"by,omitempty"`
+
+	every, timeout time.Duration
+}
+
+// compile checks m, filling in defaults and parsing its durations.
+func (m *inferenceModel) compile() error {
+	if !strings.HasPrefix(m.Subject, "telemetry.") {
+		return errors.New("subject must be a telemetry.… pattern")
+	}
+	if len(m.Features) == 0 || len(m.Features) > inferMaxFields {
+		return fmt.Errorf("a model needs 1 to %d features", inferMaxFields)
+	}
+	for _, f := range m.Features {
+		if !fieldRe.MatchString(f) {
+			return fmt.Errorf("bad feature %q", f)
+		}
+	}
+	if m.Window == 0 {
+		m.Window = 1
+	}
+	if m.Window < 0 || m.Window > 1000 {
+		return errors.New("window must be 1 to 1000 readings")
+	}
+	m.every = time.Second
+	if m.Every != "" {
+		var err error
+		if m.every, err = time.ParseDuration(m.Every); err != nil || m.every < inferTick {
+			return fmt.Errorf("bad every %q (at least %s)", m.Every, inferTick)
+		}
+	}
+	m.timeout = 500 * time.Millisecond
+	if m.Timeout != "" {
+		var err error
+		if m.timeout, err = time.ParseDuration(m.Timeout); err != nil || m.timeout <= 0 || m.timeout > 30*time.Second {
+			return fmt.Errorf("bad timeout %q (up to 30s)", m.Timeout)
+		}
+	}
+	if u, err := url.Parse(m.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("bad url %q", m.URL)
+	}
+	switch m.Protocol {
+	case "":
+		m.Protocol = inferJSON
+	case inferJSON, inferKServe:
+	default:
+		return fmt.Errorf("unknown protocol %q (json or kserve)", m.Protocol)
+	}
+	switch m.Fallback {
+	case "":
+		m.Fallback = inferFallbackSkip
+	case inferFallbackSkip, inferFallbackLast:
+	case inferFallbackDefault:
+		if len(m.Default) == 0 {
+			return errors.New("fallback default needs a default")
+		}
+	default:
+		return fmt.Errorf("unknown fallback %q (skip, last or default)", m.Fallback)
+	}
+	if m.ClassField == "" {
+		m.ClassField = "class"
+	}
+	return nil
+}
+
+// inferSeries is one model's state for one subject.
+type inferSeries struct {
+	model   string
+	subject string
+	rows    [][]float64 // the last window readings, oldest first
+	newest  time.Time   // the last row's time
+	fresh   bool        // rows came since the last call
+	busy    bool        // a call is outstanding
+	due     time.Time
+	last    map[string]interface{} // the last prediction
+	class   string
+}
+
+// inferHealth is a model server's state, on GET /api/inference.
+type inferHealth struct {
+	Model     string     `json:"model"`
+	Series    int        `json:"series"`
+	InFlight  int        `json:"in_flight"`
+	Failures  int        `json:"failures"` // in a row
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+	LastOK    *time.Time `json:"last_ok,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	Latency   float64    `json:"latency_ms"` // of the last call answered
+}
+
+// inference runs the models in INFERENCE_MODELS against live telemetry, so
+// fault classifiers and the like can run online without living in the
+// worker. Every gateway with INFERENCE on (the default) calls the servers,
+// so run it on one.
+type inference struct {
+	js    nats.JetStreamContext
+	kv    nats.KeyValue
+	audit *auditLog
+	calls *metrics.Counter
+	lat   *metrics.Gauge
+
+	mu     sync.Mutex
+	models map[string]*inferenceModel
+	series map[string]*inferSeries // model:subject →
+	health map[string]*inferHealth
+}
+
+func newInference(js nats.JetStreamContext, audit *auditLog) (*inference, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: inferenceModelsBucket, History: 5, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	return &inference{js: js, kv: kv, audit: audit,
+		calls:  metrics.NewCounter("evabot_inference_calls_total", "Model server calls by model and outcome (ok, error, timeout, open).", "model", "outcome"),
+		lat:    metrics.NewGauge("evabot_inference_latency_seconds", "Latency of the last model server call answered, by model.", "model"),
+		models: map[string]*inferenceModel{}, series: map[string]*inferSeries{}, health: map[string]*inferHealth{}}, nil
+}
+
+// run follows the models bucket and telemetry until ctx is done.
+func (in *inference) run(ctx context.Context, nc *nats.Conn) error {
+	w, err := in.kv.WatchAll()
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer w.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-w.Updates():
+				if e != nil {
+					in.setModel(e)
+				}
+			}
+		}
+	}()
+	sub, err := nc.Subscribe("telemetry.>", func(msg *nats.Msg) {
+		now := time.Now()
+		subject := telem.TrimFormat(msg.Subject)
+		if !in.matches(subject) {
+			return
+		}
+		p, err := telem.DecodeAny(msg.Subject, msg.Header.Get("Content-Type"), msg.Data, now, now)
+		if err != nil {
+			return
+		}
+		in.observe(subject, p)
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Unsubscribe()
+		t := time.NewTicker(inferTick)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				in.dispatch(ctx, now)
+			}
+		}
+	}()
+	return nil
+}
+
+func (in *inference) setModel(e nats.KeyValueEntry) {
+	var m inferenceModel
+	ok := e.Operation() == nats.KeyValuePut && json.Unmarshal(e.Value(), &m) == nil
+	if ok {
+		if err := m.compile(); err != nil {
+			log.Printf("inference: model %s: not applied: %v", e.Key(), err)
+			ok = false
+		}
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	// a changed model starts over
+	for key, s := range in.series {
+		if s.model == e.Key() {
+			delete(in.series, key)
+		}
+	}
+	if ok && !m.Disabled {
+		in.models[e.Key()] = &m
+		if in.health[e.Key()] == nil {
+			in.health[e.Key()] = &inferHealth{Model: e.Key()}
+		}
+	} else {
+		delete(in.models, e.Key())
+		delete(in.health, e.Key())
+	}
+}
+
+func (in *inference) matches(subject string) bool {
+	if strings.Contains(subject, "."+inferTopic+".") {
+		return false // our own predictions
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for _, m := range in.models {
+		if telem.SubjectMatches(m.Subject, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// observe adds a reading to the series of the models matching subject.
+func (in *inference) observe(subject string, p telem.Point) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for name, m := range in.models {
+		if !telem.SubjectMatches(m.Subject, subject) {
+			continue
+		}
+		row := make([]float64, len(m.Features))
+		complete := true
+		for i, f := range m.Features {
+			v, ok := numeric(p.Fields[f])
+			if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+				complete = false
+				break
+			}
+			row[i] = v
+		}
+		if !complete {
+			continue
+		}
+		key := name + ":" + subject
+		s := in.series[key]
+		if s == nil {
+			s = &inferSeries{model: name, subject: subject}
+			in.series[key] = s
+		}
+		s.rows = append(s.rows, row)
+		if len(s.rows) > m.Window {
+			s.rows = s.rows[len(s.rows)-m.Window:]
+		}
+		s.newest, s.fresh = p.Time, true
+	}
+}
+
+// dispatch calls the model servers for the series due at now.
+func (in *inference) dispatch(ctx context.Context, now time.Time) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for _, s := range in.series {
+		m, h := in.models[s.model], in.health[s.model]
+		if m == nil || !s.fresh || s.busy || now.Before(s.due) || len(s.rows) < m.Window {
+			continue
+		}
+		if h.OpenUntil != nil && now.Before(*h.OpenUntil) {
+			in.calls.Inc(s.model, "open")
+			s.fresh, s.due = false, now.Add(m.every)
+			in.fallback(m, s, "model server circuit open")
+			continue
+		}
+		if h.InFlight >= inferMaxInFlight {
+			continue
+		}
+		rows := make([][]float64, len(s.rows))
+		copy(rows, s.rows)
+		s.fresh, s.busy, s.due = false, true, now.Add(m.every)
+		h.InFlight++
+		go in.call(ctx, *m, h, s, rows, s.newest)
+	}
+}
+
+// call sends one series' window to m's server and publishes the outcome.
+func (in *inference) call(ctx context.Context, m inferenceModel, h *inferHealth, s *inferSeries, rows [][]float64, newest time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	start := time.Now()
+	pred, err := in.predict(ctx, &m, s.subject, rows)
+	took := time.Since(start)
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	s.busy = false
+	h.InFlight--
+	if in.health[m.Name] != h || in.series[m.Name+":"+s.subject] != s {
+		return // the model changed meanwhile
+	}
+	if err != nil {
+		outcome := "error"
+		if errors.Is(err, context.DeadlineExceeded) {
+			outcome, err = "timeout", fmt.Errorf("no answer within %s", m.timeout)
+		}
+		in.calls.Inc(m.Name, outcome)
+		h.Failures++
+		h.LastError = err.Error()
+		if h.Failures >= inferBreakAfter {
+			until := time.Now().Add(inferBreakFor)
+			h.OpenUntil = &until
+			log.Printf("inference: %s: %d calls failed in a row, pausing %s: %v", m.Name, h.Failures, inferBreakFor, err)
+		}
+		in.fallback(&m, s, err.Error())
+		return
+	}
+	in.calls.Inc(m.Name, "ok")
+	in.lat.Set(took.Seconds(), m.Name)
+	now := time.Now()
+	h.Failures, h.OpenUntil, h.LastOK, h.LastError = 0, nil, &now, ""
+	h.Latency = float64(took) / float64(time.Millisecond)
+	s.last = pred
+	in.publish(&m, s, pred, newest, h.Latency, false)
+}
+
+// fallback publishes m's fallback for s after a failed call; in.mu is held.
+func (in *inference) fallback(m *inferenceModel, s *inferSeries, reason string) {
+	var pred map[string]interface{}
+	switch m.Fallback {
+	case inferFallbackLast:
+		pred = s.last
+	case inferFallbackDefault:
+		pred = m.Default
+	}
+	if pred == nil {
+		return
+	}
+	out := map[string]interface{}{"fallback_reason": reason}
+	for k, v := range pred {
+		out[k] = v
+	}
+	in.publish(m, s, out, s.newest, 0, true)
+}
+
+// publish sends a prediction as telemetry, and an event when its class
+// changed; in.mu is held.
+func (in *inference) publish(m *inferenceModel, s *inferSeries, pred map[string]interface{}, ts time.Time, latencyMs float64, fallback bool) {
+	robot := robotOfSubject(s.subject)
+	body := map[string]interface{}{}
+	for k, v := range pred {
+		body[k] = v
+	}
+	body["ts_ns"], body["source"], body["latency_ms"] = ts.UnixNano(), s.subject, latencyMs
+	if fallback {
+		body["fallback"] = true
+	}
+	b, _ := json.Marshal(body)
+	if err := in.emit("telemetry."+robot+"."+inferTopic+"."+m.Name, b); err != nil {
+		log.Printf("inference: publish %s for %s: %v", m.Name, s.subject, err)
+	}
+	class, ok := pred[m.ClassField].(string)
+	if !ok || class == s.class {
+		return
+	}
+	ev, _ := json.Marshal(map[string]interface{}{"model": m.Name, "robot": robot, "subject": s.subject,
+		"class": class, "previous": s.class, "fallback": fallback, "ts": ts})
+	s.class = class
+	if err := in.emit("events.inference."+robot, ev); err != nil {
+		log.Printf("inference: event %s for %s: %v", m.Name, s.subject, err)
+	}
+}
+
+func (in *inference) emit(subject string, data []byte) error {
+	_, err := in.js.PublishAsync(subject, data)
+	return err
+}
+
+// predict makes one call to m's server.
+func (in *inference) predict(ctx context.Context, m *inferenceModel, subject string, rows [][]float64) (map[string]interface{}, error) {
+	var body []byte
+	if m.Protocol == inferKServe {
+		flat := make([]float64, 0, len(rows)*len(m.Features))
+		for _, r := range rows {
+			flat = append(flat, r...)
+		}
+		body, _ = json.Marshal(map[string]interface{}{"id": subject, "inputs": []map[string]interface{}{{
+			"name": "features", "datatype": "FP64", "shape": []int{len(rows), len(m.Features)}, "data": flat}}})
+	} else {
+		body, _ = json.Marshal(map[string]interface{}{"model": m.Name, "robot": robotOfSubject(subject), "subject": subject,
+			"features": m.Features, "instances": rows})
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range m.Headers {
+		req.Header.Set(k, v)
+	}
+	res, err := inferClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(raw[:min(len(raw), 256)])))
+	}
+	if m.Protocol == inferKServe {
+		return kserveOutputs(raw)
+	}
+	return flatPrediction(raw)
+}
+
+// flatPrediction keeps a json server's scalar answers, and one level of
+// nested objects' as {key}_{sub}.
+func flatPrediction(raw []byte) (map[string]interface{}, error) {
+	var v map[string]interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, fmt.Errorf("answer isn't a JSON object: %w", err)
+	}
+	out := map[string]interface{}{}
+	add := func(k string, x interface{}) {
+		switch x.(type) {
+		case string, float64, bool:
+			if fieldRe.MatchString(k) && len(out) < inferMaxFields {
+				out[k] = x
+			}
+		}
+	}
+	for k, x := range v {
+		if sub, ok := x.(map[string]interface{}); ok {
+			for sk, sx := range sub {
+				add(k+"_"+sk, sx)
+			}
+			continue
+		}
+		add(k, x)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("answer has no usable fields")
+	}
+	return out, nil
+}
+
+// kserveOutputs maps a v2 response's outputs to fields: {name} for one
+// value, {name}_{i} for more.
+func kserveOutputs(raw []byte) (map[string]interface{}, error) {
+	var v struct {
+		Outputs []struct {
+			Name string        `json:"name"`
+			Data []interface{} `json:"data"`
+		} `json:"outputs"`
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, fmt.Errorf("bad v2 answer: %w", err)
+	}
+	out := map[string]interface{}{}
+	for _, o := range v.Outputs {
+		for i, x := range o.Data {
+			k := o.Name
+			if len(o.Data) > 1 {
+				k += "_" + strconv.Itoa(i)
+			}
+			switch x.(type) {
+			case string, float64, bool:
+				if fieldRe.MatchString(k) && len(out) < inferMaxFields {
+					out[k] = x
+				}
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("answer has no usable outputs")
+	}
+	return out, nil
+}
+
+// GET /api/inference gives each model server's health.
+func (in *inference) handleList(w http.ResponseWriter, _ *http.Request) {
+	in.mu.Lock()
+	out := []inferHealth{}
+	for name, h := range in.health {
+		c := *h
+		for _, s := range in.series {
+			if s.model == name {
+				c.Series++
+			}
+		}
+		out = append(out, c)
+	}
+	in.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Model < out[j].Model })
+	writeJSON(w, out)
+}
+
+func (in *inference) getModel(name string) (*inferenceModel, error) {
+	e, err := in.kv.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	var m inferenceModel
+	if err := json.Unmarshal(e.Value(), &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// GET /api/inference/models
+func (in *inference) handleListModels(w http.ResponseWriter, _ *http.Request) {
+	keys, err := kvKeys(in.kv, ">")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := []inferenceModel{}
+	for _, k := range keys {
+		if m, err := in.getModel(k); err == nil {
+			out = append(out, *m)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	writeJSON(w, out)
+}
+
+// GET /api/inference/models/{name}
+func (in *inference) handleGetModel(w http.ResponseWriter, req *http.Request) {
+	m, err := in.getModel(chi.URLParam(req, "name"))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such model", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, m)
+}
+
+// PUT /api/inference/models/{name} creates or replaces a model (see
+// inferenceModel).
+func (in *inference) handlePutModel(w http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, "name")
+	if !tokenRe.MatchString(name) {
+		http.Error(w, "bad model name", 400)
+		return
+	}
+	var m inferenceModel
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64<<10)).Decode(&m); err != nil {
+		http.Error(w, "bad JSON", 400)
+		return
+	}
+	m.Name, m.Updated, m.By = name, time.Now().UTC(), actorOf(req)
+	if err := m.compile(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := in.audit.record(auditRecord{Actor: m.By, Action: "inference_model.put", Details: map[string]interface{}{"name": name, "subject": m.Subject, "url": m.URL, "disabled": m.Disabled}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	b, _ := json.Marshal(m)
+	if _, err := in.kv.Put(name, b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, m)
+}
+
+// DELETE /api/inference/models/{name}
+func (in *inference) handleDeleteModel(w http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, "name")
+	if _, err := in.getModel(name); errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such model", 404)
+		return
+	}
+	if err := in.audit.record(auditRecord{Actor: actorOf(req), Action: "inference_model.delete", Details: map[string]interface{}{"name": name}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	if err := in.kv.Delete(name); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// device is a piece of building infrastructure robots depend on: a door, an
+// elevator, a charger.
+type device struct {
+	ID     string            `json:"id"`
+	Kind   string            `json:"kind"` // door, elevator, charger, ...
+	Name   string            `json:"name,omitempty"`
+	Site   string            `json:"site,omitempty"`
+	Driver string            `json:"driver"` // http, mqtt or nats; see newInfraDriver
+	Config map[string]string `json:"config"`
+	Robots []string          `json:"robots,omitempty"` // patterns of robots that may command it themselves
+}
+
+type deviceState struct {
+	State   map[string]interface{} `json:"state"`
+	Updated time.Time              `json:"updated,omitempty"`
+	Error   string                 `json:"error,omitempty"` // the driver's last failure
+}
+
+// infra keeps the device registry (the DEVICES bucket) and a driver per
+// device. Device state is published as telemetry on
+// telemetry.infra-{id}.state ({"topic":"infra","kind",…,"data":state}), so it
+// is stored and charted like robot data. Devices are commanded by operators
+// and automations over POST /api/infra/{id}/cmd, and by robots themselves (a
+// mission stuck at a door opens it) with a request on
+// infra.request.{id}.{robot}, if the device's robots patterns allow that
+// robot. Every command is audited. Each gateway watches the bucket and runs
+// the drivers.
+type infra struct {
+	nc    *nats.Conn
+	kv    nats.KeyValue
+	audit *auditLog
+
+	mu      sync.Mutex
+	devices map[string]device
+	drivers map[string]infraDriver
+	stop    map[string]context.CancelFunc
+	states  map[string]*deviceState
+}
+
+func newInfra(nc *nats.Conn, js nats.JetStreamContext, audit *auditLog) (*infra, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "DEVICES", History: 5, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	in := &infra{nc: nc, kv: kv, audit: audit, devices: map[string]device{}, drivers: map[string]infraDriver{},
+		stop: map[string]context.CancelFunc{}, states: map[string]*deviceState{}}
+
+	w, err := kv.WatchAll()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for e := range w.Updates() {
+			if e == nil {
+				continue
+			}
+			var d device
+			if e.Operation() == nats.KeyValuePut && json.Unmarshal(e.Value(), &d) == nil {
+				in.start(d)
+			} else {
+				in.remove(e.Key())
+			}
+		}
+	}()
+	if _, err := nc.Subscribe("infra.request.*.*", in.handleRobotRequest); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// start (re)starts d's driver.
+func (in *infra) start(d device) {
+	drv, err := newInfraDriver(in.nc, d)
+	in.remove(d.ID)
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.devices[d.ID] = d
+	in.states[d.ID] = &deviceState{}
+	if err != nil {
+		in.states[d.ID].Error = err.Error()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	in.drivers[d.ID], in.stop[d.ID] = drv, cancel
+	go drv.watch(ctx, func(state map[string]interface{}, err error) {
+		if ctx.Err() == nil {
+			in.update(d, state, err)
+		}
+	})
+}
+
+func (in *infra) remove(id string) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if cancel := in.stop[id]; cancel != nil {
+		cancel()
+	}
+	delete(in.devices, id)
+	delete(in.drivers, id)
+	delete(in.stop, id)
+	delete(in.states, id)
+}
+
+func (in *infra) update(d device, state map[string]interface{}, err error) {
+	now := time.Now()
+	in.mu.Lock()
+	st := in.states[d.ID]
+	if st != nil {
+		if err != nil {
+			st.Error = err.Error()
+		} else {
+			st.State, st.Updated, st.Error = state, now, ""
+		}
+	}
+	in.mu.Unlock()
+	if err != nil || st == nil {
+		return
+	}
+	b, _ := json.Marshal(map[string]interface{}{"topic": "infra", "kind": d.Kind, "device": d.ID, "data": state, "ts_ns": now.UnixNano()})
+	if err := in.nc.Publish("telemetry.infra-"+d.ID+".state", b); err != nil {
+		log.Printf("infra: publish state of %s: %v", d.ID, err)
+	}
+}
+
+var errNoDevice = errors.New("no such device")
+
+// command runs action on device id through its driver, auditing it as actor.
+func (in *infra) command(ctx context.Context, actor, id, action string, params map[string]interface{}) error {
+	in.mu.Lock()
+	drv, d := in.drivers[id], in.devices[id]
+	in.mu.Unlock()
+	if d.ID == "" {
+		return errNoDevice
+	}
+	if drv == nil {
+		return errors.New("device " + id + " has no working driver: " + in.stateOf(id).Error)
+	}
+	err := drv.command(ctx, action, params)
+	details := map[string]interface{}{"device": id, "kind": d.Kind, "action": action, "params": params}
+	if err != nil {
+		details["error"] = err.Error()
+	}
+	if aerr := in.audit.record(auditRecord{Actor: actor, Action: "infra.command", Details: details}); aerr != nil && err == nil {
+		return aerr
+	}
+	return err
+}
+
+func (in *infra) stateOf(id string) deviceState {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if st := in.states[id]; st != nil {
+		return *st
+	}
+	return deviceState{}
+}
+
+// handleRobotRequest serves infra.request.{id}.{robot} with
+// {"action":"open","params":{…}}, answering {"ok":true} or {"error":…}.
+// NATS permissions should let a robot publish only with its own id.
+func (in *infra) handleRobotRequest(msg *nats.Msg) {
+	parts := strings.Split(msg.Subject, ".")
+	id, robot := parts[2], parts[3]
+	reply := func(err error) {
+		if msg.Reply == "" {
+			return
+		}
+		b, _ := json.Marshal(map[string]interface{}{"ok": true})
+		if err != nil {
+			b, _ = json.Marshal(map[string]string{"error": err.Error()})
+		}
+		in.nc.Publish(msg.Reply, b)
+	}
+	var body struct {
+		Action string                 `json:"action"`
+		Params map[string]interface{} `json:"params"`
+	}
+	if err := json.Unmarshal(msg.Data, &body); err != nil || !tokenRe.MatchString(body.Action) {
+		reply(errors.New("bad request: want {\"action\":…,\"params\":{…}}"))
+		return
+	}
+	in.mu.Lock()
+	d := in.devices[id]
+	in.mu.Unlock()
+	allowed := false
+	for _, p := range d.Robots {
+		if ok, _ := path.Match(p, robot); ok {
+			allowed = true
+		}
+	}
+	if !allowed {
+		reply(errors.New("robot " + robot + " may not command " + id))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	reply(in.command(ctx, "robot:"+robot, id, body.Action, body.Params))
+}
+
+type deviceView struct {
+	device
+	deviceState
+}
+
+func (in *infra) view(id string) (deviceView, bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	d, ok := in.devices[id]
+	if !ok {
+		return deviceView{}, false
+	}
+	v := deviceView{device: d}
+	if st := in.states[id]; st != nil {
+		v.deviceState = *st
+	}
+	// tokens and the like stay out of responses
+	v.Config = map[string]string{}
+	for k, val := range d.Config {
+		if k == "token" {
+			val = "***"
+		}
+		v.Config[k] = val
+	}
+	return v, true
+}
+
+// GET /api/infra lists devices with their last state; ?kind= and ?site= filter.
+func (in *infra) handleList(w http.ResponseWriter, req *http.Request) {
+	kind, site := req.URL.Query().Get("kind"), req.URL.Query().Get("site")
+	in.mu.Lock()
+	ids := make([]string, 0, len(in.devices))
+	for id, d := range in.devices {
+		if (kind == "" || d.Kind == kind) && (site == "" || d.Site == site) {
+			ids = append(ids, id)
+		}
+	}
+	in.mu.Unlock()
+	sort.Strings(ids)
+	out := make([]deviceView, 0, len(ids))
+	for _, id := range ids {
+		if v, ok := in.view(id); ok {
+			out = append(out, v)
+		}
+	}
+	writeJSON(w, out)
+}
+
+// GET /api/infra/{id}
+func (in *infra) handleGet(w http.ResponseWriter, req *http.Request) {
+	v, ok := in.view(chi.URLParam(req, "id"))
+	if !ok {
+		http.Error(w, errNoDevice.Error(), 404)
+		return
+	}
+	writeJSON(w, v)
+}
+
+// PUT /api/infra/{id} with {"kind":"door","site":"north","driver":"http",
+// "config":{"state_url":…,"command_url":…},"robots":["amr-*"]}
+func (in *infra) handlePut(w http.ResponseWriter, req *http.Request) {
+	var d device
+	if err := json.NewDecoder(req.Body).Decode(&d); err != nil {
+		http.Error(w, "bad device: "+err.Error(), 400)
+		return
+	}
+	d.ID = chi.URLParam(req, "id")
+	if !tokenRe.MatchString(d.ID) {
+		http.Error(w, "bad device id (letters, digits, _ and - only)", 400)
+		return
+	}
+	if !tokenRe.MatchString(d.Kind) {
+		http.Error(w, "bad or missing kind (door, elevator, charger, ...)", 400)
+		return
+	}
+	for _, p := range d.Robots {
+		if _, err := path.Match(p, ""); err != nil {
+			http.Error(w, "bad robots pattern "+p, 400)
+			return
+		}
+	}
+	if _, err := newInfraDriver(in.nc, d); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	b, _ := json.Marshal(d)
+	if _, err := in.kv.Put(d.ID, b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := in.audit.record(auditRecord{Actor: actorOf(req), Action: "infra.put", Details: map[string]interface{}{"device": d.ID, "kind": d.Kind, "driver": d.Driver}}); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, d)
+}
+
+// DELETE /api/infra/{id}
+func (in *infra) handleDelete(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	if err := in.kv.Delete(id); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := in.audit.record(auditRecord{Actor: actorOf(req), Action: "infra.delete", Details: map[string]interface{}{"device": id}}); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// POST /api/infra/{id}/cmd with {"action":"open","params":{"hold_s":30}}
+// answers 204 once the driver has passed the command on, 502 if it couldn't.
+// Drivers act as they are called, so ?dryRun=true is refused rather than
+// ignored.
+func (in *infra) handleCommand(w http.ResponseWriter, req *http.Request) {
+	if dry, err := dryRun(req); err != nil || dry {
+		http.Error(w, "infrastructure commands have no dry run", 400)
+		return
+	}
+	var body struct {
+		Action string                 `json:"action"`
+		Params map[string]interface{} `json:"params"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || !tokenRe.MatchString(body.Action) {
+		http.Error(w, "bad command: want {\"action\":…,\"params\":{…}}", 400)
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), 10*time.Second)
+	defer cancel()
+	err := in.command(ctx, actorOf(req), chi.URLParam(req, "id"), body.Action, body.Params)
+	switch {
+	case errors.Is(err, errNoDevice):
+		http.Error(w, err.Error(), 404)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		w.WriteHeader(204)
+	}
+}
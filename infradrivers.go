@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// infraDriver talks to one infrastructure device.
+type infraDriver interface {
+	// command asks the device to carry out action.
+	command(ctx context.Context, action string, params map[string]interface{}) error
+	// watch reports the device's state until ctx ends.
+	watch(ctx context.Context, update func(state map[string]interface{}, err error))
+}
+
+// newInfraDriver builds d's driver from its config:
+//
+//	http: state_url (GET, a JSON object), command_url (POST {"action","params"}),
+//	      token (sent as a bearer token), poll (default 5s)
+//	mqtt: state_topic, command_topic; through the NATS server's MQTT listener
+//	      (MQTT_PORT in all-in-one), so a/b is subject a.b
+//	nats: subject (default infra.{id}); a bridge (BACnet, Modbus, ...) publishes
+//	      state on {subject}.state and answers commands on {subject}.cmd
+func newInfraDriver(nc *nats.Conn, d device) (infraDriver, error) {
+	cfg := d.Config
+	switch d.Driver {
+	case "http":
+		if cfg["state_url"] == "" && cfg["command_url"] == "" {
+			return nil, fmt.Errorf("http driver needs state_url or command_url")
+		}
+		poll := 5 * time.Second
+		if v := cfg["poll"]; v != "" {
+			p, err := time.ParseDuration(v)
+			if err != nil || p < time.Second {
+				return nil, fmt.Errorf("bad poll %q (at least 1s)", v)
+			}
+			poll = p
+		}
+		return &httpDriver{stateURL: cfg["state_url"], commandURL: cfg["command_url"], token: cfg["token"], poll: poll,
+			client: &http.Client{Timeout: 10 * time.Second}}, nil
+	case "mqtt":
+		state, err := mqttSubject(cfg["state_topic"])
+		if err != nil {
+			return nil, fmt.Errorf("state_topic: %w", err)
+		}
+		cmd, err := mqttSubject(cfg["command_topic"])
+		if err != nil {
+			return nil, fmt.Errorf("command_topic: %w", err)
+		}
+		return &natsDriver{nc: nc, state: state, cmd: cmd}, nil
+	case "nats":
+		subject := cfg["subject"]
+		if subject == "" {
+			subject = "infra." + d.ID
+		}
+		if !subjectRe.MatchString(subject) {
+			return nil, fmt.Errorf("bad subject %q", subject)
+		}
+		return &natsDriver{nc: nc, state: subject + ".state", cmd: subject + ".cmd", request: true}, nil
+	}
+	return nil, fmt.Errorf("unknown driver %q (http, mqtt or nats)", d.Driver)
+}
+
+var mqttTopicRe = regexp.MustCompile(`^[A-Za-z0-9_-]+(/[A-Za-z0-9_-]+)*$`)
+
+// mqttSubject maps an MQTT topic to the NATS subject the server's MQTT
+// listener uses for it; wildcards and dots aren't supported.
+func mqttSubject(topic string) (string, error) {
+	if !mqttTopicRe.MatchString(topic) {
+		return "", fmt.Errorf("bad MQTT topic %q", topic)
+	}
+	return strings.ReplaceAll(topic, "/", "."), nil
+}
+
+type httpDriver struct {
+	stateURL, commandURL, token string
+	poll                        time.Duration
+	client                      *http.Client
+}
+
+func (h *httpDriver) do(ctx context.Context, method, url string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s", method, url, res.Status)
+	}
+	return b, nil
+}
+
+func (h *httpDriver) command(ctx context.Context, action string, params map[string]interface{}) error {
+	if h.commandURL == "" {
+		return fmt.Errorf("device takes no commands (no command_url)")
+	}
+	b, _ := json.Marshal(map[string]interface{}{"action": action, "params": params})
+	_, err := h.do(ctx, http.MethodPost, h.commandURL, b)
+	return err
+}
+
+func (h *httpDriver) watch(ctx context.Context, update func(map[string]interface{}, error)) {
+	if h.stateURL == "" {
+		return
+	}
+	t := time.NewTicker(h.poll)
+	defer t.Stop()
+	for {
+		b, err := h.do(ctx, http.MethodGet, h.stateURL, nil)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			var state map[string]interface{}
+			if err = json.Unmarshal(b, &state); err == nil {
+				update(state, nil)
+			}
+		}
+		if err != nil {
+			update(nil, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// natsDriver reaches devices whose state and commands travel over NATS:
+// bridges answering requests (request) or MQTT devices, which can't reply.
+type natsDriver struct {
+	nc         *nats.Conn
+	state, cmd string
+	request    bool
+}
+
+func (n *natsDriver) command(ctx context.Context, action string, params map[string]interface{}) error {
+	b, _ := json.Marshal(map[string]interface{}{"action": action, "params": params})
+	if !n.request {
+		return n.nc.Publish(n.cmd, b)
+	}
+	m, err := n.nc.RequestWithContext(ctx, n.cmd, b)
+	if err != nil {
+		return err
+	}
+	var reply struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(m.Data, &reply) == nil && reply.Error != "" {
+		return fmt.Errorf("%s", reply.Error)
+	}
+	return nil
+}
+
+func (n *natsDriver) watch(ctx context.Context, update func(map[string]interface{}, error)) {
+	sub, err := n.nc.Subscribe(n.state, func(m *nats.Msg) {
+		var state map[string]interface{}
+		if json.Unmarshal(m.Data, &state) != nil || state == nil {
+			// plain MQTT payloads: a number, true/false, or text
+			raw := strings.TrimSpace(string(m.Data))
+			var v interface{} = raw
+			if f, err := strconv.ParseFloat(raw, 64); err == nil {
+				v = f
+			} else if b, err := strconv.ParseBool(raw); err == nil {
+				v = b
+			}
+			state = map[string]interface{}{"value": v}
+		}
+		update(state, nil)
+	})
+	if err != nil {
+		log.Printf("infra: subscribe %s: %v", n.state, err)
+		return
+	}
+	<-ctx.Done()
+	sub.Unsubscribe()
+}
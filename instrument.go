@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/metrics"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+var httpDuration = metrics.NewHistogram("evabot_http_request_duration_seconds",
+	"Time to serve API requests, by route pattern; WebSocket sessions are not included.",
+	metrics.DefBuckets, "method", "route", "code")
+
+// instrument is middleware timing every request by its chi route pattern, so
+// /api/robot/{id}/cmd is one series however many robots there are.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, req) // the upgrader needs the raw writer
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: 200}
+		start := time.Now()
+		next.ServeHTTP(rec, req)
+		route := "unmatched"
+		if rc := chi.RouteContext(req.Context()); rc != nil && rc.RoutePattern() != "" {
+			route = rc.RoutePattern()
+		}
+		httpDuration.Observe(time.Since(start).Seconds(), req.Method, route, strconv.Itoa(rec.status))
+	})
+}
+
+// registerGatewayMetrics exposes the gateway's NATS traffic and WebSocket
+// clients on /metrics.
+func registerGatewayMetrics(nc *nats.Conn, h *hub) {
+	stat := func(field func(nats.Statistics) uint64) func() float64 {
+		return func() float64 { return float64(field(nc.Stats())) }
+	}
+	metrics.NewCounterFunc("evabot_gateway_nats_in_msgs_total", "Messages the gateway received from NATS.",
+		stat(func(s nats.Statistics) uint64 { return s.InMsgs }))
+	metrics.NewCounterFunc("evabot_gateway_nats_out_msgs_total", "Messages the gateway published to NATS.",
+		stat(func(s nats.Statistics) uint64 { return s.OutMsgs }))
+	metrics.NewCounterFunc("evabot_gateway_nats_in_bytes_total", "Bytes the gateway received from NATS.",
+		stat(func(s nats.Statistics) uint64 { return s.InBytes }))
+	metrics.NewCounterFunc("evabot_gateway_nats_out_bytes_total", "Bytes the gateway published to NATS.",
+		stat(func(s nats.Statistics) uint64 { return s.OutBytes }))
+	metrics.NewCounterFunc("evabot_gateway_nats_reconnects_total", "Times the gateway reconnected to NATS.",
+		stat(func(s nats.Statistics) uint64 { return s.Reconnects }))
+	metrics.NewGaugeFunc("evabot_ws_clients", "Open /ws telemetry connections.", func() float64 {
+		clients, _ := h.totals()
+		return float64(clients)
+	})
+	metrics.NewCounterFunc("evabot_ws_dropped_messages_total", "Messages dropped by slow /ws clients.", func() float64 {
+		_, dropped := h.totals()
+		return float64(dropped)
+	})
+}
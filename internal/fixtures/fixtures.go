@@ -0,0 +1,142 @@
+// Package fixtures holds representative telemetry payloads per robot model
+// together with golden files recording exactly which point the pipeline
+// produces for each. TestGolden compares the two under `go test`, so a change
+// to telem.Decode that alters what lands in Influx shows up as a diff;
+// `go test ./internal/fixtures -update` rewrites the golden files after an
+// intentional one.
+//
+// Each payloads/{model}/{name}.json fixture looks like
+//
+//	{"subject":"telemetry.r1.imu","server_ts":"…","now":"…","payload":{…}}
+//
+// where payload is the message body verbatim (or payload_text for non-JSON
+// bodies, payload_hex for binary ones such as CBOR, optionally with the
+// content_type header they came with), and {name}.golden.json next to it is
+// the expected result. A "mappings" array (see telem.Mapping) and a "raw"
+// string (RAW_FIELDS, see telem.RawRule) apply to that fixture alone.
+package fixtures
+
+import (
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+)
+
+//go:embed payloads
+var files embed.FS
+
+type Fixture struct {
+	Model   string
+	Name    string
+	Path    string // relative to payloads/
+	Subject string
+	// ServerTS is the JetStream timestamp; Now pins the plausibility window.
+	ServerTS    time.Time
+	Now         time.Time
+	ContentType string
+	Payload     []byte
+	Mappings    telem.Mappings
+	Raw         telem.RawRules
+}
+
+// GoldenPath is the fixture's golden file, relative to payloads/.
+func (f Fixture) GoldenPath() string {
+	return strings.TrimSuffix(f.Path, ".json") + ".golden.json"
+}
+
+// Result is what a golden file records.
+type Result struct {
+	Point *telem.Point `json:"point,omitempty"`
+	Error string       `json:"error,omitempty"`
+}
+
+// All returns every fixture, sorted by path.
+func All() ([]Fixture, error) {
+	var out []Fixture
+	err := fs.WalkDir(files, "payloads", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, ".json") || strings.HasSuffix(p, ".golden.json") {
+			return err
+		}
+		b, err := files.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		var raw struct {
+			Subject     string          `json:"subject"`
+			ServerTS    time.Time       `json:"server_ts"`
+			Now         time.Time       `json:"now"`
+			Payload     json.RawMessage `json:"payload"`
+			PayloadText string          `json:"payload_text"`
+			PayloadHex  string          `json:"payload_hex"`
+			ContentType string          `json:"content_type"`
+			Mappings    telem.Mappings  `json:"mappings"`
+			Raw         string          `json:"raw"`
+		}
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return errors.New(p + ": " + err.Error())
+		}
+		rel := strings.TrimPrefix(p, "payloads/")
+		f := Fixture{
+			Model:       path.Dir(rel),
+			Name:        strings.TrimSuffix(path.Base(rel), ".json"),
+			Path:        rel,
+			Subject:     raw.Subject,
+			ServerTS:    raw.ServerTS,
+			Now:         raw.Now,
+			Payload:     raw.Payload,
+			ContentType: raw.ContentType,
+			Mappings:    raw.Mappings,
+		}
+		if f.Raw, err = telem.LoadRaw(raw.Raw); err != nil {
+			return errors.New(p + ": " + err.Error())
+		}
+		if raw.PayloadText != "" {
+			f.Payload = []byte(raw.PayloadText)
+		}
+		if raw.PayloadHex != "" {
+			if f.Payload, err = hex.DecodeString(raw.PayloadHex); err != nil {
+				return errors.New(p + ": " + err.Error())
+			}
+		}
+		out = append(out, f)
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out, err
+}
+
+// Run feeds a fixture through the pipeline and renders the result the way
+// golden files store it.
+func Run(f Fixture) ([]byte, error) {
+	var res Result
+	telem.SetMappings(f.Mappings)
+	defer telem.SetMappings(nil)
+	telem.SetRaw(f.Raw)
+	defer telem.SetRaw(nil)
+	p, err := telem.DecodeAny(f.Subject, f.ContentType, f.Payload, f.ServerTS, f.Now)
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		p.Time = p.Time.UTC()
+		res.Point = &p
+	}
+	b, err := json.MarshalIndent(res, "", "  ")
+	return append(b, '\n'), err
+}
+
+// Golden returns the recorded result for a fixture, or nil if there is none yet.
+func Golden(f Fixture) []byte {
+	b, err := files.ReadFile("payloads/" + f.GoldenPath())
+	if err != nil {
+		return nil
+	}
+	return b
+}
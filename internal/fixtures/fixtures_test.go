@@ -0,0 +1,44 @@
+package fixtures
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files with the current output")
+
+// TestGolden runs every fixture through the pipeline and compares the
+// produced fields, tags and timestamp with its golden file.
+func TestGolden(t *testing.T) {
+	all, err := All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) == 0 {
+		t.Fatal("no fixtures found")
+	}
+	for _, f := range all {
+		t.Run(f.Path, func(t *testing.T) {
+			got, err := Run(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *update {
+				if err := os.WriteFile(filepath.Join("payloads", filepath.FromSlash(f.GoldenPath())), got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want := Golden(f)
+			switch {
+			case want == nil:
+				t.Errorf("missing %s (run with -update)", f.GoldenPath())
+			case !bytes.Equal(got, want):
+				t.Errorf("differs from %s\n--- golden\n%s+++ got\n%s", f.GoldenPath(), want, got)
+			}
+		})
+	}
+}
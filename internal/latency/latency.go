@@ -0,0 +1,315 @@
+// Package latency measures how long telemetry takes to get from a robot to
+// where it is used: publish→persisted (the worker, once a point's batch is
+// written to Influx) and publish→delivered (the gateway, once a WebSocket
+// client is sent it). The publish time is the payload's ts_ns, moved onto
+// the backend's clock by the robot's clock offset (the CLOCK bucket);
+// messages without ts_ns aren't measured.
+//
+// Every process counts into per-robot histograms in memory and adds them to
+// the LATENCY bucket every flush, keyed {stage}.{minute}.{instance}, so any
+// number of workers and gateways can record at once and percentiles over a
+// window are read by merging the minutes in it.
+package latency
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Bucket holds one Report per stage, minute and instance.
+const Bucket = "LATENCY"
+
+// ClockBucket is where the gateway records each robot's clock offset.
+const ClockBucket = "CLOCK"
+
+// Stages.
+const (
+	Persisted = "persisted"
+	Delivered = "delivered"
+)
+
+// Histogram bounds grow by a quarter from 1ms, to about 11 minutes.
+const (
+	buckets = 61
+	growth  = 1.25
+)
+
+// Hist counts latencies into log-spaced buckets: Counts[i] holds those up to
+// bound(i); the last counts everything longer.
+type Hist struct {
+	Counts [buckets + 1]uint64 `json:"counts"`
+	Max    float64             `json:"max_ms"`
+}
+
+func bound(i int) float64 { return math.Pow(growth, float64(i)) }
+
+// Add counts one latency; negative ones (a stale clock offset) count as 0.
+func (h *Hist) Add(d time.Duration) {
+	ms := math.Max(float64(d)/float64(time.Millisecond), 0)
+	i := 0
+	if ms > 1 {
+		i = int(math.Ceil(math.Log(ms) / math.Log(growth)))
+	}
+	h.Counts[min(i, buckets)]++
+	h.Max = math.Max(h.Max, ms)
+}
+
+// Merge adds o's counts to h.
+func (h *Hist) Merge(o *Hist) {
+	for i, n := range o.Counts {
+		h.Counts[i] += n
+	}
+	h.Max = math.Max(h.Max, o.Max)
+}
+
+// Count is the number of latencies counted.
+func (h *Hist) Count() uint64 {
+	var n uint64
+	for _, c := range h.Counts {
+		n += c
+	}
+	return n
+}
+
+// Quantile estimates the q quantile in milliseconds, as the upper bound of
+// its bucket (at most 25% high) but no more than the largest seen.
+func (h *Hist) Quantile(q float64) float64 {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(n)))
+	var seen uint64
+	for i, c := range h.Counts {
+		if seen += c; seen >= rank && c > 0 {
+			return math.Min(bound(i), h.Max)
+		}
+	}
+	return h.Max
+}
+
+// Report is what one instance counted in one minute, per robot.
+type Report struct {
+	Robots map[string]*Hist `json:"robots"`
+}
+
+// Open binds to the bucket, creating it on first use. Minutes are kept for
+// a day.
+func Open(js nats.JetStreamContext) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: Bucket, History: 1, Storage: nats.FileStorage, TTL: 24 * time.Hour})
+	}
+	return kv, err
+}
+
+// Clock follows the robots' clock offsets.
+type Clock struct {
+	mu      sync.RWMutex
+	offsets map[string]time.Duration // backend clock minus robot clock
+}
+
+// WatchClock follows the CLOCK bucket, creating it on first use as the
+// gateway does.
+func WatchClock(js nats.JetStreamContext) (*Clock, error) {
+	kv, err := js.KeyValue(ClockBucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: ClockBucket, History: 20, Storage: nats.FileStorage})
+	}
+	if err != nil {
+		return nil, err
+	}
+	w, err := kv.WatchAll()
+	if err != nil {
+		return nil, err
+	}
+	c := &Clock{offsets: map[string]time.Duration{}}
+	go func() {
+		for e := range w.Updates() {
+			if e == nil {
+				continue
+			}
+			var est struct {
+				OffsetNs int64 `json:"offset_ns"`
+			}
+			c.mu.Lock()
+			if e.Operation() == nats.KeyValuePut && json.Unmarshal(e.Value(), &est) == nil {
+				c.offsets[e.Key()] = time.Duration(est.OffsetNs)
+			} else {
+				delete(c.offsets, e.Key())
+			}
+			c.mu.Unlock()
+		}
+	}()
+	return c, nil
+}
+
+// Offset is robot's clock offset, 0 when unknown.
+func (c *Clock) Offset(robot string) time.Duration {
+	if c == nil {
+		return 0
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.offsets[robot]
+}
+
+var unsafeKey = regexp.MustCompile(`[^A-Za-z0-9_\-]`)
+
+// Recorder counts one stage's latencies and flushes them to the bucket.
+type Recorder struct {
+	kv       nats.KeyValue
+	clock    *Clock
+	stage    string
+	instance string
+
+	mu      sync.Mutex
+	pending map[int64]map[string]*Hist // minute → robot →
+}
+
+// NewRecorder returns a recorder for stage, flushing into kv under
+// instance's name; clock may be nil.
+func NewRecorder(kv nats.KeyValue, clock *Clock, stage, instance string) *Recorder {
+	return &Recorder{kv: kv, clock: clock, stage: stage, instance: unsafeKey.ReplaceAllString(instance, "_"),
+		pending: map[int64]map[string]*Hist{}}
+}
+
+// Observe counts the latency of robot's message published at published (on
+// the robot's clock) and handled at now.
+func (r *Recorder) Observe(robot string, published, now time.Time) {
+	if r == nil || published.IsZero() {
+		return
+	}
+	d := now.Sub(published.Add(r.clock.Offset(robot)))
+	minute := now.Unix() / 60
+	r.mu.Lock()
+	m := r.pending[minute]
+	if m == nil {
+		m = map[string]*Hist{}
+		r.pending[minute] = m
+	}
+	h := m[robot]
+	if h == nil {
+		h = &Hist{}
+		m[robot] = h
+	}
+	h.Add(d)
+	r.mu.Unlock()
+}
+
+// Run flushes every interval, for good.
+func (r *Recorder) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		r.Flush()
+	}
+}
+
+// Flush adds pending counts to the bucket; what fails is kept for the next
+// flush.
+func (r *Recorder) Flush() {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = map[int64]map[string]*Hist{}
+	r.mu.Unlock()
+	for minute, robots := range pending {
+		key := r.stage + "." + strconv.FormatInt(minute, 10) + "." + r.instance
+		if err := r.add(key, robots); err != nil {
+			log.Printf("latency: flush %s: %v", key, err)
+			r.mu.Lock()
+			m := r.pending[minute]
+			if m == nil {
+				m = map[string]*Hist{}
+				r.pending[minute] = m
+			}
+			for robot, h := range robots {
+				if m[robot] == nil {
+					m[robot] = &Hist{}
+				}
+				m[robot].Merge(h)
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// add merges robots into key's report, retrying when another replica got
+// there first.
+func (r *Recorder) add(key string, robots map[string]*Hist) error {
+	for {
+		rep := Report{Robots: map[string]*Hist{}}
+		var rev uint64
+		e, err := r.kv.Get(key)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(e.Value(), &rep); err != nil {
+				return err
+			}
+			rev = e.Revision()
+		case !errors.Is(err, nats.ErrKeyNotFound):
+			return err
+		}
+		if rep.Robots == nil {
+			rep.Robots = map[string]*Hist{}
+		}
+		for robot, h := range robots {
+			if rep.Robots[robot] == nil {
+				rep.Robots[robot] = &Hist{}
+			}
+			rep.Robots[robot].Merge(h)
+		}
+		b, _ := json.Marshal(rep)
+		if rev == 0 {
+			_, err = r.kv.Create(key, b)
+		} else {
+			_, err = r.kv.Update(key, b, rev)
+		}
+		if !errors.Is(err, nats.ErrKeyExists) { // ErrKeyExists also covers a stale revision
+			return err
+		}
+	}
+}
+
+// Load merges stage's reports for the minutes from since, per robot and over
+// every robot.
+func Load(kv nats.KeyValue, stage string, since time.Time) (global *Hist, robots map[string]*Hist, err error) {
+	w, err := kv.Watch(stage+".>", nats.IgnoreDeletes())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer w.Stop()
+	global, robots = &Hist{}, map[string]*Hist{}
+	from := since.Unix() / 60
+	for e := range w.Updates() {
+		if e == nil {
+			break
+		}
+		parts := strings.SplitN(e.Key(), ".", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if minute, err := strconv.ParseInt(parts[1], 10, 64); err != nil || minute < from {
+			continue
+		}
+		var rep Report
+		if json.Unmarshal(e.Value(), &rep) != nil {
+			continue
+		}
+		for robot, h := range rep.Robots {
+			if robots[robot] == nil {
+				robots[robot] = &Hist{}
+			}
+			robots[robot].Merge(h)
+			global.Merge(h)
+		}
+	}
+	return global, robots, nil
+}
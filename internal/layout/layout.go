@@ -0,0 +1,257 @@
+// Package layout is how telemetry points are laid out in Influx: which
+// measurement a subject's points go to and which tags they carry. Changing
+// the layout (new tags, a measurement split per topic) is done in phases
+// rather than as a big-bang migration, with the state kept in the LAYOUTS
+// bucket so every worker and gateway follows along:
+//
+//	stable    one layout is written and read
+//	dual      workers write the current and the next layout; reads stay on current
+//	cutover   next is current and the only one written; reads take the old layout
+//	          before the dual writes began and the new one after, so history
+//	          stays where it is
+//
+// Finishing a cutover forgets the old layout, once its data has aged out of
+// the bucket's retention or been deleted. evactl layout drives the phases
+// through /api/layouts.
+package layout
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+)
+
+// Layout places the points of telemetry subjects:
+//
+//	{"name":"v2","measurement":"telemetry",
+//	 "split":[{"subject":"telemetry.*.battery","measurement":"battery"}],
+//	 "tags":{"robot":1,"topic":2},
+//	 "drop":["source"]}
+//
+// Split sends matching subjects to their own measurement (first match wins),
+// the rest go to Measurement. Tags adds tags from subject tokens
+// (telemetry.{1}.{2}) and Drop leaves tags out. The subject tag is always
+// kept: queries select and group on it.
+type Layout struct {
+	Name        string         `json:"name"`
+	Measurement string         `json:"measurement"`
+	Split       []Split        `json:"split,omitempty"`
+	Tags        map[string]int `json:"tags,omitempty"`
+	Drop        []string       `json:"drop,omitempty"`
+}
+
+// Split is one subject pattern with its own measurement.
+type Split struct {
+	Subject     string `json:"subject"`
+	Measurement string `json:"measurement"`
+}
+
+// Default is the layout until one is changed: every point in "telemetry".
+var Default = Layout{Name: "v1", Measurement: telem.Measurement}
+
+var nameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+
+// Validate checks names, patterns and that the subject tag is kept.
+func (l Layout) Validate() error {
+	if !nameRe.MatchString(l.Name) {
+		return errors.New("layout needs a name of letters, digits and _")
+	}
+	if !nameRe.MatchString(l.Measurement) {
+		return fmt.Errorf("layout %s: bad measurement %q", l.Name, l.Measurement)
+	}
+	for _, s := range l.Split {
+		if !strings.HasPrefix(s.Subject, "telemetry.") || !nameRe.MatchString(s.Measurement) {
+			return fmt.Errorf("layout %s: split needs a telemetry.… subject and a measurement name", l.Name)
+		}
+	}
+	for tag, i := range l.Tags {
+		if !nameRe.MatchString(tag) || tag == "subject" || i < 1 {
+			return fmt.Errorf("layout %s: tag %q must be named and take subject token 1 or later", l.Name, tag)
+		}
+	}
+	for _, tag := range l.Drop {
+		if tag == "subject" {
+			return fmt.Errorf("layout %s: the subject tag can't be dropped", l.Name)
+		}
+	}
+	return nil
+}
+
+// MeasurementOf is the measurement subject's points are written to.
+func (l Layout) MeasurementOf(subject string) string {
+	for _, s := range l.Split {
+		if telem.SubjectMatches(s.Subject, subject) {
+			return s.Measurement
+		}
+	}
+	return l.Measurement
+}
+
+// Measurements lists every measurement l writes, sorted.
+func (l Layout) Measurements() []string {
+	seen := map[string]bool{l.Measurement: true}
+	out := []string{l.Measurement}
+	for _, s := range l.Split {
+		if !seen[s.Measurement] {
+			seen[s.Measurement] = true
+			out = append(out, s.Measurement)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Apply lays p out. Points a transform moved to a measurement of its own
+// keep it; only telemetry's is placed.
+func (l Layout) Apply(p telem.Point) telem.Point {
+	subject := p.Tags["subject"]
+	out := telem.Point{Measurement: p.Measurement, Tags: make(map[string]string, len(p.Tags)+len(l.Tags)), Fields: p.Fields, Time: p.Time}
+	if p.Measurement == telem.Measurement {
+		out.Measurement = l.MeasurementOf(subject)
+	}
+	for k, v := range p.Tags {
+		out.Tags[k] = v
+	}
+	tokens := strings.Split(subject, ".")
+	for tag, i := range l.Tags {
+		if i < len(tokens) {
+			out.Tags[tag] = tokens[i]
+		}
+	}
+	for _, tag := range l.Drop {
+		delete(out.Tags, tag)
+	}
+	return out
+}
+
+// settle is added to the start of the dual writes to make the read boundary,
+// for workers that saw the dual phase a little late.
+const settle = time.Minute
+
+// State is the migration state, under "telemetry" in the bucket.
+type State struct {
+	Current  Layout     `json:"current"`
+	Next     *Layout    `json:"next,omitempty"`
+	DualFrom *time.Time `json:"dual_from,omitempty"`
+	// CutoverAfter is the earliest cutover without force: the end of the
+	// transition window, for comparing the layouts side by side.
+	CutoverAfter *time.Time `json:"cutover_after,omitempty"`
+	Previous     *Layout    `json:"previous,omitempty"`
+	// Boundary splits reads between Previous (before) and Current.
+	Boundary *time.Time `json:"boundary,omitempty"`
+	Updated  time.Time  `json:"updated"`
+	By       string     `json:"by,omitempty"`
+}
+
+// Phase is "stable", "dual" or "cutover".
+func (s State) Phase() string {
+	switch {
+	case s.Next != nil:
+		return "dual"
+	case s.Previous != nil:
+		return "cutover"
+	}
+	return "stable"
+}
+
+// Writes are the layouts a point is written in.
+func (s State) Writes() []Layout {
+	if s.Next != nil {
+		return []Layout{s.Current, *s.Next}
+	}
+	return []Layout{s.Current}
+}
+
+// Begin starts writing next alongside the current layout. Its measurements
+// must be new, so reads of the current layout don't see the copies.
+func (s State) Begin(next Layout, window time.Duration, now time.Time) (State, error) {
+	if s.Phase() != "stable" {
+		return s, fmt.Errorf("a %s phase is under way; finish or abort it first", s.Phase())
+	}
+	if err := next.Validate(); err != nil {
+		return s, err
+	}
+	if next.Name == s.Current.Name {
+		return s, fmt.Errorf("layout %s is already current", next.Name)
+	}
+	cur := map[string]bool{}
+	for _, m := range s.Current.Measurements() {
+		cur[m] = true
+	}
+	for _, m := range next.Measurements() {
+		if cur[m] {
+			return s, fmt.Errorf("layout %s writes measurement %s, which %s already does: pick a new name", next.Name, m, s.Current.Name)
+		}
+	}
+	after := now.Add(window)
+	s.Next, s.DualFrom, s.CutoverAfter = &next, &now, &after
+	return s, nil
+}
+
+// Cutover makes the next layout current. Before the transition window is
+// over it needs force.
+func (s State) Cutover(force bool, now time.Time) (State, error) {
+	if s.Phase() != "dual" {
+		return s, errors.New("no dual phase to cut over")
+	}
+	if !force && now.Before(*s.CutoverAfter) {
+		return s, fmt.Errorf("the transition window runs until %s (force to cut over now)", s.CutoverAfter.Format(time.RFC3339))
+	}
+	prev := s.Current
+	boundary := s.DualFrom.Add(settle)
+	s.Previous, s.Boundary = &prev, &boundary
+	s.Current, s.Next, s.DualFrom, s.CutoverAfter = *s.Next, nil, nil, nil
+	return s, nil
+}
+
+// Abort stops the dual writes and keeps the current layout.
+func (s State) Abort() (State, error) {
+	if s.Phase() != "dual" {
+		return s, errors.New("no dual phase to abort")
+	}
+	s.Next, s.DualFrom, s.CutoverAfter = nil, nil, nil
+	return s, nil
+}
+
+// Finish forgets the previous layout: reads go to the current one only.
+func (s State) Finish() (State, error) {
+	if s.Phase() != "cutover" {
+		return s, errors.New("no cutover to finish")
+	}
+	s.Previous, s.Boundary = nil, nil
+	return s, nil
+}
+
+// Filter is the Flux that selects telemetry rows, for piping after range().
+// Across a cutover it reads both layouts, each on its side of the boundary,
+// and regroups by field and subject so series run on across it.
+func (s State) Filter() string {
+	if s.Previous == nil {
+		return ` |> filter(fn:(r)=> ` + measurementIn(s.Current) + `)`
+	}
+	b := s.Boundary.UTC().Format(time.RFC3339Nano)
+	return ` |> filter(fn:(r)=> (` + measurementIn(*s.Previous) + ` and r._time < ` + b + `) or (` +
+		measurementIn(s.Current) + ` and r._time >= ` + b + `))` +
+		` |> group(columns: ["_field","subject"]) |> sort(columns: ["_time"])`
+}
+
+// Predicate matches the measurements read, for schema.fieldKeys and the like.
+func (s State) Predicate() string {
+	if s.Previous == nil {
+		return measurementIn(s.Current)
+	}
+	return measurementIn(*s.Previous) + ` or ` + measurementIn(s.Current)
+}
+
+func measurementIn(l Layout) string {
+	ms := l.Measurements()
+	if len(ms) == 1 {
+		return `r._measurement == "` + ms[0] + `"`
+	}
+	return `(r._measurement == "` + strings.Join(ms, `" or r._measurement == "`) + `")`
+}
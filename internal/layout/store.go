@@ -0,0 +1,104 @@
+package layout
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Bucket holds the migration state.
+const Bucket = "LAYOUTS"
+
+const key = "telemetry"
+
+// Store follows the state in the bucket.
+type Store struct {
+	kv nats.KeyValue
+
+	mu  sync.RWMutex
+	cur State
+}
+
+// Open binds to the LAYOUTS bucket, creating it on first use, and watches
+// the state from then on.
+func Open(js nats.JetStreamContext) (*Store, error) {
+	kv, err := js.KeyValue(Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: Bucket, History: 10, Storage: nats.FileStorage})
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{kv: kv, cur: State{Current: Default}}
+	w, err := kv.Watch(key)
+	if err != nil {
+		return nil, err
+	}
+	ready := make(chan struct{})
+	go func() {
+		for e := range w.Updates() {
+			if e == nil {
+				close(ready)
+				continue
+			}
+			st := State{Current: Default}
+			if e.Operation() == nats.KeyValuePut {
+				if err := json.Unmarshal(e.Value(), &st); err != nil {
+					log.Printf("layout: bad state (rev %d): %v", e.Revision(), err)
+					continue
+				}
+			}
+			s.mu.Lock()
+			s.cur = st
+			s.mu.Unlock()
+		}
+	}()
+	<-ready
+	return s, nil
+}
+
+// State is the state as last seen.
+func (s *Store) State() State {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cur
+}
+
+// Update applies fn to the stored state and saves the result, failing
+// rather than overwriting if someone else changed it meanwhile.
+func (s *Store) Update(fn func(State) (State, error)) (State, error) {
+	st, rev := State{Current: Default}, uint64(0)
+	e, err := s.kv.Get(key)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(e.Value(), &st); err != nil {
+			return st, err
+		}
+		rev = e.Revision()
+	case !errors.Is(err, nats.ErrKeyNotFound):
+		return st, err
+	}
+	next, err := fn(st)
+	if err != nil {
+		return st, err
+	}
+	b, err := json.Marshal(next)
+	if err != nil {
+		return st, err
+	}
+	if rev == 0 {
+		_, err = s.kv.Create(key, b)
+	} else {
+		_, err = s.kv.Update(key, b, rev)
+	}
+	if err != nil {
+		return st, err
+	}
+	s.mu.Lock()
+	s.cur = next
+	s.mu.Unlock()
+	return next, nil
+}
@@ -0,0 +1,324 @@
+// Package metrics exposes counters, gauges and histograms in the Prometheus
+// text format, for the gateway's and the worker's /metrics. It covers what
+// the two binaries need and no more: metrics are registered once at startup,
+// label values are given in the order the labels were declared, and
+// histograms have fixed buckets.
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are latency buckets in seconds, as in the Prometheus clients.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry the binaries serve.
+var Default = &Registry{families: map[string]family{}}
+
+// Registry holds metric families by name.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]family
+
+	base     *Registry // set on views made by With
+	constant string    // rendered labels every metric registered through r carries
+}
+
+// With returns a view of r whose metrics all carry the label name=value, such
+// as the instance of a component that runs several replicas.
+func (r *Registry) With(name, value string) *Registry {
+	base := r
+	if r.base != nil {
+		base = r.base
+	}
+	return &Registry{base: base, constant: labelString(r.constant, []string{name}, []string{value}, "")}
+}
+
+type family interface {
+	write(b *strings.Builder)
+}
+
+func (r *Registry) register(name string, f family) {
+	if r.base != nil {
+		r.base.register(name, f)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, dup := r.families[name]; dup {
+		panic("metrics: " + name + " registered twice")
+	}
+	r.families[name] = f
+}
+
+// Handler serves every family, sorted by name.
+func (r *Registry) Handler() http.Handler {
+	if r.base != nil {
+		r = r.base
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		r.mu.Lock()
+		names := make([]string, 0, len(r.families))
+		for name := range r.families {
+			names = append(names, name)
+		}
+		fams := make([]family, 0, len(names))
+		sort.Strings(names)
+		for _, name := range names {
+			fams = append(fams, r.families[name])
+		}
+		r.mu.Unlock()
+		var b strings.Builder
+		for _, f := range fams {
+			f.write(&b)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write([]byte(b.String()))
+	})
+}
+
+func header(b *strings.Builder, name, help, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelString renders {a="x",b="y"}, after constant and before extra
+// (already rendered, without braces) pairs.
+func labelString(constant string, names, values []string, extra string) string {
+	parts := make([]string, 0, len(names)+2)
+	if constant != "" {
+		parts = append(parts, strings.Trim(constant, "{}"))
+	}
+	for i, n := range names {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		parts = append(parts, n+`="`+v+`"`)
+	}
+	if extra != "" {
+		parts = append(parts, extra)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// vec keeps one value per label combination.
+type vec[T any] struct {
+	labels []string
+	mu     sync.Mutex
+	series map[string]*T
+	values map[string][]string
+}
+
+func newVec[T any](labels []string) vec[T] {
+	return vec[T]{labels: labels, series: map[string]*T{}, values: map[string][]string{}}
+}
+
+func (v *vec[T]) get(values []string, init func() *T) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: want %d label values, got %d", len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s := v.series[key]
+	if s == nil {
+		s = init()
+		v.series[key] = s
+		v.values[key] = append([]string(nil), values...)
+	}
+	return s
+}
+
+// each visits the series in label order; v.mu is held.
+func (v *vec[T]) each(fn func(values []string, s *T)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fn(v.values[k], v.series[k])
+	}
+}
+
+// Counter only goes up.
+type Counter struct {
+	name, help, constant string
+	vec                  vec[float64]
+}
+
+// NewCounter registers a counter with the given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, constant: r.constant, vec: newVec[float64](labels)}
+	r.register(name, c)
+	return c
+}
+
+// NewCounter registers a counter in Default.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// Inc adds one to the series with the given label values.
+func (c *Counter) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+// Add adds d, which must not be negative.
+func (c *Counter) Add(d float64, labelValues ...string) {
+	s := c.vec.get(labelValues, func() *float64 { return new(float64) })
+	c.vec.mu.Lock()
+	*s += d
+	c.vec.mu.Unlock()
+}
+
+func (c *Counter) write(b *strings.Builder) {
+	header(b, c.name, c.help, "counter")
+	if len(c.vec.labels) == 0 {
+		c.vec.get(nil, func() *float64 { return new(float64) }) // 0 before the first Inc
+	}
+	c.vec.each(func(values []string, s *float64) {
+		fmt.Fprintf(b, "%s%s %s\n", c.name, labelString(c.constant, c.vec.labels, values, ""), formatFloat(*s))
+	})
+}
+
+// Gauge goes up and down.
+type Gauge struct {
+	name, help, constant string
+	vec                  vec[float64]
+}
+
+// NewGauge registers a gauge with the given label names.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{name: name, help: help, constant: r.constant, vec: newVec[float64](labels)}
+	r.register(name, g)
+	return g
+}
+
+// NewGauge registers a gauge in Default.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+// Set sets the series with the given label values to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	s := g.vec.get(labelValues, func() *float64 { return new(float64) })
+	g.vec.mu.Lock()
+	*s = v
+	g.vec.mu.Unlock()
+}
+
+// Add adds d (negative to subtract).
+func (g *Gauge) Add(d float64, labelValues ...string) {
+	s := g.vec.get(labelValues, func() *float64 { return new(float64) })
+	g.vec.mu.Lock()
+	*s += d
+	g.vec.mu.Unlock()
+}
+
+func (g *Gauge) write(b *strings.Builder) {
+	header(b, g.name, g.help, "gauge")
+	if len(g.vec.labels) == 0 {
+		g.vec.get(nil, func() *float64 { return new(float64) })
+	}
+	g.vec.each(func(values []string, s *float64) {
+		fmt.Fprintf(b, "%s%s %s\n", g.name, labelString(g.constant, g.vec.labels, values, ""), formatFloat(*s))
+	})
+}
+
+// funcMetric is read when scraped.
+type funcMetric struct {
+	name, help, kind, constant string
+	fn                         func() float64
+}
+
+func (f *funcMetric) write(b *strings.Builder) {
+	header(b, f.name, f.help, f.kind)
+	fmt.Fprintf(b, "%s%s %s\n", f.name, f.constant, formatFloat(f.fn()))
+}
+
+// NewGaugeFunc registers a gauge whose value fn gives at scrape time.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(name, &funcMetric{name: name, help: help, kind: "gauge", constant: r.constant, fn: fn})
+}
+
+// NewGaugeFunc registers a gauge func in Default.
+func NewGaugeFunc(name, help string, fn func() float64) { Default.NewGaugeFunc(name, help, fn) }
+
+// NewCounterFunc is NewGaugeFunc for a value that only goes up, such as a
+// total kept elsewhere.
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(name, &funcMetric{name: name, help: help, kind: "counter", constant: r.constant, fn: fn})
+}
+
+// NewCounterFunc registers a counter func in Default.
+func NewCounterFunc(name, help string, fn func() float64) { Default.NewCounterFunc(name, help, fn) }
+
+// Histogram counts observations into buckets.
+type Histogram struct {
+	name, help, constant string
+	buckets              []float64
+	vec                  vec[histSeries]
+}
+
+type histSeries struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram registers a histogram with the given upper bounds, in
+// increasing order, and label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, constant: r.constant, buckets: buckets, vec: newVec[histSeries](labels)}
+	r.register(name, h)
+	return h
+}
+
+// NewHistogram registers a histogram in Default.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// Observe counts v in the series with the given label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	s := h.vec.get(labelValues, func() *histSeries { return &histSeries{counts: make([]uint64, len(h.buckets))} })
+	i := sort.SearchFloat64s(h.buckets, v) // first bucket with bound >= v
+	h.vec.mu.Lock()
+	if i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+	h.vec.mu.Unlock()
+}
+
+func (h *Histogram) write(b *strings.Builder) {
+	header(b, h.name, h.help, "histogram")
+	h.vec.each(func(values []string, s *histSeries) {
+		var cum uint64
+		for i, le := range h.buckets {
+			cum += s.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, labelString(h.constant, h.vec.labels, values, `le="`+formatFloat(le)+`"`), cum)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, labelString(h.constant, h.vec.labels, values, `le="+Inf"`), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, labelString(h.constant, h.vec.labels, values, ""), formatFloat(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, labelString(h.constant, h.vec.labels, values, ""), s.count)
+	})
+}
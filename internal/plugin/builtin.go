@@ -0,0 +1,53 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+)
+
+// The built-ins: the standard JSON decoder and its CBOR and MessagePack
+// counterparts, a field-dropping transform, a notifier that only logs
+// (mostly useful as examples and for development) and the webhook, Slack and
+// SMTP notifiers (notifiers.go).
+func init() {
+	RegisterDecoder("json", DecoderFunc(telem.Decode))
+	RegisterDecoder("cbor", DecoderFunc(telem.DecodeCBOR))
+	RegisterDecoder("msgpack", DecoderFunc(telem.DecodeMsgPack))
+	RegisterTransform("drop_fields", newDropFields)
+	RegisterNotifier("log", func(json.RawMessage) (Notifier, error) { return logNotifier{}, nil })
+	RegisterNotifier("webhook", newWebhookNotifier)
+	RegisterNotifier("slack", newSlackNotifier)
+	RegisterNotifier("smtp", newSMTPNotifier)
+}
+
+// drop_fields: {"fields":["debug_blob","tmp"]}
+type dropFields struct {
+	Fields []string `json:"fields"`
+}
+
+func newDropFields(config json.RawMessage) (Transform, error) {
+	var t dropFields
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, &t); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t dropFields) Transform(p *telem.Point) (bool, error) {
+	for _, f := range t.Fields {
+		delete(p.Fields, f)
+	}
+	return true, nil
+}
+
+type logNotifier struct{}
+
+func (logNotifier) Notify(_ context.Context, n Notification) error {
+	log.Printf("notify [%s] %s: %s (robot=%s)", n.Severity, n.Title, n.Body, n.Robot)
+	return nil
+}
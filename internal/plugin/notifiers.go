@@ -0,0 +1,283 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// post sends body to u as JSON with extra headers; a 4xx other than 408 or
+// 429 is permanent.
+func post(ctx context.Context, u string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	res, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	if res.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+	if res.StatusCode/100 == 4 && res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusTooManyRequests {
+		return Permanent(err)
+	}
+	return err
+}
+
+func checkURL(u string) error {
+	p, err := url.Parse(u)
+	if err != nil || (p.Scheme != "https" && p.Scheme != "http") || p.Host == "" {
+		return fmt.Errorf("bad url %q", u)
+	}
+	return nil
+}
+
+// webhook: {"url":"https://…","secret":"…","headers":{"X-Team":"ops"}}
+//
+// POSTs the notification as JSON. With a secret, X-Evabot-Timestamp carries
+// the Unix time and X-Evabot-Signature "sha256=" and the hex HMAC-SHA256,
+// keyed by the secret, of the timestamp, a dot and the body, so a receiver
+// can check the sender and refuse replays.
+type webhookNotifier struct {
+	URL     string            `json:"url"`
+	Secret  string            `json:"secret"`
+	Headers map[string]string `json:"headers"`
+}
+
+func newWebhookNotifier(config json.RawMessage) (Notifier, error) {
+	var n webhookNotifier
+	if err := json.Unmarshal(config, &n); err != nil {
+		return nil, fmt.Errorf("webhook: %w", err)
+	}
+	if err := checkURL(n.URL); err != nil {
+		return nil, fmt.Errorf("webhook: %w", err)
+	}
+	return &n, nil
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, note Notification) error {
+	body, _ := json.Marshal(note)
+	h := http.Header{}
+	for k, v := range n.Headers {
+		h.Set(k, v)
+	}
+	if n.Secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		h.Set("X-Evabot-Timestamp", ts)
+		h.Set("X-Evabot-Signature", "sha256="+Sign(n.Secret, ts, body))
+	}
+	return post(ctx, n.URL, body, h)
+}
+
+// Sign is the hex HMAC-SHA256 a webhook carries in X-Evabot-Signature.
+func Sign(secret, ts string, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(ts + "."))
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// slack: {"url":"https://hooks.slack.com/services/…","channel":"#ops","username":"evabot"}
+//
+// Posts to an incoming webhook, coloured by severity; channel and username
+// override the webhook's own where Slack allows it.
+type slackNotifier struct {
+	URL      string `json:"url"`
+	Channel  string `json:"channel"`
+	Username string `json:"username"`
+}
+
+func newSlackNotifier(config json.RawMessage) (Notifier, error) {
+	var n slackNotifier
+	if err := json.Unmarshal(config, &n); err != nil {
+		return nil, fmt.Errorf("slack: %w", err)
+	}
+	if err := checkURL(n.URL); err != nil {
+		return nil, fmt.Errorf("slack: %w", err)
+	}
+	return &n, nil
+}
+
+var slackColors = map[string]string{"info": "#439fe0", "warning": "warning", "critical": "danger"}
+
+func (n *slackNotifier) Notify(ctx context.Context, note Notification) error {
+	type field struct {
+		Title string `json:"title"`
+		Value string `json:"value"`
+		Short bool   `json:"short"`
+	}
+	var fields []field
+	for _, k := range keys(note.Labels) {
+		fields = append(fields, field{k, note.Labels[k], true})
+	}
+	if note.Labels["state"] == "resolved" {
+		note.Severity = "resolved"
+	}
+	msg := map[string]interface{}{
+		"text": note.Title,
+		"attachments": []map[string]interface{}{{
+			"color": slackColors[note.Severity], "text": note.Body, "fields": fields, "ts": note.TS.Unix(),
+		}},
+	}
+	if n.Channel != "" {
+		msg["channel"] = n.Channel
+	}
+	if n.Username != "" {
+		msg["username"] = n.Username
+	}
+	body, _ := json.Marshal(msg)
+	return post(ctx, n.URL, body, nil)
+}
+
+// smtp: {"host":"smtp.example.com","port":587,"username":"…","password":"…",
+// "from":"evabot@example.com","to":["ops@example.com"]}
+//
+// Mails a plain-text message. Port 465 speaks TLS from the start; others
+// upgrade with STARTTLS when the server offers it, and credentials are
+// only sent over TLS.
+type smtpNotifier struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+
+	from string // bare addresses, for the envelope
+	to   []string
+}
+
+func newSMTPNotifier(config json.RawMessage) (Notifier, error) {
+	n := smtpNotifier{Port: 587}
+	if err := json.Unmarshal(config, &n); err != nil {
+		return nil, fmt.Errorf("smtp: %w", err)
+	}
+	if n.Host == "" || n.Port <= 0 || n.Port > 65535 {
+		return nil, errors.New("smtp: needs a host and a port")
+	}
+	from, err := mail.ParseAddress(n.From)
+	if err != nil {
+		return nil, fmt.Errorf("smtp: bad from: %w", err)
+	}
+	n.from = from.Address
+	if len(n.To) == 0 {
+		return nil, errors.New("smtp: needs at least one to")
+	}
+	for _, to := range n.To {
+		a, err := mail.ParseAddress(to)
+		if err != nil {
+			return nil, fmt.Errorf("smtp: bad to %q: %w", to, err)
+		}
+		n.to = append(n.to, a.Address)
+	}
+	return &n, nil
+}
+
+func (n *smtpNotifier) Notify(ctx context.Context, note Notification) error {
+	err := n.send(ctx, n.message(note))
+	var te *textproto.Error
+	if errors.As(err, &te) && te.Code >= 500 {
+		return Permanent(err)
+	}
+	return err
+}
+
+func (n *smtpNotifier) message(note Notification) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", n.From, strings.Join(n.To, ", "),
+		mime.QEncoding.Encode("utf-8", "["+note.Severity+"] "+note.Title), note.TS.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(note.Body + "\r\n\r\n")
+	if note.Robot != "" {
+		b.WriteString("robot: " + note.Robot + "\r\n")
+	}
+	for _, k := range keys(note.Labels) {
+		b.WriteString(k + ": " + note.Labels[k] + "\r\n")
+	}
+	b.WriteString("at: " + note.TS.UTC().Format(time.RFC3339) + "\r\n")
+	return b.Bytes()
+}
+
+func (n *smtpNotifier) send(ctx context.Context, msg []byte) error {
+	addr := net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
+	tlsConfig := &tls.Config{ServerName: n.Host}
+	var conn net.Conn
+	var err error
+	if n.Port == 465 {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	c, err := smtp.NewClient(conn, n.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok && n.Port != 465 {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if n.Username != "" {
+		if _, isTLS := c.TLSConnectionState(); !isTLS {
+			return Permanent(errors.New("server offers no TLS; not sending credentials"))
+		}
+		if err := c.Auth(smtp.PlainAuth("", n.Username, n.Password, n.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.from); err != nil {
+		return err
+	}
+	for _, to := range n.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,209 @@
+// Package plugin is the compile-time extension point for customer-specific
+// formats and channels. A plugin is a Go package that registers itself from
+// init(), the way database/sql drivers do:
+//
+//	func init() {
+//		plugin.RegisterDecoder("acme-can", plugin.DecoderFunc(decodeCAN))
+//	}
+//
+// and is linked in with a blank import in cmd/telem_worker/plugins.go (or the
+// gateway for notifiers). Which decoder handles which subject, and which
+// transforms run, is configuration (see internal/worker), so adding a format
+// never means forking the worker.
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+)
+
+// Decoder turns one message into a point. serverTS is the JetStream timestamp
+// and now bounds timestamp plausibility, as in telem.Decode; decoders return
+// telem.ErrBadTimestamp for implausible times so the worker drops rather than
+// quarantines them.
+type Decoder interface {
+	Decode(subject string, data []byte, serverTS, now time.Time) (telem.Point, error)
+}
+
+// DecoderFunc adapts a function to Decoder.
+type DecoderFunc func(subject string, data []byte, serverTS, now time.Time) (telem.Point, error)
+
+func (f DecoderFunc) Decode(subject string, data []byte, serverTS, now time.Time) (telem.Point, error) {
+	return f(subject, data, serverTS, now)
+}
+
+// DecoderFactory builds a decoder from its JSON configuration, for formats
+// that need telling how to read a subject (which message type, which fields).
+type DecoderFactory func(config json.RawMessage) (Decoder, error)
+
+// Transform rewrites a decoded point in place before it is stored. Returning
+// false drops the point (counted, acked, not stored).
+type Transform interface {
+	Transform(p *telem.Point) (keep bool, err error)
+}
+
+// TransformFactory builds a transform from its JSON configuration.
+type TransformFactory func(config json.RawMessage) (Transform, error)
+
+// Notification is what alerting hands to a notification channel.
+type Notification struct {
+	Title    string            `json:"title"`
+	Body     string            `json:"body"`
+	Severity string            `json:"severity"`
+	Robot    string            `json:"robot,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	TS       time.Time         `json:"ts"`
+}
+
+// Notifier delivers notifications to one channel (chat, mail, pager...).
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// Permanent marks a notifier's error as one retrying won't fix (a rejected
+// request, an unknown recipient), so the delivery is given up at once.
+func Permanent(err error) error { return permanentError{err} }
+
+// IsPermanent reports whether err was marked by Permanent.
+func IsPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+type permanentError struct{ error }
+
+func (p permanentError) Unwrap() error { return p.error }
+
+// NotifierFactory builds a notifier from its JSON configuration.
+type NotifierFactory func(config json.RawMessage) (Notifier, error)
+
+var (
+	mu         sync.RWMutex
+	decoders   = map[string]Decoder{}
+	decoderFs  = map[string]DecoderFactory{}
+	transforms = map[string]TransformFactory{}
+	notifiers  = map[string]NotifierFactory{}
+)
+
+// RegisterDecoder makes a decoder available under name. It panics if the name
+// is taken, so two plugins can't silently shadow each other.
+func RegisterDecoder(name string, d Decoder) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := decoders[name]; dup || decoderFs[name] != nil {
+		panic("plugin: decoder " + name + " registered twice")
+	}
+	decoders[name] = d
+}
+
+// RegisterDecoderFactory makes a configurable decoder available under name.
+func RegisterDecoderFactory(name string, f DecoderFactory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := decoders[name]; dup || decoderFs[name] != nil {
+		panic("plugin: decoder " + name + " registered twice")
+	}
+	decoderFs[name] = f
+}
+
+// RegisterTransform makes a transform available under name.
+func RegisterTransform(name string, f TransformFactory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := transforms[name]; dup {
+		panic("plugin: transform " + name + " registered twice")
+	}
+	transforms[name] = f
+}
+
+// RegisterNotifier makes a notification channel available under name.
+func RegisterNotifier(name string, f NotifierFactory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := notifiers[name]; dup {
+		panic("plugin: notifier " + name + " registered twice")
+	}
+	notifiers[name] = f
+}
+
+// LookupDecoder returns the decoder registered under name.
+func LookupDecoder(name string) (Decoder, error) {
+	return NewDecoder(name, nil)
+}
+
+// NewDecoder returns the decoder registered under name, built from config if
+// it is a configurable one.
+func NewDecoder(name string, config json.RawMessage) (Decoder, error) {
+	mu.RLock()
+	d, ok := decoders[name]
+	f := decoderFs[name]
+	have := decoderNames()
+	mu.RUnlock()
+	switch {
+	case ok && len(config) > 0:
+		return nil, fmt.Errorf("plugin: decoder %q takes no config", name)
+	case ok:
+		return d, nil
+	case f != nil:
+		return f(config)
+	}
+	return nil, fmt.Errorf("plugin: unknown decoder %q (have %v)", name, have)
+}
+
+// NewTransform builds the transform registered under name.
+func NewTransform(name string, config json.RawMessage) (Transform, error) {
+	mu.RLock()
+	f, ok := transforms[name]
+	have := keys(transforms)
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("plugin: unknown transform %q (have %v)", name, have)
+	}
+	return f(config)
+}
+
+// NewNotifier builds the notifier registered under name.
+func NewNotifier(name string, config json.RawMessage) (Notifier, error) {
+	mu.RLock()
+	f, ok := notifiers[name]
+	have := keys(notifiers)
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("plugin: unknown notifier %q (have %v)", name, have)
+	}
+	return f(config)
+}
+
+// Registered lists the registered names per kind, for diagnostics.
+func Registered() map[string][]string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return map[string][]string{
+		"decoders":   decoderNames(),
+		"transforms": keys(transforms),
+		"notifiers":  keys(notifiers),
+	}
+}
+
+// decoderNames lists plain and configurable decoders; mu is held.
+func decoderNames() []string {
+	out := append(keys(decoders), keys(decoderFs)...)
+	sort.Strings(out)
+	return out
+}
+
+func keys[V any](m map[string]V) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
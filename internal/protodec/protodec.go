@@ -0,0 +1,325 @@
+// Package protodec is the "protobuf" decoder for robots that publish
+// protobuf rather than JSON. The message types come from FileDescriptorSets
+// loaded at startup (protoc --include_imports --descriptor_set_out=…), so a
+// new message type is a config change, not a rebuild. Each DECODERS route
+// says which message a subject carries and how it maps to the point:
+//
+//	{"subject":"telemetry.*.pose","decoder":"protobuf","config":{
+//	  "message":"evabot.v1.Pose",
+//	  "time":"stamp",
+//	  "tags":{"frame":"header.frame_id"},
+//	  "fields":{"x":"position.x","y":"position.y","battery":"battery_pct"}}}
+//
+// Paths are dotted field names through nested messages. Without "fields",
+// every scalar field is stored, nested ones named with "_" (position_x).
+// "time" may be a google.protobuf.Timestamp or an integer epoch in any unit;
+// without it, or when it is unset, the JetStream timestamp is used.
+// Numbers are stored as floats, like the JSON decoder's, and enums by name.
+package protodec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/plugin"
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func init() {
+	plugin.RegisterDecoderFactory("protobuf", newDecoder)
+}
+
+// maxDepth bounds how deep default fields are collected, for recursive types.
+const maxDepth = 8
+
+var (
+	mu    sync.RWMutex
+	files *protoregistry.Files
+)
+
+// Load reads FileDescriptorSets from paths, replacing what was loaded
+// before. A file in more than one set is taken once.
+func Load(paths ...string) error {
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := map[string]bool{}
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var s descriptorpb.FileDescriptorSet
+		if err := proto.Unmarshal(b, &s); err != nil {
+			return fmt.Errorf("%s: not a FileDescriptorSet: %w", path, err)
+		}
+		for _, f := range s.File {
+			if !seen[f.GetName()] {
+				seen[f.GetName()] = true
+				set.File = append(set.File, f)
+			}
+		}
+	}
+	fs, err := protodesc.NewFiles(set)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	files = fs
+	mu.Unlock()
+	return nil
+}
+
+// Messages lists the loaded message types, for diagnostics.
+func Messages() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	var out []string
+	if files == nil {
+		return out
+	}
+	files.RangeFiles(func(f protoreflect.FileDescriptor) bool {
+		collect(f.Messages(), &out)
+		return true
+	})
+	sort.Strings(out)
+	return out
+}
+
+func collect(ms protoreflect.MessageDescriptors, out *[]string) {
+	for i := 0; i < ms.Len(); i++ {
+		*out = append(*out, string(ms.Get(i).FullName()))
+		collect(ms.Get(i).Messages(), out)
+	}
+}
+
+// path is a resolved dotted field name.
+type path []protoreflect.FieldDescriptor
+
+type decoder struct {
+	md     protoreflect.MessageDescriptor
+	time   path // nil: the JetStream timestamp
+	tags   map[string]path
+	fields map[string]path
+}
+
+func newDecoder(config json.RawMessage) (plugin.Decoder, error) {
+	var c struct {
+		Message string            `json:"message"`
+		Time    string            `json:"time"`
+		Tags    map[string]string `json:"tags"`
+		Fields  map[string]string `json:"fields"`
+	}
+	if len(config) == 0 {
+		return nil, errors.New(`protobuf: config needs "message"`)
+	}
+	if err := json.Unmarshal(config, &c); err != nil {
+		return nil, fmt.Errorf("protobuf: %w", err)
+	}
+	mu.RLock()
+	fs := files
+	mu.RUnlock()
+	if fs == nil {
+		return nil, errors.New("protobuf: no descriptors loaded (PROTO_DESCRIPTORS)")
+	}
+	desc, err := fs.FindDescriptorByName(protoreflect.FullName(c.Message))
+	md, ok := desc.(protoreflect.MessageDescriptor)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("protobuf: no message %q in the loaded descriptors", c.Message)
+	}
+	d := &decoder{md: md, tags: map[string]path{}, fields: map[string]path{}}
+	used := map[string]bool{}
+	if c.Time != "" {
+		if d.time, err = resolve(md, c.Time, true); err != nil {
+			return nil, err
+		}
+		used[c.Time] = true
+	}
+	for tag, name := range c.Tags {
+		if d.tags[tag], err = resolve(md, name, false); err != nil {
+			return nil, err
+		}
+		used[name] = true
+	}
+	for field, name := range c.Fields {
+		if d.fields[field], err = resolve(md, name, false); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.Fields) == 0 {
+		scalars(md, nil, used, d.fields)
+	}
+	return d, nil
+}
+
+// resolve looks up a dotted field name in md. The field must be a singular
+// scalar or enum, or a google.protobuf.Timestamp when it is the time.
+func resolve(md protoreflect.MessageDescriptor, name string, isTime bool) (path, error) {
+	var p path
+	for i, part := range strings.Split(name, ".") {
+		if md == nil {
+			return nil, fmt.Errorf("protobuf: %s: %s is not a message", name, p[i-1].Name())
+		}
+		fd := md.Fields().ByName(protoreflect.Name(part))
+		if fd == nil {
+			return nil, fmt.Errorf("protobuf: %s has no field %q", md.FullName(), part)
+		}
+		if fd.IsList() || fd.IsMap() {
+			return nil, fmt.Errorf("protobuf: %s: repeated and map fields can't be mapped", name)
+		}
+		p = append(p, fd)
+		md = fd.Message()
+	}
+	last := p.last()
+	switch {
+	case isTime && last.Message() != nil && last.Message().FullName() == "google.protobuf.Timestamp":
+	case isTime && isInt(last.Kind()):
+	case isTime:
+		return nil, fmt.Errorf("protobuf: time %s must be a google.protobuf.Timestamp or an integer", name)
+	case last.Message() != nil || last.Kind() == protoreflect.BytesKind:
+		return nil, fmt.Errorf("protobuf: %s is not a scalar", name)
+	}
+	return p, nil
+}
+
+// scalars adds every singular scalar field under md not in used to out,
+// named by their path joined with "_".
+func scalars(md protoreflect.MessageDescriptor, prefix path, used map[string]bool, out map[string]path) {
+	if len(prefix) >= maxDepth {
+		return
+	}
+	fds := md.Fields()
+	for i := 0; i < fds.Len(); i++ {
+		fd := fds.Get(i)
+		if fd.IsList() || fd.IsMap() || fd.Kind() == protoreflect.BytesKind {
+			continue
+		}
+		p := append(append(path{}, prefix...), fd)
+		if used[p.dotted()] {
+			continue
+		}
+		if fd.Message() != nil {
+			scalars(fd.Message(), p, used, out)
+			continue
+		}
+		out[p.joined("_")] = p
+	}
+}
+
+func (p path) joined(sep string) string {
+	names := make([]string, len(p))
+	for i, fd := range p {
+		names[i] = string(fd.Name())
+	}
+	return strings.Join(names, sep)
+}
+
+func (p path) dotted() string { return p.joined(".") }
+
+func (p path) last() protoreflect.FieldDescriptor { return p[len(p)-1] }
+
+// get returns the value at p, false if it or a message on the way is unset.
+func (p path) get(m protoreflect.Message) (protoreflect.Value, bool) {
+	for _, fd := range p[:len(p)-1] {
+		if !m.Has(fd) {
+			return protoreflect.Value{}, false
+		}
+		m = m.Get(fd).Message()
+	}
+	last := p.last()
+	if last.HasPresence() && !m.Has(last) {
+		return protoreflect.Value{}, false
+	}
+	return m.Get(last), true
+}
+
+func isInt(k protoreflect.Kind) bool {
+	switch k {
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return true
+	}
+	return false
+}
+
+// value converts a scalar for Influx: numbers to float64, enums to names.
+func value(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return v.Bool()
+	case protoreflect.StringKind:
+		return v.String()
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return fmt.Sprint(v.Enum())
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return v.Float()
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return float64(v.Uint())
+	default:
+		return float64(v.Int())
+	}
+}
+
+// stamp reads the configured time field, false if there is none or it is
+// unset.
+func (d *decoder) stamp(m protoreflect.Message) (time.Time, bool) {
+	if d.time == nil {
+		return time.Time{}, false
+	}
+	v, ok := d.time.get(m)
+	if !ok {
+		return time.Time{}, false
+	}
+	if md := d.time.last().Message(); md != nil {
+		tm := v.Message()
+		secs, nanos := tm.Get(md.Fields().ByName("seconds")).Int(), tm.Get(md.Fields().ByName("nanos")).Int()
+		return time.Unix(secs, nanos), secs != 0 || nanos != 0
+	}
+	n, _ := value(d.time.last(), v).(float64)
+	return telem.UnixAnyToTime(int64(n)), n > 0
+}
+
+func (d *decoder) Decode(subject string, data []byte, serverTS, now time.Time) (telem.Point, error) {
+	m := dynamicpb.NewMessage(d.md)
+	if err := proto.Unmarshal(data, m); err != nil {
+		return telem.Point{}, fmt.Errorf("protobuf %s: %w", d.md.FullName(), err)
+	}
+	ts := serverTS
+	if v, ok := d.stamp(m); ok {
+		ts = v
+	}
+	p := telem.Point{Measurement: telem.Measurement, Time: ts}
+	if ts.Before(now.AddDate(-10, 0, 0)) || ts.After(now.Add(24*time.Hour)) {
+		return p, telem.ErrBadTimestamp
+	}
+	p.Tags = map[string]string{"subject": subject}
+	for tag, tp := range d.tags {
+		if v, ok := tp.get(m); ok {
+			p.Tags[tag] = fmt.Sprint(value(tp.last(), v))
+		}
+	}
+	p.Fields = map[string]interface{}{}
+	for field, fp := range d.fields {
+		if v, ok := fp.get(m); ok {
+			p.Fields[field] = value(fp.last(), v)
+		}
+	}
+	if len(p.Fields) == 0 {
+		return p, fmt.Errorf("protobuf %s: no fields set", d.md.FullName())
+	}
+	return p, nil
+}
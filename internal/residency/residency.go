@@ -0,0 +1,82 @@
+// Package residency decides which Influx instance holds a tenant's
+// telemetry, for customers whose data must stay in a region. Regions and the
+// tenants pinned to them are deployment configuration, shared by the worker
+// (which writes) and the gateway (which queries):
+//
+//	INFLUX_REGIONS={"eu":{"url":"https://influx.eu.example","org":"r4f","bucket":"telemetry_eu","token_env":"INFLUX_TOKEN_EU"}}
+//	TENANT_REGIONS={"acme-eu":"eu"}
+//
+// Tenants not listed use the default instance (INFLUX_URL/INFLUX_BUCKET). A
+// robot belongs to the tenant set on its registry record.
+package residency
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Region is one region's Influx instance. The token is given inline or,
+// preferably, as the name of the environment variable holding it.
+type Region struct {
+	URL      string `json:"url"`
+	Org      string `json:"org"`
+	Bucket   string `json:"bucket"`
+	Token    string `json:"token,omitempty"`
+	TokenEnv string `json:"token_env,omitempty"`
+}
+
+// Config maps tenants to regions; the zero value routes everything to the
+// default instance.
+type Config struct {
+	Regions map[string]Region
+	Tenants map[string]string // tenant → region
+}
+
+// Load parses INFLUX_REGIONS / TENANT_REGIONS style JSON and checks that
+// every pinned tenant has a complete region to go to, so routing can't fall
+// back to the default instance at run time.
+func Load(regionsJSON, tenantsJSON string) (*Config, error) {
+	c := &Config{Regions: map[string]Region{}, Tenants: map[string]string{}}
+	if regionsJSON != "" {
+		if err := json.Unmarshal([]byte(regionsJSON), &c.Regions); err != nil {
+			return nil, fmt.Errorf("INFLUX_REGIONS: %w", err)
+		}
+	}
+	if tenantsJSON != "" {
+		if err := json.Unmarshal([]byte(tenantsJSON), &c.Tenants); err != nil {
+			return nil, fmt.Errorf("TENANT_REGIONS: %w", err)
+		}
+	}
+	for name, r := range c.Regions {
+		if r.TokenEnv != "" {
+			r.Token = os.Getenv(r.TokenEnv)
+		}
+		if r.URL == "" || r.Org == "" || r.Bucket == "" || r.Token == "" {
+			return nil, fmt.Errorf("INFLUX_REGIONS: region %q needs url, org, bucket and a token", name)
+		}
+		c.Regions[name] = r
+	}
+	for tenant, region := range c.Tenants {
+		if _, ok := c.Regions[region]; !ok {
+			return nil, fmt.Errorf("TENANT_REGIONS: tenant %q is pinned to undefined region %q", tenant, region)
+		}
+	}
+	return c, nil
+}
+
+// RegionOf names the region a tenant's data lives in, "" for the default.
+func (c *Config) RegionOf(tenant string) string {
+	return c.Tenants[tenant]
+}
+
+// Names lists the configured regions.
+func (c *Config) Names() []string {
+	out := make([]string, 0, len(c.Regions))
+	for name := range c.Regions {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
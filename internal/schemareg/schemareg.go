@@ -0,0 +1,233 @@
+// Package schemareg is the registry of JSON Schemas telemetry payloads are
+// checked against. The gateway stores schemas in the TELEMETRY_SCHEMAS
+// bucket (PUT /api/schemas/{name}); workers watch it and validate every
+// message whose subject matches a schema's pattern before decoding it.
+// Invalid payloads go to the dead-letter stream with what failed, so a
+// robot sending the wrong shape shows up there instead of as gaps or odd
+// fields in Influx.
+//
+// Binary payloads (CBOR, MessagePack) are validated as the JSON they are
+// converted to. Protobuf payloads are typed by their descriptors already and
+// can't be read as JSON, so their subjects shouldn't have a schema.
+package schemareg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/nats-io/nats.go"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Bucket holds one Schema per key, by name.
+const Bucket = "TELEMETRY_SCHEMAS"
+
+// Modes: enforce dead-letters invalid payloads, warn only counts and logs
+// them, for trying a schema on live traffic first.
+const (
+	Enforce = "enforce"
+	Warn    = "warn"
+)
+
+// Schema applies a JSON Schema to the payloads of subjects matching Subject.
+// A subject matching several schemas must satisfy all of them.
+type Schema struct {
+	Name    string          `json:"name"`
+	Subject string          `json:"subject"`
+	Mode    string          `json:"mode"`
+	Schema  json.RawMessage `json:"schema"`
+	Version int             `json:"version"`
+	Updated time.Time       `json:"updated"`
+	By      string          `json:"by,omitempty"`
+}
+
+// maxErrors bounds the failures reported for one payload.
+const maxErrors = 5
+
+// Compile checks s and compiles its schema. References are resolved within
+// the schema only: nothing is fetched from files or the network.
+func (s Schema) Compile() (*jsonschema.Schema, error) {
+	if !strings.HasPrefix(s.Subject, "telemetry.") {
+		return nil, errors.New("subject must be a telemetry.… pattern")
+	}
+	if s.Mode != Enforce && s.Mode != Warn {
+		return nil, fmt.Errorf("mode must be %s or %s", Enforce, Warn)
+	}
+	c := jsonschema.NewCompiler()
+	c.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("%s: only references within the schema are resolved", url)
+	}
+	url := "schema:" + s.Name
+	if err := c.AddResource(url, bytes.NewReader(s.Schema)); err != nil {
+		return nil, err
+	}
+	return c.Compile(url)
+}
+
+// Failure is one way a payload doesn't match a schema.
+type Failure struct {
+	Schema string `json:"schema"`
+	At     string `json:"at"` // JSON pointer into the payload
+	Error  string `json:"error"`
+}
+
+// Invalid is the error for a payload that fails a schema.
+type Invalid struct {
+	Failures []Failure
+	Enforced bool // false when every failed schema is in warn mode
+}
+
+func (e *Invalid) Error() string {
+	parts := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		at := f.At
+		if at == "" {
+			at = "/"
+		}
+		parts[i] = fmt.Sprintf("schema %s: %s: %s", f.Schema, at, f.Error)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Check validates doc against a compiled schema, returning its failures.
+func Check(name string, sch *jsonschema.Schema, doc interface{}) []Failure {
+	err := sch.Validate(doc)
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		if err != nil {
+			return []Failure{{Schema: name, Error: err.Error()}}
+		}
+		return nil
+	}
+	var out []Failure
+	var leaves func(*jsonschema.ValidationError)
+	leaves = func(ve *jsonschema.ValidationError) {
+		if len(ve.Causes) == 0 && len(out) < maxErrors {
+			out = append(out, Failure{Schema: name, At: ve.InstanceLocation, Error: ve.Message})
+		}
+		for _, c := range ve.Causes {
+			leaves(c)
+		}
+	}
+	leaves(ve)
+	return out
+}
+
+// Document parses a payload the way it is validated: JSON as is, CBOR and
+// MessagePack converted to JSON.
+func Document(contentType, subject string, data []byte) (interface{}, error) {
+	data, err := telem.ToJSON(contentType, subject, data)
+	if err != nil {
+		return nil, fmt.Errorf("not decodable: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("not JSON: %w", err)
+	}
+	return doc, nil
+}
+
+type compiled struct {
+	Schema
+	sch *jsonschema.Schema
+}
+
+// Registry is the workers' copy of the bucket.
+type Registry struct {
+	mu      sync.RWMutex
+	schemas map[string]compiled
+}
+
+// Open binds to the bucket, creating it on first use.
+func Open(js nats.JetStreamContext) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: Bucket, History: 5, Storage: nats.FileStorage})
+	}
+	return kv, err
+}
+
+// Watch follows the bucket. A schema that doesn't compile is skipped, with
+// logf told why; the gateway doesn't store such schemas.
+func Watch(kv nats.KeyValue, logf func(format string, args ...interface{})) (*Registry, error) {
+	r := &Registry{schemas: map[string]compiled{}}
+	w, err := kv.WatchAll()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for e := range w.Updates() {
+			if e == nil {
+				continue
+			}
+			var s Schema
+			if e.Operation() != nats.KeyValuePut || json.Unmarshal(e.Value(), &s) != nil {
+				r.remove(e.Key())
+				continue
+			}
+			sch, err := s.Compile()
+			if err != nil {
+				logf("schema %s: not applied: %v", s.Name, err)
+				r.remove(e.Key())
+				continue
+			}
+			r.mu.Lock()
+			r.schemas[e.Key()] = compiled{Schema: s, sch: sch}
+			r.mu.Unlock()
+		}
+	}()
+	return r, nil
+}
+
+func (r *Registry) remove(name string) {
+	r.mu.Lock()
+	delete(r.schemas, name)
+	r.mu.Unlock()
+}
+
+// Validate checks a message against every schema for its subject. It
+// returns nil when there are none or it passes, else an *Invalid; a payload
+// that can't be parsed fails every schema for its subject.
+func (r *Registry) Validate(subject, contentType string, data []byte) error {
+	base := telem.TrimFormat(subject)
+	r.mu.RLock()
+	var match []compiled
+	for _, c := range r.schemas {
+		if telem.SubjectMatches(c.Subject, base) {
+			match = append(match, c)
+		}
+	}
+	r.mu.RUnlock()
+	if len(match) == 0 {
+		return nil
+	}
+	sort.Slice(match, func(i, j int) bool { return match[i].Name < match[j].Name })
+	doc, err := Document(contentType, subject, data)
+	inv := &Invalid{}
+	for _, c := range match {
+		var fs []Failure
+		if err != nil {
+			fs = []Failure{{Schema: c.Name, Error: err.Error()}}
+		} else {
+			fs = Check(c.Name, c.sch, doc)
+		}
+		if len(fs) > 0 {
+			inv.Failures = append(inv.Failures, fs...)
+			inv.Enforced = inv.Enforced || c.Mode == Enforce
+		}
+	}
+	if len(inv.Failures) == 0 {
+		return nil
+	}
+	return inv
+}
@@ -0,0 +1,458 @@
+package telem
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"strings"
+	"time"
+)
+
+// Payload formats besides JSON, for bandwidth-constrained robots. A message
+// says which it is with a Content-Type header (application/cbor,
+// application/msgpack) or a subject suffix (telemetry.r1.pose.cbor, stored
+// with the suffix dropped from the subject tag); failing that, a binary map
+// is recognised by its first byte, which is never valid JSON. Either is
+// flattened like JSON: the same "data" block, topic, ts_ns and source rules.
+const (
+	FormatJSON    = "json"
+	FormatCBOR    = "cbor"
+	FormatMsgPack = "msgpack"
+)
+
+// maxNesting bounds how deep binary payloads may nest.
+const maxNesting = 32
+
+var errTruncated = errors.New("truncated")
+
+// FormatOf picks the format of a message from its Content-Type header, its
+// subject suffix, or its first byte, in that order.
+func FormatOf(contentType, subject string, data []byte) string {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch mt {
+		case "application/cbor":
+			return FormatCBOR
+		case "application/msgpack", "application/x-msgpack", "application/vnd.msgpack":
+			return FormatMsgPack
+		case "application/json":
+			return FormatJSON
+		}
+	}
+	switch subject[strings.LastIndexByte(subject, '.')+1:] {
+	case FormatCBOR:
+		return FormatCBOR
+	case FormatMsgPack, "mpk":
+		return FormatMsgPack
+	}
+	if len(data) > 0 {
+		switch b := data[0]; {
+		case b >= 0xa0 && b <= 0xbb, b == 0xbf, b == 0xd9: // CBOR map, or the self-describe tag
+			return FormatCBOR
+		case b >= 0x80 && b <= 0x8f, b == 0xde, b == 0xdf: // msgpack map
+			return FormatMsgPack
+		}
+	}
+	return FormatJSON
+}
+
+// TrimFormat drops a format suffix from subject.
+func TrimFormat(subject string) string {
+	for _, suffix := range []string{"." + FormatCBOR, "." + FormatMsgPack, ".mpk"} {
+		if s, ok := strings.CutSuffix(subject, suffix); ok {
+			return s
+		}
+	}
+	return subject
+}
+
+// DecodeAny decodes a message in whichever format FormatOf picks.
+func DecodeAny(subject, contentType string, data []byte, serverTS, now time.Time) (Point, error) {
+	switch FormatOf(contentType, subject, data) {
+	case FormatCBOR:
+		return DecodeCBOR(subject, data, serverTS, now)
+	case FormatMsgPack:
+		return DecodeMsgPack(subject, data, serverTS, now)
+	}
+	return Decode(subject, data, serverTS, now)
+}
+
+// ToJSON converts a CBOR or MessagePack payload to the JSON it is stored as
+// in "raw"; a JSON payload is returned as it is.
+func ToJSON(contentType, subject string, data []byte) ([]byte, error) {
+	var v interface{}
+	var err error
+	switch FormatOf(contentType, subject, data) {
+	case FormatCBOR:
+		if v, err = (&cborReader{b: data}).value(0); err != nil {
+			return nil, fmt.Errorf("cbor: %w", err)
+		}
+	case FormatMsgPack:
+		if v, err = (&msgpackReader{b: data}).value(0); err != nil {
+			return nil, fmt.Errorf("msgpack: %w", err)
+		}
+	default:
+		return data, nil
+	}
+	return json.Marshal(v)
+}
+
+// DecodeCBOR is Decode for CBOR (RFC 8949) payloads.
+func DecodeCBOR(subject string, data []byte, serverTS, now time.Time) (Point, error) {
+	d := &cborReader{b: data}
+	v, err := d.value(0)
+	if err != nil {
+		return Point{Time: serverTS}, fmt.Errorf("cbor: %w", err)
+	}
+	return decodeBinary(subject, v, serverTS, now)
+}
+
+// DecodeMsgPack is Decode for MessagePack payloads.
+func DecodeMsgPack(subject string, data []byte, serverTS, now time.Time) (Point, error) {
+	d := &msgpackReader{b: data}
+	v, err := d.value(0)
+	if err != nil {
+		return Point{Time: serverTS}, fmt.Errorf("msgpack: %w", err)
+	}
+	return decodeBinary(subject, v, serverTS, now)
+}
+
+// decodeBinary builds the point for a decoded payload, with it as JSON for
+// "raw" so it can be read when debugging.
+func decodeBinary(subject string, v interface{}, serverTS, now time.Time) (Point, error) {
+	parsed, ok := v.(map[string]interface{})
+	if !ok {
+		return Point{Time: serverTS}, errors.New("payload is not a map")
+	}
+	raw, err := json.Marshal(parsed)
+	if err != nil {
+		return Point{Time: serverTS}, err
+	}
+	return build(subject, parsed, string(raw), serverTS, now)
+}
+
+// mapKey renders a non-string map key.
+func mapKey(k interface{}) string {
+	if s, ok := k.(string); ok {
+		return s
+	}
+	return fmt.Sprint(k)
+}
+
+// cborReader decodes CBOR into the types encoding/json produces, except that
+// integers stay int64/uint64 and byte strings []byte.
+type cborReader struct {
+	b   []byte
+	off int
+}
+
+func (d *cborReader) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.b)-d.off) {
+		return nil, errTruncated
+	}
+	out := d.b[d.off : d.off+int(n)]
+	d.off += int(n)
+	return out, nil
+}
+
+// head reads an item's major type, additional info and argument; info 31 is
+// the streaming form of strings, arrays and maps.
+func (d *cborReader) head() (major, info byte, arg uint64, err error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info = b[0]>>5, b[0]&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info == 31:
+		return major, info, 0, nil
+	case info > 27:
+		return 0, 0, 0, fmt.Errorf("reserved additional info %d", info)
+	}
+	v, err := d.next(uint64(1) << (info - 24))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, c := range v {
+		arg = arg<<8 | uint64(c)
+	}
+	return major, info, arg, nil
+}
+
+func (d *cborReader) isBreak() bool {
+	if d.off < len(d.b) && d.b[d.off] == 0xff {
+		d.off++
+		return true
+	}
+	return false
+}
+
+func (d *cborReader) value(depth int) (interface{}, error) {
+	if depth > maxNesting {
+		return nil, errors.New("nested too deep")
+	}
+	major, info, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	indefinite := info == 31
+	switch major {
+	case 0:
+		return arg, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return -float64(arg) - 1, nil
+		}
+		return -int64(arg) - 1, nil
+	case 2, 3:
+		var s []byte
+		if !indefinite {
+			if s, err = d.next(arg); err != nil {
+				return nil, err
+			}
+		}
+		for indefinite && !d.isBreak() {
+			chunk, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch c := chunk.(type) {
+			case string:
+				s = append(s, c...)
+			case []byte:
+				s = append(s, c...)
+			default:
+				return nil, errors.New("bad string chunk")
+			}
+		}
+		if major == 3 {
+			return string(s), nil
+		}
+		return append([]byte(nil), s...), nil
+	case 4:
+		out := []interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite && d.isBreak() {
+				break
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	case 5:
+		out := map[string]interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite && d.isBreak() {
+				break
+			}
+			k, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			out[mapKey(k)] = v
+		}
+		return out, nil
+	case 6:
+		return d.value(depth + 1) // tags (dates, bignums…) are read as their content
+	}
+	switch {
+	case info == 25:
+		return halfFloat(uint16(arg)), nil
+	case info == 26:
+		return float64(math.Float32frombits(uint32(arg))), nil
+	case info == 27:
+		return math.Float64frombits(arg), nil
+	case arg == 20:
+		return false, nil
+	case arg == 21:
+		return true, nil
+	case arg == 22, arg == 23:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported simple value %d", arg)
+}
+
+// halfFloat converts an IEEE 754 half-precision float.
+func halfFloat(h uint16) float64 {
+	exp, frac := int(h>>10)&0x1f, float64(h&0x3ff)
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(frac, -24)
+	case 31:
+		v = math.Inf(1)
+		if frac != 0 {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(frac+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -v
+	}
+	return v
+}
+
+// msgpackReader decodes MessagePack the way cborReader decodes CBOR.
+// Extension types (timestamps included) are read as nil.
+type msgpackReader struct {
+	b   []byte
+	off int
+}
+
+func (d *msgpackReader) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.b)-d.off) {
+		return nil, errTruncated
+	}
+	out := d.b[d.off : d.off+int(n)]
+	d.off += int(n)
+	return out, nil
+}
+
+// uint reads an n-byte big-endian length or number.
+func (d *msgpackReader) uint(n uint64) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *msgpackReader) value(depth int) (interface{}, error) {
+	if depth > maxNesting {
+		return nil, errors.New("nested too deep")
+	}
+	tb, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	t := tb[0]
+	switch {
+	case t <= 0x7f:
+		return uint64(t), nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t <= 0x8f:
+		return d.mapOf(uint64(t&0x0f), depth)
+	case t <= 0x9f:
+		return d.arrayOf(uint64(t&0x0f), depth)
+	case t <= 0xbf:
+		s, err := d.next(uint64(t & 0x1f))
+		return string(s), err
+	}
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6: // bin
+		n, err := d.uint(uint64(1) << (t - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(n)
+		return append([]byte(nil), b...), err
+	case 0xd9, 0xda, 0xdb: // str
+		n, err := d.uint(uint64(1) << (t - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(n)
+		return string(b), err
+	case 0xc7, 0xc8, 0xc9: // ext
+		n, err := d.uint(uint64(1) << (t - 0xc7))
+		if err == nil {
+			_, err = d.next(n + 1)
+		}
+		return nil, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext
+		_, err := d.next(1 + uint64(1)<<(t-0xd4))
+		return nil, err
+	case 0xca:
+		v, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.uint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(uint64(1) << (t - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		b, err := d.next(uint64(1) << (t - 0xd0))
+		if err != nil {
+			return nil, err
+		}
+		switch len(b) {
+		case 1:
+			return int64(int8(b[0])), nil
+		case 2:
+			return int64(int16(binary.BigEndian.Uint16(b))), nil
+		case 4:
+			return int64(int32(binary.BigEndian.Uint32(b))), nil
+		}
+		return int64(binary.BigEndian.Uint64(b)), nil
+	case 0xdc, 0xdd:
+		n, err := d.uint(uint64(2) << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayOf(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(uint64(2) << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapOf(n, depth)
+	}
+	return nil, fmt.Errorf("unsupported type byte 0x%02x", t)
+}
+
+func (d *msgpackReader) arrayOf(n uint64, depth int) (interface{}, error) {
+	if n > uint64(len(d.b)-d.off) { // every element takes a byte at least
+		return nil, errTruncated
+	}
+	out := make([]interface{}, 0, n)
+	for i := uint64(0); i < n; i++ {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func (d *msgpackReader) mapOf(n uint64, depth int) (interface{}, error) {
+	if n > uint64(len(d.b)-d.off) {
+		return nil, errTruncated
+	}
+	out := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		out[mapKey(k)] = v
+	}
+	return out, nil
+}
@@ -0,0 +1,217 @@
+package telem
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Mapping reshapes the points of subjects matching Subject, instead of the
+// default of one flattened "data" level and numbers/bools only. The worker
+// reads them from FIELD_MAPPINGS, a JSON array or a file such as
+//
+//	# mappings.yaml
+//	- subject: telemetry.*.nav
+//	  depth: 2                 # flatten nested objects two levels: pose.position.x
+//	  tags: [frame_id, mode]   # these keys become tags
+//	  strings: true            # keep other strings as fields
+//	  drop: [raw, "debug.*"]
+//	  rename: {pose.position.x: x}
+//
+// Keys are dot-joined paths after the "data" block is merged into the top
+// level as usual; tags and drop take path.Match patterns. Rename applies to
+// tags and fields alike, last.
+type Mapping struct {
+	Subject string            `json:"subject" yaml:"subject"`
+	Depth   int               `json:"depth" yaml:"depth"`
+	Tags    []string          `json:"tags" yaml:"tags"`
+	Strings bool              `json:"strings" yaml:"strings"`
+	Drop    []string          `json:"drop" yaml:"drop"`
+	Rename  map[string]string `json:"rename" yaml:"rename"`
+}
+
+// maxDepth bounds Mapping.Depth.
+const maxDepth = 8
+
+// Mappings are tried in order; the first whose subject matches applies.
+type Mappings []Mapping
+
+var (
+	mappingsMu sync.RWMutex
+	mappings   Mappings
+)
+
+// SetMappings makes ms apply to every Decode from now on.
+func SetMappings(ms Mappings) {
+	mappingsMu.Lock()
+	mappings = ms
+	mappingsMu.Unlock()
+}
+
+// LoadMappings parses mappings given inline as a JSON array, or as the path
+// of a JSON or YAML (.yaml, .yml) file.
+func LoadMappings(s string) (Mappings, error) {
+	var ms Mappings
+	b, isFile := []byte(s), !strings.HasPrefix(strings.TrimSpace(s), "[")
+	if isFile {
+		var err error
+		if b, err = os.ReadFile(s); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if ext := path.Ext(s); isFile && (ext == ".yaml" || ext == ".yml") {
+		err = yaml.Unmarshal(b, &ms)
+	} else {
+		err = json.Unmarshal(b, &ms)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range ms {
+		if m.Subject == "" {
+			return nil, fmt.Errorf("mapping %d: no subject", i)
+		}
+		if m.Depth < 0 || m.Depth > maxDepth {
+			return nil, fmt.Errorf("mapping %s: depth must be 0 to %d", m.Subject, maxDepth)
+		}
+		for _, p := range append(append([]string{}, m.Tags...), m.Drop...) {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("mapping %s: bad pattern %q", m.Subject, p)
+			}
+		}
+	}
+	return ms, nil
+}
+
+func mappingFor(subject string) *Mapping {
+	mappingsMu.RLock()
+	defer mappingsMu.RUnlock()
+	for i := range mappings {
+		if SubjectMatches(mappings[i].Subject, subject) {
+			return &mappings[i]
+		}
+	}
+	return nil
+}
+
+func matchAny(patterns []string, key string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Mapping) name(key string) string {
+	if to, ok := m.Rename[key]; ok {
+		return to
+	}
+	return key
+}
+
+// apply builds the fields and adds the tags for a parsed payload.
+func (m *Mapping) apply(parsed map[string]interface{}, tags map[string]string) map[string]interface{} {
+	flat := map[string]interface{}{}
+	if dv, ok := parsed["data"].(map[string]interface{}); ok {
+		m.flatten(flat, "", dv, 0)
+	}
+	top := map[string]interface{}{}
+	for k, v := range parsed {
+		if k != "data" && k != "topic" && k != "trace_id" && k != "ts_ns" && k != "source" {
+			top[k] = v
+		}
+	}
+	m.flatten(flat, "", top, 0) // top-level keys win, as without a mapping
+
+	fields := map[string]interface{}{}
+	for k, v := range flat {
+		if matchAny(m.Drop, k) {
+			continue
+		}
+		name := m.name(k)
+		if matchAny(m.Tags, k) {
+			if name != "subject" {
+				tags[name] = tagValue(v)
+			}
+			continue
+		}
+		switch vv := v.(type) {
+		case string:
+			if m.Strings {
+				fields[name] = vv
+			}
+		default:
+			if f, ok := fieldValue(v); ok {
+				fields[name] = f
+			}
+		}
+	}
+	return fields
+}
+
+// flatten copies the scalars of src into dst as prefix+key, following nested
+// objects up to m.Depth levels.
+func (m *Mapping) flatten(dst map[string]interface{}, prefix string, src map[string]interface{}, depth int) {
+	for k, v := range src {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			if depth < m.Depth {
+				m.flatten(dst, prefix+k+".", vv, depth+1)
+			}
+		case []interface{}, nil:
+		default:
+			dst[prefix+k] = v
+		}
+	}
+}
+
+// fieldValue converts a number or bool for a field.
+func fieldValue(v interface{}) (interface{}, bool) {
+	switch vv := v.(type) {
+	case float64, bool:
+		return vv, true
+	case int64:
+		return float64(vv), true
+	case uint64:
+		return float64(vv), true
+	case json.Number:
+		f, err := vv.Float64()
+		return f, err == nil
+	}
+	return nil, false
+}
+
+func tagValue(v interface{}) string {
+	switch vv := v.(type) {
+	case string:
+		return vv
+	case float64:
+		return strconv.FormatFloat(vv, 'f', -1, 64)
+	case json.Number:
+		return vv.String()
+	}
+	return fmt.Sprint(v)
+}
+
+// SubjectMatches applies NATS wildcard rules: * is one token, > the rest.
+func SubjectMatches(pattern, subject string) bool {
+	pt := strings.Split(pattern, ".")
+	st := strings.Split(subject, ".")
+	for i, p := range pt {
+		if p == ">" {
+			return len(st) > i
+		}
+		if i >= len(st) || (p != "*" && p != st[i]) {
+			return false
+		}
+	}
+	return len(pt) == len(st)
+}
@@ -0,0 +1,170 @@
+package telem
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// PackField is the field a packed point keeps its samples in. A packed point
+// stands for a run of samples of one series (an IMU at 200 Hz, say): it is
+// stamped with the first sample's time, carries each numeric field's mean
+// over the run under the field's own name, so windowed queries and charts
+// keep working at the run's resolution, and the samples themselves, in
+// full, as a columnar chunk in PackField. /api/ts unpacks them.
+//
+// The chunk is base64 of
+//
+//	version (1) | uvarint n | n varint time deltas in ns, from the point's time
+//	uvarint fields | per field: uvarint len, name, n float64 LE (NaN: no value)
+const PackField = "_pack"
+
+const packVersion = 1
+
+// Pack collects samples of one series.
+type Pack struct {
+	Times  []time.Time
+	Fields map[string][]float64
+}
+
+// Len is the number of samples.
+func (p *Pack) Len() int { return len(p.Times) }
+
+// Add appends a point's numeric and bool fields (bools as 0 and 1); strings
+// such as raw are not packed.
+func (p *Pack) Add(pt Point) {
+	if p.Fields == nil {
+		p.Fields = map[string][]float64{}
+	}
+	n := len(p.Times)
+	p.Times = append(p.Times, pt.Time)
+	for k, v := range pt.Fields {
+		fv, ok := fieldValue(v)
+		if !ok {
+			continue
+		}
+		f, isNum := fv.(float64)
+		if b, _ := fv.(bool); !isNum && b {
+			f = 1
+		}
+		col, ok := p.Fields[k]
+		if !ok {
+			col = make([]float64, n, n+1)
+			for i := range col {
+				col[i] = math.NaN()
+			}
+		}
+		p.Fields[k] = append(col, f)
+	}
+	for k, col := range p.Fields {
+		if len(col) == n {
+			p.Fields[k] = append(col, math.NaN())
+		}
+	}
+}
+
+// Point is the packed point for measurement and tags.
+func (p *Pack) Point(measurement string, tags map[string]string) Point {
+	out := Point{Measurement: measurement, Tags: tags, Fields: map[string]interface{}{PackField: p.Encode()}, Time: p.Times[0]}
+	for k, col := range p.Fields {
+		sum, n := 0.0, 0
+		for _, v := range col {
+			if !math.IsNaN(v) {
+				sum, n = sum+v, n+1
+			}
+		}
+		if n > 0 {
+			out.Fields[k] = sum / float64(n)
+		}
+	}
+	return out
+}
+
+// Encode renders the chunk.
+func (p *Pack) Encode() string {
+	var b []byte
+	b = append(b, packVersion)
+	b = binary.AppendUvarint(b, uint64(len(p.Times)))
+	prev := p.Times[0]
+	for _, t := range p.Times {
+		b = binary.AppendVarint(b, int64(t.Sub(prev)))
+		prev = t
+	}
+	names := make([]string, 0, len(p.Fields))
+	for k := range p.Fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	b = binary.AppendUvarint(b, uint64(len(names)))
+	for _, k := range names {
+		b = binary.AppendUvarint(b, uint64(len(k)))
+		b = append(b, k...)
+		for _, v := range p.Fields[k] {
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+		}
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// maxPack bounds the samples a chunk may claim, against corrupt input.
+const maxPack = 1 << 16
+
+// Unpack reads a chunk stored with a point at t.
+func Unpack(s string, t time.Time) (*Pack, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 || b[0] != packVersion {
+		return nil, errors.New("pack: unknown version")
+	}
+	b = b[1:]
+	uvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, errTruncated
+		}
+		b = b[n:]
+		return v, nil
+	}
+	n, err := uvarint()
+	if err != nil || n == 0 || n > maxPack {
+		return nil, fmt.Errorf("pack: bad length %d", n)
+	}
+	p := &Pack{Times: make([]time.Time, n), Fields: map[string][]float64{}}
+	for i := range p.Times {
+		d, m := binary.Varint(b)
+		if m <= 0 {
+			return nil, fmt.Errorf("pack: %w", errTruncated)
+		}
+		b = b[m:]
+		t = t.Add(time.Duration(d))
+		p.Times[i] = t
+	}
+	fields, err := uvarint()
+	if err != nil {
+		return nil, fmt.Errorf("pack: %w", err)
+	}
+	for ; fields > 0; fields-- {
+		l, err := uvarint()
+		if err != nil || l > uint64(len(b)) {
+			return nil, fmt.Errorf("pack: %w", errTruncated)
+		}
+		name := string(b[:l])
+		b = b[l:]
+		if uint64(len(b)) < 8*n {
+			return nil, fmt.Errorf("pack: %w", errTruncated)
+		}
+		col := make([]float64, n)
+		for i := range col {
+			col[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:]))
+		}
+		b = b[8*n:]
+		p.Fields[name] = col
+	}
+	return p, nil
+}
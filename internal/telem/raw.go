@@ -0,0 +1,76 @@
+package telem
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// RawRule keeps the payload as the "raw" field for subjects matching
+// Subject, on every point or on one in Every. Without a matching rule raw
+// is not stored: a string per point doubles what Influx holds. The worker
+// reads rules from RAW_FIELDS, comma-separated subject[:every]:
+//
+//	RAW_FIELDS=telemetry.*.debug.>,telemetry.*.pose:100
+//
+// keeps raw for debug subjects and one pose in a hundred; ">" keeps it
+// everywhere, as before it was opt-in. A point with no other fields keeps
+// raw regardless, as Influx can't store a point without fields.
+type RawRule struct {
+	Subject string
+	Every   uint64
+
+	seen *atomic.Uint64
+}
+
+// RawRules are tried in order; the first whose subject matches applies.
+type RawRules []RawRule
+
+var (
+	rawMu    sync.RWMutex
+	rawRules RawRules
+)
+
+// SetRaw makes rs apply to every Decode from now on.
+func SetRaw(rs RawRules) {
+	rawMu.Lock()
+	rawRules = rs
+	rawMu.Unlock()
+}
+
+// LoadRaw parses RAW_FIELDS.
+func LoadRaw(s string) (RawRules, error) {
+	var rs RawRules
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		r := RawRule{Subject: part, Every: 1, seen: new(atomic.Uint64)}
+		if i := strings.LastIndexByte(part, ':'); i >= 0 {
+			n, err := strconv.ParseUint(part[i+1:], 10, 32)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("raw %s: keep one in N, N at least 1", part)
+			}
+			r.Subject, r.Every = part[:i], n
+		}
+		if r.Subject == "" {
+			return nil, fmt.Errorf("raw %s: no subject", part)
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// keepRaw reports whether this point of subject keeps its payload.
+func keepRaw(subject string) bool {
+	rawMu.RLock()
+	defer rawMu.RUnlock()
+	for _, r := range rawRules {
+		if SubjectMatches(r.Subject, subject) {
+			return r.Every <= 1 || r.seen == nil || r.seen.Add(1)%r.Every == 1
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+// Package telem turns raw telemetry messages into Influx points. It is the
+// single place that decides which fields, tags and timestamp a message lands
+// with, shared by the worker and the golden-file fixtures.
+package telem
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"time"
+)
+
+// Measurement is the Influx measurement telemetry points are decoded into;
+// internal/layout decides the one they are written to.
+const Measurement = "telemetry"
+
+// ErrBadTimestamp means the message's timestamp is implausible (more than ten
+// years old or a day in the future); retrying it won't help.
+var ErrBadTimestamp = errors.New("bad timestamp")
+
+// Point is the Influx-ready form of one message.
+type Point struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        time.Time              `json:"time"`
+}
+
+// Decode builds the point for a message on subject. serverTS is the JetStream
+// timestamp, used unless the payload carries ts_ns; now bounds plausibility.
+// On ErrBadTimestamp the returned point still carries the offending time.
+func Decode(subject string, data []byte, serverTS, now time.Time) (Point, error) {
+	// parse JSON if possible
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var parsed map[string]interface{}
+	_ = dec.Decode(&parsed)
+	return build(subject, parsed, string(data), serverTS, now)
+}
+
+// build makes the point for a parsed payload; raw is kept as the "raw"
+// field where RAW_FIELDS asks for it (see RawRule).
+func build(subject string, parsed map[string]interface{}, raw string, serverTS, now time.Time) (Point, error) {
+	ts := serverTS
+
+	// consider ts_ns override
+	if v, ok := asInt64(parsed["ts_ns"]); ok && v > 0 {
+		ts = UnixAnyToTime(v)
+	}
+
+	p := Point{Measurement: Measurement, Time: ts}
+	if ts.Before(now.AddDate(-10, 0, 0)) || ts.After(now.Add(24*time.Hour)) {
+		return p, ErrBadTimestamp
+	}
+
+	subject = TrimFormat(subject)
+	p.Tags = map[string]string{
+		"subject": subject,
+	}
+	if tv, ok := parsed["topic"].(string); ok && tv != "" {
+		p.Tags["topic"] = tv
+	}
+	// data not measured by a robot (weather, ...) says where it came from
+	if src, ok := parsed["source"].(string); ok && src != "" {
+		p.Tags["source"] = src
+	}
+	m := mappingFor(subject)
+	if m != nil {
+		p.Fields = m.apply(parsed, p.Tags)
+	} else {
+		p.Fields = extractFields(parsed)
+	}
+	if keepRaw(subject) || len(p.Fields) == 0 {
+		if m == nil {
+			p.Fields["raw"] = raw
+		} else if !matchAny(m.Drop, "raw") {
+			p.Fields[m.name("raw")] = raw
+		}
+	}
+	return p, nil
+}
+
+// UnixAnyToTime interprets an epoch timestamp in s, ms, µs or ns.
+func UnixAnyToTime(ts int64) time.Time {
+	// Heuristics: current epoch in...
+	//   s  ~ 1e9
+	//   ms ~ 1e12
+	//   µs ~ 1e15
+	//   ns ~ 1e18
+	switch {
+	case ts >= 1e17: // nanoseconds
+		return time.Unix(0, ts)
+	case ts >= 1e14: // microseconds
+		return time.Unix(0, ts*1_000)
+	case ts >= 1e11: // milliseconds
+		return time.Unix(0, ts*1_000_000)
+	default: // seconds
+		return time.Unix(ts, 0)
+	}
+}
+
+type anyMap = map[string]interface{}
+
+func asInt64(v interface{}) (int64, bool) {
+	switch t := v.(type) {
+	case float64:
+		// JSON numbers are float64; only treat as int if it's an integer
+		if math.Trunc(t) == t {
+			return int64(t), true
+		}
+	case int64:
+		return t, true
+	case uint64:
+		if t <= math.MaxInt64 {
+			return int64(t), true
+		}
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// flatten one level of { "data": { ... } } into fields
+func extractFields(m anyMap) map[string]interface{} {
+	fields := map[string]interface{}{}
+	// prefer "data" block for numeric/bool fields
+	if dv, ok := m["data"].(map[string]interface{}); ok {
+		for k, v := range dv {
+			if f, ok := fieldValue(v); ok {
+				fields[k] = f
+			}
+		}
+	}
+	// also allow top-level numeric/bool fields
+	for k, v := range m {
+		if k == "data" || k == "topic" || k == "trace_id" || k == "ts_ns" {
+			continue
+		}
+		if f, ok := fieldValue(v); ok {
+			fields[k] = f
+		}
+	}
+	return fields
+}
+
+// RobotID returns the {id} token of a telemetry.{id}.… subject.
+func RobotID(subject string) string {
+	parts := strings.SplitN(subject, ".", 3)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
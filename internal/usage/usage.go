@@ -0,0 +1,139 @@
+// Package usage meters what the backend itself consumes per tenant (Influx
+// points written, bytes served), for cost reports. The gateway and the
+// worker each count in memory and add their counts to the USAGE bucket every
+// flush, keyed {month}.{metric}.{tenant}, so any number of replicas can meter
+// at once.
+package usage
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Bucket holds the monthly totals.
+const Bucket = "USAGE"
+
+// Metrics.
+const (
+	PointsWritten = "influx_points"
+	EgressBytes   = "egress_bytes"
+)
+
+// Month is the key prefix for t's month, in UTC.
+func Month(t time.Time) string { return t.UTC().Format("2006-01") }
+
+// Meter counts usage and flushes it to the bucket.
+type Meter struct {
+	kv nats.KeyValue
+
+	mu      sync.Mutex
+	pending map[string]float64 // key → count since the last flush
+}
+
+// Open binds to the USAGE bucket, creating it on first use.
+func Open(js nats.JetStreamContext) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: Bucket, History: 1, Storage: nats.FileStorage, TTL: 400 * 24 * time.Hour})
+	}
+	return kv, err
+}
+
+// NewMeter returns a meter flushing into kv.
+func NewMeter(kv nats.KeyValue) *Meter {
+	return &Meter{kv: kv, pending: map[string]float64{}}
+}
+
+// Add counts n of metric for tenant ("" counts as "default").
+func (m *Meter) Add(metric, tenant string, n float64) {
+	if tenant == "" {
+		tenant = "default"
+	}
+	key := Month(time.Now()) + "." + metric + "." + tenant
+	m.mu.Lock()
+	m.pending[key] += n
+	m.mu.Unlock()
+}
+
+// Run flushes every interval, for good.
+func (m *Meter) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		m.Flush()
+	}
+}
+
+// Flush adds pending counts to the bucket; what fails is kept for the next
+// flush.
+func (m *Meter) Flush() {
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = map[string]float64{}
+	m.mu.Unlock()
+	for key, n := range pending {
+		if err := m.add(key, n); err != nil {
+			log.Printf("usage: flush %s: %v", key, err)
+			m.mu.Lock()
+			m.pending[key] += n
+			m.mu.Unlock()
+		}
+	}
+}
+
+// add adds n to the count at key, retrying when another replica got there
+// first.
+func (m *Meter) add(key string, n float64) error {
+	for {
+		var total float64
+		var rev uint64
+		e, err := m.kv.Get(key)
+		switch {
+		case err == nil:
+			if total, err = strconv.ParseFloat(string(e.Value()), 64); err != nil {
+				return err
+			}
+			rev = e.Revision()
+		case !errors.Is(err, nats.ErrKeyNotFound):
+			return err
+		}
+		b := []byte(strconv.FormatFloat(total+n, 'f', -1, 64))
+		if rev == 0 {
+			_, err = m.kv.Create(key, b)
+		} else {
+			_, err = m.kv.Update(key, b, rev)
+		}
+		if !errors.Is(err, nats.ErrKeyExists) { // ErrKeyExists also covers a stale revision
+			return err
+		}
+	}
+}
+
+// Totals reads month's counts as metric → tenant → count.
+func Totals(kv nats.KeyValue, month string) (map[string]map[string]float64, error) {
+	out := map[string]map[string]float64{}
+	w, err := kv.Watch(month+".>", nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+	for e := range w.Updates() {
+		if e == nil {
+			break
+		}
+		parts := strings.SplitN(e.Key(), ".", 3)
+		n, err := strconv.ParseFloat(string(e.Value()), 64)
+		if len(parts) != 3 || err != nil {
+			continue
+		}
+		if out[parts[1]] == nil {
+			out[parts[1]] = map[string]float64{}
+		}
+		out[parts[1]][parts[2]] = n
+	}
+	return out, nil
+}
@@ -0,0 +1,171 @@
+// Package wasm runs user-supplied WebAssembly transforms on telemetry points,
+// for customers who can't ship a Go plugin. The gateway validates and stores
+// modules; the worker loads them and applies them at ingest.
+//
+// A module exports its memory as "memory" and
+//
+//	alloc(size i32) i32
+//	transform(ptr i32, len i32) i64
+//
+// The host writes the point as JSON (the telem.Point shape) into memory from
+// alloc and calls transform, which returns (out_ptr << 32 | out_len) locating
+// the rewritten point's JSON, or 0 to drop it. WASI preview 1 is available
+// so TinyGo and Rust builds work; there is no filesystem, network or clock
+// beyond what WASI stubs provide.
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Buckets: module metadata lives in KV, binaries in an object store.
+const (
+	MetaBucket   = "WASM_MODULES"
+	ObjectBucket = "WASM_BINARIES"
+)
+
+// Meta describes an uploaded module. Modules run in ascending Order.
+type Meta struct {
+	Name        string    `json:"name"`
+	SHA256      string    `json:"sha256"`
+	Size        int       `json:"size"`
+	Order       int       `json:"order"`
+	Enabled     bool      `json:"enabled"`
+	TimeoutMs   int       `json:"timeout_ms"`
+	MemoryPages uint32    `json:"memory_pages"` // 64 KiB each
+	Uploaded    time.Time `json:"uploaded"`
+	Actor       string    `json:"actor,omitempty"`
+}
+
+// Defaults and ceilings for the per-module limits.
+const (
+	DefaultTimeoutMs   = 5
+	MaxTimeoutMs       = 100
+	DefaultMemoryPages = 16 // 1 MiB
+	MaxMemoryPages     = 256
+)
+
+// Normalize fills defaults and clamps limits to the ceilings.
+func (m *Meta) Normalize() {
+	if m.TimeoutMs <= 0 {
+		m.TimeoutMs = DefaultTimeoutMs
+	}
+	if m.TimeoutMs > MaxTimeoutMs {
+		m.TimeoutMs = MaxTimeoutMs
+	}
+	if m.MemoryPages == 0 {
+		m.MemoryPages = DefaultMemoryPages
+	}
+	if m.MemoryPages > MaxMemoryPages {
+		m.MemoryPages = MaxMemoryPages
+	}
+}
+
+// ErrTimeout means a call ran past the module's time budget.
+var ErrTimeout = errors.New("wasm: transform timed out")
+
+// Module is one compiled transform with its own runtime, so memory limits are
+// per module. Calls are serialized.
+type Module struct {
+	meta    Meta
+	timeout time.Duration
+	rt      wazero.Runtime
+	code    wazero.CompiledModule
+
+	mu   sync.Mutex
+	inst api.Module
+}
+
+// Compile checks the binary exports the ABI and prepares it to run.
+func Compile(ctx context.Context, bin []byte, meta Meta) (*Module, error) {
+	meta.Normalize()
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(meta.MemoryPages).
+		WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, rt); err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	code, err := rt.CompileModule(ctx, bin)
+	if err != nil {
+		rt.Close(ctx)
+		return nil, fmt.Errorf("wasm: compile: %w", err)
+	}
+	exports := code.ExportedFunctions()
+	for _, name := range []string{"alloc", "transform"} {
+		if _, ok := exports[name]; !ok {
+			rt.Close(ctx)
+			return nil, fmt.Errorf("wasm: module does not export %q", name)
+		}
+	}
+	if _, ok := code.ExportedMemories()["memory"]; !ok {
+		rt.Close(ctx)
+		return nil, errors.New(`wasm: module does not export "memory"`)
+	}
+	return &Module{meta: meta, timeout: time.Duration(meta.TimeoutMs) * time.Millisecond, rt: rt, code: code}, nil
+}
+
+// Meta returns the module's normalized metadata.
+func (m *Module) Meta() Meta { return m.meta }
+
+// Close releases the runtime.
+func (m *Module) Close(ctx context.Context) error { return m.rt.Close(ctx) }
+
+// Transform runs the module on in (point JSON). A nil result with a nil error
+// means the module dropped the point.
+func (m *Module) Transform(in []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	// an instance closed by a timeout or trap is replaced on the next call
+	if m.inst == nil || m.inst.IsClosed() {
+		mod, err := m.rt.InstantiateModule(context.Background(), m.code, wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+		if err != nil {
+			return nil, fmt.Errorf("wasm: instantiate: %w", err)
+		}
+		m.inst = mod
+	}
+
+	res, err := m.inst.ExportedFunction("alloc").Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, m.callErr(ctx, err)
+	}
+	ptr := uint32(res[0])
+	if !m.inst.Memory().Write(ptr, in) {
+		return nil, errors.New("wasm: alloc returned out-of-range pointer")
+	}
+	res, err = m.inst.ExportedFunction("transform").Call(ctx, uint64(ptr), uint64(len(in)))
+	if err != nil {
+		return nil, m.callErr(ctx, err)
+	}
+	if res[0] == 0 {
+		return nil, nil
+	}
+	outPtr, outLen := uint32(res[0]>>32), uint32(res[0])
+	out, ok := m.inst.Memory().Read(outPtr, outLen)
+	if !ok {
+		return nil, errors.New("wasm: transform returned out-of-range result")
+	}
+	// memory is reused by the next call
+	return append([]byte(nil), out...), nil
+}
+
+func (m *Module) callErr(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	// a trap can leave the instance in any state; start fresh next time
+	m.inst.Close(context.Background())
+	return fmt.Errorf("wasm: %w", err)
+}
@@ -0,0 +1,195 @@
+// Package wave stores high-frequency signals (motor currents, vibration,
+// audio-rate sensors) as chunks of samples in a NATS object store instead of
+// as Influx points: at 1 kHz, fifty robots would be fifty thousand points a
+// second per channel. Robots publish frames, runs of evenly spaced samples
+// per channel:
+//
+//	{"ts_ns":1718000000000000000,"rate_hz":1000,"channels":{"current_a":[…],"current_b":[…]}}
+//
+// (ts_ns is the first sample's time, the JetStream timestamp without it;
+// every channel holds the same number of samples). The worker joins a
+// subject's consecutive frames into chunks of about WAVE_CHUNK, stores each
+// channel's samples as an object and indexes it with a point in Influx
+// (Measurement); the gateway's /api/waveform finds chunks by the index and
+// reassembles them, decimated to what a chart can show.
+package wave
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/nats-io/nats.go"
+)
+
+// ObjectBucket holds one object per chunk and channel, named by ObjectName.
+const ObjectBucket = "WAVEFORMS"
+
+// Measurement is the Influx measurement of the chunk index: one point per
+// chunk and channel, stamped with the chunk's first sample, tagged subject
+// and channel, with fields object (the object's name), rate_hz, samples,
+// min, max and mean.
+const Measurement = "waveform_chunks"
+
+// MaxRate bounds a frame's sample rate.
+const MaxRate = 1e6
+
+// Frame is one message of samples.
+type Frame struct {
+	Start    time.Time
+	Rate     float64
+	Channels map[string][]float64
+}
+
+// Len is the number of samples per channel.
+func (f Frame) Len() int {
+	for _, c := range f.Channels {
+		return len(c)
+	}
+	return 0
+}
+
+// ParseFrame reads a frame; serverTS is its start without ts_ns.
+func ParseFrame(data []byte, serverTS time.Time) (Frame, error) {
+	var in struct {
+		TS       *int64               `json:"ts_ns"`
+		Rate     float64              `json:"rate_hz"`
+		Channels map[string][]float64 `json:"channels"`
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return Frame{}, fmt.Errorf("wave frame: %w", err)
+	}
+	f := Frame{Start: serverTS, Rate: in.Rate, Channels: in.Channels}
+	if in.TS != nil && *in.TS > 0 {
+		f.Start = telem.UnixAnyToTime(*in.TS)
+	}
+	if f.Rate <= 0 || f.Rate > MaxRate {
+		return Frame{}, fmt.Errorf("wave frame: rate_hz must be above 0 and at most %g", MaxRate)
+	}
+	if len(f.Channels) == 0 {
+		return Frame{}, errors.New("wave frame: no channels")
+	}
+	n := f.Len()
+	for name, c := range f.Channels {
+		if len(c) != n || n == 0 {
+			return Frame{}, fmt.Errorf("wave frame: channel %s: every channel needs the same, non-zero number of samples", name)
+		}
+	}
+	return f, nil
+}
+
+// Chunk is one channel's samples over consecutive frames.
+type Chunk struct {
+	Start   time.Time
+	Rate    float64
+	Samples []float32
+}
+
+// End is when the sample after the last would be.
+func (c Chunk) End() time.Time {
+	return c.Start.Add(c.Period() * time.Duration(len(c.Samples)))
+}
+
+// Period is the time between samples.
+func (c Chunk) Period() time.Duration {
+	return time.Duration(float64(time.Second) / c.Rate)
+}
+
+// At is the time of sample i.
+func (c Chunk) At(i int) time.Time {
+	return c.Start.Add(time.Duration(float64(i) * float64(time.Second) / c.Rate))
+}
+
+// ObjectName names a channel's chunk of subject starting at start.
+func ObjectName(subject, channel string, start time.Time) string {
+	return fmt.Sprintf("%s/%s/%d", subject, channel, start.UnixNano())
+}
+
+const chunkVersion = 1
+
+// Encode renders c as stored:
+//
+//	version (1) | start, int64 ns LE | rate, float64 LE | samples, float32 LE…
+func (c Chunk) Encode() []byte {
+	b := make([]byte, 0, 17+4*len(c.Samples))
+	b = append(b, chunkVersion)
+	b = binary.LittleEndian.AppendUint64(b, uint64(c.Start.UnixNano()))
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(c.Rate))
+	for _, v := range c.Samples {
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(v))
+	}
+	return b
+}
+
+// Decode reads a stored chunk.
+func Decode(b []byte) (Chunk, error) {
+	if len(b) < 17 || b[0] != chunkVersion || (len(b)-17)%4 != 0 {
+		return Chunk{}, errors.New("wave: not a chunk")
+	}
+	c := Chunk{Start: time.Unix(0, int64(binary.LittleEndian.Uint64(b[1:]))),
+		Rate: math.Float64frombits(binary.LittleEndian.Uint64(b[9:]))}
+	c.Samples = make([]float32, (len(b)-17)/4)
+	for i := range c.Samples {
+		c.Samples[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[17+4*i:]))
+	}
+	return c, nil
+}
+
+// Stats are a chunk's min, max and mean, for its index point.
+func (c Chunk) Stats() (lo, hi, mean float64) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	for _, v := range c.Samples {
+		f := float64(v)
+		lo, hi, mean = math.Min(lo, f), math.Max(hi, f), mean+f
+	}
+	return lo, hi, mean / float64(len(c.Samples))
+}
+
+// Bucket is a span of samples reduced to its extremes, so decimation keeps
+// spikes a mean would flatten.
+type Bucket struct {
+	T   time.Time `json:"t"`
+	Min float64   `json:"min"`
+	Max float64   `json:"max"`
+}
+
+// Decimate reduces the samples of chunks (in time order) within [from, to)
+// to at most n buckets of equal duration; empty buckets are left out.
+func Decimate(chunks []Chunk, from, to time.Time, n int) []Bucket {
+	span := to.Sub(from) / time.Duration(n)
+	if span <= 0 {
+		span = 1
+	}
+	var out []Bucket
+	for _, c := range chunks {
+		for i, v := range c.Samples {
+			t := c.At(i)
+			if t.Before(from) || !t.Before(to) {
+				continue
+			}
+			bt := from.Add(t.Sub(from) / span * span)
+			f := float64(v)
+			if len(out) > 0 && out[len(out)-1].T.Equal(bt) {
+				b := &out[len(out)-1]
+				b.Min, b.Max = math.Min(b.Min, f), math.Max(b.Max, f)
+				continue
+			}
+			out = append(out, Bucket{T: bt, Min: f, Max: f})
+		}
+	}
+	return out
+}
+
+// Open binds to the object store, creating it on first use. Chunks expire
+// after retention (0 keeps them).
+func Open(js nats.JetStreamContext, retention time.Duration) (nats.ObjectStore, error) {
+	obj, err := js.ObjectStore(ObjectBucket)
+	if errors.Is(err, nats.ErrStreamNotFound) || errors.Is(err, nats.ErrBucketNotFound) {
+		obj, err = js.CreateObjectStore(&nats.ObjectStoreConfig{Bucket: ObjectBucket, TTL: retention, Storage: nats.FileStorage})
+	}
+	return obj, err
+}
@@ -0,0 +1,140 @@
+package worker
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/latency"
+	"github.com/VazRibeiro/evabot-backend/internal/usage"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/nats-io/nats.go"
+)
+
+// queued is a message's points (one per layout written) waiting for their
+// batch, with the message to settle once the batch is written. A packed
+// point settles every message of its run.
+type queued struct {
+	msgs   []*nats.Msg
+	robot  string
+	points []*write.Point
+	sent   time.Time // the (first) message's ts_ns, zero without one
+}
+
+// batcher writes points to one Influx writer in batches of up to size, or
+// whatever has arrived every interval, and only then acks their messages: a
+// batch that fails transiently is nakked whole and redelivered, except for
+// messages on their last delivery, which are dead-lettered.
+type batcher struct {
+	w        api.WriteAPIBlocking
+	size     int
+	interval time.Duration
+	in       chan queued
+	wm       *workerMetrics
+	outs     *outcomes
+	dlq      *deadLetters
+	route    *router
+	meter    *usage.Meter
+	lat      *latency.Recorder
+}
+
+func newBatcher(w api.WriteAPIBlocking, size int, interval time.Duration, wm *workerMetrics, outs *outcomes, dlq *deadLetters, route *router, meter *usage.Meter, lat *latency.Recorder) *batcher {
+	return &batcher{w: w, size: size, interval: interval, in: make(chan queued, size), wm: wm, outs: outs, dlq: dlq, route: route, meter: meter, lat: lat}
+}
+
+// add queues q; false means the worker is stopping and q's message is left
+// for redelivery.
+func (b *batcher) add(ctx context.Context, q queued) bool {
+	select {
+	case b.in <- q:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// run collects and writes batches until ctx is done, then writes what is
+// left.
+func (b *batcher) run(ctx context.Context) {
+	t := time.NewTicker(b.interval)
+	defer t.Stop()
+	batch := make([]queued, 0, b.size)
+	for {
+		select {
+		case q := <-b.in:
+			if batch = append(batch, q); len(batch) < b.size {
+				continue
+			}
+		case <-t.C:
+		case <-ctx.Done():
+			for {
+				select {
+				case q := <-b.in:
+					batch = append(batch, q)
+				default:
+					b.flush(batch)
+					return
+				}
+			}
+		}
+		b.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+func (b *batcher) flush(batch []queued) {
+	if len(batch) == 0 {
+		return
+	}
+	points := make([]*write.Point, 0, len(batch))
+	for _, q := range batch {
+		points = append(points, q.points...)
+	}
+	start := time.Now()
+	err := b.w.WritePoint(context.Background(), points...)
+	b.wm.writeSeconds.Observe(time.Since(start).Seconds())
+	b.wm.batchPoints.Observe(float64(len(points)))
+	switch {
+	case err == nil:
+		now := time.Now()
+		for _, q := range batch {
+			b.meter.Add(usage.PointsWritten, b.route.tenant(q.robot), float64(len(q.points)))
+			b.lat.Observe(q.robot, q.sent, now)
+			for _, msg := range q.msgs {
+				b.outs.count(q.robot, outcomeStored)
+				b.wm.ack(msg)
+			}
+		}
+		b.wm.lastStored.Set(float64(time.Now().Unix()))
+	case unsalvageable(err) && len(batch) > 1:
+		// find the points Influx won't take by writing one at a time;
+		// rewriting the good ones is harmless
+		for i := range batch {
+			b.flush(batch[i : i+1])
+		}
+	case unsalvageable(err):
+		// Influx says this point can never be accepted: ack it so it doesn't loop.
+		q := batch[0]
+		logger.Printf("drop unsalvageable point (%s): %v", q.points[0].Time().Format(time.RFC3339Nano), err)
+		b.wm.writeErrors.Inc("unsalvageable")
+		for _, msg := range q.msgs {
+			b.outs.count(q.robot, outcomeUnsalvageable)
+			b.wm.ack(msg)
+		}
+	default:
+		// Otherwise it's likely transient (network, etc): let JetStream retry.
+		logger.Printf("influx write error, %d points (will retry): %v", len(batch), err)
+		b.wm.writeErrors.Inc("transient")
+		for _, q := range batch {
+			for _, msg := range q.msgs {
+				b.dlq.fail(b.wm, msg, err)
+			}
+		}
+	}
+}
+
+func unsalvageable(err error) bool {
+	return strings.Contains(err.Error(), "outside retention policy") ||
+		strings.Contains(err.Error(), "unprocessable entity")
+}
@@ -0,0 +1,138 @@
+package worker
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cardinalityGuard keeps track of the tag sets (series) the worker has written
+// and refuses to create more than maxNew new series per window, or more than
+// maxSeries in total. Messages that would create a refused series are
+// quarantined instead of written, so a robot publishing on ever-changing
+// subjects or topics can't explode Influx's series index.
+type cardinalityGuard struct {
+	maxNew    int
+	maxSeries int
+	window    time.Duration
+	ttl       time.Duration // forget series not seen for this long
+
+	mu          sync.Mutex
+	series      map[string]time.Time // series key → last seen
+	tagValues   map[string]map[string]struct{}
+	windowStart time.Time
+	newInWindow int
+	refused     int64
+	lastSweep   time.Time
+}
+
+func newCardinalityGuard(maxNew, maxSeries int, window, ttl time.Duration) *cardinalityGuard {
+	return &cardinalityGuard{
+		maxNew:    maxNew,
+		maxSeries: maxSeries,
+		window:    window,
+		ttl:       ttl,
+		series:    map[string]time.Time{},
+		tagValues: map[string]map[string]struct{}{},
+	}
+}
+
+func seriesKey(measurement string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(measurement)
+	for _, k := range keys {
+		b.WriteString("," + k + "=" + tags[k])
+	}
+	return b.String()
+}
+
+// admit reports whether a point with these tags may be written.
+func (g *cardinalityGuard) admit(measurement string, tags map[string]string, now time.Time) bool {
+	key := seriesKey(measurement, tags)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now.Sub(g.lastSweep) > g.ttl/10 {
+		g.sweep(now)
+	}
+	if _, ok := g.series[key]; ok {
+		g.series[key] = now
+		return true
+	}
+
+	if now.Sub(g.windowStart) >= g.window {
+		g.windowStart, g.newInWindow = now, 0
+	}
+	if (g.maxNew > 0 && g.newInWindow >= g.maxNew) || (g.maxSeries > 0 && len(g.series) >= g.maxSeries) {
+		g.refused++
+		return false
+	}
+	g.newInWindow++
+	g.series[key] = now
+	for k, v := range tags {
+		if g.tagValues[k] == nil {
+			g.tagValues[k] = map[string]struct{}{}
+		}
+		g.tagValues[k][v] = struct{}{}
+	}
+	return true
+}
+
+func (g *cardinalityGuard) sweep(now time.Time) {
+	g.lastSweep = now
+	expired := false
+	for k, seen := range g.series {
+		if now.Sub(seen) > g.ttl {
+			delete(g.series, k)
+			expired = true
+		}
+	}
+	if !expired {
+		return
+	}
+	// rebuild per-tag value sets from what's left
+	g.tagValues = map[string]map[string]struct{}{}
+	for k := range g.series {
+		for _, kv := range strings.Split(k, ",")[1:] {
+			tag, val, _ := strings.Cut(kv, "=")
+			if g.tagValues[tag] == nil {
+				g.tagValues[tag] = map[string]struct{}{}
+			}
+			g.tagValues[tag][val] = struct{}{}
+		}
+	}
+}
+
+type cardinalityStats struct {
+	Series      int            `json:"series"`
+	MaxSeries   int            `json:"max_series"`
+	NewInWindow int            `json:"new_in_window"`
+	MaxNew      int            `json:"max_new_per_window"`
+	Window      string         `json:"window"`
+	Refused     int64          `json:"refused_total"`
+	TagValues   map[string]int `json:"tag_values"` // tag key → distinct values
+}
+
+func (g *cardinalityGuard) stats() cardinalityStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := cardinalityStats{
+		Series:      len(g.series),
+		MaxSeries:   g.maxSeries,
+		NewInWindow: g.newInWindow,
+		MaxNew:      g.maxNew,
+		Window:      g.window.String(),
+		Refused:     g.refused,
+		TagValues:   map[string]int{},
+	}
+	for k, vals := range g.tagValues {
+		s.TagValues[k] = len(vals)
+	}
+	return s
+}
@@ -0,0 +1,93 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/plugin"
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+)
+
+// ingestChain is the configured decode → transform path for a message.
+//
+//	DECODERS='[{"subject":"telemetry.*.can","decoder":"acme-can"},
+//	           {"subject":"telemetry.*.pose","decoder":"protobuf","config":{"message":"evabot.v1.Pose"}}]'
+//	TRANSFORMS='[{"name":"drop_fields","config":{"fields":["debug"]}}]'
+//
+// A Content-Type header or subject suffix naming CBOR or MessagePack picks
+// that format's decoder (see telem.FormatOf); otherwise the first route whose
+// subject pattern matches picks the decoder, and anything unrouted is JSON,
+// or CBOR/MessagePack if it starts like a map in those. Transforms run in order, then
+// any WASM modules uploaded through the gateway.
+type ingestChain struct {
+	routes     []decoderRoute
+	transforms []plugin.Transform
+	wasm       *wasmTransforms // nil when WASM transforms are off
+}
+
+type decoderRoute struct {
+	Subject string          `json:"subject"`
+	Decoder string          `json:"decoder"`
+	Config  json.RawMessage `json:"config"` // for configurable decoders
+	dec     plugin.Decoder
+}
+
+func newIngestChain(decoders, transforms string) (*ingestChain, error) {
+	c := &ingestChain{}
+	var err error
+	if decoders != "" {
+		if err := json.Unmarshal([]byte(decoders), &c.routes); err != nil {
+			return nil, fmt.Errorf("bad DECODERS: %w", err)
+		}
+		for i := range c.routes {
+			if c.routes[i].dec, err = plugin.NewDecoder(c.routes[i].Decoder, c.routes[i].Config); err != nil {
+				return nil, fmt.Errorf("DECODERS %s: %w", c.routes[i].Subject, err)
+			}
+		}
+	}
+	if transforms != "" {
+		var specs []struct {
+			Name   string          `json:"name"`
+			Config json.RawMessage `json:"config"`
+		}
+		if err := json.Unmarshal([]byte(transforms), &specs); err != nil {
+			return nil, fmt.Errorf("bad TRANSFORMS: %w", err)
+		}
+		for _, s := range specs {
+			t, err := plugin.NewTransform(s.Name, s.Config)
+			if err != nil {
+				return nil, err
+			}
+			c.transforms = append(c.transforms, t)
+		}
+	}
+	return c, nil
+}
+
+// decode decodes a message; contentType is its Content-Type header, if any.
+func (c *ingestChain) decode(subject, contentType string, data []byte, serverTS, now time.Time) (telem.Point, error) {
+	if telem.FormatOf(contentType, subject, nil) != telem.FormatJSON {
+		return telem.DecodeAny(subject, contentType, data, serverTS, now)
+	}
+	for _, r := range c.routes {
+		if telem.SubjectMatches(r.Subject, subject) {
+			return r.dec.Decode(subject, data, serverTS, now)
+		}
+	}
+	return telem.DecodeAny(subject, contentType, data, serverTS, now)
+}
+
+// transform runs every transform; false means a transform dropped the point.
+func (c *ingestChain) transform(p *telem.Point) (bool, error) {
+	for _, t := range c.transforms {
+		keep, err := t.Transform(p)
+		if err != nil || !keep {
+			return false, err
+		}
+	}
+	if c.wasm != nil {
+		return c.wasm.apply(p)
+	}
+	return true, nil
+}
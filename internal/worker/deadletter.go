@@ -0,0 +1,104 @@
+package worker
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// maxDeliver is how often JetStream offers the worker a message.
+const maxDeliver = 3
+
+// deadLetters keeps messages the worker gave up on in the TELEMETRY_DLQ
+// stream (created by the gateway), on dlq.{original subject minus
+// "telemetry."} with the payload unchanged and why in headers, so they can
+// be looked at and replayed after a fix (GET /api/dlq on the gateway).
+// A message is dead-lettered when its last delivery fails, when JetStream
+// reports it ran out of deliveries without an answer (the worker died or
+// hung on it), or at once when it fails its schema (internal/schemareg).
+type deadLetters struct {
+	nc *nats.Conn
+	js nats.JetStreamContext
+}
+
+// final reports whether msg is on its last delivery.
+func final(msg *nats.Msg) bool {
+	md, err := msg.Metadata()
+	return err == nil && md.NumDelivered >= maxDeliver
+}
+
+func (d *deadLetters) put(subject string, data []byte, published time.Time, seq, deliveries uint64, reason string) error {
+	out := nats.NewMsg("dlq." + strings.TrimPrefix(subject, "telemetry."))
+	out.Data = data
+	out.Header.Set("Original-Subject", subject)
+	out.Header.Set("Original-Seq", strconv.FormatUint(seq, 10))
+	out.Header.Set("Original-Time", published.UTC().Format(time.RFC3339Nano))
+	out.Header.Set("Dlq-Error", reason)
+	out.Header.Set("Dlq-Deliveries", strconv.FormatUint(deliveries, 10))
+	out.Header.Set("Dlq-Worker", instance)
+	_, err := d.js.PublishMsg(out)
+	return err
+}
+
+// fail settles a message the worker couldn't handle: nak for another try,
+// or, on its last delivery, dead-letter and ack it.
+func (d *deadLetters) fail(wm *workerMetrics, msg *nats.Msg, err error) {
+	if !final(msg) {
+		wm.nak(msg)
+		return
+	}
+	md, _ := msg.Metadata()
+	if derr := d.put(msg.Subject, msg.Data, md.Timestamp, md.Sequence.Stream, md.NumDelivered, err.Error()); derr != nil {
+		logger.Printf("dead-letter %s (seq %d) failed, dropped: %v", msg.Subject, md.Sequence.Stream, derr)
+		wm.nak(msg)
+		return
+	}
+	logger.Printf("dead-lettered %s (seq %d) after %d deliveries: %v", msg.Subject, md.Sequence.Stream, md.NumDelivered, err)
+	wm.deadLettered.Inc()
+	wm.ack(msg)
+}
+
+// reject dead-letters a message that can't be stored as it is, such as one
+// failing its schema, without waiting for redeliveries.
+func (d *deadLetters) reject(wm *workerMetrics, msg *nats.Msg, reason string) {
+	md, err := msg.Metadata()
+	if err == nil {
+		err = d.put(msg.Subject, msg.Data, md.Timestamp, md.Sequence.Stream, md.NumDelivered, reason)
+	}
+	if err != nil {
+		logger.Printf("dead-letter %s failed, will retry: %v", msg.Subject, err)
+		wm.nak(msg)
+		return
+	}
+	wm.deadLettered.Inc()
+	wm.ack(msg)
+}
+
+// watchAdvisories dead-letters messages JetStream stopped delivering
+// without an ack. Replicas share the advisories as a queue group.
+func (d *deadLetters) watchAdvisories(wm *workerMetrics) error {
+	_, err := d.nc.QueueSubscribe("$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES.TELEMETRY."+consumer, consumer+"-dlq", func(m *nats.Msg) {
+		var adv struct {
+			StreamSeq  uint64 `json:"stream_seq"`
+			Deliveries uint64 `json:"deliveries"`
+		}
+		if err := json.Unmarshal(m.Data, &adv); err != nil || adv.StreamSeq == 0 {
+			return
+		}
+		orig, err := d.js.GetMsg("TELEMETRY", adv.StreamSeq)
+		if err != nil {
+			logger.Printf("dead-letter seq %d: %v", adv.StreamSeq, err)
+			return
+		}
+		if err := d.put(orig.Subject, orig.Data, orig.Time, adv.StreamSeq, adv.Deliveries, "max deliveries reached without an ack"); err != nil {
+			logger.Printf("dead-letter seq %d: %v", adv.StreamSeq, err)
+			return
+		}
+		logger.Printf("dead-lettered %s (seq %d): no ack after %d deliveries", orig.Subject, adv.StreamSeq, adv.Deliveries)
+		wm.deadLettered.Inc()
+	})
+	return err
+}
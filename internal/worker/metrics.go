@@ -0,0 +1,61 @@
+package worker
+
+import (
+	"github.com/VazRibeiro/evabot-backend/internal/metrics"
+	"github.com/nats-io/nats.go"
+)
+
+// workerMetrics are the worker's series on /metrics (WORKER_BIND), labeled
+// with the worker's instance. An
+// ingestion stall shows as evabot_worker_consumer_pending growing while
+// evabot_worker_last_stored_timestamp_seconds stands still.
+type workerMetrics struct {
+	writeSeconds *metrics.Histogram
+	batchPoints  *metrics.Histogram
+	writeErrors  *metrics.Counter // by kind: transient (retried) or unsalvageable
+	replies      *metrics.Counter // by reply: ack or nak
+	outcomes     *metrics.Counter // by outcome, as in pipeline_outcomes
+	lastStored   *metrics.Gauge
+	deadLettered *metrics.Counter
+	schemaFails  *metrics.Counter // by mode: enforce (dead-lettered) or warn (stored)
+}
+
+func newWorkerMetrics(nc *nats.Conn, js nats.JetStreamContext, reg *metrics.Registry) *workerMetrics {
+	m := &workerMetrics{
+		writeSeconds: reg.NewHistogram("evabot_worker_influx_write_seconds", "Time to write one batch of points to Influx.", metrics.DefBuckets),
+		batchPoints: reg.NewHistogram("evabot_worker_influx_batch_points", "Points per Influx write.",
+			[]float64{1, 10, 50, 100, 250, 500, 1000, 5000}),
+		writeErrors:  reg.NewCounter("evabot_worker_influx_write_errors_total", "Failed Influx writes.", "kind"),
+		replies:      reg.NewCounter("evabot_worker_consumer_replies_total", "Acks and naks sent on the telem-worker consumer.", "reply"),
+		outcomes:     reg.NewCounter("evabot_worker_messages_total", "Telemetry messages by outcome.", "outcome"),
+		deadLettered: reg.NewCounter("evabot_worker_dead_lettered_total", "Messages moved to TELEMETRY_DLQ."),
+		schemaFails:  reg.NewCounter("evabot_worker_schema_failures_total", "Messages failing a telemetry schema.", "mode"),
+		lastStored:   reg.NewGauge("evabot_worker_last_stored_timestamp_seconds", "When a point was last written to Influx (Unix time)."),
+	}
+	reg.NewCounterFunc("evabot_worker_nats_in_msgs_total", "Messages the worker received from NATS.",
+		func() float64 { return float64(nc.Stats().InMsgs) })
+	consumer := func(field func(*nats.ConsumerInfo) uint64) func() float64 {
+		return func() float64 {
+			info, err := js.ConsumerInfo("TELEMETRY", consumer)
+			if err != nil {
+				return 0
+			}
+			return float64(field(info))
+		}
+	}
+	reg.NewGaugeFunc("evabot_worker_consumer_pending", "TELEMETRY messages not yet delivered to the worker.",
+		consumer(func(i *nats.ConsumerInfo) uint64 { return i.NumPending }))
+	reg.NewGaugeFunc("evabot_worker_consumer_ack_pending", "Messages delivered to the worker but not yet acked.",
+		consumer(func(i *nats.ConsumerInfo) uint64 { return uint64(i.NumAckPending) }))
+	return m
+}
+
+func (m *workerMetrics) ack(msg *nats.Msg) {
+	m.replies.Inc("ack")
+	_ = msg.Ack()
+}
+
+func (m *workerMetrics) nak(msg *nats.Msg) {
+	m.replies.Inc("nak")
+	_ = msg.Nak()
+}
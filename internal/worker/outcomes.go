@@ -0,0 +1,132 @@
+package worker
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/metrics"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Every message the worker handles ends in exactly one of these outcomes.
+const (
+	outcomeStored        = "stored"
+	outcomeDeduped       = "deduped"
+	outcomeQuarantined   = "quarantined"
+	outcomeInvalid       = "dead_lettered_invalid"
+	outcomeTransformed   = "dropped_transform"
+	outcomeBadTS         = "dropped_bad_ts"
+	outcomeRateLimit     = "dropped_rate_limit"
+	outcomeQuota         = "dropped_quota"
+	outcomeUnsalvageable = "dropped_unsalvageable"
+)
+
+// outcomeMeasurement holds one point per robot and outcome per flush period
+// and worker, with the count for that period, so losses can be accounted for
+// after the fact.
+const outcomeMeasurement = "pipeline_outcomes"
+
+// outcomes counts message outcomes per robot. Counts accumulate in memory and
+// are flushed to Influx every interval; a failed flush is retried with the
+// next one so no period is lost.
+type outcomes struct {
+	total *metrics.Counter // by outcome, for /metrics
+
+	mu      sync.Mutex
+	pending map[string]map[string]int64 // robot → outcome → count since last flush
+	totals  map[string]map[string]int64 // since process start
+}
+
+func newOutcomes(total *metrics.Counter) *outcomes {
+	return &outcomes{total: total, pending: map[string]map[string]int64{}, totals: map[string]map[string]int64{}}
+}
+
+func (o *outcomes) count(robot, outcome string) {
+	o.total.Inc(outcome)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, m := range []map[string]map[string]int64{o.pending, o.totals} {
+		if m[robot] == nil {
+			m[robot] = map[string]int64{}
+		}
+		m[robot][outcome]++
+	}
+}
+
+// run flushes pending counts every interval until ctx is done.
+func (o *outcomes) run(ctx context.Context, w api.WriteAPIBlocking, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			o.flush(ctx, w, now)
+		}
+	}
+}
+
+func (o *outcomes) flush(ctx context.Context, w api.WriteAPIBlocking, now time.Time) {
+	o.mu.Lock()
+	pending := o.pending
+	o.pending = map[string]map[string]int64{}
+	o.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	if w == nil {
+		for robot, m := range pending {
+			logger.Printf("outcomes %s: %v", robot, m)
+		}
+		return
+	}
+
+	var points []*write.Point
+	for robot, m := range pending {
+		for outcome, n := range m {
+			points = append(points, influxdb2.NewPoint(outcomeMeasurement,
+				map[string]string{"robot": robot, "outcome": outcome, "worker": instance},
+				map[string]interface{}{"count": n}, now))
+		}
+	}
+	if err := w.WritePoint(ctx, points...); err != nil {
+		logger.Printf("outcome flush failed, keeping counts: %v", err)
+		o.mu.Lock()
+		for robot, m := range pending {
+			if o.pending[robot] == nil {
+				o.pending[robot] = map[string]int64{}
+			}
+			for outcome, n := range m {
+				o.pending[robot][outcome] += n
+			}
+		}
+		o.mu.Unlock()
+	}
+}
+
+type outcomeRow struct {
+	Robot    string           `json:"robot"`
+	Outcomes map[string]int64 `json:"outcomes"`
+}
+
+// snapshot returns the totals since start, sorted by robot.
+func (o *outcomes) snapshot() []outcomeRow {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	out := make([]outcomeRow, 0, len(o.totals))
+	for robot, m := range o.totals {
+		c := make(map[string]int64, len(m))
+		for k, v := range m {
+			c[k] = v
+		}
+		out = append(out, outcomeRow{Robot: robot, Outcomes: c})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Robot < out[j].Robot })
+	return out
+}
@@ -0,0 +1,141 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/nats-io/nats.go"
+)
+
+// packRule packs runs of every samples of subjects matching subject.
+type packRule struct {
+	subject string
+	every   int
+}
+
+// maxPackRun bounds PACK_FIELDS' run length.
+const maxPackRun = 10000
+
+// packer turns runs of samples of high-rate numeric channels into one
+// packed point each (telem.PackField), cutting the points written by the
+// run length. PACK_FIELDS lists subject:samples pairs, comma-separated:
+//
+//	PACK_FIELDS=telemetry.*.imu:50,telemetry.*.wheel_odom:20
+//
+// A run is written when it is full, or once its first sample has waited
+// PACK_MAX_AGE (default 5s), whichever is first; its messages are acked
+// with it. A worker that stops leaves the messages of unfinished runs
+// unacked, for redelivery.
+type packer struct {
+	rules  []packRule
+	maxAge time.Duration
+	route  *router
+	store  func(telem.Point, queued)
+
+	mu   sync.Mutex
+	runs map[string]*packRun // series →
+}
+
+type packRun struct {
+	every   int
+	started time.Time
+	p       telem.Point // the first sample: measurement and tags
+	pack    telem.Pack
+	q       queued
+}
+
+func newPacker(config string, maxAge time.Duration, route *router, store func(telem.Point, queued)) (*packer, error) {
+	k := &packer{maxAge: maxAge, route: route, store: store, runs: map[string]*packRun{}}
+	for _, part := range strings.Split(config, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		i := strings.LastIndexByte(part, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("PACK_FIELDS: %s: want subject:samples", part)
+		}
+		n, err := strconv.Atoi(part[i+1:])
+		if err != nil || n < 2 || n > maxPackRun {
+			return nil, fmt.Errorf("PACK_FIELDS: %s: samples must be 2 to %d", part, maxPackRun)
+		}
+		k.rules = append(k.rules, packRule{subject: part[:i], every: n})
+	}
+	if len(k.rules) > 0 {
+		logger.Printf("packing %d subject patterns, runs written after at most %s", len(k.rules), maxAge)
+	}
+	return k, nil
+}
+
+// add puts p into its series' run, storing the run once it is full; false
+// means p's subject isn't packed and msg is the caller's to settle. sent is
+// p's ts_ns, as in queued.
+func (k *packer) add(p telem.Point, msg *nats.Msg, robot string, sent time.Time) bool {
+	every := 0
+	for _, r := range k.rules {
+		if telem.SubjectMatches(r.subject, p.Tags["subject"]) {
+			every = r.every
+			break
+		}
+	}
+	if every == 0 {
+		return false
+	}
+	if w, _ := k.route.writer(robot); w == nil {
+		return false // nothing to save
+	}
+	key := seriesKey(p.Measurement, p.Tags)
+	k.mu.Lock()
+	run := k.runs[key]
+	if run == nil {
+		run = &packRun{every: every, started: time.Now(), p: p, q: queued{robot: robot, sent: sent}}
+		k.runs[key] = run
+	}
+	run.pack.Add(p)
+	run.q.msgs = append(run.q.msgs, msg)
+	full := run.pack.Len() >= run.every
+	if full {
+		delete(k.runs, key)
+	}
+	k.mu.Unlock()
+	if full {
+		k.write(run)
+	}
+	return true
+}
+
+func (k *packer) write(run *packRun) {
+	k.store(run.pack.Point(run.p.Measurement, run.p.Tags), run.q)
+}
+
+// run writes runs that have waited maxAge, until ctx is done.
+func (k *packer) run(ctx context.Context) {
+	if len(k.rules) == 0 {
+		return
+	}
+	t := time.NewTicker(k.maxAge / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			var due []*packRun
+			k.mu.Lock()
+			for key, run := range k.runs {
+				if now.Sub(run.started) >= k.maxAge {
+					due = append(due, run)
+					delete(k.runs, key)
+				}
+			}
+			k.mu.Unlock()
+			for _, run := range due {
+				k.write(run)
+			}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package worker
+
+import (
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// quarantine republishes messages the worker refuses to store onto
+// quarantine.{original subject minus "telemetry."}, kept in the QUARANTINE
+// stream for inspection or replay.
+type quarantine struct {
+	js nats.JetStreamContext
+}
+
+func newQuarantine(js nats.JetStreamContext) (*quarantine, error) {
+	_, err := js.AddStream(&nats.StreamConfig{Name: "QUARANTINE", Subjects: []string{"quarantine.>"}, Storage: nats.FileStorage, MaxAge: 14 * 24 * time.Hour})
+	if err != nil && err != nats.ErrStreamNameAlreadyInUse {
+		return nil, err
+	}
+	return &quarantine{js: js}, nil
+}
+
+func (q *quarantine) divert(msg *nats.Msg, reason string) error {
+	out := nats.NewMsg("quarantine." + strings.TrimPrefix(msg.Subject, "telemetry."))
+	out.Data = msg.Data
+	out.Header.Set("Original-Subject", msg.Subject)
+	out.Header.Set("Quarantine-Reason", reason)
+	_, err := q.js.PublishMsg(out)
+	return err
+}
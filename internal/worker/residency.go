@@ -0,0 +1,92 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/VazRibeiro/evabot-backend/internal/residency"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/nats-io/nats.go"
+)
+
+// router picks the Influx writer for a robot's points: its tenant's region,
+// or the default writer. Robot tenants are followed from the ROBOTS bucket.
+type router struct {
+	cfg     *residency.Config
+	def     api.WriteAPIBlocking
+	writers map[string]api.WriteAPIBlocking
+	clients []influxdb2.Client
+
+	mu      sync.RWMutex
+	tenants map[string]string // robot → tenant
+}
+
+func newRouter(js nats.JetStreamContext, cfg *residency.Config, def api.WriteAPIBlocking) (*router, error) {
+	r := &router{cfg: cfg, def: def, writers: map[string]api.WriteAPIBlocking{}, tenants: map[string]string{}}
+	for _, name := range cfg.Names() {
+		reg := cfg.Regions[name]
+		c := influxdb2.NewClient(reg.URL, reg.Token)
+		r.clients = append(r.clients, c)
+		r.writers[name] = c.WriteAPIBlocking(reg.Org, reg.Bucket)
+		logger.Printf("Influx region %s → %s (org=%s bucket=%s)", name, reg.URL, reg.Org, reg.Bucket)
+	}
+	// tenants are followed for usage metering too, but only pinned ones
+	// make the bucket a must
+	kv, err := js.KeyValue("ROBOTS")
+	if err != nil && len(cfg.Tenants) == 0 {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ROBOTS bucket (created by the gateway): %w", err)
+	}
+	w, err := kv.WatchAll()
+	if err != nil {
+		return nil, err
+	}
+	ready := make(chan struct{})
+	go func() {
+		for e := range w.Updates() {
+			if e == nil {
+				close(ready)
+				continue
+			}
+			var rec struct {
+				Tenant string `json:"tenant"`
+			}
+			r.mu.Lock()
+			if e.Operation() == nats.KeyValuePut && json.Unmarshal(e.Value(), &rec) == nil && rec.Tenant != "" {
+				r.tenants[e.Key()] = rec.Tenant
+			} else {
+				delete(r.tenants, e.Key())
+			}
+			r.mu.Unlock()
+		}
+	}()
+	// route nothing until every robot's tenant is known
+	<-ready
+	return r, nil
+}
+
+// tenant returns robot's tenant, "" if it has none.
+func (r *router) tenant(robot string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.tenants[robot]
+}
+
+// writer returns where robot's points go; nil means the default instance
+// isn't configured (log only). A pinned robot never gets the default writer.
+func (r *router) writer(robot string) (api.WriteAPIBlocking, string) {
+	if region := r.cfg.RegionOf(r.tenant(robot)); region != "" {
+		return r.writers[region], region
+	}
+	return r.def, ""
+}
+
+func (r *router) close() {
+	for _, c := range r.clients {
+		c.Close()
+	}
+}
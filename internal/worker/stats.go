@@ -0,0 +1,41 @@
+package worker
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/VazRibeiro/evabot-backend/internal/metrics"
+	"github.com/VazRibeiro/evabot-backend/internal/plugin"
+)
+
+// serveStats exposes the worker's internal counters over HTTP (WORKER_BIND),
+// as JSON and for Prometheus on /metrics.
+func serveStats(addr string, guard *cardinalityGuard, outs *outcomes, wasmT *wasmTransforms) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(204) })
+	mux.Handle("/metrics", metrics.Default.Handler())
+	mux.HandleFunc("/stats/cardinality", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, guard.stats())
+	})
+	mux.HandleFunc("/stats/outcomes", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, outs.snapshot())
+	})
+	mux.HandleFunc("/stats/plugins", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, plugin.Registered())
+	})
+	mux.HandleFunc("/stats/wasm", func(w http.ResponseWriter, _ *http.Request) {
+		if wasmT == nil {
+			writeJSON(w, []wasmStats{})
+			return
+		}
+		writeJSON(w, wasmT.snapshot())
+	})
+	logger.Printf("worker stats on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
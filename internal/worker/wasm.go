@@ -0,0 +1,194 @@
+package worker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/VazRibeiro/evabot-backend/internal/wasm"
+	"github.com/nats-io/nats.go"
+)
+
+// wasmTransforms follows the modules uploaded through the gateway's admin API
+// and runs the enabled ones, in order, after the plugin transforms.
+type wasmTransforms struct {
+	js  nats.JetStreamContext
+	obj nats.ObjectStore
+
+	mu   sync.RWMutex
+	mods map[string]*wasmEntry
+}
+
+type wasmEntry struct {
+	mod   *wasm.Module
+	stats wasmStats
+}
+
+// wasmStats are per-module counters, exposed on /stats/wasm.
+type wasmStats struct {
+	Name     string    `json:"name"`
+	Order    int       `json:"order"`
+	SHA256   string    `json:"sha256"`
+	Loaded   time.Time `json:"loaded"`
+	Calls    int64     `json:"calls"`
+	Dropped  int64     `json:"dropped"`
+	Errors   int64     `json:"errors"`
+	Timeouts int64     `json:"timeouts"`
+	TotalNs  int64     `json:"total_ns"`
+	MaxNs    int64     `json:"max_ns"`
+}
+
+func newWasmTransforms(js nats.JetStreamContext) (*wasmTransforms, error) {
+	kv, err := js.KeyValue(wasm.MetaBucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: wasm.MetaBucket, Storage: nats.FileStorage})
+	}
+	if err != nil {
+		return nil, err
+	}
+	obj, err := js.ObjectStore(wasm.ObjectBucket)
+	if errors.Is(err, nats.ErrStreamNotFound) || errors.Is(err, nats.ErrBucketNotFound) {
+		obj, err = js.CreateObjectStore(&nats.ObjectStoreConfig{Bucket: wasm.ObjectBucket, Storage: nats.FileStorage})
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &wasmTransforms{js: js, obj: obj, mods: map[string]*wasmEntry{}}
+
+	w, err := kv.WatchAll()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for e := range w.Updates() {
+			if e == nil {
+				continue
+			}
+			var meta wasm.Meta
+			if e.Operation() != nats.KeyValuePut || json.Unmarshal(e.Value(), &meta) != nil || !meta.Enabled {
+				t.unload(e.Key())
+				continue
+			}
+			if err := t.load(meta); err != nil {
+				logger.Printf("wasm %s: not loaded: %v", meta.Name, err)
+				t.unload(e.Key())
+			}
+		}
+	}()
+	return t, nil
+}
+
+func (t *wasmTransforms) load(meta wasm.Meta) error {
+	bin, err := t.obj.GetBytes(meta.Name)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(bin)
+	if hex.EncodeToString(sum[:]) != meta.SHA256 {
+		return errors.New("binary does not match its recorded sha256")
+	}
+	mod, err := wasm.Compile(context.Background(), bin, meta)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	old := t.mods[meta.Name]
+	t.mods[meta.Name] = &wasmEntry{mod: mod, stats: wasmStats{Name: meta.Name, Order: meta.Order, SHA256: meta.SHA256, Loaded: time.Now()}}
+	t.mu.Unlock()
+	if old != nil {
+		old.mod.Close(context.Background())
+	}
+	logger.Printf("wasm %s loaded (order=%d timeout=%dms memory=%d pages)", meta.Name, meta.Order, mod.Meta().TimeoutMs, mod.Meta().MemoryPages)
+	return nil
+}
+
+func (t *wasmTransforms) unload(name string) {
+	t.mu.Lock()
+	old := t.mods[name]
+	delete(t.mods, name)
+	t.mu.Unlock()
+	if old != nil {
+		old.mod.Close(context.Background())
+		logger.Printf("wasm %s unloaded", name)
+	}
+}
+
+func (t *wasmTransforms) ordered() []*wasmEntry {
+	out := make([]*wasmEntry, 0, len(t.mods))
+	for _, e := range t.mods {
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].stats.Order != out[j].stats.Order {
+			return out[i].stats.Order < out[j].stats.Order
+		}
+		return out[i].stats.Name < out[j].stats.Name
+	})
+	return out
+}
+
+// apply runs every loaded module on p; false means a module dropped it.
+func (t *wasmTransforms) apply(p *telem.Point) (bool, error) {
+	t.mu.RLock()
+	mods := t.ordered()
+	t.mu.RUnlock()
+
+	for _, e := range mods {
+		in, err := json.Marshal(p)
+		if err != nil {
+			return false, err
+		}
+		start := time.Now()
+		out, err := e.mod.Transform(in)
+		took := time.Since(start).Nanoseconds()
+
+		t.mu.Lock()
+		e.stats.Calls++
+		e.stats.TotalNs += took
+		if took > e.stats.MaxNs {
+			e.stats.MaxNs = took
+		}
+		switch {
+		case errors.Is(err, wasm.ErrTimeout):
+			e.stats.Timeouts++
+		case err != nil:
+			e.stats.Errors++
+		case out == nil:
+			e.stats.Dropped++
+		}
+		t.mu.Unlock()
+
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", e.stats.Name, err)
+		}
+		if out == nil {
+			return false, nil
+		}
+		next := telem.Point{Measurement: p.Measurement, Time: p.Time}
+		if err := json.Unmarshal(out, &next); err != nil {
+			t.mu.Lock()
+			e.stats.Errors++
+			t.mu.Unlock()
+			return false, fmt.Errorf("%s: bad output: %w", e.stats.Name, err)
+		}
+		*p = next
+	}
+	return true, nil
+}
+
+func (t *wasmTransforms) snapshot() []wasmStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	out := []wasmStats{}
+	for _, e := range t.ordered() {
+		out = append(out, e.stats)
+	}
+	return out
+}
@@ -0,0 +1,197 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/VazRibeiro/evabot-backend/internal/wave"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/nats-io/nats.go"
+)
+
+// waveStore joins the frames of subjects matching WAVE_SUBJECTS
+// (comma-separated patterns, e.g. telemetry.*.wave.>) into chunks of about
+// WAVE_CHUNK (default 1s), stored in the WAVEFORMS object store with their
+// index points queued like any others (see internal/wave). A chunk ends
+// early on a gap, a change of rate or channels, or when its first frame has
+// waited twice WAVE_CHUNK; its messages are acked once its index is written.
+type waveStore struct {
+	subjects []string
+	chunk    time.Duration
+	obj      nats.ObjectStore
+	wm       *workerMetrics
+	dlq      *deadLetters
+	queue    func(queued) bool
+
+	mu   sync.Mutex
+	runs map[string]*waveRun // subject →
+}
+
+type waveRun struct {
+	robot    string
+	subject  string
+	started  time.Time // wall clock, for aging
+	channels map[string]*wave.Chunk
+	msgs     []*nats.Msg
+}
+
+func newWaveStore(js nats.JetStreamContext, subjects string, chunk, retention time.Duration, wm *workerMetrics, dlq *deadLetters, queue func(queued) bool) (*waveStore, error) {
+	s := &waveStore{chunk: chunk, wm: wm, dlq: dlq, queue: queue, runs: map[string]*waveRun{}}
+	for _, p := range strings.Split(subjects, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			s.subjects = append(s.subjects, p)
+		}
+	}
+	if len(s.subjects) == 0 {
+		return s, nil
+	}
+	var err error
+	if s.obj, err = wave.Open(js, retention); err != nil {
+		return nil, err
+	}
+	logger.Printf("waveforms: %d subject patterns, chunks of %s", len(s.subjects), chunk)
+	return s, nil
+}
+
+func (s *waveStore) matches(subject string) bool {
+	for _, p := range s.subjects {
+		if telem.SubjectMatches(p, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// add puts a frame into its subject's chunk. false means the subject isn't
+// a waveform's and msg is the caller's to settle; an error, that the frame
+// can't be read.
+func (s *waveStore) add(msg *nats.Msg, robot string, ts time.Time) (bool, error) {
+	subject := telem.TrimFormat(msg.Subject)
+	if !s.matches(subject) {
+		return false, nil
+	}
+	f, err := wave.ParseFrame(msg.Data, ts)
+	if err != nil {
+		return true, err
+	}
+	var done []*waveRun
+	s.mu.Lock()
+	run := s.runs[subject]
+	if run != nil && !run.continues(f) {
+		done = append(done, run)
+		run = nil
+	}
+	if run == nil {
+		run = &waveRun{robot: robot, subject: subject, started: time.Now(), channels: map[string]*wave.Chunk{}}
+		for name := range f.Channels {
+			run.channels[name] = &wave.Chunk{Start: f.Start, Rate: f.Rate}
+		}
+		s.runs[subject] = run
+	}
+	for name, samples := range f.Channels {
+		c := run.channels[name]
+		for _, v := range samples {
+			c.Samples = append(c.Samples, float32(v))
+		}
+	}
+	run.msgs = append(run.msgs, msg)
+	if run.length() >= s.chunk {
+		done = append(done, run)
+		delete(s.runs, subject)
+	}
+	s.mu.Unlock()
+	for _, r := range done {
+		s.write(r)
+	}
+	return true, nil
+}
+
+// continues reports whether f carries on where the run ends: same channels
+// and rate, starting within half a sample of the run's end.
+func (r *waveRun) continues(f wave.Frame) bool {
+	if len(f.Channels) != len(r.channels) {
+		return false
+	}
+	var c *wave.Chunk
+	for name := range f.Channels {
+		if c = r.channels[name]; c == nil {
+			return false
+		}
+	}
+	gap := f.Start.Sub(c.End())
+	return f.Rate == c.Rate && gap < c.Period()/2 && gap > -c.Period()/2
+}
+
+func (r *waveRun) length() time.Duration {
+	for _, c := range r.channels {
+		return c.End().Sub(c.Start)
+	}
+	return 0
+}
+
+// write stores a run's chunks and queues their index points with its
+// messages.
+func (s *waveStore) write(r *waveRun) {
+	names := make([]string, 0, len(r.channels))
+	for name := range r.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	q := queued{msgs: r.msgs, robot: r.robot}
+	for _, name := range names {
+		c := r.channels[name]
+		object := wave.ObjectName(r.subject, name, c.Start)
+		if _, err := s.obj.PutBytes(object, c.Encode()); err != nil {
+			logger.Printf("waveform %s: store chunk: %v", object, err)
+			for _, msg := range r.msgs {
+				s.dlq.fail(s.wm, msg, err)
+			}
+			return
+		}
+		lo, hi, mean := c.Stats()
+		q.points = append(q.points, influxdb2.NewPoint(wave.Measurement,
+			map[string]string{"subject": r.subject, "channel": name},
+			map[string]interface{}{"object": object, "rate_hz": c.Rate, "samples": len(c.Samples), "min": lo, "max": hi, "mean": mean},
+			c.Start))
+	}
+	if !s.queue(q) {
+		for _, msg := range r.msgs {
+			fmt.Printf("waveform %s: %d channels from %s\n", msg.Subject, len(names), r.channels[names[0]].Start.Format(time.RFC3339Nano))
+			s.wm.ack(msg)
+		}
+	}
+}
+
+// run writes chunks whose first frame has waited twice the chunk length,
+// until ctx is done.
+func (s *waveStore) run(ctx context.Context) {
+	if len(s.subjects) == 0 {
+		return
+	}
+	t := time.NewTicker(s.chunk / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			var due []*waveRun
+			s.mu.Lock()
+			for subject, r := range s.runs {
+				if now.Sub(r.started) >= 2*s.chunk {
+					due = append(due, r)
+					delete(s.runs, subject)
+				}
+			}
+			s.mu.Unlock()
+			for _, r := range due {
+				s.write(r)
+			}
+		}
+	}
+}
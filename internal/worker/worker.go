@@ -0,0 +1,400 @@
+// Package worker is the telemetry ingest worker: it drains the TELEMETRY
+// stream into Influx, guarding series cardinality and counting per-robot
+// outcomes. cmd/telem_worker runs it standalone; the gateway's all-in-one
+// mode runs it in-process.
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/latency"
+	"github.com/VazRibeiro/evabot-backend/internal/layout"
+	"github.com/VazRibeiro/evabot-backend/internal/metrics"
+	"github.com/VazRibeiro/evabot-backend/internal/protodec"
+	"github.com/VazRibeiro/evabot-backend/internal/residency"
+	"github.com/VazRibeiro/evabot-backend/internal/schemareg"
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/VazRibeiro/evabot-backend/internal/usage"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/nats-io/nats.go"
+)
+
+// instance names this worker replica (WORKER_INSTANCE, default the host
+// name); it prefixes the worker's log lines and labels its metrics.
+var (
+	instance = "worker"
+	logger   = log.Default()
+)
+
+// consumer is the durable consumer worker replicas share as a queue group,
+// so each message goes to one of them.
+const consumer = "telem-worker"
+
+func getenv(k, def string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return def
+}
+
+func getenvInt(k string, def int) int {
+	if v := os.Getenv(k); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("bad %s: %v", k, err)
+		}
+		return n
+	}
+	return def
+}
+
+func getenvDuration(k string, def time.Duration) time.Duration {
+	if v := os.Getenv(k); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("bad %s: %v", k, err)
+		}
+		return d
+	}
+	return def
+}
+
+// ackWait is how long JetStream waits for the worker to settle a message
+// before redelivering it; a batch must be written well within it.
+const ackWait = 30 * time.Second
+
+// Run consumes TELEMETRY through the durable "telem-worker" consumer and
+// writes it to Influx until ctx is done. Settings come from the environment.
+// Any number of workers can run: they share the consumer's messages.
+// Points are written in batches of INFLUX_BATCH_SIZE (default 500), or every
+// INFLUX_FLUSH_INTERVAL (default 1s) when traffic is light, and messages are
+// acked only after their batch is written.
+func Run(ctx context.Context, nc *nats.Conn) error {
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	instance = getenv("WORKER_INSTANCE", host)
+	logger = log.New(log.Writer(), "["+instance+"] ", log.Flags()|log.Lmsgprefix)
+
+	// --- Influx ---
+	influxURL := getenv("INFLUX_URL", "http://127.0.0.1:8086")
+	influxOrg := getenv("INFLUX_ORG", "r4f")
+	influxBucket := getenv("INFLUX_BUCKET", "telemetry_raw")
+	influxToken := os.Getenv("INFLUX_TOKEN")
+
+	var write api.WriteAPIBlocking
+	var influxClient influxdb2.Client
+	if influxToken != "" {
+		influxClient = influxdb2.NewClient(influxURL, influxToken)
+		defer influxClient.Close()
+		write = influxClient.WriteAPIBlocking(influxOrg, influxBucket)
+		logger.Printf("Influx enabled → %s (org=%s bucket=%s)", influxURL, influxOrg, influxBucket)
+	} else {
+		logger.Printf("Influx disabled (no INFLUX_TOKEN). Will just log.")
+	}
+
+	// --- Per-tenant data residency (internal/residency) ---
+	res, err := residency.Load(os.Getenv("INFLUX_REGIONS"), os.Getenv("TENANT_REGIONS"))
+	if err != nil {
+		return err
+	}
+	route, err := newRouter(js, res, write)
+	if err != nil {
+		return err
+	}
+	defer route.close()
+
+	// --- Decoders and transforms (internal/plugin) ---
+	if paths := os.Getenv("PROTO_DESCRIPTORS"); paths != "" {
+		if err := protodec.Load(strings.Split(paths, ",")...); err != nil {
+			return fmt.Errorf("PROTO_DESCRIPTORS: %w", err)
+		}
+		logger.Printf("protobuf descriptors loaded: %d message types", len(protodec.Messages()))
+	}
+	chain, err := newIngestChain(os.Getenv("DECODERS"), os.Getenv("TRANSFORMS"))
+	if err != nil {
+		return err
+	}
+	if s := os.Getenv("FIELD_MAPPINGS"); s != "" {
+		ms, err := telem.LoadMappings(s)
+		if err != nil {
+			return fmt.Errorf("FIELD_MAPPINGS: %w", err)
+		}
+		telem.SetMappings(ms)
+		logger.Printf("field mappings: %d subject patterns", len(ms))
+	}
+	if s := os.Getenv("RAW_FIELDS"); s != "" {
+		rs, err := telem.LoadRaw(s)
+		if err != nil {
+			return fmt.Errorf("RAW_FIELDS: %w", err)
+		}
+		telem.SetRaw(rs)
+		logger.Printf("raw payloads kept for %d subject patterns", len(rs))
+	}
+	if getenv("WASM_TRANSFORMS", "on") != "off" {
+		if chain.wasm, err = newWasmTransforms(js); err != nil {
+			return err
+		}
+	}
+
+	// --- Influx layout, dual-written during a change (internal/layout) ---
+	layouts, err := layout.Open(js)
+	if err != nil {
+		return err
+	}
+	if st := layouts.State(); st.Phase() != "stable" {
+		logger.Printf("layout %s: writing %d layouts", st.Phase(), len(st.Writes()))
+	}
+
+	// --- Payload schemas (internal/schemareg) ---
+	schemaKV, err := schemareg.Open(js)
+	if err != nil {
+		return err
+	}
+	schemas, err := schemareg.Watch(schemaKV, logger.Printf)
+	if err != nil {
+		return err
+	}
+
+	// --- Cardinality guard ---
+	quar, err := newQuarantine(js)
+	if err != nil {
+		return err
+	}
+	guard := newCardinalityGuard(
+		getenvInt("CARDINALITY_MAX_NEW", 500),
+		getenvInt("CARDINALITY_MAX_SERIES", 100000),
+		getenvDuration("CARDINALITY_WINDOW", time.Minute),
+		getenvDuration("CARDINALITY_TTL", 24*time.Hour),
+	)
+	wm := newWorkerMetrics(nc, js, metrics.Default.With("worker", instance))
+	dlq := &deadLetters{nc: nc, js: js}
+	if err := dlq.watchAdvisories(wm); err != nil {
+		return err
+	}
+	outs := newOutcomes(wm.outcomes)
+	go outs.run(ctx, write, getenvDuration("OUTCOME_FLUSH", time.Minute))
+	go serveStats(getenv("WORKER_BIND", ":8081"), guard, outs, chain.wasm)
+
+	// --- Batched Influx writes, one batcher per instance ---
+	batchSize := getenvInt("INFLUX_BATCH_SIZE", 500)
+	flushInterval := getenvDuration("INFLUX_FLUSH_INTERVAL", time.Second)
+	if batchSize < 1 || flushInterval <= 0 || flushInterval > ackWait/2 {
+		return fmt.Errorf("INFLUX_BATCH_SIZE must be at least 1 and INFLUX_FLUSH_INTERVAL between 0 and %s", ackWait/2)
+	}
+	usageKV, err := usage.Open(js)
+	if err != nil {
+		return err
+	}
+	meter := usage.NewMeter(usageKV)
+	go meter.Run(time.Minute)
+	defer meter.Flush()
+
+	// --- Publish→persisted latency (internal/latency) ---
+	latencyKV, err := latency.Open(js)
+	if err != nil {
+		return err
+	}
+	clock, err := latency.WatchClock(js)
+	if err != nil {
+		return err
+	}
+	lat := latency.NewRecorder(latencyKV, clock, latency.Persisted, instance)
+	go lat.Run(time.Minute)
+	defer lat.Flush()
+
+	batches := map[string]*batcher{}
+	if write != nil {
+		batches[""] = newBatcher(write, batchSize, flushInterval, wm, outs, dlq, route, meter, lat)
+	}
+	for region, w := range route.writers {
+		batches[region] = newBatcher(w, batchSize, flushInterval, wm, outs, dlq, route, meter, lat)
+	}
+	for _, b := range batches {
+		go b.run(ctx)
+	}
+
+	// queue hands q to its robot's batch; false means there is no Influx
+	// to write to
+	queue := func(q queued) bool {
+		w, region := route.writer(q.robot)
+		if w != nil {
+			// acked (or nakked) once its batch is written
+			batches[region].add(ctx, q)
+		}
+		return w != nil
+	}
+
+	// store lays p out, guards its series and queues it for its batch, for
+	// the messages in q
+	store := func(p telem.Point, q queued) {
+		// one point per layout written: two while a layout change dual-writes
+		admitted := true
+		for _, l := range layouts.State().Writes() {
+			lp := l.Apply(p)
+			if admitted = guard.admit(lp.Measurement, lp.Tags, time.Now()); !admitted {
+				break
+			}
+			q.points = append(q.points, influxdb2.NewPoint(lp.Measurement, lp.Tags, lp.Fields, lp.Time))
+		}
+		if !admitted {
+			for _, msg := range q.msgs {
+				if err := quar.divert(msg, "cardinality"); err != nil {
+					logger.Printf("quarantine error: %v", err)
+					dlq.fail(wm, msg, err)
+					continue
+				}
+				logger.Printf("quarantined new series over cardinality budget (subject=%s)", msg.Subject)
+				outs.count(q.robot, outcomeQuarantined)
+				wm.ack(msg)
+			}
+			return
+		}
+
+		if queue(q) {
+			return
+		}
+		for _, msg := range q.msgs {
+			fmt.Printf("telemetry %s @ %s: %s\n", msg.Subject, p.Time.Format(time.RFC3339Nano), msg.Data)
+			wm.ack(msg)
+		}
+	}
+
+	// --- Waveforms: chunks in an object store, indexed in Influx (WAVE_SUBJECTS) ---
+	waves, err := newWaveStore(js, os.Getenv("WAVE_SUBJECTS"), getenvDuration("WAVE_CHUNK", time.Second),
+		getenvDuration("WAVE_RETENTION", 30*24*time.Hour), wm, dlq, queue)
+	if err != nil {
+		return err
+	}
+	if waves.chunk <= 0 || 2*waves.chunk > ackWait/3 {
+		return fmt.Errorf("WAVE_CHUNK must be between 0 and %s", ackWait/6)
+	}
+	go waves.run(ctx)
+
+	// --- Packed high-rate channels (PACK_FIELDS) ---
+	pk, err := newPacker(os.Getenv("PACK_FIELDS"), getenvDuration("PACK_MAX_AGE", 5*time.Second), route, store)
+	if err != nil {
+		return err
+	}
+	if pk.maxAge <= 0 || pk.maxAge > ackWait/3 {
+		return fmt.Errorf("PACK_MAX_AGE must be between 0 and %s", ackWait/3)
+	}
+	go pk.run(ctx)
+
+	// Durable consumer; manual ack for at-least-once semantics
+	start, err := queueConsumer(js)
+	if err != nil {
+		return err
+	}
+	opts := append([]nats.SubOpt{nats.Durable(consumer), nats.ManualAck(), nats.AckWait(ackWait), nats.MaxDeliver(maxDeliver)}, start...)
+	sub, err := js.QueueSubscribe("telemetry.>", consumer, func(msg *nats.Msg) {
+		// default timestamp = JetStream server timestamp
+		ts := time.Now()
+		if md, e := msg.Metadata(); e == nil {
+			ts = md.Timestamp
+		}
+		// replayed from the DLQ: when it was first published
+		if t, e := time.Parse(time.RFC3339Nano, msg.Header.Get("Original-Time")); e == nil {
+			ts = t
+		}
+
+		robot := telem.RobotID(msg.Subject)
+		if err := schemas.Validate(msg.Subject, msg.Header.Get("Content-Type"), msg.Data); err != nil {
+			var inv *schemareg.Invalid
+			if errors.As(err, &inv) && !inv.Enforced {
+				wm.schemaFails.Inc(schemareg.Warn)
+				logger.Printf("schema warning (subject=%s): %v", msg.Subject, err)
+			} else {
+				wm.schemaFails.Inc(schemareg.Enforce)
+				logger.Printf("dead-lettered invalid payload (subject=%s): %v", msg.Subject, err)
+				outs.count(robot, outcomeInvalid)
+				dlq.reject(wm, msg, err.Error())
+				return
+			}
+		}
+		if ok, err := waves.add(msg, robot, ts); ok {
+			if err != nil {
+				logger.Printf("dead-lettered bad waveform frame (subject=%s): %v", msg.Subject, err)
+				outs.count(robot, outcomeInvalid)
+				dlq.reject(wm, msg, err.Error())
+			}
+			return // else settled with its chunk
+		}
+		p, err := chain.decode(msg.Subject, msg.Header.Get("Content-Type"), msg.Data, ts, time.Now())
+		if errors.Is(err, telem.ErrBadTimestamp) {
+			logger.Printf("drop bad timestamp %s (subject=%s)", p.Time.Format(time.RFC3339Nano), msg.Subject)
+			outs.count(robot, outcomeBadTS)
+			wm.ack(msg) // do NOT retry this one
+			return
+		}
+		keep := err == nil
+		reason := "decode"
+		if keep {
+			reason = "transform"
+			keep, err = chain.transform(&p)
+		}
+		if err != nil {
+			if qerr := quar.divert(msg, reason); qerr != nil {
+				logger.Printf("quarantine error: %v", qerr)
+				dlq.fail(wm, msg, qerr)
+				return
+			}
+			logger.Printf("quarantined on %s error (subject=%s): %v", reason, msg.Subject, err)
+			outs.count(robot, outcomeQuarantined)
+			wm.ack(msg)
+			return
+		}
+		if !keep {
+			outs.count(robot, outcomeTransformed)
+			wm.ack(msg)
+			return
+		}
+		// a time other than ts is the robot's ts_ns; replays aren't timed
+		var sent time.Time
+		if !p.Time.Equal(ts) && msg.Header.Get("Original-Time") == "" {
+			sent = p.Time
+		}
+		if pk.add(p, msg, robot, sent) {
+			return // settled with its run
+		}
+		store(p, queued{msgs: []*nats.Msg{msg}, robot: robot, sent: sent})
+	}, opts...)
+	if err != nil {
+		return err
+	}
+	defer sub.Drain()
+
+	logger.Printf("Worker running. NATS=%s subject=telemetry.> queue=%s", nc.ConnectedUrl(), consumer)
+	<-ctx.Done()
+	return nil
+}
+
+// queueConsumer readies the shared consumer. One left by a worker from
+// before queue groups can't take a queue subscription, so it is recreated as
+// one, starting after the last message it had acked; the options returned
+// say where.
+func queueConsumer(js nats.JetStreamContext) ([]nats.SubOpt, error) {
+	info, err := js.ConsumerInfo("TELEMETRY", consumer)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		return nil, nil
+	}
+	if err != nil || info.Config.DeliverGroup != "" {
+		return nil, err
+	}
+	from := info.AckFloor.Stream + 1
+	if err := js.DeleteConsumer("TELEMETRY", consumer); err != nil {
+		return nil, err
+	}
+	logger.Printf("recreating consumer %s as a queue group from stream seq %d", consumer, from)
+	return []nats.SubOpt{nats.StartSequence(from)}, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// externalJWT verifies bearer tokens issued by someone else (an IdP, another
+// service), configured with
+//
+//	JWT_ALG          HS256 or RS256
+//	JWT_SECRET       HS256 shared secret
+//	JWT_PUBLIC_KEY   RS256 public key, PEM text or a path to a PEM file
+//	JWT_ISSUER       required iss, optional
+//	JWT_AUDIENCE     required aud, optional
+//	JWT_ROLES_CLAIM  claim holding roles, default "roles" (array or space/comma separated)
+//	JWT_TENANT_CLAIM claim holding the tenant, default "tenant"
+//	JWT_ROBOTS_CLAIM claim holding the robots in scope, default "robots" (see rbac)
+//
+// Such tokens are stateless: there is no session to revoke, they simply
+// expire (exp is required).
+type externalJWT struct {
+	alg         string
+	key         interface{}
+	issuer      string
+	audience    string
+	rolesClaim  string
+	tenantClaim string
+	robotsClaim string
+}
+
+// newExternalJWT reads the JWT_* settings; nil when JWT_ALG is unset.
+func newExternalJWT() (*externalJWT, error) {
+	alg := os.Getenv("JWT_ALG")
+	if alg == "" {
+		return nil, nil
+	}
+	v := &externalJWT{alg: alg, issuer: os.Getenv("JWT_ISSUER"), audience: os.Getenv("JWT_AUDIENCE"),
+		rolesClaim: env("JWT_ROLES_CLAIM", "roles"), tenantClaim: env("JWT_TENANT_CLAIM", "tenant"),
+		robotsClaim: env("JWT_ROBOTS_CLAIM", "robots")}
+	switch alg {
+	case "HS256":
+		secret := os.Getenv("JWT_SECRET")
+		if secret == "" {
+			return nil, errors.New("JWT_ALG=HS256 needs JWT_SECRET")
+		}
+		v.key = []byte(secret)
+	case "RS256":
+		pem := os.Getenv("JWT_PUBLIC_KEY")
+		if pem != "" && !strings.Contains(pem, "-----BEGIN") {
+			b, err := os.ReadFile(pem)
+			if err != nil {
+				return nil, fmt.Errorf("JWT_PUBLIC_KEY: %w", err)
+			}
+			pem = string(b)
+		}
+		key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(pem))
+		if err != nil {
+			return nil, fmt.Errorf("JWT_PUBLIC_KEY: %w", err)
+		}
+		v.key = key
+	default:
+		return nil, fmt.Errorf("JWT_ALG %q: use HS256 or RS256", alg)
+	}
+	return v, nil
+}
+
+// verify checks tok and maps its claims to an identity.
+func (v *externalJWT) verify(tok string) (*identity, error) {
+	opts := []jwt.ParserOption{jwt.WithValidMethods([]string{v.alg}), jwt.WithExpirationRequired()}
+	if v.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(v.issuer))
+	}
+	if v.audience != "" {
+		opts = append(opts, jwt.WithAudience(v.audience))
+	}
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(tok, claims, func(*jwt.Token) (interface{}, error) { return v.key, nil }, opts...); err != nil {
+		return nil, err
+	}
+	sub, _ := claims.GetSubject()
+	if sub == "" {
+		return nil, errors.New("token has no sub")
+	}
+	id := &identity{User: sub, Roles: claimList(claims[v.rolesClaim]), Claims: claims}
+	id.Tenant, _ = claims[v.tenantClaim].(string)
+	id.Robots = claimList(claims[v.robotsClaim])
+	return id, nil
+}
+
+// claimList reads a claim that is an array of strings or one space/comma
+// separated string.
+func claimList(c interface{}) []string {
+	out := []string{}
+	switch r := c.(type) {
+	case []interface{}:
+		for _, x := range r {
+			if s, ok := x.(string); ok {
+				out = append(out, s)
+			}
+		}
+	case string:
+		out = strings.FieldsFunc(r, func(c rune) bool { return c == ' ' || c == ',' })
+	}
+	return out
+}
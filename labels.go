@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// labelsBucket holds one label per key, {robot}.{id}.
+const labelsBucket = "LABELS"
+
+// maxLabelSpan bounds one label; longer stretches are rarely one behaviour.
+const maxLabelSpan = 24 * time.Hour
+
+var labelNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_\-]{0,63}$`)
+
+// label marks a stretch of a robot's telemetry as a behaviour, for building
+// supervised datasets:
+//
+//	{"label":"slipping","start":"2024-05-01T10:00:00Z","end":"2024-05-01T10:00:12Z","confidence":0.8,"subject":"telemetry.r1.imu","note":"wet floor"}
+//
+// Subject narrows it to one of the robot's subjects; without one it covers
+// them all. Confidence is 0 to 1 (default 1). Author is whoever created it;
+// an edit by someone else is recorded in By.
+type label struct {
+	ID         string    `json:"id"`
+	Robot      string    `json:"robot"`
+	Subject    string    `json:"subject,omitempty"`
+	Label      string    `json:"label"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Confidence float64   `json:"confidence"`
+	Note       string    `json:"note,omitempty"`
+	Author     string    `json:"author"`
+	Created    time.Time `json:"created"`
+	Updated    time.Time `json:"updated"`
+	By         string    `json:"by,omitempty"`
+}
+
+func (l *label) check() error {
+	switch {
+	case !labelNameRe.MatchString(l.Label):
+		return errors.New("bad or missing 'label' (lowercase letters, digits, _ and -)")
+	case l.Start.IsZero() || l.End.IsZero() || !l.End.After(l.Start):
+		return errors.New("'start' and 'end' must be RFC3339 times, end after start")
+	case l.End.Sub(l.Start) > maxLabelSpan:
+		return fmt.Errorf("a label spans at most %s", maxLabelSpan)
+	case l.Start.After(time.Now()):
+		return errors.New("'start' is in the future")
+	case l.Confidence < 0 || l.Confidence > 1:
+		return errors.New("'confidence' must be between 0 and 1")
+	case len(l.Note) > 1024:
+		return errors.New("'note' is too long")
+	}
+	if l.Subject != "" && (!subjectRe.MatchString(l.Subject) || robotOfSubject(l.Subject) != l.Robot) {
+		return fmt.Errorf("'subject' must be one of %s's, telemetry.%s.…", l.Robot, l.Robot)
+	}
+	return nil
+}
+
+// overlaps reports whether l covers any of [from, to].
+func (l *label) overlaps(from, to time.Time) bool {
+	return !l.End.Before(from) && !l.Start.After(to)
+}
+
+// labeling stores labels in LABELS, for the UI to list and for /api/ts to
+// export alongside the series (include=labels).
+type labeling struct {
+	kv    nats.KeyValue
+	audit *auditLog
+	rb    *rbac
+}
+
+func newLabeling(js nats.JetStreamContext, audit *auditLog, rb *rbac) (*labeling, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: labelsBucket, History: 5, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	return &labeling{kv: kv, audit: audit, rb: rb}, nil
+}
+
+func (lb *labeling) get(robot, id string) (*label, error) {
+	if !tokenRe.MatchString(id) {
+		return nil, nats.ErrKeyNotFound
+	}
+	e, err := lb.kv.Get(robot + "." + id)
+	if err != nil {
+		return nil, err
+	}
+	var l label
+	if err := json.Unmarshal(e.Value(), &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// list returns robot's labels ("" for every robot's) overlapping [from, to],
+// named name when it isn't "", oldest first.
+func (lb *labeling) list(robot, name string, from, to time.Time) ([]label, error) {
+	pattern := ">"
+	if robot != "" {
+		pattern = robot + ".*"
+	}
+	keys, err := kvKeys(lb.kv, pattern)
+	if err != nil {
+		return nil, err
+	}
+	out := []label{}
+	for _, k := range keys {
+		i := strings.LastIndexByte(k, '.')
+		if i < 0 {
+			continue
+		}
+		l, err := lb.get(k[:i], k[i+1:])
+		if err != nil || (name != "" && l.Label != name) || !l.overlaps(from, to) {
+			continue
+		}
+		out = append(out, *l)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+	return out, nil
+}
+
+// entries are robot's labels overlapping [since, now] as timeline entries,
+// at their start.
+func (lb *labeling) entries(robot string, since time.Time) ([]timelineEntry, error) {
+	list, err := lb.list(robot, "", since, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]timelineEntry, 0, len(list))
+	for _, l := range list {
+		subject := l.Subject
+		if subject == "" {
+			subject = "telemetry." + l.Robot
+		}
+		b, _ := json.Marshal(l)
+		out = append(out, timelineEntry{Channel: "label", Subject: subject, T: l.Start, Data: b})
+	}
+	return out, nil
+}
+
+// labelRange reads start (default -24h) and stop (default now) as /api/ts
+// does.
+func labelRange(req *http.Request) (time.Time, time.Time, error) {
+	q := req.URL.Query()
+	start, stop := q.Get("start"), q.Get("stop")
+	if start == "" {
+		start = "-24h"
+	}
+	if !validTime(start) || (stop != "" && !validTime(stop)) {
+		return time.Time{}, time.Time{}, errors.New("bad 'start' or 'stop' (-15m or RFC3339)")
+	}
+	to := time.Now()
+	if stop != "" {
+		to = startTime(stop)
+	}
+	return startTime(start), to, nil
+}
+
+// GET /api/labels?label=slipping&robot=r1&start=-7d&stop=… lists the labels
+// overlapping the range (default the last day) on robots in the caller's
+// scope, oldest first.
+func (lb *labeling) handleList(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	robot, name := q.Get("robot"), q.Get("label")
+	if robot != "" && !tokenRe.MatchString(robot) {
+		http.Error(w, "bad 'robot'", 400)
+		return
+	}
+	from, to, err := labelRange(req)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	list, err := lb.list(robot, name, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	id := identityOf(req)
+	out := list[:0]
+	for _, l := range list {
+		if lb.rb.sees(id, l.Robot) {
+			out = append(out, l)
+		}
+	}
+	writeJSON(w, out)
+}
+
+// GET /api/robot/{id}/labels?label=&start=&stop= is the same for one robot.
+func (lb *labeling) handleRobotList(w http.ResponseWriter, req *http.Request) {
+	from, to, err := labelRange(req)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	out, err := lb.list(chi.URLParam(req, "id"), req.URL.Query().Get("label"), from, to)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, out)
+}
+
+// POST /api/robot/{id}/labels creates a label (see label), authored by the
+// caller.
+func (lb *labeling) handleCreate(w http.ResponseWriter, req *http.Request) {
+	l := label{Confidence: 1}
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 16<<10)).Decode(&l); err != nil {
+		http.Error(w, "bad JSON", 400)
+		return
+	}
+	now := time.Now().UTC()
+	l.ID, l.Robot, l.Author, l.Created, l.Updated, l.By = nuid.Next(), chi.URLParam(req, "id"), actorOf(req), now, now, ""
+	if err := l.check(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := lb.audit.record(auditRecord{Actor: l.Author, Action: "label.create", Robot: l.Robot,
+		Details: map[string]interface{}{"id": l.ID, "label": l.Label, "start": l.Start, "end": l.End}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	b, _ := json.Marshal(l)
+	if _, err := lb.kv.Create(l.Robot+"."+l.ID, b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSONStatus(w, http.StatusCreated, l)
+}
+
+// PUT /api/robot/{id}/labels/{lid} replaces a label's label, range,
+// subject, confidence and note, keeping its author.
+func (lb *labeling) handleUpdate(w http.ResponseWriter, req *http.Request) {
+	robot, lid := chi.URLParam(req, "id"), chi.URLParam(req, "lid")
+	prev, err := lb.get(robot, lid)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such label", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	l := label{Confidence: 1}
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 16<<10)).Decode(&l); err != nil {
+		http.Error(w, "bad JSON", 400)
+		return
+	}
+	l.ID, l.Robot, l.Author, l.Created, l.Updated, l.By = lid, robot, prev.Author, prev.Created, time.Now().UTC(), actorOf(req)
+	if err := l.check(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := lb.audit.record(auditRecord{Actor: l.By, Action: "label.update", Robot: robot,
+		Details: map[string]interface{}{"id": lid, "label": l.Label, "start": l.Start, "end": l.End}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	b, _ := json.Marshal(l)
+	if _, err := lb.kv.Put(robot+"."+lid, b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, l)
+}
+
+// DELETE /api/robot/{id}/labels/{lid}
+func (lb *labeling) handleDelete(w http.ResponseWriter, req *http.Request) {
+	robot, lid := chi.URLParam(req, "id"), chi.URLParam(req, "lid")
+	if _, err := lb.get(robot, lid); errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such label", 404)
+		return
+	}
+	if err := lb.audit.record(auditRecord{Actor: actorOf(req), Action: "label.delete", Robot: robot,
+		Details: map[string]interface{}{"id": lid}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	if err := lb.kv.Delete(robot + "." + lid); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// maxStateFields bounds the fields remembered per subject, so a robot sending
+// ever-new field names can't grow the cache without end.
+const maxStateFields = 256
+
+type fieldState struct {
+	Value interface{} `json:"value"`
+	T     time.Time   `json:"t"`
+}
+
+type subjectState struct {
+	Updated time.Time             `json:"updated"`
+	Fields  map[string]fieldState `json:"fields"`
+}
+
+// stateCache keeps the latest value of every numeric and boolean field per
+// telemetry subject, decoded as the worker does (telem.Decode), so dashboards
+// can draw the current state on connect instead of waiting for each field to
+// come round again. A field keeps its value until a message carries it again.
+// It lives in memory: after a restart it fills up from live telemetry.
+type stateCache struct {
+	mu       sync.RWMutex
+	subjects map[string]*subjectState
+}
+
+func newStateCache() *stateCache {
+	return &stateCache{subjects: map[string]*subjectState{}}
+}
+
+func (s *stateCache) subscribe(nc *nats.Conn) error {
+	_, err := nc.Subscribe("telemetry.>", func(msg *nats.Msg) {
+		now := time.Now()
+		p, err := telem.DecodeAny(msg.Subject, msg.Header.Get("Content-Type"), msg.Data, now, now)
+		if err != nil {
+			return
+		}
+		s.put(msg.Subject, p)
+	})
+	return err
+}
+
+func (s *stateCache) put(subject string, p telem.Point) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.subjects[subject]
+	if st == nil {
+		st = &subjectState{Fields: map[string]fieldState{}}
+		s.subjects[subject] = st
+	}
+	for name, v := range p.Fields {
+		if name == "raw" {
+			continue
+		}
+		if _, ok := st.Fields[name]; !ok && len(st.Fields) >= maxStateFields {
+			continue
+		}
+		st.Fields[name] = fieldState{Value: v, T: p.Time}
+	}
+	st.Updated = p.Time
+}
+
+// snapshot copies the state of the subjects robot publishes, or of every
+// robot when robot is empty; allow, when not nil, filters subjects.
+func (s *stateCache) snapshot(robot string, allow func(subject string) bool) map[string]subjectState {
+	out := map[string]subjectState{}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for subject, st := range s.subjects {
+		if robot != "" && telem.RobotID(subject) != robot {
+			continue
+		}
+		if allow != nil && !allow(subject) {
+			continue
+		}
+		fields := make(map[string]fieldState, len(st.Fields))
+		for name, f := range st.Fields {
+			fields[name] = f
+		}
+		out[subject] = subjectState{Updated: st.Updated, Fields: fields}
+	}
+	return out
+}
+
+// stateFrame is the first /ws frame: a text frame, unlike the binary
+// telemetry frames after it.
+func stateFrame(subjects map[string]subjectState) []byte {
+	b, _ := json.Marshal(map[string]interface{}{"type": "snapshot", "ts": time.Now(), "subjects": subjects})
+	return b
+}
+
+// GET /api/robot/{id}/state returns {"robot","subjects":{subject:{"updated",
+// "fields":{name:{"value","t"}}}}}. Viewers can't have it: their telemetry is
+// delayed, this isn't.
+func (s *stateCache) handleGet(w http.ResponseWriter, req *http.Request) {
+	if viewerOf(req) != nil {
+		http.Error(w, "live state is not available to viewers", http.StatusForbidden)
+		return
+	}
+	id := chi.URLParam(req, "id")
+	subjects := s.snapshot(id, nil)
+	if len(subjects) == 0 {
+		http.Error(w, "no telemetry from robot "+id+" since the gateway started", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"robot": id, "subjects": subjects})
+}
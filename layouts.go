@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/layout"
+)
+
+// telemetryLayouts follows the Influx layout of telemetry, for the queries
+// that read it; nil reads the default layout.
+var telemetryLayouts *layout.Store
+
+func layoutState() layout.State {
+	if telemetryLayouts == nil {
+		return layout.State{Current: layout.Default}
+	}
+	return telemetryLayouts.State()
+}
+
+// telemetryFilter selects telemetry rows after range(), across a layout
+// cutover if one is under way.
+func telemetryFilter() string { return layoutState().Filter() }
+
+// layoutAdmin moves telemetry between Influx layouts (internal/layout):
+// begin dual-writes a new layout, cutover switches to it, finish forgets
+// the old one once its data is gone, abort drops the new one.
+type layoutAdmin struct {
+	store *layout.Store
+	audit *auditLog
+}
+
+type layoutStatus struct {
+	Phase string `json:"phase"`
+	layout.State
+}
+
+// GET /api/layouts
+func (a *layoutAdmin) handleGet(w http.ResponseWriter, _ *http.Request) {
+	st := a.store.State()
+	writeJSON(w, layoutStatus{Phase: st.Phase(), State: st})
+}
+
+// POST /api/layouts/begin {"layout":{...},"window":"168h"}
+func (a *layoutAdmin) handleBegin(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Layout layout.Layout `json:"layout"`
+		Window string        `json:"window"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, "bad JSON", 400)
+		return
+	}
+	window := 7 * 24 * time.Hour
+	if body.Window != "" {
+		d, err := time.ParseDuration(body.Window)
+		if err != nil || d < 0 {
+			http.Error(w, "bad 'window' (a duration such as 168h)", 400)
+			return
+		}
+		window = d
+	}
+	if err := body.Layout.Validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	a.update(w, req, "layout.begin", map[string]interface{}{"layout": body.Layout, "window": window.String()}, func(st layout.State) (layout.State, error) {
+		return st.Begin(body.Layout, window, time.Now().UTC())
+	})
+}
+
+// POST /api/layouts/cutover[?force=true]
+func (a *layoutAdmin) handleCutover(w http.ResponseWriter, req *http.Request) {
+	force := req.URL.Query().Get("force") == "true"
+	a.update(w, req, "layout.cutover", map[string]interface{}{"force": force}, func(st layout.State) (layout.State, error) {
+		return st.Cutover(force, time.Now().UTC())
+	})
+}
+
+// POST /api/layouts/abort
+func (a *layoutAdmin) handleAbort(w http.ResponseWriter, req *http.Request) {
+	a.update(w, req, "layout.abort", map[string]interface{}{}, layout.State.Abort)
+}
+
+// POST /api/layouts/finish
+func (a *layoutAdmin) handleFinish(w http.ResponseWriter, req *http.Request) {
+	a.update(w, req, "layout.finish", map[string]interface{}{}, layout.State.Finish)
+}
+
+func (a *layoutAdmin) update(w http.ResponseWriter, req *http.Request, action string, details map[string]interface{}, fn func(layout.State) (layout.State, error)) {
+	actor := actorOf(req)
+	st, err := a.store.Update(func(st layout.State) (layout.State, error) {
+		st, err := fn(st)
+		st.Updated, st.By = time.Now().UTC(), actor
+		return st, err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	details["phase"], details["current"] = st.Phase(), st.Current.Name
+	_ = a.audit.record(auditRecord{Actor: actor, Action: action, Details: details})
+	writeJSON(w, layoutStatus{Phase: st.Phase(), State: st})
+}
+
+// GET /api/layouts/compare?start=-1h counts the points each layout being
+// written or read holds in the range, to check a dual-written layout keeps
+// up before cutting over to it.
+func (a *layoutAdmin) handleCompare(w http.ResponseWriter, req *http.Request) {
+	db := influxOf(req)
+	if db == nil {
+		http.Error(w, "influx not configured", http.StatusNotImplemented)
+		return
+	}
+	start := req.URL.Query().Get("start")
+	if start == "" {
+		start = "-1h"
+	}
+	if !validTime(start) {
+		http.Error(w, "bad 'start' (use -15m or RFC3339 time)", 400)
+		return
+	}
+	st := a.store.State()
+	ls := st.Writes()
+	if st.Previous != nil {
+		ls = append(ls, *st.Previous)
+	}
+	bucket, _ := json.Marshal(db.Bucket)
+	out := map[string]int64{}
+	for _, l := range ls {
+		flux := `from(bucket:` + string(bucket) + `) |> range(start:` + start + `)` +
+			(layout.State{Current: l}).Filter() + ` |> group() |> count()`
+		res, err := db.Client.QueryAPI(db.Org).Query(req.Context(), flux)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		out[l.Name] = 0
+		for res.Next() {
+			if n, ok := res.Record().Value().(int64); ok {
+				out[l.Name] += n
+			}
+		}
+		err = res.Err()
+		res.Close()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	writeJSON(w, map[string]interface{}{"phase": st.Phase(), "start": start, "points": out})
+}
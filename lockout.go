@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type lockoutState struct {
+	Active bool      `json:"active"`
+	Reason string    `json:"reason,omitempty"`
+	Actor  string    `json:"actor,omitempty"`
+	Since  time.Time `json:"since,omitempty"`
+}
+
+// lockout is the global emergency switch for site evacuations and audits.
+// While active, every guarded (motion/mission) endpoint is refused unless the
+// caller presents the break-glass token, an e-stop hold is re-published to
+// ctrl.broadcast.estop every holdEvery, and each API response carries an
+// X-Lockout header. The state lives in the LOCKOUT bucket so every gateway
+// instance follows it.
+type lockout struct {
+	nc         *nats.Conn
+	kv         nats.KeyValue
+	audit      *auditLog
+	breakGlass string
+	holdEvery  time.Duration
+
+	mu    sync.RWMutex
+	state lockoutState
+}
+
+func newLockout(nc *nats.Conn, js nats.JetStreamContext, audit *auditLog, breakGlass string, holdEvery time.Duration) (*lockout, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "LOCKOUT", History: 20, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	l := &lockout{nc: nc, kv: kv, audit: audit, breakGlass: breakGlass, holdEvery: holdEvery}
+
+	w, err := kv.Watch("state")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for e := range w.Updates() {
+			if e == nil {
+				continue
+			}
+			var st lockoutState
+			if e.Operation() == nats.KeyValuePut && json.Unmarshal(e.Value(), &st) == nil {
+				l.mu.Lock()
+				l.state = st
+				l.mu.Unlock()
+			}
+		}
+	}()
+	go l.hold()
+	return l, nil
+}
+
+func (l *lockout) current() lockoutState {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.state
+}
+
+func (l *lockout) hold() {
+	t := time.NewTicker(l.holdEvery)
+	defer t.Stop()
+	for range t.C {
+		st := l.current()
+		if !st.Active {
+			continue
+		}
+		b, _ := json.Marshal(map[string]interface{}{"reason": "lockout", "hold": true, "since": st.Since})
+		if err := l.nc.Publish("ctrl.broadcast.estop", b); err != nil {
+			log.Printf("lockout: e-stop hold: %v", err)
+		}
+	}
+}
+
+func (l *lockout) isBreakGlass(req *http.Request) bool {
+	return l.breakGlass != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get("X-Break-Glass")), []byte(l.breakGlass)) == 1
+}
+
+// banner is middleware adding X-Lockout to every response.
+func (l *lockout) banner(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if st := l.current(); st.Active {
+			w.Header().Set("X-Lockout", "active; since="+st.Since.UTC().Format(time.RFC3339))
+		} else {
+			w.Header().Set("X-Lockout", "inactive")
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// holds reports whether a lockout refuses req: one is active and req
+// doesn't carry the break-glass token.
+func (l *lockout) holds(req *http.Request) bool {
+	return l.current().Active && !l.isBreakGlass(req)
+}
+
+// guard wraps a motion/mission endpoint so it is refused during a lockout.
+func (l *lockout) guard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if l.holds(req) {
+			http.Error(w, "emergency lockout active", http.StatusLocked)
+			return
+		}
+		next(w, req)
+	}
+}
+
+func (l *lockout) set(st lockoutState) error {
+	b, _ := json.Marshal(st)
+	if _, err := l.kv.Put("state", b); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.state = st
+	l.mu.Unlock()
+	return nil
+}
+
+// GET /api/lockout
+func (l *lockout) handleGet(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, l.current())
+}
+
+// POST /api/lockout with {"reason":"evacuation drill"}; anyone may engage it.
+func (l *lockout) handleEngage(w http.ResponseWriter, req *http.Request) {
+	var in struct {
+		Reason string `json:"reason"`
+	}
+	_ = json.NewDecoder(req.Body).Decode(&in)
+	st := lockoutState{Active: true, Reason: in.Reason, Actor: actorOf(req), Since: time.Now()}
+	if err := l.audit.record(auditRecord{Actor: st.Actor, Action: "lockout.engage", Details: map[string]interface{}{"reason": in.Reason}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	if err := l.set(st); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	// don't wait for the first tick
+	b, _ := json.Marshal(map[string]interface{}{"reason": "lockout", "hold": true, "since": st.Since})
+	_ = l.nc.Publish("ctrl.broadcast.estop", b)
+	writeJSON(w, st)
+}
+
+// DELETE /api/lockout; only with break-glass.
+func (l *lockout) handleRelease(w http.ResponseWriter, req *http.Request) {
+	if !l.isBreakGlass(req) {
+		http.Error(w, "break-glass required to release lockout", http.StatusForbidden)
+		return
+	}
+	if err := l.audit.record(auditRecord{Actor: actorOf(req), Action: "lockout.release"}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	if err := l.set(lockoutState{}); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLockoutGuard(t *testing.T) {
+	cases := []struct {
+		name       string
+		active     bool
+		breakGlass string // configured token
+		header     string // X-Break-Glass sent
+		want       int
+	}{
+		{"inactive", false, "", "", 200},
+		{"inactive, token sent", false, "bg", "bg", 200},
+		{"active", true, "bg", "", 423},
+		{"active, break glass", true, "bg", "bg", 200},
+		{"active, wrong token", true, "bg", "bgx", 423},
+		{"active, prefix of token", true, "bg", "b", 423},
+		{"active, none configured", true, "", "", 423},
+		{"active, none configured, token sent", true, "", "anything", 423},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			l := &lockout{breakGlass: c.breakGlass, state: lockoutState{Active: c.active}}
+			reached := false
+			h := l.guard(func(w http.ResponseWriter, _ *http.Request) { reached = true })
+			req := httptest.NewRequest(http.MethodPost, "/api/robot/r1/cmd", nil)
+			if c.header != "" {
+				req.Header.Set("X-Break-Glass", c.header)
+			}
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			if rec.Code != c.want {
+				t.Errorf("got %d, want %d", rec.Code, c.want)
+			}
+			if reached != (c.want == 200) {
+				t.Errorf("handler reached: %v, want %v", reached, c.want == 200)
+			}
+		})
+	}
+}
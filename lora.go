@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// loraDevice maps a LoRaWAN end device to the telemetry id its uplinks are
+// published under, and names the codec for its payload:
+//
+//	network      use the payload the network server decoded
+//	cayenne_lpp  Cayenne Low Power Payload
+//	struct       fixed big-endian layout (see loraField)
+//	raw          metadata only (rssi, snr, f_port)
+type loraDevice struct {
+	DevEUI string      `json:"dev_eui"`
+	ID     string      `json:"id"`
+	Site   string      `json:"site,omitempty"`
+	Codec  string      `json:"codec"`
+	Layout []loraField `json:"layout,omitempty"`
+}
+
+// lora accepts uplink webhooks from The Things Stack (v3) and ChirpStack (v4)
+// and republishes them as telemetry.{id}.lora, so LoRa environment sensors
+// flow through the same pipeline as robots. Devices are registered in the
+// LORA_DEVICES bucket; uplinks from unknown devices are acknowledged and
+// dropped so the network server doesn't retry them.
+type lora struct {
+	js    nats.JetStreamContext
+	kv    nats.KeyValue
+	token string
+}
+
+func newLoRa(js nats.JetStreamContext, token string) (*lora, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "LORA_DEVICES", History: 5, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	return &lora{js: js, kv: kv, token: token}, nil
+}
+
+// loraUplink is the provider-neutral form of an uplink.
+type loraUplink struct {
+	DevEUI   string
+	Received time.Time
+	FPort    int
+	Payload  []byte
+	Decoded  map[string]interface{}
+	RSSI     *float64
+	SNR      *float64
+}
+
+func parseTTN(b []byte) (*loraUplink, error) {
+	var in struct {
+		EndDeviceIDs struct {
+			DevEUI string `json:"dev_eui"`
+		} `json:"end_device_ids"`
+		ReceivedAt    time.Time `json:"received_at"`
+		UplinkMessage *struct {
+			FPort          int                    `json:"f_port"`
+			FrmPayload     []byte                 `json:"frm_payload"`
+			DecodedPayload map[string]interface{} `json:"decoded_payload"`
+			RxMetadata     []struct {
+				RSSI *float64 `json:"rssi"`
+				SNR  *float64 `json:"snr"`
+			} `json:"rx_metadata"`
+		} `json:"uplink_message"`
+	}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return nil, err
+	}
+	if in.UplinkMessage == nil {
+		return nil, nil // join accepts, downlink events, ...
+	}
+	u := &loraUplink{DevEUI: in.EndDeviceIDs.DevEUI, Received: in.ReceivedAt, FPort: in.UplinkMessage.FPort,
+		Payload: in.UplinkMessage.FrmPayload, Decoded: in.UplinkMessage.DecodedPayload}
+	for _, rx := range in.UplinkMessage.RxMetadata {
+		if rx.RSSI != nil && (u.RSSI == nil || *rx.RSSI > *u.RSSI) {
+			u.RSSI, u.SNR = rx.RSSI, rx.SNR
+		}
+	}
+	return u, nil
+}
+
+func parseChirpStack(b []byte) (*loraUplink, error) {
+	var in struct {
+		DeviceInfo struct {
+			DevEUI string `json:"devEui"`
+		} `json:"deviceInfo"`
+		Time   time.Time              `json:"time"`
+		FPort  int                    `json:"fPort"`
+		Data   string                 `json:"data"`
+		Object map[string]interface{} `json:"object"`
+		RxInfo []struct {
+			RSSI *float64 `json:"rssi"`
+			SNR  *float64 `json:"snr"`
+		} `json:"rxInfo"`
+	}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return nil, err
+	}
+	payload, err := base64.StdEncoding.DecodeString(in.Data)
+	if err != nil {
+		return nil, err
+	}
+	u := &loraUplink{DevEUI: in.DeviceInfo.DevEUI, Received: in.Time, FPort: in.FPort, Payload: payload, Decoded: in.Object}
+	for _, rx := range in.RxInfo {
+		if rx.RSSI != nil && (u.RSSI == nil || *rx.RSSI > *u.RSSI) {
+			u.RSSI, u.SNR = rx.RSSI, rx.SNR
+		}
+	}
+	return u, nil
+}
+
+func (l *lora) device(eui string) (*loraDevice, error) {
+	e, err := l.kv.Get(strings.ToLower(eui))
+	if err != nil {
+		return nil, err
+	}
+	var d loraDevice
+	if err := json.Unmarshal(e.Value(), &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// POST /api/lora/uplink/{provider} (ttn or chirpstack); the integration must
+// send the shared secret as X-Webhook-Token or a bearer token.
+func (l *lora) handleUplink(w http.ResponseWriter, req *http.Request) {
+	got := req.Header.Get("X-Webhook-Token")
+	if got == "" {
+		got = strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	}
+	if l.token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(l.token)) != 1 {
+		http.Error(w, "bad webhook token", http.StatusUnauthorized)
+		return
+	}
+	b, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	var up *loraUplink
+	switch chi.URLParam(req, "provider") {
+	case "ttn":
+		up, err = parseTTN(b)
+	case "chirpstack":
+		// ChirpStack posts every event type to one URL
+		if ev := req.URL.Query().Get("event"); ev != "" && ev != "up" {
+			w.WriteHeader(204)
+			return
+		}
+		up, err = parseChirpStack(b)
+	default:
+		http.Error(w, "unknown provider (want ttn or chirpstack)", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, "bad uplink: "+err.Error(), 400)
+		return
+	}
+	if up == nil {
+		w.WriteHeader(204)
+		return
+	}
+
+	dev, err := l.device(up.DevEUI)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		log.Printf("lora: uplink from unregistered device %s dropped", up.DevEUI)
+		w.WriteHeader(204)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	fields, err := decodeLoRa(dev, up.Payload, up.Decoded)
+	if err != nil {
+		// a codec mismatch won't fix itself on retry
+		log.Printf("lora: %s (%s): %v", dev.ID, up.DevEUI, err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	fields["f_port"] = float64(up.FPort)
+	if up.RSSI != nil {
+		fields["rssi"] = *up.RSSI
+	}
+	if up.SNR != nil {
+		fields["snr"] = *up.SNR
+	}
+	if up.Received.IsZero() {
+		up.Received = time.Now()
+	}
+	msg, _ := json.Marshal(map[string]interface{}{
+		"ts_ns": up.Received.UnixNano(),
+		"topic": "lora",
+		"data":  fields,
+	})
+	if _, err := l.js.Publish("telemetry."+dev.ID+".lora", msg); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// GET /api/lora/devices
+func (l *lora) handleList(w http.ResponseWriter, _ *http.Request) {
+	keys, err := kvKeys(l.kv, ">")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := []loraDevice{}
+	for _, k := range keys {
+		if d, err := l.device(k); err == nil {
+			out = append(out, *d)
+		}
+	}
+	writeJSON(w, out)
+}
+
+// PUT /api/lora/devices/{eui} with {"id":"site1-weather","codec":"cayenne_lpp"}
+func (l *lora) handlePut(w http.ResponseWriter, req *http.Request) {
+	var d loraDevice
+	if err := json.NewDecoder(req.Body).Decode(&d); err != nil {
+		http.Error(w, "bad device: "+err.Error(), 400)
+		return
+	}
+	d.DevEUI = strings.ToLower(chi.URLParam(req, "eui"))
+	if !tokenRe.MatchString(d.DevEUI) {
+		http.Error(w, "bad dev_eui", 400)
+		return
+	}
+	if d.ID == "" {
+		d.ID = "lora-" + d.DevEUI
+	}
+	if !tokenRe.MatchString(d.ID) {
+		http.Error(w, "bad id (letters, digits, _ and - only)", 400)
+		return
+	}
+	// check the codec now rather than on the first uplink
+	if !loraCodecs[d.Codec] {
+		http.Error(w, "unknown codec "+d.Codec, 400)
+		return
+	}
+	for _, f := range d.Layout {
+		if _, err := decodeStruct([]loraField{f}, make([]byte, 4)); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	b, _ := json.Marshal(d)
+	if _, err := l.kv.Put(d.DevEUI, b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, d)
+}
+
+// DELETE /api/lora/devices/{eui}
+func (l *lora) handleDelete(w http.ResponseWriter, req *http.Request) {
+	if err := l.kv.Delete(strings.ToLower(chi.URLParam(req, "eui"))); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// loraField is one entry of a "struct" codec layout: fields are read in order,
+// big-endian, and multiplied by scale (default 1).
+type loraField struct {
+	Name  string  `json:"name"`
+	Type  string  `json:"type"` // uint8, int8, uint16, int16, uint32, int32, float32
+	Scale float64 `json:"scale,omitempty"`
+}
+
+var loraCodecs = map[string]bool{"": true, "raw": true, "network": true, "cayenne_lpp": true, "struct": true}
+
+// decodeLoRa turns an uplink's bytes into telemetry fields using the
+// device's codec. network is the payload the network server already decoded
+// (TTN payload formatters, ChirpStack codecs), used by the "network" codec.
+func decodeLoRa(dev *loraDevice, payload []byte, network map[string]interface{}) (map[string]interface{}, error) {
+	switch dev.Codec {
+	case "network":
+		if network == nil {
+			return nil, fmt.Errorf("codec network: uplink has no decoded payload")
+		}
+		out := map[string]interface{}{}
+		for k, v := range network {
+			switch v.(type) {
+			case float64, bool:
+				out[k] = v
+			}
+		}
+		return out, nil
+	case "cayenne_lpp":
+		return decodeCayenneLPP(payload)
+	case "struct":
+		return decodeStruct(dev.Layout, payload)
+	case "", "raw":
+		return map[string]interface{}{}, nil
+	}
+	return nil, fmt.Errorf("unknown codec %q", dev.Codec)
+}
+
+func decodeStruct(layout []loraField, b []byte) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+	off := 0
+	for _, f := range layout {
+		var v float64
+		var n int
+		switch f.Type {
+		case "uint8", "int8":
+			n = 1
+		case "uint16", "int16":
+			n = 2
+		case "uint32", "int32", "float32":
+			n = 4
+		default:
+			return nil, fmt.Errorf("field %s: unknown type %q", f.Name, f.Type)
+		}
+		if off+n > len(b) {
+			return nil, fmt.Errorf("payload too short for field %s (%d bytes)", f.Name, len(b))
+		}
+		p := b[off : off+n]
+		switch f.Type {
+		case "uint8":
+			v = float64(p[0])
+		case "int8":
+			v = float64(int8(p[0]))
+		case "uint16":
+			v = float64(binary.BigEndian.Uint16(p))
+		case "int16":
+			v = float64(int16(binary.BigEndian.Uint16(p)))
+		case "uint32":
+			v = float64(binary.BigEndian.Uint32(p))
+		case "int32":
+			v = float64(int32(binary.BigEndian.Uint32(p)))
+		case "float32":
+			v = float64(math.Float32frombits(binary.BigEndian.Uint32(p)))
+		}
+		off += n
+		if f.Scale != 0 {
+			v *= f.Scale
+		}
+		out[f.Name] = v
+	}
+	return out, nil
+}
+
+// Cayenne LPP data types: size in bytes, divisor, field name(s).
+var lppTypes = map[byte]struct {
+	size    int
+	divisor float64
+	signed  bool
+	names   []string
+}{
+	0:   {1, 1, false, []string{"digital_in"}},
+	1:   {1, 1, false, []string{"digital_out"}},
+	2:   {2, 100, true, []string{"analog_in"}},
+	3:   {2, 100, true, []string{"analog_out"}},
+	101: {2, 1, false, []string{"illuminance"}},
+	102: {1, 1, false, []string{"presence"}},
+	103: {2, 10, true, []string{"temperature"}},
+	104: {1, 2, false, []string{"humidity"}},
+	113: {6, 1000, true, []string{"accel_x", "accel_y", "accel_z"}},
+	115: {2, 10, false, []string{"barometer"}},
+	134: {6, 100, true, []string{"gyro_x", "gyro_y", "gyro_z"}},
+	136: {9, 1, true, []string{"lat", "lon", "alt"}},
+}
+
+// decodeCayenneLPP decodes channel/type/value triplets into fields named
+// {name}_{channel}, e.g. temperature_1.
+func decodeCayenneLPP(b []byte) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+	for i := 0; i < len(b); {
+		if i+2 > len(b) {
+			return nil, fmt.Errorf("lpp: truncated header at byte %d", i)
+		}
+		ch, typ := b[i], b[i+1]
+		i += 2
+		t, ok := lppTypes[typ]
+		if !ok {
+			return nil, fmt.Errorf("lpp: unknown type %d on channel %d", typ, ch)
+		}
+		if i+t.size > len(b) {
+			return nil, fmt.Errorf("lpp: truncated value on channel %d", ch)
+		}
+		p := b[i : i+t.size]
+		i += t.size
+
+		if typ == 136 { // GPS: 3-byte lat/lon (1e-4 deg), alt (1e-2 m)
+			for k, name := range t.names {
+				raw := int32(uint32(p[3*k])<<24|uint32(p[3*k+1])<<16|uint32(p[3*k+2])<<8) >> 8
+				div := 10000.0
+				if name == "alt" {
+					div = 100
+				}
+				out[fmt.Sprintf("%s_%d", name, ch)] = float64(raw) / div
+			}
+			continue
+		}
+		width := t.size / len(t.names)
+		for k, name := range t.names {
+			q := p[k*width : (k+1)*width]
+			var raw float64
+			switch width {
+			case 1:
+				raw = float64(q[0])
+			case 2:
+				if t.signed {
+					raw = float64(int16(binary.BigEndian.Uint16(q)))
+				} else {
+					raw = float64(binary.BigEndian.Uint16(q))
+				}
+			}
+			out[fmt.Sprintf("%s_%d", name, ch)] = raw / t.divisor
+		}
+	}
+	return out, nil
+}
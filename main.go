@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/VazRibeiro/evabot-backend/internal/latency"
+	"github.com/VazRibeiro/evabot-backend/internal/layout"
+	"github.com/VazRibeiro/evabot-backend/internal/metrics"
+	"github.com/VazRibeiro/evabot-backend/internal/residency"
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/websocket"
 	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc"
 
 	"encoding/json"
-	"regexp"
-	"strings"
+	"strconv"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 )
@@ -20,6 +29,9 @@ import (
 var influxClient influxdb2.Client
 var influxOrg, influxBucket string
 
+// tsMaxPoints caps the points one /api/ts response carries (TS_MAX_POINTS).
+var tsMaxPoints = 100000
+
 var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
 
 func must(err error) {
@@ -29,24 +41,34 @@ func must(err error) {
 }
 
 func main() {
-	natsURL := env("NATS_URL", "nats://127.0.0.1:4222")
-	nc, err := nats.Connect(natsURL)
-	must(err)
-	js, err := nc.JetStream()
-	must(err)
-
-	// Ensure streams exist
-	ensure := func(cfg *nats.StreamConfig) {
-		if _, err := js.AddStream(cfg); err != nil && err != nats.ErrStreamNameAlreadyInUse {
+	if len(os.Args) > 1 && os.Args[1] == "all-in-one" {
+		must(runAllInOne())
+		return
+	}
+	if len(os.Args) > 1 {
+		if err := runConfigCLI(os.Args[1], os.Args[2:]); err != nil {
 			log.Fatal(err)
 		}
+		return
 	}
-	ensure(&nats.StreamConfig{Name: "TELEMETRY", Subjects: []string{"telemetry.>"}, Storage: nats.FileStorage, MaxAge: 365 * 24 * time.Hour})
-	ensure(&nats.StreamConfig{Name: "CTRL", Subjects: []string{"ctrl.>"}, Storage: nats.MemoryStorage, MaxMsgsPerSubject: 1000})
+
+	nc, err := nats.Connect(env("NATS_URL", "nats://127.0.0.1:4222"))
+	must(err)
+	serve(nc)
+}
+
+// serve runs the HTTP API on BIND until SIGINT or SIGTERM, then drains
+// WebSocket clients (see hub.drain) and finishes in-flight requests within
+// SHUTDOWN_GRACE.
+func serve(nc *nats.Conn) {
+	js, err := nc.JetStream()
+	must(err)
+	must(ensureStreams(js))
 
 	influxURL := env("INFLUX_URL", "http://127.0.0.1:8086")
 	influxOrg = env("INFLUX_ORG", "r4f")
 	influxBucket = env("INFLUX_BUCKET", "telemetry_raw")
+	tsMaxPoints = envInt("TS_MAX_POINTS", tsMaxPoints)
 	influxToken := os.Getenv("INFLUX_TOKEN")
 	if influxToken != "" {
 		influxClient = influxdb2.NewClient(influxURL, influxToken)
@@ -56,150 +78,611 @@ func main() {
 		log.Printf("influx query disabled (no INFLUX_TOKEN)")
 	}
 
-	r := chi.NewRouter()
-	r.Get("/healthz", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(204) })
+	diag := newDiagnostics(envDuration("DIAG_STALE", 30*time.Second))
+	must(diag.subscribe(nc))
 
-	// WebSocket: stream TELEMETRY to client
-	r.Get("/ws", func(w http.ResponseWriter, req *http.Request) {
-		c, err := upgrader.Upgrade(w, req, nil)
-		if err != nil {
-			return
-		}
-		defer c.Close()
+	reg, err := newRegistry(js)
+	must(err)
+	audit, err := newAuditLog(js)
+	must(err)
+	vers, err := newVersions(js, reg, audit)
+	must(err)
+	must(vers.subscribe(nc))
+	pl := &payloads{js: js, reg: reg}
+	must(pl.subscribe(nc))
+	protos, err := newProtocols(js, reg, envInt("PROTOCOL_MIN", protocolOldest))
+	must(err)
+	must(protos.subscribe(nc))
 
-		sub, err := js.SubscribeSync("telemetry.>")
-		if err != nil {
-			log.Println(err)
-			return
+	diagCmd, err := newDiagCommands(nc, audit, os.Getenv("DIAG_TOKEN"), os.Getenv("DIAG_COMMANDS"), envDuration("DIAG_TIMEOUT", 15*time.Second))
+	must(err)
+
+	cmds, err := newCommands(js)
+	must(err)
+	cmds.proto = protos
+
+	clock, err := newClockSync(js)
+	must(err)
+	rsvc, err := newRobotService(nc, js, clock)
+	must(err)
+
+	hbs := newHeartbeats(reg, clock, envInt("HEARTBEAT_LOST_AFTER", 3))
+	must(hbs.subscribe(nc))
+
+	conn := newConnectivity(hbs, clock, env("ROBOT_CLIENT_PREFIX", "robot-"))
+	must(conn.subscribe(nc))
+
+	state := newStateCache()
+	must(state.subscribe(nc))
+
+	pres, err := newPresence(js, reg, hbs, envDuration("PRESENCE_STALE", 10*time.Second), envDuration("PRESENCE_OFFLINE", time.Minute))
+	must(err)
+	must(pres.subscribe(nc))
+
+	bcast, err := newBroadcasts(js, reg, audit)
+	must(err)
+	must(bcast.subscribe(nc))
+
+	thr, err := newThrottle(js, os.Getenv("THROTTLE_POLICY"))
+	must(err)
+	must(thr.subscribe(nc))
+
+	r2r, err := newRelay(nc, js, os.Getenv("R2R_POLICY"), envDuration("R2R_RECORD_RETENTION", 7*24*time.Hour))
+	must(err)
+	must(r2r.subscribe())
+
+	infraDevs, err := newInfra(nc, js, audit)
+	must(err)
+
+	cfgStore := &configStore{js: js}
+
+	lock, err := newLockout(nc, js, audit, os.Getenv("BREAK_GLASS_TOKEN"), envDuration("LOCKOUT_HOLD_EVERY", 2*time.Second))
+	must(err)
+
+	wasmMods, err := newWasmModules(js, audit)
+	must(err)
+	schemas, err := newTelemetrySchemas(js, audit)
+	must(err)
+
+	tenantsReg, err := newTenants(js, audit)
+	must(err)
+
+	res, err := residency.Load(os.Getenv("INFLUX_REGIONS"), os.Getenv("TENANT_REGIONS"))
+	must(err)
+	ql, err := newQueryLog(js, envDuration("QUERY_LOG_RETENTION", 30*24*time.Hour), envDuration("QUERY_SLOW", 2*time.Second))
+	must(err)
+	budget := &queryBudget{reg: reg, maxPoints: float64(envInt("QUERY_MAX_POINTS", 1000000)), hz: float64(envInt("QUERY_ASSUMED_HZ", 10)),
+		reject: os.Getenv("QUERY_OVER_BUDGET") == "reject"}
+	tl := &timeline{js: js, cmds: cmds}
+	qlim := newQueryLimiter(envInt("QUERY_MAX_CONCURRENT", 8), envInt("QUERY_MAX_PER_USER", 2), envDuration("QUERY_QUEUE_WAIT", 2*time.Second))
+	rg := newRegions(res, os.Getenv("REGION"), tenantsReg, reg, audit)
+	defer rg.close()
+
+	sitesReg, err := newSites(js)
+	must(err)
+
+	lr, err := newLoRa(js, os.Getenv("LORA_WEBHOOK_TOKEN"))
+	must(err)
+
+	usersReg, err := newUsers(js, os.Getenv("ADMIN_PASSWORD"))
+	must(err)
+	authn, err := newAuth(js, usersReg, audit, os.Getenv("AUTH_SECRET"),
+		envDuration("ACCESS_TOKEN_TTL", 15*time.Minute), envDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		envInt("SESSION_MAX_PER_USER", 5), os.Getenv("AUTH_REQUIRED") != "false")
+	must(err)
+	authn.external, err = newExternalJWT()
+	must(err)
+	if !authn.required {
+		log.Printf("AUTH_REQUIRED=false: the API accepts unauthenticated requests")
+	}
+
+	appr, err := newApprovals(js, audit, os.Getenv("TWO_PERSON") == "true", envDuration("APPROVAL_WINDOW", 15*time.Minute), env("APPROVER_ROLES", "admin"))
+	must(err)
+
+	obs := &viewers{delay: envDuration("VIEWER_DELAY", time.Minute), every: envDuration("VIEWER_EVERY", 5*time.Second)}
+
+	tele := newTeleop(nc, thr, lock, audit, float64(envInt("TELEOP_RATE", 20)), envDuration("TELEOP_DEADMAN", 500*time.Millisecond))
+
+	rb := &rbac{reg: reg}
+	wsq := newWSQuotas(envInt("WS_MAX_CONNECTIONS", 1000), envInt("WS_MAX_PER_USER", 10), envInt("WS_MAX_SUBJECTS_PER_USER", 20))
+	poll := &poller{js: js, rbac: rb, maxWait: envDuration("POLL_MAX_WAIT", 25*time.Second)}
+	robotCmds, err := newRobotCommands(cmds, thr, pl, lock, os.Getenv("CMD_SCHEMAS"))
+	must(err)
+	announce, err := newAnnouncer(js, cmds, os.Getenv("ANNOUNCE_SOUNDS"))
+	must(err)
+	nrg, err := newEnergy(js, reg, envDuration("ENERGY_MAX_GAP", time.Minute))
+	must(err)
+	if env("ENERGY_ACCOUNTING", "on") != "off" {
+		must(nrg.subscribe(nc))
+		go nrg.run(envDuration("ENERGY_FLUSH", 30*time.Second))
+	}
+	budgets, err := newStorageBudgets(js, reg, audit, os.Getenv("STORAGE_BUDGETS"), envDuration("STORAGE_PRUNE_GRACE", time.Hour))
+	must(err)
+	if budgets.enabled() && env("STORAGE_ENFORCE", "on") != "off" {
+		go budgets.run(envDuration("STORAGE_CHECK_EVERY", 5*time.Minute))
+	}
+	lights, err := newIndicators(js, cmds, env("INDICATOR_PATTERNS", "off,idle,busy,charging,fault,attention"))
+	must(err)
+	wsHub, err := newHub(nc, js, rb, state, envInt("WS_CLIENT_BUFFER", 256), env("WS_DROP_POLICY", dropOldest),
+		envDuration("WS_RECONNECT_AFTER", 2*time.Second))
+	must(err)
+
+	alerts, err := newAlerting(js, rb, audit, env("ALERT_CHANNELS", `{"log":{"type":"log"}}`))
+	must(err)
+	digests, err := newDigests(js, alerts, usersReg)
+	must(err)
+	latencyKV, err := latency.Open(js)
+	must(err)
+	robotClocks, err := latency.WatchClock(js)
+	must(err)
+	host, _ := os.Hostname()
+	wsHub.lat = latency.NewRecorder(latencyKV, robotClocks, latency.Delivered, env("GATEWAY_INSTANCE", host))
+	if wsHub.latEvery = uint64(envInt("LATENCY_WS_SAMPLE", 10)); wsHub.latEvery < 1 {
+		log.Fatal("bad LATENCY_WS_SAMPLE: time one in N delivered messages, N at least 1")
+	}
+	go wsHub.lat.Run(time.Minute)
+	wsHub.pingEvery, wsHub.pongWait = envDuration("WS_PING_EVERY", 30*time.Second), envDuration("WS_PONG_WAIT", time.Minute)
+	if wsHub.writeWait = envDuration("WS_WRITE_WAIT", 10*time.Second); wsHub.writeWait <= 0 {
+		log.Fatal("bad WS_WRITE_WAIT: must be positive")
+	}
+	if wsHub.pingEvery > 0 && wsHub.pongWait <= wsHub.pingEvery {
+		log.Fatal("bad WS_PONG_WAIT: must be longer than WS_PING_EVERY")
+	}
+	upgrader.EnableCompression = env("WS_COMPRESSION", "on") != "off"
+	if wsHub.compressLevel = envInt("WS_COMPRESSION_LEVEL", 1); wsHub.compressLevel < 1 || wsHub.compressLevel > 9 {
+		log.Fatal("bad WS_COMPRESSION_LEVEL: 1 (fastest) to 9 (smallest)")
+	}
+	slo, err := newLatencySLO(latencyKV, rb, alerts, env("LATENCY_SLO", "p99<2s"), envDuration("LATENCY_SLO_WINDOW", 5*time.Minute),
+		os.Getenv("LATENCY_SLO_NOTIFY"))
+	must(err)
+	if env("ALERTING", "on") != "off" {
+		must(alerts.run(context.Background(), nc))
+		go slo.run(time.Minute)
+	}
+	quality, err := newDataQuality(js, reg, rb, audit)
+	must(err)
+	if env("QUALITY", "on") != "off" {
+		must(quality.run(context.Background(), nc))
+	}
+	fences, err := newGeofencing(js, rb, audit, cmds, env("GEOFENCE_SUBJECTS", "telemetry.*.gps"),
+		env("GEOFENCE_LAT_FIELD", "lat"), env("GEOFENCE_LON_FIELD", "lon"))
+	must(err)
+	if env("GEOFENCING", "on") != "off" {
+		must(fences.run(context.Background(), nc))
+	}
+	infer, err := newInference(js, audit)
+	must(err)
+	if env("INFERENCE", "on") != "off" {
+		must(infer.run(context.Background(), nc))
+	}
+	exps, err := newExperiments(js, reg, cmds, audit)
+	must(err)
+	go exps.run(context.Background())
+	labels, err := newLabeling(js, audit, rb)
+	must(err)
+	tl.labels = labels
+
+	telemetryLayouts, err = layout.Open(js)
+	must(err)
+	layouts := &layoutAdmin{store: telemetryLayouts, audit: audit}
+
+	rates, err := parseCostRates(os.Getenv("COST_RATES"))
+	must(err)
+	cost, err := newCosts(js, rg, rates)
+	must(err)
+	go cost.meter.Run(time.Minute)
+	wsHub.egress = cost.egressOf
+
+	registerGatewayMetrics(nc, wsHub)
+
+	var probe *canary
+	if env("CANARY", "off") == "on" {
+		var db *influxTarget
+		if influxClient != nil {
+			db = &influxTarget{Client: influxClient, Org: influxOrg, Bucket: influxBucket}
 		}
-		defer sub.Unsubscribe()
-
-		for {
-			msg, err := sub.NextMsg(5 * time.Second)
-			if err != nil {
-				continue
-			} // idle
-			if err := c.WriteMessage(websocket.BinaryMessage, msg.Data); err != nil {
-				return
-			}
+		robot := env("CANARY_ROBOT", "canary")
+		if !tokenRe.MatchString(robot) {
+			log.Fatal("bad CANARY_ROBOT")
 		}
-	})
+		every, deadline := envDuration("CANARY_EVERY", 5*time.Second), envDuration("CANARY_DEADLINE", 30*time.Second)
+		if every <= 0 || deadline < 2*every {
+			log.Fatal("bad CANARY_EVERY or CANARY_DEADLINE: the deadline must be at least twice the interval")
+		}
+		probe = newCanary(js, wsHub, db, robot, env("GATEWAY_INSTANCE", host), every, deadline)
+		must(probe.run(context.Background()))
+	}
 
-	// REST: e-stop (publish a tiny JSON)
-	r.Post("/api/robot/{id}/estop", func(w http.ResponseWriter, req *http.Request) {
-		id := chi.URLParam(req, "id")
-		_, err := js.Publish("ctrl."+id+".estop", []byte(`{"reason":"ui"}`))
-		if err != nil {
-			http.Error(w, err.Error(), 500)
+	r := chi.NewRouter()
+	appr.router = r
+	fleet := newFleetAPI(nc, authn, rb)
+	fleet.router = r
+	r.Use(instrument)
+	r.Use(lock.banner)
+	r.Use(authn.middleware)
+	r.Use(cost.egress) // after authn, to meter by the caller's tenant
+	r.Use(obs.middleware)
+	r.Get("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		if wsHub.draining() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
 			return
 		}
 		w.WriteHeader(204)
 	})
+	r.Get("/readyz", readyz(nc, wsHub, probe))
+	status, err := newStatusPage(nc, js, wsHub, probe, pres, reg, audit, env("STATUS_PAGE", "public"), os.Getenv("STATUS_PAGE_TOKEN"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	r.Get("/status", status.handlePage)
+	r.Get("/status.json", status.handleJSON)
+	r.Get("/api/incidents", status.handleList)
+	r.Post("/api/incidents", rb.admin(status.handleCreate))
+	r.Post("/api/incidents/{id}/updates", rb.admin(status.handleUpdate))
+	r.Delete("/api/incidents/{id}", rb.admin(status.handleDelete))
+	r.Handle("/metrics", metrics.Default.Handler())
 
-	// GET /api/ts?field=angle_deg&subject=telemetry.demo&start=-15m&window=1s
-	r.Get("/api/ts", func(w http.ResponseWriter, req *http.Request) {
-		if influxClient == nil {
-			http.Error(w, "influx not configured", http.StatusNotImplemented)
-			return
-		}
+	// Login sessions and accounts
+	r.Post("/api/auth/login", authn.handleLogin)
+	r.Post("/api/auth/refresh", authn.handleRefresh)
+	r.Post("/api/auth/logout", authn.handleLogout)
+	r.Get("/api/me", authn.handleMe)
+	r.Get("/api/users", rb.admin(authn.handleListUsers))
+	r.Put("/api/users/{name}", rb.admin(authn.handlePutUser))
+	r.Get("/api/users/{name}/sessions", rb.self(authn.handleListSessions))
+	r.Delete("/api/users/{name}/sessions", rb.self(authn.handleRevokeUser))
+	r.Delete("/api/users/{name}/sessions/{sid}", rb.self(authn.handleRevokeSession))
 
-		field := req.URL.Query().Get("field")
-		if field == "" {
-			field = "raw"
-		}
-		subject := req.URL.Query().Get("subject") // optional
-		start := req.URL.Query().Get("start")
-		if start == "" {
-			start = "-15m"
-		}
-		window := req.URL.Query().Get("window") // optional; mean aggregation
+	// Diagnostics: aggregated device tree per robot
+	r.Get("/api/robots/{id}/diagnostics", rb.watch(diag.handleGet))
+	r.Get("/ws/diagnostics/{id}", rb.watch(diag.handleWS))
+
+	// Registry and version inventory
+	r.Get("/api/robots", reg.handleList)
+	r.Post("/api/robots", rb.admin(reg.handleCreate))
+	r.Get("/api/robots/{id}", reg.handleGet)
+	r.Patch("/api/robots/{id}", rb.admin(reg.handlePatch))
+	r.Delete("/api/robots/{id}", rb.admin(reg.handleDelete))
+	r.Post("/api/robots/{id}/archive", rb.admin(reg.handleArchive))
+	r.Post("/api/robots/{id}/unarchive", rb.admin(reg.handleUnarchive))
+	r.Put("/api/robots/{id}/group", rb.admin(vers.handleSetGroup))
+	r.Get("/api/fleet/versions", vers.handleMatrix)
+	r.Get("/api/fleet/protocols", protos.handleReport)
+	r.Put("/api/groups/{group}/target-version", rb.admin(appr.require("fleet.target_version", vers.handleSetTarget)))
+
+	// Audit trail and gated diagnostic commands
+	r.Get("/api/audit", rb.admin(audit.handleList))
+	r.Get("/api/diag/commands", diagCmd.handleList)
+	r.Post("/api/robot/{id}/diag", rb.command(reg.known(diagCmd.handleExec)))
+
+	// Telemetry the worker gave up on, and replaying it after a fix
+	deadLetters := &dlq{js: js, audit: audit}
+	r.Get("/api/dlq", rb.operator(deadLetters.handleList))
+	r.Post("/api/dlq/replay", rb.admin(deadLetters.handleReplay))
+	r.Delete("/api/dlq/{seq}", rb.admin(deadLetters.handleDelete))
+
+	// Data robots fetch over svc.{id}.>
+	r.Get("/api/robots/{id}/config", rsvc.handleGetConfig)
+	r.Put("/api/robots/{id}/config", rb.command(reg.known(rsvc.handlePutConfig)))
+	r.Get("/api/robots/{id}/schedule", rsvc.handleGetSchedule)
+	r.Put("/api/robots/{id}/schedule", rb.command(reg.known(lock.guard(rsvc.handlePutSchedule))))
+	r.Get("/api/robots/{id}/clock", clock.handleGet)
+
+	// Heartbeat cadence and liveness
+	r.Get("/api/heartbeats", hbs.handleList)
+	r.Get("/api/robots/{id}/heartbeat", hbs.handleGet)
+	r.Get("/api/robots/{id}/connectivity", conn.handleGet)
+	r.Get("/api/robots/{id}/status", pres.handleStatus)
+	r.Get("/api/robot/{id}/state", rb.watch(state.handleGet))
+	r.Get("/api/r2r", r2r.handleStats)
+
+	// Doors, elevators and chargers robots depend on
+	r.Get("/api/infra", infraDevs.handleList)
+	r.Get("/api/infra/{id}", infraDevs.handleGet)
+	r.Put("/api/infra/{id}", rb.admin(infraDevs.handlePut))
+	r.Delete("/api/infra/{id}", rb.admin(infraDevs.handleDelete))
+	r.Post("/api/infra/{id}/cmd", rb.operator(lock.guard(infraDevs.handleCommand)))
+
+	// Whole-environment configuration export/import
+	r.Get("/api/config/export", cfgStore.handleExport)
+	r.Post("/api/config/import", rb.admin(cfgStore.handleImport))
+	r.Post("/api/config/diff", rb.admin(cfgStore.handleDiff))
+
+	// Emergency lockout
+	r.Get("/api/lockout", lock.handleGet)
+	r.Post("/api/lockout", lock.handleEngage)
+	r.Delete("/api/lockout", appr.require("lockout.release", lock.handleRelease))
+
+	// Two-person confirmation of staged destructive actions
+	r.Get("/api/approvals", appr.handleList)
+	r.Post("/api/approvals/{aid}/confirm", appr.handleConfirm)
+	r.Post("/api/approvals/{aid}/reject", appr.handleReject)
+
+	// Battery/thermal command limits
+	r.Get("/api/robots/{id}/limits", thr.handleGet)
+	r.Get("/api/throttle/policy", thr.handlePolicy)
+
+	// Teleoperation: command frames in, clamped setpoints out, dead-man stop
+	r.Get("/ws/ctrl/{id}", wsq.limit(ctrlSubject, rb.command(reg.known(lock.guard(tele.handleWS)))))
+
+	// WebSocket: stream TELEMETRY to clients through the shared hub
+	r.Get("/ws", wsq.limit(telemetrySubject, wsHub.handleTelemetryWS))
+	r.Get("/api/ws/stats", wsHub.handleStats)
+	r.Get("/api/admin/ws", rb.admin(wsHub.handleConns))
+	r.Delete("/api/admin/ws/{cid}", rb.admin(wsHub.handleKick))
+	r.Post("/api/admin/drain", rb.admin(wsHub.handleDrain))
+	r.Get("/api/admin/costs", rb.admin(cost.handleReport))
+	r.Get("/api/ws/quotas", wsq.handleStats)
 
-		// basic input hygiene for durations; allow RFC3339 too
-		okDur, _ := regexp.MatchString(`^-\d+[smhdw]$`, start)
-		if !okDur && !strings.Contains(start, "T") {
-			http.Error(w, "bad 'start' (use -15m or RFC3339 time)", 400)
+	// Long-polling fallback for networks without WebSocket or SSE
+	r.Get("/api/poll", poll.handlePoll)
+
+	// Schema-checked robot commands on ctrl.{id}.{name}
+	r.Get("/api/commands", robotCmds.handleSchemas)
+	r.Post("/api/robot/{id}/cmd", rb.command(reg.known(robotCmds.handleSend)))
+
+	// REST: e-stop (publish a tiny JSON); sent whatever the registry says, as
+	// an unregistered or archived robot may still be moving
+	r.Post("/api/robot/{id}/estop", rb.command(func(w http.ResponseWriter, req *http.Request) {
+		id := chi.URLParam(req, "id")
+		if !tokenRe.MatchString(id) {
+			http.Error(w, "bad robot id", 400)
 			return
 		}
-
-		flux := strings.Builder{}
-		flux.WriteString(`from(bucket:"` + influxBucket + `") |> range(start:` + start + `)`)
-		flux.WriteString(` |> filter(fn:(r)=> r._measurement == "telemetry")`)
-		flux.WriteString(` |> filter(fn:(r)=> r._field == "` + field + `")`)
-		if subject != "" {
-			flux.WriteString(` |> filter(fn:(r)=> r.subject == "` + subject + `")`)
+		dry, err := dryRun(req)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
 		}
-		if window != "" && field != "raw" {
-			flux.WriteString(` |> aggregateWindow(every:` + window + `, fn: mean, createEmpty: false)`)
+		if dry {
+			writePlan(w, cmds.plan(id, "estop", []byte(`{"reason":"ui"}`)))
+			return
 		}
-		flux.WriteString(` |> keep(columns: ["_time","_value","subject"])`)
-
-		q := influxClient.QueryAPI(influxOrg)
-		res, err := q.Query(req.Context(), flux.String())
-		if err != nil {
+		if rec, err := reg.get(id); errors.Is(err, errRobotNotFound) {
+			log.Printf("estop: %s isn't registered; sending anyway", id)
+		} else if err == nil && rec.Archived {
+			log.Printf("estop: %s is archived; sending anyway", id)
+		}
+		if _, err := cmds.publish(id, "estop", []byte(`{"reason":"ui"}`)); err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
-		defer res.Close()
+		w.WriteHeader(204)
+	}))
 
-		type point struct {
-			T time.Time   `json:"t"`
-			V interface{} `json:"v"`
-		}
-		type series struct {
-			Subject string  `json:"subject"`
-			Points  []point `json:"points"`
-		}
+	// Spoken warnings and sounds through a robot's speaker; not held by a
+	// lockout, which is when they matter most
+	r.Get("/api/sounds", announce.handleSounds)
+	r.Post("/api/robot/{id}/announce", rb.command(reg.known(announce.handleAnnounce)))
+	r.Get("/api/robot/{id}/announcements", rb.watch(announce.handleHistory))
 
-		if subject != "" {
-			out := struct {
-				Field   string  `json:"field"`
-				Subject string  `json:"subject"`
-				Points  []point `json:"points"`
-			}{
-				Field: field, Subject: subject, Points: make([]point, 0), // ensure [] not null
-			}
+	// Status lights: one place for what each robot should be signaling
+	r.Get("/api/indicators", lights.handleList)
+	r.Get("/api/robot/{id}/indicator", rb.watch(lights.handleGet))
+	r.Put("/api/robot/{id}/indicator", rb.command(reg.known(lights.handlePut)))
 
-			for res.Next() {
-				out.Points = append(out.Points, point{T: res.Record().Time(), V: res.Record().Value()})
-			}
-			if res.Err() != nil {
-				http.Error(w, res.Err().Error(), 500)
-				return
+	// Payloads (carts, tools) robots carry, as missions require them
+	r.Get("/api/robot/{id}/payloads", rb.watch(reg.known(pl.handleList)))
+	r.Post("/api/robot/{id}/payloads", rb.command(reg.known(pl.handleAttach)))
+	r.Delete("/api/robot/{id}/payloads/{pid}", rb.command(reg.known(pl.handleDetach)))
+
+	// Energy used per robot-day and per mission, split by zone
+	r.Get("/api/energy/daily", nrg.handleDaily)
+	r.Get("/api/energy/missions", nrg.handleMissions)
+	r.Get("/api/energy/missions/{mission}", nrg.handleMission)
+
+	// Storage budgets per stream and tenant, pruned when exceeded
+	r.Get("/api/storage", rb.operator(budgets.handleList))
+
+	// Influx layout changes: dual-write, compare, cut over
+	r.Get("/api/layouts", rb.operator(layouts.handleGet))
+	r.Get("/api/layouts/compare", rb.operator(rg.pin(layouts.handleCompare)))
+	r.Post("/api/layouts/begin", rb.admin(layouts.handleBegin))
+	r.Post("/api/layouts/cutover", rb.admin(layouts.handleCutover))
+	r.Post("/api/layouts/abort", rb.admin(layouts.handleAbort))
+	r.Post("/api/layouts/finish", rb.admin(layouts.handleFinish))
+
+	// Alert rules on live telemetry, and the alerts they raise
+	r.Get("/api/alerts", alerts.handleList)
+	r.Get("/ws/alerts", wsq.limit(alertsSubject, alerts.handleWS))
+	r.Get("/api/alerts/rules", alerts.handleListRules)
+	r.Get("/api/alerts/rules/{name}", alerts.handleGetRule)
+	r.Put("/api/alerts/rules/{name}", rb.admin(alerts.handlePutRule))
+	r.Delete("/api/alerts/rules/{name}", rb.admin(alerts.handleDeleteRule))
+	r.Get("/api/alerts/channels", alerts.handleChannels)
+	r.Post("/api/alerts/channels/{name}/test", rb.admin(alerts.handleTestChannel))
+	r.Get("/api/alerts/deliveries", alerts.handleDeliveries)
+	r.Get("/api/alerts/digests", rb.admin(digests.handleList))
+	r.Get("/api/alerts/digests/{name}", rb.self(digests.handleGet))
+	r.Put("/api/alerts/digests/{name}", rb.self(digests.handlePut))
+	r.Delete("/api/alerts/digests/{name}", rb.self(digests.handleDelete))
+
+	// Data quality: stuck and jumping fields, on events.quality.{robot}
+	r.Get("/api/quality", quality.handleList)
+	r.Get("/api/quality/rules", quality.handleListRules)
+	r.Get("/api/quality/rules/{name}", quality.handleGetRule)
+	r.Put("/api/quality/rules/{name}", rb.admin(quality.handlePutRule))
+	r.Delete("/api/quality/rules/{name}", rb.admin(quality.handleDeleteRule))
+
+	// Geofences: entry, exit and violation events on events.geofence.{id}
+	r.Get("/api/geofences", fences.handleList)
+	r.Get("/api/geofences/{id}", fences.handleGet)
+	r.Put("/api/geofences/{id}", rb.admin(fences.handlePut))
+	r.Delete("/api/geofences/{id}", rb.admin(fences.handleDelete))
+
+	// Online inference: model servers fed live telemetry, predictions
+	// published on telemetry.{robot}.inference.{model}
+	r.Get("/api/inference", infer.handleList)
+	r.Get("/api/inference/models", infer.handleListModels)
+	r.Get("/api/inference/models/{name}", infer.handleGetModel)
+	r.Put("/api/inference/models/{name}", rb.admin(infer.handlePutModel))
+	r.Delete("/api/inference/models/{name}", rb.admin(infer.handleDeleteModel))
+
+	// A/B experiments on robot parameters, compared on telemetry metrics
+	r.Get("/api/experiments", exps.handleList)
+	r.Get("/api/experiments/{id}", exps.handleGet)
+	r.Put("/api/experiments/{id}", rb.admin(exps.handlePut))
+	r.Delete("/api/experiments/{id}", rb.admin(exps.handleDelete))
+	r.Post("/api/experiments/{id}/start", rb.admin(lock.guard(exps.handleStart)))
+	r.Post("/api/experiments/{id}/stop", rb.admin(exps.handleStop))
+	r.Get("/api/experiments/{id}/report", rg.pin(qlim.limit(exps.handleReport)))
+
+	// Labeled telemetry ranges for training data; /api/ts exports them with
+	// include=labels
+	r.Get("/api/labels", labels.handleList)
+	r.Get("/api/robot/{id}/labels", rb.watch(labels.handleRobotList))
+	r.Post("/api/robot/{id}/labels", rb.operator(rb.watch(reg.known(labels.handleCreate))))
+	r.Put("/api/robot/{id}/labels/{lid}", rb.operator(rb.watch(labels.handleUpdate)))
+	r.Delete("/api/robot/{id}/labels/{lid}", rb.operator(rb.watch(labels.handleDelete)))
+
+	// Publish→persisted and publish→delivered latency, against LATENCY_SLO
+	r.Get("/api/slo/latency", slo.handleGet)
+
+	// Fleet-wide broadcasts with receipt tracking
+	r.Post("/api/fleet/broadcast", rb.fleet(lock.guard(bcast.handleSend)))
+	r.Get("/api/fleet/broadcasts", bcast.handleList)
+	r.Get("/api/fleet/broadcast/{bid}", bcast.handleReport)
+
+	// Command delivery tracking
+	r.Get("/api/robot/{id}/commands", rb.watch(cmds.handleList))
+	r.Delete("/api/robot/{id}/commands/{seq}", rb.command(reg.known(cmds.handleCancel)))
+
+	// WASM ingest transforms, run by the worker
+	r.Get("/api/transforms/wasm", wasmMods.handleList)
+	r.Put("/api/transforms/wasm/{name}", rb.admin(wasmMods.handlePut))
+	r.Post("/api/transforms/wasm/{name}/enable", rb.admin(wasmMods.handleEnable))
+	r.Post("/api/transforms/wasm/{name}/disable", rb.admin(wasmMods.handleDisable))
+	r.Delete("/api/transforms/wasm/{name}", rb.admin(wasmMods.handleDelete))
+
+	// JSON Schemas for telemetry payloads, enforced by the worker
+	r.Get("/api/schemas", schemas.handleList)
+	r.Get("/api/schemas/{name}", schemas.handleGet)
+	r.Put("/api/schemas/{name}", rb.admin(schemas.handlePut))
+	r.Delete("/api/schemas/{name}", rb.admin(schemas.handleDelete))
+	r.Post("/api/schemas/{name}/validate", schemas.handleValidate)
+
+	// Tenant branding and settings for the frontend
+	r.Get("/api/tenant/settings", tenantsReg.handleSettings)
+	r.Get("/api/tenants", tenantsReg.handleList)
+	r.Get("/api/tenants/{id}", tenantsReg.handleGet)
+	r.Put("/api/tenants/{id}", rb.admin(tenantsReg.handlePut))
+	r.Delete("/api/tenants/{id}", rb.admin(tenantsReg.handleDelete))
+
+	// Sites, for external context such as weather (cmd/enricher)
+	r.Get("/api/sites", sitesReg.handleList)
+	r.Get("/api/sites/{id}", sitesReg.handleGet)
+	r.Put("/api/sites/{id}", rb.admin(sitesReg.handlePut))
+	r.Delete("/api/sites/{id}", rb.admin(sitesReg.handleDelete))
+
+	// LoRaWAN network-server webhooks and device codecs
+	r.Post("/api/lora/uplink/{provider}", lr.handleUplink)
+	r.Get("/api/lora/devices", lr.handleList)
+	r.Put("/api/lora/devices/{eui}", rb.admin(lr.handlePut))
+	r.Delete("/api/lora/devices/{eui}", rb.admin(lr.handleDelete))
+
+	// Per-robot message outcome summaries written by the worker
+	r.Get("/api/pipeline/outcomes", rg.pin(ql.track("outcomes", qlim.limit(handleOutcomes))))
+
+	r.Get("/api/ts", rb.series(rg.pin(ql.track("ts", budget.guard("-15m", qlim.limit(tl.provide(handleTS)))))))
+	r.Get("/api/ts/meta", rb.series(rg.pin(ql.track("meta", qlim.limit(handleTSMeta)))))
+	r.Get("/api/ts/compare", rb.series(rg.pin(ql.track("compare", budget.guard("-1h", qlim.limit(handleTSCompare))))))
+
+	// High-frequency signals, stored as chunks by the worker (WAVE_SUBJECTS)
+	waves := &waveforms{js: js}
+	r.Get("/api/waveform", rb.series(rg.pin(ql.track("waveform", qlim.limit(waves.handleGet)))))
+
+	// Query audit: slow queries and per-user load
+	r.Get("/api/queries/slow", ql.handleSlow)
+	r.Get("/api/queries/stats", ql.handleStats)
+	r.Get("/api/queries/active", qlim.handleActive)
+
+	// Data residency: regions and robot ownership
+	r.Get("/api/regions", rg.handleList)
+	r.Put("/api/robots/{id}/tenant", rb.admin(rg.handleSetTenant))
+
+	// SCIM 2.0 provisioning from an IdP
+	if token := os.Getenv("SCIM_TOKEN"); token != "" {
+		sc, err := newSCIM(js, authn, token, os.Getenv("SCIM_GROUP_ROLES"))
+		must(err)
+		r.Route("/scim/v2", func(r chi.Router) {
+			r.Use(sc.authenticate)
+			r.Get("/ServiceProviderConfig", sc.handleConfig)
+			r.Get("/Users", sc.handleListUsers)
+			r.Post("/Users", sc.handleCreateUser)
+			r.Get("/Users/{id}", sc.handleGetUser)
+			r.Put("/Users/{id}", sc.handleReplaceUser)
+			r.Patch("/Users/{id}", sc.handlePatchUser)
+			r.Delete("/Users/{id}", sc.handleDeleteUser)
+			r.Get("/Groups", sc.handleListGroups)
+			r.Post("/Groups", sc.handleCreateGroup)
+			r.Get("/Groups/{id}", sc.handleGetGroup)
+			r.Put("/Groups/{id}", sc.handleReplaceGroup)
+			r.Patch("/Groups/{id}", sc.handlePatchGroup)
+			r.Delete("/Groups/{id}", sc.handleDeleteGroup)
+		})
+		log.Printf("SCIM provisioning enabled")
+	}
+
+	// Compiled web UI (STATIC_DIR or -tags embedui) with SPA fallback
+	if ui := newWebUI(os.Getenv("STATIC_DIR")); ui != nil {
+		r.Get("/config.js", ui.handleConfig)
+		r.NotFound(ui.ServeHTTP)
+		log.Printf("serving web UI")
+	}
+
+	// gRPC for services: GRPC_BIND (e.g. :9090), off when empty
+	var grpcSrv *grpc.Server
+	if gaddr := os.Getenv("GRPC_BIND"); gaddr != "" {
+		lis, err := net.Listen("tcp", gaddr)
+		must(err)
+		grpcSrv = fleet.server()
+		go func() {
+			if err := grpcSrv.Serve(lis); err != nil {
+				log.Fatal(err)
 			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(out)
-			return
-		}
+		}()
+		log.Printf("gRPC listening on %s", gaddr)
+	}
 
-		// group by subject
-		m := map[string][]point{}
-		for res.Next() {
-			s := res.Record().ValueByKey("subject")
-			sub, _ := s.(string)
-			m[sub] = append(m[sub], point{T: res.Record().Time(), V: res.Record().Value()})
-		}
-		if res.Err() != nil {
-			http.Error(w, res.Err().Error(), 500)
-			return
+	addr := env("BIND", ":8080")
+	srv := &http.Server{Addr: addr, Handler: r}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		grace := envDuration("SHUTDOWN_GRACE", 10*time.Second)
+		_, n := wsHub.drain()
+		log.Printf("shutting down: told %d WebSocket clients to reconnect", n)
+		wsHub.wait(grace)
+		sctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		if grpcSrv != nil {
+			// telemetry streams don't end by themselves
+			t := time.AfterFunc(grace, grpcSrv.Stop)
+			grpcSrv.GracefulStop()
+			t.Stop()
 		}
+		srv.Shutdown(sctx)
+	}()
+	log.Printf("backend listening on %s (NATS %s)", addr, nc.ConnectedUrl())
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
 
-		out := struct {
-			Field  string   `json:"field"`
-			Series []series `json:"series"`
-		}{
-			Field:  field,
-			Series: make([]series, 0), // ensure [] not null
-		}
-		for sub, pts := range m {
-			out.Series = append(out.Series, series{Subject: sub, Points: pts})
+// ensureStreams creates the streams the gateway and worker share.
+func ensureStreams(js nats.JetStreamContext) error {
+	for _, cfg := range []*nats.StreamConfig{
+		{Name: "TELEMETRY", Subjects: []string{"telemetry.>"}, Storage: nats.FileStorage, MaxAge: 365 * 24 * time.Hour},
+		{Name: "CTRL", Subjects: []string{"ctrl.>"}, Storage: nats.MemoryStorage, MaxMsgsPerSubject: 1000},
+		{Name: "EVENTS", Subjects: []string{"events.>"}, Storage: nats.FileStorage, MaxAge: 90 * 24 * time.Hour},
+		{Name: "TELEMETRY_DLQ", Subjects: []string{"dlq.>"}, Storage: nats.FileStorage, MaxAge: 30 * 24 * time.Hour},
+	} {
+		if _, err := js.AddStream(cfg); err != nil && err != nats.ErrStreamNameAlreadyInUse {
+			return err
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(out)
-	})
-
-	addr := env("BIND", ":8080")
-	log.Printf("backend listening on %s (NATS %s)", addr, natsURL)
-	must(http.ListenAndServe(addr, r))
+	}
+	return nil
 }
 
 func env(k, def string) string {
@@ -208,3 +691,35 @@ func env(k, def string) string {
 	}
 	return def
 }
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+func writeJSONStatus(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func envInt(k string, def int) int {
+	if v := os.Getenv(k); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("bad %s: %v", k, err)
+		}
+		return n
+	}
+	return def
+}
+
+func envDuration(k string, def time.Duration) time.Duration {
+	if v := os.Getenv(k); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("bad %s: %v", k, err)
+		}
+		return d
+	}
+	return def
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// attachment is a payload a robot carries: a cart, a tool on its changer, a
+// tote. IDs are unique across the fleet; Kind is what missions ask for.
+type attachment struct {
+	ID     string    `json:"id"`
+	Kind   string    `json:"kind"`
+	Since  time.Time `json:"since"`
+	Source string    `json:"source"` // telemetry or api
+	By     string    `json:"by,omitempty"`
+}
+
+var errPayloadElsewhere = errors.New("payload is attached to another robot")
+
+// payloads tracks what each robot carries, in its registry record (Payloads).
+// Robots report attach and detach on telemetry.{id}.payload:
+//
+//	{"event":"attach","id":"cart-7","kind":"cart"}
+//	{"event":"detach","id":"cart-7"}
+//
+// and operators correct the record over the API. A payload is on one robot
+// at a time: a robot reporting one another robot had takes it over, while
+// the API refuses that with 409. Every change is published on
+// events.payload.{id}.
+type payloads struct {
+	js  nats.JetStreamContext
+	reg *registry
+}
+
+func (p *payloads) subscribe(nc *nats.Conn) error {
+	_, err := nc.Subscribe("telemetry.*.payload", func(msg *nats.Msg) {
+		id := telem.RobotID(msg.Subject)
+		var in struct {
+			Event string `json:"event"`
+			ID    string `json:"id"`
+			Kind  string `json:"kind"`
+		}
+		if err := json.Unmarshal(msg.Data, &in); err != nil || !tokenRe.MatchString(in.ID) {
+			log.Printf("payloads: bad report from %s: %s", id, msg.Data)
+			return
+		}
+		var err error
+		switch in.Event {
+		case "attach":
+			err = p.attach(id, attachment{ID: in.ID, Kind: in.Kind, Source: "telemetry"}, true)
+		case "detach":
+			err = p.detach(id, in.ID, "telemetry", "")
+		default:
+			err = fmt.Errorf("unknown event %q", in.Event)
+		}
+		if err != nil {
+			log.Printf("payloads: %s: %v", id, err)
+		}
+	})
+	return err
+}
+
+// carrier finds the robot carrying payload pid, if any.
+func (p *payloads) carrier(pid string) (string, error) {
+	robots, err := p.reg.list()
+	if err != nil {
+		return "", err
+	}
+	for _, r := range robots {
+		for _, a := range r.Payloads {
+			if a.ID == pid {
+				return r.ID, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// attach records a on robot id; take lets it leave the robot that had it.
+func (p *payloads) attach(id string, a attachment, take bool) error {
+	if !tokenRe.MatchString(a.Kind) {
+		return fmt.Errorf("bad or missing payload kind")
+	}
+	if _, err := p.reg.get(id); err != nil {
+		return err
+	}
+	prev, err := p.carrier(a.ID)
+	if err != nil {
+		return err
+	}
+	if prev != "" && prev != id {
+		if !take {
+			return fmt.Errorf("%w (%s)", errPayloadElsewhere, prev)
+		}
+		if err := p.detach(prev, a.ID, a.Source, a.By); err != nil {
+			return err
+		}
+	}
+	a.Since = time.Now()
+	if _, err := p.reg.updateExisting(id, func(r *robot) error {
+		kept := r.Payloads[:0]
+		for _, x := range r.Payloads {
+			if x.ID != a.ID {
+				kept = append(kept, x)
+			}
+		}
+		r.Payloads = append(kept, a)
+		return nil
+	}); err != nil {
+		return err
+	}
+	return p.event(id, "attach", a)
+}
+
+func (p *payloads) detach(id, pid, source, by string) error {
+	if _, err := p.reg.get(id); err != nil {
+		return err
+	}
+	var gone *attachment
+	if _, err := p.reg.updateExisting(id, func(r *robot) error {
+		gone = nil
+		kept := r.Payloads[:0]
+		for _, x := range r.Payloads {
+			if x.ID == pid {
+				gone = &x
+			} else {
+				kept = append(kept, x)
+			}
+		}
+		r.Payloads = kept
+		return nil
+	}); err != nil {
+		return err
+	}
+	if gone == nil {
+		return nil
+	}
+	gone.Source, gone.By = source, by
+	return p.event(id, "detach", *gone)
+}
+
+func (p *payloads) event(id, event string, a attachment) error {
+	b, _ := json.Marshal(map[string]interface{}{"robot": id, "event": event, "payload": a.ID, "kind": a.Kind,
+		"source": a.Source, "by": a.By, "ts": time.Now()})
+	_, err := p.js.Publish("events.payload."+id, b)
+	return err
+}
+
+// missing returns the requirements robot id's payloads don't meet; each is
+// a payload kind or a payload id.
+func (p *payloads) missing(id string, requires []string) ([]string, error) {
+	if len(requires) == 0 {
+		return nil, nil
+	}
+	r, err := p.reg.get(id)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, need := range requires {
+		met := false
+		for _, a := range r.Payloads {
+			if a.Kind == need || a.ID == need {
+				met = true
+			}
+		}
+		if !met {
+			out = append(out, need)
+		}
+	}
+	return out, nil
+}
+
+// GET /api/robot/{id}/payloads
+func (p *payloads) handleList(w http.ResponseWriter, req *http.Request) {
+	r, err := p.reg.get(chi.URLParam(req, "id"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := r.Payloads
+	if out == nil {
+		out = []attachment{}
+	}
+	writeJSON(w, out)
+}
+
+// POST /api/robot/{id}/payloads with {"id":"cart-7","kind":"cart"} records an
+// attachment the robot couldn't report itself; 409 if another robot has it.
+func (p *payloads) handleAttach(w http.ResponseWriter, req *http.Request) {
+	var a attachment
+	if err := json.NewDecoder(req.Body).Decode(&a); err != nil {
+		http.Error(w, "bad body: "+err.Error(), 400)
+		return
+	}
+	if !tokenRe.MatchString(a.ID) || !tokenRe.MatchString(a.Kind) {
+		http.Error(w, "bad payload id or kind (letters, digits, _ and - only)", 400)
+		return
+	}
+	a.Source, a.By = "api", actorOf(req)
+	err := p.attach(chi.URLParam(req, "id"), a, false)
+	switch {
+	case errors.Is(err, errPayloadElsewhere):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+	default:
+		w.WriteHeader(204)
+	}
+}
+
+// DELETE /api/robot/{id}/payloads/{pid}
+func (p *payloads) handleDetach(w http.ResponseWriter, req *http.Request) {
+	if err := p.detach(chi.URLParam(req, "id"), chi.URLParam(req, "pid"), "api", actorOf(req)); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	relDurRe = regexp.MustCompile(`^-\d+[smhdw]$`)
+	durRe    = regexp.MustCompile(`^\d+(ms|s|m|h|d|w|mo|y)$`)
+	tokenRe  = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+	// Flux identifiers we accept from callers: field keys and NATS subjects
+	fieldRe   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.\-]{0,127}$`)
+	subjectRe = regexp.MustCompile(`^[A-Za-z0-9_\-]+(\.[A-Za-z0-9_\-]+){0,15}$`)
+	tzRe      = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_+\-/]{0,63}$`)
+)
+
+// validTime accepts a relative duration (-15m) or an RFC3339 time.
+func validTime(s string) bool {
+	if relDurRe.MatchString(s) {
+		return true
+	}
+	_, err := time.Parse(time.RFC3339, s)
+	return err == nil
+}
+
+// GET /api/pipeline/outcomes?start=-7d&stop=...&robot=...&every=1d&tz=Europe/Lisbon
+//
+// Sums the worker's per-robot message outcomes (stored, quarantined,
+// dropped_bad_ts, ...) over the range, optionally bucketed by `every`, on
+// tz's calendar when given (as /api/ts).
+func handleOutcomes(w http.ResponseWriter, req *http.Request) {
+	db := influxOf(req)
+	if db == nil {
+		http.Error(w, "influx not configured", http.StatusNotImplemented)
+		return
+	}
+	q := req.URL.Query()
+	start, stop := q.Get("start"), q.Get("stop")
+	if start == "" {
+		start = "-24h"
+	}
+	if !validTime(start) || (stop != "" && !validTime(stop)) {
+		http.Error(w, "bad 'start'/'stop' (use -15m or RFC3339 time)", 400)
+		return
+	}
+	robot, every := q.Get("robot"), q.Get("every")
+	if robot != "" && !tokenRe.MatchString(robot) {
+		http.Error(w, "bad 'robot'", 400)
+		return
+	}
+	if every != "" && !durRe.MatchString(every) {
+		http.Error(w, "bad 'every'", 400)
+		return
+	}
+	tz := q.Get("tz")
+	if tz != "" {
+		if _, err := time.LoadLocation(tz); err != nil || !tzRe.MatchString(tz) {
+			http.Error(w, "bad 'tz' (an IANA zone such as Europe/Lisbon)", 400)
+			return
+		}
+	}
+
+	flux := strings.Builder{}
+	if tz != "" {
+		flux.WriteString(`import "timezone" option location = timezone.location(name: "` + tz + `") `)
+	}
+	flux.WriteString(`from(bucket:"` + db.Bucket + `") |> range(start:` + start)
+	if stop != "" {
+		flux.WriteString(`, stop:` + stop)
+	}
+	flux.WriteString(`)`)
+	flux.WriteString(` |> filter(fn:(r)=> r._measurement == "pipeline_outcomes" and r._field == "count")`)
+	if robot != "" {
+		flux.WriteString(` |> filter(fn:(r)=> r.robot == "` + robot + `")`)
+	}
+	flux.WriteString(` |> group(columns: ["robot","outcome"])`)
+	if every != "" {
+		offset := ""
+		if strings.HasSuffix(every, "w") {
+			offset = `, offset: -3d` // weeks start on Monday
+		}
+		flux.WriteString(` |> aggregateWindow(every:` + every + offset + `, fn: sum, createEmpty: false)`)
+	} else {
+		flux.WriteString(` |> sum()`)
+	}
+
+	res, err := db.Client.QueryAPI(db.Org).Query(req.Context(), flux.String())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer res.Close()
+
+	type period struct {
+		T        time.Time        `json:"t"`
+		Outcomes map[string]int64 `json:"outcomes"`
+	}
+	type row struct {
+		Robot    string           `json:"robot"`
+		Outcomes map[string]int64 `json:"outcomes"`
+		Periods  []*period        `json:"periods,omitempty"`
+	}
+	rows := map[string]*row{}
+	periods := map[string]map[time.Time]*period{}
+	for res.Next() {
+		traceOf(req).addPoints(1)
+		rec := res.Record()
+		rb, _ := rec.ValueByKey("robot").(string)
+		oc, _ := rec.ValueByKey("outcome").(string)
+		n, _ := rec.Value().(int64)
+		r := rows[rb]
+		if r == nil {
+			r = &row{Robot: rb, Outcomes: map[string]int64{}}
+			rows[rb] = r
+			periods[rb] = map[time.Time]*period{}
+		}
+		r.Outcomes[oc] += n
+		if every != "" {
+			p := periods[rb][rec.Time()]
+			if p == nil {
+				p = &period{T: rec.Time(), Outcomes: map[string]int64{}}
+				periods[rb][rec.Time()] = p
+				r.Periods = append(r.Periods, p)
+			}
+			p.Outcomes[oc] += n
+		}
+	}
+	if res.Err() != nil {
+		http.Error(w, res.Err().Error(), 500)
+		return
+	}
+
+	out := make([]*row, 0, len(rows))
+	for _, r := range rows {
+		sort.Slice(r.Periods, func(i, j int) bool { return r.Periods[i].T.Before(r.Periods[j].T) })
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Robot < out[j].Robot })
+	writeJSON(w, map[string]interface{}{"start": start, "stop": stop, "robots": out})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// pollMsg is one telemetry message in a poll batch. Data is the payload as
+// JSON, or as a string when it isn't JSON.
+type pollMsg struct {
+	Seq     uint64          `json:"seq"`
+	Subject string          `json:"subject"`
+	TS      time.Time       `json:"ts"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// poller is the live path of last resort, for networks that pass neither
+// WebSocket nor SSE: plain requests that wait up to maxWait for telemetry
+// after a TELEMETRY stream sequence. Scoped callers (rbac) only get their
+// robots; viewers get the delayed, decimated feed.
+type poller struct {
+	js      nats.JetStreamContext
+	rbac    *rbac
+	maxWait time.Duration
+}
+
+// GET /api/poll?cursor=1234&robot=r1&max=100&wait=25s returns
+// {"cursor":…,"messages":[…]}: the messages from sequence cursor on (new ones
+// only without a cursor), as soon as there are any or when wait runs out.
+// The next poll passes the returned cursor.
+func (p *poller) handlePoll(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	subject := "telemetry.>"
+	if id := q.Get("robot"); id != "" {
+		if !tokenRe.MatchString(id) {
+			http.Error(w, "bad robot id", 400)
+			return
+		}
+		subject = "telemetry." + id + ".>"
+	}
+	limit := 100
+	if v := q.Get("max"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, "bad 'max' (1-1000)", 400)
+			return
+		}
+		limit = n
+	}
+	wait := p.maxWait
+	if v := q.Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "bad 'wait' (e.g. 25s)", 400)
+			return
+		}
+		wait = min(d, p.maxWait)
+	}
+	var cursor uint64
+	if v := q.Get("cursor"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || n == 0 {
+			http.Error(w, "bad 'cursor'", 400)
+			return
+		}
+		cursor = n
+	} else {
+		info, err := p.js.StreamInfo("TELEMETRY")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		cursor = info.State.LastSeq + 1
+	}
+
+	sub, err := p.js.SubscribeSync(subject, nats.OrderedConsumer(), nats.StartSequence(cursor))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer sub.Unsubscribe()
+
+	scope := p.rbac.filter(identityOf(req))
+	view := viewerOf(req)
+	last := map[string]time.Time{} // viewer decimation, per subject
+	out := []pollMsg{}
+	deadline := time.Now().Add(wait)
+	for len(out) < limit {
+		ctx, cancel := context.WithDeadline(req.Context(), deadline)
+		m, err := sub.NextMsgWithContext(ctx)
+		cancel()
+		if err != nil {
+			break // wait ran out, or the client left
+		}
+		md, err := m.Metadata()
+		if err != nil {
+			continue
+		}
+		if view != nil {
+			if due := md.Timestamp.Add(view.Delay); time.Now().Before(due) {
+				if len(out) > 0 || due.After(deadline) {
+					break // send it in a later poll, from this cursor
+				}
+				time.Sleep(time.Until(due))
+			}
+		}
+		cursor = md.Sequence.Stream + 1
+		keep := scope == nil || scope.allows(m.Subject)
+		if keep && view != nil {
+			if md.Timestamp.Sub(last[m.Subject]) < view.Every {
+				keep = false
+			} else {
+				last[m.Subject] = md.Timestamp
+			}
+		}
+		if keep {
+			data := json.RawMessage(m.Data)
+			if !json.Valid(data) {
+				data, _ = json.Marshal(string(m.Data))
+			}
+			out = append(out, pollMsg{Seq: md.Sequence.Stream, Subject: m.Subject, TS: md.Timestamp, Data: data})
+		}
+		if len(out) > 0 && md.NumPending == 0 {
+			break // caught up: answer now rather than holding the batch
+		}
+	}
+	writeJSON(w, map[string]interface{}{"cursor": cursor, "messages": out})
+}
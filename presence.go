@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// Presence derived from telemetry arrival.
+const (
+	presOnline  = "online"  // telemetry within the stale timeout
+	presStale   = "stale"   // quiet for longer, but not yet offline
+	presOffline = "offline" // quiet past the offline timeout, or never heard from
+)
+
+type robotPresence struct {
+	state    string
+	since    time.Time            // when state began
+	lastSeen time.Time            // last telemetry message
+	subjects map[string]time.Time // subject → last message
+}
+
+// presence tells whether robots are online from their telemetry: a robot is
+// online while any telemetry.{id}.> message arrived within stale, stale until
+// offline has passed, then offline. Transitions are published on
+// events.presence.{id} as {"robot","state","previous","last_seen","ts"}.
+// Heartbeats (heartbeats) say whether the robot's process is alive; presence
+// says whether its data is flowing, and the status endpoint reports both.
+type presence struct {
+	js      nats.JetStreamContext
+	reg     *registry
+	hbs     *heartbeats
+	stale   time.Duration
+	offline time.Duration
+
+	mu     sync.Mutex
+	robots map[string]*robotPresence
+}
+
+func newPresence(js nats.JetStreamContext, reg *registry, hbs *heartbeats, stale, offline time.Duration) (*presence, error) {
+	if stale <= 0 || offline <= stale {
+		return nil, errors.New("presence: need 0 < PRESENCE_STALE < PRESENCE_OFFLINE")
+	}
+	return &presence{js: js, reg: reg, hbs: hbs, stale: stale, offline: offline, robots: map[string]*robotPresence{}}, nil
+}
+
+// subscribe follows telemetry and starts re-classifying robots as they go
+// quiet.
+func (p *presence) subscribe(nc *nats.Conn) error {
+	if _, err := nc.Subscribe("telemetry.>", func(msg *nats.Msg) {
+		if id := telem.RobotID(msg.Subject); id != "" {
+			p.seen(id, msg.Subject, time.Now())
+		}
+	}); err != nil {
+		return err
+	}
+	go p.watch()
+	return nil
+}
+
+func (p *presence) seen(id, subject string, now time.Time) {
+	p.mu.Lock()
+	rp := p.robots[id]
+	if rp == nil {
+		rp = &robotPresence{state: presOffline, subjects: map[string]time.Time{}}
+		p.robots[id] = rp
+	}
+	rp.lastSeen = now
+	rp.subjects[subject] = now
+	prev := rp.state
+	changed := p.set(rp, presOnline, now)
+	p.mu.Unlock()
+	if changed {
+		p.publish(id, presOnline, prev, now)
+	}
+}
+
+// set moves rp to state, reporting whether that was a change.
+func (p *presence) set(rp *robotPresence, state string, now time.Time) bool {
+	if rp.state == state {
+		return false
+	}
+	rp.state, rp.since = state, now
+	return true
+}
+
+func (p *presence) classify(lastSeen, now time.Time) string {
+	switch since := now.Sub(lastSeen); {
+	case lastSeen.IsZero() || since >= p.offline:
+		return presOffline
+	case since >= p.stale:
+		return presStale
+	default:
+		return presOnline
+	}
+}
+
+func (p *presence) watch() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for now := range t.C {
+		type change struct {
+			id, state, prev string
+			lastSeen        time.Time
+		}
+		var changes []change
+		p.mu.Lock()
+		for id, rp := range p.robots {
+			prev := rp.state
+			if state := p.classify(rp.lastSeen, now); p.set(rp, state, now) {
+				changes = append(changes, change{id, state, prev, rp.lastSeen})
+			}
+		}
+		p.mu.Unlock()
+		for _, c := range changes {
+			p.publish(c.id, c.state, c.prev, c.lastSeen)
+		}
+	}
+}
+
+// stateOf is robot id's presence at now.
+func (p *presence) stateOf(id string, now time.Time) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if rp := p.robots[id]; rp != nil {
+		return p.classify(rp.lastSeen, now)
+	}
+	return presOffline
+}
+
+func (p *presence) publish(id, state, prev string, lastSeen time.Time) {
+	b, _ := json.Marshal(map[string]interface{}{"robot": id, "state": state, "previous": prev, "last_seen": lastSeen, "ts": time.Now()})
+	if _, err := p.js.Publish("events.presence."+id, b); err != nil {
+		log.Printf("presence: publish event for %s: %v", id, err)
+	}
+}
+
+type subjectPresence struct {
+	Subject  string     `json:"subject"`
+	State    string     `json:"state"`
+	LastSeen *time.Time `json:"last_seen"` // null for an expected subject never seen
+	Expected bool       `json:"expected,omitempty"`
+}
+
+type presenceStatus struct {
+	Robot     string            `json:"robot"`
+	State     string            `json:"state"`
+	Since     *time.Time        `json:"since,omitempty"`
+	LastSeen  *time.Time        `json:"last_seen"`
+	Heartbeat string            `json:"heartbeat"`
+	StaleMs   int64             `json:"stale_ms"`
+	OfflineMs int64             `json:"offline_ms"`
+	Subjects  []subjectPresence `json:"subjects"`
+}
+
+// GET /api/robots/{id}/status: the robot's presence, each telemetry subject's
+// (including subjects the registry expects but that never arrived), and its
+// heartbeat state.
+func (p *presence) handleStatus(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	r, err := p.reg.get(id)
+	if err != nil && !errors.Is(err, errRobotNotFound) {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	now := time.Now()
+	out := presenceStatus{Robot: id, State: presOffline, StaleMs: p.stale.Milliseconds(), OfflineMs: p.offline.Milliseconds(),
+		Subjects: []subjectPresence{}}
+	out.Heartbeat, _ = p.hbs.state(id, now)
+
+	seen := map[string]time.Time{}
+	p.mu.Lock()
+	rp := p.robots[id]
+	if rp != nil {
+		out.State = rp.state
+		since, last := rp.since, rp.lastSeen
+		out.Since, out.LastSeen = &since, &last
+		for s, t := range rp.subjects {
+			seen[s] = t
+		}
+	}
+	p.mu.Unlock()
+	if rp == nil && r == nil {
+		http.Error(w, "unknown robot: not registered and no telemetry seen", http.StatusNotFound)
+		return
+	}
+
+	expected := map[string]bool{}
+	if r != nil {
+		for _, s := range r.Subjects {
+			expected[s] = true
+			if _, ok := seen[s]; !ok {
+				out.Subjects = append(out.Subjects, subjectPresence{Subject: s, State: presOffline, Expected: true})
+			}
+		}
+	}
+	for s, t := range seen {
+		out.Subjects = append(out.Subjects, subjectPresence{Subject: s, State: p.classify(t, now), LastSeen: &t, Expected: expected[s]})
+	}
+	sort.Slice(out.Subjects, func(i, j int) bool { return out.Subjects[i].Subject < out.Subjects[j].Subject })
+	writeJSON(w, out)
+}
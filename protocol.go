@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/metrics"
+	"github.com/nats-io/nats.go"
+)
+
+// Robot protocol versions, which fix how a robot and the backend talk:
+//
+//	1  telemetry is {"ts":<epoch ms>,"values":{…}}; a command's payload is
+//	   its params alone.
+//	2  telemetry is {"ts_ns":…,"data":{…}} or flat fields; a command is
+//	   {"name","params","priority","requires","requested_by","ts_ns"}.
+const (
+	protocolOldest  = 1
+	protocolCurrent = 2
+)
+
+// protocolHeader carries a robot's protocol version on any message it
+// publishes, for robots that don't say hello.
+const protocolHeader = "Evabot-Protocol"
+
+// protocolRefresh is how often an unchanged announcement is written back,
+// so reported stays roughly current without a write per heartbeat.
+const protocolRefresh = time.Hour
+
+// robotProtocol is what a robot last said it speaks.
+type robotProtocol struct {
+	Version   int       `json:"version"`             // negotiated
+	Supported []int     `json:"supported,omitempty"` // as announced
+	Envelope  string    `json:"envelope,omitempty"`  // payload encoding: json, cbor, msgpack
+	Agent     string    `json:"agent,omitempty"`     // e.g. evabot-agent/1.4.2
+	Source    string    `json:"source"`              // hello or header
+	Reported  time.Time `json:"reported"`
+}
+
+// protocols negotiates protocol versions with robots and bridges the ones
+// behind protocolCurrent, so a fleet can upgrade robot by robot:
+//
+//   - A robot says hello on connect, a request on hello.{id}:
+//     {"protocols":[1,2],"envelope":"json","agent":"evabot-agent/1.4.2"}
+//     and is answered with the version to speak, the newest both sides
+//     know: {"protocol":2,"current":2,"min":1,"deprecated":false}. A robot
+//     knowing none at or above PROTOCOL_MIN, or not registered, is refused
+//     ("error").
+//   - A robot that doesn't say hello may put Evabot-Protocol: N on its
+//     heartbeats instead.
+//
+// The version is kept on the robot's registry record. Commands to a robot
+// on version 1 are cut down to their params (see shimCommand), and version
+// 1 telemetry, published on v1.telemetry.{id}.…, is republished as version
+// 2 on telemetry.{id}.…. GET /api/fleet/protocols shows who speaks what,
+// and which robots stand in the way of raising PROTOCOL_MIN.
+type protocols struct {
+	js     nats.JetStreamContext
+	reg    *registry
+	min    int // PROTOCOL_MIN
+	shims  *metrics.Counter
+	hellos *metrics.Counter
+
+	mu    sync.Mutex
+	known map[string]robotProtocol // by robot, as this gateway last wrote it
+}
+
+func newProtocols(js nats.JetStreamContext, reg *registry, min int) (*protocols, error) {
+	if min < protocolOldest || min > protocolCurrent {
+		return nil, errors.New("bad PROTOCOL_MIN: " + strconv.Itoa(protocolOldest) + " to " + strconv.Itoa(protocolCurrent))
+	}
+	return &protocols{js: js, reg: reg, min: min, known: map[string]robotProtocol{},
+		shims:  metrics.NewCounter("evabot_protocol_shimmed_total", "Messages converted for robots on an older protocol, by version and direction (up, down).", "version", "direction"),
+		hellos: metrics.NewCounter("evabot_protocol_hellos_total", "Robot hellos by outcome (accepted, refused).", "outcome")}, nil
+}
+
+func (p *protocols) subscribe(nc *nats.Conn) error {
+	// queue groups: one gateway answers, records and republishes each
+	if _, err := nc.QueueSubscribe("hello.*", "protocols", p.handleHello); err != nil {
+		return err
+	}
+	if _, err := nc.QueueSubscribe("heartbeat.*", "protocols", func(msg *nats.Msg) {
+		if v := msg.Header.Get(protocolHeader); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < protocolOldest || n > protocolCurrent {
+				return
+			}
+			p.record(strings.TrimPrefix(msg.Subject, "heartbeat."), robotProtocol{Version: n, Source: "header"})
+		}
+	}); err != nil {
+		return err
+	}
+	_, err := nc.QueueSubscribe("v1.telemetry.>", "protocols", p.upgradeV1)
+	return err
+}
+
+// negotiate picks the newest version both sides know, 0 for none.
+func (p *protocols) negotiate(supported []int) int {
+	best := 0
+	for _, v := range supported {
+		if v >= p.min && v <= protocolCurrent && v > best {
+			best = v
+		}
+	}
+	return best
+}
+
+// handleHello answers a robot's hello.{id} request.
+func (p *protocols) handleHello(msg *nats.Msg) {
+	id := strings.TrimPrefix(msg.Subject, "hello.")
+	var in struct {
+		Protocol  int    `json:"protocol"`
+		Protocols []int  `json:"protocols"`
+		Envelope  string `json:"envelope"`
+		Agent     string `json:"agent"`
+	}
+	reply := map[string]interface{}{"current": protocolCurrent, "min": p.min}
+	if err := json.Unmarshal(msg.Data, &in); err != nil || !tokenRe.MatchString(id) {
+		reply["error"] = "bad hello"
+	} else {
+		if in.Protocol > 0 && len(in.Protocols) == 0 {
+			in.Protocols = []int{in.Protocol}
+		}
+		if _, err := p.reg.get(id); errors.Is(err, errRobotNotFound) {
+			reply["error"] = "robot " + id + " isn't registered"
+		} else if v := p.negotiate(in.Protocols); v == 0 {
+			reply["error"] = "no common protocol version (the backend speaks " + strconv.Itoa(p.min) + " to " + strconv.Itoa(protocolCurrent) + ")"
+		} else {
+			reply["protocol"], reply["deprecated"] = v, v < protocolCurrent
+			p.record(id, robotProtocol{Version: v, Supported: in.Protocols, Envelope: in.Envelope, Agent: in.Agent, Source: "hello"})
+		}
+	}
+	outcome := "accepted"
+	if reply["error"] != nil {
+		outcome = "refused"
+		log.Printf("protocol: hello from %s refused: %v", id, reply["error"])
+	}
+	p.hellos.Inc(outcome)
+	if msg.Reply != "" {
+		b, _ := json.Marshal(reply)
+		msg.Respond(b)
+	}
+}
+
+// record keeps what robot id announced, writing the registry only when it
+// changed or protocolRefresh has passed.
+func (p *protocols) record(id string, rp robotProtocol) {
+	now := time.Now().UTC()
+	p.mu.Lock()
+	last, ok := p.known[id]
+	same := ok && last.Version == rp.Version && (rp.Source == "header" || (last.Envelope == rp.Envelope && last.Agent == rp.Agent))
+	if same && now.Sub(last.Reported) < protocolRefresh {
+		p.mu.Unlock()
+		return
+	}
+	if same {
+		rp = last // a header says less than the hello before it
+	}
+	rp.Reported = now
+	p.known[id] = rp
+	p.mu.Unlock()
+	_, err := p.reg.updateExisting(id, func(r *robot) error {
+		r.Protocol = &rp
+		return nil
+	})
+	switch {
+	case errors.Is(err, errRobotNotFound):
+		p.mu.Lock()
+		delete(p.known, id) // not registered: nothing to keep
+		p.mu.Unlock()
+	case err != nil:
+		log.Printf("protocol: %s: %v", id, err)
+	}
+}
+
+// versionOf is the protocol robot id speaks, protocolCurrent when it hasn't
+// said. It reads the registry, as another gateway may have heard the hello.
+func (p *protocols) versionOf(id string) int {
+	if r, err := p.reg.get(id); err == nil && r.Protocol != nil {
+		return r.Protocol.Version
+	}
+	return protocolCurrent
+}
+
+// shimCommand turns a command payload into what robot id's protocol
+// expects.
+func (p *protocols) shimCommand(id string, payload []byte) []byte {
+	if p.versionOf(id) != 1 {
+		return payload
+	}
+	var cmd struct {
+		Params json.RawMessage `json:"params"`
+	}
+	if json.Unmarshal(payload, &cmd) != nil {
+		return payload
+	}
+	p.shims.Inc("1", "down")
+	if len(cmd.Params) == 0 {
+		return []byte("{}")
+	}
+	return cmd.Params
+}
+
+// upgradeV1 republishes version 1 telemetry as version 2.
+func (p *protocols) upgradeV1(msg *nats.Msg) {
+	subject := strings.TrimPrefix(msg.Subject, "v1.")
+	var in struct {
+		TS     json.Number            `json:"ts"`
+		Values map[string]interface{} `json:"values"`
+	}
+	if err := json.Unmarshal(msg.Data, &in); err != nil {
+		log.Printf("protocol: bad v1 telemetry on %s: %v", msg.Subject, err)
+		return
+	}
+	out := map[string]interface{}{"data": in.Values}
+	if ms, err := in.TS.Int64(); err == nil && ms > 0 {
+		out["ts_ns"] = ms * int64(time.Millisecond)
+	}
+	b, _ := json.Marshal(out)
+	if _, err := p.js.Publish(subject, b); err != nil {
+		log.Printf("protocol: republish %s: %v", subject, err)
+		return
+	}
+	p.shims.Inc("1", "up")
+}
+
+// GET /api/fleet/protocols counts robots by protocol version and lists, for
+// each version below protocolCurrent, the robots that would be cut off if
+// PROTOCOL_MIN were raised past it; robots that never said count as
+// "unknown", as they may be older still.
+func (p *protocols) handleReport(w http.ResponseWriter, _ *http.Request) {
+	robots, err := p.reg.active()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	type entry struct {
+		Robot    string    `json:"robot"`
+		Version  int       `json:"version"`
+		Agent    string    `json:"agent,omitempty"`
+		Reported time.Time `json:"reported"`
+	}
+	out := struct {
+		Current  int                `json:"current"`
+		Min      int                `json:"min"`
+		Counts   map[string]int     `json:"counts"`   // version or "unknown" →
+		Blocking map[string][]entry `json:"blocking"` // version → robots on it
+		Unknown  []string           `json:"unknown"`
+	}{Current: protocolCurrent, Min: p.min, Counts: map[string]int{}, Blocking: map[string][]entry{}, Unknown: []string{}}
+	for _, r := range robots {
+		if r.Protocol == nil {
+			out.Counts["unknown"]++
+			out.Unknown = append(out.Unknown, r.ID)
+			continue
+		}
+		v := strconv.Itoa(r.Protocol.Version)
+		out.Counts[v]++
+		if r.Protocol.Version < protocolCurrent {
+			out.Blocking[v] = append(out.Blocking[v], entry{r.ID, r.Protocol.Version, r.Protocol.Agent, r.Protocol.Reported})
+		}
+	}
+	for _, list := range out.Blocking {
+		sort.Slice(list, func(i, j int) bool { return list[i].Robot < list[j].Robot })
+	}
+	writeJSON(w, out)
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/metrics"
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// qualityRulesBucket holds one qualityRule per key, by name.
+const qualityRulesBucket = "QUALITY_RULES"
+
+// Data-quality findings, the kind of a qualityEvent.
+const (
+	qualityStuck     = "stuck"     // the field hasn't changed for the rule's stuck_for
+	qualityRecovered = "recovered" // a stuck field changed again
+	qualityJump      = "jump"      // the field changed implausibly between two readings
+	qualityOutlier   = "outlier"   // the field is far from its peers'
+	qualityInLine    = "in_line"   // an outlier is back among its peers
+)
+
+// qualityJumpQuiet is the least time between two jump events of one series;
+// jumps in between are counted into the next.
+const qualityJumpQuiet = 10 * time.Second
+
+// maxQualityHistory bounds the events kept for GET /api/quality.
+const maxQualityHistory = 500
+
+// A robot is only compared with its fleet when at least fleetMinPeers
+// robots of its model (itself included) have readings in the window;
+// comparisons run every fleetCheckEvery.
+const (
+	fleetMinPeers   = 5
+	fleetCheckEvery = 30 * time.Second
+)
+
+// qualityRule checks a field that should vary and move smoothly, e.g. an
+// encoder that mustn't freeze or teleport:
+//
+//	{"subject":"telemetry.*.drive","field":"encoder_l","stuck_for":"5m","max_jump":2000,"max_rate":500}
+//
+// stuck_for flags readings that stayed within tolerance (default 0, exactly
+// equal) of each other that long; max_jump flags a change between
+// consecutive readings larger than it, max_rate one faster than it per
+// second.
+//
+// fleet_z compares robots with their peers instead of with fixed limits,
+// catching the motor that draws more current than every other robot of its
+// model while staying under any threshold: each robot's mean over
+// fleet_window (default 10m) is held against the median of the means of
+// the robots with the same registry model, and one whose robust z-score
+// (distance from the median in scaled median absolute deviations) is over
+// fleet_z is an outlier until it is back within it.
+//
+// A rule needs at least one of stuck_for, max_jump, max_rate and fleet_z.
+// Each subject matching a rule is a series of its own, so one rule watches
+// every robot.
+type qualityRule struct {
+	Name      string    `json:"name"`
+	Subject   string    `json:"subject"`
+	Field     string    `json:"field"`
+	StuckFor  string    `json:"stuck_for,omitempty"`
+	Tolerance float64   `json:"tolerance,omitempty"`
+	MaxJump   float64   `json:"max_jump,omitempty"`
+	MaxRate   float64   `json:"max_rate,omitempty"`
+	FleetZ    float64   `json:"fleet_z,omitempty"`
+	FleetWin  string    `json:"fleet_window,omitempty"`
+	Disabled  bool      `json:"disabled,omitempty"`
+	Updated   time.Time `json:"updated"`
+	By        string    `json:"by,omitempty"`
+
+	stuckFor, fleetWindow time.Duration
+}
+
+// compile checks r and parses its duration.
+func (r *qualityRule) compile() error {
+	if !strings.HasPrefix(r.Subject, "telemetry.") {
+		return errors.New("subject must be a telemetry.… pattern")
+	}
+	if !fieldRe.MatchString(r.Field) {
+		return errors.New("bad field")
+	}
+	if r.StuckFor != "" {
+		var err error
+		if r.stuckFor, err = time.ParseDuration(r.StuckFor); err != nil || r.stuckFor <= 0 {
+			return fmt.Errorf("bad stuck_for %q", r.StuckFor)
+		}
+	}
+	if r.Tolerance < 0 || r.MaxJump < 0 || r.MaxRate < 0 || r.FleetZ < 0 {
+		return errors.New("tolerance, max_jump, max_rate and fleet_z can't be negative")
+	}
+	r.fleetWindow = 10 * time.Minute
+	if r.FleetWin != "" {
+		var err error
+		if r.fleetWindow, err = time.ParseDuration(r.FleetWin); err != nil || r.fleetWindow < time.Minute {
+			return fmt.Errorf("bad fleet_window %q (at least 1m)", r.FleetWin)
+		}
+	}
+	if r.stuckFor == 0 && r.MaxJump == 0 && r.MaxRate == 0 && r.FleetZ == 0 {
+		return errors.New("a rule needs stuck_for, max_jump, max_rate or fleet_z")
+	}
+	return nil
+}
+
+// qualityEvent is published on events.quality.{robot}.
+type qualityEvent struct {
+	Rule     string    `json:"rule"`
+	Robot    string    `json:"robot"`
+	Subject  string    `json:"subject"`
+	Field    string    `json:"field"`
+	Kind     string    `json:"kind"`               // stuck, recovered, jump, outlier or in_line
+	Value    float64   `json:"value"`              // outlier, in_line: the robot's mean over the window
+	Previous *float64  `json:"previous,omitempty"` // jump: the reading before
+	Rate     *float64  `json:"rate,omitempty"`     // jump: change per second
+	Jumps    int       `json:"jumps,omitempty"`    // jump: how many since the last event
+	Model    string    `json:"model,omitempty"`    // outlier, in_line: the peers'
+	Baseline *float64  `json:"baseline,omitempty"` // outlier, in_line: the peers' median
+	Z        *float64  `json:"z,omitempty"`        // outlier, in_line: the robust z-score
+	Peers    int       `json:"peers,omitempty"`    // outlier, in_line: robots compared
+	Since    time.Time `json:"since"`              // stuck: since when; jump: the reading before's time; in_line: outlier since
+	TS       time.Time `json:"ts"`
+}
+
+// qualitySeries is one rule's state for one subject.
+type qualitySeries struct {
+	rule    string
+	subject string
+	last    float64
+	lastAt  time.Time
+	seen    bool
+	ref     float64   // the value the field has stayed near
+	refAt   time.Time // since when
+	stuck   bool
+	jumps   int // since the last jump event
+	jumpAt  time.Time
+	current *qualityEvent // while stuck
+	robot   string
+	minutes []qualityMinute // fleet_z rules, oldest first
+	outlier *qualityEvent   // while an outlier
+}
+
+// qualityMinute sums a series' readings in one minute.
+type qualityMinute struct {
+	minute int64
+	sum    float64
+	n      int
+}
+
+// mean is the series' mean over the minutes from since; ok is false
+// without readings.
+func (s *qualitySeries) mean(since time.Time) (float64, bool) {
+	from := since.Unix() / 60
+	var sum float64
+	var n int
+	for _, m := range s.minutes {
+		if m.minute >= from {
+			sum, n = sum+m.sum, n+m.n
+		}
+	}
+	return sum / float64(n), n > 0
+}
+
+// dataQuality watches live telemetry for sensors that freeze or jump, the
+// faults that pass threshold alerts by (a stuck encoder reads a perfectly
+// plausible position). Rules live in the QUALITY_RULES bucket; like
+// alerting, evaluation keeps its state in memory and runs where QUALITY
+// isn't off, which should be one gateway. Findings are published on
+// events.quality.{robot}, so they show in the robot's timeline.
+type dataQuality struct {
+	js    nats.JetStreamContext
+	kv    nats.KeyValue
+	reg   *registry // models, for fleet_z
+	rb    *rbac
+	audit *auditLog
+	found *metrics.Counter
+
+	mu      sync.Mutex
+	rules   map[string]*qualityRule
+	series  map[string]*qualitySeries // rule:subject →
+	history []qualityEvent            // oldest first
+}
+
+func newDataQuality(js nats.JetStreamContext, reg *registry, rb *rbac, audit *auditLog) (*dataQuality, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: qualityRulesBucket, History: 5, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	return &dataQuality{js: js, kv: kv, reg: reg, rb: rb, audit: audit,
+		found: metrics.NewCounter("evabot_data_quality_events_total", "Data-quality findings by kind (stuck, recovered, jump, outlier, in_line).", "kind"),
+		rules: map[string]*qualityRule{}, series: map[string]*qualitySeries{}}, nil
+}
+
+// run follows the rules bucket and telemetry until ctx is done.
+func (q *dataQuality) run(ctx context.Context, nc *nats.Conn) error {
+	w, err := q.kv.WatchAll()
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer w.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-w.Updates():
+				if e != nil {
+					q.setRule(e)
+				}
+			}
+		}
+	}()
+	sub, err := nc.Subscribe("telemetry.>", func(msg *nats.Msg) {
+		now := time.Now()
+		subject := telem.TrimFormat(msg.Subject)
+		if !q.matches(subject) {
+			return
+		}
+		p, err := telem.DecodeAny(msg.Subject, msg.Header.Get("Content-Type"), msg.Data, now, now)
+		if err != nil {
+			return
+		}
+		q.observe(subject, p)
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Unsubscribe()
+		t := time.NewTicker(fleetCheckEvery)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				q.compareFleet(now)
+			}
+		}
+	}()
+	return nil
+}
+
+func (q *dataQuality) setRule(e nats.KeyValueEntry) {
+	var r qualityRule
+	ok := e.Operation() == nats.KeyValuePut && json.Unmarshal(e.Value(), &r) == nil
+	if ok {
+		if err := r.compile(); err != nil {
+			log.Printf("quality: rule %s: not applied: %v", e.Key(), err)
+			ok = false
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// a changed rule starts over
+	for key, s := range q.series {
+		if s.rule == e.Key() {
+			delete(q.series, key)
+		}
+	}
+	if ok && !r.Disabled {
+		q.rules[e.Key()] = &r
+	} else {
+		delete(q.rules, e.Key())
+	}
+}
+
+func (q *dataQuality) matches(subject string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, r := range q.rules {
+		if telem.SubjectMatches(r.Subject, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// observe checks one reading against the rules matching subject.
+func (q *dataQuality) observe(subject string, p telem.Point) {
+	robot := robotOfSubject(subject)
+	var events []qualityEvent
+	q.mu.Lock()
+	for name, r := range q.rules {
+		if !telem.SubjectMatches(r.Subject, subject) {
+			continue
+		}
+		v, ok := numeric(p.Fields[r.Field])
+		if !ok || math.IsNaN(v) {
+			continue
+		}
+		key := name + ":" + subject
+		s := q.series[key]
+		if s == nil {
+			s = &qualitySeries{rule: name, subject: subject, robot: robot}
+			q.series[key] = s
+		}
+		if r.FleetZ > 0 {
+			minute := p.Time.Unix() / 60
+			if n := len(s.minutes); n > 0 && s.minutes[n-1].minute == minute {
+				s.minutes[n-1].sum += v
+				s.minutes[n-1].n++
+			} else if n == 0 || minute > s.minutes[n-1].minute {
+				s.minutes = append(s.minutes, qualityMinute{minute, v, 1})
+			}
+			for len(s.minutes) > 0 && s.minutes[0].minute < (p.Time.Unix()-int64(r.fleetWindow.Seconds()))/60 {
+				s.minutes = s.minutes[1:]
+			}
+		}
+		if !s.seen {
+			s.seen, s.last, s.lastAt, s.ref, s.refAt = true, v, p.Time, v, p.Time
+			continue
+		}
+		if p.Time.Before(s.lastAt) {
+			continue // replayed or reordered
+		}
+		ev := qualityEvent{Rule: name, Robot: robot, Subject: subject, Field: r.Field, Value: v, TS: p.Time}
+
+		if r.MaxJump > 0 || r.MaxRate > 0 {
+			delta := math.Abs(v - s.last)
+			var rate float64
+			if dt := p.Time.Sub(s.lastAt).Seconds(); dt > 0 {
+				rate = delta / dt
+			}
+			if (r.MaxJump > 0 && delta > r.MaxJump) || (r.MaxRate > 0 && rate > r.MaxRate) {
+				s.jumps++
+				if p.Time.Sub(s.jumpAt) >= qualityJumpQuiet {
+					prev := s.last
+					e := ev
+					e.Kind, e.Previous, e.Jumps, e.Since = qualityJump, &prev, s.jumps, s.lastAt
+					if rate > 0 {
+						e.Rate = &rate
+					}
+					events = append(events, e)
+					s.jumps, s.jumpAt = 0, p.Time
+				}
+			}
+		}
+
+		if r.stuckFor > 0 {
+			switch {
+			case math.Abs(v-s.ref) > r.Tolerance:
+				if s.stuck {
+					e := ev
+					e.Kind, e.Since = qualityRecovered, s.refAt
+					events = append(events, e)
+				}
+				s.ref, s.refAt, s.stuck, s.current = v, p.Time, false, nil
+			case !s.stuck && p.Time.Sub(s.refAt) >= r.stuckFor:
+				e := ev
+				e.Kind, e.Since = qualityStuck, s.refAt
+				events = append(events, e)
+				s.stuck, s.current = true, &e
+			}
+		}
+		s.last, s.lastAt = v, p.Time
+	}
+	q.record(events)
+	q.mu.Unlock()
+	for _, e := range events {
+		q.publish(e)
+	}
+}
+
+// record keeps events for GET /api/quality; q.mu is held.
+func (q *dataQuality) record(events []qualityEvent) {
+	q.history = append(q.history, events...)
+	if len(q.history) > maxQualityHistory {
+		q.history = q.history[len(q.history)-maxQualityHistory:]
+	}
+}
+
+// compareFleet holds each fleet_z rule's robots against the peers of their
+// model.
+func (q *dataQuality) compareFleet(now time.Time) {
+	q.mu.Lock()
+	fleet := false
+	for _, r := range q.rules {
+		fleet = fleet || r.FleetZ > 0
+	}
+	q.mu.Unlock()
+	if !fleet {
+		return
+	}
+	robots, err := q.reg.active()
+	if err != nil {
+		log.Printf("quality: fleet baseline: %v", err)
+		return
+	}
+	models := map[string]string{}
+	for _, r := range robots {
+		models[r.ID] = r.Model
+	}
+
+	var events []qualityEvent
+	q.mu.Lock()
+	for name, r := range q.rules {
+		if r.FleetZ <= 0 {
+			continue
+		}
+		type member struct {
+			s    *qualitySeries
+			mean float64
+		}
+		peers := map[string][]member{} // model →
+		for _, s := range q.series {
+			if s.rule != name || models[s.robot] == "" {
+				continue
+			}
+			if m, ok := s.mean(now.Add(-r.fleetWindow)); ok {
+				peers[models[s.robot]] = append(peers[models[s.robot]], member{s, m})
+			} else {
+				s.outlier = nil // quiet for the whole window; nothing to compare
+			}
+		}
+		for model, ms := range peers {
+			if len(ms) < fleetMinPeers {
+				continue
+			}
+			means := make([]float64, len(ms))
+			for i, m := range ms {
+				means[i] = m.mean
+			}
+			med := median(means)
+			devs := make([]float64, len(ms))
+			for i, m := range ms {
+				devs[i] = math.Abs(m.mean - med)
+			}
+			mad := median(devs) * 1.4826 // scaled to a normal distribution's standard deviation
+			if mad == 0 {
+				continue // most robots read the same; nothing to scale by
+			}
+			for _, m := range ms {
+				z := (m.mean - med) / mad
+				out := math.Abs(z) > r.FleetZ
+				if out == (m.s.outlier != nil) {
+					continue
+				}
+				baseline, zz := med, z
+				e := qualityEvent{Rule: name, Robot: m.s.robot, Subject: m.s.subject, Field: r.Field, Value: m.mean,
+					Model: model, Baseline: &baseline, Z: &zz, Peers: len(ms), Since: now, TS: now}
+				if out {
+					e.Kind = qualityOutlier
+					m.s.outlier = &e
+				} else {
+					e.Kind, e.Since = qualityInLine, m.s.outlier.Since
+					m.s.outlier = nil
+				}
+				events = append(events, e)
+			}
+		}
+	}
+	q.record(events)
+	q.mu.Unlock()
+	for _, e := range events {
+		q.publish(e)
+	}
+}
+
+func median(xs []float64) float64 {
+	sort.Float64s(xs)
+	n := len(xs)
+	if n%2 == 1 {
+		return xs[n/2]
+	}
+	return (xs[n/2-1] + xs[n/2]) / 2
+}
+
+func (q *dataQuality) publish(e qualityEvent) {
+	q.found.Inc(e.Kind)
+	b, _ := json.Marshal(e)
+	if _, err := q.js.Publish("events.quality."+e.Robot, b); err != nil {
+		log.Printf("quality: publish %s %s for %s: %v", e.Kind, e.Rule, e.Subject, err)
+	}
+}
+
+// GET /api/quality[?robot=] lists the fields stuck now and the robots out
+// of line with their peers, then recent findings, newest first, within the
+// caller's scope.
+func (q *dataQuality) handleList(w http.ResponseWriter, req *http.Request) {
+	id := identityOf(req)
+	robot := req.URL.Query().Get("robot")
+	keep := func(e qualityEvent) bool { return (robot == "" || e.Robot == robot) && q.rb.sees(id, e.Robot) }
+	out := struct {
+		Stuck    []qualityEvent `json:"stuck"`
+		Outliers []qualityEvent `json:"outliers"`
+		Recent   []qualityEvent `json:"recent"`
+	}{Stuck: []qualityEvent{}, Outliers: []qualityEvent{}, Recent: []qualityEvent{}}
+	q.mu.Lock()
+	for _, s := range q.series {
+		if s.current != nil && keep(*s.current) {
+			out.Stuck = append(out.Stuck, *s.current)
+		}
+		if s.outlier != nil && keep(*s.outlier) {
+			out.Outliers = append(out.Outliers, *s.outlier)
+		}
+	}
+	for i := len(q.history) - 1; i >= 0; i-- {
+		if keep(q.history[i]) {
+			out.Recent = append(out.Recent, q.history[i])
+		}
+	}
+	q.mu.Unlock()
+	sort.Slice(out.Stuck, func(i, j int) bool { return out.Stuck[i].Since.Before(out.Stuck[j].Since) })
+	sort.Slice(out.Outliers, func(i, j int) bool { return math.Abs(*out.Outliers[i].Z) > math.Abs(*out.Outliers[j].Z) })
+	writeJSON(w, out)
+}
+
+func (q *dataQuality) getRule(name string) (*qualityRule, error) {
+	e, err := q.kv.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	var r qualityRule
+	if err := json.Unmarshal(e.Value(), &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// GET /api/quality/rules
+func (q *dataQuality) handleListRules(w http.ResponseWriter, _ *http.Request) {
+	keys, err := kvKeys(q.kv, ">")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := []qualityRule{}
+	for _, k := range keys {
+		if r, err := q.getRule(k); err == nil {
+			out = append(out, *r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	writeJSON(w, out)
+}
+
+// GET /api/quality/rules/{name}
+func (q *dataQuality) handleGetRule(w http.ResponseWriter, req *http.Request) {
+	r, err := q.getRule(chi.URLParam(req, "name"))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such rule", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, r)
+}
+
+// PUT /api/quality/rules/{name} creates or replaces a rule (see qualityRule).
+func (q *dataQuality) handlePutRule(w http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, "name")
+	if !tokenRe.MatchString(name) {
+		http.Error(w, "bad rule name", 400)
+		return
+	}
+	var r qualityRule
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64<<10)).Decode(&r); err != nil {
+		http.Error(w, "bad JSON", 400)
+		return
+	}
+	r.Name, r.Updated, r.By = name, time.Now().UTC(), actorOf(req)
+	if err := r.compile(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := q.audit.record(auditRecord{Actor: r.By, Action: "quality_rule.put", Details: map[string]interface{}{"name": name, "subject": r.Subject, "field": r.Field, "disabled": r.Disabled}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	b, _ := json.Marshal(r)
+	if _, err := q.kv.Put(name, b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, r)
+}
+
+// DELETE /api/quality/rules/{name}
+func (q *dataQuality) handleDeleteRule(w http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, "name")
+	if _, err := q.getRule(name); errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such rule", 404)
+		return
+	}
+	if err := q.audit.record(auditRecord{Actor: actorOf(req), Action: "quality_rule.delete", Details: map[string]interface{}{"name": name}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	if err := q.kv.Delete(name); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
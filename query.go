@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+)
+
+// GET /api/ts?field=angle_deg&subject=telemetry.demo&start=-15m&window=1s&agg=max
+//
+// With a window, points are aggregated per window by agg: mean (the
+// default), min, max, median, last, count, stddev, or percentile with
+// q=0.95. tz=Europe/Lisbon aligns windows to that zone's calendar: 1d is a
+// local day, 1mo a calendar month, 1y a year; week windows start on Monday.
+// fill gives every window a point for charting: null (empty windows
+// as null values), previous (carry the last value forward), linear
+// (interpolate between neighbours) or 0.
+//
+// field may list several, field=x,y,heading: the result is pivoted to one
+// point per time, shaped {"t":…,"values":{"x":…,"y":…,"heading":…}}, under
+// "fields" instead of "field".
+//
+// Results come in pages of at most limit points per series (maximum
+// TS_MAX_POINTS) starting at offset, and at most TS_MAX_POINTS in all: a
+// query without a subject, over every subject with data in the range, gets
+// a default limit of TS_MAX_POINTS shared between them, and is refused if
+// it asks for more, so no series is ever cut short of its page and one
+// next_offset continues them all. A cut-short page says so:
+// "truncated":true and "next_offset" in JSON, a last
+// {"truncated":true,"next_offset":…} line in NDJSON, and for every format an
+// X-Truncated trailer.
+//
+// format=csv (or Accept: text/csv) gives time,subject,{field…} rows and
+// format=ndjson (or Accept: application/x-ndjson) one point per line; every
+// format is streamed as Influx returns rows. For one robot's subject,
+// include=events,commands,labels interleaves that robot's events, the
+// commands sent to it and the labels on its telemetry (at their start, with
+// their end in the record) by time, as their own rows (CSV channel/data
+// columns) or lines.
+//
+// Channels the worker packs (PACK_FIELDS, see telem.PackField) come back
+// sample by sample without a window; with one, windows aggregate the runs'
+// means. limit, offset and TS_MAX_POINTS count stored points, a packed run as
+// one.
+//
+// Every parameter is checked against a strict pattern before it reaches the
+// Flux text (the Influx OSS query API has no bind parameters), so a value
+// can't close a string literal and append its own Flux.
+//
+// Callers who see only some robots (rbac.series) must name one's subject.
+// Viewers get no raw field, a window of at least VIEWER_EVERY, and nothing
+// newer than VIEWER_DELAY.
+func handleTS(w http.ResponseWriter, req *http.Request) {
+	db := influxOf(req)
+	if db == nil {
+		http.Error(w, "influx not configured", http.StatusNotImplemented)
+		return
+	}
+
+	field := req.URL.Query().Get("field")
+	if field == "" {
+		field = "raw"
+	}
+	subject := req.URL.Query().Get("subject") // optional
+	start := req.URL.Query().Get("start")
+	if start == "" {
+		start = "-15m"
+	}
+	window := req.URL.Query().Get("window") // optional; aggregated by agg
+	agg := req.URL.Query().Get("agg")
+	fill := req.URL.Query().Get("fill")
+	tz := req.URL.Query().Get("tz")
+	format := tsFormat(req)
+	if format == "" {
+		http.Error(w, "unsupported 'format' (json, csv or ndjson)", 400)
+		return
+	}
+	limit, offset := tsMaxPoints, 0
+	limitSet := req.URL.Query().Get("limit") != ""
+	if v := req.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "bad 'limit'", 400)
+			return
+		}
+		limit = min(n, tsMaxPoints)
+	}
+	if v := req.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "bad 'offset'", 400)
+			return
+		}
+		offset = n
+	}
+	include := map[string]bool{}
+	if v := req.URL.Query().Get("include"); v != "" {
+		for _, c := range strings.Split(v, ",") {
+			if c != "events" && c != "commands" && c != "labels" {
+				http.Error(w, "unsupported 'include' (events, commands, labels)", 400)
+				return
+			}
+			include[c] = true
+		}
+		if format == "json" || robotOfSubject(subject) == "" || timelineOf(req) == nil {
+			http.Error(w, "'include' needs format=csv or ndjson and a telemetry.{robot}.… 'subject'", 400)
+			return
+		}
+	}
+
+	if !validTime(start) {
+		http.Error(w, "bad 'start' (use -15m or RFC3339 time)", 400)
+		return
+	}
+	fields := strings.Split(field, ",")
+	for _, f := range fields {
+		if !fieldRe.MatchString(f) || (len(fields) > 1 && f == "raw") {
+			http.Error(w, "bad 'field' (one field, or a comma-separated list of numeric fields)", 400)
+			return
+		}
+	}
+	multi := len(fields) > 1
+	if subject != "" && !subjectRe.MatchString(subject) {
+		http.Error(w, "bad 'subject' (a NATS subject such as telemetry.demo)", 400)
+		return
+	}
+	if subject == "" && scopeOf(req) != nil {
+		http.Error(w, "you see only some robots: name one with 'subject'", http.StatusForbidden)
+		return
+	}
+	if window != "" && !durRe.MatchString(window) {
+		http.Error(w, "bad 'window' (use 1s, 5m, 1h, ...)", 400)
+		return
+	}
+
+	aggFn, err := aggregateFn(agg, req.URL.Query().Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if agg != "" && (window == "" || field == "raw") {
+		http.Error(w, "'agg' needs a 'window' and a numeric 'field' (not raw)", 400)
+		return
+	}
+	switch fill {
+	case "", "null", "previous", "linear", "0":
+	default:
+		http.Error(w, "unsupported 'fill' (null, previous, linear or 0)", 400)
+		return
+	}
+	if fill != "" && (window == "" || field == "raw") {
+		http.Error(w, "'fill' needs a 'window' and a numeric 'field' (not raw)", 400)
+		return
+	}
+	if tz != "" {
+		if _, err := time.LoadLocation(tz); err != nil || !tzRe.MatchString(tz) {
+			http.Error(w, "bad 'tz' (an IANA zone such as Europe/Lisbon)", 400)
+			return
+		}
+	}
+	if fill == "linear" && agg == "count" {
+		http.Error(w, "fill=linear interpolates floats; counts can use fill=0", 400)
+		return
+	}
+
+	if subject == "" {
+		n, err := subjectCount(req.Context(), db, start)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if n > 0 && n*limit > tsMaxPoints {
+			most := tsMaxPoints / n
+			if limitSet || most < 1 {
+				http.Error(w, fmt.Sprintf("%d subjects × limit %d points is over TS_MAX_POINTS (%d): name a 'subject' or lower 'limit' to %d", n, limit, tsMaxPoints, max(most, 1)), 400)
+				return
+			}
+			limit = most
+		}
+	}
+
+	stop := ""
+	if view := viewerOf(req); view != nil {
+		if field == "raw" {
+			http.Error(w, "raw payloads are not available to viewers", http.StatusForbidden)
+			return
+		}
+		if d, err := time.ParseDuration(window); view.Every > 0 && (window == "" || (err == nil && d < view.Every)) {
+			window = view.Every.String()
+		}
+		if view.Delay > 0 {
+			stop = `, stop:-` + view.Delay.String()
+		}
+	}
+
+	flux := strings.Builder{}
+	if fill == "linear" {
+		flux.WriteString(`import "interpolate" `)
+	}
+	if tz != "" {
+		flux.WriteString(`import "timezone" option location = timezone.location(name: "` + tz + `") `)
+	}
+	flux.WriteString(`from(bucket:"` + db.Bucket + `") |> range(start:` + start + stop + `)`)
+	flux.WriteString(telemetryFilter())
+	// raw points carry packed runs of samples too (telem.PackField)
+	unpack := window == "" && field != "raw"
+	want := fields
+	if unpack {
+		want = append([]string{telem.PackField}, fields...)
+	}
+	flux.WriteString(` |> filter(fn:(r)=> r._field == "` + strings.Join(want, `" or r._field == "`) + `")`)
+	if subject != "" {
+		flux.WriteString(` |> filter(fn:(r)=> r.subject == "` + subject + `")`)
+	}
+	if window != "" && field != "raw" {
+		// empty windows come back as nulls for null, previous and 0;
+		// interpolate.linear adds its own rows for the gaps
+		createEmpty := fill != "" && fill != "linear"
+		offset := ""
+		if strings.HasSuffix(window, "w") {
+			offset = `, offset: -3d` // windows count from 1970-01-01, a Thursday
+		}
+		flux.WriteString(` |> aggregateWindow(every:` + window + offset + `, fn: ` + aggFn + `, createEmpty: ` + strconv.FormatBool(createEmpty) + `)`)
+		switch fill {
+		case "previous":
+			flux.WriteString(` |> fill(usePrevious: true)`)
+		case "linear":
+			flux.WriteString(` |> interpolate.linear(every: ` + window + `)`)
+		case "0":
+			zero := "0.0"
+			if agg == "count" {
+				zero = "0"
+			}
+			flux.WriteString(` |> fill(value: ` + zero + `)`)
+		}
+	}
+	if multi || unpack {
+		flux.WriteString(` |> keep(columns: ["_time","_value","_field","subject"])`)
+		flux.WriteString(` |> group(columns: ["subject"])`)
+		flux.WriteString(` |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")`)
+		flux.WriteString(` |> sort(columns: ["_time"])`)
+	} else {
+		flux.WriteString(` |> keep(columns: ["_time","_value","subject"])`)
+	}
+
+	if !multi && !unpack {
+		// one table per subject, so each series is written once, whole
+		flux.WriteString(` |> group(columns: ["subject"])`)
+	}
+	// one point more than the page, to tell whether there are more
+	flux.WriteString(` |> limit(n: ` + strconv.Itoa(limit+1) + `, offset: ` + strconv.Itoa(offset) + `)`)
+
+	q := db.Client.QueryAPI(db.Org)
+	res, err := q.Query(req.Context(), flux.String())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer res.Close()
+
+	var entries []timelineEntry
+	if len(include) > 0 {
+		entries, err = timelineOf(req).collect(req.Context(), robotOfSubject(subject), include, startTime(start))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	w.Header().Set("Trailer", "X-Truncated")
+	out := newTSOutput(w, format, fields, subject, len(include) > 0)
+	values := make([]interface{}, len(fields))
+	perSeries := map[string]int{}
+	page := tsPage{}
+	for res.Next() {
+		rec := res.Record()
+		sub, _ := rec.ValueByKey("subject").(string)
+		if perSeries[sub]++; perSeries[sub] > limit {
+			page.Truncated = true // the extra point: this series goes on
+			continue
+		}
+		if pack, ok := rec.ValueByKey(telem.PackField).(string); ok && unpack {
+			run, err := telem.Unpack(pack, rec.Time())
+			if err != nil {
+				continue
+			}
+			for i, t := range run.Times {
+				for len(entries) > 0 && !entries[0].T.After(t) {
+					out.entry(entries[0])
+					entries = entries[1:]
+				}
+				for j, f := range fields {
+					values[j] = nil
+					if col := run.Fields[f]; col != nil && !math.IsNaN(col[i]) {
+						values[j] = col[i]
+					}
+				}
+				out.row(sub, t, values)
+			}
+			continue
+		}
+		for len(entries) > 0 && !entries[0].T.After(rec.Time()) {
+			out.entry(entries[0])
+			entries = entries[1:]
+		}
+		if multi || unpack {
+			for i, f := range fields {
+				values[i] = rec.ValueByKey(f)
+			}
+		} else {
+			values[0] = rec.Value()
+		}
+		out.row(sub, rec.Time(), values)
+	}
+	if res.Err() == nil && !page.Truncated { // else they belong to a later page
+		for _, e := range entries {
+			out.entry(e)
+		}
+	}
+	if page.Truncated {
+		page.NextOffset = offset + limit
+	}
+	traceOf(req).addPoints(out.finish(res.Err(), page))
+	w.Header().Set("X-Truncated", strconv.FormatBool(page.Truncated))
+}
+
+// subjectCount is how many telemetry subjects have data since start.
+func subjectCount(ctx context.Context, db *influxTarget, start string) (int, error) {
+	bucket, _ := json.Marshal(db.Bucket)
+	res, err := db.Client.QueryAPI(db.Org).Query(ctx, `import "influxdata/influxdb/schema" schema.tagValues(bucket: `+string(bucket)+
+		`, tag: "subject", predicate: (r) => `+layoutState().Predicate()+`, start: `+start+`)`)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+	n := 0
+	for res.Next() {
+		n++
+	}
+	return n, res.Err()
+}
+
+// GET /api/ts/meta?start=-24h lists the telemetry fields and subjects with
+// data in the range, for query builders; subjects only of robots in the
+// caller's scope.
+func handleTSMeta(w http.ResponseWriter, req *http.Request) {
+	db := influxOf(req)
+	if db == nil {
+		http.Error(w, "influx not configured", http.StatusNotImplemented)
+		return
+	}
+	start := req.URL.Query().Get("start")
+	if start == "" {
+		start = "-24h"
+	}
+	if !validTime(start) {
+		http.Error(w, "bad 'start' (use -15m or RFC3339 time)", 400)
+		return
+	}
+	bucket, _ := json.Marshal(db.Bucket)
+	pred := `predicate: (r) => ` + layoutState().Predicate() + `, start: ` + start
+	out := struct {
+		Fields   []string `json:"fields"`
+		Subjects []string `json:"subjects"`
+	}{}
+	for _, part := range []struct {
+		flux string
+		dst  *[]string
+	}{
+		{`import "influxdata/influxdb/schema" schema.fieldKeys(bucket: ` + string(bucket) + `, ` + pred + `)`, &out.Fields},
+		{`import "influxdata/influxdb/schema" schema.tagValues(bucket: ` + string(bucket) + `, tag: "subject", ` + pred + `)`, &out.Subjects},
+	} {
+		res, err := db.Client.QueryAPI(db.Org).Query(req.Context(), part.flux)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		*part.dst = []string{}
+		scope := scopeOf(req)
+		for res.Next() {
+			if v, ok := res.Record().Value().(string); ok {
+				if part.dst == &out.Subjects && scope != nil && !scope.allows(v) {
+					continue
+				}
+				*part.dst = append(*part.dst, v)
+			}
+		}
+		err = res.Err()
+		res.Close()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		sort.Strings(*part.dst)
+	}
+	traceOf(req).addPoints(len(out.Fields) + len(out.Subjects))
+	writeJSON(w, out)
+}
+
+// aggregateFn maps ?agg= (and ?q= for percentile) to the Flux function given
+// to aggregateWindow.
+func aggregateFn(agg, q string) (string, error) {
+	if q != "" && agg != "percentile" {
+		return "", errors.New("'q' only applies to agg=percentile")
+	}
+	switch agg {
+	case "", "mean":
+		return "mean", nil
+	case "min", "max", "median", "last", "count", "stddev":
+		return agg, nil
+	case "percentile":
+		p, err := strconv.ParseFloat(q, 64)
+		if err != nil || p < 0 || p > 1 {
+			return "", errors.New("agg=percentile needs 'q' between 0 and 1, e.g. q=0.95")
+		}
+		return `(column, tables=<-) => tables |> quantile(q: ` + strconv.FormatFloat(p, 'f', -1, 64) + `, column: column)`, nil
+	}
+	return "", fmt.Errorf("unsupported 'agg' %q (min, max, mean, median, last, count, stddev or percentile)", agg)
+}
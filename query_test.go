@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// TestHandleTSRejectsFluxInjection checks that values able to close a Flux
+// string literal or start a new pipe stage are refused with 400 before any
+// query reaches Influx.
+func TestHandleTSRejectsFluxInjection(t *testing.T) {
+	var queries atomic.Int32
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		queries.Add(1)
+		http.Error(w, "no data here", 500)
+	}))
+	defer influx.Close()
+	client := influxdb2.NewClient(influx.URL, "token")
+	defer client.Close()
+	db := &influxTarget{Client: client, Org: "org", Bucket: "telemetry"}
+
+	payloads := []string{
+		`"`,
+		`")`,
+		`x") |> drop(columns: ["_value"])`,
+		`x |> yield()`,
+		"x\n",
+		"x\n|> drop()",
+	}
+	params := []struct {
+		name  string
+		base  url.Values // a valid query the payload is put into
+		param string
+	}{
+		{"field", url.Values{"field": {"speed"}}, "field"},
+		{"subject", url.Values{"field": {"speed"}, "subject": {"telemetry.r1.odom"}}, "subject"},
+		{"window", url.Values{"field": {"speed"}, "window": {"1m"}}, "window"},
+		{"start", url.Values{"field": {"speed"}, "start": {"-15m"}}, "start"},
+		{"tz", url.Values{"field": {"speed"}, "window": {"1d"}, "tz": {"Europe/Lisbon"}}, "tz"},
+	}
+
+	serve := func(q url.Values) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/ts?"+q.Encode(), nil)
+		req = req.WithContext(context.WithValue(req.Context(), influxKey{}, db))
+		rec := httptest.NewRecorder()
+		handleTS(rec, req)
+		return rec.Code
+	}
+
+	for _, p := range params {
+		t.Run(p.name+"/valid", func(t *testing.T) {
+			before := queries.Load()
+			if code := serve(p.base); code == 400 {
+				t.Fatalf("valid query refused: %d", code)
+			}
+			if queries.Load() == before {
+				t.Fatal("valid query didn't reach Influx; the cases below prove nothing")
+			}
+		})
+		for _, payload := range payloads {
+			q := url.Values{}
+			for k, v := range p.base {
+				q[k] = v
+			}
+			q.Set(p.param, q.Get(p.param)+payload)
+			t.Run(p.name+"/"+payload, func(t *testing.T) {
+				before := queries.Load()
+				if code := serve(q); code != 400 {
+					t.Errorf("%s=%q: got %d, want 400", p.param, q.Get(p.param), code)
+				}
+				if queries.Load() != before {
+					t.Errorf("%s=%q reached Influx", p.param, q.Get(p.param))
+				}
+			})
+		}
+	}
+}
+
+// TestHandleTSCompareCapsPoints checks that a comparison whose grid would
+// exceed TS_MAX_POINTS is refused with 422 before any query reaches Influx.
+func TestHandleTSCompareCapsPoints(t *testing.T) {
+	var queries atomic.Int32
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		queries.Add(1)
+		http.Error(w, "no data here", 500)
+	}))
+	defer influx.Close()
+	client := influxdb2.NewClient(influx.URL, "token")
+	defer client.Close()
+	db := &influxTarget{Client: client, Org: "org", Bucket: "telemetry"}
+
+	defer func(n int) { tsMaxPoints = n }(tsMaxPoints)
+	tsMaxPoints = 1000
+
+	cases := []struct {
+		start, window, robots string
+		refused               bool
+	}{
+		{"-1h", "1m", "a,b,c", false}, // 61 windows × 3
+		{"-1h", "10s", "a,b", false},  // 361 × 2
+		{"-1h", "10s", "a,b,c", true}, // 361 × 3
+		{"-1h", "1s", "a,b", true},    // 3601 × 2
+		{"-30d", "1d", "a,b", false},  // 31 × 2
+		{"-30d", "1h", "a,b", true},   // 721 × 2
+		{"-1h", "0s", "a,b", true},    // no grid at all
+	}
+	for _, c := range cases {
+		t.Run(c.start+"/"+c.window+"/"+c.robots, func(t *testing.T) {
+			q := url.Values{"field": {"speed"}, "start": {c.start}, "window": {c.window}, "robots": {c.robots}}
+			req := httptest.NewRequest(http.MethodGet, "/api/ts/compare?"+q.Encode(), nil)
+			req = req.WithContext(context.WithValue(req.Context(), influxKey{}, db))
+			rec := httptest.NewRecorder()
+			before := queries.Load()
+			handleTSCompare(rec, req)
+			reached := queries.Load() != before
+			if c.refused && (rec.Code < 400 || rec.Code >= 500 || reached) {
+				t.Errorf("got %d (reached Influx: %v), want refused before querying", rec.Code, reached)
+			}
+			if !c.refused && !reached {
+				t.Errorf("got %d without querying Influx, want the query run", rec.Code)
+			}
+		})
+	}
+}
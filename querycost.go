@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// downsampleSteps are the windows a query can be forced to, smallest first.
+var downsampleSteps = []struct {
+	flux string
+	d    time.Duration
+}{
+	{"1s", time.Second}, {"5s", 5 * time.Second}, {"10s", 10 * time.Second}, {"30s", 30 * time.Second},
+	{"1m", time.Minute}, {"5m", 5 * time.Minute}, {"15m", 15 * time.Minute}, {"30m", 30 * time.Minute},
+	{"1h", time.Hour}, {"3h", 3 * time.Hour}, {"6h", 6 * time.Hour}, {"12h", 12 * time.Hour}, {"1d", 24 * time.Hour},
+}
+
+// relDuration reads a relative time such as -15m or -7d as a positive span.
+func relDuration(s string) (time.Duration, bool) {
+	if !relDurRe.MatchString(s) {
+		return 0, false
+	}
+	n, _ := strconv.Atoi(s[1 : len(s)-1])
+	unit := map[byte]time.Duration{'s': time.Second, 'm': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour}[s[len(s)-1]]
+	return time.Duration(n) * unit, true
+}
+
+// querySpan is how far back a query's start (relative or RFC3339) reaches.
+func querySpan(start string) (time.Duration, bool) {
+	if span, ok := relDuration(start); ok {
+		return span, true
+	}
+	t, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		return 0, false
+	}
+	return time.Since(t), true
+}
+
+// windowDuration approximates a Flux window (1s, 1d, 1mo, 1y, ...); 0 when it
+// doesn't parse.
+func windowDuration(s string) time.Duration {
+	if !durRe.MatchString(s) {
+		return 0
+	}
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	n, _ := strconv.Atoi(s[:i])
+	unit := map[string]time.Duration{"ms": time.Millisecond, "s": time.Second, "m": time.Minute, "h": time.Hour,
+		"d": 24 * time.Hour, "w": 7 * 24 * time.Hour, "mo": 30 * 24 * time.Hour, "y": 365 * 24 * time.Hour}[s[i:]]
+	return time.Duration(n) * unit
+}
+
+// queryBudget estimates what a time-series query will return before it
+// runs: range × expected series × points per series, where a window gives
+// range/window points and a raw query range × QUERY_ASSUMED_HZ. Expected
+// series is 1 for a subject filter, one per robot compared, and the number
+// of active robots otherwise, times the number of fields asked for. Over QUERY_MAX_POINTS an
+// aggregated query is downsampled to the smallest window that fits
+// (X-Query-Downsampled says which), and a raw one, or any with
+// QUERY_OVER_BUDGET=reject, is refused with the estimate so the caller knows
+// what to narrow.
+type queryBudget struct {
+	reg       *registry
+	maxPoints float64
+	hz        float64
+	reject    bool
+}
+
+func (b *queryBudget) seriesFor(subject string) float64 {
+	if subject != "" {
+		return 1
+	}
+	robots, err := b.reg.active()
+	if err != nil || len(robots) == 0 {
+		return 1
+	}
+	return float64(len(robots))
+}
+
+// estimate is the expected point count for a query over span.
+func (b *queryBudget) estimate(span time.Duration, series float64, window time.Duration) float64 {
+	perSeries := span.Seconds() * b.hz
+	if window > 0 {
+		perSeries = math.Min(perSeries, math.Ceil(span.Seconds()/window.Seconds()))
+	}
+	return series * perSeries
+}
+
+// guard wraps GET /api/ts and /api/ts/compare; defaultStart is the start
+// the handler uses when none is given. A compare query has a series per
+// robot in ?robots=.
+func (b *queryBudget) guard(defaultStart string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		start := q.Get("start")
+		if start == "" {
+			start = defaultStart
+		}
+		span, ok := querySpan(start)
+		if !ok {
+			next(w, req) // the handler reports the bad parameter
+			return
+		}
+		field := q.Get("field")
+		var window time.Duration
+		if v := q.Get("window"); v != "" && field != "" && field != "raw" {
+			window = windowDuration(v)
+		}
+		series := b.seriesFor(q.Get("subject")) * float64(len(strings.Split(field, ",")))
+		if robots := q.Get("robots"); robots != "" {
+			series = float64(len(strings.Split(robots, ",")))
+		}
+		cost := b.estimate(span, series, window)
+		w.Header().Set("X-Query-Cost", strconv.FormatFloat(cost, 'f', 0, 64))
+		if cost <= b.maxPoints {
+			next(w, req)
+			return
+		}
+
+		if b.reject || field == "" || field == "raw" {
+			http.Error(w, fmt.Sprintf("query too expensive: about %.0f points (%.0f series over %s) against a budget of %.0f; "+
+				"narrow 'start', pick a 'subject', or aggregate with a larger 'window'", cost, series, span.Round(time.Second), b.maxPoints),
+				http.StatusUnprocessableEntity)
+			return
+		}
+		for _, step := range downsampleSteps {
+			if step.d <= window {
+				continue
+			}
+			if b.estimate(span, series, step.d) <= b.maxPoints {
+				q.Set("window", step.flux)
+				req.URL.RawQuery = q.Encode()
+				w.Header().Set("X-Query-Downsampled", step.flux)
+				next(w, req)
+				return
+			}
+		}
+		http.Error(w, fmt.Sprintf("query too expensive even at 1d resolution: about %.0f points against a budget of %.0f; narrow 'start' or pick a 'subject'",
+			b.estimate(span, series, 24*time.Hour), b.maxPoints), http.StatusUnprocessableEntity)
+	}
+}
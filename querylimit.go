@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// queryLimiter bounds the Influx queries in flight: at most perUser for any
+// one caller, so a burst from one dashboard can't take every slot, and total
+// overall. A query that finds its caller at the cap is refused at once; one
+// that finds every slot busy queues for up to wait. Either way the answer is
+// 503 with Retry-After, which dashboards already back off on.
+type queryLimiter struct {
+	slots   chan struct{}
+	perUser int
+	wait    time.Duration
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newQueryLimiter(total, perUser int, wait time.Duration) *queryLimiter {
+	return &queryLimiter{slots: make(chan struct{}, total), perUser: perUser, wait: wait, active: map[string]int{}}
+}
+
+func (l *queryLimiter) busy(w http.ResponseWriter, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(l.wait.Seconds())+1))
+	http.Error(w, msg, http.StatusServiceUnavailable)
+}
+
+// limit wraps a query endpoint.
+func (l *queryLimiter) limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		user := queryUser(req)
+		l.mu.Lock()
+		if l.perUser > 0 && l.active[user] >= l.perUser {
+			l.mu.Unlock()
+			l.busy(w, "too many concurrent queries for "+user+" (limit "+strconv.Itoa(l.perUser)+")")
+			return
+		}
+		l.active[user]++
+		l.mu.Unlock()
+		defer func() {
+			l.mu.Lock()
+			if l.active[user]--; l.active[user] == 0 {
+				delete(l.active, user)
+			}
+			l.mu.Unlock()
+		}()
+
+		t := time.NewTimer(l.wait)
+		defer t.Stop()
+		select {
+		case l.slots <- struct{}{}:
+		case <-t.C:
+			l.busy(w, "query capacity saturated, try again shortly")
+			return
+		case <-req.Context().Done():
+			return
+		}
+		defer func() { <-l.slots }()
+		next(w, req)
+	}
+}
+
+// GET /api/queries/active shows the slots in use and, per caller, the
+// queries running or queued.
+func (l *queryLimiter) handleActive(w http.ResponseWriter, _ *http.Request) {
+	l.mu.Lock()
+	byUser := make(map[string]int, len(l.active))
+	for u, n := range l.active {
+		byUser[u] = n
+	}
+	l.mu.Unlock()
+	writeJSON(w, map[string]interface{}{"running": len(l.slots), "capacity": cap(l.slots), "per_user_limit": l.perUser, "by_user": byUser})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// queryRecord is one execution of a query endpoint, kept in the QUERIES
+// stream under queries.{endpoint}.
+type queryRecord struct {
+	TS         time.Time         `json:"ts"`
+	User       string            `json:"user"`
+	Endpoint   string            `json:"endpoint"`
+	Params     map[string]string `json:"params"`
+	Region     string            `json:"region,omitempty"`
+	DurationMs float64           `json:"duration_ms"`
+	Points     int64             `json:"points"`
+	Status     int               `json:"status"`
+}
+
+// queryTrace collects what a handler reports about its query.
+type queryTrace struct {
+	points atomic.Int64
+}
+
+type queryTraceKey struct{}
+
+// traceOf returns the request's query trace; nil (and a no-op) outside
+// queryLog.track.
+func traceOf(req *http.Request) *queryTrace {
+	t, _ := req.Context().Value(queryTraceKey{}).(*queryTrace)
+	return t
+}
+
+// addPoints counts points returned to the caller.
+func (t *queryTrace) addPoints(n int) {
+	if t != nil {
+		t.points.Add(int64(n))
+	}
+}
+
+// queryLog records every query endpoint execution (who, parameters, time
+// taken, points returned) so the dashboards loading Influx can be found.
+// Executions over slow are also logged as they happen.
+type queryLog struct {
+	js   nats.JetStreamContext
+	slow time.Duration
+}
+
+func newQueryLog(js nats.JetStreamContext, retention, slow time.Duration) (*queryLog, error) {
+	_, err := js.AddStream(&nats.StreamConfig{Name: "QUERIES", Subjects: []string{"queries.>"}, Storage: nats.FileStorage, MaxAge: retention})
+	if err != nil && err != nats.ErrStreamNameAlreadyInUse {
+		return nil, err
+	}
+	return &queryLog{js: js, slow: slow}, nil
+}
+
+// track wraps a query endpoint; name is the endpoint in records.
+func (q *queryLog) track(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		tr := &queryTrace{}
+		rec := &statusRecorder{ResponseWriter: w, status: 200}
+		start := time.Now()
+		next(rec, req.WithContext(context.WithValue(req.Context(), queryTraceKey{}, tr)))
+		took := time.Since(start)
+
+		qr := queryRecord{TS: start.UTC(), User: queryUser(req), Endpoint: name, Params: map[string]string{},
+			DurationMs: float64(took.Microseconds()) / 1000, Points: tr.points.Load(), Status: rec.status}
+		for k := range req.URL.Query() {
+			if k != "access_token" {
+				qr.Params[k] = req.URL.Query().Get(k)
+			}
+		}
+		if db := influxOf(req); db != nil {
+			qr.Region = db.Region
+		}
+		if took >= q.slow {
+			log.Printf("slow query: %s by %s took %s, %d points, params %v", name, qr.User, took.Round(time.Millisecond), qr.Points, qr.Params)
+		}
+		b, _ := json.Marshal(qr)
+		if _, err := q.js.Publish("queries."+name, b); err != nil {
+			log.Printf("query log: %v", err)
+		}
+	}
+}
+
+// queryUser names the caller for per-user statistics: unlike actorOf it
+// leaves out the client address, which changes with every connection.
+func queryUser(req *http.Request) string {
+	if id := identityOf(req); id != nil {
+		return id.User
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// scan calls fn for every record since t, oldest first.
+func (q *queryLog) scan(ctx context.Context, since time.Time, fn func(queryRecord)) error {
+	info, err := q.js.StreamInfo("QUERIES")
+	if err != nil {
+		return err
+	}
+	if info.State.Msgs == 0 {
+		return nil
+	}
+	sub, err := q.js.SubscribeSync("queries.>", nats.OrderedConsumer(), nats.StartTime(since))
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	for {
+		wait, cancel := context.WithTimeout(ctx, time.Second)
+		m, err := sub.NextMsgWithContext(wait)
+		cancel()
+		if err != nil {
+			return nil // caught up (nothing newer than since) or cancelled
+		}
+		var r queryRecord
+		if json.Unmarshal(m.Data, &r) == nil {
+			fn(r)
+		}
+		if md, err := m.Metadata(); err == nil && md.NumPending == 0 {
+			return nil
+		}
+	}
+}
+
+// sinceParam reads ?since=-24h (s, m, h, d or w), defaulting to def.
+func sinceParam(req *http.Request, def time.Duration) (time.Time, bool) {
+	s := req.URL.Query().Get("since")
+	if s == "" {
+		return time.Now().Add(-def), true
+	}
+	d, ok := relDuration(s)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Now().Add(-d), true
+}
+
+// GET /api/queries/slow?since=-24h&min_ms=1000&limit=50 lists the slowest
+// executions, slowest first; min_ms defaults to QUERY_SLOW.
+func (q *queryLog) handleSlow(w http.ResponseWriter, req *http.Request) {
+	since, ok := sinceParam(req, 24*time.Hour)
+	if !ok {
+		http.Error(w, "bad 'since' (use -24h)", 400)
+		return
+	}
+	minMs := float64(q.slow.Milliseconds())
+	if v := req.URL.Query().Get("min_ms"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, "bad 'min_ms'", 400)
+			return
+		}
+		minMs = f
+	}
+	limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 1000 {
+		limit = 50
+	}
+	out := []queryRecord{}
+	err := q.scan(req.Context(), since, func(r queryRecord) {
+		if r.DurationMs >= minMs {
+			out = append(out, r)
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DurationMs > out[j].DurationMs })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	writeJSON(w, out)
+}
+
+type userQueryStats struct {
+	User      string  `json:"user"`
+	Queries   int     `json:"queries"`
+	Errors    int     `json:"errors"`
+	Slow      int     `json:"slow"`
+	TotalMs   float64 `json:"total_ms"`
+	MeanMs    float64 `json:"mean_ms"`
+	P95Ms     float64 `json:"p95_ms"`
+	MaxMs     float64 `json:"max_ms"`
+	Points    int64   `json:"points"`
+	durations []float64
+}
+
+// GET /api/queries/stats?since=-24h summarizes executions per user, the
+// heaviest total time first.
+func (q *queryLog) handleStats(w http.ResponseWriter, req *http.Request) {
+	since, ok := sinceParam(req, 24*time.Hour)
+	if !ok {
+		http.Error(w, "bad 'since' (use -24h)", 400)
+		return
+	}
+	byUser := map[string]*userQueryStats{}
+	slowMs := float64(q.slow.Milliseconds())
+	err := q.scan(req.Context(), since, func(r queryRecord) {
+		s := byUser[r.User]
+		if s == nil {
+			s = &userQueryStats{User: r.User}
+			byUser[r.User] = s
+		}
+		s.Queries++
+		if r.Status >= 400 {
+			s.Errors++
+		}
+		if r.DurationMs >= slowMs {
+			s.Slow++
+		}
+		s.TotalMs += r.DurationMs
+		s.Points += r.Points
+		if r.DurationMs > s.MaxMs {
+			s.MaxMs = r.DurationMs
+		}
+		s.durations = append(s.durations, r.DurationMs)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := make([]*userQueryStats, 0, len(byUser))
+	for _, s := range byUser {
+		s.MeanMs = s.TotalMs / float64(s.Queries)
+		sort.Float64s(s.durations)
+		s.P95Ms = s.durations[int(math.Ceil(0.95*float64(len(s.durations))))-1]
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].TotalMs > out[j].TotalMs })
+	writeJSON(w, out)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/go-chi/chi/v5"
+)
+
+// Roles, least to most privileged. Viewers are further restricted by
+// viewers.middleware.
+const (
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+var roleRank = map[string]int{roleViewer: 1, roleOperator: 2, roleAdmin: 3}
+
+// rankOf is the identity's highest role; roles outside roleRank grant
+// nothing. Without an identity (AUTH_REQUIRED=false and no token) nothing is
+// restricted, as before authentication existed.
+func rankOf(id *identity) int {
+	if id == nil {
+		return roleRank[roleAdmin]
+	}
+	n := 0
+	for _, r := range id.Roles {
+		if roleRank[r] > n {
+			n = roleRank[r]
+		}
+	}
+	return n
+}
+
+// rbac scopes what an identity may do to which robots. Admins reach every
+// robot. Anyone else reaches the robots their account or token lists
+// (user.Robots or the JWT_ROBOTS_CLAIM claim; shell patterns such as
+// "dock-*"), or with no list, the robots owned by their tenant, or with no
+// tenant either, every robot. Commanding a robot takes the operator role;
+// watching its telemetry any role.
+type rbac struct {
+	reg *registry
+}
+
+// sees reports whether robot is in id's scope.
+func (a *rbac) sees(id *identity, robot string) bool {
+	if rankOf(id) >= roleRank[roleAdmin] {
+		return true
+	}
+	if len(id.Robots) > 0 {
+		for _, p := range id.Robots {
+			if ok, _ := path.Match(p, robot); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if id.Tenant == "" {
+		return true
+	}
+	r, err := a.reg.get(robot)
+	return err == nil && r.Tenant == id.Tenant
+}
+
+// unscoped reports whether id sees every robot, so nothing needs filtering.
+func (a *rbac) unscoped(id *identity) bool {
+	return rankOf(id) >= roleRank[roleAdmin] || (len(id.Robots) == 0 && id.Tenant == "")
+}
+
+// command wraps an endpoint acting on robot {id}: operators and admins only,
+// and only within scope.
+func (a *rbac) command(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id := identityOf(req)
+		if rankOf(id) < roleRank[roleOperator] {
+			http.Error(w, "commanding robots needs the operator role", http.StatusForbidden)
+			return
+		}
+		if robot := chi.URLParam(req, "id"); !a.sees(id, robot) {
+			http.Error(w, "robot "+robot+" is outside your scope", http.StatusForbidden)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// watch wraps an endpoint reading robot {id}'s data: any role, within scope.
+func (a *rbac) watch(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if robot := chi.URLParam(req, "id"); !a.sees(identityOf(req), robot) {
+			http.Error(w, "robot "+robot+" is outside your scope", http.StatusForbidden)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// operator wraps an endpoint acting on something other than a robot:
+// operators and admins only.
+func (a *rbac) operator(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if rankOf(identityOf(req)) < roleRank[roleOperator] {
+			http.Error(w, "this needs the operator role", http.StatusForbidden)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// fleet wraps an endpoint acting on every robot at once, such as a
+// broadcast: operators and admins whose scope is the whole fleet.
+func (a *rbac) fleet(next http.HandlerFunc) http.HandlerFunc {
+	return a.operator(func(w http.ResponseWriter, req *http.Request) {
+		if !a.unscoped(identityOf(req)) {
+			http.Error(w, "this reaches every robot; your scope is limited", http.StatusForbidden)
+			return
+		}
+		next(w, req)
+	})
+}
+
+// admin wraps an endpoint only admins may use.
+func (a *rbac) admin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if rankOf(identityOf(req)) < roleRank[roleAdmin] {
+			http.Error(w, "this needs the admin role", http.StatusForbidden)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// self wraps an endpoint on user {name}'s own things, such as their
+// sessions: that user and admins only.
+func (a *rbac) self(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id := identityOf(req)
+		if rankOf(id) < roleRank[roleAdmin] && id.User != chi.URLParam(req, "name") {
+			http.Error(w, "only the user themselves or an admin may do this", http.StatusForbidden)
+			return
+		}
+		next(w, req)
+	}
+}
+
+type scopeKey struct{}
+
+// scopeOf returns the filter series provided for the request, nil when the
+// caller sees every robot.
+func scopeOf(req *http.Request) *scopeFilter {
+	f, _ := req.Context().Value(scopeKey{}).(*scopeFilter)
+	return f
+}
+
+// series wraps a stored-telemetry query: the robots it names, by ?subject=
+// (telemetry.{robot}.…) or ?robots=a,b, must be in scope. The caller's
+// filter is provided (scopeOf) for queries that name none, which must then
+// narrow or refuse themselves.
+func (a *rbac) series(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id := identityOf(req)
+		var robots []string
+		if s := req.URL.Query().Get("subject"); s != "" {
+			robots = append(robots, telem.RobotID(s))
+		}
+		if s := req.URL.Query().Get("robots"); s != "" {
+			robots = append(robots, strings.Split(s, ",")...)
+		}
+		for _, robot := range robots {
+			if !a.sees(id, robot) {
+				http.Error(w, "robot "+robot+" is outside your scope", http.StatusForbidden)
+				return
+			}
+		}
+		if f := a.filter(id); f != nil {
+			req = req.WithContext(context.WithValue(req.Context(), scopeKey{}, f))
+		}
+		next(w, req)
+	}
+}
+
+// scopeFilter decides per telemetry subject (telemetry.{robot}.…) whether a
+// stream client may receive it, remembering each robot's answer for the
+// connection.
+type scopeFilter struct {
+	a     *rbac
+	id    *identity
+	known map[string]bool
+}
+
+// filter returns nil when id needs no filtering.
+func (a *rbac) filter(id *identity) *scopeFilter {
+	if a.unscoped(id) {
+		return nil
+	}
+	return &scopeFilter{a: a, id: id, known: map[string]bool{}}
+}
+
+func (f *scopeFilter) allows(subject string) bool {
+	parts := strings.SplitN(subject, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	ok, seen := f.known[parts[1]]
+	if !seen {
+		ok = f.a.sees(f.id, parts[1])
+		f.known[parts[1]] = ok
+	}
+	return ok
+}
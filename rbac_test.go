@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// as makes req come from id, as auth.middleware does for a valid token.
+func as(req *http.Request, id *identity) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), identityKey{}, id))
+}
+
+func TestRBACSees(t *testing.T) {
+	a := &rbac{reg: testRegistry(t,
+		robot{ID: "r1", Tenant: "acme"},
+		robot{ID: "dock-1", Tenant: "globex"},
+		robot{ID: "dock-2"},
+	)}
+	var (
+		admin     = &identity{User: "ana", Roles: []string{roleAdmin}, Robots: []string{"r1"}, Tenant: "acme"}
+		docks     = &identity{User: "dan", Roles: []string{roleOperator}, Robots: []string{"dock-*"}}
+		acme      = &identity{User: "vic", Roles: []string{roleViewer}, Tenant: "acme"}
+		everyone  = &identity{User: "eve", Roles: []string{roleOperator}}
+		listFirst = &identity{User: "lou", Roles: []string{roleOperator}, Robots: []string{"r1"}, Tenant: "globex"}
+	)
+	cases := []struct {
+		name     string
+		id       *identity
+		robot    string
+		sees     bool
+		unscoped bool
+	}{
+		{"no identity", nil, "r1", true, true},
+		{"no identity, unknown robot", nil, "r9", true, true},
+		{"admin ignores their list", admin, "dock-1", true, true},
+		{"pattern match", docks, "dock-1", true, false},
+		{"pattern match, unregistered", docks, "dock-9", true, false},
+		{"pattern miss", docks, "r1", false, false},
+		{"tenant robot", acme, "r1", true, false},
+		{"other tenant's robot", acme, "dock-1", false, false},
+		{"robot without tenant", acme, "dock-2", false, false},
+		{"unknown robot, tenant caller", acme, "r9", false, false},
+		{"no list, no tenant", everyone, "dock-1", true, true},
+		{"no list, no tenant, unknown robot", everyone, "r9", true, true},
+		{"list wins over tenant", listFirst, "r1", true, false},
+		{"list wins over tenant, tenant robot", listFirst, "dock-1", false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := a.sees(c.id, c.robot); got != c.sees {
+				t.Errorf("sees(%s) = %v, want %v", c.robot, got, c.sees)
+			}
+			if got := a.unscoped(c.id); got != c.unscoped {
+				t.Errorf("unscoped = %v, want %v", got, c.unscoped)
+			}
+			if got := a.filter(c.id) == nil; got != c.unscoped {
+				t.Errorf("filter nil = %v, want %v", got, c.unscoped)
+			}
+		})
+	}
+}
+
+func TestRBACSeries(t *testing.T) {
+	a := &rbac{reg: testRegistry(t, robot{ID: "r1"}, robot{ID: "dock-1"})}
+	docks := &identity{User: "dan", Roles: []string{roleViewer}, Robots: []string{"dock-*"}}
+	admin := &identity{User: "ana", Roles: []string{roleAdmin}}
+
+	cases := []struct {
+		name  string
+		id    *identity
+		query url.Values
+		want  int
+		scope bool // a filter reaches the handler
+	}{
+		{"own subject", docks, url.Values{"subject": {"telemetry.dock-1.odom"}}, 200, true},
+		{"other subject", docks, url.Values{"subject": {"telemetry.r1.odom"}}, 403, false},
+		{"own robots", docks, url.Values{"robots": {"dock-1,dock-2"}}, 200, true},
+		{"one robot out of scope", docks, url.Values{"robots": {"dock-1,r1"}}, 403, false},
+		{"subject in scope, robots not", docks, url.Values{"subject": {"telemetry.dock-1.odom"}, "robots": {"r1"}}, 403, false},
+		{"names none", docks, url.Values{}, 200, true},
+		{"admin, any subject", admin, url.Values{"subject": {"telemetry.r1.odom"}}, 200, false},
+		{"admin, names none", admin, url.Values{}, 200, false},
+		{"no identity", nil, url.Values{"robots": {"r1,dock-1"}}, 200, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var scope *scopeFilter
+			h := a.series(func(w http.ResponseWriter, req *http.Request) { scope = scopeOf(req) })
+			req := httptest.NewRequest(http.MethodGet, "/api/ts?"+c.query.Encode(), nil)
+			if c.id != nil {
+				req = as(req, c.id)
+			}
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			if rec.Code != c.want {
+				t.Fatalf("got %d, want %d", rec.Code, c.want)
+			}
+			if (scope != nil) != c.scope {
+				t.Fatalf("scope filter provided: %v, want %v", scope != nil, c.scope)
+			}
+			if scope != nil && (!scope.allows("telemetry.dock-1.odom") || scope.allows("telemetry.r1.odom") || scope.allows("telemetry")) {
+				t.Error("scope filter lets the wrong subjects through")
+			}
+		})
+	}
+}
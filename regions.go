@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/VazRibeiro/evabot-backend/internal/residency"
+	"github.com/go-chi/chi/v5"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// influxTarget is the Influx instance a query runs against.
+type influxTarget struct {
+	Region string // "" for the default instance
+	Client influxdb2.Client
+	Org    string
+	Bucket string
+}
+
+type influxKey struct{}
+
+// influxOf returns the instance resolved for the request by regions.pin, or
+// nil when there is none to query.
+func influxOf(req *http.Request) *influxTarget {
+	t, _ := req.Context().Value(influxKey{}).(*influxTarget)
+	return t
+}
+
+// regions enforces data residency on the query side: a request is answered
+// only from its tenant's region (internal/residency), and a gateway started
+// with REGION serves only tenants of that region, refusing others with 421 so
+// a regional deployment never reads another region's data.
+type regions struct {
+	cfg     *residency.Config
+	local   string
+	tenants *tenants
+	reg     *registry
+	audit   *auditLog
+	targets map[string]*influxTarget
+}
+
+func newRegions(cfg *residency.Config, local string, tn *tenants, reg *registry, audit *auditLog) *regions {
+	g := &regions{cfg: cfg, local: local, tenants: tn, reg: reg, audit: audit, targets: map[string]*influxTarget{}}
+	if influxClient != nil {
+		g.targets[""] = &influxTarget{Client: influxClient, Org: influxOrg, Bucket: influxBucket}
+	}
+	for _, name := range cfg.Names() {
+		r := cfg.Regions[name]
+		g.targets[name] = &influxTarget{Region: name, Client: influxdb2.NewClient(r.URL, r.Token), Org: r.Org, Bucket: r.Bucket}
+		log.Printf("influx region %s → %s (org=%s bucket=%s)", name, r.URL, r.Org, r.Bucket)
+	}
+	return g
+}
+
+func (g *regions) close() {
+	for name, t := range g.targets {
+		if name != "" {
+			t.Client.Close()
+		}
+	}
+}
+
+// tenantOf is the caller's tenant: their account's, else the request's.
+func (g *regions) tenantOf(req *http.Request) string {
+	if id := identityOf(req); id != nil && id.Tenant != "" {
+		return id.Tenant
+	}
+	return g.tenants.tenantOf(req)
+}
+
+// pin wraps a query endpoint so it runs against the caller's region.
+func (g *regions) pin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		region := g.cfg.RegionOf(g.tenantOf(req))
+		if g.local != "" && region != g.local {
+			http.Error(w, "this gateway serves region "+g.local+" only", http.StatusMisdirectedRequest)
+			return
+		}
+		if t := g.targets[region]; t != nil {
+			w.Header().Set("X-Data-Region", t.Region)
+			req = req.WithContext(context.WithValue(req.Context(), influxKey{}, t))
+		}
+		next(w, req)
+	}
+}
+
+// GET /api/regions lists the configured regions and pinned tenants.
+func (g *regions) handleList(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, map[string]interface{}{"local": g.local, "regions": g.cfg.Names(), "tenants": g.cfg.Tenants})
+}
+
+// PUT /api/robots/{id}/tenant with {"tenant":"acme-eu"}. New telemetry goes
+// to the tenant's region; what is already stored stays where it is.
+func (g *regions) handleSetTenant(w http.ResponseWriter, req *http.Request) {
+	var in struct {
+		Tenant string `json:"tenant"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		http.Error(w, "bad body: "+err.Error(), 400)
+		return
+	}
+	if in.Tenant != "" && !tokenRe.MatchString(in.Tenant) {
+		http.Error(w, "bad tenant id", 400)
+		return
+	}
+	id := chi.URLParam(req, "id")
+	if !tokenRe.MatchString(id) {
+		http.Error(w, "bad robot id", 400)
+		return
+	}
+	if _, err := g.reg.get(id); errors.Is(err, errRobotNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := g.audit.record(auditRecord{Actor: actorOf(req), Action: "robot.tenant", Robot: id, Details: map[string]interface{}{
+		"tenant": in.Tenant, "region": g.cfg.RegionOf(in.Tenant)}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	r, err := g.reg.update(id, func(r *robot) error {
+		r.Tenant = in.Tenant
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, r)
+}
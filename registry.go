@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// robot is a registry record, stored as JSON under its id in the ROBOTS bucket.
+type robot struct {
+	ID               string            `json:"id"`
+	Name             string            `json:"name,omitempty"`
+	Model            string            `json:"model,omitempty"`
+	Tags             []string          `json:"tags,omitempty"`
+	Subjects         []string          `json:"subjects,omitempty"` // telemetry subjects it is expected to publish
+	Group            string            `json:"group,omitempty"`
+	Tenant           string            `json:"tenant,omitempty"`   // owner; decides where its telemetry is stored
+	Versions         map[string]string `json:"versions,omitempty"` // component (firmware, os, app) → version
+	VersionsReported time.Time         `json:"versions_reported,omitempty"`
+	Drift            []string          `json:"drift,omitempty"`    // components off their group's target
+	Payloads         []attachment      `json:"payloads,omitempty"` // what it carries; see payloads
+	// HeartbeatIntervalMs is the cadence the robot declared for heartbeat.{id}.
+	HeartbeatIntervalMs int64 `json:"heartbeat_interval_ms,omitempty"`
+	// Protocol is the protocol version it speaks; see protocols.
+	Protocol *robotProtocol `json:"protocol,omitempty"`
+	// Archived robots drop out of fleet views but keep their record (and id)
+	// so their history stays reachable; ids are never handed out again.
+	Archived   bool       `json:"archived,omitempty"`
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+	Created    time.Time  `json:"created"`
+	Updated    time.Time  `json:"updated"`
+}
+
+var (
+	errRobotNotFound = errors.New("robot not found")
+	errRobotExists   = errors.New("robot id already registered")
+	errRobotArchived = errors.New("robot id belongs to an archived robot and can't be reused")
+)
+
+type registry struct {
+	kv nats.KeyValue
+}
+
+func newRegistry(js nats.JetStreamContext) (*registry, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "ROBOTS", History: 5, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	return &registry{kv: kv}, nil
+}
+
+// ensureKV binds to a KV bucket, creating it on first use.
+func ensureKV(js nats.JetStreamContext, cfg *nats.KeyValueConfig) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(cfg.Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(cfg)
+	}
+	return kv, err
+}
+
+// kvKeys lists the keys matching a subject-style filter such as "r1.>".
+func kvKeys(kv nats.KeyValue, filter string) ([]string, error) {
+	w, err := kv.Watch(filter, nats.IgnoreDeletes(), nats.MetaOnly())
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+	var keys []string
+	for e := range w.Updates() {
+		if e == nil { // caught up
+			break
+		}
+		keys = append(keys, e.Key())
+	}
+	return keys, nil
+}
+
+func (g *registry) get(id string) (*robot, error) {
+	e, err := g.kv.Get(id)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, errRobotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r robot
+	if err := json.Unmarshal(e.Value(), &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// update applies fn to the robot's record (a fresh one if it doesn't exist yet)
+// and stores it, retrying when a concurrent writer got there first.
+func (g *registry) update(id string, fn func(r *robot) error) (*robot, error) {
+	return g.write(id, true, fn)
+}
+
+// updateExisting is update for registered robots only: errRobotNotFound for
+// any other id. What robots say over NATS goes through it, so publishing on
+// a robot's subjects never registers one.
+func (g *registry) updateExisting(id string, fn func(r *robot) error) (*robot, error) {
+	return g.write(id, false, fn)
+}
+
+func (g *registry) write(id string, create bool, fn func(r *robot) error) (*robot, error) {
+	for {
+		var r robot
+		var rev uint64
+		e, err := g.kv.Get(id)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(e.Value(), &r); err != nil {
+				return nil, err
+			}
+			rev = e.Revision()
+		case errors.Is(err, nats.ErrKeyNotFound) && !create:
+			return nil, errRobotNotFound
+		case errors.Is(err, nats.ErrKeyNotFound):
+			r = robot{ID: id, Created: time.Now()}
+		default:
+			return nil, err
+		}
+
+		if err := fn(&r); err != nil {
+			return nil, err
+		}
+		r.Updated = time.Now()
+		b, _ := json.Marshal(r)
+
+		if rev == 0 {
+			_, err = g.kv.Create(id, b)
+		} else {
+			_, err = g.kv.Update(id, b, rev)
+		}
+		if err == nil {
+			return &r, nil
+		}
+		if !errors.Is(err, nats.ErrKeyExists) { // ErrKeyExists also covers a stale revision
+			return nil, err
+		}
+	}
+}
+
+// create registers a brand-new robot. Ids of existing robots, archived ones
+// included, are refused.
+func (g *registry) create(r robot) (*robot, error) {
+	if existing, err := g.get(r.ID); err == nil {
+		if existing.Archived {
+			return nil, errRobotArchived
+		}
+		return nil, errRobotExists
+	} else if !errors.Is(err, errRobotNotFound) {
+		return nil, err
+	}
+	r.Created, r.Updated = time.Now(), time.Now()
+	r.Archived, r.ArchivedAt = false, nil
+	b, _ := json.Marshal(r)
+	if _, err := g.kv.Create(r.ID, b); errors.Is(err, nats.ErrKeyExists) {
+		return nil, errRobotExists
+	} else if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// active lists the robots that aren't archived.
+func (g *registry) active() ([]robot, error) {
+	all, err := g.list()
+	if err != nil {
+		return nil, err
+	}
+	out := all[:0]
+	for _, r := range all {
+		if !r.Archived {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func (g *registry) list() ([]robot, error) {
+	keys, err := g.kv.Keys()
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return []robot{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	out := make([]robot, 0, len(keys))
+	for _, k := range keys {
+		r, err := g.get(k)
+		if errors.Is(err, errRobotNotFound) {
+			continue // deleted in between
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *r)
+	}
+	return out, nil
+}
+
+// GET /api/robots?archived=false|true|all (default false)
+func (g *registry) handleList(w http.ResponseWriter, req *http.Request) {
+	filter := req.URL.Query().Get("archived")
+	if filter == "" {
+		filter = "false"
+	}
+	if filter != "false" && filter != "true" && filter != "all" {
+		http.Error(w, "archived must be false, true or all", 400)
+		return
+	}
+	robots, err := g.list()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := make([]robot, 0, len(robots))
+	for _, r := range robots {
+		if filter == "all" || r.Archived == (filter == "true") {
+			out = append(out, r)
+		}
+	}
+	writeJSON(w, out)
+}
+
+// GET /api/robots/{id}
+func (g *registry) handleGet(w http.ResponseWriter, req *http.Request) {
+	r, err := g.get(chi.URLParam(req, "id"))
+	if errors.Is(err, errRobotNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, r)
+}
+
+func (g *registry) setArchived(w http.ResponseWriter, req *http.Request, archived bool) {
+	id := chi.URLParam(req, "id")
+	if _, err := g.get(id); errors.Is(err, errRobotNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	r, err := g.update(id, func(r *robot) error {
+		r.Archived = archived
+		r.ArchivedAt = nil
+		if archived {
+			now := time.Now()
+			r.ArchivedAt = &now
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, r)
+}
+
+// POST /api/robots/{id}/archive
+func (g *registry) handleArchive(w http.ResponseWriter, req *http.Request) {
+	g.setArchived(w, req, true)
+}
+
+// POST /api/robots/{id}/unarchive re-activates an archived robot.
+func (g *registry) handleUnarchive(w http.ResponseWriter, req *http.Request) {
+	g.setArchived(w, req, false)
+}
+
+// robotFields are the descriptive fields a client may set; nil leaves a
+// field as it is.
+type robotFields struct {
+	Name     *string   `json:"name"`
+	Model    *string   `json:"model"`
+	Tags     *[]string `json:"tags"`
+	Subjects *[]string `json:"subjects"`
+	Group    *string   `json:"group"`
+}
+
+func (f robotFields) validate() error {
+	if f.Tags != nil {
+		for _, t := range *f.Tags {
+			if !tokenRe.MatchString(t) {
+				return errors.New("bad tag " + t)
+			}
+		}
+	}
+	if f.Subjects != nil {
+		for _, s := range *f.Subjects {
+			if !subjectRe.MatchString(s) || !strings.HasPrefix(s, "telemetry.") {
+				return errors.New("bad subject " + s + " (telemetry.{id}.{topic})")
+			}
+		}
+	}
+	if f.Group != nil && *f.Group != "" && !tokenRe.MatchString(*f.Group) {
+		return errors.New("bad group")
+	}
+	return nil
+}
+
+func (f robotFields) apply(r *robot) {
+	if f.Name != nil {
+		r.Name = *f.Name
+	}
+	if f.Model != nil {
+		r.Model = *f.Model
+	}
+	if f.Tags != nil {
+		r.Tags = *f.Tags
+	}
+	if f.Subjects != nil {
+		r.Subjects = *f.Subjects
+	}
+	if f.Group != nil {
+		r.Group = *f.Group
+	}
+}
+
+// POST /api/robots with {"id":"r1","name":"Dock 1","model":"eva-mk2","tags":["dock"],
+// "subjects":["telemetry.r1.pose"]} registers a robot.
+func (g *registry) handleCreate(w http.ResponseWriter, req *http.Request) {
+	var in struct {
+		ID string `json:"id"`
+		robotFields
+	}
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		http.Error(w, "bad body: "+err.Error(), 400)
+		return
+	}
+	if !tokenRe.MatchString(in.ID) {
+		http.Error(w, "bad robot id (letters, digits, _ and - only)", 400)
+		return
+	}
+	if err := in.validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	r := robot{ID: in.ID}
+	in.apply(&r)
+	created, err := g.create(r)
+	if errors.Is(err, errRobotExists) || errors.Is(err, errRobotArchived) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSONStatus(w, http.StatusCreated, created)
+}
+
+// PATCH /api/robots/{id} with any of name, model, tags, subjects and group.
+func (g *registry) handlePatch(w http.ResponseWriter, req *http.Request) {
+	var in robotFields
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		http.Error(w, "bad body: "+err.Error(), 400)
+		return
+	}
+	if err := in.validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	id := chi.URLParam(req, "id")
+	if _, err := g.get(id); errors.Is(err, errRobotNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	r, err := g.update(id, func(r *robot) error {
+		in.apply(r)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, r)
+}
+
+// DELETE /api/robots/{id} archives the robot: its record and id stay, so
+// history remains reachable and the id is never reused.
+func (g *registry) handleDelete(w http.ResponseWriter, req *http.Request) {
+	g.setArchived(w, req, true)
+}
+
+// known wraps an endpoint acting on robot {id} so it only reaches registered,
+// active robots.
+func (g *registry) known(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !tokenRe.MatchString(chi.URLParam(req, "id")) {
+			http.Error(w, "bad robot id", 400)
+			return
+		}
+		r, err := g.get(chi.URLParam(req, "id"))
+		switch {
+		case errors.Is(err, errRobotNotFound):
+			http.Error(w, "unknown robot (register it with POST /api/robots)", http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), 500)
+			return
+		case r.Archived:
+			http.Error(w, "robot is archived", http.StatusConflict)
+			return
+		}
+		next(w, req)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// testJetStream starts an embedded JetStream server with its store under a
+// temporary directory, as all-in-one does, and connects to it in-process.
+func testJetStream(t *testing.T) (*nats.Conn, nats.JetStreamContext) {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{
+		JetStream:  true,
+		StoreDir:   t.TempDir(),
+		DontListen: true,
+		NoSigs:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(10 * time.Second) {
+		t.Fatal("embedded nats: not ready after 10s")
+	}
+	nc, err := nats.Connect("", nats.InProcessServer(ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		nc.Close()
+		ns.Shutdown()
+		ns.WaitForShutdown()
+	})
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nc, js
+}
+
+// testRegistry is a registry holding robots, with r-archived archived.
+func testRegistry(t *testing.T, robots ...robot) *registry {
+	t.Helper()
+	_, js := testJetStream(t)
+	reg, err := newRegistry(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range robots {
+		if _, err := reg.create(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := reg.create(robot{ID: "r-archived"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.update("r-archived", func(r *robot) error { r.Archived = true; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+// withURLParams routes req as chi would, with the given {name} values.
+func withURLParams(req *http.Request, kv ...string) *http.Request {
+	rctx := chi.NewRouteContext()
+	for i := 0; i+1 < len(kv); i += 2 {
+		rctx.URLParams.Add(kv[i], kv[i+1])
+	}
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestRegistryKnown(t *testing.T) {
+	reg := testRegistry(t, robot{ID: "r1"})
+	cases := []struct {
+		id   string
+		want int
+	}{
+		{"r1", 200},
+		{"r2", 404},
+		{"r-archived", 409},
+		{"r1.>", 400},
+		{"r1.odom", 400},
+		{"*", 400},
+		{"", 400},
+	}
+	for _, c := range cases {
+		t.Run(c.id, func(t *testing.T) {
+			reached := false
+			h := reg.known(func(w http.ResponseWriter, _ *http.Request) { reached = true })
+			rec := httptest.NewRecorder()
+			h(rec, withURLParams(httptest.NewRequest(http.MethodPost, "/", nil), "id", c.id))
+			if rec.Code != c.want {
+				t.Errorf("got %d, want %d", rec.Code, c.want)
+			}
+			if reached != (c.want == 200) {
+				t.Errorf("handler reached: %v, want %v", reached, c.want == 200)
+			}
+		})
+	}
+}
+
+// TestRegistryUpdateExisting checks that reports can't register robots:
+// updateExisting refuses ids the registry doesn't hold, where update creates.
+func TestRegistryUpdateExisting(t *testing.T) {
+	reg := testRegistry(t, robot{ID: "r1"})
+	touch := func(r *robot) error { r.Model = "m2"; return nil }
+
+	if r, err := reg.updateExisting("r1", touch); err != nil || r.Model != "m2" {
+		t.Fatalf("existing robot: got %+v, %v", r, err)
+	}
+	if _, err := reg.updateExisting("r2", touch); !errors.Is(err, errRobotNotFound) {
+		t.Fatalf("unknown robot: got %v, want errRobotNotFound", err)
+	}
+	if _, err := reg.get("r2"); !errors.Is(err, errRobotNotFound) {
+		t.Fatalf("unknown robot was registered: %v", err)
+	}
+	if _, err := reg.update("r2", touch); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if _, err := reg.get("r2"); err != nil {
+		t.Fatalf("update didn't create r2: %v", err)
+	}
+}
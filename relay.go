@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// r2rRule lets robots matching From message robots matching To (shell
+// patterns such as "convoy-*"), on the listed topics only when Topics is set.
+type r2rRule struct {
+	From   string   `json:"from"`
+	To     string   `json:"to"`
+	Topics []string `json:"topics,omitempty"` // patterns over the dot-separated topic, e.g. "convoy.*"
+}
+
+type r2rPolicy struct {
+	Allow    []r2rRule `json:"allow"`
+	Rate     float64   `json:"rate"`  // messages per second per sender; 0 means unlimited
+	Burst    float64   `json:"burst"` // bucket size, at least 1
+	MaxBytes int       `json:"max_bytes"`
+	Record   bool      `json:"record"` // keep copies in the R2R stream, on r2rlog.{to}.{from}.{topic…}
+}
+
+var defaultR2RPolicy = r2rPolicy{Rate: 10, Burst: 20, MaxBytes: 64 << 10}
+
+// r2rPair counts what one sender sent one recipient.
+type r2rPair struct {
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Relayed int64     `json:"relayed"`
+	Bytes   int64     `json:"bytes"`
+	Denied  int64     `json:"denied"`       // no rule allows it, or too big
+	Limited int64     `json:"rate_limited"` // over the sender's rate
+	Last    time.Time `json:"last"`
+}
+
+type r2rBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// relay carries robot-to-robot messages for coordination (convoying, taking
+// turns at doorways) under policy (R2R_POLICY). A robot publishes to
+// r2r.{from}.{to}.{topic…}; if a rule allows the pair and topic and the
+// sender is within its rate, the relay delivers it on relay.{to}.{from}.{topic…}
+// with the reply subject and headers kept, and otherwise answers a request
+// with {"error":…}. Without rules nothing is relayed. That robots can't go
+// around the relay is up to NATS permissions: publish on r2r.{self}.> and
+// subscribe to relay.{self}.> only.
+type relay struct {
+	nc     *nats.Conn
+	policy r2rPolicy
+
+	mu      sync.Mutex
+	buckets map[string]*r2rBucket // sender → rate bucket
+	pairs   map[string]*r2rPair   // "from>to" → counts
+}
+
+func newRelay(nc *nats.Conn, js nats.JetStreamContext, policyJSON string, retention time.Duration) (*relay, error) {
+	p := defaultR2RPolicy
+	if policyJSON != "" {
+		if err := json.Unmarshal([]byte(policyJSON), &p); err != nil {
+			return nil, fmt.Errorf("R2R_POLICY: %w", err)
+		}
+	}
+	for _, r := range p.Allow {
+		for _, pat := range append([]string{r.From, r.To}, r.Topics...) {
+			if _, err := path.Match(pat, ""); err != nil || pat == "" {
+				return nil, fmt.Errorf("R2R_POLICY: bad pattern %q", pat)
+			}
+		}
+	}
+	p.Burst = math.Max(p.Burst, 1)
+	if p.Record {
+		// not relay.> itself: JetStream would answer requests with its ack
+		_, err := js.AddStream(&nats.StreamConfig{Name: "R2R", Subjects: []string{"r2rlog.>"}, Storage: nats.FileStorage, MaxAge: retention})
+		if err != nil && err != nats.ErrStreamNameAlreadyInUse {
+			return nil, err
+		}
+	}
+	return &relay{nc: nc, policy: p, buckets: map[string]*r2rBucket{}, pairs: map[string]*r2rPair{}}, nil
+}
+
+func (r *relay) subscribe() error {
+	_, err := r.nc.Subscribe("r2r.*.*.>", r.handle)
+	return err
+}
+
+func (r *relay) handle(msg *nats.Msg) {
+	parts := strings.SplitN(msg.Subject, ".", 4)
+	from, to, topic := parts[1], parts[2], parts[3]
+	now := time.Now()
+
+	r.mu.Lock()
+	pair := r.pairs[from+">"+to]
+	if pair == nil {
+		pair = &r2rPair{From: from, To: to}
+		r.pairs[from+">"+to] = pair
+	}
+	pair.Last = now
+	refuse := ""
+	switch {
+	case r.policy.MaxBytes > 0 && len(msg.Data) > r.policy.MaxBytes:
+		pair.Denied++
+		refuse = fmt.Sprintf("message over %d bytes", r.policy.MaxBytes)
+	case !r.allowed(from, to, topic):
+		pair.Denied++
+		refuse = "not allowed by policy"
+	case !r.take(from, now):
+		pair.Limited++
+		refuse = "rate limited"
+	default:
+		pair.Relayed++
+		pair.Bytes += int64(len(msg.Data))
+	}
+	r.mu.Unlock()
+
+	if refuse != "" {
+		if msg.Reply != "" {
+			b, _ := json.Marshal(map[string]string{"error": refuse})
+			r.nc.Publish(msg.Reply, b)
+		}
+		return
+	}
+	r.nc.PublishMsg(&nats.Msg{Subject: "relay." + to + "." + from + "." + topic, Reply: msg.Reply, Header: msg.Header, Data: msg.Data})
+	if r.policy.Record {
+		r.nc.PublishMsg(&nats.Msg{Subject: "r2rlog." + to + "." + from + "." + topic, Header: msg.Header, Data: msg.Data})
+	}
+}
+
+func (r *relay) allowed(from, to, topic string) bool {
+	for _, rule := range r.policy.Allow {
+		if ok, _ := path.Match(rule.From, from); !ok {
+			continue
+		}
+		if ok, _ := path.Match(rule.To, to); !ok {
+			continue
+		}
+		if len(rule.Topics) == 0 {
+			return true
+		}
+		for _, pat := range rule.Topics {
+			if ok, _ := path.Match(pat, topic); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// take spends one of from's tokens; r.mu is held.
+func (r *relay) take(from string, now time.Time) bool {
+	if r.policy.Rate <= 0 {
+		return true
+	}
+	b := r.buckets[from]
+	if b == nil {
+		b = &r2rBucket{tokens: r.policy.Burst, last: now}
+		r.buckets[from] = b
+	}
+	b.tokens = math.Min(r.policy.Burst, b.tokens+now.Sub(b.last).Seconds()*r.policy.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// GET /api/r2r shows the policy and per-pair counts, busiest first.
+func (r *relay) handleStats(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	pairs := make([]r2rPair, 0, len(r.pairs))
+	for _, p := range r.pairs {
+		pairs = append(pairs, *p)
+	}
+	r.mu.Unlock()
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Relayed != pairs[j].Relayed {
+			return pairs[i].Relayed > pairs[j].Relayed
+		}
+		return pairs[i].From+">"+pairs[i].To < pairs[j].From+">"+pairs[j].To
+	})
+	writeJSON(w, map[string]interface{}{"policy": r.policy, "pairs": pairs})
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// paramSpec describes one command parameter.
+type paramSpec struct {
+	Type     string   `json:"type"` // number, integer, string or bool
+	Required bool     `json:"required,omitempty"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	Enum     []string `json:"enum,omitempty"` // strings only
+}
+
+// cmdSchema is what a command accepts.
+type cmdSchema struct {
+	Params   map[string]paramSpec `json:"params"`
+	Priority string               `json:"priority,omitempty"` // default when the caller gives none
+	Requires []string             `json:"requires,omitempty"` // payload kinds or ids the robot must carry
+}
+
+func floatp(f float64) *float64 { return &f }
+
+// defaultCmdSchemas are the commands robots understand out of the box;
+// CMD_SCHEMAS adds to or replaces them.
+var defaultCmdSchemas = map[string]cmdSchema{
+	"estop":  {Params: map[string]paramSpec{"reason": {Type: "string"}}, Priority: "critical"},
+	"stop":   {Params: map[string]paramSpec{}, Priority: "high"},
+	"pause":  {Params: map[string]paramSpec{}},
+	"resume": {Params: map[string]paramSpec{}},
+	"dock":   {Params: map[string]paramSpec{"station": {Type: "string"}}},
+	"goto": {Params: map[string]paramSpec{
+		"x":       {Type: "number", Required: true},
+		"y":       {Type: "number", Required: true},
+		"heading": {Type: "number", Min: floatp(-math.Pi), Max: floatp(math.Pi)},
+		"map":     {Type: "string"},
+	}},
+	"set_speed": {Params: map[string]paramSpec{
+		"linear":  {Type: "number", Required: true, Min: floatp(0)},
+		"angular": {Type: "number"},
+	}},
+	"gripper": {Params: map[string]paramSpec{"open": {Type: "bool", Required: true}}},
+}
+
+// stopCommands bring a robot to rest; a lockout lets them through, as do
+// commands whose schema is critical.
+var stopCommands = []string{"estop", "stop", "pause"}
+
+// stops reports whether command name with schema s brings a robot to rest.
+func (s cmdSchema) stops(name string) bool {
+	return contains(stopCommands, name) || s.Priority == "critical"
+}
+
+// cmdPriorities, lowest first.
+var cmdPriorities = []string{"low", "normal", "high", "critical"}
+
+// robotCommands accepts commands for robots over HTTP, checks them against
+// their schema and queues them on ctrl.{id}.{name} through commands, so they
+// are tracked like every other command. Throttle limits apply: set_speed's
+// linear speed is clamped and gripper is refused while payload operations
+// are limited. A command whose schema or request requires payloads is
+// refused unless the robot carries them. During a lockout only stop
+// commands (see stops) get through.
+type robotCommands struct {
+	cmds    *commands
+	thr     *throttle
+	pl      *payloads
+	lock    *lockout
+	schemas map[string]cmdSchema
+}
+
+func newRobotCommands(cmds *commands, thr *throttle, pl *payloads, lock *lockout, schemasJSON string) (*robotCommands, error) {
+	rc := &robotCommands{cmds: cmds, thr: thr, pl: pl, lock: lock, schemas: map[string]cmdSchema{}}
+	for name, s := range defaultCmdSchemas {
+		rc.schemas[name] = s
+	}
+	if schemasJSON != "" {
+		extra := map[string]cmdSchema{}
+		if err := json.Unmarshal([]byte(schemasJSON), &extra); err != nil {
+			return nil, fmt.Errorf("CMD_SCHEMAS: %w", err)
+		}
+		for name, s := range extra {
+			if !tokenRe.MatchString(name) {
+				return nil, fmt.Errorf("CMD_SCHEMAS: bad command name %q", name)
+			}
+			if s.Params == nil {
+				s.Params = map[string]paramSpec{}
+			}
+			for pname, spec := range s.Params {
+				switch spec.Type {
+				case "number", "integer", "string", "bool":
+				default:
+					return nil, fmt.Errorf("CMD_SCHEMAS: %s.%s: bad type %q", name, pname, spec.Type)
+				}
+			}
+			if s.Priority != "" && !contains(cmdPriorities, s.Priority) {
+				return nil, fmt.Errorf("CMD_SCHEMAS: %s: bad priority %q", name, s.Priority)
+			}
+			for _, need := range s.Requires {
+				if !tokenRe.MatchString(need) {
+					return nil, fmt.Errorf("CMD_SCHEMAS: %s: bad required payload %q", name, need)
+				}
+			}
+			rc.schemas[name] = s
+		}
+	}
+	return rc, nil
+}
+
+// check validates params against s, returning the first problem.
+func (s cmdSchema) check(params map[string]interface{}) error {
+	for name := range params {
+		if _, ok := s.Params[name]; !ok {
+			return fmt.Errorf("unknown parameter %q", name)
+		}
+	}
+	names := make([]string, 0, len(s.Params))
+	for name := range s.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		spec := s.Params[name]
+		v, ok := params[name]
+		if !ok || v == nil {
+			if spec.Required {
+				return fmt.Errorf("parameter %q is required", name)
+			}
+			continue
+		}
+		switch spec.Type {
+		case "number", "integer":
+			f, ok := v.(float64)
+			if !ok {
+				return fmt.Errorf("parameter %q must be a number", name)
+			}
+			if spec.Type == "integer" && f != math.Trunc(f) {
+				return fmt.Errorf("parameter %q must be an integer", name)
+			}
+			if spec.Min != nil && f < *spec.Min {
+				return fmt.Errorf("parameter %q must be at least %g", name, *spec.Min)
+			}
+			if spec.Max != nil && f > *spec.Max {
+				return fmt.Errorf("parameter %q must be at most %g", name, *spec.Max)
+			}
+		case "string":
+			str, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("parameter %q must be a string", name)
+			}
+			if len(spec.Enum) > 0 && !contains(spec.Enum, str) {
+				return fmt.Errorf("parameter %q must be one of %v", name, spec.Enum)
+			}
+		case "bool":
+			if _, ok := v.(bool); !ok {
+				return fmt.Errorf("parameter %q must be true or false", name)
+			}
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// GET /api/commands lists the accepted commands and their schemas.
+func (rc *robotCommands) handleSchemas(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, rc.schemas)
+}
+
+// POST /api/robot/{id}/cmd with {"name":"goto","params":{"x":1,"y":2},"priority":"high"}
+// and, for missions that need them, "requires":["cart"]; answers 409 if the
+// robot lacks a required payload, otherwise 202 with the command's CTRL stream sequence, which the robot's ack
+// and GET /api/robot/{id}/commands refer to. With ?dryRun=true it answers
+// 200 with the message it would have published instead.
+func (rc *robotCommands) handleSend(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	if !tokenRe.MatchString(id) {
+		http.Error(w, "bad robot id", 400)
+		return
+	}
+	dry, err := dryRun(req)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var in struct {
+		Name     string                 `json:"name"`
+		Params   map[string]interface{} `json:"params"`
+		Priority string                 `json:"priority"`
+		Requires []string               `json:"requires"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		http.Error(w, "bad body: "+err.Error(), 400)
+		return
+	}
+	schema, ok := rc.schemas[in.Name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown command %q (see GET /api/commands)", in.Name), 400)
+		return
+	}
+	if rc.lock != nil && rc.lock.holds(req) && !schema.stops(in.Name) {
+		http.Error(w, "emergency lockout active", http.StatusLocked)
+		return
+	}
+	if in.Params == nil {
+		in.Params = map[string]interface{}{}
+	}
+	if err := schema.check(in.Params); err != nil {
+		http.Error(w, in.Name+": "+err.Error(), 400)
+		return
+	}
+	if in.Priority == "" {
+		in.Priority = schema.Priority
+	}
+	if in.Priority == "" {
+		in.Priority = "normal"
+	}
+	if !contains(cmdPriorities, in.Priority) {
+		http.Error(w, fmt.Sprintf("bad priority %q (one of %v)", in.Priority, cmdPriorities), 400)
+		return
+	}
+
+	for _, need := range in.Requires {
+		if !tokenRe.MatchString(need) {
+			http.Error(w, fmt.Sprintf("bad required payload %q", need), 400)
+			return
+		}
+	}
+	missing, err := rc.pl.missing(id, append(schema.Requires, in.Requires...))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if len(missing) > 0 {
+		http.Error(w, fmt.Sprintf("%s needs payload %s, which %s isn't carrying", in.Name, strings.Join(missing, ", "), id), http.StatusConflict)
+		return
+	}
+
+	switch in.Name {
+	case "set_speed":
+		if v, ok := in.Params["linear"].(float64); ok {
+			in.Params["linear"] = rc.thr.clampSpeed(id, v)
+		}
+	case "gripper":
+		if !rc.thr.current(id).PayloadOps {
+			http.Error(w, "payload operations are limited on "+id, http.StatusConflict)
+			return
+		}
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{"name": in.Name, "params": in.Params, "priority": in.Priority,
+		"requires": in.Requires, "requested_by": actorOf(req), "ts_ns": time.Now().UnixNano()})
+	if dry {
+		writePlan(w, rc.cmds.plan(id, in.Name, payload))
+		return
+	}
+	cmd, err := rc.cmds.publish(id, in.Name, payload)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSONStatus(w, http.StatusAccepted, cmd)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCmdSchemaCheck(t *testing.T) {
+	s := cmdSchema{Params: map[string]paramSpec{
+		"x":     {Type: "number", Required: true},
+		"speed": {Type: "number", Min: floatp(0), Max: floatp(2)},
+		"count": {Type: "integer"},
+		"mode":  {Type: "string", Enum: []string{"fast", "safe"}},
+		"label": {Type: "string"},
+		"open":  {Type: "bool"},
+	}}
+	cases := []struct {
+		name   string
+		params string
+		err    string // substring of the error, "" for none
+	}{
+		{"required only", `{"x":1}`, ""},
+		{"everything", `{"x":-3.5,"speed":2,"count":4,"mode":"safe","label":"a","open":false}`, ""},
+		{"null optional", `{"x":1,"label":null}`, ""},
+		{"missing required", `{}`, `"x" is required`},
+		{"null required", `{"x":null}`, `"x" is required`},
+		{"unknown", `{"x":1,"y":2}`, `unknown parameter "y"`},
+		{"number as string", `{"x":"1"}`, `"x" must be a number`},
+		{"below min", `{"x":1,"speed":-0.1}`, `"speed" must be at least 0`},
+		{"at min", `{"x":1,"speed":0}`, ""},
+		{"above max", `{"x":1,"speed":2.5}`, `"speed" must be at most 2`},
+		{"fractional integer", `{"x":1,"count":1.5}`, `"count" must be an integer`},
+		{"whole float integer", `{"x":1,"count":3.0}`, ""},
+		{"not in enum", `{"x":1,"mode":"turbo"}`, `"mode" must be one of`},
+		{"string as number", `{"x":1,"label":5}`, `"label" must be a string`},
+		{"bool as string", `{"x":1,"open":"true"}`, `"open" must be true or false`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var params map[string]interface{}
+			if err := json.Unmarshal([]byte(c.params), &params); err != nil {
+				t.Fatal(err)
+			}
+			err := s.check(params)
+			switch {
+			case c.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case c.err != "" && err == nil:
+				t.Errorf("no error, want %q", c.err)
+			case c.err != "" && !strings.Contains(err.Error(), c.err):
+				t.Errorf("error %q, want %q", err, c.err)
+			}
+		})
+	}
+}
+
+func TestThrottleClampSpeed(t *testing.T) {
+	thr := &throttle{state: map[string]limits{
+		"slow":    {MaxSpeed: floatp(0.5)},
+		"stopped": {MaxSpeed: floatp(0)},
+		"free":    {},
+	}}
+	cases := []struct {
+		robot string
+		v     float64
+		want  float64
+	}{
+		{"slow", 0.3, 0.3},
+		{"slow", 0.5, 0.5},
+		{"slow", 1.2, 0.5},
+		{"slow", -1.2, -0.5}, // reversing is capped too
+		{"slow", -0.2, -0.2},
+		{"stopped", 1, 0},
+		{"free", 9, 9},
+		{"unknown", 9, 9}, // no limits recorded
+	}
+	for _, c := range cases {
+		if got := thr.clampSpeed(c.robot, c.v); got != c.want || math.Signbit(got) != math.Signbit(c.want) {
+			t.Errorf("clampSpeed(%s, %g) = %g, want %g", c.robot, c.v, got, c.want)
+		}
+	}
+}
+
+// TestRobotCommandsLockout checks that during a lockout /cmd still lets
+// through commands that bring a robot to rest, and clamps set_speed; the
+// requests are dry runs, so nothing is published.
+func TestRobotCommandsLockout(t *testing.T) {
+	extra := `{"halt":{"params":{},"priority":"critical"},"beep":{"params":{},"priority":"high"}}`
+	rc, err := newRobotCommands(&commands{}, &throttle{state: map[string]limits{"r1": {MaxSpeed: floatp(0.5)}}},
+		&payloads{}, &lockout{breakGlass: "bg"}, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name       string
+		active     bool
+		body       string
+		breakGlass bool
+		want       int
+	}{
+		{"estop", true, `{"name":"estop"}`, false, 200},
+		{"stop", true, `{"name":"stop"}`, false, 200},
+		{"pause", true, `{"name":"pause"}`, false, 200},
+		{"critical schema", true, `{"name":"halt"}`, false, 200},
+		{"high schema", true, `{"name":"beep"}`, false, 423},
+		{"caller's critical priority doesn't count", true, `{"name":"resume","priority":"critical"}`, false, 423},
+		{"motion", true, `{"name":"goto","params":{"x":1,"y":2}}`, false, 423},
+		{"motion, break glass", true, `{"name":"goto","params":{"x":1,"y":2}}`, true, 200},
+		{"motion, no lockout", false, `{"name":"goto","params":{"x":1,"y":2}}`, false, 200},
+		{"unknown command", true, `{"name":"dance"}`, false, 400},
+		{"clamped speed", false, `{"name":"set_speed","params":{"linear":3}}`, false, 200},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rc.lock.state.Active = c.active
+			req := withURLParams(httptest.NewRequest(http.MethodPost, "/api/robot/r1/cmd?dryRun=true", strings.NewReader(c.body)), "id", "r1")
+			if c.breakGlass {
+				req.Header.Set("X-Break-Glass", "bg")
+			}
+			rec := httptest.NewRecorder()
+			rc.handleSend(rec, req)
+			if rec.Code != c.want {
+				t.Fatalf("got %d, want %d: %s", rec.Code, c.want, rec.Body)
+			}
+			if !strings.Contains(c.body, "set_speed") {
+				return
+			}
+			var out struct {
+				Messages []struct {
+					Payload struct {
+						Params map[string]float64 `json:"params"`
+					} `json:"payload"`
+				} `json:"messages"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil || len(out.Messages) != 1 {
+				t.Fatalf("plan: %v: %s", err, rec.Body)
+			}
+			if got := out.Messages[0].Payload.Params["linear"]; got != 0.5 {
+				t.Errorf("linear = %g, want 0.5", got)
+			}
+		})
+	}
+}
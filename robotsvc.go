@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// scheduleEntry is one slot of a robot's schedule.
+type scheduleEntry struct {
+	Start   time.Time       `json:"start"`
+	End     time.Time       `json:"end"`
+	Mission string          `json:"mission"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// robotService answers requests robots make to the backend on svc.{id}.>,
+// as a NATS micro service (discoverable with `nats micro ls`):
+//
+//	svc.{id}.config    → the robot's config document
+//	svc.{id}.schedule  → schedule entries for a day ({"date":"2025-03-04"}, default today UTC)
+//	svc.{id}.time      → NTP-style timestamps (see clockSync)
+//	svc.{id}.time.report → measured clock samples
+//
+// Configs and schedules are kept in the ROBOT_CONFIG and SCHEDULES buckets and
+// managed through the HTTP API.
+type robotService struct {
+	config   nats.KeyValue
+	schedule nats.KeyValue
+	svc      micro.Service
+}
+
+func newRobotService(nc *nats.Conn, js nats.JetStreamContext, clock *clockSync) (*robotService, error) {
+	cfg, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "ROBOT_CONFIG", History: 10, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	sched, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "SCHEDULES", History: 5, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	s := &robotService{config: cfg, schedule: sched}
+
+	s.svc, err = micro.AddService(nc, micro.Config{
+		Name:        "evabot-robot-svc",
+		Version:     "1.0.0",
+		Description: "backend services for robots",
+	})
+	if err != nil {
+		return nil, err
+	}
+	endpoints := map[string]micro.HandlerFunc{
+		"config":      s.serveConfig,
+		"schedule":    s.serveSchedule,
+		"time":        clock.serveTime,
+		"time.report": clock.serveReport,
+	}
+	for name, h := range endpoints {
+		epName := strings.ReplaceAll(name, ".", "-")
+		if err := s.svc.AddEndpoint(epName, h, micro.WithEndpointSubject("svc.*."+name)); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func svcRobotID(req micro.Request) string {
+	return strings.Split(req.Subject(), ".")[1]
+}
+
+func (s *robotService) serveConfig(req micro.Request) {
+	e, err := s.config.Get(svcRobotID(req))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		_ = req.Error("404", "no config for robot", nil)
+		return
+	}
+	if err != nil {
+		_ = req.Error("500", err.Error(), nil)
+		return
+	}
+	_ = req.Respond(e.Value())
+}
+
+func (s *robotService) serveSchedule(req micro.Request) {
+	var in struct {
+		Date string `json:"date"`
+	}
+	if len(req.Data()) > 0 {
+		if err := json.Unmarshal(req.Data(), &in); err != nil {
+			_ = req.Error("400", "bad request: "+err.Error(), nil)
+			return
+		}
+	}
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	if in.Date != "" {
+		d, err := time.Parse("2006-01-02", in.Date)
+		if err != nil {
+			_ = req.Error("400", "bad date", nil)
+			return
+		}
+		day = d
+	}
+
+	entries, err := s.entries(svcRobotID(req))
+	if err != nil {
+		_ = req.Error("500", err.Error(), nil)
+		return
+	}
+	out := []scheduleEntry{}
+	for _, e := range entries {
+		if e.Start.Before(day.Add(24*time.Hour)) && e.End.After(day) {
+			out = append(out, e)
+		}
+	}
+	_ = req.RespondJSON(out)
+}
+
+func (s *robotService) entries(id string) ([]scheduleEntry, error) {
+	e, err := s.schedule.Get(id)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return []scheduleEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []scheduleEntry
+	return out, json.Unmarshal(e.Value(), &out)
+}
+
+// GET /api/robots/{id}/config
+func (s *robotService) handleGetConfig(w http.ResponseWriter, req *http.Request) {
+	e, err := s.config.Get(chi.URLParam(req, "id"))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no config for robot", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(e.Value())
+}
+
+// PUT /api/robots/{id}/config stores any JSON document as the robot's config.
+func (s *robotService) handlePutConfig(w http.ResponseWriter, req *http.Request) {
+	b, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err != nil || !json.Valid(b) {
+		http.Error(w, "body must be a JSON document", 400)
+		return
+	}
+	if _, err := s.config.Put(chi.URLParam(req, "id"), b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// GET /api/robots/{id}/schedule
+func (s *robotService) handleGetSchedule(w http.ResponseWriter, req *http.Request) {
+	entries, err := s.entries(chi.URLParam(req, "id"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+// PUT /api/robots/{id}/schedule replaces the schedule with a list of entries.
+func (s *robotService) handlePutSchedule(w http.ResponseWriter, req *http.Request) {
+	var entries []scheduleEntry
+	if err := json.NewDecoder(req.Body).Decode(&entries); err != nil {
+		http.Error(w, "bad body: "+err.Error(), 400)
+		return
+	}
+	for _, e := range entries {
+		if !e.End.After(e.Start) {
+			http.Error(w, "schedule entry ends before it starts", 400)
+			return
+		}
+	}
+	b, _ := json.Marshal(entries)
+	if _, err := s.schedule.Put(chi.URLParam(req, "id"), b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
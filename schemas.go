@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/schemareg"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+const maxSchemaSize = 256 << 10
+
+// telemetrySchemas is the admin side of the schema registry
+// (internal/schemareg): schemas are compiled here before they are stored,
+// and workers validate payloads against them from the bucket.
+type telemetrySchemas struct {
+	kv    nats.KeyValue
+	audit *auditLog
+}
+
+func newTelemetrySchemas(js nats.JetStreamContext, audit *auditLog) (*telemetrySchemas, error) {
+	kv, err := schemareg.Open(js)
+	if err != nil {
+		return nil, err
+	}
+	return &telemetrySchemas{kv: kv, audit: audit}, nil
+}
+
+func (s *telemetrySchemas) get(name string) (*schemareg.Schema, nats.KeyValueEntry, error) {
+	e, err := s.kv.Get(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	var sc schemareg.Schema
+	if err := json.Unmarshal(e.Value(), &sc); err != nil {
+		return nil, nil, err
+	}
+	return &sc, e, nil
+}
+
+// GET /api/schemas
+func (s *telemetrySchemas) handleList(w http.ResponseWriter, _ *http.Request) {
+	keys, err := kvKeys(s.kv, ">")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := []schemareg.Schema{}
+	for _, k := range keys {
+		if sc, _, err := s.get(k); err == nil {
+			out = append(out, *sc)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	writeJSON(w, out)
+}
+
+// GET /api/schemas/{name}
+func (s *telemetrySchemas) handleGet(w http.ResponseWriter, req *http.Request) {
+	sc, _, err := s.get(chi.URLParam(req, "name"))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such schema", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, sc)
+}
+
+// PUT /api/schemas/{name} {"subject":"telemetry.*.battery","mode":"enforce","schema":{…}}
+// creates or replaces a schema. mode defaults to enforce; warn only counts
+// and logs failures.
+func (s *telemetrySchemas) handlePut(w http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, "name")
+	if !tokenRe.MatchString(name) {
+		http.Error(w, "bad schema name", 400)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxSchemaSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if len(body) > maxSchemaSize {
+		http.Error(w, "schema larger than 256 KiB", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var in schemareg.Schema
+	if err := json.Unmarshal(body, &in); err != nil {
+		http.Error(w, "bad JSON", 400)
+		return
+	}
+	sc := schemareg.Schema{Name: name, Subject: in.Subject, Mode: in.Mode, Schema: in.Schema, Version: 1,
+		Updated: time.Now().UTC(), By: actorOf(req)}
+	if sc.Mode == "" {
+		sc.Mode = schemareg.Enforce
+	}
+	// refuse anything the workers would fail to compile
+	if _, err := sc.Compile(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	var rev uint64
+	if old, e, err := s.get(name); err == nil {
+		sc.Version, rev = old.Version+1, e.Revision()
+	} else if !errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := s.audit.record(auditRecord{Actor: sc.By, Action: "schema.put", Details: map[string]interface{}{"name": name, "subject": sc.Subject, "mode": sc.Mode, "version": sc.Version}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	b, _ := json.Marshal(sc)
+	if rev == 0 {
+		_, err = s.kv.Create(name, b)
+	} else {
+		_, err = s.kv.Update(name, b, rev)
+	}
+	if err != nil {
+		code := 500
+		if errors.Is(err, nats.ErrKeyExists) {
+			code = 409
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	writeJSON(w, sc)
+}
+
+// DELETE /api/schemas/{name}
+func (s *telemetrySchemas) handleDelete(w http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, "name")
+	if _, _, err := s.get(name); errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such schema", 404)
+		return
+	}
+	if err := s.audit.record(auditRecord{Actor: actorOf(req), Action: "schema.delete", Details: map[string]interface{}{"name": name}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	if err := s.kv.Delete(name); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// POST /api/schemas/{name}/validate checks the body, a payload as a robot
+// would send it (Content-Type as its header), against the schema, to try a
+// schema out before robots hit it.
+func (s *telemetrySchemas) handleValidate(w http.ResponseWriter, req *http.Request) {
+	sc, _, err := s.get(chi.URLParam(req, "name"))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such schema", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(req.Body, maxSchemaSize))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	compiled, err := sc.Compile()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := struct {
+		Valid    bool                `json:"valid"`
+		Failures []schemareg.Failure `json:"failures"`
+	}{Failures: []schemareg.Failure{}}
+	doc, err := schemareg.Document(req.Header.Get("Content-Type"), "", data)
+	if err != nil {
+		out.Failures = append(out.Failures, schemareg.Failure{Schema: sc.Name, Error: err.Error()})
+	} else {
+		out.Failures = append(out.Failures, schemareg.Check(sc.Name, compiled, doc)...)
+	}
+	out.Valid = len(out.Failures) == 0
+	writeJSON(w, out)
+}
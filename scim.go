@@ -0,0 +1,920 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimSPCSchema   = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+)
+
+// scimFilterRe is the one filter form IdPs use for lookups: attr eq "value".
+var scimFilterRe = regexp.MustCompile(`(?i)^\s*(\w+)\s+eq\s+"([^"]*)"\s*$`)
+
+// scimGroup is a provisioned group; its display name picks the role its
+// members get.
+type scimGroup struct {
+	ID          string    `json:"id"`
+	DisplayName string    `json:"display_name"`
+	ExternalID  string    `json:"external_id,omitempty"`
+	Members     []string  `json:"members"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+}
+
+// scim is a SCIM 2.0 (RFC 7644) service provider under /scim/v2 so an IdP can
+// provision accounts. SCIM users are ordinary USERS entries marked
+// source=scim, named after userName with anything but letters, digits, _ and
+// - turned into - ("alice@corp.com" logs in as "alice-corp-com"). Groups live
+// in SCIM_GROUPS; a SCIM user's roles are exactly those SCIM_GROUP_ROLES maps
+// their groups to, and losing a role, deactivation or deletion ends their
+// sessions. The IdP authenticates with the SCIM_TOKEN bearer token.
+type scim struct {
+	auth   *auth
+	groups nats.KeyValue
+	token  string
+	roles  map[string]string // group display name → role
+
+	mu sync.Mutex // one change at a time, so role recomputation sees a stable view
+}
+
+func newSCIM(js nats.JetStreamContext, a *auth, token, groupRoles string) (*scim, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "SCIM_GROUPS", History: 5, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	s := &scim{auth: a, groups: kv, token: token, roles: map[string]string{}}
+	if groupRoles != "" {
+		if err := json.Unmarshal([]byte(groupRoles), &s.roles); err != nil {
+			return nil, fmt.Errorf("SCIM_GROUP_ROLES: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// authenticate checks the IdP's bearer token.
+func (s *scim) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tok := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(s.token)) != 1 {
+			scimError(w, http.StatusUnauthorized, "", "invalid token")
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func scimJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func scimError(w http.ResponseWriter, code int, scimType, detail string) {
+	body := map[string]interface{}{"schemas": []string{scimErrorSchema}, "status": strconv.Itoa(code), "detail": detail}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	scimJSON(w, code, body)
+}
+
+func (s *scim) record(req *http.Request, action string, details map[string]interface{}) error {
+	return s.auth.audit.record(auditRecord{Actor: "scim@" + req.RemoteAddr, Action: action, Details: details})
+}
+
+// scimUsername turns a SCIM userName into a valid local username.
+func scimUsername(userName string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return '-'
+	}, strings.ToLower(userName))
+}
+
+// scimBool reads a boolean some IdPs send as "True"/"False".
+func scimBool(v interface{}) (bool, bool) {
+	switch b := v.(type) {
+	case bool:
+		return b, true
+	case string:
+		p, err := strconv.ParseBool(strings.ToLower(b))
+		return p, err == nil
+	}
+	return false, false
+}
+
+type scimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+type scimRef struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+}
+
+type scimUser struct {
+	Schemas    []string  `json:"schemas"`
+	ID         string    `json:"id"`
+	ExternalID string    `json:"externalId,omitempty"`
+	UserName   string    `json:"userName"`
+	Active     bool      `json:"active"`
+	Groups     []scimRef `json:"groups"`
+	Meta       scimMeta  `json:"meta"`
+}
+
+type scimGroupResource struct {
+	Schemas     []string  `json:"schemas"`
+	ID          string    `json:"id"`
+	ExternalID  string    `json:"externalId,omitempty"`
+	DisplayName string    `json:"displayName"`
+	Members     []scimRef `json:"members"`
+	Meta        scimMeta  `json:"meta"`
+}
+
+func (s *scim) allGroups() ([]scimGroup, error) {
+	keys, err := kvKeys(s.groups, ">")
+	if err != nil {
+		return nil, err
+	}
+	out := []scimGroup{}
+	for _, k := range keys {
+		if g, _, err := s.getGroup(k); err == nil {
+			out = append(out, *g)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out, nil
+}
+
+func (s *scim) getGroup(id string) (*scimGroup, uint64, error) {
+	e, err := s.groups.Get(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	var g scimGroup
+	if err := json.Unmarshal(e.Value(), &g); err != nil {
+		return nil, 0, err
+	}
+	return &g, e.Revision(), nil
+}
+
+func (s *scim) userResource(u *user, groups []scimGroup) scimUser {
+	out := scimUser{Schemas: []string{scimUserSchema}, ID: u.Username, ExternalID: u.ExternalID, UserName: u.SCIMUserName,
+		Active: !u.Disabled, Groups: []scimRef{},
+		Meta: scimMeta{ResourceType: "User", Created: u.Created, LastModified: u.Updated, Location: "/scim/v2/Users/" + u.Username}}
+	if out.UserName == "" {
+		out.UserName = u.Username
+	}
+	for _, g := range groups {
+		for _, m := range g.Members {
+			if m == u.Username {
+				out.Groups = append(out.Groups, scimRef{Value: g.ID, Display: g.DisplayName})
+			}
+		}
+	}
+	return out
+}
+
+func groupResource(g *scimGroup) scimGroupResource {
+	out := scimGroupResource{Schemas: []string{scimGroupSchema}, ID: g.ID, ExternalID: g.ExternalID, DisplayName: g.DisplayName,
+		Members: []scimRef{}, Meta: scimMeta{ResourceType: "Group", Created: g.Created, LastModified: g.Updated, Location: "/scim/v2/Groups/" + g.ID}}
+	for _, m := range g.Members {
+		out.Members = append(out.Members, scimRef{Value: m})
+	}
+	return out
+}
+
+// syncRoles recomputes the roles of SCIM users from their groups. Anyone who
+// loses a role is logged out so the old role doesn't outlive the change.
+func (s *scim) syncRoles(names []string) error {
+	groups, err := s.allGroups()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		u, err := s.auth.users.get(name)
+		if errors.Is(err, errUserNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if u.Source != "scim" {
+			continue
+		}
+		set := map[string]bool{}
+		for _, g := range groups {
+			role, ok := s.roles[g.DisplayName]
+			if !ok {
+				continue
+			}
+			for _, m := range g.Members {
+				if m == name {
+					set[role] = true
+				}
+			}
+		}
+		roles := make([]string, 0, len(set))
+		for r := range set {
+			roles = append(roles, r)
+		}
+		sort.Strings(roles)
+		lost := false
+		for _, r := range u.Roles {
+			lost = lost || !set[r]
+		}
+		if !lost && len(roles) == len(u.Roles) {
+			continue
+		}
+		u.Roles = roles
+		if err := s.auth.users.put(*u, ""); err != nil {
+			return err
+		}
+		if lost {
+			if _, err := s.auth.revokeUser(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// page applies SCIM startIndex/count (1-based) to n results.
+func scimPage(req *http.Request, n int) (from, to int) {
+	start, _ := strconv.Atoi(req.URL.Query().Get("startIndex"))
+	if start < 1 {
+		start = 1
+	}
+	count, err := strconv.Atoi(req.URL.Query().Get("count"))
+	if err != nil || count < 0 || count > 200 {
+		count = 200
+	}
+	from = start - 1
+	if from > n {
+		from = n
+	}
+	to = from + count
+	if to > n {
+		to = n
+	}
+	return from, to
+}
+
+func scimList(w http.ResponseWriter, req *http.Request, total int, items interface{}) {
+	start, _ := strconv.Atoi(req.URL.Query().Get("startIndex"))
+	if start < 1 {
+		start = 1
+	}
+	n := 0
+	switch v := items.(type) {
+	case []scimUser:
+		n = len(v)
+	case []scimGroupResource:
+		n = len(v)
+	}
+	scimJSON(w, 200, map[string]interface{}{"schemas": []string{scimListSchema}, "totalResults": total,
+		"startIndex": start, "itemsPerPage": n, "Resources": items})
+}
+
+// GET /scim/v2/ServiceProviderConfig
+func (s *scim) handleConfig(w http.ResponseWriter, _ *http.Request) {
+	no := map[string]bool{"supported": false}
+	scimJSON(w, 200, map[string]interface{}{
+		"schemas":        []string{scimSPCSchema},
+		"patch":          map[string]bool{"supported": true},
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": 200},
+		"changePassword": no,
+		"sort":           no,
+		"etag":           no,
+		"authenticationSchemes": []map[string]interface{}{{
+			"type": "oauthbearertoken", "name": "Bearer token", "description": "SCIM_TOKEN as a bearer token",
+		}},
+	})
+}
+
+// GET /scim/v2/Users?filter=userName eq "alice@corp.com"
+func (s *scim) handleListUsers(w http.ResponseWriter, req *http.Request) {
+	var attr, val string
+	if f := req.URL.Query().Get("filter"); f != "" {
+		m := scimFilterRe.FindStringSubmatch(f)
+		if m == nil {
+			scimError(w, 400, "invalidFilter", "only `attr eq \"value\"` filters are supported")
+			return
+		}
+		attr, val = strings.ToLower(m[1]), m[2]
+	}
+	keys, err := kvKeys(s.auth.users.kv, ">")
+	if err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	groups, err := s.allGroups()
+	if err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	sort.Strings(keys)
+	all := []scimUser{}
+	for _, k := range keys {
+		u, err := s.auth.users.get(k)
+		if err != nil {
+			continue
+		}
+		r := s.userResource(u, groups)
+		switch attr {
+		case "":
+		case "username":
+			if !strings.EqualFold(r.UserName, val) {
+				continue
+			}
+		case "externalid":
+			if r.ExternalID != val {
+				continue
+			}
+		case "id":
+			if r.ID != val {
+				continue
+			}
+		default:
+			scimError(w, 400, "invalidFilter", "can't filter users on "+attr)
+			return
+		}
+		all = append(all, r)
+	}
+	from, to := scimPage(req, len(all))
+	scimList(w, req, len(all), all[from:to])
+}
+
+// GET /scim/v2/Users/{id}
+func (s *scim) handleGetUser(w http.ResponseWriter, req *http.Request) {
+	u, err := s.auth.users.get(chi.URLParam(req, "id"))
+	if errors.Is(err, errUserNotFound) {
+		scimError(w, 404, "", "no such user")
+		return
+	}
+	if err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	groups, err := s.allGroups()
+	if err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	scimJSON(w, 200, s.userResource(u, groups))
+}
+
+type scimUserIn struct {
+	UserName   string      `json:"userName"`
+	ExternalID string      `json:"externalId"`
+	Active     interface{} `json:"active"`
+	Password   string      `json:"password"`
+}
+
+// POST /scim/v2/Users
+func (s *scim) handleCreateUser(w http.ResponseWriter, req *http.Request) {
+	var in scimUserIn
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		scimError(w, 400, "invalidSyntax", err.Error())
+		return
+	}
+	name := scimUsername(in.UserName)
+	if !tokenRe.MatchString(name) {
+		scimError(w, 400, "invalidValue", "userName required")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.auth.users.get(name); err == nil {
+		scimError(w, 409, "uniqueness", "user "+name+" exists")
+		return
+	} else if !errors.Is(err, errUserNotFound) {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	active := true
+	if b, ok := scimBool(in.Active); ok {
+		active = b
+	}
+	u := user{Username: name, Disabled: !active, Source: "scim", ExternalID: in.ExternalID, SCIMUserName: in.UserName}
+	if err := s.record(req, "scim.user.create", map[string]interface{}{"user": name, "active": active}); err != nil {
+		scimError(w, 500, "", "audit: "+err.Error())
+		return
+	}
+	if err := s.auth.users.put(u, in.Password); err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	stored, err := s.auth.users.get(name)
+	if err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	scimJSON(w, 201, s.userResource(stored, nil))
+}
+
+// setActive applies an active flag, ending sessions on deactivation.
+func (s *scim) setActive(u *user, active bool) error {
+	u.Disabled = !active
+	if err := s.auth.users.put(*u, ""); err != nil {
+		return err
+	}
+	if !active {
+		_, err := s.auth.revokeUser(u.Username)
+		return err
+	}
+	return nil
+}
+
+// PUT /scim/v2/Users/{id} replaces userName, externalId and active.
+func (s *scim) handleReplaceUser(w http.ResponseWriter, req *http.Request) {
+	var in scimUserIn
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		scimError(w, 400, "invalidSyntax", err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.scimUser(w, req)
+	if !ok {
+		return
+	}
+	active := true
+	if b, ok := scimBool(in.Active); ok {
+		active = b
+	}
+	if in.UserName != "" {
+		u.SCIMUserName = in.UserName
+	}
+	u.ExternalID = in.ExternalID
+	if err := s.record(req, "scim.user.replace", map[string]interface{}{"user": u.Username, "active": active}); err != nil {
+		scimError(w, 500, "", "audit: "+err.Error())
+		return
+	}
+	if err := s.setActive(u, active); err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	s.respondUser(w, u.Username)
+}
+
+type scimPatch struct {
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+// PATCH /scim/v2/Users/{id}; "active", "userName" and "externalId" are
+// patchable, with or without a path.
+func (s *scim) handlePatchUser(w http.ResponseWriter, req *http.Request) {
+	var p scimPatch
+	if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+		scimError(w, 400, "invalidSyntax", err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.scimUser(w, req)
+	if !ok {
+		return
+	}
+	active := !u.Disabled
+	for _, op := range p.Operations {
+		if o := strings.ToLower(op.Op); o != "replace" && o != "add" {
+			scimError(w, 400, "invalidValue", "unsupported op "+op.Op)
+			return
+		}
+		attrs := map[string]interface{}{}
+		if op.Path != "" {
+			var v interface{}
+			if err := json.Unmarshal(op.Value, &v); err != nil {
+				scimError(w, 400, "invalidValue", err.Error())
+				return
+			}
+			attrs[op.Path] = v
+		} else if err := json.Unmarshal(op.Value, &attrs); err != nil {
+			scimError(w, 400, "invalidValue", err.Error())
+			return
+		}
+		for k, v := range attrs {
+			switch strings.ToLower(k) {
+			case "active":
+				b, ok := scimBool(v)
+				if !ok {
+					scimError(w, 400, "invalidValue", "active must be a boolean")
+					return
+				}
+				active = b
+			case "username":
+				if str, ok := v.(string); ok && str != "" {
+					u.SCIMUserName = str
+				}
+			case "externalid":
+				str, _ := v.(string)
+				u.ExternalID = str
+			}
+			// other attributes (name, emails, …) aren't stored
+		}
+	}
+	if err := s.record(req, "scim.user.patch", map[string]interface{}{"user": u.Username, "active": active}); err != nil {
+		scimError(w, 500, "", "audit: "+err.Error())
+		return
+	}
+	if err := s.setActive(u, active); err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	s.respondUser(w, u.Username)
+}
+
+// DELETE /scim/v2/Users/{id} removes the account and its group memberships.
+func (s *scim) handleDeleteUser(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.scimUser(w, req)
+	if !ok {
+		return
+	}
+	if err := s.record(req, "scim.user.delete", map[string]interface{}{"user": u.Username}); err != nil {
+		scimError(w, 500, "", "audit: "+err.Error())
+		return
+	}
+	if _, err := s.auth.revokeUser(u.Username); err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	groups, err := s.allGroups()
+	if err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	for _, g := range groups {
+		if kept := removeMember(g.Members, u.Username); len(kept) != len(g.Members) {
+			g.Members = kept
+			if err := s.putGroup(&g); err != nil {
+				scimError(w, 500, "", err.Error())
+				return
+			}
+		}
+	}
+	if err := s.auth.users.delete(u.Username); err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// scimUser loads the {id} user, refusing accounts SCIM didn't create.
+func (s *scim) scimUser(w http.ResponseWriter, req *http.Request) (*user, bool) {
+	u, err := s.auth.users.get(chi.URLParam(req, "id"))
+	if errors.Is(err, errUserNotFound) {
+		scimError(w, 404, "", "no such user")
+		return nil, false
+	}
+	if err != nil {
+		scimError(w, 500, "", err.Error())
+		return nil, false
+	}
+	if u.Source != "scim" {
+		scimError(w, 403, "mutability", "local account, not managed by SCIM")
+		return nil, false
+	}
+	return u, true
+}
+
+func (s *scim) respondUser(w http.ResponseWriter, name string) {
+	u, err := s.auth.users.get(name)
+	if err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	groups, err := s.allGroups()
+	if err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	scimJSON(w, 200, s.userResource(u, groups))
+}
+
+func removeMember(members []string, name string) []string {
+	out := members[:0:0]
+	for _, m := range members {
+		if m != name {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func (s *scim) putGroup(g *scimGroup) error {
+	g.Updated = time.Now().UTC()
+	if g.Members == nil {
+		g.Members = []string{}
+	}
+	b, _ := json.Marshal(g)
+	_, err := s.groups.Put(g.ID, b)
+	return err
+}
+
+// GET /scim/v2/Groups?filter=displayName eq "evabot-operators"
+func (s *scim) handleListGroups(w http.ResponseWriter, req *http.Request) {
+	var attr, val string
+	if f := req.URL.Query().Get("filter"); f != "" {
+		m := scimFilterRe.FindStringSubmatch(f)
+		if m == nil {
+			scimError(w, 400, "invalidFilter", "only `attr eq \"value\"` filters are supported")
+			return
+		}
+		attr, val = strings.ToLower(m[1]), m[2]
+	}
+	groups, err := s.allGroups()
+	if err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	all := []scimGroupResource{}
+	for i := range groups {
+		g := &groups[i]
+		switch attr {
+		case "":
+		case "displayname":
+			if g.DisplayName != val {
+				continue
+			}
+		case "externalid":
+			if g.ExternalID != val {
+				continue
+			}
+		case "id":
+			if g.ID != val {
+				continue
+			}
+		default:
+			scimError(w, 400, "invalidFilter", "can't filter groups on "+attr)
+			return
+		}
+		all = append(all, groupResource(g))
+	}
+	from, to := scimPage(req, len(all))
+	scimList(w, req, len(all), all[from:to])
+}
+
+// GET /scim/v2/Groups/{id}
+func (s *scim) handleGetGroup(w http.ResponseWriter, req *http.Request) {
+	g, _, err := s.getGroup(chi.URLParam(req, "id"))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		scimError(w, 404, "", "no such group")
+		return
+	}
+	if err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	scimJSON(w, 200, groupResource(g))
+}
+
+type scimGroupIn struct {
+	DisplayName string    `json:"displayName"`
+	ExternalID  string    `json:"externalId"`
+	Members     []scimRef `json:"members"`
+}
+
+func memberNames(refs []scimRef) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, r := range refs {
+		if r.Value != "" && !seen[r.Value] {
+			seen[r.Value] = true
+			out = append(out, r.Value)
+		}
+	}
+	return out
+}
+
+// POST /scim/v2/Groups
+func (s *scim) handleCreateGroup(w http.ResponseWriter, req *http.Request) {
+	var in scimGroupIn
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		scimError(w, 400, "invalidSyntax", err.Error())
+		return
+	}
+	if in.DisplayName == "" {
+		scimError(w, 400, "invalidValue", "displayName required")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	groups, err := s.allGroups()
+	if err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	for _, g := range groups {
+		if g.DisplayName == in.DisplayName {
+			scimError(w, 409, "uniqueness", "group "+in.DisplayName+" exists")
+			return
+		}
+	}
+	g := &scimGroup{ID: nuid.Next(), DisplayName: in.DisplayName, ExternalID: in.ExternalID, Members: memberNames(in.Members), Created: time.Now().UTC()}
+	if err := s.record(req, "scim.group.create", map[string]interface{}{"group": g.DisplayName, "members": g.Members}); err != nil {
+		scimError(w, 500, "", "audit: "+err.Error())
+		return
+	}
+	if err := s.putGroup(g); err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	if err := s.syncRoles(g.Members); err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	scimJSON(w, 201, groupResource(g))
+}
+
+// PUT /scim/v2/Groups/{id}
+func (s *scim) handleReplaceGroup(w http.ResponseWriter, req *http.Request) {
+	var in scimGroupIn
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		scimError(w, 400, "invalidSyntax", err.Error())
+		return
+	}
+	s.changeGroup(w, req, func(g *scimGroup) error {
+		if in.DisplayName != "" {
+			g.DisplayName = in.DisplayName
+		}
+		g.ExternalID = in.ExternalID
+		g.Members = memberNames(in.Members)
+		return nil
+	})
+}
+
+// PATCH /scim/v2/Groups/{id}: add/remove/replace members (including the
+// members[value eq "id"] path form) and replace displayName.
+func (s *scim) handlePatchGroup(w http.ResponseWriter, req *http.Request) {
+	var p scimPatch
+	if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+		scimError(w, 400, "invalidSyntax", err.Error())
+		return
+	}
+	s.changeGroup(w, req, func(g *scimGroup) error {
+		for _, op := range p.Operations {
+			path := strings.TrimSpace(op.Path)
+			var refs []scimRef
+			if strings.HasPrefix(strings.ToLower(path), "members[") {
+				// members[value eq "id"]
+				m := scimFilterRe.FindStringSubmatch(strings.TrimSuffix(path[len("members["):], "]"))
+				if m == nil {
+					return fmt.Errorf("bad path %s", path)
+				}
+				refs, path = []scimRef{{Value: m[2]}}, "members"
+			}
+			switch o := strings.ToLower(op.Op); {
+			case strings.EqualFold(path, "members"):
+				if refs == nil && len(op.Value) > 0 {
+					if err := json.Unmarshal(op.Value, &refs); err != nil {
+						return err
+					}
+				}
+				switch o {
+				case "add":
+					g.Members = memberNames(append(refsOf(g.Members), refs...))
+				case "remove":
+					if refs == nil {
+						g.Members = []string{}
+					}
+					for _, r := range refs {
+						g.Members = removeMember(g.Members, r.Value)
+					}
+				case "replace":
+					g.Members = memberNames(refs)
+				default:
+					return fmt.Errorf("unsupported op %s", op.Op)
+				}
+			case strings.EqualFold(path, "displayName"):
+				var name string
+				if err := json.Unmarshal(op.Value, &name); err != nil || name == "" {
+					return errors.New("displayName must be a string")
+				}
+				g.DisplayName = name
+			case path == "":
+				var in scimGroupIn
+				if err := json.Unmarshal(op.Value, &in); err != nil {
+					return err
+				}
+				if in.DisplayName != "" {
+					g.DisplayName = in.DisplayName
+				}
+				if in.ExternalID != "" {
+					g.ExternalID = in.ExternalID
+				}
+				if in.Members != nil {
+					if o == "add" {
+						g.Members = memberNames(append(refsOf(g.Members), in.Members...))
+					} else {
+						g.Members = memberNames(in.Members)
+					}
+				}
+			default:
+				return fmt.Errorf("unsupported path %s", op.Path)
+			}
+		}
+		return nil
+	})
+}
+
+func refsOf(names []string) []scimRef {
+	out := make([]scimRef, 0, len(names))
+	for _, n := range names {
+		out = append(out, scimRef{Value: n})
+	}
+	return out
+}
+
+// changeGroup applies change to the {id} group and resyncs the roles of
+// everyone who was or is a member.
+func (s *scim) changeGroup(w http.ResponseWriter, req *http.Request, change func(*scimGroup) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, _, err := s.getGroup(chi.URLParam(req, "id"))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		scimError(w, 404, "", "no such group")
+		return
+	}
+	if err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	before := append([]string{}, g.Members...)
+	if err := change(g); err != nil {
+		scimError(w, 400, "invalidValue", err.Error())
+		return
+	}
+	if err := s.record(req, "scim.group.update", map[string]interface{}{"group": g.DisplayName, "members": g.Members}); err != nil {
+		scimError(w, 500, "", "audit: "+err.Error())
+		return
+	}
+	if err := s.putGroup(g); err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	if err := s.syncRoles(append(before, g.Members...)); err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	scimJSON(w, 200, groupResource(g))
+}
+
+// DELETE /scim/v2/Groups/{id}
+func (s *scim) handleDeleteGroup(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, _, err := s.getGroup(chi.URLParam(req, "id"))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		scimError(w, 404, "", "no such group")
+		return
+	}
+	if err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	if err := s.record(req, "scim.group.delete", map[string]interface{}{"group": g.DisplayName}); err != nil {
+		scimError(w, 500, "", "audit: "+err.Error())
+		return
+	}
+	if err := s.groups.Delete(g.ID); err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	if err := s.syncRoles(g.Members); err != nil {
+		scimError(w, 500, "", err.Error())
+		return
+	}
+	w.WriteHeader(204)
+}
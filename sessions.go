@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// identity is who an authenticated request acts as. Session is empty for
+// externally issued tokens; Claims are the token's, for handlers that need
+// more than the user, roles and tenant.
+type identity struct {
+	User    string        `json:"user"`
+	Roles   []string      `json:"roles"`
+	Tenant  string        `json:"tenant,omitempty"`
+	Robots  []string      `json:"robots,omitempty"`
+	Session string        `json:"session,omitempty"`
+	Claims  jwt.MapClaims `json:"claims,omitempty"`
+}
+
+type identityKey struct{}
+
+// identityOf returns the request's authenticated identity, or nil.
+func identityOf(req *http.Request) *identity {
+	id, _ := req.Context().Value(identityKey{}).(*identity)
+	return id
+}
+
+// session is one login. Only a hash of the refresh token is kept.
+type session struct {
+	ID          string    `json:"id"`
+	User        string    `json:"user"`
+	Created     time.Time `json:"created"`
+	Refreshed   time.Time `json:"refreshed"`
+	Expires     time.Time `json:"expires"`
+	RefreshHash string    `json:"refresh_hash,omitempty"`
+	IP          string    `json:"ip,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+}
+
+func (s session) key() string { return s.User + "." + s.ID }
+
+type accessClaims struct {
+	jwt.RegisteredClaims
+	Session string   `json:"sid"`
+	Roles   []string `json:"roles"`
+	Tenant  string   `json:"tenant,omitempty"`
+	Robots  []string `json:"robots,omitempty"`
+}
+
+// auth issues sessions: a short-lived JWT access token plus an opaque,
+// rotating refresh token. Sessions live in the SESSIONS bucket (key
+// {user}.{session}) and every gateway instance watches it, so deleting a
+// session rejects its access token on the next request rather than when the
+// token expires. A refresh token presented twice is treated as stolen and
+// ends the session.
+type auth struct {
+	users       *users
+	kv          nats.KeyValue
+	audit       *auditLog
+	secret      []byte
+	accessTTL   time.Duration
+	refreshTTL  time.Duration
+	maxSessions int
+	required    bool
+	external    *externalJWT // JWT_ALG tokens, nil if not configured
+
+	mu   sync.RWMutex
+	live map[string]session // by key()
+}
+
+func newAuth(js nats.JetStreamContext, u *users, audit *auditLog, secret string, accessTTL, refreshTTL time.Duration, maxSessions int, required bool) (*auth, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "SESSIONS", TTL: refreshTTL, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		rand.Read(key)
+		log.Printf("AUTH_SECRET not set: using a random key, sessions end on restart and aren't shared between instances")
+	}
+	a := &auth{users: u, kv: kv, audit: audit, secret: key, accessTTL: accessTTL, refreshTTL: refreshTTL,
+		maxSessions: maxSessions, required: required, live: map[string]session{}}
+
+	w, err := kv.WatchAll()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for e := range w.Updates() {
+			if e == nil {
+				continue
+			}
+			a.mu.Lock()
+			var s session
+			if e.Operation() == nats.KeyValuePut && json.Unmarshal(e.Value(), &s) == nil {
+				a.live[e.Key()] = s
+			} else {
+				delete(a.live, e.Key())
+			}
+			a.mu.Unlock()
+		}
+	}()
+	return a, nil
+}
+
+func hashToken(t string) string {
+	h := sha256.Sum256([]byte(t))
+	return hex.EncodeToString(h[:])
+}
+
+type tokenPair struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int    `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int    `json:"refresh_expires_in"`
+}
+
+// tokens signs an access token for s and rotates its refresh token, storing
+// the session (created when rev is 0, else updated from rev).
+func (a *auth) tokens(u *user, s *session, rev uint64) (*tokenPair, error) {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	refresh := s.User + "." + s.ID + "." + base64.RawURLEncoding.EncodeToString(buf)
+	now := time.Now().UTC()
+	s.RefreshHash = hashToken(refresh)
+	s.Refreshed = now
+	s.Expires = now.Add(a.refreshTTL)
+
+	b, _ := json.Marshal(s)
+	var err error
+	if rev == 0 {
+		_, err = a.kv.Create(s.key(), b)
+	} else {
+		_, err = a.kv.Update(s.key(), b, rev)
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	a.live[s.key()] = *s
+	a.mu.Unlock()
+
+	access, err := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "evabot",
+			Subject:   u.Username,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(a.accessTTL)),
+		},
+		Session: s.ID,
+		Roles:   u.Roles,
+		Tenant:  u.Tenant,
+		Robots:  u.Robots,
+	}).SignedString(a.secret)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenPair{AccessToken: access, TokenType: "Bearer", ExpiresIn: int(a.accessTTL.Seconds()),
+		RefreshToken: refresh, RefreshExpiresIn: int(a.refreshTTL.Seconds())}, nil
+}
+
+// sessionsOf lists a user's sessions, oldest first.
+func (a *auth) sessionsOf(name string) ([]session, error) {
+	keys, err := kvKeys(a.kv, name+".*")
+	if err != nil {
+		return nil, err
+	}
+	out := []session{}
+	for _, k := range keys {
+		e, err := a.kv.Get(k)
+		if err != nil {
+			continue
+		}
+		var s session
+		if json.Unmarshal(e.Value(), &s) == nil {
+			s.RefreshHash = ""
+			out = append(out, s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out, nil
+}
+
+func (a *auth) revoke(key string) error {
+	a.mu.Lock()
+	delete(a.live, key)
+	a.mu.Unlock()
+	err := a.kv.Delete(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil
+	}
+	return err
+}
+
+// revokeUser ends every session of a user.
+func (a *auth) revokeUser(name string) (int, error) {
+	list, err := a.sessionsOf(name)
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range list {
+		if err := a.revoke(s.key()); err != nil {
+			return 0, err
+		}
+	}
+	return len(list), nil
+}
+
+// authExempt are paths that work without a token when auth is required.
+func authExempt(path string) bool {
+	switch path {
+	case "/healthz", "/readyz", "/config.js", "/api/tenant/settings", "/api/auth/login", "/api/auth/refresh":
+		return true
+	}
+	// the web UI itself
+	return !strings.HasPrefix(path, "/api/") && !strings.HasPrefix(path, "/ws")
+}
+
+// verify accepts the gateway's own session tokens and, when configured,
+// externally issued ones.
+func (a *auth) verify(tok string) (*identity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tok, claims, func(*jwt.Token) (interface{}, error) { return a.secret, nil },
+		jwt.WithValidMethods([]string{"HS256"}), jwt.WithIssuer("evabot"), jwt.WithExpirationRequired())
+	if err != nil {
+		if a.external != nil {
+			if id, xerr := a.external.verify(tok); xerr == nil {
+				return id, nil
+			}
+		}
+		return nil, errors.New("invalid token")
+	}
+	var c accessClaims
+	b, _ := json.Marshal(claims)
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, errors.New("invalid token")
+	}
+	a.mu.RLock()
+	s, ok := a.live[c.Subject+"."+c.Session]
+	a.mu.RUnlock()
+	if !ok || time.Now().After(s.Expires) {
+		return nil, errors.New("session ended")
+	}
+	return &identity{User: c.Subject, Roles: c.Roles, Tenant: c.Tenant, Robots: c.Robots, Session: c.Session, Claims: claims}, nil
+}
+
+// middleware authenticates bearer tokens (or ?access_token= on WebSocket
+// upgrades, which browsers can't add headers to). A bad, expired or revoked
+// token is always refused; a missing one too, on everything but authExempt
+// paths, unless AUTH_REQUIRED=false.
+func (a *auth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/api/lora/uplink/") || strings.HasPrefix(req.URL.Path, "/scim/") {
+			next.ServeHTTP(w, req) // webhooks and SCIM carry their own token
+			return
+		}
+		tok := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if tok == req.Header.Get("Authorization") {
+			tok = ""
+		}
+		if tok == "" && strings.HasPrefix(req.URL.Path, "/ws") {
+			tok = req.URL.Query().Get("access_token")
+		}
+		if tok == "" {
+			if a.required && !authExempt(req.URL.Path) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="evabot"`)
+				http.Error(w, "authentication required", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		id, err := a.verify(tok)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), identityKey{}, id)))
+	})
+}
+
+// POST /api/auth/login with {"username":"…","password":"…"}. Beyond
+// SESSION_MAX_PER_USER concurrent sessions the oldest are ended.
+func (a *auth) handleLogin(w http.ResponseWriter, req *http.Request) {
+	var in struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		http.Error(w, "bad request", 400)
+		return
+	}
+	u, ok := a.users.check(in.Username, in.Password)
+	if !ok {
+		log.Printf("auth: failed login for %q from %s", in.Username, req.RemoteAddr)
+		http.Error(w, "invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	existing, err := a.sessionsOf(u.Username)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for i := 0; a.maxSessions > 0 && i <= len(existing)-a.maxSessions; i++ {
+		if err := a.revoke(existing[i].key()); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	s := &session{ID: nuid.Next(), User: u.Username, Created: now, IP: req.RemoteAddr, UserAgent: req.UserAgent()}
+	if err := a.audit.record(auditRecord{Actor: u.Username + "@" + req.RemoteAddr, Action: "auth.login", Details: map[string]interface{}{"session": s.ID}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	tp, err := a.tokens(u, s, 0)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, tp)
+}
+
+// POST /api/auth/refresh with {"refresh_token":"…"} returns a new pair; the
+// old refresh token stops working.
+func (a *auth) handleRefresh(w http.ResponseWriter, req *http.Request) {
+	var in struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		http.Error(w, "bad request", 400)
+		return
+	}
+	parts := strings.SplitN(in.RefreshToken, ".", 3)
+	if len(parts) != 3 {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	key := parts[0] + "." + parts[1]
+	e, err := a.kv.Get(key)
+	if err != nil {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	var s session
+	if err := json.Unmarshal(e.Value(), &s); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(in.RefreshToken)), []byte(s.RefreshHash)) != 1 {
+		// an already-rotated token: someone else has the current one
+		log.Printf("auth: refresh token reuse on session %s of %s, ending it", s.ID, s.User)
+		_ = a.revoke(key)
+		_ = a.audit.record(auditRecord{Actor: s.User + "@" + req.RemoteAddr, Action: "auth.refresh_reuse", Details: map[string]interface{}{"session": s.ID}})
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if time.Now().After(s.Expires) {
+		_ = a.revoke(key)
+		http.Error(w, "session expired", http.StatusUnauthorized)
+		return
+	}
+	u, err := a.users.get(s.User)
+	if err != nil || u.Disabled {
+		_ = a.revoke(key)
+		http.Error(w, "account disabled", http.StatusUnauthorized)
+		return
+	}
+	tp, err := a.tokens(u, &s, e.Revision())
+	if errors.Is(err, nats.ErrKeyExists) {
+		http.Error(w, "refresh raced with another refresh", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, tp)
+}
+
+// POST /api/auth/logout ends the caller's session.
+func (a *auth) handleLogout(w http.ResponseWriter, req *http.Request) {
+	id := identityOf(req)
+	if id == nil {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return
+	}
+	if id.Session == "" {
+		http.Error(w, "token isn't a login session", 400)
+		return
+	}
+	if err := a.revoke(id.User + "." + id.Session); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// GET /api/me
+func (a *auth) handleMe(w http.ResponseWriter, req *http.Request) {
+	id := identityOf(req)
+	if id == nil {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return
+	}
+	if id.Session == "" {
+		writeJSON(w, map[string]interface{}{"identity": id})
+		return
+	}
+	u, err := a.users.get(id.User)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	a.mu.RLock()
+	s := a.live[id.User+"."+id.Session]
+	a.mu.RUnlock()
+	s.RefreshHash = ""
+	writeJSON(w, map[string]interface{}{"user": u.public(), "session": s})
+}
+
+// GET /api/users/{name}/sessions
+func (a *auth) handleListSessions(w http.ResponseWriter, req *http.Request) {
+	list, err := a.sessionsOf(chi.URLParam(req, "name"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// DELETE /api/users/{name}/sessions ends all of a user's sessions at once.
+func (a *auth) handleRevokeUser(w http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, "name")
+	if err := a.audit.record(auditRecord{Actor: actorOf(req), Action: "auth.revoke_user", Details: map[string]interface{}{"user": name}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	n, err := a.revokeUser(name)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, map[string]int{"revoked": n})
+}
+
+// DELETE /api/users/{name}/sessions/{sid}
+func (a *auth) handleRevokeSession(w http.ResponseWriter, req *http.Request) {
+	name, sid := chi.URLParam(req, "name"), chi.URLParam(req, "sid")
+	if err := a.audit.record(auditRecord{Actor: actorOf(req), Action: "auth.revoke_session", Details: map[string]interface{}{"user": name, "session": sid}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	if err := a.revoke(name + "." + sid); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
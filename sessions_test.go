@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRefreshRotation walks one session through its refresh tokens: each
+// refresh hands out a new pair and retires the old refresh token, and
+// presenting a retired one ends the session, current token included.
+func TestRefreshRotation(t *testing.T) {
+	_, js := testJetStream(t)
+	users, err := newUsers(js, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := newAuditLog(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAuth(js, users, audit, "secret", time.Minute, time.Hour, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(h http.HandlerFunc, body string) (int, tokenPair) {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		var tp tokenPair
+		if rec.Code == 200 {
+			if err := json.Unmarshal(rec.Body.Bytes(), &tp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, tp
+	}
+	refresh := func(tok string) string { return `{"refresh_token":"` + tok + `"}` }
+
+	code, first := call(a.handleLogin, `{"username":"admin","password":"pw"}`)
+	if code != 200 {
+		t.Fatalf("login: %d", code)
+	}
+	pairs := map[string]tokenPair{"first": first}
+	steps := []struct {
+		name    string
+		present string // the pair whose refresh token is sent, or a raw token
+		want    int
+		save    string // name for the pair handed out
+	}{
+		{"malformed", "no-dots", 401, ""},
+		{"unknown session", "admin.nosuchsession.x", 401, ""},
+		{"first refresh", "first", 200, "second"},
+		{"rotated again", "second", 200, "third"},
+		{"replay of a retired token", "second", 401, ""},
+		{"current token after the replay", "third", 401, ""},
+		{"original token", "first", 401, ""},
+	}
+	for _, s := range steps {
+		tok := s.present
+		if p, ok := pairs[s.present]; ok {
+			tok = p.RefreshToken
+		}
+		code, tp := call(a.handleRefresh, refresh(tok))
+		if code != s.want {
+			t.Fatalf("%s: got %d, want %d", s.name, code, s.want)
+		}
+		if s.save != "" {
+			if tp.RefreshToken == "" || tp.RefreshToken == tok {
+				t.Fatalf("%s: refresh token wasn't rotated", s.name)
+			}
+			pairs[s.save] = tp
+		}
+	}
+
+	// the watcher may briefly replay the session's last update before its
+	// deletion; the access token must stop working once it settles
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := a.verify(pairs["third"].AccessToken); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("access token still valid after its session ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
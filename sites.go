@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// site is a physical deployment location. External context (weather, ...)
+// is fetched per site by cmd/enricher and written as telemetry.site-{id}.*.
+type site struct {
+	ID   string  `json:"id"`
+	Name string  `json:"name,omitempty"`
+	Lat  float64 `json:"lat"`
+	Lon  float64 `json:"lon"`
+}
+
+type sites struct {
+	kv nats.KeyValue
+}
+
+func newSites(js nats.JetStreamContext) (*sites, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "SITES", History: 5, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	return &sites{kv: kv}, nil
+}
+
+// GET /api/sites
+func (s *sites) handleList(w http.ResponseWriter, _ *http.Request) {
+	keys, err := kvKeys(s.kv, ">")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := []site{}
+	for _, k := range keys {
+		e, err := s.kv.Get(k)
+		if err != nil {
+			continue
+		}
+		var st site
+		if json.Unmarshal(e.Value(), &st) == nil {
+			out = append(out, st)
+		}
+	}
+	writeJSON(w, out)
+}
+
+// GET /api/sites/{id}
+func (s *sites) handleGet(w http.ResponseWriter, req *http.Request) {
+	e, err := s.kv.Get(chi.URLParam(req, "id"))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such site", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(e.Value())
+}
+
+// PUT /api/sites/{id} with {"name":"North yard","lat":38.72,"lon":-9.14}
+func (s *sites) handlePut(w http.ResponseWriter, req *http.Request) {
+	var st site
+	if err := json.NewDecoder(req.Body).Decode(&st); err != nil {
+		http.Error(w, "bad site: "+err.Error(), 400)
+		return
+	}
+	st.ID = chi.URLParam(req, "id")
+	if !tokenRe.MatchString(st.ID) {
+		http.Error(w, "bad site id (letters, digits, _ and - only)", 400)
+		return
+	}
+	if st.Lat < -90 || st.Lat > 90 || st.Lon < -180 || st.Lon > 180 {
+		http.Error(w, "lat/lon out of range", 400)
+		return
+	}
+	b, _ := json.Marshal(st)
+	if _, err := s.kv.Put(st.ID, b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, st)
+}
+
+// DELETE /api/sites/{id}
+func (s *sites) handleDelete(w http.ResponseWriter, req *http.Request) {
+	if err := s.kv.Delete(chi.URLParam(req, "id")); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
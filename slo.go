@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/latency"
+	"github.com/VazRibeiro/evabot-backend/internal/metrics"
+	"github.com/nats-io/nats.go"
+)
+
+// sloMinSamples is how many latencies a robot needs in the window before
+// its quantile is held against the SLO; fewer are too noisy to alert on.
+const sloMinSamples = 20
+
+var sloRe = regexp.MustCompile(`^p(\d{1,2}(?:\.\d+)?)<(\S+)$`)
+
+// latencySLO holds publish→persisted and publish→delivered latencies (see
+// internal/latency) to LATENCY_SLO, a quantile under a bound such as p99<2s
+// (the default), over the last LATENCY_SLO_WINDOW (default 5m). Every check
+// it sets the fleet's quantiles on /metrics and, through alerting, fires an
+// slo.{stage} alert for the fleet, and for each robot with enough samples,
+// whose quantile is over the bound, notifying LATENCY_SLO_NOTIFY's channels.
+type latencySLO struct {
+	kv     nats.KeyValue
+	rb     *rbac
+	alerts *alerting
+	spec   string
+	q      float64
+	field  string // p99_ms
+	bound  time.Duration
+	window time.Duration
+	notify []string
+	gauge  *metrics.Gauge
+}
+
+func newLatencySLO(kv nats.KeyValue, rb *rbac, alerts *alerting, spec string, window time.Duration, notify string) (*latencySLO, error) {
+	m := sloRe.FindStringSubmatch(spec)
+	if m == nil {
+		return nil, fmt.Errorf("LATENCY_SLO %q: want p<quantile><<bound>, e.g. p99<2s", spec)
+	}
+	q, _ := strconv.ParseFloat(m[1], 64)
+	bound, err := time.ParseDuration(m[2])
+	if err != nil || q <= 0 || bound <= 0 {
+		return nil, fmt.Errorf("LATENCY_SLO %q: want p<quantile><<bound>, e.g. p99<2s", spec)
+	}
+	s := &latencySLO{kv: kv, rb: rb, alerts: alerts, spec: spec, q: q / 100, field: "p" + m[1] + "_ms", bound: bound, window: window,
+		gauge: metrics.NewGauge("evabot_latency_seconds", "Fleet-wide telemetry latency quantiles over LATENCY_SLO_WINDOW, by stage.", "stage", "quantile")}
+	for _, c := range strings.Split(notify, ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		if alerts.channels[c] == nil {
+			return nil, fmt.Errorf("LATENCY_SLO_NOTIFY: no notification channel %q (see ALERT_CHANNELS)", c)
+		}
+		s.notify = append(s.notify, c)
+	}
+	return s, nil
+}
+
+// run checks every interval, for good.
+func (s *latencySLO) run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		s.check(now)
+	}
+}
+
+func (s *latencySLO) check(now time.Time) {
+	for _, stage := range []string{latency.Persisted, latency.Delivered} {
+		fleet, robots, err := latency.Load(s.kv, stage, now.Add(-s.window))
+		if err != nil {
+			log.Printf("latency SLO: %s: %v", stage, err)
+			continue
+		}
+		for _, q := range []float64{0.5, 0.9, 0.99, s.q} {
+			s.gauge.Set(fleet.Quantile(q)/1000, stage, strconv.FormatFloat(q, 'f', -1, 64))
+		}
+		values := map[string]float64{}
+		if fleet.Count() >= sloMinSamples {
+			values["telemetry"] = fleet.Quantile(s.q)
+		}
+		for robot, h := range robots {
+			if h.Count() >= sloMinSamples {
+				values["telemetry."+robot] = h.Quantile(s.q)
+			}
+		}
+		r := &alertRule{Name: "slo." + stage, Kind: "slo", Field: s.field, Op: ">", Value: float64(s.bound.Milliseconds()),
+			Severity: "critical", Notify: s.notify}
+		s.alerts.assess(r, values, now)
+	}
+}
+
+type latencySummary struct {
+	Count uint64  `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+	SLO   float64 `json:"slo_ms"` // the SLO's quantile
+	Max   float64 `json:"max_ms"`
+	Met   bool    `json:"met"`
+}
+
+func (s *latencySLO) summary(h *latency.Hist) latencySummary {
+	out := latencySummary{Count: h.Count(), P50: h.Quantile(0.5), P90: h.Quantile(0.9), P99: h.Quantile(0.99),
+		SLO: h.Quantile(s.q), Max: h.Max}
+	out.Met = out.SLO <= float64(s.bound.Milliseconds())
+	return out
+}
+
+// GET /api/slo/latency[?window=1h] gives each stage's latency quantiles for
+// the fleet and per robot over the window (default LATENCY_SLO_WINDOW), and
+// whether each meets the SLO. Callers scoped to some robots get only theirs.
+func (s *latencySLO) handleGet(w http.ResponseWriter, req *http.Request) {
+	window := s.window
+	if v := req.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute || d > 24*time.Hour {
+			http.Error(w, "bad 'window' (1m to 24h)", 400)
+			return
+		}
+		window = d
+	}
+	id := identityOf(req)
+	type stageSummary struct {
+		Fleet  *latencySummary           `json:"fleet,omitempty"`
+		Robots map[string]latencySummary `json:"robots"`
+	}
+	out := struct {
+		SLO    string                  `json:"slo"`
+		Window string                  `json:"window"`
+		Stages map[string]stageSummary `json:"stages"`
+	}{SLO: s.spec, Window: window.String(), Stages: map[string]stageSummary{}}
+	for _, stage := range []string{latency.Persisted, latency.Delivered} {
+		fleet, robots, err := latency.Load(s.kv, stage, time.Now().Add(-window))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		st := stageSummary{Robots: map[string]latencySummary{}}
+		if s.rb.unscoped(id) {
+			f := s.summary(fleet)
+			st.Fleet = &f
+		}
+		for robot, h := range robots {
+			if s.rb.sees(id, robot) {
+				st.Robots[robot] = s.summary(h)
+			}
+		}
+		out.Stages[stage] = st
+	}
+	writeJSON(w, out)
+}
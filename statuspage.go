@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// incidentsBucket holds one incident per key, by id.
+const incidentsBucket = "INCIDENTS"
+
+// Component states, best to worst.
+const (
+	compOperational = "operational"
+	compDegraded    = "degraded"
+	compOutage      = "outage"
+)
+
+var compRank = map[string]int{compOperational: 0, compDegraded: 1, compOutage: 2}
+
+// statusComponents are what the status page reports on, and what an
+// incident may name.
+var statusComponents = []string{"api", "realtime", "messaging", "storage", "fleet"}
+
+// incidentStatuses are an incident's stages; resolved ends it.
+var incidentStatuses = map[string]bool{"investigating": true, "identified": true, "monitoring": true, "resolved": true}
+
+// incidentImpacts maps an incident's impact to what it does to the
+// components it names.
+var incidentImpacts = map[string]string{"minor": compDegraded, "major": compOutage, "critical": compOutage}
+
+// statusCacheFor is how long the public summary is reused, so an
+// unauthenticated page can't make the gateway check Influx at will.
+const statusCacheFor = 10 * time.Second
+
+// resolvedShownFor is how long a resolved incident stays on the page.
+const resolvedShownFor = 7 * 24 * time.Hour
+
+// incident is an outage or degradation declared by an admin, with its
+// updates, oldest first.
+type incident struct {
+	ID         string           `json:"id"`
+	Title      string           `json:"title"`
+	Status     string           `json:"status"`
+	Impact     string           `json:"impact"`
+	Components []string         `json:"components"`
+	Updates    []incidentUpdate `json:"updates"`
+	Started    time.Time        `json:"started"`
+	Resolved   *time.Time       `json:"resolved,omitempty"`
+	By         string           `json:"by,omitempty"`
+}
+
+type incidentUpdate struct {
+	At      time.Time `json:"at"`
+	Status  string    `json:"status"`
+	Message string    `json:"message"`
+	By      string    `json:"by,omitempty"`
+}
+
+// public is the incident as the status page shows it, without who wrote it.
+func (in incident) public() incident {
+	in.By = ""
+	in.Updates = append([]incidentUpdate(nil), in.Updates...)
+	for i := range in.Updates {
+		in.Updates[i].By = ""
+	}
+	return in
+}
+
+type componentStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+type fleetStatus struct {
+	Robots       int     `json:"robots"`
+	Online       int     `json:"online"`
+	Stale        int     `json:"stale"`
+	Offline      int     `json:"offline"`
+	Availability float64 `json:"availability"` // online / robots, 1 with none
+}
+
+// statusSummary is what GET /status.json returns.
+type statusSummary struct {
+	Status     string            `json:"status"` // the worst component's
+	Components []componentStatus `json:"components"`
+	Fleet      fleetStatus       `json:"fleet"`
+	Incidents  []incident        `json:"incidents"` // open
+	Resolved   []incident        `json:"resolved"`  // within the last week
+	Updated    time.Time         `json:"updated"`
+}
+
+// statusPage serves a summary for customers to check during an outage:
+// whether the gateway, its live feeds, NATS and Influx are working, how
+// much of the fleet is online, and the incidents admins have declared. It
+// needs no account: STATUS_PAGE=public (the default) serves it to anyone,
+// token only to callers with STATUS_PAGE_TOKEN (?token= or X-Status-Token),
+// and off not at all. It names no robots and no customers.
+type statusPage struct {
+	nc    *nats.Conn
+	kv    nats.KeyValue
+	hub   *hub
+	probe *canary
+	pres  *presence
+	reg   *registry
+	audit *auditLog
+	mode  string
+	token string
+	title string
+
+	mu     sync.Mutex
+	cached *statusSummary
+}
+
+func newStatusPage(nc *nats.Conn, js nats.JetStreamContext, h *hub, probe *canary, pres *presence, reg *registry, audit *auditLog, mode, token string) (*statusPage, error) {
+	switch mode {
+	case "public", "off":
+	case "token":
+		if token == "" {
+			return nil, errors.New("STATUS_PAGE=token needs STATUS_PAGE_TOKEN")
+		}
+	default:
+		return nil, errors.New("bad STATUS_PAGE (public, token or off)")
+	}
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: incidentsBucket, History: 5, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	return &statusPage{nc: nc, kv: kv, hub: h, probe: probe, pres: pres, reg: reg, audit: audit, mode: mode, token: token,
+		title: env("UI_TITLE", "evabot")}, nil
+}
+
+// summary returns the current summary, at most statusCacheFor old.
+func (s *statusPage) summary(ctx context.Context) statusSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cached != nil && time.Since(s.cached.Updated) < statusCacheFor {
+		return *s.cached
+	}
+	now := time.Now().UTC()
+	sum := statusSummary{Status: compOperational, Incidents: []incident{}, Resolved: []incident{}, Updated: now}
+	comps := map[string]string{"api": compOperational, "realtime": compOperational, "messaging": compOperational, "fleet": compOperational}
+	if s.hub.draining() {
+		comps["api"] = compDegraded
+	}
+	if s.probe != nil {
+		if _, ok := s.probe.status(); !ok {
+			comps["realtime"] = compDegraded
+		}
+	}
+	if s.nc.Status() != nats.CONNECTED {
+		comps["messaging"], comps["realtime"] = compOutage, compOutage
+	}
+	if influxClient != nil {
+		hctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		comps["storage"] = compOperational
+		if ok, err := influxClient.Ping(hctx); err != nil || !ok {
+			comps["storage"] = compOutage
+		}
+		cancel()
+	}
+
+	incidents, err := s.list()
+	if err != nil {
+		log.Printf("status: incidents: %v", err)
+	}
+	for _, in := range incidents {
+		if in.Resolved != nil {
+			if now.Sub(*in.Resolved) < resolvedShownFor {
+				sum.Resolved = append(sum.Resolved, in.public())
+			}
+			continue
+		}
+		sum.Incidents = append(sum.Incidents, in.public())
+		for _, c := range in.Components {
+			if st, ok := comps[c]; ok && compRank[incidentImpacts[in.Impact]] > compRank[st] {
+				comps[c] = incidentImpacts[in.Impact]
+			}
+		}
+	}
+	for _, name := range statusComponents {
+		st, ok := comps[name]
+		if !ok {
+			continue
+		}
+		sum.Components = append(sum.Components, componentStatus{name, st})
+		if compRank[st] > compRank[sum.Status] {
+			sum.Status = st
+		}
+	}
+
+	sum.Fleet.Availability = 1
+	if robots, err := s.reg.active(); err != nil {
+		log.Printf("status: robots: %v", err)
+	} else {
+		for _, r := range robots {
+			switch s.pres.stateOf(r.ID, now) {
+			case presOnline:
+				sum.Fleet.Online++
+			case presStale:
+				sum.Fleet.Stale++
+			default:
+				sum.Fleet.Offline++
+			}
+		}
+		if sum.Fleet.Robots = len(robots); sum.Fleet.Robots > 0 {
+			sum.Fleet.Availability = float64(sum.Fleet.Online) / float64(sum.Fleet.Robots)
+		}
+	}
+	s.cached = &sum
+	return sum
+}
+
+// forget drops the cached summary, after an incident changes.
+func (s *statusPage) forget() {
+	s.mu.Lock()
+	s.cached = nil
+	s.mu.Unlock()
+}
+
+// allowed applies STATUS_PAGE, answering for the request when it isn't.
+func (s *statusPage) allowed(w http.ResponseWriter, req *http.Request) bool {
+	switch s.mode {
+	case "off":
+		http.NotFound(w, req)
+		return false
+	case "token":
+		tok := req.URL.Query().Get("token")
+		if tok == "" {
+			tok = req.Header.Get("X-Status-Token")
+		}
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(s.token)) != 1 {
+			http.Error(w, "status token required", http.StatusUnauthorized)
+			return false
+		}
+	}
+	return true
+}
+
+// GET /status.json
+func (s *statusPage) handleJSON(w http.ResponseWriter, req *http.Request) {
+	if !s.allowed(w, req) {
+		return
+	}
+	w.Header().Set("Cache-Control", "max-age=10")
+	writeJSON(w, s.summary(req.Context()))
+}
+
+var statusTmpl = template.Must(template.New("status").Funcs(template.FuncMap{
+	"pct":  func(f float64) string { return fmt.Sprintf("%.1f%%", f*100) },
+	"when": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04 MST") },
+}).Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width">
+<meta http-equiv="refresh" content="30"><title>{{.Title}} status</title>
+<style>body{font:15px system-ui,sans-serif;max-width:42em;margin:2em auto;padding:0 1em;color:#222}
+.operational{color:#1a7f37}.degraded{color:#9a6700}.outage{color:#cf222e}
+li{margin:.3em 0}small{color:#666}</style></head><body>
+<h1>{{.Title}}: <span class="{{.Sum.Status}}">{{.Sum.Status}}</span></h1>
+<ul>{{range .Sum.Components}}<li>{{.Name}}: <span class="{{.Status}}">{{.Status}}</span></li>{{end}}</ul>
+<p>Fleet: {{.Sum.Fleet.Online}} of {{.Sum.Fleet.Robots}} robots online ({{pct .Sum.Fleet.Availability}}).</p>
+{{if .Sum.Incidents}}<h2>Ongoing incidents</h2>{{range .Sum.Incidents}}<h3>{{.Title}} <small>{{.Impact}}, since {{when .Started}}</small></h3>
+<ul>{{range .Updates}}<li><b>{{.Status}}</b> <small>{{when .At}}</small><br>{{.Message}}</li>{{end}}</ul>{{end}}{{end}}
+{{if .Sum.Resolved}}<h2>Resolved this week</h2><ul>{{range .Sum.Resolved}}<li>{{.Title}} <small>{{when .Started}} to {{when .Resolved}}</small></li>{{end}}</ul>{{end}}
+<p><small>Updated {{when .Sum.Updated}}</small></p>
+</body></html>
+`))
+
+// GET /status is the same summary as a page for people.
+func (s *statusPage) handlePage(w http.ResponseWriter, req *http.Request) {
+	if !s.allowed(w, req) {
+		return
+	}
+	sum := s.summary(req.Context())
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "max-age=10")
+	if sum.Status == compOutage {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	statusTmpl.Execute(w, struct {
+		Title string
+		Sum   statusSummary
+	}{s.title, sum})
+}
+
+func (s *statusPage) list() ([]incident, error) {
+	keys, err := kvKeys(s.kv, ">")
+	if err != nil {
+		return nil, err
+	}
+	out := []incident{}
+	for _, k := range keys {
+		if in, err := s.get(k); err == nil {
+			out = append(out, *in)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.After(out[j].Started) })
+	return out, nil
+}
+
+func (s *statusPage) get(id string) (*incident, error) {
+	e, err := s.kv.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	var in incident
+	if err := json.Unmarshal(e.Value(), &in); err != nil {
+		return nil, err
+	}
+	return &in, nil
+}
+
+func (s *statusPage) put(in *incident) error {
+	b, _ := json.Marshal(in)
+	_, err := s.kv.Put(in.ID, b)
+	s.forget()
+	return err
+}
+
+// GET /api/incidents[?state=open|resolved] lists incidents, newest first.
+func (s *statusPage) handleList(w http.ResponseWriter, req *http.Request) {
+	state := req.URL.Query().Get("state")
+	if state != "" && state != "open" && state != "resolved" {
+		http.Error(w, "bad state (open or resolved)", 400)
+		return
+	}
+	all, err := s.list()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := []incident{}
+	for _, in := range all {
+		if state == "" || (state == "resolved") == (in.Resolved != nil) {
+			out = append(out, in)
+		}
+	}
+	writeJSON(w, out)
+}
+
+// incidentInput is the body of POST /api/incidents and of an update; an
+// update may leave out what doesn't change.
+type incidentInput struct {
+	Title      string   `json:"title"`
+	Status     string   `json:"status"`
+	Impact     string   `json:"impact"`
+	Components []string `json:"components"`
+	Message    string   `json:"message"`
+}
+
+func (i incidentInput) check() error {
+	if i.Status != "" && !incidentStatuses[i.Status] {
+		return errors.New("bad status (investigating, identified, monitoring or resolved)")
+	}
+	if i.Impact != "" && incidentImpacts[i.Impact] == "" {
+		return errors.New("bad impact (minor, major or critical)")
+	}
+	for _, c := range i.Components {
+		known := false
+		for _, name := range statusComponents {
+			known = known || c == name
+		}
+		if !known {
+			return errors.New("bad component " + c + " (" + strings.Join(statusComponents, ", ") + ")")
+		}
+	}
+	if len(i.Title) > 200 || len(i.Message) > 4000 {
+		return errors.New("title (200) or message (4000) too long")
+	}
+	return nil
+}
+
+// POST /api/incidents declares an incident:
+//
+//	{"title":"Delayed telemetry","impact":"minor","components":["realtime"],"message":"We are looking into it."}
+//
+// status defaults to investigating.
+func (s *statusPage) handleCreate(w http.ResponseWriter, req *http.Request) {
+	var in incidentInput
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64<<10)).Decode(&in); err != nil {
+		http.Error(w, "bad JSON", 400)
+		return
+	}
+	if in.Status == "" {
+		in.Status = "investigating"
+	}
+	if in.Impact == "" {
+		in.Impact = "minor"
+	}
+	if err := in.check(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if in.Title == "" || in.Message == "" || len(in.Components) == 0 {
+		http.Error(w, "title, message and components required", 400)
+		return
+	}
+	now, by := time.Now().UTC(), actorOf(req)
+	inc := &incident{ID: nuid.Next(), Title: in.Title, Status: in.Status, Impact: in.Impact, Components: in.Components,
+		Updates: []incidentUpdate{{At: now, Status: in.Status, Message: in.Message, By: by}}, Started: now, By: by}
+	if in.Status == "resolved" {
+		inc.Resolved = &now
+	}
+	if err := s.audit.record(auditRecord{Actor: by, Action: "incident.create", Details: map[string]interface{}{"id": inc.ID, "title": inc.Title, "impact": inc.Impact, "components": inc.Components}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	if err := s.put(inc); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSONStatus(w, http.StatusCreated, inc)
+}
+
+// POST /api/incidents/{id}/updates posts an update, e.g.
+// {"status":"resolved","message":"Fixed."}; title, impact and components
+// change too when given. Resolving sets resolved; a later update reopens.
+func (s *statusPage) handleUpdate(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	inc, err := s.get(id)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such incident", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var in incidentInput
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64<<10)).Decode(&in); err != nil {
+		http.Error(w, "bad JSON", 400)
+		return
+	}
+	if err := in.check(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if in.Message == "" {
+		http.Error(w, "message required", 400)
+		return
+	}
+	now, by := time.Now().UTC(), actorOf(req)
+	if in.Status != "" {
+		inc.Status = in.Status
+	}
+	if in.Title != "" {
+		inc.Title = in.Title
+	}
+	if in.Impact != "" {
+		inc.Impact = in.Impact
+	}
+	if len(in.Components) > 0 {
+		inc.Components = in.Components
+	}
+	inc.Resolved = nil
+	if inc.Status == "resolved" {
+		inc.Resolved = &now
+	}
+	inc.Updates = append(inc.Updates, incidentUpdate{At: now, Status: inc.Status, Message: in.Message, By: by})
+	if err := s.audit.record(auditRecord{Actor: by, Action: "incident.update", Details: map[string]interface{}{"id": id, "status": inc.Status, "impact": inc.Impact}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	if err := s.put(inc); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, inc)
+}
+
+// DELETE /api/incidents/{id} removes an incident declared by mistake.
+func (s *statusPage) handleDelete(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	if _, err := s.get(id); errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such incident", 404)
+		return
+	}
+	if err := s.audit.record(auditRecord{Actor: actorOf(req), Action: "incident.delete", Details: map[string]interface{}{"id": id}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	if err := s.kv.Delete(id); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	s.forget()
+	w.WriteHeader(204)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Budget thresholds, as shares of the budget: a warning event goes out at
+// warnAt, and pruning brings usage down to pruneTo so it isn't repeated on
+// every check.
+const (
+	warnAt  = 0.8
+	pruneTo = 0.9
+)
+
+// byteSize is a size in bytes, configured as a number or "500MB", "20GB".
+type byteSize int64
+
+func (b *byteSize) UnmarshalJSON(data []byte) error {
+	var n int64
+	if json.Unmarshal(data, &n) == nil {
+		*b = byteSize(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mult
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f <= 0 {
+		return fmt.Errorf("bad size %s", data)
+	}
+	*b = byteSize(f * float64(mult))
+	return nil
+}
+
+// budgetStatus is one budget as of the last check.
+type budgetStatus struct {
+	Kind       string     `json:"kind"` // "stream" or "tenant"
+	Name       string     `json:"name"`
+	Budget     int64      `json:"budget"`
+	Used       int64      `json:"used"`
+	Msgs       uint64     `json:"msgs"`
+	State      string     `json:"state"`    // ok, warning, over
+	Prunable   bool       `json:"prunable"` // KV and object buckets hold live state: warned about, never pruned
+	Warned     *time.Time `json:"warned,omitempty"`
+	Pruned     *time.Time `json:"pruned,omitempty"`
+	PrunedMsgs uint64     `json:"pruned_msgs,omitempty"`
+	Checked    time.Time  `json:"checked"`
+}
+
+// storageBudgets keeps an edge deployment's disk from filling up, e.g. with
+// a runaway robot's telemetry. STORAGE_BUDGETS caps streams (KV and object
+// buckets are streams too: KV_ENERGY, OBJ_WASM_MODULES) and tenants' share
+// of TELEMETRY:
+//
+//	STORAGE_BUDGETS='{"streams":{"TELEMETRY":"20GB","EVENTS":"2GB"},"tenants":{"acme":"5GB"}}'
+//
+// Every STORAGE_CHECK_EVERY, a budget past 80% gets an events.storage.{kind}.{name}
+// warning. One still over budget STORAGE_PRUNE_GRACE after its warning has its
+// oldest messages purged (a tenant's: its robots' oldest telemetry) down to
+// 90%, audited as storage.prune. A tenant's TELEMETRY bytes are estimated
+// from its share of the stream's messages.
+type storageBudgets struct {
+	js      nats.JetStreamContext
+	reg     *registry
+	audit   *auditLog
+	streams map[string]byteSize
+	tenants map[string]byteSize
+	grace   time.Duration
+
+	mu     sync.Mutex
+	status map[string]*budgetStatus // kind/name →
+}
+
+func newStorageBudgets(js nats.JetStreamContext, reg *registry, audit *auditLog, config string, grace time.Duration) (*storageBudgets, error) {
+	s := &storageBudgets{js: js, reg: reg, audit: audit, grace: grace, status: map[string]*budgetStatus{}}
+	if config == "" {
+		return s, nil
+	}
+	var c struct {
+		Streams map[string]byteSize `json:"streams"`
+		Tenants map[string]byteSize `json:"tenants"`
+	}
+	if err := json.Unmarshal([]byte(config), &c); err != nil {
+		return nil, fmt.Errorf("bad STORAGE_BUDGETS: %w", err)
+	}
+	s.streams, s.tenants = c.Streams, c.Tenants
+	return s, nil
+}
+
+func (s *storageBudgets) enabled() bool { return len(s.streams)+len(s.tenants) > 0 }
+
+// run checks budgets every interval, for good.
+func (s *storageBudgets) run(interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		if err := s.check(); err != nil {
+			log.Printf("storage budgets: %v", err)
+		}
+	}
+}
+
+func (s *storageBudgets) check() error {
+	for name, budget := range s.streams {
+		info, err := s.js.StreamInfo(name)
+		if err != nil {
+			log.Printf("storage budgets: stream %s: %v", name, err)
+			continue
+		}
+		prunable := !strings.HasPrefix(name, "KV_") && !strings.HasPrefix(name, "OBJ_")
+		s.enforce("stream", name, int64(budget), int64(info.State.Bytes), info.State.Msgs, prunable, func(target float64) (uint64, error) {
+			keep := uint64(float64(info.State.Msgs) * target)
+			return s.purge(name, "", keep)
+		})
+	}
+	if len(s.tenants) == 0 {
+		return nil
+	}
+	info, err := s.js.StreamInfo("TELEMETRY", &nats.StreamInfoRequest{SubjectsFilter: "telemetry.>"})
+	if err != nil {
+		return err
+	}
+	robots, err := s.reg.list()
+	if err != nil {
+		return err
+	}
+	tenantOf := map[string]string{}
+	for _, r := range robots {
+		tenantOf[r.ID] = r.Tenant
+		if r.Tenant == "" {
+			tenantOf[r.ID] = defaultTenant
+		}
+	}
+	perRobot := map[string]uint64{} // robot → messages
+	for subject, n := range info.State.Subjects {
+		parts := strings.SplitN(subject, ".", 3)
+		if len(parts) == 3 {
+			perRobot[parts[1]] += n
+		}
+	}
+	var avg float64
+	if info.State.Msgs > 0 {
+		avg = float64(info.State.Bytes) / float64(info.State.Msgs)
+	}
+	for tenant, budget := range s.tenants {
+		var msgs uint64
+		ids := []string{}
+		for id, n := range perRobot {
+			if tenantOf[id] == tenant || (tenantOf[id] == "" && tenant == defaultTenant) {
+				msgs += n
+				ids = append(ids, id)
+			}
+		}
+		s.enforce("tenant", tenant, int64(budget), int64(float64(msgs)*avg), msgs, true, func(target float64) (uint64, error) {
+			var pruned uint64
+			for _, id := range ids {
+				n, err := s.purge("TELEMETRY", "telemetry."+id+".>", uint64(float64(perRobot[id])*target))
+				pruned += n
+				if err != nil {
+					return pruned, err
+				}
+			}
+			return pruned, nil
+		})
+	}
+	return nil
+}
+
+// purge drops the oldest messages of stream (on subject, if set), keeping
+// the newest keep.
+func (s *storageBudgets) purge(stream, subject string, keep uint64) (uint64, error) {
+	before, err := s.js.StreamInfo(stream)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.js.PurgeStream(stream, &nats.StreamPurgeRequest{Subject: subject, Keep: keep}); err != nil {
+		return 0, err
+	}
+	after, err := s.js.StreamInfo(stream)
+	if err != nil {
+		return 0, err
+	}
+	return before.State.Msgs - after.State.Msgs, nil
+}
+
+// enforce updates the status of one budget, warning and pruning as due.
+// prune keeps the newest target share of the messages it covers.
+func (s *storageBudgets) enforce(kind, name string, budget, used int64, msgs uint64, prunable bool, prune func(target float64) (uint64, error)) {
+	now := time.Now()
+	s.mu.Lock()
+	st := s.status[kind+"/"+name]
+	if st == nil {
+		st = &budgetStatus{Kind: kind, Name: name}
+		s.status[kind+"/"+name] = st
+	}
+	st.Budget, st.Used, st.Msgs, st.Prunable, st.Checked = budget, used, msgs, prunable, now
+	state := "ok"
+	switch {
+	case used > budget:
+		state = "over"
+	case float64(used) >= warnAt*float64(budget):
+		state = "warning"
+	}
+	warnedAt := st.Warned
+	if state == "ok" {
+		st.Warned = nil
+	} else if st.Warned == nil {
+		st.Warned = &now
+	}
+	st.State = state
+	s.mu.Unlock()
+
+	if state == "ok" {
+		return
+	}
+	if warnedAt == nil {
+		s.event(kind, name, "warning", map[string]interface{}{"used": used, "budget": budget, "over": state == "over"})
+		return
+	}
+	if state != "over" || !prunable || now.Sub(*warnedAt) < s.grace {
+		return
+	}
+	target := math.Min(1, pruneTo*float64(budget)/float64(used))
+	pruned, err := prune(target)
+	if err != nil {
+		log.Printf("storage budgets: prune %s %s: %v", kind, name, err)
+	}
+	if pruned == 0 {
+		return
+	}
+	log.Printf("storage budgets: %s %s over budget (%d > %d bytes), pruned its %d oldest messages", kind, name, used, budget, pruned)
+	s.mu.Lock()
+	st.Pruned, st.PrunedMsgs = &now, pruned
+	s.mu.Unlock()
+	details := map[string]interface{}{"kind": kind, "name": name, "used": used, "budget": budget, "pruned_msgs": pruned}
+	if err := s.audit.record(auditRecord{Actor: "storage-budget", Action: "storage.prune", Details: details}); err != nil {
+		log.Printf("storage budgets: audit: %v", err)
+	}
+	s.event(kind, name, "pruned", details)
+}
+
+func (s *storageBudgets) event(kind, name, what string, details map[string]interface{}) {
+	details["event"], details["kind"], details["name"], details["ts"] = what, kind, name, time.Now()
+	b, _ := json.Marshal(details)
+	if _, err := s.js.Publish("events.storage."+kind+"."+name, b); err != nil {
+		log.Printf("storage budgets: event: %v", err)
+	}
+}
+
+// GET /api/storage lists budgets as of the last check.
+func (s *storageBudgets) handleList(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	out := make([]budgetStatus, 0, len(s.status))
+	for _, st := range s.status {
+		out = append(out, *st)
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Kind != out[j].Kind {
+			return out[i].Kind < out[j].Kind
+		}
+		return out[i].Name < out[j].Name
+	})
+	writeJSON(w, map[string]interface{}{"budgets": out, "warn_at": warnAt, "prune_to": pruneTo, "grace": s.grace.String()})
+}
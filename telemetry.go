@@ -0,0 +1,24 @@
+package main
+
+import "encoding/json"
+
+// parsePayload decodes a JSON telemetry payload; non-JSON payloads yield nil.
+func parsePayload(data []byte) map[string]interface{} {
+	var m map[string]interface{}
+	if json.Unmarshal(data, &m) != nil {
+		return nil
+	}
+	return m
+}
+
+// numField looks a numeric field up the same way the worker flattens
+// payloads: inside the "data" block first, then at the top level.
+func numField(m map[string]interface{}, name string) (float64, bool) {
+	if dv, ok := m["data"].(map[string]interface{}); ok {
+		if f, ok := dv[name].(float64); ok {
+			return f, true
+		}
+	}
+	f, ok := m[name].(float64)
+	return f, ok
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// teleopFrame is a command frame from the browser:
+//
+//	{"type":"velocity","linear":0.4,"angular":-0.2}
+//	{"type":"gripper","action":"close","position":0.8}
+//	{"type":"ping"}
+type teleopFrame struct {
+	Type     string   `json:"type"`
+	Linear   float64  `json:"linear"`
+	Angular  float64  `json:"angular"`
+	Action   string   `json:"action"`
+	Position *float64 `json:"position,omitempty"`
+}
+
+// teleopReply is what the gateway sends back per frame.
+type teleopReply struct {
+	Type   string   `json:"type"` // ack | error | stop
+	Seq    int      `json:"seq,omitempty"`
+	Error  string   `json:"error,omitempty"`
+	Linear *float64 `json:"linear,omitempty"` // as sent, after clamping
+}
+
+// teleop drives a robot from a WebSocket. Velocity setpoints go to
+// ctrl.{id}.cmd_vel (linear speed clamped by the throttle policy) and gripper
+// commands to ctrl.{id}.gripper (refused while payload ops are throttled).
+// Frames above rate per second are refused. If the driver goes quiet for
+// deadman, or disconnects, a zero velocity with "reason":"deadman" is sent.
+// One driver per robot; a lockout ends the session.
+//
+// Setpoints are published directly rather than tracked like other commands,
+// and carry expires_ns so a robot that reconnects can ignore stale ones
+// queued on CTRL.
+type teleop struct {
+	nc      *nats.Conn
+	thr     *throttle
+	lock    *lockout
+	audit   *auditLog
+	rate    float64
+	deadman time.Duration
+
+	mu      sync.Mutex
+	drivers map[string]string // robot → actor
+}
+
+func newTeleop(nc *nats.Conn, thr *throttle, lock *lockout, audit *auditLog, rate float64, deadman time.Duration) *teleop {
+	return &teleop{nc: nc, thr: thr, lock: lock, audit: audit, rate: rate, deadman: deadman, drivers: map[string]string{}}
+}
+
+func (t *teleop) send(id, name string, v map[string]interface{}) error {
+	now := time.Now()
+	v["ts_ns"] = now.UnixNano()
+	v["expires_ns"] = now.Add(t.deadman).UnixNano()
+	b, _ := json.Marshal(v)
+	return t.nc.Publish("ctrl."+id+"."+name, b)
+}
+
+func (t *teleop) stop(id, reason string) {
+	if err := t.send(id, "cmd_vel", map[string]interface{}{"linear": 0.0, "angular": 0.0, "reason": reason}); err != nil {
+		log.Printf("teleop: stop %s: %v", id, err)
+	}
+}
+
+// GET /ws/ctrl/{id}
+func (t *teleop) handleWS(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	if !tokenRe.MatchString(id) {
+		http.Error(w, "bad robot id", 400)
+		return
+	}
+	actor := actorOf(req)
+	t.mu.Lock()
+	if other, busy := t.drivers[id]; busy {
+		t.mu.Unlock()
+		http.Error(w, "robot is being driven by "+other, http.StatusConflict)
+		return
+	}
+	t.drivers[id] = actor
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.drivers, id)
+		t.mu.Unlock()
+	}()
+
+	if err := t.audit.record(auditRecord{Actor: actor, Action: "teleop.start", Robot: id}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	c, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	frames := make(chan teleopFrame)
+	bad := make(chan string)
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(closed)
+		for {
+			_, b, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			var f teleopFrame
+			if err := json.Unmarshal(b, &f); err != nil {
+				select {
+				case bad <- "bad frame: " + err.Error():
+					continue
+				case <-done:
+					return
+				}
+			}
+			select {
+			case frames <- f:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	count, stopped := 0, true
+	tokens, last := t.rate, time.Now()
+	deadman := time.NewTimer(t.deadman)
+	defer deadman.Stop()
+	check := time.NewTicker(250 * time.Millisecond)
+	defer check.Stop()
+	reply := func(r teleopReply) bool { return c.WriteJSON(r) == nil }
+
+	end := func(reason string) {
+		if !stopped {
+			t.stop(id, reason)
+		}
+		_ = t.audit.record(auditRecord{Actor: actor, Action: "teleop.end", Robot: id, Details: map[string]interface{}{"reason": reason, "frames": count}})
+	}
+
+	for {
+		select {
+		case <-closed:
+			end("deadman")
+			return
+		case <-check.C:
+			if t.lock.current().Active {
+				reply(teleopReply{Type: "stop", Error: "emergency lockout active"})
+				end("lockout")
+				return
+			}
+			continue
+		case <-deadman.C:
+			if !stopped {
+				t.stop(id, "deadman")
+				stopped = true
+				reply(teleopReply{Type: "stop", Error: "dead-man timeout"})
+			}
+			continue
+		case msg := <-bad:
+			if !reply(teleopReply{Type: "error", Error: msg}) {
+				end("deadman")
+				return
+			}
+			continue
+		case f := <-frames:
+			count++
+			if !deadman.Stop() {
+				select {
+				case <-deadman.C:
+				default:
+				}
+			}
+			deadman.Reset(t.deadman)
+
+			now := time.Now()
+			tokens = math.Min(t.rate, tokens+now.Sub(last).Seconds()*t.rate)
+			last = now
+			if tokens < 1 {
+				reply(teleopReply{Type: "error", Seq: count, Error: "rate limited"})
+				continue
+			}
+			tokens--
+
+			var r teleopReply
+			switch f.Type {
+			case "ping":
+				r = teleopReply{Type: "ack", Seq: count}
+			case "velocity":
+				lin := t.thr.clampSpeed(id, f.Linear)
+				ang := f.Angular
+				if err := t.send(id, "cmd_vel", map[string]interface{}{"linear": lin, "angular": ang}); err != nil {
+					r = teleopReply{Type: "error", Seq: count, Error: err.Error()}
+					break
+				}
+				stopped = lin == 0 && ang == 0
+				r = teleopReply{Type: "ack", Seq: count, Linear: &lin}
+			case "gripper":
+				if !t.thr.current(id).PayloadOps {
+					r = teleopReply{Type: "error", Seq: count, Error: "payload operations are throttled"}
+					break
+				}
+				if f.Action != "open" && f.Action != "close" && f.Position == nil {
+					r = teleopReply{Type: "error", Seq: count, Error: "gripper needs action open|close or a position"}
+					break
+				}
+				cmd := map[string]interface{}{"action": f.Action}
+				if f.Position != nil {
+					cmd["position"] = *f.Position
+				}
+				if err := t.send(id, "gripper", cmd); err != nil {
+					r = teleopReply{Type: "error", Seq: count, Error: err.Error()}
+					break
+				}
+				r = teleopReply{Type: "ack", Seq: count}
+			default:
+				r = teleopReply{Type: "error", Seq: count, Error: "unknown frame type " + f.Type}
+			}
+			if !reply(r) {
+				end("deadman")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// defaultTenant is used when a request matches no tenant.
+const defaultTenant = "default"
+
+// tenantSettings is what the frontend needs to brand and configure itself.
+type tenantSettings struct {
+	ID          string            `json:"id"`
+	DisplayName string            `json:"display_name"`
+	LogoURL     string            `json:"logo_url,omitempty"`
+	Hostnames   []string          `json:"hostnames,omitempty"`
+	Units       tenantUnits       `json:"units"`
+	Map         tenantMap         `json:"map"`
+	Features    map[string]bool   `json:"features"`
+	Extra       map[string]string `json:"extra,omitempty"`
+}
+
+type tenantUnits struct {
+	Length      string `json:"length"`      // m | ft
+	Speed       string `json:"speed"`       // m/s | km/h | mph
+	Temperature string `json:"temperature"` // C | F
+}
+
+// tenantMap carries browser-side map provider keys; they are public by nature.
+type tenantMap struct {
+	Provider string `json:"provider,omitempty"`
+	APIKey   string `json:"api_key,omitempty"`
+	StyleURL string `json:"style_url,omitempty"`
+}
+
+func (t *tenantSettings) normalize() {
+	if t.DisplayName == "" {
+		t.DisplayName = t.ID
+	}
+	if t.Units.Length == "" {
+		t.Units.Length = "m"
+	}
+	if t.Units.Speed == "" {
+		t.Units.Speed = "m/s"
+	}
+	if t.Units.Temperature == "" {
+		t.Units.Temperature = "C"
+	}
+	if t.Features == nil {
+		t.Features = map[string]bool{}
+	}
+	for i, h := range t.Hostnames {
+		t.Hostnames[i] = strings.ToLower(h)
+	}
+}
+
+// tenants holds per-customer settings in the TENANTS bucket. A request belongs
+// to the tenant named by X-Tenant, else the one listing its Host, else
+// "default".
+type tenants struct {
+	kv    nats.KeyValue
+	audit *auditLog
+
+	mu     sync.RWMutex
+	byID   map[string]tenantSettings
+	byHost map[string]string
+}
+
+func newTenants(js nats.JetStreamContext, audit *auditLog) (*tenants, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "TENANTS", History: 10, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	t := &tenants{kv: kv, audit: audit, byID: map[string]tenantSettings{}, byHost: map[string]string{}}
+	w, err := kv.WatchAll()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for e := range w.Updates() {
+			if e == nil {
+				continue
+			}
+			t.mu.Lock()
+			delete(t.byID, e.Key())
+			var s tenantSettings
+			if e.Operation() == nats.KeyValuePut && json.Unmarshal(e.Value(), &s) == nil {
+				s.normalize()
+				t.byID[e.Key()] = s
+			}
+			t.byHost = map[string]string{}
+			for id, s := range t.byID {
+				for _, h := range s.Hostnames {
+					t.byHost[h] = id
+				}
+			}
+			t.mu.Unlock()
+		}
+	}()
+	return t, nil
+}
+
+// tenantOf names the tenant a request belongs to.
+func (t *tenants) tenantOf(req *http.Request) string {
+	if id := req.Header.Get("X-Tenant"); id != "" {
+		return id
+	}
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if id, ok := t.byHost[host]; ok {
+		return id
+	}
+	return defaultTenant
+}
+
+func (t *tenants) settings(id string) (tenantSettings, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	s, ok := t.byID[id]
+	return s, ok
+}
+
+// GET /api/tenant/settings for the caller's tenant. An unconfigured default
+// tenant gets built-in defaults so a fresh install works.
+func (t *tenants) handleSettings(w http.ResponseWriter, req *http.Request) {
+	id := t.tenantOf(req)
+	s, ok := t.settings(id)
+	if !ok {
+		if id != defaultTenant {
+			http.Error(w, "unknown tenant", 404)
+			return
+		}
+		s = tenantSettings{ID: defaultTenant, DisplayName: "evabot"}
+		s.normalize()
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, s)
+}
+
+// GET /api/tenants
+func (t *tenants) handleList(w http.ResponseWriter, _ *http.Request) {
+	t.mu.RLock()
+	out := make([]tenantSettings, 0, len(t.byID))
+	for _, s := range t.byID {
+		out = append(out, s)
+	}
+	t.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	writeJSON(w, out)
+}
+
+// GET /api/tenants/{id}
+func (t *tenants) handleGet(w http.ResponseWriter, req *http.Request) {
+	e, err := t.kv.Get(chi.URLParam(req, "id"))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such tenant", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(e.Value())
+}
+
+// PUT /api/tenants/{id} replaces a tenant's settings.
+func (t *tenants) handlePut(w http.ResponseWriter, req *http.Request) {
+	var s tenantSettings
+	if err := json.NewDecoder(req.Body).Decode(&s); err != nil {
+		http.Error(w, "bad settings: "+err.Error(), 400)
+		return
+	}
+	s.ID = chi.URLParam(req, "id")
+	if !tokenRe.MatchString(s.ID) {
+		http.Error(w, "bad tenant id (letters, digits, _ and - only)", 400)
+		return
+	}
+	s.normalize()
+	t.mu.RLock()
+	for _, h := range s.Hostnames {
+		if other, ok := t.byHost[h]; ok && other != s.ID {
+			t.mu.RUnlock()
+			http.Error(w, "hostname "+h+" already belongs to tenant "+other, 409)
+			return
+		}
+	}
+	t.mu.RUnlock()
+
+	if err := t.audit.record(auditRecord{Actor: actorOf(req), Action: "tenant.put", Details: map[string]interface{}{"tenant": s.ID}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	b, _ := json.Marshal(s)
+	if _, err := t.kv.Put(s.ID, b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, s)
+}
+
+// DELETE /api/tenants/{id}
+func (t *tenants) handleDelete(w http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	if err := t.audit.record(auditRecord{Actor: actorOf(req), Action: "tenant.delete", Details: map[string]interface{}{"tenant": id}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	if err := t.kv.Delete(id); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// throttleStage is one step of the degradation policy. A stage is active when
+// the battery drops below BatteryBelow or the temperature rises above
+// TemperatureAbove (whichever is set); it clears once the value recovers past
+// the threshold by the policy's hysteresis.
+type throttleStage struct {
+	Name             string   `json:"name"`
+	BatteryBelow     *float64 `json:"battery_below,omitempty"`
+	TemperatureAbove *float64 `json:"temperature_above,omitempty"`
+	MaxSpeed         *float64 `json:"max_speed,omitempty"` // m/s
+	PayloadOps       *bool    `json:"payload_ops,omitempty"`
+}
+
+type throttlePolicy struct {
+	BatteryField     string          `json:"battery_field"`
+	TemperatureField string          `json:"temperature_field"`
+	Hysteresis       float64         `json:"hysteresis"`
+	Stages           []throttleStage `json:"stages"`
+}
+
+// limits is the combined restriction of all active stages; nil fields mean
+// "unrestricted".
+type limits struct {
+	Stages     []string  `json:"stages"`
+	MaxSpeed   *float64  `json:"max_speed,omitempty"`
+	PayloadOps bool      `json:"payload_ops"`
+	Since      time.Time `json:"since"`
+}
+
+var defaultThrottlePolicy = throttlePolicy{
+	BatteryField:     "battery_pct",
+	TemperatureField: "temp_c",
+	Hysteresis:       2,
+}
+
+// throttle watches battery/temperature telemetry and publishes the active
+// limitation state on ctrl.{id}.limits (robots) and events.limits.{id} (UI)
+// whenever it changes.
+type throttle struct {
+	js     nats.JetStreamContext
+	policy throttlePolicy
+
+	mu     sync.Mutex
+	active map[string]map[string]bool // robot → active stage names
+	state  map[string]limits
+}
+
+func newThrottle(js nats.JetStreamContext, policyJSON string) (*throttle, error) {
+	p := defaultThrottlePolicy
+	if policyJSON != "" {
+		if err := json.Unmarshal([]byte(policyJSON), &p); err != nil {
+			return nil, fmt.Errorf("THROTTLE_POLICY: %w", err)
+		}
+	}
+	return &throttle{js: js, policy: p, active: map[string]map[string]bool{}, state: map[string]limits{}}, nil
+}
+
+func (t *throttle) subscribe(nc *nats.Conn) error {
+	if len(t.policy.Stages) == 0 {
+		return nil
+	}
+	_, err := nc.Subscribe("telemetry.>", func(msg *nats.Msg) {
+		m := parsePayload(msg.Data)
+		if m == nil {
+			return
+		}
+		batt, hasBatt := numField(m, t.policy.BatteryField)
+		temp, hasTemp := numField(m, t.policy.TemperatureField)
+		if !hasBatt && !hasTemp {
+			return
+		}
+		t.evaluate(telem.RobotID(msg.Subject), batt, hasBatt, temp, hasTemp)
+	})
+	return err
+}
+
+func (t *throttle) evaluate(id string, batt float64, hasBatt bool, temp float64, hasTemp bool) {
+	t.mu.Lock()
+	act := t.active[id]
+	if act == nil {
+		act = map[string]bool{}
+		t.active[id] = act
+	}
+	changed := false
+	for _, s := range t.policy.Stages {
+		on := act[s.Name]
+		next := on
+		switch {
+		case s.BatteryBelow != nil && hasBatt:
+			if on {
+				next = batt < *s.BatteryBelow+t.policy.Hysteresis
+			} else {
+				next = batt < *s.BatteryBelow
+			}
+		case s.TemperatureAbove != nil && hasTemp:
+			if on {
+				next = temp > *s.TemperatureAbove-t.policy.Hysteresis
+			} else {
+				next = temp > *s.TemperatureAbove
+			}
+		}
+		if next != on {
+			act[s.Name] = next
+			changed = true
+		}
+	}
+	if !changed {
+		t.mu.Unlock()
+		return
+	}
+	l := t.combine(act)
+	t.state[id] = l
+	t.mu.Unlock()
+
+	b, _ := json.Marshal(l)
+	if _, err := t.js.Publish("ctrl."+id+".limits", b); err != nil {
+		log.Printf("throttle: publish limits for %s: %v", id, err)
+	}
+	if _, err := t.js.Publish("events.limits."+id, b); err != nil {
+		log.Printf("throttle: publish event for %s: %v", id, err)
+	}
+}
+
+func (t *throttle) combine(act map[string]bool) limits {
+	l := limits{Stages: []string{}, PayloadOps: true, Since: time.Now()}
+	for _, s := range t.policy.Stages {
+		if !act[s.Name] {
+			continue
+		}
+		l.Stages = append(l.Stages, s.Name)
+		if s.MaxSpeed != nil && (l.MaxSpeed == nil || *s.MaxSpeed < *l.MaxSpeed) {
+			v := *s.MaxSpeed
+			l.MaxSpeed = &v
+		}
+		if s.PayloadOps != nil && !*s.PayloadOps {
+			l.PayloadOps = false
+		}
+	}
+	sort.Strings(l.Stages)
+	return l
+}
+
+// current returns the limits in force for a robot.
+func (t *throttle) current(id string) limits {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l, ok := t.state[id]; ok {
+		return l
+	}
+	return limits{Stages: []string{}, PayloadOps: true}
+}
+
+// clampSpeed caps a requested speed (any sign) to the robot's limit.
+func (t *throttle) clampSpeed(id string, v float64) float64 {
+	l := t.current(id)
+	if l.MaxSpeed == nil || math.Abs(v) <= *l.MaxSpeed {
+		return v
+	}
+	return math.Copysign(*l.MaxSpeed, v)
+}
+
+// GET /api/robots/{id}/limits
+func (t *throttle) handleGet(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, t.current(chi.URLParam(req, "id")))
+}
+
+// GET /api/throttle/policy
+func (t *throttle) handlePolicy(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, t.policy)
+}
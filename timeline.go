@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// maxTimelineEntries bounds what an export interleaves with its series.
+const maxTimelineEntries = 10000
+
+// timelineEntry is a non-numeric record exported alongside a series.
+type timelineEntry struct {
+	Channel string // "event", "command" or "label"
+	Subject string // the NATS subject it was published on
+	T       time.Time
+	Data    json.RawMessage // the event body, or the command or label record
+}
+
+// timeline gathers what happened to a robot besides telemetry, for exports:
+// its events (events.*.{id} on EVENTS, e.g. limits and drift) and the
+// commands sent to it (CTRL_CMDS), and the labels put on its telemetry
+// (LABELS).
+type timeline struct {
+	js     nats.JetStreamContext
+	cmds   *commands
+	labels *labeling
+}
+
+type timelineKey struct{}
+
+// timelineOf returns the timeline provided for the request, or nil.
+func timelineOf(req *http.Request) *timeline {
+	t, _ := req.Context().Value(timelineKey{}).(*timeline)
+	return t
+}
+
+// provide makes the timeline available to a query handler.
+func (tl *timeline) provide(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		next(w, req.WithContext(context.WithValue(req.Context(), timelineKey{}, tl)))
+	}
+}
+
+// collect returns robot's entries of the given channels since t, oldest
+// first.
+func (tl *timeline) collect(ctx context.Context, robot string, channels map[string]bool, since time.Time) ([]timelineEntry, error) {
+	var out []timelineEntry
+	if channels["events"] {
+		sub, err := tl.js.SubscribeSync("events.*."+robot, nats.OrderedConsumer(), nats.StartTime(since))
+		if err != nil {
+			return nil, err
+		}
+		defer sub.Unsubscribe()
+		for len(out) < maxTimelineEntries {
+			wait, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+			m, err := sub.NextMsgWithContext(wait)
+			cancel()
+			if err != nil {
+				break // caught up (or no events at all) or cancelled
+			}
+			md, err := m.Metadata()
+			if err != nil {
+				continue
+			}
+			data := json.RawMessage(m.Data)
+			if !json.Valid(data) {
+				data, _ = json.Marshal(string(m.Data))
+			}
+			out = append(out, timelineEntry{Channel: "event", Subject: m.Subject, T: md.Timestamp, Data: data})
+			if md.NumPending == 0 {
+				break
+			}
+		}
+	}
+	if channels["commands"] {
+		list, err := tl.cmds.list(robot)
+		if err != nil {
+			return nil, err
+		}
+		for _, cmd := range list {
+			if cmd.Published.Before(since) {
+				continue
+			}
+			b, _ := json.Marshal(cmd)
+			out = append(out, timelineEntry{Channel: "command", Subject: cmd.Subject, T: cmd.Published, Data: b})
+		}
+	}
+	if channels["labels"] {
+		list, err := tl.labels.entries(robot, since)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, list...)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].T.Before(out[j].T) })
+	if len(out) > maxTimelineEntries {
+		out = out[:maxTimelineEntries]
+	}
+	return out, nil
+}
+
+// startTime resolves an /api/ts start (-15m or RFC3339).
+func startTime(s string) time.Time {
+	if d, ok := relDuration(s); ok {
+		return time.Now().Add(-d)
+	}
+	t, _ := time.Parse(time.RFC3339, s)
+	return t
+}
+
+// robotOfSubject is the robot in telemetry.{robot}.….
+func robotOfSubject(subject string) string {
+	parts := strings.SplitN(subject, ".", 3)
+	if len(parts) < 3 || parts[0] != "telemetry" {
+		return ""
+	}
+	return parts[1]
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GET /api/ts/compare?field=speed&robots=a,b,c&start=-1h&window=10s&agg=max
+//
+// The same field for several robots on one time grid, from a single Flux
+// query: every window has a point, with a value per robot (null where a
+// robot reported nothing), shaped
+//
+//	{"field":"speed","window":"10s","robots":["a","b","c"],
+//	 "points":[{"t":…,"values":{"a":1.2,"b":null,"c":0.8}},…]}
+//
+// topic=odom narrows to telemetry.{robot}.odom; agg and tz work as in /api/ts.
+// A comparison whose grid would carry more than TS_MAX_POINTS values (windows
+// × robots) is refused with 422 before it runs; should the grid come out
+// longer than expected, it is cut there and ends "truncated":true.
+func handleTSCompare(w http.ResponseWriter, req *http.Request) {
+	db := influxOf(req)
+	if db == nil {
+		http.Error(w, "influx not configured", http.StatusNotImplemented)
+		return
+	}
+	q := req.URL.Query()
+	field, window, topic, tz := q.Get("field"), q.Get("window"), q.Get("topic"), q.Get("tz")
+	start := q.Get("start")
+	if start == "" {
+		start = "-1h"
+	}
+	if !fieldRe.MatchString(field) || field == "raw" {
+		http.Error(w, "bad 'field' (one numeric field)", 400)
+		return
+	}
+	if !validTime(start) {
+		http.Error(w, "bad 'start' (use -15m or RFC3339 time)", 400)
+		return
+	}
+	if !durRe.MatchString(window) || windowDuration(window) == 0 {
+		http.Error(w, "'window' is required (1s, 5m, 1h, ...): it is the common grid", 400)
+		return
+	}
+	if topic != "" && !tokenRe.MatchString(topic) {
+		http.Error(w, "bad 'topic'", 400)
+		return
+	}
+	if tz != "" {
+		if _, err := time.LoadLocation(tz); err != nil || !tzRe.MatchString(tz) {
+			http.Error(w, "bad 'tz' (an IANA zone such as Europe/Lisbon)", 400)
+			return
+		}
+	}
+	robots := strings.Split(q.Get("robots"), ",")
+	if len(robots) < 2 || len(robots) > 20 {
+		http.Error(w, "'robots' takes 2 to 20 robot ids, comma separated", 400)
+		return
+	}
+	seen := map[string]bool{}
+	for _, id := range robots {
+		if !tokenRe.MatchString(id) || seen[id] {
+			http.Error(w, "bad or repeated robot id in 'robots'", 400)
+			return
+		}
+		seen[id] = true
+	}
+	aggFn, err := aggregateFn(q.Get("agg"), q.Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	span, _ := querySpan(start)
+	rows := int(span/windowDuration(window)) + 1
+	if rows*len(robots) > tsMaxPoints {
+		http.Error(w, fmt.Sprintf("about %d windows × %d robots is over TS_MAX_POINTS (%d): narrow 'start' or widen 'window'",
+			rows, len(robots), tsMaxPoints), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// robot ids are tokenRe, so safe inside the regex alternation
+	match := `/^telemetry\.(` + strings.Join(robots, "|") + `)\.`
+	if topic != "" {
+		match += topic + `$/`
+	} else {
+		match += `/`
+	}
+	offset := ""
+	if strings.HasSuffix(window, "w") {
+		offset = `, offset: -3d` // weeks start on Monday
+	}
+	flux := strings.Builder{}
+	flux.WriteString(`import "strings" `)
+	if tz != "" {
+		flux.WriteString(`import "timezone" option location = timezone.location(name: "` + tz + `") `)
+	}
+	flux.WriteString(`from(bucket:"` + db.Bucket + `") |> range(start:` + start + `)`)
+	flux.WriteString(telemetryFilter())
+	flux.WriteString(` |> filter(fn:(r)=> r._field == "` + field + `")`)
+	flux.WriteString(` |> filter(fn:(r)=> r.subject =~ ` + match + `)`)
+	flux.WriteString(` |> map(fn:(r)=> ({r with robot: strings.split(v: r.subject, t: ".")[1]}))`)
+	flux.WriteString(` |> group(columns: ["robot"])`)
+	flux.WriteString(` |> aggregateWindow(every:` + window + offset + `, fn: ` + aggFn + `, createEmpty: true)`)
+	flux.WriteString(` |> keep(columns: ["_time","_value","robot"])`)
+	flux.WriteString(` |> group()`)
+	flux.WriteString(` |> pivot(rowKey: ["_time"], columnKey: ["robot"], valueColumn: "_value")`)
+	flux.WriteString(` |> sort(columns: ["_time"])`)
+
+	res, err := db.Client.QueryAPI(db.Org).Query(req.Context(), flux.String())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer res.Close()
+
+	head, _ := json.Marshal(struct {
+		Field  string   `json:"field"`
+		Window string   `json:"window"`
+		Robots []string `json:"robots"`
+	}{field, window, robots})
+	out := &tsJSON{tsBase: &tsBase{w: w, rc: http.NewResponseController(w), ctype: "application/json"},
+		fields: robots, first: true, prefix: string(head[:len(head)-1]) + `,"points":[`}
+	values := make([]interface{}, len(robots))
+	var page tsPage
+	for n := 0; res.Next(); n++ {
+		if (n+1)*len(robots) > tsMaxPoints {
+			page.Truncated = true
+			break
+		}
+		rec := res.Record()
+		for i, id := range robots {
+			values[i] = rec.ValueByKey(id) // nil when the robot has no column at all
+		}
+		out.row("", rec.Time(), values)
+	}
+	traceOf(req).addPoints(out.finish(res.Err(), page) * len(robots))
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tsOutput writes /api/ts rows as they arrive from Influx, in the format the
+// caller asked for, so a request holds one row at a time however many it
+// returns.
+type tsOutput interface {
+	// row writes one point: values holds one value per requested field
+	row(subject string, t time.Time, values []interface{})
+	// entry writes a timeline entry between rows (csv and ndjson only)
+	entry(e timelineEntry)
+	// finish ends the document, or reports err; it returns the points written
+	finish(err error, page tsPage) int
+}
+
+// tsPage says whether a response stopped short of the whole result.
+type tsPage struct {
+	Truncated  bool `json:"truncated"`
+	NextOffset int  `json:"next_offset,omitempty"`
+}
+
+// tsFormat picks the output format from ?format=json|csv|ndjson, else the
+// Accept header; "" when the request names one we don't have.
+func tsFormat(req *http.Request) string {
+	if f := req.URL.Query().Get("format"); f != "" {
+		switch f {
+		case "json", "csv", "ndjson":
+			return f
+		}
+		return ""
+	}
+	accept := req.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/csv"):
+		return "csv"
+	case strings.Contains(accept, "application/x-ndjson"):
+		return "ndjson"
+	}
+	return "json"
+}
+
+// newTSOutput starts the output; with timeline set, CSV gets channel and
+// data columns for interleaved entries.
+func newTSOutput(w http.ResponseWriter, format string, fields []string, subject string, timeline bool) tsOutput {
+	base := &tsBase{w: w, rc: http.NewResponseController(w)}
+	switch format {
+	case "csv":
+		base.ctype = "text/csv; charset=utf-8"
+		out := &tsCSV{tsBase: base, csv: csv.NewWriter(base), fields: fields, timeline: timeline}
+		base.buffer = out.csv.Flush
+		return out
+	case "ndjson":
+		base.ctype = "application/x-ndjson"
+		return &tsNDJSON{tsBase: base, fields: fields}
+	}
+	base.ctype = "application/json"
+	out := &tsJSON{tsBase: base, fields: fields, grouped: subject == "", first: true}
+	head, _ := json.Marshal(fields[0])
+	head = append([]byte(`"field":`), head...)
+	if len(fields) > 1 {
+		list, _ := json.Marshal(fields)
+		head = append([]byte(`"fields":`), list...)
+	}
+	if subject != "" {
+		sub, _ := json.Marshal(subject)
+		out.prefix = `{` + string(head) + `,"subject":` + string(sub) + `,"points":[`
+	} else {
+		out.prefix = `{` + string(head) + `,"series":[`
+	}
+	return out
+}
+
+// tsBase sends nothing until the first write, so an error before then is
+// still a plain 500; after it the output is cut short, which a client's
+// parser reports.
+type tsBase struct {
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	ctype  string
+	buffer func() // empties a writer layered on top, if any, before a flush
+	sent   bool
+	points int
+}
+
+func (b *tsBase) Write(p []byte) (int, error) {
+	if !b.sent {
+		b.w.Header().Set("Content-Type", b.ctype)
+		b.sent = true
+	}
+	return b.w.Write(p)
+}
+
+// counted notes a written point, flushing every thousand.
+func (b *tsBase) counted() {
+	if b.points++; b.points%1000 == 0 {
+		if b.buffer != nil {
+			b.buffer()
+		}
+		_ = b.rc.Flush()
+	}
+}
+
+func (b *tsBase) fail(err error) int {
+	if !b.sent {
+		http.Error(b.w, err.Error(), 500)
+	} else {
+		log.Printf("ts: output cut short after %d points: %v", b.points, err)
+	}
+	return b.points
+}
+
+// point is a JSON point: v for one field, values for several.
+func point(fields []string, t time.Time, values []interface{}) interface{} {
+	if len(fields) == 1 {
+		return struct {
+			T time.Time   `json:"t"`
+			V interface{} `json:"v"`
+		}{t, values[0]}
+	}
+	m := make(map[string]interface{}, len(fields))
+	for i, f := range fields {
+		m[f] = values[i]
+	}
+	return struct {
+		T      time.Time              `json:"t"`
+		Values map[string]interface{} `json:"values"`
+	}{t, m}
+}
+
+// tsJSON is the default document: {"field":…,"subject":…,"points":[…]} for
+// one subject, else {"field":…,"series":[{"subject":…,"points":[…]},…]}.
+type tsJSON struct {
+	*tsBase
+	fields   []string
+	grouped  bool
+	prefix   string // written before the first point
+	current  string
+	inSeries bool
+	first    bool // no point written yet in the current array
+}
+
+func (j *tsJSON) text(s string) {
+	if !j.sent {
+		s = j.prefix + s
+	}
+	j.Write([]byte(s))
+}
+
+func (j *tsJSON) row(subject string, t time.Time, values []interface{}) {
+	if j.grouped && (!j.inSeries || subject != j.current) {
+		if j.inSeries {
+			j.text(`]},`)
+		}
+		name, _ := json.Marshal(subject)
+		j.text(`{"subject":` + string(name) + `,"points":[`)
+		j.current, j.inSeries, j.first = subject, true, true
+	}
+	b, _ := json.Marshal(point(j.fields, t, values))
+	if !j.first {
+		b = append([]byte{','}, b...)
+	}
+	j.first = false
+	j.text(string(b))
+	j.counted()
+}
+
+// entry is not supported by the JSON document; handleTS refuses the
+// combination.
+func (j *tsJSON) entry(timelineEntry) {}
+
+func (j *tsJSON) finish(err error, page tsPage) int {
+	if err != nil {
+		return j.fail(err)
+	}
+	if j.inSeries {
+		j.text(`]}`)
+	}
+	b, _ := json.Marshal(page)
+	j.text("]," + string(b[1:]) + "\n")
+	return j.points
+}
+
+// tsCSV writes time,subject,{field…} rows with RFC3339 times, plus
+// channel,data when timeline entries are interleaved: telemetry rows have
+// channel "telemetry", entries their channel and JSON data and no values.
+type tsCSV struct {
+	*tsBase
+	csv      *csv.Writer
+	fields   []string
+	timeline bool
+	header   bool
+}
+
+func (c *tsCSV) writeHeader() {
+	c.w.Header().Set("Content-Disposition", `attachment; filename="ts.csv"`)
+	cols := append([]string{"time", "subject"}, c.fields...)
+	if c.timeline {
+		cols = append(cols, "channel", "data")
+	}
+	c.csv.Write(cols)
+	c.header = true
+}
+
+func (c *tsCSV) row(subject string, t time.Time, values []interface{}) {
+	if !c.header {
+		c.writeHeader()
+	}
+	rec := []string{t.UTC().Format(time.RFC3339Nano), subject}
+	for _, v := range values {
+		if v == nil {
+			rec = append(rec, "")
+		} else {
+			rec = append(rec, fmt.Sprint(v))
+		}
+	}
+	if c.timeline {
+		rec = append(rec, "telemetry", "")
+	}
+	c.csv.Write(rec)
+	c.counted()
+}
+
+func (c *tsCSV) entry(e timelineEntry) {
+	if !c.header {
+		c.writeHeader()
+	}
+	rec := append([]string{e.T.UTC().Format(time.RFC3339Nano), e.Subject}, make([]string, len(c.fields))...)
+	c.csv.Write(append(rec, e.Channel, string(e.Data)))
+}
+
+func (c *tsCSV) finish(err error, _ tsPage) int {
+	if err != nil && !c.sent {
+		return c.fail(err)
+	}
+	if !c.header {
+		c.writeHeader()
+	}
+	c.csv.Flush()
+	if err != nil {
+		return c.fail(err)
+	}
+	return c.points
+}
+
+// tsNDJSON writes one point per line, each with its subject.
+type tsNDJSON struct {
+	*tsBase
+	fields []string
+}
+
+func (n *tsNDJSON) row(subject string, t time.Time, values []interface{}) {
+	line, _ := json.Marshal(point(n.fields, t, values))
+	// {"subject":…, then the point's own fields
+	name, _ := json.Marshal(subject)
+	n.Write(append(append([]byte(`{"subject":`+string(name)+`,`), line[1:]...), '\n'))
+	n.counted()
+}
+
+// entry writes {"channel":…,"subject":…,"t":…,"data":…}.
+func (n *tsNDJSON) entry(e timelineEntry) {
+	b, _ := json.Marshal(struct {
+		Channel string          `json:"channel"`
+		Subject string          `json:"subject"`
+		T       time.Time       `json:"t"`
+		Data    json.RawMessage `json:"data"`
+	}{e.Channel, e.Subject, e.T, e.Data})
+	n.Write(append(b, '\n'))
+}
+
+func (n *tsNDJSON) finish(err error, page tsPage) int {
+	if err != nil {
+		return n.fail(err)
+	}
+	if page.Truncated {
+		b, _ := json.Marshal(page)
+		n.Write(append(b, '\n'))
+	}
+	return n.points
+}
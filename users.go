@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errUserNotFound = errors.New("user not found")
+
+// dummyHash is compared against for unknown users so timing doesn't reveal
+// which usernames exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+// user is a login account. PasswordHash is bcrypt and never leaves the server.
+type user struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+	Roles        []string  `json:"roles"`
+	Tenant       string    `json:"tenant,omitempty"`
+	Robots       []string  `json:"robots,omitempty"` // robots an operator may command; see rbac
+	Disabled     bool      `json:"disabled"`
+	Source       string    `json:"source,omitempty"` // "scim" when provisioned by an IdP
+	ExternalID   string    `json:"external_id,omitempty"`
+	SCIMUserName string    `json:"scim_user_name,omitempty"`
+	Created      time.Time `json:"created"`
+	Updated      time.Time `json:"updated"`
+}
+
+// public is the user as the API shows it.
+func (u user) public() user {
+	u.PasswordHash = ""
+	return u
+}
+
+type users struct {
+	kv nats.KeyValue
+}
+
+// newUsers opens the USERS bucket. With an empty bucket and ADMIN_PASSWORD
+// set, an "admin" account is created so a fresh install can log in.
+func newUsers(js nats.JetStreamContext, adminPassword string) (*users, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "USERS", History: 5, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	u := &users{kv: kv}
+	if adminPassword != "" {
+		keys, err := kvKeys(kv, ">")
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			if err := u.put(user{Username: "admin", Roles: []string{"admin"}}, adminPassword); err != nil {
+				return nil, err
+			}
+			log.Printf("created bootstrap user admin")
+		}
+	}
+	return u, nil
+}
+
+func (s *users) get(name string) (*user, error) {
+	e, err := s.kv.Get(name)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var u user
+	if err := json.Unmarshal(e.Value(), &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// put stores u, hashing password when one is given and otherwise keeping the
+// stored hash.
+func (s *users) put(u user, password string) error {
+	now := time.Now().UTC()
+	if old, err := s.get(u.Username); err == nil {
+		u.Created = old.Created
+		u.PasswordHash = old.PasswordHash
+		if u.Source == "" {
+			u.Source, u.ExternalID, u.SCIMUserName = old.Source, old.ExternalID, old.SCIMUserName
+		}
+	} else if errors.Is(err, errUserNotFound) {
+		u.Created = now
+	} else {
+		return err
+	}
+	if password != "" {
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		u.PasswordHash = string(h)
+	}
+	if u.Roles == nil {
+		u.Roles = []string{}
+	}
+	u.Updated = now
+	b, _ := json.Marshal(u)
+	_, err := s.kv.Put(u.Username, b)
+	return err
+}
+
+func (s *users) delete(name string) error {
+	return s.kv.Delete(name)
+}
+
+// check verifies a login; disabled accounts and bad passwords look the same.
+func (s *users) check(name, password string) (*user, bool) {
+	u, err := s.get(name)
+	if err != nil || u.Disabled || u.PasswordHash == "" {
+		// spend the same time as a real comparison
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, false
+	}
+	return u, bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// GET /api/users
+func (a *auth) handleListUsers(w http.ResponseWriter, _ *http.Request) {
+	keys, err := kvKeys(a.users.kv, ">")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := []user{}
+	for _, k := range keys {
+		if u, err := a.users.get(k); err == nil {
+			out = append(out, u.public())
+		}
+	}
+	writeJSON(w, out)
+}
+
+// PUT /api/users/{name} with {"password":"…","roles":["operator"],"tenant":"acme","robots":["dock-*"],"disabled":false};
+// password may be omitted to keep the current one. Disabling an account ends
+// its sessions.
+func (a *auth) handlePutUser(w http.ResponseWriter, req *http.Request) {
+	var in struct {
+		user
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		http.Error(w, "bad user: "+err.Error(), 400)
+		return
+	}
+	u := in.user
+	u.Username = chi.URLParam(req, "name")
+	if !tokenRe.MatchString(u.Username) {
+		http.Error(w, "bad username (letters, digits, _ and - only)", 400)
+		return
+	}
+	if _, err := a.users.get(u.Username); errors.Is(err, errUserNotFound) && in.Password == "" {
+		http.Error(w, "password required for a new user", 400)
+		return
+	}
+	if err := a.audit.record(auditRecord{Actor: actorOf(req), Action: "user.put", Details: map[string]interface{}{"user": u.Username, "roles": u.Roles, "robots": u.Robots, "disabled": u.Disabled, "password_changed": in.Password != ""}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	if err := a.users.put(u, in.Password); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if u.Disabled || in.Password != "" {
+		if _, err := a.revokeUser(u.Username); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	stored, err := a.users.get(u.Username)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, stored.public())
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/telem"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// versions records what robots self-report on telemetry.{id}.version, e.g.
+// {"firmware":"2.1.0","os":"ubuntu-22.04","app":"1.4.2"}, and compares it to
+// the target versions set per group. A robot whose set of drifting components
+// changes gets an event on events.drift.{id}.
+type versions struct {
+	js      nats.JetStreamContext
+	reg     *registry
+	targets nats.KeyValue // group → map[component]version
+	audit   *auditLog
+}
+
+func newVersions(js nats.JetStreamContext, reg *registry, audit *auditLog) (*versions, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: "GROUP_TARGETS", History: 10, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	return &versions{js: js, reg: reg, targets: kv, audit: audit}, nil
+}
+
+func (v *versions) subscribe(nc *nats.Conn) error {
+	_, err := nc.Subscribe("telemetry.*.version", func(msg *nats.Msg) {
+		id := telem.RobotID(msg.Subject)
+		var in map[string]interface{}
+		if err := json.Unmarshal(msg.Data, &in); err != nil {
+			log.Printf("versions: bad payload from %s: %v", id, err)
+			return
+		}
+		reported := map[string]string{}
+		for k, val := range in {
+			if s, ok := val.(string); ok && k != "topic" && k != "trace_id" {
+				reported[k] = s
+			}
+		}
+		if err := v.report(id, reported); err != nil {
+			log.Printf("versions: %s: %v", id, err)
+		}
+	})
+	return err
+}
+
+func (v *versions) report(id string, reported map[string]string) error {
+	r, err := v.reg.updateExisting(id, func(r *robot) error {
+		r.Versions = reported
+		r.VersionsReported = time.Now()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return v.check(r)
+}
+
+func (v *versions) target(group string) (map[string]string, error) {
+	if group == "" {
+		return nil, nil
+	}
+	e, err := v.targets.Get(group)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t map[string]string
+	return t, json.Unmarshal(e.Value(), &t)
+}
+
+// check recomputes a robot's drift against its group target and publishes an
+// event when it changed.
+func (v *versions) check(r *robot) error {
+	target, err := v.target(r.Group)
+	if err != nil {
+		return err
+	}
+	drift := driftOf(r.Versions, target)
+	if strings.Join(drift, ",") == strings.Join(r.Drift, ",") {
+		return nil
+	}
+	if _, err := v.reg.updateExisting(r.ID, func(r *robot) error {
+		r.Drift = drift
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	ev := map[string]interface{}{
+		"robot":    r.ID,
+		"group":    r.Group,
+		"drift":    drift,
+		"versions": r.Versions,
+		"target":   target,
+		"ts":       time.Now(),
+	}
+	b, _ := json.Marshal(ev)
+	_, err = v.js.Publish("events.drift."+r.ID, b)
+	return err
+}
+
+func driftOf(have, want map[string]string) []string {
+	drift := []string{}
+	for comp, ver := range want {
+		if have[comp] != ver {
+			drift = append(drift, comp)
+		}
+	}
+	sort.Strings(drift)
+	return drift
+}
+
+// GET /api/fleet/versions: matrix of robots × components.
+func (v *versions) handleMatrix(w http.ResponseWriter, _ *http.Request) {
+	robots, err := v.reg.active()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	type row struct {
+		ID       string            `json:"id"`
+		Group    string            `json:"group,omitempty"`
+		Versions map[string]string `json:"versions"`
+		Drift    []string          `json:"drift"`
+		Reported time.Time         `json:"reported"`
+	}
+	out := struct {
+		Components []string                     `json:"components"`
+		Targets    map[string]map[string]string `json:"targets"`
+		Robots     []row                        `json:"robots"`
+	}{
+		Components: []string{},
+		Targets:    map[string]map[string]string{},
+		Robots:     make([]row, 0, len(robots)),
+	}
+
+	seen := map[string]bool{}
+	for _, r := range robots {
+		for comp := range r.Versions {
+			if !seen[comp] {
+				seen[comp] = true
+				out.Components = append(out.Components, comp)
+			}
+		}
+		if _, ok := out.Targets[r.Group]; r.Group != "" && !ok {
+			t, err := v.target(r.Group)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			out.Targets[r.Group] = t
+		}
+		drift := r.Drift
+		if drift == nil {
+			drift = []string{}
+		}
+		out.Robots = append(out.Robots, row{ID: r.ID, Group: r.Group, Versions: r.Versions, Drift: drift, Reported: r.VersionsReported})
+	}
+	sort.Strings(out.Components)
+	writeJSON(w, out)
+}
+
+// PUT /api/groups/{group}/target-version with {"firmware":"2.1.0",...}
+func (v *versions) handleSetTarget(w http.ResponseWriter, req *http.Request) {
+	group := chi.URLParam(req, "group")
+	if !tokenRe.MatchString(group) {
+		http.Error(w, "bad group", 400)
+		return
+	}
+	var t map[string]string
+	if err := json.NewDecoder(req.Body).Decode(&t); err != nil {
+		http.Error(w, "bad body: "+err.Error(), 400)
+		return
+	}
+	if err := v.audit.record(auditRecord{Actor: actorOf(req), Action: "fleet.target_version", Details: map[string]interface{}{"group": group, "target": t}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	b, _ := json.Marshal(t)
+	if _, err := v.targets.Put(group, b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// re-evaluate the group's members against the new target
+	robots, err := v.reg.list()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for i := range robots {
+		if robots[i].Group == group {
+			if err := v.check(&robots[i]); err != nil {
+				log.Printf("versions: %s: %v", robots[i].ID, err)
+			}
+		}
+	}
+	w.WriteHeader(204)
+}
+
+// PUT /api/robots/{id}/group with {"group":"warehouse-a"}
+func (v *versions) handleSetGroup(w http.ResponseWriter, req *http.Request) {
+	var in struct {
+		Group string `json:"group"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		http.Error(w, "bad body: "+err.Error(), 400)
+		return
+	}
+	id := chi.URLParam(req, "id")
+	if !tokenRe.MatchString(id) {
+		http.Error(w, "bad robot id", 400)
+		return
+	}
+	if in.Group != "" && !tokenRe.MatchString(in.Group) {
+		http.Error(w, "bad group", 400)
+		return
+	}
+	if _, err := v.reg.get(id); errors.Is(err, errRobotNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	r, err := v.reg.update(id, func(r *robot) error {
+		r.Group = in.Group
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := v.check(r); err != nil {
+		log.Printf("versions: %s: %v", r.ID, err)
+	}
+	writeJSON(w, r)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// roleViewer is the read-only observer role for demos and auditors.
+const roleViewer = "viewer"
+
+// viewerLimits is how data is degraded for viewers: at most one sample per
+// subject every Every, and nothing newer than Delay.
+type viewerLimits struct {
+	User  string
+	Delay time.Duration
+	Every time.Duration
+}
+
+type viewerKey struct{}
+
+// viewerOf returns the limits that apply to the request, or nil when the
+// caller isn't a viewer.
+func viewerOf(req *http.Request) *viewerLimits {
+	v, _ := req.Context().Value(viewerKey{}).(*viewerLimits)
+	return v
+}
+
+// viewerPaths are GET endpoints a viewer can't use: account data, the full
+// configuration dump, and teleoperation (a WebSocket, so also a GET).
+var viewerPaths = []string{"/api/users", "/api/config/export", "/api/approvals", "/ws/ctrl"}
+
+// viewers restricts identities whose only role is viewer. They get no control
+// endpoints (anything but GET, apart from their own session handling),
+// telemetry decimated and delayed per VIEWER_EVERY / VIEWER_DELAY, and every
+// response carries an X-Evabot-Watermark naming them, so leaked exports can be
+// traced.
+type viewers struct {
+	delay time.Duration
+	every time.Duration
+}
+
+func isViewer(id *identity) bool {
+	if id == nil || len(id.Roles) == 0 {
+		return false
+	}
+	for _, r := range id.Roles {
+		if r != roleViewer {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *viewers) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := identityOf(req)
+		if !isViewer(id) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		path := req.URL.Path
+		switch {
+		case path == "/api/auth/logout" || path == "/api/auth/refresh":
+		case req.Method != http.MethodGet && req.Method != http.MethodHead:
+			http.Error(w, "viewers have read-only access", http.StatusForbidden)
+			return
+		}
+		for _, p := range viewerPaths {
+			if path == p || strings.HasPrefix(path, p+"/") {
+				http.Error(w, "not available to viewers", http.StatusForbidden)
+				return
+			}
+		}
+		now := time.Now().UTC()
+		w.Header().Set("X-Evabot-Watermark", "viewer="+id.User+"; session="+id.Session+"; at="+now.Format(time.RFC3339))
+		lim := &viewerLimits{User: id.User, Delay: v.delay, Every: v.every}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), viewerKey{}, lim)))
+	})
+}
+
+// viewerFeed decimates and delays a live message stream for one viewer.
+type viewerFeed struct {
+	lim     *viewerLimits
+	last    map[string]time.Time
+	pending []viewerMsg
+}
+
+type viewerMsg struct {
+	due  time.Time
+	data []byte
+}
+
+func newViewerFeed(lim *viewerLimits) *viewerFeed {
+	return &viewerFeed{lim: lim, last: map[string]time.Time{}}
+}
+
+// offer takes a message received at now; most are dropped by decimation.
+func (f *viewerFeed) offer(subject string, data []byte, now time.Time) {
+	if now.Sub(f.last[subject]) < f.lim.Every {
+		return
+	}
+	f.last[subject] = now
+	f.pending = append(f.pending, viewerMsg{due: now.Add(f.lim.Delay), data: data})
+}
+
+// ready returns the messages whose delay has passed.
+func (f *viewerFeed) ready(now time.Time) [][]byte {
+	var out [][]byte
+	n := 0
+	for _, m := range f.pending {
+		if now.Before(m.due) {
+			break
+		}
+		out = append(out, m.data)
+		n++
+	}
+	f.pending = f.pending[n:]
+	return out
+}
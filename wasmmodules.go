@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/wasm"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+var wasmNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+const maxWasmSize = 8 << 20
+
+// wasmModules is the admin side of WASM ingest transforms: modules are
+// validated here and stored (binary in WASM_BINARIES, metadata in
+// WASM_MODULES); workers pick changes up from the buckets. Per-module call
+// counts and timings are on the worker's /stats/wasm.
+type wasmModules struct {
+	kv    nats.KeyValue
+	obj   nats.ObjectStore
+	audit *auditLog
+}
+
+func newWasmModules(js nats.JetStreamContext, audit *auditLog) (*wasmModules, error) {
+	kv, err := ensureKV(js, &nats.KeyValueConfig{Bucket: wasm.MetaBucket, Storage: nats.FileStorage})
+	if err != nil {
+		return nil, err
+	}
+	obj, err := js.ObjectStore(wasm.ObjectBucket)
+	if errors.Is(err, nats.ErrStreamNotFound) || errors.Is(err, nats.ErrBucketNotFound) {
+		obj, err = js.CreateObjectStore(&nats.ObjectStoreConfig{Bucket: wasm.ObjectBucket, Storage: nats.FileStorage})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &wasmModules{kv: kv, obj: obj, audit: audit}, nil
+}
+
+func (m *wasmModules) get(name string) (*wasm.Meta, nats.KeyValueEntry, error) {
+	e, err := m.kv.Get(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	var meta wasm.Meta
+	if err := json.Unmarshal(e.Value(), &meta); err != nil {
+		return nil, nil, err
+	}
+	return &meta, e, nil
+}
+
+// GET /api/transforms/wasm
+func (m *wasmModules) handleList(w http.ResponseWriter, _ *http.Request) {
+	keys, err := kvKeys(m.kv, ">")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out := []wasm.Meta{}
+	for _, k := range keys {
+		if meta, _, err := m.get(k); err == nil {
+			out = append(out, *meta)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Order != out[j].Order {
+			return out[i].Order < out[j].Order
+		}
+		return out[i].Name < out[j].Name
+	})
+	writeJSON(w, out)
+}
+
+// PUT /api/transforms/wasm/{name}?order=10&timeout_ms=5&memory_pages=16&enabled=false
+// with the module binary as the body. Replaces any module of that name.
+func (m *wasmModules) handlePut(w http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, "name")
+	if !wasmNameRe.MatchString(name) {
+		http.Error(w, "bad module name", 400)
+		return
+	}
+	bin, err := io.ReadAll(io.LimitReader(req.Body, maxWasmSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if len(bin) > maxWasmSize {
+		http.Error(w, "module larger than 8 MiB", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	q := req.URL.Query()
+	order, _ := strconv.Atoi(q.Get("order"))
+	timeout, _ := strconv.Atoi(q.Get("timeout_ms"))
+	pages, _ := strconv.ParseUint(q.Get("memory_pages"), 10, 32)
+	sum := sha256.Sum256(bin)
+	meta := wasm.Meta{
+		Name:        name,
+		SHA256:      hex.EncodeToString(sum[:]),
+		Size:        len(bin),
+		Order:       order,
+		Enabled:     q.Get("enabled") != "false",
+		TimeoutMs:   timeout,
+		MemoryPages: uint32(pages),
+		Uploaded:    time.Now().UTC(),
+		Actor:       actorOf(req),
+	}
+	meta.Normalize()
+
+	// refuse anything the worker would fail to load
+	mod, err := wasm.Compile(req.Context(), bin, meta)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	mod.Close(context.Background())
+
+	if err := m.audit.record(auditRecord{Actor: meta.Actor, Action: "wasm.upload", Details: map[string]interface{}{"name": name, "sha256": meta.SHA256, "enabled": meta.Enabled}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	// binary first: workers load on the metadata change
+	if _, err := m.obj.PutBytes(name, bin); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	b, _ := json.Marshal(meta)
+	if _, err := m.kv.Put(name, b); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, meta)
+}
+
+func (m *wasmModules) setEnabled(w http.ResponseWriter, req *http.Request, enabled bool) {
+	name := chi.URLParam(req, "name")
+	meta, e, err := m.get(name)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such module", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	action := "wasm.disable"
+	if enabled {
+		action = "wasm.enable"
+	}
+	if err := m.audit.record(auditRecord{Actor: actorOf(req), Action: action, Details: map[string]interface{}{"name": name}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	meta.Enabled = enabled
+	b, _ := json.Marshal(meta)
+	if _, err := m.kv.Update(name, b, e.Revision()); err != nil {
+		code := 500
+		if errors.Is(err, nats.ErrKeyExists) {
+			code = 409
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	writeJSON(w, meta)
+}
+
+// POST /api/transforms/wasm/{name}/enable
+func (m *wasmModules) handleEnable(w http.ResponseWriter, req *http.Request) {
+	m.setEnabled(w, req, true)
+}
+
+// POST /api/transforms/wasm/{name}/disable
+func (m *wasmModules) handleDisable(w http.ResponseWriter, req *http.Request) {
+	m.setEnabled(w, req, false)
+}
+
+// DELETE /api/transforms/wasm/{name}
+func (m *wasmModules) handleDelete(w http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, "name")
+	if _, _, err := m.get(name); errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(w, "no such module", 404)
+		return
+	}
+	if err := m.audit.record(auditRecord{Actor: actorOf(req), Action: "wasm.delete", Details: map[string]interface{}{"name": name}}); err != nil {
+		http.Error(w, "audit: "+err.Error(), 500)
+		return
+	}
+	if err := m.kv.Delete(name); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := m.obj.Delete(name); err != nil && !errors.Is(err, nats.ErrObjectNotFound) {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/VazRibeiro/evabot-backend/internal/wave"
+	"github.com/nats-io/nats.go"
+)
+
+// maxWaveChunks bounds the chunks one /api/waveform request reads: an hour
+// of one-second chunks.
+const maxWaveChunks = 3600
+
+// waveforms answers queries for the chunks the worker stores (see
+// internal/wave).
+type waveforms struct {
+	js nats.JetStreamContext
+}
+
+type wavePoint struct {
+	T time.Time `json:"t"`
+	V float32   `json:"v"`
+}
+
+// GET /api/waveform?subject=telemetry.r1.wave.motor&channel=current_a&start=-10s&stop=-5s&points=2000
+//
+// A channel's samples in [start, stop) (stop defaults to now), read from
+// the chunks the Influx index lists. Up to points samples (default 2000,
+// at most TS_MAX_POINTS) come back as they are, under "points" as
+// {"t","v"}; more are decimated to points buckets of equal duration, under
+// "buckets" as {"t","min","max"}, so spikes stay visible at any zoom.
+func (wf *waveforms) handleGet(w http.ResponseWriter, req *http.Request) {
+	db := influxOf(req)
+	if db == nil {
+		http.Error(w, "influx not configured", http.StatusNotImplemented)
+		return
+	}
+	q := req.URL.Query()
+	subject, channel := q.Get("subject"), q.Get("channel")
+	start, stop := q.Get("start"), q.Get("stop")
+	if start == "" {
+		start = "-1m"
+	}
+	if !subjectRe.MatchString(subject) || robotOfSubject(subject) == "" {
+		http.Error(w, "bad 'subject' (a telemetry.{robot}.… subject)", 400)
+		return
+	}
+	if !fieldRe.MatchString(channel) {
+		http.Error(w, "bad 'channel'", 400)
+		return
+	}
+	if !validTime(start) || (stop != "" && !validTime(stop)) {
+		http.Error(w, "bad 'start' or 'stop' (use -15m or RFC3339 time)", 400)
+		return
+	}
+	points := 2000
+	if v := q.Get("points"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > tsMaxPoints {
+			http.Error(w, "bad 'points' (1 to TS_MAX_POINTS)", 400)
+			return
+		}
+		points = n
+	}
+	from, to := startTime(start), time.Now()
+	if stop != "" {
+		to = startTime(stop)
+	}
+	if !to.After(from) {
+		http.Error(w, "'stop' must be after 'start'", 400)
+		return
+	}
+
+	// a chunk is stamped with its first sample, so one starting a little
+	// before the range may still reach into it
+	flux := `from(bucket:"` + db.Bucket + `") |> range(start: ` + from.Add(-time.Minute).UTC().Format(time.RFC3339Nano) +
+		`, stop: ` + to.UTC().Format(time.RFC3339Nano) + `)` +
+		` |> filter(fn:(r)=> r._measurement == "` + wave.Measurement + `" and r._field == "object")` +
+		` |> filter(fn:(r)=> r.subject == "` + subject + `" and r.channel == "` + channel + `")` +
+		` |> keep(columns: ["_time","_value"]) |> sort(columns: ["_time"])` +
+		` |> limit(n: ` + strconv.Itoa(maxWaveChunks+1) + `)`
+	res, err := db.Client.QueryAPI(db.Org).Query(req.Context(), flux)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var objects []string
+	for res.Next() {
+		if name, ok := res.Record().Value().(string); ok {
+			objects = append(objects, name)
+		}
+	}
+	err = res.Err()
+	res.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if len(objects) > maxWaveChunks {
+		http.Error(w, "more than "+strconv.Itoa(maxWaveChunks)+" chunks in range; narrow it", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var chunks []wave.Chunk
+	if len(objects) > 0 {
+		obj, err := wf.js.ObjectStore(wave.ObjectBucket)
+		if err != nil && !errors.Is(err, nats.ErrStreamNotFound) && !errors.Is(err, nats.ErrBucketNotFound) {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		for _, name := range objects {
+			if obj == nil {
+				break
+			}
+			b, err := obj.GetBytes(name, nats.Context(req.Context()))
+			if errors.Is(err, nats.ErrObjectNotFound) {
+				continue // expired before its index
+			}
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			if c, err := wave.Decode(b); err == nil {
+				chunks = append(chunks, c)
+			}
+		}
+	}
+
+	out := struct {
+		Subject   string        `json:"subject"`
+		Channel   string        `json:"channel"`
+		Samples   int           `json:"samples"`
+		Decimated bool          `json:"decimated"`
+		Points    []wavePoint   `json:"points,omitempty"`
+		Buckets   []wave.Bucket `json:"buckets,omitempty"`
+	}{Subject: subject, Channel: channel}
+	for _, c := range chunks {
+		for i, v := range c.Samples {
+			if t := c.At(i); !t.Before(from) && t.Before(to) {
+				out.Samples++
+				if out.Samples <= points {
+					out.Points = append(out.Points, wavePoint{t, v})
+				}
+			}
+		}
+	}
+	if out.Samples > points {
+		out.Decimated, out.Points = true, nil
+		out.Buckets = wave.Decimate(chunks, from, to, points)
+	}
+	traceOf(req).addPoints(len(out.Points) + len(out.Buckets))
+	writeJSON(w, out)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// hashedAssetRe matches bundler output like app.3f2a9c1d.js or index-BdX8k2Qa.css,
+// which can be cached forever.
+var hashedAssetRe = regexp.MustCompile(`[.-][A-Za-z0-9_]{8,}\.(js|css|woff2?|png|svg|jpg|webp)$`)
+
+// webUI serves the compiled frontend so a small deployment is one process.
+// Files come from STATIC_DIR or, when built with -tags embedui, from ui/.
+// Unknown non-API paths fall back to index.html for client-side routing.
+type webUI struct {
+	files  fs.FS
+	config map[string]interface{}
+}
+
+// newWebUI returns nil when there is nothing to serve.
+func newWebUI(dir string) *webUI {
+	var files fs.FS
+	switch {
+	case dir != "":
+		files = os.DirFS(dir)
+	case embeddedUIFS() != nil:
+		files = embeddedUIFS()
+	default:
+		return nil
+	}
+	if _, err := fs.Stat(files, "index.html"); err != nil {
+		return nil
+	}
+	return &webUI{
+		files: files,
+		config: map[string]interface{}{
+			"apiBase":      env("UI_API_BASE", ""),
+			"wsBase":       env("UI_WS_BASE", ""),
+			"title":        env("UI_TITLE", "evabot"),
+			"queryEnabled": influxClient != nil,
+		},
+	}
+}
+
+// GET /config.js: runtime settings for the frontend, so one build works
+// against any deployment.
+func (u *webUI) handleConfig(w http.ResponseWriter, _ *http.Request) {
+	b, _ := json.Marshal(u.config)
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("window.__EVABOT_CONFIG__ = "))
+	w.Write(b)
+	w.Write([]byte(";\n"))
+}
+
+// ServeHTTP is mounted as the router's NotFound handler, so every API route
+// takes precedence.
+func (u *webUI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if strings.HasPrefix(req.URL.Path, "/api/") || strings.HasPrefix(req.URL.Path, "/ws") {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+req.URL.Path), "/")
+	if name == "" {
+		name = "index.html"
+	}
+	st, err := fs.Stat(u.files, name)
+	if err == nil && st.IsDir() {
+		name = path.Join(name, "index.html")
+		st, err = fs.Stat(u.files, name)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		// a missing asset is a real 404; anything else is a client-side route
+		if path.Ext(name) != "" {
+			http.NotFound(w, req)
+			return
+		}
+		name = "index.html"
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	switch {
+	case path.Base(name) == "index.html":
+		w.Header().Set("Cache-Control", "no-cache")
+	case hashedAssetRe.MatchString(name):
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	default:
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+	// ServeFileFS redirects ".../index.html" to "./"; serve it under the request path instead
+	req.URL.Path = "/" + name
+	if path.Base(name) == "index.html" {
+		f, err := u.files.Open(name)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer f.Close()
+		fi, _ := f.Stat()
+		rs, ok := f.(io.ReadSeeker)
+		if !ok {
+			http.Error(w, "index.html not seekable", 500)
+			return
+		}
+		http.ServeContent(w, req, "index.html", fi.ModTime(), rs)
+		return
+	}
+	http.ServeFileFS(w, req, u.files, name)
+}
@@ -0,0 +1,16 @@
+//go:build embedui
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed all:ui
+var embeddedUI embed.FS
+
+func embeddedUIFS() fs.FS {
+	sub, _ := fs.Sub(embeddedUI, "ui")
+	return sub
+}
@@ -0,0 +1,8 @@
+//go:build !embedui
+
+package main
+
+import "io/fs"
+
+// embeddedUIFS is nil unless built with -tags embedui.
+func embeddedUIFS() fs.FS { return nil }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket compression: with WS_COMPRESSION on (the default) the upgrader
+// negotiates permessage-deflate (without context takeover) with clients
+// that offer it, at WS_COMPRESSION_LEVEL (1, fastest, to 9; default 1).
+// Large JSON frames (the state frame, scans) shrink several times over;
+// small ones can grow a little, as each message is compressed on its own. A
+// /ws client can opt out with ?compress=off. evabot_ws_payload_bytes_total
+// and evabot_ws_wire_bytes_total, by whether the connection compresses,
+// give the ratio.
+
+// wsCompressed reports whether the upgrader will compress for req, as it
+// decides: the client offered permessage-deflate.
+func wsCompressed(req *http.Request) bool {
+	if !upgrader.EnableCompression {
+		return false
+	}
+	for _, h := range req.Header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(h, ",") {
+			if name, _, _ := strings.Cut(strings.TrimSpace(ext), ";"); strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgrade upgrades a /ws request, counting what goes on the wire under
+// label (see wsCompressed).
+func (h *hub) upgrade(w http.ResponseWriter, req *http.Request, label string) (*websocket.Conn, error) {
+	return upgrader.Upgrade(&wireCounter{ResponseWriter: w, h: h, label: label}, req, nil)
+}
+
+// wireCounter hands the upgrader a connection that counts the bytes
+// written to it, after compression and framing.
+type wireCounter struct {
+	http.ResponseWriter
+	h     *hub
+	label string
+}
+
+func (wc *wireCounter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(wc.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countingConn{Conn: conn, h: wc.h, label: wc.label}, brw, nil
+}
+
+type countingConn struct {
+	net.Conn
+	h     *hub
+	label string
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.h.wireBytes.Add(float64(n), c.label)
+	return n, err
+}
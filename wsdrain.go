@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+)
+
+// wsDrainHint is the reason text of the close frame (1012, service restart)
+// /ws clients get when the instance drains: reconnect after ReconnectAfterMs,
+// passing Resume as ?resume= to be replayed what was published since.
+type wsDrainHint struct {
+	ReconnectAfterMs int64  `json:"reconnect_after_ms"`
+	Resume           uint64 `json:"resume,omitempty"` // TELEMETRY stream sequence
+}
+
+// drain closes every /ws connection with a reconnect hint and refuses new
+// ones the same way, for rolling deploys. The resume sequence is taken
+// before fan-out stops, so a resumed client may see a few messages twice but
+// misses none. It returns the sequence and how many clients were told.
+func (h *hub) drain() (uint64, int) {
+	n := 0
+	h.drainOnce.Do(func() {
+		if info, err := h.js.StreamInfo("TELEMETRY"); err == nil {
+			h.resume = info.State.LastSeq + 1
+		}
+		h.mu.Lock()
+		for _, t := range h.topics {
+			t.sub.Unsubscribe()
+			n += len(t.clients)
+		}
+		close(h.drained)
+		h.mu.Unlock()
+	})
+	return h.resume, n
+}
+
+// draining reports whether drain has been called.
+func (h *hub) draining() bool {
+	select {
+	case <-h.drained:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait blocks until every /ws handler has returned, or for at most d.
+func (h *hub) wait(d time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		h.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(d):
+	}
+}
+
+// closeDrained tells c to reconnect elsewhere. Clients are spread over
+// [reconnectAfter, 2×reconnectAfter) so they don't all land at once; resume 0
+// (viewers, whose feed is delayed) leaves the token out. closed is as for
+// closeWith.
+func (h *hub) closeDrained(c *websocket.Conn, closed <-chan struct{}, resume uint64) {
+	after := h.reconnectAfter
+	if after > 0 {
+		after += time.Duration(rand.Int63n(int64(after)))
+	}
+	reason, _ := json.Marshal(wsDrainHint{ReconnectAfterMs: after.Milliseconds(), Resume: resume})
+	h.closeWith(c, closed, websocket.CloseServiceRestart, string(reason))
+}
+
+// replay writes what subject got on TELEMETRY from start on, until it has
+// caught up.
+func (h *hub) replay(ctx context.Context, subject string, start nats.SubOpt, scope *scopeFilter, write func(*nats.Msg) error) error {
+	sub, err := h.js.SubscribeSync(subject, nats.OrderedConsumer(), start)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	for {
+		wait, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		m, err := sub.NextMsgWithContext(wait)
+		cancel()
+		if err != nil {
+			return nil // caught up (nothing after seq) or the client left
+		}
+		if scope == nil || scope.allows(m.Subject) {
+			if err := write(m); err != nil {
+				return err
+			}
+		}
+		if md, err := m.Metadata(); err != nil || md.NumPending == 0 {
+			return nil
+		}
+	}
+}
+
+// POST /api/admin/drain closes every /ws connection with a reconnect hint and
+// turns /healthz to 503 so the load balancer stops sending clients here. The
+// same happens on SIGTERM before the server stops.
+func (h *hub) handleDrain(w http.ResponseWriter, _ *http.Request) {
+	resume, n := h.drain()
+	writeJSON(w, map[string]interface{}{"connections": n, "resume": resume})
+}
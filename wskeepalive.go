@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsMaxInbound bounds a frame from a /ws client, which sends nothing but
+// control frames.
+const wsMaxInbound = 4096
+
+// wsCloseWait is how long a close frame we sent waits for the client's.
+const wsCloseWait = 2 * time.Second
+
+// /ws clients send nothing, so a half-open connection (a laptop lid shut,
+// a NAT entry expired) would otherwise linger until a write to it failed,
+// which on a quiet subject may be never. The hub pings every WS_PING_EVERY
+// (default 30s) and gives up on a client that hasn't answered, or sent
+// anything, for WS_PONG_WAIT (default 60s); a write taking longer than
+// WS_WRITE_WAIT (default 10s) ends the connection as well. Zero
+// WS_PING_EVERY turns pings and the read deadline off.
+
+// watchPeer reads c until the client closes it, goes away or goes quiet
+// for pongWait, and closes the returned channel then. A client's close
+// frame is answered with its code.
+func (h *hub) watchPeer(c *websocket.Conn) <-chan struct{} {
+	closed := make(chan struct{})
+	c.SetReadLimit(wsMaxInbound)
+	alive := func() {
+		if h.pingEvery > 0 {
+			c.SetReadDeadline(time.Now().Add(h.pongWait))
+		}
+	}
+	alive()
+	c.SetPongHandler(func(string) error {
+		alive()
+		return nil
+	})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := c.NextReader(); err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					h.dead.Inc()
+				}
+				return
+			}
+			alive()
+		}
+	}()
+	return closed
+}
+
+// pinger returns a channel ticking when c should be pinged, nil with pings
+// off, and a func to stop it.
+func (h *hub) pinger() (<-chan time.Time, func()) {
+	if h.pingEvery <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(h.pingEvery)
+	return t.C, t.Stop
+}
+
+func (h *hub) ping(c *websocket.Conn) error {
+	return c.WriteControl(websocket.PingMessage, nil, time.Now().Add(h.writeWait))
+}
+
+// frame writes one data frame within writeWait.
+func (h *hub) frame(c *websocket.Conn, typ int, data []byte) error {
+	c.SetWriteDeadline(time.Now().Add(h.writeWait))
+	return c.WriteMessage(typ, data)
+}
+
+// closeWith sends a close frame and, when the client is being read
+// (closed, from watchPeer, isn't nil), waits a little for its reply, so the
+// close handshake completes before the connection is dropped.
+func (h *hub) closeWith(c *websocket.Conn, closed <-chan struct{}, code int, text string) {
+	if err := c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(h.writeWait)); err != nil || closed == nil {
+		return
+	}
+	select {
+	case <-closed:
+	case <-time.After(wsCloseWait):
+	}
+}
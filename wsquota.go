@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+// Close codes for refused WebSocket connections (application range
+// 4000-4999); the reason text names the limit.
+const (
+	closeTooManyConns    = 4429
+	closeTooManySubjects = 4430
+)
+
+// wsQuotas bounds WebSocket use, so a wall of forgotten browser tabs can't
+// exhaust the server: at most total connections overall, and per caller
+// (authenticated user, else address; see queryUser) at most perUser
+// connections over at most subjects distinct subjects. A refused connection is
+// accepted and closed at once with closeTooManyConns or closeTooManySubjects,
+// since browsers don't show why a handshake failed.
+type wsQuotas struct {
+	total    int
+	perUser  int
+	subjects int
+
+	mu    sync.Mutex
+	conns int
+	users map[string]*wsUsage
+}
+
+type wsUsage struct {
+	conns    int
+	subjects map[string]int // subject → connections on it
+}
+
+func newWSQuotas(total, perUser, subjects int) *wsQuotas {
+	return &wsQuotas{total: total, perUser: perUser, subjects: subjects, users: map[string]*wsUsage{}}
+}
+
+// acquire reserves a connection on subject for user; a zero code means
+// granted.
+func (q *wsQuotas) acquire(user, subject string) (int, string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.users[user]
+	if u == nil {
+		u = &wsUsage{subjects: map[string]int{}}
+	}
+	switch {
+	case q.total > 0 && q.conns >= q.total:
+		return closeTooManyConns, fmt.Sprintf("server at its %d WebSocket connections", q.total)
+	case q.perUser > 0 && u.conns >= q.perUser:
+		return closeTooManyConns, fmt.Sprintf("%s has %d WebSocket connections open (limit %d)", user, u.conns, q.perUser)
+	case q.subjects > 0 && u.subjects[subject] == 0 && len(u.subjects) >= q.subjects:
+		return closeTooManySubjects, fmt.Sprintf("%s is subscribed to %d subjects (limit %d)", user, len(u.subjects), q.subjects)
+	}
+	q.users[user] = u
+	q.conns++
+	u.conns++
+	u.subjects[subject]++
+	return 0, ""
+}
+
+func (q *wsQuotas) release(user, subject string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.users[user]
+	if u == nil {
+		return
+	}
+	q.conns--
+	u.conns--
+	if u.subjects[subject]--; u.subjects[subject] <= 0 {
+		delete(u.subjects, subject)
+	}
+	if u.conns <= 0 {
+		delete(q.users, user)
+	}
+}
+
+// limit wraps a WebSocket endpoint; subjectOf names what a request
+// subscribes to.
+func (q *wsQuotas) limit(subjectOf func(*http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		user, subject := queryUser(req), subjectOf(req)
+		if code, reason := q.acquire(user, subject); code != 0 {
+			c, err := upgrader.Upgrade(w, req, nil)
+			if err != nil {
+				return
+			}
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+			c.Close()
+			return
+		}
+		defer q.release(user, subject)
+		next(w, req)
+	}
+}
+
+// telemetrySubject is what GET /ws?robot= subscribes to.
+func telemetrySubject(req *http.Request) string {
+	if id := req.URL.Query().Get("robot"); id != "" {
+		return "telemetry." + id + ".>"
+	}
+	return "telemetry.>"
+}
+
+// ctrlSubject is what GET /ws/ctrl/{id} publishes to.
+func ctrlSubject(req *http.Request) string {
+	return "ctrl." + chi.URLParam(req, "id") + ".>"
+}
+
+type wsUserStats struct {
+	User        string   `json:"user"`
+	Connections int      `json:"connections"`
+	Subjects    []string `json:"subjects"`
+}
+
+// GET /api/ws/quotas shows the limits and each caller's usage.
+func (q *wsQuotas) handleStats(w http.ResponseWriter, _ *http.Request) {
+	q.mu.Lock()
+	users := make([]wsUserStats, 0, len(q.users))
+	for name, u := range q.users {
+		s := wsUserStats{User: name, Connections: u.conns, Subjects: make([]string, 0, len(u.subjects))}
+		for subject := range u.subjects {
+			s.Subjects = append(s.Subjects, subject)
+		}
+		sort.Strings(s.Subjects)
+		users = append(users, s)
+	}
+	conns := q.conns
+	q.mu.Unlock()
+	sort.Slice(users, func(i, j int) bool { return users[i].Connections > users[j].Connections })
+	writeJSON(w, map[string]interface{}{"connections": conns, "max_connections": q.total,
+		"max_per_user": q.perUser, "max_subjects_per_user": q.subjects, "users": users})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// wsThrottle rate-limits a /ws connection per subject: at most one message
+// per every, the latest winning. A message is sent at once when its subject
+// has been quiet for every, else it waits, replacing any message already
+// waiting on that subject, until the window has passed.
+type wsThrottle struct {
+	every   time.Duration
+	last    map[string]time.Time
+	pending map[string]*nats.Msg
+}
+
+func newWSThrottle(every time.Duration) *wsThrottle {
+	return &wsThrottle{every: every, last: map[string]time.Time{}, pending: map[string]*nats.Msg{}}
+}
+
+// tick is how often due should be called: often enough that a waiting
+// message is late by a small part of the window.
+func (t *wsThrottle) tick() time.Duration {
+	d := t.every / 4
+	if d < 5*time.Millisecond {
+		d = 5 * time.Millisecond
+	}
+	if d > 250*time.Millisecond {
+		d = 250 * time.Millisecond
+	}
+	return d
+}
+
+// offer takes m, received at now, returning it if it may be sent now; nil
+// means it waits for due (or is replaced by a later one).
+func (t *wsThrottle) offer(m *nats.Msg, now time.Time) *nats.Msg {
+	if _, waiting := t.pending[m.Subject]; !waiting && now.Sub(t.last[m.Subject]) >= t.every {
+		t.last[m.Subject] = now
+		return m
+	}
+	t.pending[m.Subject] = m
+	return nil
+}
+
+// due returns the waiting messages whose window has passed, by subject.
+func (t *wsThrottle) due(now time.Time) []*nats.Msg {
+	var out []*nats.Msg
+	for subject, m := range t.pending {
+		if now.Sub(t.last[subject]) >= t.every {
+			out = append(out, m)
+			t.last[subject] = now
+			delete(t.pending, subject)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Subject < out[j].Subject })
+	return out
+}
+
+// throttleOf reads a /ws connection's ?max_hz= (messages per second per
+// subject, up to 1000) or ?every= (a duration, 1ms to 1m); zero for neither.
+func throttleOf(req *http.Request) (time.Duration, error) {
+	hz, every := req.URL.Query().Get("max_hz"), req.URL.Query().Get("every")
+	switch {
+	case hz != "" && every != "":
+		return 0, errors.New("'max_hz' and 'every' exclude each other")
+	case hz != "":
+		f, err := strconv.ParseFloat(hz, 64)
+		if err != nil || f <= 0 || f > 1000 {
+			return 0, errors.New("bad 'max_hz' (above 0, up to 1000)")
+		}
+		return time.Duration(float64(time.Second) / f), nil
+	case every != "":
+		d, err := time.ParseDuration(every)
+		if err != nil || d < time.Millisecond || d > time.Minute {
+			return 0, errors.New("bad 'every' (1ms to 1m)")
+		}
+		return d, nil
+	}
+	return 0, nil
+}